@@ -7,14 +7,16 @@ toolchain go1.24.11
 require (
 	github.com/fsnotify/fsnotify v1.9.0
 	github.com/mevdschee/tqtemplate v1.1.0
+	github.com/prometheus/client_golang v1.23.2
+	github.com/tetratelabs/wazero v1.9.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
 	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
-	github.com/prometheus/client_golang v1.23.2 // indirect
 	github.com/prometheus/client_model v0.6.2 // indirect
 	github.com/prometheus/common v0.66.1 // indirect
 	github.com/prometheus/procfs v0.16.1 // indirect
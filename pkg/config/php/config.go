@@ -22,6 +22,15 @@ type Config struct {
 	// Settings are individual PHP configuration directives injected as env entries
 	// into the generated php-fpm pool (e.g. PHP_VALUE, env[] entries).
 	Settings map[string]string
+
+	// Preload is a script run at startup to preload code into the opcache
+	// (opcache.preload). It is passed to php-fpm with -d as preloading is
+	// not possible from pool configuration.
+	Preload string
+
+	// PreloadUser is the user preloading runs as when php-fpm runs as root
+	// (opcache.preload_user).
+	PreloadUser string
 }
 
 // PHPFPMConfig controls how php-fpm is launched and configured.
@@ -78,6 +87,14 @@ type PoolConfig struct {
 
 	// ProcessIdleTimeout maps to process_idle_timeout (ondemand) (e.g. "10s").
 	ProcessIdleTimeout time.Duration
+
+	// RequestSlowlogTimeout maps to request_slowlog_timeout, requests running
+	// longer get a backtrace in the slowlog. Zero disables the slowlog.
+	RequestSlowlogTimeout time.Duration
+
+	// Slowlog maps to slowlog, the file slow request traces are written to.
+	// Defaults to php-fpm.slow.log in the generated config directory.
+	Slowlog string
 }
 
 // Validate checks if the configuration is valid for php-fpm generation and launch.
@@ -137,6 +154,10 @@ func (p *PoolConfig) Validate() error {
 		p.ProcessIdleTimeout = 10 * time.Second
 	}
 
+	if p.RequestSlowlogTimeout < 0 {
+		p.RequestSlowlogTimeout = 0
+	}
+
 	return nil
 }
 
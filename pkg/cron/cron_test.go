@@ -0,0 +1,67 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	from := time.Date(2026, 10, 17, 10, 30, 15, 0, time.UTC) // A Saturday
+	for _, tt := range []struct {
+		expr string
+		want string
+	}{
+		{"0 4 * * *", "2026-10-18 04:00"},
+		{"@daily", "2026-10-18 00:00"},
+		{"@hourly", "2026-10-17 11:00"},
+		{"*/15 * * * *", "2026-10-17 10:45"},
+		{"31 10 * * *", "2026-10-17 10:31"},
+		{"30 10 * * *", "2026-10-18 10:30"},
+		{"0 3 * * mon-fri", "2026-10-19 03:00"},
+		{"0 3 * * 7", "2026-10-18 03:00"},
+		{"0 0 1 jan *", "2027-01-01 00:00"},
+		{"0 0 29 2 *", "2028-02-29 00:00"},
+		{"0 2 1,15 * *", "2026-11-01 02:00"},
+		{"0 2 13 * 5", "2026-10-23 02:00"}, // The 13th or a Friday
+		{"5-10/5 22 * * *", "2026-10-17 22:05"},
+	} {
+		s, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := s.Next(from).Format("2006-01-02 15:04"); got != tt.want {
+			t.Errorf("Next(%q) = %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestNextNever(t *testing.T) {
+	s, err := Parse("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := s.Next(time.Now()); !next.IsZero() {
+		t.Errorf("Next = %s, want never", next)
+	}
+}
+
+func TestNextHalfHourZone(t *testing.T) {
+	zone := time.FixedZone("IST", 5*3600+1800)
+	s, err := Parse("0 4 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 10, 17, 3, 40, 0, 0, zone)
+	if got := s.Next(from); !got.Equal(time.Date(2026, 10, 17, 4, 0, 0, 0, zone)) {
+		t.Errorf("Next = %s", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "x * * * *"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded", expr)
+		}
+	}
+}
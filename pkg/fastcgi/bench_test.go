@@ -0,0 +1,143 @@
+package fastcgi
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// discardConn is a net.Conn that drops writes and replays a fixed input
+type discardConn struct {
+	net.Conn
+	input  []byte
+	reader *bytes.Reader
+}
+
+func (c *discardConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func (c *discardConn) Read(p []byte) (int, error) {
+	if c.reader.Len() == 0 {
+		c.reader.Reset(c.input)
+	}
+	return c.reader.Read(p)
+}
+
+func (c *discardConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *discardConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *discardConn) Close() error                     { return nil }
+
+func newDiscardConn(input []byte) *discardConn {
+	return &discardConn{input: input, reader: bytes.NewReader(input)}
+}
+
+var benchParams = map[string]string{
+	"SCRIPT_FILENAME": "/var/www/index.php",
+	"REQUEST_METHOD":  "POST",
+	"REQUEST_URI":     "/index.php?page=1",
+	"QUERY_STRING":    "page=1",
+	"CONTENT_TYPE":    "application/x-www-form-urlencoded",
+	"CONTENT_LENGTH":  "1024",
+	"HTTP_USER_AGENT": strings.Repeat("x", 200),
+}
+
+func BenchmarkRecordEncode(b *testing.B) {
+	record := NewRecord(TypeStdout, 1, make([]byte, 4096))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		record.Encode()
+	}
+}
+
+func BenchmarkRecordAppendTo(b *testing.B) {
+	record := NewRecord(TypeStdout, 1, make([]byte, 4096))
+	buf := make([]byte, 0, 8192)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = record.AppendTo(buf[:0])
+	}
+}
+
+func BenchmarkSendStdout(b *testing.B) {
+	for _, size := range []int{512, 64 * 1024, 1024 * 1024} {
+		b.Run(byteSize(size), func(b *testing.B) {
+			conn := NewConn(newDiscardConn(nil), time.Second, time.Second)
+			data := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := conn.SendStdout(1, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSendRequest(b *testing.B) {
+	conn := NewConn(newDiscardConn(nil), time.Second, time.Second)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := conn.SendRequest(1, RoleResponder, true, benchParams); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadRequest(b *testing.B) {
+	// Encode one complete request, the connection replays it forever
+	var input bytes.Buffer
+	writer := NewConn(&writeConn{discardConn: newDiscardConn(nil), w: &input}, 0, 0)
+	writer.SendRequest(1, RoleResponder, true, benchParams)
+	writer.SendStdin(1, make([]byte, 1024))
+	writer.SendStdin(1, nil)
+
+	conn := NewConn(newDiscardConn(input.Bytes()), 0, 0)
+	b.SetBytes(int64(input.Len()))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.ReadRequest(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkClientRoundTrip(b *testing.B) {
+	srv := &Server{Handler: HandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+		return conn.SendResponse(req.RequestID, []byte("Content-Type: text/plain\r\n\r\nhello"), nil, 0)
+	})}
+	addr := startServer(b, srv)
+
+	client := NewClient(addr, "tcp", 4, time.Second, 5*time.Second)
+	defer client.Close()
+
+	body := make([]byte, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Do(context.Background(), benchParams, bytes.NewReader(body)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// writeConn is a discardConn that records writes
+type writeConn struct {
+	*discardConn
+	w *bytes.Buffer
+}
+
+func (c *writeConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+func byteSize(n int) string {
+	switch {
+	case n >= 1024*1024:
+		return strconv.Itoa(n/(1024*1024)) + "MB"
+	case n >= 1024:
+		return strconv.Itoa(n/1024) + "KB"
+	}
+	return strconv.Itoa(n) + "B"
+}
@@ -0,0 +1,126 @@
+package fastcgi
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+// inlineContentSize is the largest record content copied into the batch
+// buffer, larger content is written from the caller's slice without copying
+const inlineContentSize = 1024
+
+// zeroPadding is the source of record padding bytes
+var zeroPadding [8]byte
+
+// bufPool holds scratch buffers for encoding records and reading stdin
+var bufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 32*1024)
+		return &buf
+	},
+}
+
+func getBuffer() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+func putBuffer(buf *[]byte) {
+	// Don't keep buffers that grew for an unusually large write
+	if cap(*buf) > 256*1024 {
+		return
+	}
+	*buf = (*buf)[:0]
+	bufPool.Put(buf)
+}
+
+// writeBatch collects records for a single vectored write. Headers, padding
+// and small content are encoded into a pooled buffer, large content is
+// referenced in place, so a stream of any size goes out in one writev call
+// on TCP and unix connections.
+type writeBatch struct {
+	buf   *[]byte
+	bufs  net.Buffers
+	start int // start of the part of buf not yet added to bufs
+}
+
+var batchPool = sync.Pool{
+	New: func() any {
+		return &writeBatch{bufs: make(net.Buffers, 0, 8)}
+	},
+}
+
+func newWriteBatch() *writeBatch {
+	b := batchPool.Get().(*writeBatch)
+	b.buf = getBuffer()
+	return b
+}
+
+// add appends a single record, content must fit in one record
+func (b *writeBatch) add(recordType uint8, requestID uint16, content []byte) {
+	contentLen := len(content)
+	paddingLen := (8 - (contentLen % 8)) % 8
+
+	buf := appendHeader(*b.buf, recordType, requestID, contentLen, paddingLen)
+	if contentLen <= inlineContentSize {
+		buf = append(buf, content...)
+	} else {
+		// Flush the encoded bytes so far and reference the content directly
+		b.bufs = append(b.bufs, buf[b.start:], content)
+		b.start = len(buf)
+	}
+	buf = append(buf, zeroPadding[:paddingLen]...)
+	*b.buf = buf
+}
+
+// addStream appends data split into records of at most MaxContentLength,
+// followed by the empty record that ends the stream when end is set
+func (b *writeBatch) addStream(recordType uint8, requestID uint16, data []byte, end bool) {
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > MaxContentLength {
+			chunk = chunk[:MaxContentLength]
+		}
+		b.add(recordType, requestID, chunk)
+		data = data[len(chunk):]
+	}
+	if end {
+		b.add(recordType, requestID, nil)
+	}
+}
+
+// writeTo writes all records in the batch to w
+func (b *writeBatch) writeTo(w io.Writer) error {
+	buf := *b.buf
+	if len(b.bufs) == 0 {
+		_, err := w.Write(buf)
+		return err
+	}
+	if b.start < len(buf) {
+		b.bufs = append(b.bufs, buf[b.start:])
+	}
+	// WriteTo consumes the slice it is called on, keep b.bufs for release
+	bufs := b.bufs
+	_, err := bufs.WriteTo(w)
+	return err
+}
+
+// release returns the batch and its buffer to their pools
+func (b *writeBatch) release() {
+	putBuffer(b.buf)
+	b.buf = nil
+	clear(b.bufs[:cap(b.bufs)])
+	b.bufs = b.bufs[:0]
+	b.start = 0
+	batchPool.Put(b)
+}
+
+// appendHeader appends an encoded record header to dst
+func appendHeader(dst []byte, recordType uint8, requestID uint16, contentLen, paddingLen int) []byte {
+	dst = append(dst, Version1, recordType, 0, 0, 0, 0, uint8(paddingLen), 0)
+	h := dst[len(dst)-HeaderSize:]
+	binary.BigEndian.PutUint16(h[2:4], requestID)
+	binary.BigEndian.PutUint16(h[4:6], uint16(contentLen))
+	return dst
+}
@@ -0,0 +1,71 @@
+package fastcgi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// ParseCGIResponse splits CGI output (headers, blank line, body) into the
+// status from the Status header, the remaining headers and the body.
+// Repeated headers such as Set-Cookie keep all their values and folded
+// continuation lines are joined. Without a Status header the status is 200,
+// or 302 when a Location header is present. Output that does not start with
+// a header section is returned as a 200 body.
+func ParseCGIResponse(data []byte) (int, http.Header, []byte, error) {
+	end := headerEnd(data)
+	if end < 0 {
+		// No header section, all output is body
+		return http.StatusOK, http.Header{}, data, nil
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data[:end])))
+	mimeHeader, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("parse cgi headers: %w", err)
+	}
+	headers := http.Header(mimeHeader)
+
+	status := http.StatusOK
+	if value := headers.Get("Status"); value != "" {
+		code, _, _ := strings.Cut(strings.TrimSpace(value), " ")
+		status, err = strconv.Atoi(code)
+		if err != nil || status < 100 || status > 999 {
+			return 0, nil, nil, fmt.Errorf("invalid cgi status %q", value)
+		}
+		headers.Del("Status")
+	} else if headers.Get("Location") != "" {
+		status = http.StatusFound
+	}
+
+	return status, headers, data[end:], nil
+}
+
+// headerEnd returns the offset of the body, just past the first empty line
+// ending in "\n" or "\r\n". It returns -1 when there is no empty line or the
+// first line is not a header, so the output has no header section.
+func headerEnd(data []byte) int {
+	pos := 0
+	for pos < len(data) {
+		eol := bytes.IndexByte(data[pos:], '\n')
+		if eol < 0 {
+			return -1
+		}
+		line := bytes.TrimSuffix(data[pos:pos+eol], []byte("\r"))
+		if len(line) == 0 {
+			if pos == 0 {
+				return -1
+			}
+			return pos + eol + 1
+		}
+		if pos == 0 && bytes.IndexByte(line, ':') <= 0 {
+			return -1
+		}
+		pos += eol + 1
+	}
+	return -1
+}
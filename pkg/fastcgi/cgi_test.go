@@ -0,0 +1,110 @@
+package fastcgi
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseCGIResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		status  int
+		headers http.Header
+		body    string
+	}{
+		{
+			name:    "StatusHeader",
+			data:    "Status: 404 Not Found\r\nContent-Type: text/plain\r\n\r\nmissing",
+			status:  404,
+			headers: http.Header{"Content-Type": {"text/plain"}},
+			body:    "missing",
+		},
+		{
+			name:    "StatusWithoutReason",
+			data:    "Status: 204\r\n\r\n",
+			status:  204,
+			headers: http.Header{},
+		},
+		{
+			name:    "DefaultStatus",
+			data:    "Content-Type: text/html\n\n<p>hi</p>",
+			status:  200,
+			headers: http.Header{"Content-Type": {"text/html"}},
+			body:    "<p>hi</p>",
+		},
+		{
+			name:    "Location",
+			data:    "Location: /login\r\n\r\n",
+			status:  302,
+			headers: http.Header{"Location": {"/login"}},
+		},
+		{
+			name:   "SetCookieMultiplicity",
+			data:   "Set-Cookie: a=1\r\nSet-Cookie: b=2\r\nset-cookie: c=3\r\n\r\n",
+			status: 200,
+			headers: http.Header{
+				"Set-Cookie": {"a=1", "b=2", "c=3"},
+			},
+		},
+		{
+			name:    "FoldedHeader",
+			data:    "X-Long: first\r\n  second\r\n\r\nbody",
+			status:  200,
+			headers: http.Header{"X-Long": {"first second"}},
+			body:    "body",
+		},
+		{
+			name:    "BodyContainsSeparator",
+			data:    "Content-Type: text/plain\n\nline\r\n\r\nmore",
+			status:  200,
+			headers: http.Header{"Content-Type": {"text/plain"}},
+			body:    "line\r\n\r\nmore",
+		},
+		{
+			name:    "NoHeaders",
+			data:    "just output",
+			status:  200,
+			headers: http.Header{},
+			body:    "just output",
+		},
+		{
+			name:    "NoHeaderSection",
+			data:    "<html>\n\n</html>",
+			status:  200,
+			headers: http.Header{},
+			body:    "<html>\n\n</html>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, headers, body, err := ParseCGIResponse([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("ParseCGIResponse: %v", err)
+			}
+			if status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+			if !reflect.DeepEqual(headers, tt.headers) {
+				t.Errorf("headers = %v, want %v", headers, tt.headers)
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestParseCGIResponseInvalid(t *testing.T) {
+	for _, data := range []string{
+		"Status: abc\r\n\r\n",
+		"Status: 42\r\n\r\n",
+		"Content-Type: text/plain\r\nnot a header\r\n\r\n",
+	} {
+		if _, _, _, err := ParseCGIResponse([]byte(data)); err == nil {
+			t.Errorf("ParseCGIResponse(%q) succeeded, want error", data)
+		}
+	}
+}
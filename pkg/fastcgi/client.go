@@ -0,0 +1,380 @@
+package fastcgi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// abortGracePeriod is how long an aborted request may take to end before its
+// connection is closed
+const abortGracePeriod = 1 * time.Second
+
+// Client is a pooled FastCGI client, used for php-fpm. Pooled connections are
+// kept alive (FCGI_KEEP_CONN) and reused. With multiplexing enabled,
+// concurrent requests share connections using distinct request IDs.
+type Client struct {
+	// OnStderr, when set, receives the stderr output of each request
+	OnStderr func(stderr []byte)
+
+	addr        string
+	transport   string // "tcp" or "unix"
+	pool        chan net.Conn
+	dialTimeout time.Duration
+	rwTimeout   time.Duration
+	multiplex   int // max concurrent requests per connection, 0 disables multiplexing
+	muxConns    []*MuxConn
+	mu          sync.Mutex
+}
+
+// NewClient constructs a new Client. poolSize==0 disables pooling.
+func NewClient(listen, transport string, poolSize int, dialTimeout, rwTimeout time.Duration) *Client {
+	var pool chan net.Conn
+	if poolSize > 0 {
+		pool = make(chan net.Conn, poolSize)
+	}
+	if transport == "" {
+		if strings.Contains(listen, "/") {
+			transport = "unix"
+		} else {
+			transport = "tcp"
+		}
+	}
+	return &Client{
+		addr:        listen,
+		transport:   transport,
+		pool:        pool,
+		dialTimeout: dialTimeout,
+		rwTimeout:   rwTimeout,
+	}
+}
+
+// Address returns the address the client connects to
+func (c *Client) Address() string {
+	return c.addr
+}
+
+// Transport returns the network used to connect, "tcp" or "unix"
+func (c *Client) Transport() string {
+	return c.transport
+}
+
+// SetMultiplex enables multiplexing of up to maxRequests concurrent requests
+// per connection. The number of connections is bounded by the pool size.
+// Only enable this for FastCGI applications that support it, php-fpm does not.
+func (c *Client) SetMultiplex(maxRequests int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.multiplex = maxRequests
+}
+
+// DoRequest sends a Responder request with params, streaming body as stdin,
+// and parses the CGI response into status, headers and body. The caller sets
+// CONTENT_LENGTH in params. When ctx is canceled (e.g. the HTTP client went
+// away) an FCGI_ABORT_REQUEST is sent and ctx.Err() is returned. Output on
+// stderr is passed to OnStderr.
+func (c *Client) DoRequest(ctx context.Context, params map[string]string, body io.Reader) (status int, headers http.Header, respBody io.Reader, err error) {
+	resp, err := c.Do(ctx, params, body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if len(resp.Stderr) > 0 && c.OnStderr != nil {
+		c.OnStderr(resp.Stderr)
+	}
+	status, headers, content, err := ParseCGIResponse(resp.Stdout)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return status, headers, bytes.NewReader(content), nil
+}
+
+// Do sends a Responder request and returns the raw stdout and stderr streams
+// and the application status.
+func (c *Client) Do(ctx context.Context, params map[string]string, stdin io.Reader) (*Response, error) {
+	c.mu.Lock()
+	multiplex := c.multiplex
+	c.mu.Unlock()
+	if multiplex > 0 {
+		return c.doMultiplexed(ctx, params, stdin)
+	}
+
+	conn, reused, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	counted := &countingReader{r: stdin}
+	resp, err := c.doOnConn(ctx, conn, params, counted)
+	if err != nil && ctx.Err() == nil && reused && len(resp.Stdout) == 0 && counted.n == 0 {
+		// A pooled connection may have been closed by the application while
+		// idle (e.g. php-fpm after pm.max_requests), retry once on a fresh
+		// connection. Only possible while none of the body has been consumed.
+		conn, err = c.dial()
+		if err != nil {
+			return nil, fmt.Errorf("dial %s %s: %w", c.transport, c.addr, err)
+		}
+		resp, err = c.doOnConn(ctx, conn, params, counted)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	if cr.r == nil {
+		return 0, io.EOF
+	}
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// GetValues queries the application for management variables such as
+// ValueMaxConns on a dedicated short-lived connection.
+func (c *Client) GetValues(names ...string) (map[string]string, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, fmt.Errorf("dial %s %s: %w", c.transport, c.addr, err)
+	}
+	defer conn.Close()
+
+	fcgi := NewConn(conn, c.dialTimeout, c.dialTimeout)
+	return fcgi.GetValues(names...)
+}
+
+// doOnConn performs a single request on conn, returning it to the pool on
+// success. The returned response is never nil, it holds any partial output.
+func (c *Client) doOnConn(ctx context.Context, conn net.Conn, params map[string]string, stdin io.Reader) (*Response, error) {
+	resp := &Response{}
+
+	// Wrap in Conn
+	fcgi := NewConn(conn, c.rwTimeout, c.rwTimeout)
+	// One request at a time per connection, so requestID=1 is always free
+	var reqID uint16 = 1
+	// Ask the application to keep the connection open when we can reuse it
+	keepConn := c.pool != nil
+
+	// On cancellation ask the application to abort, and give it a moment to
+	// end the request before the connection is closed to unblock the read below
+	stop := context.AfterFunc(ctx, func() {
+		fcgi.SendAbortRequest(reqID)
+		time.AfterFunc(abortGracePeriod, func() { conn.Close() })
+	})
+	defer stop()
+
+	if err := fcgi.SendRequest(reqID, RoleResponder, keepConn, params); err != nil {
+		c.closeConn(conn)
+		return resp, fmt.Errorf("SendRequest: %w", err)
+	}
+
+	if _, err := fcgi.SendStdinFrom(reqID, stdin); err != nil {
+		c.closeConn(conn)
+		return resp, fmt.Errorf("SendStdin: %w", err)
+	}
+
+	// Read response
+	for {
+		rec, rerr := fcgi.nextRecord()
+		if rerr != nil && ctx.Err() != nil {
+			c.closeConn(conn)
+			return resp, ctx.Err()
+		}
+		if rerr != nil {
+			if rerr == io.EOF || rerr == ErrConnClosed {
+				// connection closed unexpectedly
+				c.closeConn(conn)
+				return resp, fmt.Errorf("connection closed: %w", rerr)
+			}
+			c.closeConn(conn)
+			return resp, fmt.Errorf("read record: %w", rerr)
+		}
+
+		switch rec.Header.Type {
+		case TypeStdout:
+			resp.Stdout = append(resp.Stdout, rec.Content...)
+		case TypeStderr:
+			resp.Stderr = append(resp.Stderr, rec.Content...)
+		case TypeEndRequest:
+			body, derr := DecodeEndRequestBody(rec.Content)
+			if derr != nil {
+				// unable to decode, return an error
+				c.closeConn(conn)
+				return resp, fmt.Errorf("decode end request: %w", derr)
+			}
+			resp.AppStatus = body.AppStatus
+			resp.ProtocolStatus = body.ProtocolStatus
+			if !stop() {
+				// Aborted, the connection is closed shortly, don't reuse it
+				return resp, ctx.Err()
+			}
+			// finished
+			// Return connection to pool if pooling enabled
+			c.putConn(conn)
+			return resp, nil
+		}
+	}
+}
+
+// doMultiplexed sends the request over a shared multiplexed connection
+func (c *Client) doMultiplexed(ctx context.Context, params map[string]string, stdin io.Reader) (*Response, error) {
+	mux, err := c.getMuxConn()
+	if err != nil {
+		return nil, err
+	}
+	if c.rwTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.rwTimeout)
+		defer cancel()
+	}
+	resp, err := mux.Do(ctx, RoleResponder, params, stdin)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ProtocolStatus == uint8(StatusCantMultiplex) {
+		return resp, fmt.Errorf("application cannot multiplex connections")
+	}
+	return resp, nil
+}
+
+// getMuxConn returns the least loaded multiplexed connection, dialing a new
+// one while all are at capacity and the pool size allows it
+func (c *Client) getMuxConn() (*MuxConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Drop broken connections
+	alive := c.muxConns[:0]
+	for _, m := range c.muxConns {
+		if m.Err() == nil {
+			alive = append(alive, m)
+		}
+	}
+	c.muxConns = alive
+
+	var best *MuxConn
+	bestActive := 0
+	for _, m := range c.muxConns {
+		if active := m.Active(); best == nil || active < bestActive {
+			best, bestActive = m, active
+		}
+	}
+
+	maxConns := cap(c.pool)
+	if maxConns == 0 {
+		maxConns = 1
+	}
+	if best == nil || (bestActive >= c.multiplex && len(c.muxConns) < maxConns) {
+		conn, err := c.dial()
+		if err != nil {
+			if best != nil {
+				return best, nil
+			}
+			return nil, fmt.Errorf("dial %s %s: %w", c.transport, c.addr, err)
+		}
+		// No read timeout: the connection idles between requests
+		best = NewMuxConn(NewConn(conn, 0, c.rwTimeout))
+		c.muxConns = append(c.muxConns, best)
+	}
+	return best, nil
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	if c.transport == "unix" {
+		return net.DialTimeout("unix", c.addr, c.dialTimeout)
+	}
+	return net.DialTimeout("tcp", c.addr, c.dialTimeout)
+}
+
+// getConn returns a pooled connection, or dials a new one. reused reports
+// whether the connection came from the pool.
+func (c *Client) getConn() (conn net.Conn, reused bool, err error) {
+	// try pool first
+	for c.pool != nil {
+		select {
+		case conn := <-c.pool:
+			if connAlive(conn) {
+				return conn, true, nil
+			}
+			conn.Close()
+			continue
+		default:
+		}
+		break
+	}
+	// create new
+	conn, err = c.dial()
+	if err != nil {
+		return nil, false, fmt.Errorf("dial %s %s: %w", c.transport, c.addr, err)
+	}
+	return conn, false, nil
+}
+
+// connAlive reports whether an idle pooled connection is still open. A read
+// with an expired deadline times out on a live connection and returns EOF on
+// one the peer has closed.
+func connAlive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now())
+	var buf [1]byte
+	_, err := conn.Read(buf[:])
+	conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (c *Client) putConn(conn net.Conn) {
+	if c.pool == nil || conn == nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	select {
+	case c.pool <- conn:
+		// returned to pool
+	default:
+		// pool full, close
+		conn.Close()
+	}
+}
+
+func (c *Client) closeConn(conn net.Conn) {
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Close closes all pooled and multiplexed connections.
+func (c *Client) Close() {
+	c.mu.Lock()
+	for _, m := range c.muxConns {
+		m.Close()
+	}
+	c.muxConns = nil
+	c.mu.Unlock()
+
+	if c.pool == nil {
+		return
+	}
+	for {
+		select {
+		case conn := <-c.pool:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
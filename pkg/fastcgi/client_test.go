@@ -0,0 +1,220 @@
+package fastcgi
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startFakeFCGIServer starts a minimal FastCGI server that reads one request and
+// responds with a stdout payload and an end request record, then closes.
+func startFakeFCGIServer(t *testing.T) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fc := NewConn(conn, 5*time.Second, 5*time.Second)
+		// Read request
+		req, err := fc.ReadRequest()
+		if err != nil {
+			return
+		}
+
+		// Send a small CGI response
+		_ = fc.SendStdout(req.RequestID, []byte("Status: 201 Created\r\nX-Test: a\r\nX-Test: b\r\n\r\nhello from php-fpm"))
+		// Send empty stdout to terminate stream
+		_ = fc.SendStdout(req.RequestID, nil)
+		// Send end request
+		_ = fc.SendEndRequest(req.RequestID, 0, uint8(StatusRequestComplete))
+	}()
+
+	return ln.Addr().String(), func() {
+		ln.Close()
+		<-done
+	}
+}
+
+func TestClientDoRequest(t *testing.T) {
+	addr, stop := startFakeFCGIServer(t)
+	defer stop()
+
+	client := NewClient(addr, "tcp", 0, 2*time.Second, 2*time.Second)
+	defer client.Close()
+
+	params := map[string]string{"SCRIPT_FILENAME": "index.php"}
+	status, headers, body, err := client.DoRequest(context.Background(), params, nil)
+	if err != nil {
+		t.Fatalf("DoRequest error: %v", err)
+	}
+
+	if status != 201 {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	if got := headers.Values("X-Test"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("unexpected X-Test headers: %q", got)
+	}
+	if headers.Get("Status") != "" {
+		t.Fatalf("Status header not removed")
+	}
+	content, _ := io.ReadAll(body)
+	if string(content) != "hello from php-fpm" {
+		t.Fatalf("unexpected body: %q", string(content))
+	}
+}
+
+func TestClientPoolingReuse(t *testing.T) {
+	// start a fake server that keeps the connection open and handles two requests
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		fc := NewConn(conn, 5*time.Second, 5*time.Second)
+		// handle two requests sequentially
+		for i := 0; i < 2; i++ {
+			req, err := fc.ReadRequest()
+			if err != nil {
+				return
+			}
+			_ = fc.SendStdout(req.RequestID, []byte("ok"))
+			_ = fc.SendStdout(req.RequestID, nil)
+			_ = fc.SendEndRequest(req.RequestID, 0, uint8(StatusRequestComplete))
+		}
+		conn.Close()
+	}()
+
+	addr := ln.Addr().String()
+	client := NewClient(addr, "tcp", 1, 2*time.Second, 2*time.Second)
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Do(context.Background(), map[string]string{"SCRIPT_FILENAME": "index.php"}, nil)
+		if err != nil {
+			t.Fatalf("Do(%d) error: %v", i, err)
+		}
+		if resp.AppStatus != 0 {
+			t.Fatalf("unexpected appStatus: %d", resp.AppStatus)
+		}
+		if len(resp.Stderr) != 0 {
+			t.Fatalf("unexpected stderr: %s", string(resp.Stderr))
+		}
+		if string(resp.Stdout) != "ok" {
+			t.Fatalf("unexpected stdout: %q", string(resp.Stdout))
+		}
+	}
+}
+
+func TestClientRetriesStalePooledConn(t *testing.T) {
+	// a fake server that closes every connection after one request, even
+	// though the client asked to keep it open
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fc := NewConn(conn, 5*time.Second, 5*time.Second)
+			req, err := fc.ReadRequest()
+			if err == nil {
+				if !req.KeepConn {
+					t.Errorf("pooled request without FCGI_KEEP_CONN")
+				}
+				_ = fc.SendStdout(req.RequestID, []byte("ok"))
+				_ = fc.SendEndRequest(req.RequestID, 0, uint8(StatusRequestComplete))
+			}
+			conn.Close()
+		}
+	}()
+
+	client := NewClient(ln.Addr().String(), "tcp", 1, 2*time.Second, 2*time.Second)
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Do(context.Background(), map[string]string{"SCRIPT_FILENAME": "index.php"}, nil)
+		if err != nil {
+			t.Fatalf("Do(%d) error: %v", i, err)
+		}
+		if string(resp.Stdout) != "ok" {
+			t.Fatalf("unexpected stdout: %q", string(resp.Stdout))
+		}
+	}
+}
+
+func TestClientCancelSendsAbort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	aborted := make(chan uint16, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fc := NewConn(conn, 5*time.Second, 5*time.Second)
+		req, err := fc.ReadRequest()
+		if err != nil {
+			return
+		}
+		// Don't answer, wait for the abort
+		for {
+			rec, err := fc.ReadRecord()
+			if err != nil {
+				return
+			}
+			if rec.Header.Type == TypeAbortRequest {
+				aborted <- rec.Header.RequestID
+				_ = fc.SendEndRequest(req.RequestID, 1, uint8(StatusRequestComplete))
+				return
+			}
+		}
+	}()
+
+	client := NewClient(ln.Addr().String(), "tcp", 1, 2*time.Second, 5*time.Second)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, _, _, err = client.DoRequest(ctx, map[string]string{"SCRIPT_FILENAME": "index.php"}, nil)
+	if err != context.Canceled {
+		t.Fatalf("DoRequest error = %v, want context.Canceled", err)
+	}
+
+	select {
+	case id := <-aborted:
+		if id != 1 {
+			t.Errorf("aborted request id = %d, want 1", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("backend did not receive FCGI_ABORT_REQUEST")
+	}
+}
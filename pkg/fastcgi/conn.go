@@ -3,10 +3,17 @@ package fastcgi
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,11 +28,32 @@ type Conn struct {
 	reader       *bufio.Reader
 	readTimeout  time.Duration
 	writeTimeout time.Duration
+	values       map[string]string
+	pending      []*Record // records read ahead, returned first by ReadRecord
 	mu           sync.Mutex
+
+	// Set by startReader: whole records read by its goroutine, the first
+	// read error, and whether read timeouts are ignored
+	records    chan recordRead
+	readerDone chan struct{}
+	readErr    error
+	busy       atomic.Bool
+
+	// Reused by nextRecord
+	rheader Header
+	rrecord Record
+	rbuf    []byte
+}
+
+// recordRead is a record or the error that ended the reader goroutine
+type recordRead struct {
+	record *Record
+	err    error
 }
 
 // Request represents a FastCGI request
 type Request struct {
+	ctx       context.Context
 	RequestID uint16
 	Role      uint16
 	Flags     uint8
@@ -35,6 +63,15 @@ type Request struct {
 	KeepConn  bool
 }
 
+// Context returns the request context, the same context that is passed to
+// Handler.ServeFastCGI.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
 // NewConn creates a new FastCGI connection wrapper
 func NewConn(netConn net.Conn, readTimeout, writeTimeout time.Duration) *Conn {
 	return &Conn{
@@ -45,47 +82,36 @@ func NewConn(netConn net.Conn, readTimeout, writeTimeout time.Duration) *Conn {
 	}
 }
 
-// ReadRequest reads a complete FastCGI request from the connection
+// SetValues sets the management variables (FCGI_MAX_CONNS, FCGI_MAX_REQS,
+// FCGI_MPXS_CONNS) reported to clients that send a GetValues record
+func (c *Conn) SetValues(values map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values = values
+}
+
+// ReadRequest reads a complete FastCGI request from the connection. A
+// Responder request ends with its stdin, an Authorizer request with its
+// params and a Filter request with its data stream.
 func (c *Conn) ReadRequest() (*Request, error) {
 	req := &Request{
 		Params: make(map[string]string),
 	}
+	begun := false
+	stdinDone := false
 
 	for {
-		if c.readTimeout > 0 {
-			c.netConn.SetReadDeadline(time.Now().Add(c.readTimeout))
-		}
-
-		// Peek at the header to determine record size
-		headerBytes, err := c.reader.Peek(HeaderSize)
-		if err != nil {
-			if err == io.EOF {
-				return nil, ErrConnClosed
-			}
-			return nil, fmt.Errorf("peek header: %w", err)
-		}
-
-		header, err := DecodeHeader(headerBytes)
+		record, err := c.nextRecord()
 		if err != nil {
-			return nil, fmt.Errorf("decode header: %w", err)
+			return nil, err
 		}
 
-		// Calculate total record size
-		totalSize := HeaderSize + int(header.ContentLength) + int(header.PaddingLength)
-
-		// Read the complete record
-		recordBytes := make([]byte, totalSize)
-		if _, err := io.ReadFull(c.reader, recordBytes); err != nil {
-			if err == io.EOF {
-				return nil, ErrConnClosed
+		// Skip leftover stream records of a previous request
+		switch record.Header.Type {
+		case TypeParams, TypeStdin, TypeData, TypeAbortRequest:
+			if !begun || record.Header.RequestID != req.RequestID {
+				continue
 			}
-			return nil, fmt.Errorf("read record: %w", err)
-		}
-
-		// Decode the record
-		record, _, err := DecodeRecord(recordBytes)
-		if err != nil {
-			return nil, fmt.Errorf("decode record: %w", err)
 		}
 
 		switch record.Header.Type {
@@ -98,6 +124,7 @@ func (c *Conn) ReadRequest() (*Request, error) {
 			req.Role = body.Role
 			req.Flags = body.Flags
 			req.KeepConn = (body.Flags & FlagKeepConn) != 0
+			begun = true
 
 		case TypeParams:
 			if len(record.Content) > 0 {
@@ -109,12 +136,18 @@ func (c *Conn) ReadRequest() (*Request, error) {
 				for k, v := range params {
 					req.Params[k] = v
 				}
+			} else if req.Role == RoleAuthorizer {
+				// Empty params record signals end of params, and of an
+				// Authorizer request, which has no stdin
+				return req, nil
 			}
-		// Empty params record signals end of params
 
 		case TypeStdin:
 			if len(record.Content) > 0 {
 				req.Stdin = append(req.Stdin, record.Content...)
+			} else if req.Role == RoleFilter {
+				// A Filter request continues with the data stream
+				stdinDone = true
 			} else {
 				// Empty stdin signals end of request
 				return req, nil
@@ -123,11 +156,20 @@ func (c *Conn) ReadRequest() (*Request, error) {
 		case TypeData:
 			if len(record.Content) > 0 {
 				req.Data = append(req.Data, record.Content...)
+			} else if req.Role == RoleFilter && stdinDone {
+				// Empty data signals end of a Filter request
+				return req, nil
 			}
 
 		case TypeAbortRequest:
 			return nil, fmt.Errorf("request aborted")
 
+		case TypeGetValues:
+			// Management record, answer and keep waiting for the request
+			if err := c.answerGetValues(record.Content); err != nil {
+				return nil, err
+			}
+
 		default:
 			// Unknown record type, send unknown type record
 			c.SendUnknownType(record.Header.Type)
@@ -135,6 +177,25 @@ func (c *Conn) ReadRequest() (*Request, error) {
 	}
 }
 
+// answerGetValues replies to a GetValues record with the known variables
+func (c *Conn) answerGetValues(content []byte) error {
+	query, err := DecodeParams(content)
+	if err != nil {
+		return fmt.Errorf("decode get values: %w", err)
+	}
+
+	c.mu.Lock()
+	result := make(map[string]string)
+	for name := range query {
+		if value, ok := c.values[name]; ok {
+			result[name] = value
+		}
+	}
+	c.mu.Unlock()
+
+	return c.SendGetValuesResult(result)
+}
+
 // SendStdout sends stdout data to the client
 func (c *Conn) SendStdout(requestID uint16, data []byte) error {
 	return c.sendStream(TypeStdout, requestID, data)
@@ -147,197 +208,441 @@ func (c *Conn) SendStderr(requestID uint16, data []byte) error {
 
 // sendStream sends a stream of data, splitting into multiple records if needed
 func (c *Conn) sendStream(streamType uint8, requestID uint16, data []byte) error {
+	b := newWriteBatch()
+	defer b.release()
+
+	b.addStream(streamType, requestID, data, true)
+	if err := c.write(b); err != nil {
+		return fmt.Errorf("write record: %w", err)
+	}
+	return nil
+}
+
+// write sends the records in b to the client in a single write
+func (c *Conn) write(b *writeBatch) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if c.writeTimeout > 0 {
 		c.netConn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
 	}
+	return b.writeTo(c.netConn)
+}
 
-	// Split into chunks if necessary
-	const maxChunkSize = 65535
-	for len(data) > 0 {
-		chunkSize := len(data)
-		if chunkSize > maxChunkSize {
-			chunkSize = maxChunkSize
-		}
-
-		record := NewRecord(streamType, requestID, data[:chunkSize])
-		encoded := record.Encode()
-		if _, err := c.netConn.Write(encoded); err != nil {
-			return fmt.Errorf("write record: %w", err)
-		}
+// SendResponse sends stdout and stderr followed by the end request record in
+// a single write. Empty streams are left out.
+func (c *Conn) SendResponse(requestID uint16, stdout, stderr []byte, appStatus uint32) error {
+	b := newWriteBatch()
+	defer b.release()
 
-		data = data[chunkSize:]
+	if len(stdout) > 0 {
+		b.addStream(TypeStdout, requestID, stdout, true)
 	}
-
-	// Send empty record to signal end of stream
-	record := NewRecord(streamType, requestID, nil)
-	encoded := record.Encode()
-	if _, err := c.netConn.Write(encoded); err != nil {
-		return fmt.Errorf("write end record: %w", err)
+	if len(stderr) > 0 {
+		b.addStream(TypeStderr, requestID, stderr, true)
 	}
+	b.add(TypeEndRequest, requestID, encodeEndRequest(appStatus, StatusRequestComplete))
 
+	if err := c.write(b); err != nil {
+		return fmt.Errorf("write response: %w", err)
+	}
 	return nil
 }
 
-// SendEndRequest sends an end request record
-func (c *Conn) SendEndRequest(requestID uint16, appStatus uint32, protocolStatus uint8) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// SendData sends the filter data stream to the application, followed by
+// the empty record that ends it
+func (c *Conn) SendData(requestID uint16, data []byte) error {
+	return c.sendStream(TypeData, requestID, data)
+}
 
-	if c.writeTimeout > 0 {
-		c.netConn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+// SendAuthorizerResponse answers an Authorizer request. Status 200 grants
+// access and vars are passed on to the Responder as Variable-<name> headers;
+// any other status denies access and is returned to the client with headers
+// and body.
+func (c *Conn) SendAuthorizerResponse(requestID uint16, status int, vars map[string]string, headers map[string]string, body []byte) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Status: %d %s\r\n", status, http.StatusText(status))
+
+	if status == http.StatusOK {
+		for _, name := range sortedKeys(vars) {
+			fmt.Fprintf(&b, "Variable-%s: %s\r\n", name, vars[name])
+		}
+	} else {
+		for _, name := range sortedKeys(headers) {
+			fmt.Fprintf(&b, "%s: %s\r\n", name, headers[name])
+		}
 	}
+	b.WriteString("\r\n")
 
-	body := &EndRequestBody{
-		AppStatus:      appStatus,
-		ProtocolStatus: uint8(protocolStatus),
+	output := []byte(b.String())
+	if status != http.StatusOK {
+		output = append(output, body...)
 	}
 
-	content := body.Encode()
-	record := NewRecord(TypeEndRequest, requestID, content)
-	encoded := record.Encode()
+	return c.SendResponse(requestID, output, nil, 0)
+}
 
-	if _, err := c.netConn.Write(encoded); err != nil {
-		return fmt.Errorf("write record: %w", err)
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return keys
+}
 
+// SendEndRequest sends an end request record
+func (c *Conn) SendEndRequest(requestID uint16, appStatus uint32, protocolStatus uint8) error {
+	b := newWriteBatch()
+	defer b.release()
+
+	b.add(TypeEndRequest, requestID, encodeEndRequest(appStatus, uint32(protocolStatus)))
+	if err := c.write(b); err != nil {
+		return fmt.Errorf("write record: %w", err)
+	}
 	return nil
 }
 
+// encodeEndRequest encodes an EndRequest body without allocating
+func encodeEndRequest(appStatus, protocolStatus uint32) []byte {
+	var body [8]byte
+	binary.BigEndian.PutUint32(body[0:4], appStatus)
+	body[4] = uint8(protocolStatus)
+	return body[:]
+}
+
 // SendUnknownType sends an unknown type record
 func (c *Conn) SendUnknownType(unknownType uint8) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	b := newWriteBatch()
+	defer b.release()
 
-	if c.writeTimeout > 0 {
-		c.netConn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	b.add(TypeUnknownType, NullRequestID, []byte{unknownType, 0, 0, 0, 0, 0, 0, 0})
+	if err := c.write(b); err != nil {
+		return fmt.Errorf("write record: %w", err)
 	}
+	return nil
+}
 
-	content := []byte{unknownType, 0, 0, 0, 0, 0, 0, 0}
-	record := NewRecord(TypeUnknownType, NullRequestID, content)
-	encoded := record.Encode()
-
-	if _, err := c.netConn.Write(encoded); err != nil {
-		return fmt.Errorf("write record: %w", err)
+// SendGetValues queries the application for management variables
+func (c *Conn) SendGetValues(names []string) error {
+	query := make(map[string]string, len(names))
+	for _, name := range names {
+		query[name] = ""
 	}
+	return c.sendManagement(TypeGetValues, query)
+}
+
+// SendGetValuesResult sends the answer to a GetValues query
+func (c *Conn) SendGetValuesResult(values map[string]string) error {
+	return c.sendManagement(TypeGetValuesResult, values)
+}
+
+// sendManagement sends a management record (request ID 0) with name-value pairs
+func (c *Conn) sendManagement(recordType uint8, pairs map[string]string) error {
+	b := newWriteBatch()
+	defer b.release()
 
+	b.add(recordType, NullRequestID, EncodeParams(pairs))
+	if err := c.write(b); err != nil {
+		return fmt.Errorf("write management record: %w", err)
+	}
 	return nil
 }
 
+// GetValues queries the application for management variables and waits for
+// the result. Use it on a connection with no requests in flight.
+func (c *Conn) GetValues(names ...string) (map[string]string, error) {
+	if err := c.SendGetValues(names); err != nil {
+		return nil, err
+	}
+
+	for {
+		record, err := c.ReadRecord()
+		if err != nil {
+			return nil, err
+		}
+		switch record.Header.Type {
+		case TypeGetValuesResult:
+			return DecodeParams(record.Content)
+		case TypeUnknownType:
+			return nil, fmt.Errorf("application does not support get values")
+		}
+	}
+}
+
 // SendBeginRequest sends a begin request record
 func (c *Conn) SendBeginRequest(requestID uint16, role uint16, keepConn bool) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	b := newWriteBatch()
+	defer b.release()
 
-	if c.writeTimeout > 0 {
-		c.netConn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	b.add(TypeBeginRequest, requestID, encodeBeginRequest(role, keepConn))
+	if err := c.write(b); err != nil {
+		return fmt.Errorf("write begin request: %w", err)
 	}
+	return nil
+}
 
-	flags := uint8(0)
+// encodeBeginRequest encodes a BeginRequest body without allocating
+func encodeBeginRequest(role uint16, keepConn bool) []byte {
+	var body [8]byte
+	binary.BigEndian.PutUint16(body[0:2], role)
 	if keepConn {
-		flags = FlagKeepConn
+		body[2] = FlagKeepConn
 	}
+	return body[:]
+}
 
-	body := &BeginRequestBody{
-		Role:  role,
-		Flags: flags,
-	}
+// SendRequest sends the begin request record and the params stream, ended
+// by an empty params record, in a single write. Stdin follows separately.
+func (c *Conn) SendRequest(requestID uint16, role uint16, keepConn bool, params map[string]string) error {
+	b := newWriteBatch()
+	defer b.release()
 
-	content := body.Encode()
-	record := NewRecord(TypeBeginRequest, requestID, content)
-	encoded := record.Encode()
+	content := getBuffer()
+	defer putBuffer(content)
+	*content = AppendParams(*content, params)
 
-	if _, err := c.netConn.Write(encoded); err != nil {
-		return fmt.Errorf("write begin request: %w", err)
+	b.add(TypeBeginRequest, requestID, encodeBeginRequest(role, keepConn))
+	b.addStream(TypeParams, requestID, *content, true)
+	if err := c.write(b); err != nil {
+		return fmt.Errorf("write request: %w", err)
 	}
-
 	return nil
 }
 
 // SendParams sends parameters to the FastCGI application
 func (c *Conn) SendParams(requestID uint16, params map[string]string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	b := newWriteBatch()
+	defer b.release()
 
-	if c.writeTimeout > 0 {
-		c.netConn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
-	}
+	content := getBuffer()
+	defer putBuffer(content)
+	*content = AppendParams(*content, params)
 
-	var content []byte
-	if params != nil && len(params) > 0 {
-		content = EncodeParams(params)
+	if len(*content) == 0 {
+		// Empty params record signals end of params
+		b.add(TypeParams, requestID, nil)
+	} else {
+		b.addStream(TypeParams, requestID, *content, false)
 	}
-
-	record := NewRecord(TypeParams, requestID, content)
-	encoded := record.Encode()
-
-	if _, err := c.netConn.Write(encoded); err != nil {
+	if err := c.write(b); err != nil {
 		return fmt.Errorf("write params: %w", err)
 	}
-
 	return nil
 }
 
 // SendStdin sends stdin data to the FastCGI application
 func (c *Conn) SendStdin(requestID uint16, data []byte) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	b := newWriteBatch()
+	defer b.release()
+
+	// Split into records, an empty record signals end of stdin
+	if len(data) == 0 {
+		b.add(TypeStdin, requestID, nil)
+	} else {
+		b.addStream(TypeStdin, requestID, data, false)
+	}
+	if err := c.write(b); err != nil {
+		return fmt.Errorf("write stdin: %w", err)
+	}
+	return nil
+}
 
-	if c.writeTimeout > 0 {
-		c.netConn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+// SendStdinFrom streams r as stdin records as data arrives, followed by the
+// empty record that ends stdin. It returns the number of bytes sent.
+func (c *Conn) SendStdinFrom(requestID uint16, r io.Reader) (int64, error) {
+	if r == nil {
+		return 0, c.SendStdin(requestID, nil)
+	}
+	pooled := getBuffer()
+	defer putBuffer(pooled)
+	buf := (*pooled)[:cap(*pooled)]
+	var sent int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := c.SendStdin(requestID, buf[:n]); werr != nil {
+				return sent, werr
+			}
+			sent += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return sent, fmt.Errorf("read stdin: %w", err)
+		}
 	}
+	return sent, c.SendStdin(requestID, nil)
+}
 
-	record := NewRecord(TypeStdin, requestID, data)
-	encoded := record.Encode()
+// SendAbortRequest asks the application to abort a request
+func (c *Conn) SendAbortRequest(requestID uint16) error {
+	b := newWriteBatch()
+	defer b.release()
 
-	if _, err := c.netConn.Write(encoded); err != nil {
-		return fmt.Errorf("write stdin: %w", err)
+	b.add(TypeAbortRequest, requestID, nil)
+	if err := c.write(b); err != nil {
+		return fmt.Errorf("write abort request: %w", err)
 	}
-
 	return nil
 }
 
 // ReadRecord reads a single FastCGI record from the connection
 func (c *Conn) ReadRecord() (*Record, error) {
+	// Records read ahead while watching for aborts come first
+	c.mu.Lock()
+	if len(c.pending) > 0 {
+		record := c.pending[0]
+		c.pending = c.pending[1:]
+		c.mu.Unlock()
+		return record, nil
+	}
+	c.mu.Unlock()
+
+	if c.records != nil {
+		return c.receive()
+	}
+	return c.readRecord()
+}
+
+// startReader reads the records of the connection in a goroutine until a
+// read fails or stopReader is called. A record is only handed on whole, so
+// whoever stops taking records leaves the connection at a record boundary.
+func (c *Conn) startReader() {
+	c.records = make(chan recordRead)
+	c.readerDone = make(chan struct{})
+	go func() {
+		for {
+			record, err := c.readRecord()
+			select {
+			case c.records <- recordRead{record, err}:
+			case <-c.readerDone:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// stopReader ends the goroutine of startReader, a read it is blocked in
+// ends when the connection is closed
+func (c *Conn) stopReader() {
+	close(c.readerDone)
+}
+
+// receive returns the next record of the reader goroutine, its error once
+// it ended
+func (c *Conn) receive() (*Record, error) {
+	if c.readErr != nil {
+		return nil, c.readErr
+	}
+	read := <-c.records
+	c.readErr = read.err
+	return read.record, read.err
+}
+
+// readRecord reads the next record from the network into a newly
+// allocated record owned by the caller. While the connection is busy a
+// read timeout before the record is ignored, the header is only consumed
+// once it was read whole.
+func (c *Conn) readRecord() (*Record, error) {
+	// Allocate the record and its header together
+	rec := &struct {
+		Record
+		header Header
+	}{}
+	for {
+		err := c.readHeader(&rec.header)
+		if err == nil {
+			break
+		}
+		var netErr net.Error
+		if !c.busy.Load() || !errors.As(err, &netErr) || !netErr.Timeout() {
+			return nil, err
+		}
+	}
+	rec.Header = &rec.header
+	rec.Content = make([]byte, rec.header.ContentLength)
+	if err := c.readContent(&rec.header, rec.Content); err != nil {
+		return nil, err
+	}
+	return &rec.Record, nil
+}
+
+// nextRecord returns the next record, reading it into buffers owned by the
+// connection when none was read ahead. The record is only valid until the
+// next read, callers must copy what they keep.
+func (c *Conn) nextRecord() (*Record, error) {
+	c.mu.Lock()
+	if len(c.pending) > 0 {
+		record := c.pending[0]
+		c.pending = c.pending[1:]
+		c.mu.Unlock()
+		return record, nil
+	}
+	c.mu.Unlock()
+
+	if c.records != nil {
+		return c.receive()
+	}
+
+	if err := c.readHeader(&c.rheader); err != nil {
+		return nil, err
+	}
+	n := int(c.rheader.ContentLength)
+	if cap(c.rbuf) < n {
+		c.rbuf = make([]byte, n)
+	}
+	c.rrecord = Record{Header: &c.rheader, Content: c.rbuf[:n]}
+	if err := c.readContent(&c.rheader, c.rrecord.Content); err != nil {
+		return nil, err
+	}
+	return &c.rrecord, nil
+}
+
+// readHeader reads and decodes the next record header into h
+func (c *Conn) readHeader(h *Header) error {
 	if c.readTimeout > 0 {
 		c.netConn.SetReadDeadline(time.Now().Add(c.readTimeout))
 	}
 
-	// Peek at the header to determine record size
-	headerBytes, err := c.reader.Peek(HeaderSize)
+	data, err := c.reader.Peek(HeaderSize)
 	if err != nil {
 		if err == io.EOF {
-			return nil, ErrConnClosed
+			return ErrConnClosed
 		}
-		return nil, fmt.Errorf("peek header: %w", err)
+		return fmt.Errorf("peek header: %w", err)
 	}
-
-	header, err := DecodeHeader(headerBytes)
-	if err != nil {
-		return nil, fmt.Errorf("decode header: %w", err)
+	*h = Header{
+		Version:       data[0],
+		Type:          data[1],
+		RequestID:     binary.BigEndian.Uint16(data[2:4]),
+		ContentLength: binary.BigEndian.Uint16(data[4:6]),
+		PaddingLength: data[6],
+		Reserved:      data[7],
 	}
+	c.reader.Discard(HeaderSize)
+	return nil
+}
 
-	// Calculate total record size
-	totalSize := HeaderSize + int(header.ContentLength) + int(header.PaddingLength)
-
-	// Read the complete record
-	recordBytes := make([]byte, totalSize)
-	if _, err := io.ReadFull(c.reader, recordBytes); err != nil {
+// readContent reads the record content into content and skips the padding
+func (c *Conn) readContent(h *Header, content []byte) error {
+	if _, err := io.ReadFull(c.reader, content); err != nil {
 		if err == io.EOF {
-			return nil, ErrConnClosed
+			return ErrConnClosed
 		}
-		return nil, fmt.Errorf("read record: %w", err)
+		return fmt.Errorf("read record: %w", err)
 	}
-
-	// Decode the record
-	record, _, err := DecodeRecord(recordBytes)
-	if err != nil {
-		return nil, fmt.Errorf("decode record: %w", err)
+	if _, err := c.reader.Discard(int(h.PaddingLength)); err != nil {
+		if err == io.EOF {
+			return ErrConnClosed
+		}
+		return fmt.Errorf("read record: %w", err)
 	}
-
-	return record, nil
+	return nil
 }
 
 // Close closes the connection
@@ -0,0 +1,58 @@
+package fastcgi
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGetValues(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	server := NewConn(serverConn, 5*time.Second, 5*time.Second)
+	server.SetValues(map[string]string{
+		ValueMaxConns:  "10",
+		ValueMaxReqs:   "10",
+		ValueMpxsConns: "0",
+	})
+
+	// The server answers management records while waiting for a request
+	reqChan := make(chan *Request, 1)
+	go func() {
+		req, _ := server.ReadRequest()
+		reqChan <- req
+	}()
+
+	client := NewConn(clientConn, 5*time.Second, 5*time.Second)
+	values, err := client.GetValues(ValueMaxConns, ValueMpxsConns, "UNKNOWN")
+	if err != nil {
+		t.Fatalf("GetValues failed: %v", err)
+	}
+
+	if values[ValueMaxConns] != "10" {
+		t.Errorf("%s = %q, want 10", ValueMaxConns, values[ValueMaxConns])
+	}
+	if values[ValueMpxsConns] != "0" {
+		t.Errorf("%s = %q, want 0", ValueMpxsConns, values[ValueMpxsConns])
+	}
+	if _, ok := values[ValueMaxReqs]; ok {
+		t.Errorf("%s returned but not queried", ValueMaxReqs)
+	}
+	if _, ok := values["UNKNOWN"]; ok {
+		t.Error("unknown variable returned")
+	}
+
+	// A request after the management record is still read normally
+	if err := client.SendBeginRequest(1, RoleResponder, false); err != nil {
+		t.Fatalf("SendBeginRequest: %v", err)
+	}
+	client.SendParams(1, nil)
+	client.SendStdin(1, nil)
+
+	req := <-reqChan
+	if req == nil || req.RequestID != 1 {
+		t.Fatalf("ReadRequest after GetValues = %+v, want request 1", req)
+	}
+}
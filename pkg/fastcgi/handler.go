@@ -1,13 +1,17 @@
 package fastcgi
 
-// Handler processes FastCGI requests
+import "context"
+
+// Handler processes FastCGI requests. The context is canceled when the
+// client aborts the request or disconnects, the server's request timeout
+// expires or the server is closed.
 type Handler interface {
-	ServeFastCGI(conn *Conn, req *Request) error
+	ServeFastCGI(ctx context.Context, conn *Conn, req *Request) error
 }
 
 // HandlerFunc is an adapter to allow ordinary functions to be used as handlers
-type HandlerFunc func(conn *Conn, req *Request) error
+type HandlerFunc func(ctx context.Context, conn *Conn, req *Request) error
 
-func (f HandlerFunc) ServeFastCGI(conn *Conn, req *Request) error {
-	return f(conn, req)
+func (f HandlerFunc) ServeFastCGI(ctx context.Context, conn *Conn, req *Request) error {
+	return f(ctx, conn, req)
 }
@@ -1,6 +1,7 @@
 package fastcgi
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"testing"
@@ -10,7 +11,7 @@ import (
 // Simple echo handler for testing
 type EchoHandler struct{}
 
-func (h *EchoHandler) ServeFastCGI(conn *Conn, req *Request) error {
+func (h *EchoHandler) ServeFastCGI(ctx context.Context, conn *Conn, req *Request) error {
 	// Echo back the request parameters
 	response := fmt.Sprintf("Request ID: %d\nRole: %d\n", req.RequestID, req.Role)
 	response += fmt.Sprintf("Parameters:\n")
@@ -57,7 +58,7 @@ func TestServerBasic(t *testing.T) {
 						c.Close()
 						return
 					}
-					_ = handler.ServeFastCGI(fc, req)
+					_ = handler.ServeFastCGI(req.Context(), fc, req)
 					if !req.KeepConn {
 						c.Close()
 						return
@@ -0,0 +1,185 @@
+package fastcgi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var ErrTooManyRequests = errors.New("no free request id on connection")
+
+// Response holds the collected output of a completed FastCGI request
+type Response struct {
+	Stdout         []byte
+	Stderr         []byte
+	AppStatus      uint32
+	ProtocolStatus uint8
+}
+
+// muxRequest is an in-flight request on a MuxConn
+type muxRequest struct {
+	resp Response
+	err  error
+	done chan struct{}
+}
+
+// MuxConn multiplexes concurrent requests over a single kept-alive FastCGI
+// connection. A single goroutine reads records and dispatches them by request ID.
+// Only use it against applications that report FCGI_MPXS_CONNS=1, php-fpm does not.
+type MuxConn struct {
+	conn    *Conn
+	pending map[uint16]*muxRequest
+	nextID  uint16
+	err     error
+	mu      sync.Mutex
+}
+
+// NewMuxConn starts multiplexing on conn. The connection should be created
+// without a read timeout, as it idles between requests.
+func NewMuxConn(conn *Conn) *MuxConn {
+	m := &MuxConn{
+		conn:    conn,
+		pending: make(map[uint16]*muxRequest),
+		nextID:  1,
+	}
+	go m.readLoop()
+	return m
+}
+
+// Do sends a request, streaming stdin, and waits for its response. When ctx
+// is done the request is aborted with FCGI_ABORT_REQUEST.
+func (m *MuxConn) Do(ctx context.Context, role uint16, params map[string]string, stdin io.Reader) (*Response, error) {
+	requestID, req, err := m.register()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.send(requestID, role, params, stdin); err != nil {
+		m.unregister(requestID)
+		m.fail(err)
+		return nil, err
+	}
+
+	select {
+	case <-req.done:
+		if req.err != nil {
+			return nil, req.err
+		}
+		return &req.resp, nil
+	case <-ctx.Done():
+		m.unregister(requestID)
+		m.conn.SendAbortRequest(requestID)
+		return nil, ctx.Err()
+	}
+}
+
+// Active returns the number of in-flight requests
+func (m *MuxConn) Active() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.pending)
+}
+
+// Err returns the error that broke the connection, or nil while it is usable
+func (m *MuxConn) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Close closes the connection and fails all in-flight requests
+func (m *MuxConn) Close() error {
+	m.fail(ErrConnClosed)
+	return m.conn.Close()
+}
+
+// register allocates a free request ID
+func (m *MuxConn) register() (uint16, *muxRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return 0, nil, m.err
+	}
+
+	for i := 0; i < 65535; i++ {
+		id := m.nextID
+		m.nextID++
+		if m.nextID == NullRequestID {
+			m.nextID = 1
+		}
+		if _, used := m.pending[id]; !used {
+			req := &muxRequest{done: make(chan struct{})}
+			m.pending[id] = req
+			return id, req, nil
+		}
+	}
+	return 0, nil, ErrTooManyRequests
+}
+
+func (m *MuxConn) unregister(requestID uint16) {
+	m.mu.Lock()
+	delete(m.pending, requestID)
+	m.mu.Unlock()
+}
+
+func (m *MuxConn) send(requestID, role uint16, params map[string]string, stdin io.Reader) error {
+	if err := m.conn.SendRequest(requestID, role, true, params); err != nil {
+		return err
+	}
+	_, err := m.conn.SendStdinFrom(requestID, stdin)
+	return err
+}
+
+// fail marks the connection broken and completes all pending requests with err
+func (m *MuxConn) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err == nil {
+		m.err = err
+	}
+	for id, req := range m.pending {
+		req.err = err
+		close(req.done)
+		delete(m.pending, id)
+	}
+}
+
+func (m *MuxConn) readLoop() {
+	for {
+		record, err := m.conn.nextRecord()
+		if err != nil {
+			m.fail(fmt.Errorf("read record: %w", err))
+			m.conn.Close()
+			return
+		}
+
+		m.mu.Lock()
+		req := m.pending[record.Header.RequestID]
+		if req == nil {
+			// Abandoned (timed out) request or management record
+			m.mu.Unlock()
+			continue
+		}
+
+		switch record.Header.Type {
+		case TypeStdout:
+			req.resp.Stdout = append(req.resp.Stdout, record.Content...)
+		case TypeStderr:
+			req.resp.Stderr = append(req.resp.Stderr, record.Content...)
+		case TypeEndRequest:
+			if body, derr := DecodeEndRequestBody(record.Content); derr == nil {
+				req.resp.AppStatus = body.AppStatus
+				req.resp.ProtocolStatus = body.ProtocolStatus
+			} else {
+				req.err = fmt.Errorf("decode end request: %w", derr)
+			}
+			delete(m.pending, record.Header.RequestID)
+			close(req.done)
+		}
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,119 @@
+package fastcgi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startMuxServer accepts one connection and answers requests concurrently,
+// echoing the "ID" param after a delay so responses interleave.
+func startMuxServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fc := NewConn(conn, 0, 5*time.Second)
+		var wg sync.WaitGroup
+		for {
+			req, err := fc.ReadRequest()
+			if err != nil {
+				wg.Wait()
+				return
+			}
+			if !req.KeepConn {
+				t.Errorf("request %d without FCGI_KEEP_CONN", req.RequestID)
+			}
+			wg.Add(1)
+			go func(req *Request) {
+				defer wg.Done()
+				if req.Params["ID"] == "0" {
+					time.Sleep(50 * time.Millisecond)
+				}
+				fc.SendStdout(req.RequestID, []byte("response "+req.Params["ID"]))
+				fc.SendEndRequest(req.RequestID, 0, uint8(StatusRequestComplete))
+			}(req)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestMuxConnConcurrentRequests(t *testing.T) {
+	addr := startMuxServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	mux := NewMuxConn(NewConn(conn, 0, 5*time.Second))
+	defer mux.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("%d", i)
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			resp, err := mux.Do(ctx, RoleResponder, map[string]string{"ID": id}, nil)
+			if err != nil {
+				t.Errorf("Do(%d) failed: %v", i, err)
+				return
+			}
+			if string(resp.Stdout) != "response "+id {
+				t.Errorf("Do(%d) stdout = %q", i, resp.Stdout)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if active := mux.Active(); active != 0 {
+		t.Errorf("Active = %d after all requests completed, want 0", active)
+	}
+}
+
+func TestMuxConnFailsPendingOnClose(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		// Read the request, then drop the connection without answering
+		NewConn(conn, 5*time.Second, 5*time.Second).ReadRequest()
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	mux := NewMuxConn(NewConn(conn, 0, 5*time.Second))
+	defer mux.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := mux.Do(ctx, RoleResponder, map[string]string{"A": "B"}, nil); err == nil {
+		t.Fatal("Do succeeded on a closed connection, want error")
+	}
+	if mux.Err() == nil {
+		t.Error("Err() = nil after connection was closed")
+	}
+}
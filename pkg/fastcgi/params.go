@@ -1,7 +1,6 @@
 package fastcgi
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 )
@@ -12,45 +11,37 @@ var (
 
 // EncodeParam encodes a single name-value pair according to FastCGI spec
 func EncodeParam(name, value string) []byte {
-	nameLen := len(name)
-	valueLen := len(value)
-
-	var buf bytes.Buffer
-
-	// Encode name length
-	if nameLen < 128 {
-		buf.WriteByte(byte(nameLen))
-	} else {
-		b := make([]byte, 4)
-		binary.BigEndian.PutUint32(b, uint32(nameLen)|0x80000000)
-		buf.Write(b)
-	}
-
-	// Encode value length
-	if valueLen < 128 {
-		buf.WriteByte(byte(valueLen))
-	} else {
-		b := make([]byte, 4)
-		binary.BigEndian.PutUint32(b, uint32(valueLen)|0x80000000)
-		buf.Write(b)
-	}
+	return AppendParam(nil, name, value)
+}
 
-	// Write name and value
-	buf.WriteString(name)
-	buf.WriteString(value)
+// AppendParam appends an encoded name-value pair to dst
+func AppendParam(dst []byte, name, value string) []byte {
+	dst = appendLength(dst, len(name))
+	dst = appendLength(dst, len(value))
+	dst = append(dst, name...)
+	return append(dst, value...)
+}
 
-	return buf.Bytes()
+// appendLength appends a 1 byte length, or a 4 byte length with the high bit
+// set for lengths of 128 and up
+func appendLength(dst []byte, length int) []byte {
+	if length < 128 {
+		return append(dst, byte(length))
+	}
+	return binary.BigEndian.AppendUint32(dst, uint32(length)|0x80000000)
 }
 
 // EncodeParams encodes multiple name-value pairs into FastCGI params format
 func EncodeParams(params map[string]string) []byte {
-	var buf bytes.Buffer
+	return AppendParams(nil, params)
+}
 
+// AppendParams appends encoded name-value pairs to dst
+func AppendParams(dst []byte, params map[string]string) []byte {
 	for name, value := range params {
-		buf.Write(EncodeParam(name, value))
+		dst = AppendParam(dst, name, value)
 	}
-
-	return buf.Bytes()
+	return dst
 }
 
 // DecodeParams decodes FastCGI params from bytes into a map
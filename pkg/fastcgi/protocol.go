@@ -37,6 +37,11 @@ const (
 	StatusOverloaded      uint32 = 2
 	StatusUnknownRole     uint32 = 3
 
+	// Management variable names for GetValues
+	ValueMaxConns  = "FCGI_MAX_CONNS"
+	ValueMaxReqs   = "FCGI_MAX_REQS"
+	ValueMpxsConns = "FCGI_MPXS_CONNS"
+
 	// Header size
 	HeaderSize = 8
 
@@ -56,14 +61,15 @@ type Header struct {
 
 // EncodeHeader encodes a header into bytes
 func (h *Header) Encode() []byte {
-	buf := make([]byte, HeaderSize)
-	buf[0] = h.Version
-	buf[1] = h.Type
-	binary.BigEndian.PutUint16(buf[2:4], h.RequestID)
-	binary.BigEndian.PutUint16(buf[4:6], h.ContentLength)
-	buf[6] = h.PaddingLength
-	buf[7] = h.Reserved
-	return buf
+	return h.AppendTo(make([]byte, 0, HeaderSize))
+}
+
+// AppendTo appends the encoded header to dst
+func (h *Header) AppendTo(dst []byte) []byte {
+	dst = append(dst, h.Version, h.Type)
+	dst = binary.BigEndian.AppendUint16(dst, h.RequestID)
+	dst = binary.BigEndian.AppendUint16(dst, h.ContentLength)
+	return append(dst, h.PaddingLength, h.Reserved)
 }
 
 // DecodeHeader decodes a header from bytes
@@ -166,12 +172,14 @@ func NewRecord(typ uint8, requestID uint16, content []byte) *Record {
 
 // Encode encodes a record into bytes
 func (r *Record) Encode() []byte {
-	headerBytes := r.Header.Encode()
-	result := make([]byte, 0, len(headerBytes)+len(r.Content)+len(r.Padding))
-	result = append(result, headerBytes...)
-	result = append(result, r.Content...)
-	result = append(result, r.Padding...)
-	return result
+	return r.AppendTo(make([]byte, 0, HeaderSize+len(r.Content)+len(r.Padding)))
+}
+
+// AppendTo appends the encoded record to dst, so callers can reuse buffers
+func (r *Record) AppendTo(dst []byte) []byte {
+	dst = r.Header.AppendTo(dst)
+	dst = append(dst, r.Content...)
+	return append(dst, r.Padding...)
 }
 
 // DecodeRecord decodes a record from bytes
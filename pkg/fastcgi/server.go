@@ -0,0 +1,278 @@
+package fastcgi
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("fastcgi: server closed")
+
+// Server accepts FastCGI connections and dispatches requests to a Handler.
+// Requests on a connection are served one at a time; the request context is
+// canceled when the client sends FCGI_ABORT_REQUEST or closes the connection,
+// when RequestTimeout expires and when the server is closed.
+type Server struct {
+	// Handler serves Responder requests
+	Handler Handler
+	// AuthorizerHandler and FilterHandler serve the Authorizer and Filter
+	// roles. Requests for a role without handler are rejected with
+	// FCGI_UNKNOWN_ROLE.
+	AuthorizerHandler Handler
+	FilterHandler     Handler
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// RequestTimeout limits the time a handler may spend on one request.
+	// When it expires the request context is canceled, a handler that is
+	// still running a grace period later loses its connection. Zero means
+	// no limit.
+	RequestTimeout time.Duration
+
+	// Values answers FCGI_GET_VALUES management records
+	Values map[string]string
+
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	ctx       context.Context // canceled by Close
+	cancelCtx context.CancelFunc
+	closed    bool
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+}
+
+// Serve accepts connections on ln until it fails or the server is closed
+func (s *Server) Serve(ln net.Listener) error {
+	if !s.trackListener(ln) {
+		return ErrServerClosed
+	}
+	defer s.untrackListener(ln)
+
+	for {
+		netConn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		if !s.trackConn(netConn) {
+			netConn.Close()
+			return ErrServerClosed
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrackConn(netConn)
+			s.handleConnection(netConn)
+		}()
+	}
+}
+
+// Close cancels the context of all requests being served, stops all
+// listeners and connections and waits for handlers to return
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	if s.cancelCtx != nil {
+		s.cancelCtx()
+	}
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// handleConnection serves requests on a single connection
+func (s *Server) handleConnection(netConn net.Conn) {
+	defer netConn.Close()
+
+	conn := NewConn(netConn, s.ReadTimeout, s.WriteTimeout)
+	if s.Values != nil {
+		conn.SetValues(s.Values)
+	}
+	// A single goroutine reads the records, so the abort watcher stops
+	// between records and the next request starts at a record boundary
+	conn.startReader()
+	defer conn.stopReader()
+
+	for {
+		req, err := conn.ReadRequest()
+		if err != nil {
+			if err != ErrConnClosed {
+				log.Printf("FastCGI read request: %v", err)
+			}
+			return
+		}
+
+		handler := s.handlerFor(req.Role)
+		if handler == nil {
+			if err := conn.SendEndRequest(req.RequestID, 0, uint8(StatusUnknownRole)); err != nil || !req.KeepConn {
+				return
+			}
+			continue
+		}
+
+		ctx, cancel := s.requestContext()
+		req.ctx = ctx
+
+		// Watch for an abort of this request while the handler runs, the
+		// read timeout only applies between requests
+		conn.busy.Store(true)
+		stop := make(chan struct{})
+		watchDone := make(chan bool, 1)
+		go func() {
+			watchDone <- s.watchAbort(conn, req.RequestID, cancel, stop)
+		}()
+
+		// A handler that ignores its context past the timeout loses the
+		// connection, so the client is not kept waiting forever
+		var overrun *time.Timer
+		if s.RequestTimeout > 0 {
+			overrun = time.AfterFunc(s.RequestTimeout+abortGracePeriod, func() {
+				log.Printf("FastCGI handler exceeded request timeout of %s, closing connection", s.RequestTimeout)
+				netConn.Close()
+			})
+		}
+
+		if err := handler.ServeFastCGI(ctx, conn, req); err != nil {
+			log.Printf("FastCGI handler: %v", err)
+		}
+		if overrun != nil && !overrun.Stop() {
+			cancel()
+			return
+		}
+
+		close(stop)
+		connLost := <-watchDone
+		conn.busy.Store(false)
+		cancel()
+
+		if connLost || !req.KeepConn {
+			return
+		}
+	}
+}
+
+// watchAbort takes the records of the reader goroutine while a request is
+// being served, canceling it on FCGI_ABORT_REQUEST. Other records are kept
+// for the next ReadRequest. It returns true when the connection was lost,
+// false once stop is closed.
+func (s *Server) watchAbort(conn *Conn, requestID uint16, cancel context.CancelFunc, stop <-chan struct{}) bool {
+	for {
+		var read recordRead
+		select {
+		case <-stop:
+			return false
+		case read = <-conn.records:
+		}
+		record, err := read.record, read.err
+		if err != nil {
+			// Client went away, nobody is waiting for the response
+			conn.readErr = err
+			cancel()
+			return true
+		}
+
+		switch {
+		case record.Header.Type == TypeAbortRequest && record.Header.RequestID == requestID:
+			cancel()
+		case record.Header.Type == TypeGetValues:
+			conn.answerGetValues(record.Content)
+		default:
+			conn.mu.Lock()
+			conn.pending = append(conn.pending, record)
+			conn.mu.Unlock()
+		}
+	}
+}
+
+// requestContext returns the context for a new request, derived from the
+// server context and limited by RequestTimeout
+func (s *Server) requestContext() (context.Context, context.CancelFunc) {
+	s.mu.Lock()
+	if s.ctx == nil {
+		s.ctx, s.cancelCtx = context.WithCancel(context.Background())
+	}
+	base := s.ctx
+	s.mu.Unlock()
+
+	if s.RequestTimeout > 0 {
+		return context.WithTimeout(base, s.RequestTimeout)
+	}
+	return context.WithCancel(base)
+}
+
+// handlerFor returns the handler for a role, or nil when it is not supported
+func (s *Server) handlerFor(role uint16) Handler {
+	switch role {
+	case RoleResponder:
+		return s.Handler
+	case RoleAuthorizer:
+		return s.AuthorizerHandler
+	case RoleFilter:
+		return s.FilterHandler
+	}
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) trackListener(ln net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackListener(ln net.Listener) {
+	s.mu.Lock()
+	delete(s.listeners, ln)
+	s.mu.Unlock()
+}
+
+func (s *Server) trackConn(c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackConn(c net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+}
@@ -0,0 +1,349 @@
+package fastcgi
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer serves handler on a local listener and returns its address
+func startServer(t testing.TB, srv *Server) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// dialServer connects a client Conn to addr
+func dialServer(t *testing.T, addr string) *Conn {
+	netConn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { netConn.Close() })
+	return NewConn(netConn, 2*time.Second, 2*time.Second)
+}
+
+// sendRequest sends a complete request without body
+func sendRequest(t *testing.T, c *Conn, requestID uint16, keepConn bool) {
+	if err := c.SendBeginRequest(requestID, RoleResponder, keepConn); err != nil {
+		t.Fatalf("SendBeginRequest: %v", err)
+	}
+	c.SendParams(requestID, map[string]string{"SCRIPT_NAME": "/test"})
+	c.SendParams(requestID, nil)
+	c.SendStdin(requestID, nil)
+}
+
+// readResponse reads records until EndRequest and returns stdout
+func readResponse(t *testing.T, c *Conn) string {
+	var stdout []byte
+	for {
+		record, err := c.ReadRecord()
+		if err != nil {
+			t.Fatalf("ReadRecord: %v", err)
+		}
+		switch record.Header.Type {
+		case TypeStdout:
+			stdout = append(stdout, record.Content...)
+		case TypeEndRequest:
+			return string(stdout)
+		}
+	}
+}
+
+func TestServerKeepConn(t *testing.T) {
+	srv := &Server{Handler: &EchoHandler{}, ReadTimeout: 2 * time.Second, WriteTimeout: 2 * time.Second}
+	client := dialServer(t, startServer(t, srv))
+
+	for i := uint16(1); i <= 2; i++ {
+		sendRequest(t, client, i, true)
+		if out := readResponse(t, client); out == "" {
+			t.Fatalf("request %d: empty response", i)
+		}
+	}
+}
+
+func TestServerAbortCancelsContext(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+
+	srv := &Server{
+		Handler: HandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+			close(started)
+			select {
+			case <-ctx.Done():
+				close(canceled)
+			case <-time.After(2 * time.Second):
+			}
+			return conn.SendEndRequest(req.RequestID, 1, uint8(StatusRequestComplete))
+		}),
+	}
+	client := dialServer(t, startServer(t, srv))
+
+	sendRequest(t, client, 1, true)
+	<-started
+	if err := client.SendAbortRequest(1); err != nil {
+		t.Fatalf("SendAbortRequest: %v", err)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("request context not canceled after FCGI_ABORT_REQUEST")
+	}
+	readResponse(t, client)
+}
+
+func TestServerGetValues(t *testing.T) {
+	srv := &Server{Handler: &EchoHandler{}, Values: map[string]string{ValueMpxsConns: "0"}}
+	client := dialServer(t, startServer(t, srv))
+
+	values, err := client.GetValues(ValueMpxsConns)
+	if err != nil {
+		t.Fatalf("GetValues: %v", err)
+	}
+	if values[ValueMpxsConns] != "0" {
+		t.Errorf("%s = %q, want 0", ValueMpxsConns, values[ValueMpxsConns])
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	srv := &Server{Handler: &EchoHandler{}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	time.Sleep(20 * time.Millisecond)
+	srv.Close()
+
+	select {
+	case err := <-done:
+		if err != ErrServerClosed {
+			t.Errorf("Serve returned %v, want ErrServerClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+}
+
+func TestServerRequestTimeout(t *testing.T) {
+	result := make(chan error, 1)
+
+	srv := &Server{
+		RequestTimeout: 50 * time.Millisecond,
+		Handler: HandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+			<-ctx.Done()
+			result <- ctx.Err()
+			return conn.SendEndRequest(req.RequestID, 1, uint8(StatusRequestComplete))
+		}),
+	}
+	client := dialServer(t, startServer(t, srv))
+
+	sendRequest(t, client, 1, true)
+	select {
+	case err := <-result:
+		if err != context.DeadlineExceeded {
+			t.Errorf("context error = %v, want DeadlineExceeded", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request context not canceled after RequestTimeout")
+	}
+	readResponse(t, client)
+}
+
+func TestServerCloseCancelsRequests(t *testing.T) {
+	started := make(chan struct{})
+	result := make(chan error, 1)
+
+	srv := &Server{
+		Handler: HandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+			close(started)
+			<-ctx.Done()
+			result <- ctx.Err()
+			return nil
+		}),
+	}
+	client := dialServer(t, startServer(t, srv))
+
+	sendRequest(t, client, 1, true)
+	<-started
+
+	closed := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(closed)
+	}()
+
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("context error = %v, want Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request context not canceled by Close")
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return")
+	}
+}
+
+// readEnd reads records until EndRequest and returns stdout and the end body
+func readEnd(t *testing.T, c *Conn) (string, *EndRequestBody) {
+	var stdout []byte
+	for {
+		record, err := c.ReadRecord()
+		if err != nil {
+			t.Fatalf("ReadRecord: %v", err)
+		}
+		switch record.Header.Type {
+		case TypeStdout:
+			stdout = append(stdout, record.Content...)
+		case TypeEndRequest:
+			body, err := DecodeEndRequestBody(record.Content)
+			if err != nil {
+				t.Fatalf("DecodeEndRequestBody: %v", err)
+			}
+			return string(stdout), body
+		}
+	}
+}
+
+func TestServerAuthorizer(t *testing.T) {
+	srv := &Server{
+		AuthorizerHandler: HandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+			if req.Params["HTTP_AUTHORIZATION"] == "Bearer secret" {
+				return conn.SendAuthorizerResponse(req.RequestID, 200, map[string]string{"USER": "alice"}, nil, nil)
+			}
+			return conn.SendAuthorizerResponse(req.RequestID, 401, nil, map[string]string{"WWW-Authenticate": "Bearer"}, []byte("denied"))
+		}),
+	}
+	client := dialServer(t, startServer(t, srv))
+
+	tests := []struct {
+		auth string
+		want string
+	}{
+		{"Bearer secret", "Status: 200 OK\r\nVariable-USER: alice\r\n\r\n"},
+		{"Bearer wrong", "Status: 401 Unauthorized\r\nWWW-Authenticate: Bearer\r\n\r\ndenied"},
+	}
+	for i, tt := range tests {
+		requestID := uint16(i + 1)
+		// Authorizer requests carry params only, no stdin
+		client.SendBeginRequest(requestID, RoleAuthorizer, true)
+		client.SendParams(requestID, map[string]string{"HTTP_AUTHORIZATION": tt.auth})
+		client.SendParams(requestID, nil)
+
+		out, end := readEnd(t, client)
+		if out != tt.want {
+			t.Errorf("authorizer response = %q, want %q", out, tt.want)
+		}
+		if end.ProtocolStatus != uint8(StatusRequestComplete) {
+			t.Errorf("protocol status = %d, want %d", end.ProtocolStatus, StatusRequestComplete)
+		}
+	}
+}
+
+func TestServerFilter(t *testing.T) {
+	srv := &Server{
+		FilterHandler: HandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+			out := "Content-Type: text/plain\r\n\r\n" + strings.ToUpper(string(req.Data))
+			if err := conn.SendStdout(req.RequestID, []byte(out)); err != nil {
+				return err
+			}
+			return conn.SendEndRequest(req.RequestID, 0, uint8(StatusRequestComplete))
+		}),
+	}
+	client := dialServer(t, startServer(t, srv))
+
+	data := []byte("filtered file content")
+	client.SendBeginRequest(1, RoleFilter, false)
+	client.SendParams(1, map[string]string{"FCGI_DATA_LENGTH": strconv.Itoa(len(data))})
+	client.SendParams(1, nil)
+	client.SendStdin(1, nil)
+	client.SendData(1, data)
+
+	out, _ := readEnd(t, client)
+	if want := "Content-Type: text/plain\r\n\r\nFILTERED FILE CONTENT"; out != want {
+		t.Errorf("filter response = %q, want %q", out, want)
+	}
+}
+
+func TestServerUnknownRole(t *testing.T) {
+	// Only a Responder handler, Filter requests are rejected
+	srv := &Server{Handler: &EchoHandler{}}
+	client := dialServer(t, startServer(t, srv))
+
+	client.SendBeginRequest(1, RoleFilter, true)
+	client.SendParams(1, nil)
+	client.SendStdin(1, nil)
+	client.SendData(1, nil)
+
+	_, end := readEnd(t, client)
+	if end.ProtocolStatus != uint8(StatusUnknownRole) {
+		t.Errorf("protocol status = %d, want %d", end.ProtocolStatus, StatusUnknownRole)
+	}
+
+	// The connection stays usable for a Responder request
+	sendRequest(t, client, 2, false)
+	if out := readResponse(t, client); out == "" {
+		t.Error("empty response after unknown role")
+	}
+}
+
+func TestServerPipelinedRecordSplit(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := &Server{
+		Handler: HandlerFunc(func(ctx context.Context, conn *Conn, req *Request) error {
+			if req.RequestID == 1 {
+				close(started)
+				<-release
+			}
+			return conn.SendResponse(req.RequestID, []byte(req.Params["SCRIPT_NAME"]), nil, 0)
+		}),
+		ReadTimeout: 2 * time.Second,
+	}
+	client := dialServer(t, startServer(t, srv))
+
+	record := func(recordType uint8, requestID uint16, content []byte) []byte {
+		h := Header{Version: Version1, Type: recordType, RequestID: requestID, ContentLength: uint16(len(content))}
+		return append(h.Encode(), content...)
+	}
+	request := func(requestID uint16, scriptName string) []byte {
+		var b []byte
+		b = append(b, record(TypeBeginRequest, requestID, encodeBeginRequest(RoleResponder, true))...)
+		b = append(b, record(TypeParams, requestID, EncodeParams(map[string]string{"SCRIPT_NAME": scriptName}))...)
+		b = append(b, record(TypeParams, requestID, nil)...)
+		return append(b, record(TypeStdin, requestID, nil)...)
+	}
+
+	client.netConn.Write(request(1, "/first"))
+	<-started
+
+	// The second request arrives while the first is served, cut off in the
+	// middle of its params record when the first one ends
+	second := request(2, "/second")
+	cut := 2*HeaderSize + 8 + 5
+	client.netConn.Write(second[:cut])
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if out := readResponse(t, client); out != "/first" {
+		t.Fatalf("first response = %q, want /first", out)
+	}
+	time.Sleep(50 * time.Millisecond)
+	client.netConn.Write(second[cut:])
+	if out := readResponse(t, client); out != "/second" {
+		t.Fatalf("second response = %q, want /second", out)
+	}
+}
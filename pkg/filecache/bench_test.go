@@ -0,0 +1,89 @@
+package filecache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// BenchmarkServe compares http.ServeFile with the cache over a real
+// connection, where responses from the cache are sent with sendfile
+func BenchmarkServe(b *testing.B) {
+	for _, size := range []int{512, 64 * 1024, 1024 * 1024} {
+		dir := b.TempDir()
+		path := filepath.Join(dir, "asset.bin")
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			b.Fatal(err)
+		}
+		cache := New(Options{})
+		handlers := []struct {
+			name    string
+			handler http.HandlerFunc
+		}{
+			{"ServeFile", func(w http.ResponseWriter, r *http.Request) {
+				if info, err := os.Stat(path); err != nil || info.IsDir() {
+					http.NotFound(w, r)
+					return
+				}
+				http.ServeFile(w, r, path)
+			}},
+			{"Cache", func(w http.ResponseWriter, r *http.Request) {
+				if info, _ := cache.Stat(path); info == nil {
+					http.NotFound(w, r)
+					return
+				}
+				cache.ServeFile(w, r, path)
+			}},
+		}
+		for _, h := range handlers {
+			b.Run(h.name+"/"+byteSize(size), func(b *testing.B) {
+				server := httptest.NewServer(h.handler)
+				defer server.Close()
+				client := server.Client()
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					resp, err := client.Get(server.URL + "/asset.bin")
+					if err != nil {
+						b.Fatal(err)
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkStat compares the lookup of a static file, as done for every
+// request before it is proxied, with os.Stat
+func BenchmarkStat(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "public", "missing.js")
+	b.Run("os.Stat", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			os.Stat(path)
+		}
+	})
+	b.Run("Cache", func(b *testing.B) {
+		cache := New(Options{})
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cache.Stat(path)
+		}
+	})
+}
+
+func byteSize(n int) string {
+	switch {
+	case n >= 1024*1024:
+		return strconv.Itoa(n/(1024*1024)) + "MB"
+	case n >= 1024:
+		return strconv.Itoa(n/1024) + "KB"
+	}
+	return strconv.Itoa(n) + "B"
+}
@@ -0,0 +1,230 @@
+// Package filecache serves static files without a stat and an open on every
+// request: an LRU of file metadata, missing files included, and of open
+// handles that are reused by the next request. Files are served with
+// http.ServeContent from the handle, so plain HTTP responses are sent with
+// sendfile. Entries stay until Invalidate is called for their path.
+package filecache
+
+import (
+	"container/list"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Defaults of Options
+const (
+	DefaultMaxEntries = 4096
+	DefaultMaxOpen    = 256
+)
+
+// Options limits the size of a cache
+type Options struct {
+	MaxEntries int // Paths remembered, found or not (default: DefaultMaxEntries)
+	MaxOpen    int // Handles kept open between requests (default: DefaultMaxOpen)
+}
+
+// Cache remembers the files at paths and keeps them open
+type Cache struct {
+	opts Options
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // Of *entry, most recently used first
+	gen     uint64     // Incremented by Invalidate, a lookup racing it is not kept
+
+	open atomic.Int64 // Idle handles of all entries
+}
+
+// entry is a path and the file found there, with its idle handles
+type entry struct {
+	path string
+	info os.FileInfo // nil when there is no file
+
+	mu      sync.Mutex
+	idle    []*os.File
+	dropped bool // Removed from the cache, handles are closed when released
+}
+
+// New returns an empty cache
+func New(opts Options) *Cache {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultMaxEntries
+	}
+	if opts.MaxOpen <= 0 {
+		opts.MaxOpen = DefaultMaxOpen
+	}
+	return &Cache{opts: opts, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// Stat returns the metadata of the file at path, nil when there is none or
+// it is a directory, and whether it came from the cache
+func (c *Cache) Stat(path string) (os.FileInfo, bool) {
+	e, cached := c.lookup(path)
+	return e.info, cached
+}
+
+// ServeFile serves the file at path like http.ServeFile, from a cached
+// handle. Requests that http.ServeFile handles specially, with ".." in the
+// path or for an index.html, are passed to it.
+func (c *Cache) ServeFile(w http.ResponseWriter, r *http.Request, path string) {
+	if strings.HasSuffix(r.URL.Path, "/index.html") || containsDotDot(r.URL.Path) {
+		http.ServeFile(w, r, path)
+		return
+	}
+	e, _ := c.lookup(path)
+	if e.info == nil {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := c.take(e)
+	if err != nil {
+		// Removed since the lookup, before its event arrived
+		c.Invalidate(path)
+		http.ServeFile(w, r, path)
+		return
+	}
+	defer c.release(e, f)
+	http.ServeContent(w, r, e.info.Name(), e.info.ModTime(), f)
+}
+
+// Invalidate forgets path and all paths below it, a file that changed is
+// looked up again on its next request
+func (c *Cache) Invalidate(path string) {
+	prefix := strings.TrimSuffix(path, string(os.PathSeparator)) + string(os.PathSeparator)
+	c.mu.Lock()
+	c.gen++
+	var dropped []*entry
+	for p, el := range c.entries {
+		if p == path || strings.HasPrefix(p, prefix) {
+			dropped = append(dropped, c.remove(el))
+		}
+	}
+	c.mu.Unlock()
+	for _, e := range dropped {
+		c.drop(e)
+	}
+}
+
+// Purge forgets all paths and closes the idle handles
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	c.gen++
+	var dropped []*entry
+	for _, el := range c.entries {
+		dropped = append(dropped, c.remove(el))
+	}
+	c.mu.Unlock()
+	for _, e := range dropped {
+		c.drop(e)
+	}
+}
+
+// Len returns the number of paths remembered
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Open returns the number of idle handles
+func (c *Cache) Open() int {
+	return int(c.open.Load())
+}
+
+// lookup returns the entry of path, stat-ing it when it is not cached
+func (c *Cache) lookup(path string) (*entry, bool) {
+	c.mu.Lock()
+	if el, ok := c.entries[path]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*entry), true
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	e := &entry{path: path}
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		e.info = info
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[path]; ok {
+		return el.Value.(*entry), false
+	}
+	if gen != c.gen {
+		// Invalidated while it was looked up, the result may be stale
+		return e, false
+	}
+	c.entries[path] = c.lru.PushFront(e)
+	for c.lru.Len() > c.opts.MaxEntries {
+		c.drop(c.remove(c.lru.Back()))
+	}
+	return e, false
+}
+
+// remove takes an entry out of the cache, c.mu is held
+func (c *Cache) remove(el *list.Element) *entry {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.path)
+	return e
+}
+
+// drop closes the idle handles of a removed entry
+func (c *Cache) drop(e *entry) {
+	e.mu.Lock()
+	idle := e.idle
+	e.idle = nil
+	e.dropped = true
+	e.mu.Unlock()
+	c.open.Add(-int64(len(idle)))
+	for _, f := range idle {
+		f.Close()
+	}
+}
+
+// take returns an idle handle of an entry, or opens a new one
+func (c *Cache) take(e *entry) (*os.File, error) {
+	e.mu.Lock()
+	if n := len(e.idle); n > 0 {
+		f := e.idle[n-1]
+		e.idle = e.idle[:n-1]
+		e.mu.Unlock()
+		c.open.Add(-1)
+		return f, nil
+	}
+	e.mu.Unlock()
+	return os.Open(e.path)
+}
+
+// release keeps a handle for the next request, unless the entry was
+// dropped or the cache has MaxOpen handles
+func (c *Cache) release(e *entry, f *os.File) {
+	e.mu.Lock()
+	if !e.dropped {
+		if c.open.Add(1) <= int64(c.opts.MaxOpen) {
+			e.idle = append(e.idle, f)
+			e.mu.Unlock()
+			return
+		}
+		c.open.Add(-1)
+	}
+	e.mu.Unlock()
+	f.Close()
+}
+
+// containsDotDot tells whether a URL path has a ".." element
+func containsDotDot(path string) bool {
+	if !strings.Contains(path, "..") {
+		return false
+	}
+	for _, element := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if element == ".." {
+			return true
+		}
+	}
+	return false
+}
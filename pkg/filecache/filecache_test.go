@@ -0,0 +1,169 @@
+package filecache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serve(c *Cache, urlPath, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	c.ServeFile(rec, httptest.NewRequest(http.MethodGet, urlPath, nil), path)
+	return rec
+}
+
+func TestServeFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.css")
+	writeFile(t, path, "body{}")
+	c := New(Options{})
+
+	for i := 0; i < 3; i++ {
+		rec := serve(c, "/app.css", path)
+		if rec.Code != http.StatusOK || rec.Body.String() != "body{}" {
+			t.Fatalf("request %d: got %d %q", i, rec.Code, rec.Body.String())
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "text/css; charset=utf-8" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+	}
+	if c.Open() != 1 {
+		t.Errorf("Open() = %d, want the handle kept for the next request", c.Open())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/app.css", nil)
+	req.Header.Set("Range", "bytes=1-3")
+	rec := httptest.NewRecorder()
+	c.ServeFile(rec, req, path)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "ody" {
+		t.Errorf("range: got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStatCachesMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "late.js")
+	c := New(Options{})
+
+	if info, cached := c.Stat(path); info != nil || cached {
+		t.Fatalf("Stat() = %v, %v, want nil, false", info, cached)
+	}
+	writeFile(t, path, "x")
+	if info, cached := c.Stat(path); info != nil || !cached {
+		t.Fatalf("Stat() = %v, %v, want the cached miss", info, cached)
+	}
+	c.Invalidate(path)
+	if info, cached := c.Stat(path); info == nil || cached {
+		t.Fatalf("Stat() after Invalidate = %v, %v, want the file", info, cached)
+	}
+	if info, _ := c.Stat(dir); info != nil {
+		t.Errorf("Stat(dir) = %v, want nil for directories", info)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "js", "app.js")
+	other := filepath.Join(dir, "jsx")
+	writeFile(t, path, "one")
+	writeFile(t, other, "other")
+	c := New(Options{})
+	serve(c, "/js/app.js", path)
+	serve(c, "/jsx", other)
+
+	// Replaced like an editor or deploy does, the old handle is stale
+	tmp := filepath.Join(dir, "tmp")
+	writeFile(t, tmp, "two")
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	if body := serve(c, "/js/app.js", path).Body.String(); body != "one" {
+		t.Fatalf("before Invalidate: got %q, want the cached handle", body)
+	}
+
+	c.Invalidate(filepath.Join(dir, "js"))
+	if body := serve(c, "/js/app.js", path).Body.String(); body != "two" {
+		t.Errorf("after Invalidate: got %q, want %q", body, "two")
+	}
+	if _, cached := c.Stat(other); !cached {
+		t.Errorf("Invalidate of a directory dropped a sibling with the same prefix")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	dir := t.TempDir()
+	c := New(Options{MaxEntries: 2, MaxOpen: 1})
+	var paths []string
+	for _, name := range []string{"a", "b", "c"} {
+		path := filepath.Join(dir, name)
+		writeFile(t, path, name)
+		paths = append(paths, path)
+		serve(c, "/"+name, path)
+	}
+	if c.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", c.Len())
+	}
+	if c.Open() != 1 {
+		t.Errorf("Open() = %d, want MaxOpen", c.Open())
+	}
+	if _, cached := c.Stat(paths[0]); cached {
+		t.Errorf("least recently used path is still cached")
+	}
+	c.Purge()
+	if c.Len() != 0 || c.Open() != 0 {
+		t.Errorf("after Purge: Len() = %d, Open() = %d", c.Len(), c.Open())
+	}
+}
+
+func TestServeFileLikeServeFile(t *testing.T) {
+	dir := t.TempDir()
+	index := filepath.Join(dir, "index.html")
+	writeFile(t, index, "<p>home</p>")
+	c := New(Options{})
+
+	rec := serve(c, "/docs/index.html", index)
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "./" {
+		t.Errorf("index.html: got %d to %q, want the redirect of http.ServeFile", rec.Code, rec.Header().Get("Location"))
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.URL.Path = "/../index.html"
+	rec = httptest.NewRecorder()
+	c.ServeFile(rec, req, index)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("path with ..: got %d, want 400", rec.Code)
+	}
+
+	missing := filepath.Join(dir, "missing.txt")
+	if rec := serve(c, "/missing.txt", missing); rec.Code != http.StatusNotFound {
+		t.Errorf("missing file: got %d, want 404", rec.Code)
+	}
+
+	// Removed before its invalidation arrived
+	gone := filepath.Join(dir, "gone.txt")
+	writeFile(t, gone, "x")
+	c.Stat(gone)
+	os.Remove(gone)
+	if rec := serve(c, "/gone.txt", gone); rec.Code != http.StatusNotFound {
+		t.Errorf("removed file: got %d, want 404", rec.Code)
+	}
+	if _, cached := c.Stat(gone); cached {
+		t.Errorf("removed file is still cached")
+	}
+	body, _ := io.ReadAll(serve(c, "/index.htm", index).Body)
+	if string(body) != "<p>home</p>" {
+		t.Errorf("got %q", body)
+	}
+}
@@ -0,0 +1,270 @@
+// Package logrotate provides a log file writer with date and size based
+// rotation, retention limits and optional gzip compression of rotated files.
+package logrotate
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DatePlaceholder in a path is replaced by the current date, a new file is
+// started when the date changes
+const DatePlaceholder = "{date}"
+
+// Options controls rotation and retention
+type Options struct {
+	MaxSize  int64         // Rotate when a file would exceed this size in bytes (0 = no limit)
+	MaxAge   time.Duration // Remove rotated files older than this (0 = keep)
+	MaxFiles int           // Rotated files to keep (0 = all)
+	Compress bool          // Gzip rotated files
+}
+
+// Writer writes to a log file that is rotated when its date changes or it
+// reaches its maximum size. Rotated files are compressed and pruned in the
+// background.
+type Writer struct {
+	pattern string
+	opts    Options
+	now     func() time.Time
+
+	mu   sync.Mutex
+	file *os.File
+	path string
+	size int64
+
+	millMu sync.Mutex
+	wg     sync.WaitGroup
+}
+
+// New opens the log file for a path, which may contain DatePlaceholder
+func New(pattern string, opts Options) (*Writer, error) {
+	w := &Writer{pattern: pattern, opts: opts, now: time.Now}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Path returns the path of the current log file
+func (w *Writer) Path() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.path
+}
+
+// Write appends to the current file, rotating it first when needed
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if w.currentPath() != w.path {
+		// The file of the previous date is kept under its name
+		w.file.Close()
+		w.file = nil
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	} else if w.opts.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.opts.MaxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate moves the current file aside and starts a new one
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	return w.rotate()
+}
+
+// Close closes the current file and waits for background compression
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	var err error
+	if w.file != nil {
+		err = w.file.Close()
+		w.file = nil
+	}
+	w.mu.Unlock()
+	w.wg.Wait()
+	return err
+}
+
+// currentPath returns the path for the current date
+func (w *Writer) currentPath() string {
+	return strings.ReplaceAll(w.pattern, DatePlaceholder, w.now().Format("2006-01-02"))
+}
+
+// open opens the file for the current date and prunes old files, callers
+// hold w.mu
+func (w *Writer) open() error {
+	path := w.currentPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.path, w.size = f, path, info.Size()
+	w.startMill()
+	return nil
+}
+
+// rotate renames the current file with a timestamp and opens a new one,
+// callers hold w.mu
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	ext := filepath.Ext(w.path)
+	layout := "-2006-01-02T15-04-05.000"
+	if strings.Contains(w.pattern, DatePlaceholder) {
+		layout = "-15-04-05.000"
+	}
+	rotated := strings.TrimSuffix(w.path, ext) + w.now().Format(layout) + ext
+	if err := os.Rename(w.path, rotated); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// startMill compresses and prunes rotated files in the background, callers
+// hold w.mu
+func (w *Writer) startMill() {
+	if !w.opts.Compress && w.opts.MaxAge <= 0 && w.opts.MaxFiles <= 0 {
+		return
+	}
+	current := w.path
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.millMu.Lock()
+		defer w.millMu.Unlock()
+		if err := w.mill(current); err != nil {
+			log.Printf("logrotate: %v", err)
+		}
+	}()
+}
+
+// mill compresses the rotated files and removes the ones beyond the limits
+func (w *Writer) mill(current string) error {
+	files, err := w.rotatedFiles(current)
+	if err != nil {
+		return err
+	}
+
+	cutoff := w.now().Add(-w.opts.MaxAge)
+	for i, file := range files {
+		expired := w.opts.MaxAge > 0 && file.ModTime().Before(cutoff)
+		if expired || (w.opts.MaxFiles > 0 && i >= w.opts.MaxFiles) {
+			if err := os.Remove(file.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if w.opts.Compress && !strings.HasSuffix(file.path, ".gz") {
+			if err := compress(file.path, file.ModTime()); err != nil {
+				return fmt.Errorf("compress %s: %w", file.path, err)
+			}
+		}
+	}
+	return nil
+}
+
+type rotatedFile struct {
+	os.FileInfo
+	path string
+}
+
+// rotatedFiles lists the files of the pattern besides the current one,
+// newest first
+func (w *Writer) rotatedFiles(current string) ([]rotatedFile, error) {
+	dir := filepath.Dir(w.pattern)
+	base := filepath.Base(w.pattern)
+	ext := filepath.Ext(base)
+	prefix, _, _ := strings.Cut(strings.TrimSuffix(base, ext), DatePlaceholder)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []rotatedFile
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(dir, name)
+		if path == current || entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if !strings.HasSuffix(name, ext) && !strings.HasSuffix(name, ext+".gz") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, rotatedFile{FileInfo: info, path: path})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+	return files, nil
+}
+
+// compress gzips a file next to it and removes the original
+func compress(path string, modTime time.Time) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	// Keep the age of the rotated file for retention
+	os.Chtimes(path+".gz", modTime, modTime)
+	src.Close()
+	return os.Remove(path)
+}
@@ -0,0 +1,136 @@
+package logrotate
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestWriter returns a writer with a clock the test controls
+func newTestWriter(t *testing.T, pattern string, opts Options, now *time.Time) *Writer {
+	t.Helper()
+	w := &Writer{pattern: pattern, opts: opts, now: func() time.Time { return *now }}
+	w.mu.Lock()
+	err := w.open()
+	w.mu.Unlock()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotateOnDateChange(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 10, 16, 23, 59, 0, 0, time.UTC)
+	w := newTestWriter(t, filepath.Join(dir, "socks5_{date}.log"), Options{}, &now)
+
+	w.Write([]byte("first\n"))
+	now = now.Add(2 * time.Minute)
+	w.Write([]byte("second\n"))
+
+	if got := filepath.Base(w.Path()); got != "socks5_2026-10-17.log" {
+		t.Errorf("path = %s, want socks5_2026-10-17.log", got)
+	}
+	names := listDir(t, dir)
+	if len(names) != 2 || names[0] != "socks5_2026-10-16.log" {
+		t.Errorf("files = %v", names)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "socks5_2026-10-16.log"))
+	if string(data) != "first\n" {
+		t.Errorf("old file = %q, want %q", data, "first\n")
+	}
+}
+
+func TestRotateOnSize(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	w := newTestWriter(t, filepath.Join(dir, "socks5_{date}.log"), Options{MaxSize: 10}, &now)
+
+	w.Write([]byte("12345678\n"))
+	now = now.Add(time.Second)
+	w.Write([]byte("abc\n"))
+
+	names := listDir(t, dir)
+	want := []string{"socks5_2026-10-16-12-00-01.000.log", "socks5_2026-10-16.log"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("files = %v, want %v", names, want)
+	}
+	data, _ := os.ReadFile(w.Path())
+	if string(data) != "abc\n" {
+		t.Errorf("current file = %q, want %q", data, "abc\n")
+	}
+}
+
+func TestRetentionAndCompression(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	// Rotated files of earlier days, the oldest beyond the maximum age
+	for _, day := range []int{1, 13, 14, 15} {
+		path := filepath.Join(dir, fmt.Sprintf("app_2026-10-%02d.log", day))
+		os.WriteFile(path, []byte("old\n"), 0644)
+		modTime := time.Date(2026, 10, day, 23, 0, 0, 0, time.UTC)
+		os.Chtimes(path, modTime, modTime)
+	}
+	os.WriteFile(filepath.Join(dir, "other.log"), []byte("keep\n"), 0644)
+
+	w := newTestWriter(t, filepath.Join(dir, "app_{date}.log"), Options{
+		MaxAge:   7 * 24 * time.Hour,
+		MaxFiles: 2,
+		Compress: true,
+	}, &now)
+	w.Write([]byte("new\n"))
+	w.wg.Wait()
+
+	names := listDir(t, dir)
+	want := []string{"app_2026-10-14.log.gz", "app_2026-10-15.log.gz", "app_2026-10-16.log", "other.log"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("files = %v, want %v", names, want)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "app_2026-10-15.log.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(gz)
+	if string(data) != "old\n" {
+		t.Errorf("decompressed = %q, want %q", data, "old\n")
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	w, err := New(filepath.Join(t.TempDir(), "app.log"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err := w.Write([]byte("x")); err == nil {
+		t.Error("write after close succeeded")
+	}
+}
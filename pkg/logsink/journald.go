@@ -0,0 +1,105 @@
+package logsink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JournalSocket is the native protocol socket of systemd-journald
+const JournalSocket = "/run/systemd/journal/socket"
+
+// JournaldOptions configures a journald sink
+type JournaldOptions struct {
+	Socket     string            // Default: JournalSocket
+	Identifier string            // SYSLOG_IDENTIFIER of the entries
+	Fields     map[string]string // Extra fields, names in upper case, e.g. "TQSERVER_WORKER"
+}
+
+// Journald sends entries to the systemd journal over its native protocol,
+// so priorities and fields are kept
+type Journald struct {
+	conn   *net.UnixConn
+	prefix []byte // Encoded identifier and extra fields
+}
+
+// NewJournald connects to the journal socket
+func NewJournald(opts JournaldOptions) (*Journald, error) {
+	if opts.Socket == "" {
+		opts.Socket = JournalSocket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: opts.Socket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("journald: %w", err)
+	}
+	j := &Journald{conn: conn}
+
+	var prefix bytes.Buffer
+	if opts.Identifier != "" {
+		writeField(&prefix, "SYSLOG_IDENTIFIER", opts.Identifier)
+	}
+	names := make([]string, 0, len(opts.Fields))
+	for name := range opts.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !validFieldName(name) {
+			conn.Close()
+			return nil, fmt.Errorf("journald: invalid field name %q", name)
+		}
+		writeField(&prefix, name, opts.Fields[name])
+	}
+	j.prefix = prefix.Bytes()
+	return j, nil
+}
+
+// Log sends an entry
+func (j *Journald) Log(priority Priority, message string) error {
+	var entry bytes.Buffer
+	entry.Write(j.prefix)
+	writeField(&entry, "PRIORITY", strconv.Itoa(int(priority)))
+	writeField(&entry, "MESSAGE", strings.TrimRight(message, "\n"))
+	if _, err := j.conn.Write(entry.Bytes()); err != nil {
+		return fmt.Errorf("journald: %w", err)
+	}
+	return nil
+}
+
+// Close closes the socket
+func (j *Journald) Close() error {
+	return j.conn.Close()
+}
+
+// writeField encodes a field, values with newlines get an explicit length
+func writeField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// validFieldName reports whether a name is a valid user field: upper case
+// letters, digits and underscores, not starting with an underscore
+func validFieldName(name string) bool {
+	if name == "" || name[0] == '_' || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
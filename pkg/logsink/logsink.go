@@ -0,0 +1,120 @@
+// Package logsink writes log lines to syslog (RFC 5424) or the systemd
+// journal, each with a priority.
+package logsink
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Priority is the severity of a message, as in syslog
+type Priority int
+
+// Priorities from most to least severe
+const (
+	Emerg Priority = iota
+	Alert
+	Crit
+	Err
+	Warning
+	Notice
+	Info
+	Debug
+)
+
+// Sink is a destination for log messages
+type Sink interface {
+	Log(priority Priority, message string) error
+	Close() error
+}
+
+// Writer adapts a sink to an io.Writer, writing a message per line with the
+// priority the classifier assigns to it. Several writers may share a sink.
+type Writer struct {
+	sink     Sink
+	classify func(line string) Priority
+	mu       sync.Mutex
+	buf      []byte
+}
+
+// NewWriter creates a writer, classify may be nil for Classify
+func NewWriter(sink Sink, classify func(line string) Priority) *Writer {
+	if classify == nil {
+		classify = Classify
+	}
+	return &Writer{sink: sink, classify: classify}
+}
+
+// Write sends the complete lines and keeps the last partial line
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(w.buf[:i]), "\r")
+		w.buf = w.buf[i+1:]
+		if line == "" {
+			continue
+		}
+		if err := w.sink.Log(w.classify(line), line); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends the partial line, if any
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) == 0 {
+		return nil
+	}
+	line := string(w.buf)
+	w.buf = nil
+	return w.sink.Log(w.classify(line), line)
+}
+
+// Classify guesses the priority of a plain log line from its words, like
+// "PHP Fatal error", "panic:" or "failed"
+func Classify(line string) Priority {
+	lower := strings.ToLower(line)
+	switch {
+	case strings.Contains(lower, "panic:") || strings.Contains(lower, "fatal"):
+		return Crit
+	case strings.Contains(lower, "error") || strings.Contains(lower, "failed") || strings.Contains(lower, "❌"):
+		return Err
+	case strings.Contains(lower, "warning") || strings.Contains(lower, "deprecated") || strings.Contains(lower, "⚠"):
+		return Warning
+	case strings.Contains(lower, "notice"):
+		return Notice
+	}
+	return Info
+}
+
+// facilities are the syslog facility codes by name
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// ParseFacility returns the code of a syslog facility name, "" is "daemon"
+func ParseFacility(name string) (int, error) {
+	if name == "" {
+		return facilities["daemon"], nil
+	}
+	code, ok := facilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility %q", name)
+	}
+	return code, nil
+}
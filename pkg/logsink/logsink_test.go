@@ -0,0 +1,144 @@
+package logsink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingSink struct {
+	priorities []Priority
+	messages   []string
+}
+
+func (s *recordingSink) Log(priority Priority, message string) error {
+	s.priorities = append(s.priorities, priority)
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+func TestWriterSplitsLines(t *testing.T) {
+	sink := &recordingSink{}
+	w := NewWriter(sink, nil)
+	w.Write([]byte("started\nPHP Warning: x"))
+	w.Write([]byte(" undefined\r\n\nfailed to connect\npartial"))
+	w.Flush()
+
+	want := []string{"started", "PHP Warning: x undefined", "failed to connect", "partial"}
+	if strings.Join(sink.messages, "|") != strings.Join(want, "|") {
+		t.Fatalf("messages = %q, want %q", sink.messages, want)
+	}
+	wantPriorities := []Priority{Info, Warning, Err, Info}
+	for i, p := range wantPriorities {
+		if sink.priorities[i] != p {
+			t.Errorf("priority of %q = %d, want %d", sink.messages[i], sink.priorities[i], p)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	for line, want := range map[string]Priority{
+		"PHP Fatal error:  Uncaught Error":  Crit,
+		"panic: runtime error":              Crit,
+		"Failed to start worker api":        Err,
+		"PHP Deprecated: function":          Warning,
+		"PHP Notice: Undefined index":       Notice,
+		"Worker instance api-9000 is ready": Info,
+	} {
+		if got := Classify(line); got != want {
+			t.Errorf("Classify(%q) = %d, want %d", line, got, want)
+		}
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	facility, _ := ParseFacility("local0")
+	s, err := NewSyslog(SyslogOptions{
+		Network:  "udp",
+		Address:  conn.LocalAddr().String(),
+		Facility: facility,
+		AppName:  "tqserver-api",
+		Hostname: "web 1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Log(Warning, "slow request\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// local0 (16) * 8 + warning (4) = 132
+	pattern := regexp.MustCompile(`^<132>1 \d{4}-\d\d-\d\dT\S+ web_1 tqserver-api \d+ - - slow request$`)
+	if !pattern.Match(buf[:n]) {
+		t.Errorf("message = %q", buf[:n])
+	}
+}
+
+func TestSyslogOctetCounting(t *testing.T) {
+	s := &Syslog{opts: SyslogOptions{Network: "tcp", AppName: "a", Hostname: "h"}, pid: "1"}
+	msg := string(s.format(Info, "hi", time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)))
+	body := "<6>1 2026-10-17T00:00:00.000000Z h a 1 - - hi"
+	if want := "45 " + body; msg != want {
+		t.Errorf("frame = %q, want %q", msg, want)
+	}
+}
+
+func TestJournaldEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skip("unix datagram sockets unavailable:", err)
+	}
+	defer conn.Close()
+
+	j, err := NewJournald(JournaldOptions{
+		Socket:     path,
+		Identifier: "tqserver",
+		Fields:     map[string]string{"TQSERVER_WORKER": "api"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if err := j.Log(Err, "line one\nline two"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	want.WriteString("SYSLOG_IDENTIFIER=tqserver\nTQSERVER_WORKER=api\nPRIORITY=3\nMESSAGE\n")
+	binary.Write(&want, binary.LittleEndian, uint64(len("line one\nline two")))
+	want.WriteString("line one\nline two\n")
+	if !bytes.Equal(buf[:n], want.Bytes()) {
+		t.Errorf("entry = %q, want %q", buf[:n], want.Bytes())
+	}
+
+	if _, err := NewJournald(JournaldOptions{Socket: path, Fields: map[string]string{"_PID": "1"}}); err == nil {
+		t.Error("protected field name accepted")
+	}
+}
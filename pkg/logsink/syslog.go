@@ -0,0 +1,123 @@
+package logsink
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyslogOptions configures a syslog sink
+type SyslogOptions struct {
+	Network  string // "unixgram" (default), "unix", "udp" or "tcp"
+	Address  string // Default: "/dev/log"
+	Facility int    // See ParseFacility
+	AppName  string // Default: the program name
+	Hostname string // Default: the host name
+}
+
+// Syslog sends RFC 5424 messages to a syslog daemon. Stream connections use
+// octet counting framing (RFC 6587).
+type Syslog struct {
+	opts SyslogOptions
+	pid  string
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslog connects to a syslog daemon
+func NewSyslog(opts SyslogOptions) (*Syslog, error) {
+	if opts.Network == "" {
+		opts.Network = "unixgram"
+	}
+	if opts.Address == "" {
+		opts.Address = "/dev/log"
+	}
+	if opts.AppName == "" {
+		opts.AppName = os.Args[0]
+	}
+	if opts.Hostname == "" {
+		opts.Hostname, _ = os.Hostname()
+	}
+	s := &Syslog{opts: opts, pid: fmt.Sprint(os.Getpid())}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Syslog) connect() error {
+	conn, err := net.DialTimeout(s.opts.Network, s.opts.Address, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("syslog: %w", err)
+	}
+	s.conn = conn
+	return nil
+}
+
+// Log sends a message, reconnecting once when the daemon went away
+func (s *Syslog) Log(priority Priority, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg := s.format(priority, message, time.Now())
+	if s.conn != nil {
+		if _, err := s.conn.Write(msg); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+// format builds the message, with the frame of stream connections
+func (s *Syslog) format(priority Priority, message string, now time.Time) []byte {
+	msg := fmt.Sprintf("<%d>1 %s %s %s %s - - %s",
+		s.opts.Facility*8+int(priority),
+		now.Format("2006-01-02T15:04:05.000000Z07:00"),
+		headerField(s.opts.Hostname, 255),
+		headerField(s.opts.AppName, 48),
+		s.pid,
+		strings.TrimRight(message, "\n"))
+	if s.opts.Network == "tcp" || s.opts.Network == "unix" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	return []byte(msg)
+}
+
+// Close closes the connection
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// headerField makes a value fit a header field: printable, without spaces,
+// at most max long and "-" when empty
+func headerField(value string, max int) string {
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(value) > max {
+		value = value[:max]
+	}
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -35,7 +35,8 @@ func GeneratePHPFPMConfig(cfg *php.Config, outDir string) (configPath string, er
 	configTemplate := `[global]
 daemonize = no
 error_log = {{ .ErrorLog }}
-
+{{ if .ControlTimeout }}process_control_timeout = {{ .ControlTimeout }}
+{{ end }}
 [{{ .PoolName }}]
 listen = {{ .Listen }}
 pm = {{ .PM }}
@@ -48,7 +49,9 @@ pm.max_spare_servers = {{ .MaxSpare }}
 process_idle_timeout = {{ .IdleTimeout }}
 {{ end }}pm.max_requests = {{ .MaxRequests }}
 request_terminate_timeout = {{ .RequestTimeout }}
-chdir = {{ .DocumentRoot }}
+{{ if .SlowlogTimeout }}slowlog = {{ .Slowlog }}
+request_slowlog_timeout = {{ .SlowlogTimeout }}
+{{ end }}chdir = {{ .DocumentRoot }}
 {{/* Render PHP INI directives as php_admin_value. */}}
 {{ range $k, $v := .Settings }}php_admin_value[{{ $k }}] = {{ $v }}
 {{ end }}
@@ -61,8 +64,21 @@ chdir = {{ .DocumentRoot }}
 		pm = "dynamic"
 	}
 
+	// php-fpm only writes slowlog traces when both directives are set
+	var slowlogTimeout string
+	if pool.RequestSlowlogTimeout > 0 {
+		slowlogTimeout = fmt.Sprintf("%ds", max(int(pool.RequestSlowlogTimeout.Round(time.Second).Seconds()), 1))
+	}
+
+	// Let workers finish their requests on a graceful reload (SIGUSR2)
+	var controlTimeout string
+	if pool.RequestTerminateTimeout > 0 {
+		controlTimeout = fmt.Sprintf("%ds", int(pool.RequestTerminateTimeout.Round(time.Second).Seconds()))
+	}
+
 	data := map[string]interface{}{
-		"ErrorLog":       filepath.Join(outDir, "php-fpm.error.log"),
+		"ErrorLog":       ErrorLogPath(outDir),
+		"ControlTimeout": controlTimeout,
 		"PoolDir":        poolDir,
 		"PoolName":       pool.Name,
 		"Listen":         cfg.PHPFPM.Listen,
@@ -77,6 +93,8 @@ chdir = {{ .DocumentRoot }}
 		"MaxRequests":    pool.MaxRequests,
 		"RequestTimeout": fmt.Sprintf("%ds", int(pool.RequestTerminateTimeout.Round(time.Second).Seconds())),
 		"IdleTimeout":    fmt.Sprintf("%ds", int(pool.ProcessIdleTimeout.Round(time.Second).Seconds())),
+		"Slowlog":        SlowlogPath(cfg, outDir),
+		"SlowlogTimeout": slowlogTimeout,
 		"DocumentRoot":   cfg.DocumentRoot,
 		// Settings are PHP INI-style directives that should be applied as
 		// php_admin_value[...] in the pool config.
@@ -105,6 +123,21 @@ chdir = {{ .DocumentRoot }}
 	return configPath, nil
 }
 
+// SlowlogPath returns the slowlog file for the pool, the configured path or
+// php-fpm.slow.log in outDir.
+func SlowlogPath(cfg *php.Config, outDir string) string {
+	if cfg.PHPFPM.Pool.Slowlog != "" {
+		return cfg.PHPFPM.Pool.Slowlog
+	}
+	return filepath.Join(outDir, "php-fpm.slow.log")
+}
+
+// ErrorLogPath returns the file php-fpm writes its error log to, including the
+// errors of scripts when PHP has no error_log of its own
+func ErrorLogPath(outDir string) string {
+	return filepath.Join(outDir, "php-fpm.error.log")
+}
+
 func renderToFile(tpl string, data interface{}, path string) error {
 	tt, err := template.New("conf").Parse(tpl)
 	if err != nil {
@@ -0,0 +1,93 @@
+package phpfpm
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"time"
+)
+
+// LogTail follows a php-fpm log file, such as the error log, and passes
+// every new line to OnLine.
+type LogTail struct {
+	// OnLine is called for every new line, without the line ending
+	OnLine func(string)
+
+	path     string
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewLogTail creates a tail of the log file at path
+func NewLogTail(path string) *LogTail {
+	return &LogTail{
+		path:     path,
+		interval: 500 * time.Millisecond,
+	}
+}
+
+// Path returns the log file being followed
+func (t *LogTail) Path() string {
+	return t.path
+}
+
+// Start follows the file from its current end until Stop is called
+func (t *LogTail) Start() {
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+
+	var offset int64
+	if info, err := os.Stat(t.path); err == nil {
+		offset = info.Size()
+	}
+	go t.run(offset)
+}
+
+// Stop stops following the file
+func (t *LogTail) Stop() {
+	if t.stop == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+	t.stop = nil
+}
+
+func (t *LogTail) run(offset int64) {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	var partial []byte
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		data, newOffset, truncated, err := readFrom(t.path, offset)
+		if err != nil {
+			continue
+		}
+		if truncated {
+			partial = nil
+		}
+		offset = newOffset
+
+		partial = append(partial, data...)
+		for {
+			i := bytes.IndexByte(partial, '\n')
+			if i < 0 {
+				break
+			}
+			line := strings.TrimRight(string(partial[:i]), "\r")
+			partial = partial[i+1:]
+			if t.OnLine != nil {
+				t.OnLine(line)
+			}
+		}
+	}
+}
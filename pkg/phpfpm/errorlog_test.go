@@ -0,0 +1,63 @@
+package phpfpm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogTail(t *testing.T) {
+	path := ErrorLogPath(t.TempDir())
+	if err := os.WriteFile(path, []byte("old lines are skipped\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 3)
+	tail := NewLogTail(path)
+	tail.interval = 10 * time.Millisecond
+	tail.OnLine = func(line string) { received <- line }
+	tail.Start()
+	defer tail.Stop()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("[16-Oct-2026 10:00:00] NOTICE: fpm is running\r\n[16-Oct-2026 10:00:01] WARNING: [pool ")
+	f.Sync()
+	time.Sleep(50 * time.Millisecond)
+	f.WriteString("www] child 12 said into stderr\n")
+	f.Close()
+
+	for _, want := range []string{
+		"[16-Oct-2026 10:00:00] NOTICE: fpm is running",
+		"[16-Oct-2026 10:00:01] WARNING: [pool www] child 12 said into stderr",
+	} {
+		select {
+		case line := <-received:
+			if line != want {
+				t.Errorf("line = %q, want %q", line, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no line %q", want)
+		}
+	}
+
+	// A truncated file is read from the start
+	if err := os.WriteFile(path, []byte("new\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-received:
+		if line != "new" {
+			t.Errorf("line after truncation = %q, want %q", line, "new")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no line after truncation")
+	}
+
+	if filepath.Base(tail.Path()) != "php-fpm.error.log" {
+		t.Errorf("path = %s", tail.Path())
+	}
+}
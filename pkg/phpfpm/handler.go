@@ -1,25 +1,31 @@
 package phpfpm
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 
 	"github.com/mevdschee/tqserver/pkg/fastcgi"
 )
 
-// Handler implements fastcgi.Handler by forwarding requests to a php-fpm Client.
+// Handler implements fastcgi.Handler by forwarding requests to php-fpm.
 type Handler struct {
-	client *Client
+	client *fastcgi.Client
 }
 
 // NewHandler creates a new Handler bound to the given Client.
-func NewHandler(c *Client) *Handler {
+func NewHandler(c *fastcgi.Client) *Handler {
 	return &Handler{client: c}
 }
 
-// ServeFastCGI implements fastcgi.Handler by performing a DoRequest on the client
+// ServeFastCGI implements fastcgi.Handler by performing a Do on the client
 // and streaming the returned stdout/stderr back to the FastCGI connection.
-func (h *Handler) ServeFastCGI(conn *fastcgi.Conn, req *fastcgi.Request) error {
-	stdout, stderr, _, err := h.client.DoRequest(req.Params, req.Stdin)
+func (h *Handler) ServeFastCGI(ctx context.Context, conn *fastcgi.Conn, req *fastcgi.Request) error {
+	resp, err := h.client.Do(ctx, req.Params, bytes.NewReader(req.Stdin))
+	if ctx.Err() != nil {
+		// Aborted by the client, timed out or shutting down, end the request without output
+		return conn.SendEndRequest(req.RequestID, 1, uint8(fastcgi.StatusRequestComplete))
+	}
 	if err != nil {
 		// indicate error
 		conn.SendStderr(req.RequestID, []byte(fmt.Sprintf("phpfpm error: %v", err)))
@@ -27,21 +33,6 @@ func (h *Handler) ServeFastCGI(conn *fastcgi.Conn, req *fastcgi.Request) error {
 		return err
 	}
 
-	if len(stdout) > 0 {
-		if err := conn.SendStdout(req.RequestID, stdout); err != nil {
-			return err
-		}
-	}
-	if len(stderr) > 0 {
-		if err := conn.SendStderr(req.RequestID, stderr); err != nil {
-			return err
-		}
-	}
-
-	// End request successfully
-	if err := conn.SendEndRequest(req.RequestID, 0, uint8(fastcgi.StatusRequestComplete)); err != nil {
-		return err
-	}
-
-	return nil
+	// Stdout, stderr and the end request go out in a single write
+	return conn.SendResponse(req.RequestID, resp.Stdout, resp.Stderr, 0)
 }
@@ -1,6 +1,7 @@
 package phpfpm
 
 import (
+	"context"
 	"net"
 	"testing"
 	"time"
@@ -8,14 +9,38 @@ import (
 	"github.com/mevdschee/tqserver/pkg/fastcgi"
 )
 
-// TestEndToEndHandler verifies FastCGI -> Handler -> phpfpm.Client -> backend flow.
+// startBackend serves a FastCGI backend that answers every request with a
+// stdout payload, like php-fpm
+func startBackend(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &fastcgi.Server{
+		Handler: fastcgi.HandlerFunc(func(ctx context.Context, conn *fastcgi.Conn, req *fastcgi.Request) error {
+			if err := conn.SendStdout(req.RequestID, []byte("hello from php-fpm")); err != nil {
+				return err
+			}
+			if err := conn.SendStdout(req.RequestID, nil); err != nil {
+				return err
+			}
+			return conn.SendEndRequest(req.RequestID, 0, uint8(fastcgi.StatusRequestComplete))
+		}),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// TestEndToEndHandler verifies FastCGI -> Handler -> fastcgi.Client -> backend flow.
 func TestEndToEndHandler(t *testing.T) {
 	// start fake backend
-	backendAddr, stopBackend := startFakeFCGIServer(t)
-	defer stopBackend()
+	backendAddr := startBackend(t)
 
 	// create client to backend
-	client := NewClient(backendAddr, "tcp", 1, 2*time.Second, 2*time.Second)
+	client := fastcgi.NewClient(backendAddr, "tcp", 1, 2*time.Second, 2*time.Second)
 	defer client.Close()
 
 	// create handler and start an inline listener to serve FastCGI for the test
@@ -42,7 +67,7 @@ func TestEndToEndHandler(t *testing.T) {
 						c.Close()
 						return
 					}
-					if err := handler.ServeFastCGI(fc, req); err != nil {
+					if err := handler.ServeFastCGI(req.Context(), fc, req); err != nil {
 						c.Close()
 						return
 					}
@@ -9,6 +9,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/mevdschee/tqserver/pkg/config/php"
@@ -23,6 +24,10 @@ type Launcher struct {
 	ctx       context.Context
 	cancel    context.CancelFunc
 	stoppedCh chan error
+
+	// Prepare, if set, is called with the php-fpm command before it starts,
+	// e.g. to run it in a confined filesystem
+	Prepare func(cmd *exec.Cmd) error
 }
 
 // NewLauncher creates a Launcher for the given php.Config. If cfg.PHPFPM.GeneratedConfigDir
@@ -65,6 +70,12 @@ func (l *Launcher) Start() error {
 	if l.cfg.PHPIni != "" {
 		args = append(args, "-c", l.cfg.PHPIni)
 	}
+	if l.cfg.Preload != "" {
+		args = append(args, "-d", "opcache.preload="+l.cfg.Preload)
+		if l.cfg.PreloadUser != "" {
+			args = append(args, "-d", "opcache.preload_user="+l.cfg.PreloadUser)
+		}
+	}
 	if l.cfg.PHPFPM.NoDaemonize {
 		args = append([]string{"-F"}, args...)
 	}
@@ -78,6 +89,12 @@ func (l *Launcher) Start() error {
 		env = append(env, fmt.Sprintf("%s=%s", k, v))
 	}
 	l.cmd.Env = env
+	if l.Prepare != nil {
+		if err := l.Prepare(l.cmd); err != nil {
+			l.cancel()
+			return fmt.Errorf("prepare php-fpm: %w", err)
+		}
+	}
 
 	// attach stdout/stderr for visibility
 	stdout, _ := l.cmd.StdoutPipe()
@@ -149,6 +166,52 @@ func (l *Launcher) Stop(timeout time.Duration) error {
 	}
 }
 
+// Reload gracefully reloads php-fpm by sending SIGUSR2. The master re-reads
+// its configuration and replaces the workers once they finish their current
+// request, which also empties the opcache and runs the preload script again.
+func (l *Launcher) Reload() error {
+	if l.cmd == nil || l.cmd.Process == nil {
+		return fmt.Errorf("php-fpm not running")
+	}
+	if err := l.cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		return fmt.Errorf("reload php-fpm: %w", err)
+	}
+	log.Printf("[phpfpm] reloading (pid=%d)", l.cmd.Process.Pid)
+	return nil
+}
+
+// Reconfigure regenerates the php-fpm configuration from cfg and reloads
+// php-fpm gracefully to apply it. Only the generated configuration is
+// updated: the binary, command line options and process environment of the
+// running php-fpm stay the same.
+func (l *Launcher) Reconfigure(cfg *php.Config) error {
+	if l.cmd == nil || l.cmd.Process == nil {
+		return fmt.Errorf("php-fpm not running")
+	}
+	main, err := GeneratePHPFPMConfig(cfg, l.outDir)
+	if err != nil {
+		return fmt.Errorf("generate php-fpm config: %w", err)
+	}
+	l.cfg = cfg
+	l.mainConf = main
+	return l.Reload()
+}
+
+// Config returns the configuration php-fpm was last started or reconfigured with
+func (l *Launcher) Config() *php.Config {
+	return l.cfg
+}
+
+// SlowlogPath returns the slowlog file php-fpm writes slow request traces to
+func (l *Launcher) SlowlogPath() string {
+	return SlowlogPath(l.cfg, l.outDir)
+}
+
+// ErrorLogPath returns the error log file of php-fpm
+func (l *Launcher) ErrorLogPath() string {
+	return ErrorLogPath(l.outDir)
+}
+
 func (l *Launcher) cleanup() {
 	// cancel context
 	if l.cancel != nil {
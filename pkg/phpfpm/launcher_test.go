@@ -3,6 +3,7 @@ package phpfpm
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -80,3 +81,67 @@ done
 		t.Fatalf("launcher stop: %v", err)
 	}
 }
+
+// TestLauncherReconfigure verifies that Reconfigure rewrites the generated
+// config and signals the running process to reload it.
+func TestLauncherReconfigure(t *testing.T) {
+	tmp := t.TempDir()
+	reloads := filepath.Join(tmp, "reloads")
+
+	// Shim that records SIGUSR2 like php-fpm reloading its config
+	shim := filepath.Join(tmp, "php-fpm-shim.sh")
+	script := `#!/bin/sh
+trap 'echo reload >> ` + reloads + `' USR2
+trap 'exit 0' INT TERM
+while true; do
+  sleep 0.1
+done
+`
+	if err := os.WriteFile(shim, []byte(script), 0o755); err != nil {
+		t.Fatalf("write shim: %v", err)
+	}
+
+	newConfig := func(maxChildren int) *php.Config {
+		cfg := &php.Config{PHPFPMBinary: shim, DocumentRoot: tmp}
+		cfg.PHPFPM.Enabled = true
+		cfg.PHPFPM.Listen = "127.0.0.1:9001"
+		cfg.PHPFPM.Transport = "tcp"
+		cfg.PHPFPM.GeneratedConfigDir = tmp
+		cfg.PHPFPM.NoDaemonize = true
+		cfg.PHPFPM.Pool = php.PoolConfig{Name: "tqtest", PM: "static", MaxChildren: maxChildren}
+		return cfg
+	}
+
+	launcher := NewLauncher(newConfig(2))
+	if err := launcher.Reconfigure(newConfig(4)); err == nil {
+		t.Fatal("Reconfigure before Start succeeded")
+	}
+	if err := launcher.Start(); err != nil {
+		t.Fatalf("launcher start: %v", err)
+	}
+	defer launcher.Stop(2 * time.Second)
+	time.Sleep(200 * time.Millisecond)
+
+	if err := launcher.Reconfigure(newConfig(4)); err != nil {
+		t.Fatalf("Reconfigure: %v", err)
+	}
+	conf, err := os.ReadFile(filepath.Join(tmp, "php-fpm.conf"))
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	if !strings.Contains(string(conf), "pm.max_children = 4") {
+		t.Errorf("config not regenerated:\n%s", conf)
+	}
+	if launcher.Config().PHPFPM.Pool.MaxChildren != 4 {
+		t.Errorf("Config() not updated")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(reloads); err == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("process did not receive SIGUSR2")
+}
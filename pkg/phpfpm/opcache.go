@@ -0,0 +1,47 @@
+package phpfpm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mevdschee/tqserver/pkg/fastcgi"
+)
+
+// opcacheResetScript empties the opcache of the php-fpm master running it
+const opcacheResetScript = `<?php
+echo function_exists('opcache_reset') && opcache_reset() ? 'ok' : 'failed';
+`
+
+// ResetOpcache empties the opcache of the launched php-fpm by running a
+// generated script calling opcache_reset() over client. Changed scripts are
+// compiled again on their next request, without restarting any worker.
+func (l *Launcher) ResetOpcache(ctx context.Context, client *fastcgi.Client) error {
+	script := filepath.Join(l.outDir, "opcache_reset.php")
+	if err := os.WriteFile(script, []byte(opcacheResetScript), 0o644); err != nil {
+		return fmt.Errorf("write opcache reset script: %w", err)
+	}
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		"REQUEST_METHOD":    "GET",
+		"SCRIPT_FILENAME":   script,
+		"SCRIPT_NAME":       "/" + filepath.Base(script),
+		"CONTENT_LENGTH":    "0",
+		"REDIRECT_STATUS":   "200",
+	}
+	status, _, body, err := client.DoRequest(ctx, params, strings.NewReader(""))
+	if err != nil {
+		return fmt.Errorf("opcache reset request: %w", err)
+	}
+	out, _ := io.ReadAll(body)
+	if status != 200 || !bytes.Equal(bytes.TrimSpace(out), []byte("ok")) {
+		return fmt.Errorf("opcache reset failed: status %d: %s", status, bytes.TrimSpace(out))
+	}
+	return nil
+}
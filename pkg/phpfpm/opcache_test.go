@@ -0,0 +1,59 @@
+package phpfpm
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqserver/pkg/config/php"
+	"github.com/mevdschee/tqserver/pkg/fastcgi"
+)
+
+// startScriptServer serves FastCGI requests by checking that the requested
+// script exists and replying with reply
+func startScriptServer(t *testing.T, reply string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := &fastcgi.Server{
+		Handler: fastcgi.HandlerFunc(func(ctx context.Context, conn *fastcgi.Conn, req *fastcgi.Request) error {
+			script, err := os.ReadFile(req.Params["SCRIPT_FILENAME"])
+			if err != nil || !strings.Contains(string(script), "opcache_reset()") {
+				return conn.SendResponse(req.RequestID, []byte("Status: 404 Not Found\r\n\r\nNo input file specified."), nil, 0)
+			}
+			return conn.SendResponse(req.RequestID, []byte("Content-Type: text/html\r\n\r\n"+reply), nil, 0)
+		}),
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+func TestResetOpcache(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		wantErr bool
+	}{
+		{"Reset", "ok", false},
+		{"Failed", "failed", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startScriptServer(t, tt.reply)
+			client := fastcgi.NewClient(addr, "tcp", 1, 2*time.Second, 2*time.Second)
+			defer client.Close()
+
+			launcher := NewLauncher(&php.Config{PHPFPM: php.PHPFPMConfig{GeneratedConfigDir: t.TempDir()}})
+			err := launcher.ResetOpcache(context.Background(), client)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResetOpcache() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
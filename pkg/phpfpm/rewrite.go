@@ -0,0 +1,114 @@
+package phpfpm
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule is an nginx-style rewrite: requests whose path matches Pattern
+// continue with Replacement, in which $1..$9 refer to the captured groups.
+//
+// Flag controls what happens after a match: "" continues with the next rule,
+// "last" or "break" stop rewriting, "redirect" and "permanent" answer with a
+// 302 or 301 redirect. A replacement starting with http:// or https:// is
+// always a redirect.
+type RewriteRule struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+	Flag        string `yaml:"flag"`
+}
+
+// RewriteResult is the outcome of rewriting a request
+type RewriteResult struct {
+	Path  string
+	Query string
+	// Redirect is the redirect status, or 0 for an internal rewrite
+	Redirect int
+}
+
+// Location returns the redirect target, path and query combined
+func (r *RewriteResult) Location() string {
+	if r.Query == "" {
+		return r.Path
+	}
+	return r.Path + "?" + r.Query
+}
+
+type compiledRule struct {
+	re          *regexp.Regexp
+	replacement string
+	flag        string
+}
+
+// Rewriter applies rewrite rules in order
+type Rewriter struct {
+	rules []compiledRule
+}
+
+// NewRewriter compiles the rules, failing on an invalid pattern or flag
+func NewRewriter(rules []RewriteRule) (*Rewriter, error) {
+	rw := &Rewriter{}
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite %q: %w", rule.Pattern, err)
+		}
+		switch rule.Flag {
+		case "", "last", "break", "redirect", "permanent":
+		default:
+			return nil, fmt.Errorf("rewrite %q: unknown flag %q", rule.Pattern, rule.Flag)
+		}
+		rw.rules = append(rw.rules, compiledRule{re: re, replacement: rule.Replacement, flag: rule.Flag})
+	}
+	return rw, nil
+}
+
+// Rewrite applies the rules to a request path and query. A replacement with
+// a query string gets the original query appended, unless it ends with "?".
+func (rw *Rewriter) Rewrite(urlPath, query string) RewriteResult {
+	result := RewriteResult{Path: urlPath, Query: query}
+	if rw == nil {
+		return result
+	}
+
+	for _, rule := range rw.rules {
+		match := rule.re.FindStringSubmatchIndex(result.Path)
+		if match == nil {
+			continue
+		}
+		target := string(rule.re.ExpandString(nil, expandTemplate(rule.replacement), result.Path, match))
+
+		newPath, newQuery, hasQuery := strings.Cut(target, "?")
+		switch {
+		case !hasQuery:
+			newQuery = result.Query
+		case newQuery == "":
+			// Trailing "?" drops the original query
+		case result.Query != "":
+			newQuery += "&" + result.Query
+		}
+		result.Path, result.Query = newPath, newQuery
+
+		switch {
+		case rule.flag == "permanent":
+			result.Redirect = http.StatusMovedPermanently
+		case rule.flag == "redirect", strings.HasPrefix(newPath, "http://"), strings.HasPrefix(newPath, "https://"):
+			result.Redirect = http.StatusFound
+		}
+		if result.Redirect != 0 || rule.flag == "last" || rule.flag == "break" {
+			break
+		}
+	}
+	return result
+}
+
+// groupRef matches nginx-style $1..$9 group references
+var groupRef = regexp.MustCompile(`\$(\d)`)
+
+// expandTemplate converts group references to the ${1} form used by regexp,
+// so "$1abc" does not refer to a group named "1abc"
+func expandTemplate(replacement string) string {
+	return groupRef.ReplaceAllString(replacement, "$${$1}")
+}
@@ -0,0 +1,43 @@
+package phpfpm
+
+import "testing"
+
+func TestRewriter(t *testing.T) {
+	rw, err := NewRewriter([]RewriteRule{
+		{Pattern: `^/old/(.*)$`, Replacement: "/new/$1", Flag: "permanent"},
+		{Pattern: `^/docs$`, Replacement: "https://docs.example.com/", Flag: ""},
+		{Pattern: `^/blog/(\d+)$`, Replacement: "/post.php?id=$1", Flag: "last"},
+		{Pattern: `^/feed$`, Replacement: "/rss.php?", Flag: "last"},
+		{Pattern: `^/shop/(\w+)$`, Replacement: "/$1x"},
+		{Pattern: `^/(\w+)x$`, Replacement: "/shop.php?item=$1", Flag: "break"},
+	})
+	if err != nil {
+		t.Fatalf("NewRewriter: %v", err)
+	}
+
+	tests := []struct {
+		path, query string
+		want        RewriteResult
+	}{
+		{"/index.php", "a=1", RewriteResult{Path: "/index.php", Query: "a=1"}},
+		{"/old/page", "", RewriteResult{Path: "/new/page", Redirect: 301}},
+		{"/docs", "", RewriteResult{Path: "https://docs.example.com/", Redirect: 302}},
+		{"/blog/42", "ref=x", RewriteResult{Path: "/post.php", Query: "id=42&ref=x"}},
+		{"/feed", "ref=x", RewriteResult{Path: "/rss.php"}},
+		{"/shop/hat", "", RewriteResult{Path: "/shop.php", Query: "item=hat"}},
+	}
+	for _, tt := range tests {
+		if got := rw.Rewrite(tt.path, tt.query); got != tt.want {
+			t.Errorf("Rewrite(%q, %q) = %+v, want %+v", tt.path, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestNewRewriterInvalid(t *testing.T) {
+	if _, err := NewRewriter([]RewriteRule{{Pattern: "(", Replacement: "/"}}); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+	if _, err := NewRewriter([]RewriteRule{{Pattern: "^/$", Replacement: "/", Flag: "sometimes"}}); err == nil {
+		t.Error("invalid flag accepted")
+	}
+}
@@ -0,0 +1,130 @@
+package phpfpm
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Script is the PHP script a request path resolves to
+type Script struct {
+	// Name is the script path relative to the document root (SCRIPT_NAME)
+	Name string
+	// Filename is the script path on disk (SCRIPT_FILENAME)
+	Filename string
+	// PathInfo is the part of the path after the script name (PATH_INFO)
+	PathInfo string
+	// Query is the query string to pass (QUERY_STRING)
+	Query string
+}
+
+// ResolveScript maps a request path below the document root to a PHP script.
+//
+// Without tryFiles a path like /app.php/users is split into the script
+// /app.php and PATH_INFO /users, and any other path is treated as a
+// directory containing index.php.
+//
+// tryFiles works like the nginx directive of the same name: each entry but
+// the last is checked in order, "$uri" for a .php file and "$uri/" for a
+// directory with an index.php. The last entry is the fallback URI, typically
+// the front controller "/index.php?$query_string", or "=404" to fail. "$uri",
+// "$query_string" and "$args" are expanded. It returns false when nothing
+// matched.
+func ResolveScript(documentRoot, urlPath, query string, tryFiles []string) (*Script, bool) {
+	urlPath = path.Clean("/" + urlPath)
+
+	if len(tryFiles) == 0 {
+		name, pathInfo := SplitPathInfo(urlPath)
+		if !strings.HasSuffix(name, ".php") {
+			name = path.Join(name, "index.php")
+		}
+		return newScript(documentRoot, name, pathInfo, query), true
+	}
+
+	expand := strings.NewReplacer("$uri", urlPath, "$query_string", query, "$args", query)
+	for i, entry := range tryFiles {
+		entry = expand.Replace(entry)
+
+		if i == len(tryFiles)-1 {
+			// Fallback, an internal redirect to the front controller
+			if strings.HasPrefix(entry, "=") {
+				return nil, false
+			}
+			uri, fallbackQuery, hasQuery := strings.Cut(entry, "?")
+			if !hasQuery {
+				fallbackQuery = query
+			}
+			name, pathInfo := SplitPathInfo(path.Clean("/" + uri))
+			return newScript(documentRoot, name, pathInfo, fallbackQuery), true
+		}
+
+		if strings.HasSuffix(entry, "/") {
+			name := path.Join(path.Clean(entry), "index.php")
+			if isFile(filepath.Join(documentRoot, name)) {
+				return newScript(documentRoot, name, "", query), true
+			}
+			continue
+		}
+
+		// Non-PHP files are served as static files before dispatch
+		name, pathInfo := SplitPathInfo(path.Clean(entry))
+		if strings.HasSuffix(name, ".php") && isFile(filepath.Join(documentRoot, name)) {
+			return newScript(documentRoot, name, pathInfo, query), true
+		}
+	}
+	return nil, false
+}
+
+// Exists reports whether the script is a file inside documentRoot. Symlinks
+// are resolved, so a script linking outside the document root is treated as
+// missing.
+func (s *Script) Exists(documentRoot string) bool {
+	root, err := filepath.EvalSymlinks(documentRoot)
+	if err != nil {
+		return false
+	}
+	filename, err := filepath.EvalSymlinks(s.Filename)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, filename)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	return isFile(filename)
+}
+
+// SplitPathInfo splits a path at the first ".php" path segment into the
+// script name and the PATH_INFO that follows it
+func SplitPathInfo(urlPath string) (name, pathInfo string) {
+	if i := strings.Index(urlPath, ".php/"); i >= 0 {
+		return urlPath[:i+4], urlPath[i+4:]
+	}
+	return urlPath, ""
+}
+
+// MatchPath reports whether a request path matches a pool path pattern. A
+// pattern ending in "/*" matches the directory and everything below it, any
+// other pattern is matched with path.Match.
+func MatchPath(pattern, urlPath string) bool {
+	if base, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return urlPath == base || strings.HasPrefix(urlPath, base+"/")
+	}
+	matched, _ := path.Match(pattern, urlPath)
+	return matched
+}
+
+func newScript(documentRoot, name, pathInfo, query string) *Script {
+	return &Script{
+		Name:     name,
+		Filename: filepath.Join(documentRoot, filepath.FromSlash(name)),
+		PathInfo: pathInfo,
+		Query:    query,
+	}
+}
+
+func isFile(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && !info.IsDir()
+}
@@ -0,0 +1,112 @@
+package phpfpm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveScript(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"index.php", "app.php", "admin/index.php", "css/site.css"} {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(file), 0o755)
+		os.WriteFile(file, nil, 0o644)
+	}
+	laravel := []string{"$uri", "$uri/", "/index.php?$query_string"}
+
+	tests := []struct {
+		name     string
+		path     string
+		query    string
+		tryFiles []string
+		script   string
+		pathInfo string
+		wantQry  string
+		ok       bool
+	}{
+		{"Root", "/", "", nil, "/index.php", "", "", true},
+		{"Directory", "/admin", "", nil, "/admin/index.php", "", "", true},
+		{"Script", "/app.php", "a=1", nil, "/app.php", "", "a=1", true},
+		{"PathInfo", "/app.php/users/5", "", nil, "/app.php", "/users/5", "", true},
+		{"Traversal", "/../../etc/passwd", "", nil, "/etc/passwd/index.php", "", "", true},
+		{"TryFilesScript", "/app.php", "", laravel, "/app.php", "", "", true},
+		{"TryFilesScriptPathInfo", "/app.php/x", "", laravel, "/app.php", "/x", "", true},
+		{"TryFilesDirectory", "/admin", "", laravel, "/admin/index.php", "", "", true},
+		{"TryFilesFrontController", "/users/5", "page=2", laravel, "/index.php", "", "page=2", true},
+		{"TryFilesMissingScript", "/missing.php", "", laravel, "/index.php", "", "", true},
+		{"TryFilesFallbackWithoutQuery", "/users", "page=2", []string{"$uri", "/index.php"}, "/index.php", "", "page=2", true},
+		{"TryFilesFallbackPathInfo", "/users", "", []string{"$uri", "/index.php$uri"}, "/index.php", "/users", "", true},
+		{"TryFilesNotFound", "/users", "", []string{"$uri", "$uri/", "=404"}, "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, ok := ResolveScript(root, tt.path, tt.query, tt.tryFiles)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if script.Name != tt.script || script.PathInfo != tt.pathInfo || script.Query != tt.wantQry {
+				t.Errorf("got name=%q path_info=%q query=%q, want name=%q path_info=%q query=%q",
+					script.Name, script.PathInfo, script.Query, tt.script, tt.pathInfo, tt.wantQry)
+			}
+			if want := filepath.Join(root, filepath.FromSlash(tt.script)); script.Filename != want {
+				t.Errorf("filename = %q, want %q", script.Filename, want)
+			}
+		})
+	}
+}
+
+func TestScriptExists(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "public")
+	os.MkdirAll(filepath.Join(root, "admin"), 0o755)
+	os.WriteFile(filepath.Join(root, "index.php"), nil, 0o644)
+	os.WriteFile(filepath.Join(dir, "secret.php"), nil, 0o644)
+	os.Symlink(filepath.Join(dir, "secret.php"), filepath.Join(root, "linked.php"))
+
+	tests := []struct {
+		name string
+		path string
+		want bool
+	}{
+		{"File", "/index.php", true},
+		{"Missing", "/missing.php", false},
+		{"Directory", "/admin", false},
+		{"SymlinkOutsideRoot", "/linked.php", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := newScript(root, tt.path, "", "")
+			if got := script.Exists(root); got != tt.want {
+				t.Errorf("Exists() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/admin/*", "/admin", true},
+		{"/admin/*", "/admin/users/5", true},
+		{"/admin/*", "/administrator", false},
+		{"/api/*.php", "/api/users.php", true},
+		{"/api/*.php", "/api/v1/users.php", false},
+		{"/upload.php", "/upload.php", true},
+		{"/upload.php", "/index.php", false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchPath(tt.pattern, tt.path); got != tt.want {
+			t.Errorf("MatchPath(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package phpfpm
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SlowEntry is a single request trace written to the php-fpm slowlog when a
+// request runs longer than request_slowlog_timeout.
+type SlowEntry struct {
+	Time           time.Time `json:"time"`
+	Pool           string    `json:"pool"`
+	PID            int       `json:"pid"`
+	ScriptFilename string    `json:"script_filename"`
+	Trace          []string  `json:"trace"`
+}
+
+// slowHeader matches the first line of an entry, e.g.
+// "[16-Oct-2026 10:00:00]  [pool www] pid 1234"
+var slowHeader = regexp.MustCompile(`^\[([^\]]+)\]\s+\[pool ([^\]]+)\] pid (\d+)$`)
+
+// slowParser assembles entries from slowlog lines
+type slowParser struct {
+	current *SlowEntry
+}
+
+// line feeds one line and returns an entry completed by it, if any
+func (p *slowParser) line(line string) *SlowEntry {
+	if m := slowHeader.FindStringSubmatch(line); m != nil {
+		done := p.current
+		p.current = &SlowEntry{Pool: m[2]}
+		p.current.Time, _ = time.ParseInLocation("02-Jan-2006 15:04:05", m[1], time.Local)
+		p.current.PID, _ = strconv.Atoi(m[3])
+		return done
+	}
+	if p.current == nil || line == "" {
+		return nil
+	}
+	if name, value, ok := strings.Cut(line, " = "); ok && name == "script_filename" {
+		p.current.ScriptFilename = value
+		return nil
+	}
+	p.current.Trace = append(p.current.Trace, line)
+	return nil
+}
+
+// flush returns the entry being assembled, if any
+func (p *slowParser) flush() *SlowEntry {
+	done := p.current
+	p.current = nil
+	return done
+}
+
+// ParseSlowlog reads all entries from a php-fpm slowlog
+func ParseSlowlog(r io.Reader) ([]SlowEntry, error) {
+	var entries []SlowEntry
+	var parser slowParser
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if entry := parser.line(scanner.Text()); entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+	if entry := parser.flush(); entry != nil {
+		entries = append(entries, *entry)
+	}
+	return entries, scanner.Err()
+}
+
+// SlowlogTail follows a php-fpm slowlog file, passes new entries to OnEntry
+// and keeps the most recent ones in memory.
+type SlowlogTail struct {
+	// OnEntry is called for every new entry
+	OnEntry func(SlowEntry)
+
+	path     string
+	keep     int
+	interval time.Duration
+	entries  []SlowEntry
+	stop     chan struct{}
+	done     chan struct{}
+	mu       sync.Mutex
+}
+
+// NewSlowlogTail creates a tail of the slowlog at path that keeps the last
+// keep entries.
+func NewSlowlogTail(path string, keep int) *SlowlogTail {
+	return &SlowlogTail{
+		path:     path,
+		keep:     keep,
+		interval: time.Second,
+	}
+}
+
+// Path returns the slowlog file being followed
+func (t *SlowlogTail) Path() string {
+	return t.path
+}
+
+// Start follows the file from its current end until Stop is called
+func (t *SlowlogTail) Start() {
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+
+	var offset int64
+	if info, err := os.Stat(t.path); err == nil {
+		offset = info.Size()
+	}
+	go t.run(offset)
+}
+
+// Stop stops following the file
+func (t *SlowlogTail) Stop() {
+	if t.stop == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+	t.stop = nil
+}
+
+// Entries returns the most recent entries, oldest first
+func (t *SlowlogTail) Entries() []SlowEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]SlowEntry(nil), t.entries...)
+}
+
+func (t *SlowlogTail) run(offset int64) {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	var parser slowParser
+	var partial []byte
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		data, newOffset, truncated, err := readFrom(t.path, offset)
+		if err != nil {
+			continue
+		}
+		if truncated {
+			// Rotated or truncated, start over
+			partial = nil
+			parser.flush()
+		}
+		offset = newOffset
+
+		if len(data) == 0 {
+			// php-fpm writes an entry at once, so an entry that did not
+			// grow for a whole interval is complete
+			if entry := parser.flush(); entry != nil {
+				t.add(*entry)
+			}
+			continue
+		}
+
+		partial = append(partial, data...)
+		for {
+			i := bytes.IndexByte(partial, '\n')
+			if i < 0 {
+				break
+			}
+			line := strings.TrimRight(string(partial[:i]), "\r")
+			partial = partial[i+1:]
+			if entry := parser.line(line); entry != nil {
+				t.add(*entry)
+			}
+		}
+	}
+}
+
+// readFrom returns the data appended to path after offset and the new
+// offset. A file shorter than offset was truncated and is read from the start.
+func readFrom(path string, offset int64) (data []byte, newOffset int64, truncated bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, offset, false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, offset, false, err
+	}
+	if info.Size() < offset {
+		offset = 0
+		truncated = true
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, truncated, err
+	}
+	data, err = io.ReadAll(f)
+	if err != nil {
+		return nil, offset, truncated, err
+	}
+	return data, offset + int64(len(data)), truncated, nil
+}
+
+func (t *SlowlogTail) add(entry SlowEntry) {
+	t.mu.Lock()
+	t.entries = append(t.entries, entry)
+	if t.keep > 0 && len(t.entries) > t.keep {
+		t.entries = t.entries[len(t.entries)-t.keep:]
+	}
+	t.mu.Unlock()
+
+	if t.OnEntry != nil {
+		t.OnEntry(entry)
+	} else {
+		log.Printf("[phpfpm slowlog] %s pid %d: %s", entry.Pool, entry.PID, entry.ScriptFilename)
+	}
+}
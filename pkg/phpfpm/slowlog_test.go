@@ -0,0 +1,119 @@
+package phpfpm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mevdschee/tqserver/pkg/config/php"
+)
+
+const slowlogSample = `
+[16-Oct-2026 10:00:00]  [pool blog] pid 1234
+script_filename = /var/www/public/index.php
+[0x00007f2a1c013e40] sleep() /var/www/public/slow.php:3
+[0x00007f2a1c013d10] main() /var/www/public/index.php:12
+
+[16-Oct-2026 10:00:05]  [pool blog] pid 1235
+script_filename = /var/www/public/report.php
+[0x00007f2a1c013e40] curl_exec() /var/www/public/report.php:40
+`
+
+func TestParseSlowlog(t *testing.T) {
+	entries, err := ParseSlowlog(strings.NewReader(slowlogSample))
+	if err != nil {
+		t.Fatalf("ParseSlowlog: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+
+	first := entries[0]
+	if first.Pool != "blog" || first.PID != 1234 {
+		t.Errorf("pool/pid = %s/%d, want blog/1234", first.Pool, first.PID)
+	}
+	if first.ScriptFilename != "/var/www/public/index.php" {
+		t.Errorf("script_filename = %q", first.ScriptFilename)
+	}
+	if len(first.Trace) != 2 || !strings.Contains(first.Trace[0], "sleep()") {
+		t.Errorf("trace = %q", first.Trace)
+	}
+	if first.Time.Day() != 16 || first.Time.Hour() != 10 {
+		t.Errorf("time = %v", first.Time)
+	}
+	if entries[1].ScriptFilename != "/var/www/public/report.php" || len(entries[1].Trace) != 1 {
+		t.Errorf("second entry = %+v", entries[1])
+	}
+}
+
+func TestSlowlogTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "php-fpm.slow.log")
+	if err := os.WriteFile(path, []byte("old entries are skipped\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan SlowEntry, 2)
+	tail := NewSlowlogTail(path, 1)
+	tail.interval = 10 * time.Millisecond
+	tail.OnEntry = func(entry SlowEntry) { received <- entry }
+	tail.Start()
+	defer tail.Stop()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(slowlogSample)
+	f.Close()
+
+	for _, want := range []string{"/var/www/public/index.php", "/var/www/public/report.php"} {
+		select {
+		case entry := <-received:
+			if entry.ScriptFilename != want {
+				t.Errorf("entry script = %q, want %q", entry.ScriptFilename, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no entry for %s", want)
+		}
+	}
+
+	if entries := tail.Entries(); len(entries) != 1 || entries[0].PID != 1235 {
+		t.Errorf("kept entries = %+v, want only pid 1235", entries)
+	}
+}
+
+func TestGenerateSlowlogConfig(t *testing.T) {
+	tmp := t.TempDir()
+	cfg := &php.Config{DocumentRoot: tmp}
+	cfg.PHPFPM.Listen = "127.0.0.1:9001"
+	cfg.PHPFPM.Pool = php.PoolConfig{Name: "blog", RequestSlowlogTimeout: 5 * time.Second}
+	cfg.PHPFPM.Pool.Validate()
+
+	main, err := GeneratePHPFPMConfig(cfg, tmp)
+	if err != nil {
+		t.Fatalf("GeneratePHPFPMConfig: %v", err)
+	}
+	data, err := os.ReadFile(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := string(data)
+	for _, want := range []string{
+		"slowlog = " + filepath.Join(tmp, "php-fpm.slow.log"),
+		"request_slowlog_timeout = 5s",
+	} {
+		if !strings.Contains(conf, want) {
+			t.Errorf("config missing %q:\n%s", want, conf)
+		}
+	}
+
+	// Without a timeout no slowlog is configured
+	cfg.PHPFPM.Pool.RequestSlowlogTimeout = 0
+	main, _ = GeneratePHPFPMConfig(cfg, tmp)
+	data, _ = os.ReadFile(main)
+	if strings.Contains(string(data), "slowlog") {
+		t.Errorf("slowlog configured without timeout:\n%s", data)
+	}
+}
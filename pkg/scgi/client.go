@@ -0,0 +1,65 @@
+package scgi
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Client sends requests to an SCGI backend. SCGI closes the connection after
+// each response, so connections are not pooled.
+type Client struct {
+	addr        string
+	transport   string // "tcp" or "unix"
+	dialTimeout time.Duration
+	rwTimeout   time.Duration
+}
+
+// NewClient constructs a new Client. An empty transport is derived from the address.
+func NewClient(addr, transport string, dialTimeout, rwTimeout time.Duration) *Client {
+	if transport == "" {
+		if strings.Contains(addr, "/") {
+			transport = "unix"
+		} else {
+			transport = "tcp"
+		}
+	}
+	return &Client{
+		addr:        addr,
+		transport:   transport,
+		dialTimeout: dialTimeout,
+		rwTimeout:   rwTimeout,
+	}
+}
+
+// DoRequest sends a request with the given CGI params and body and returns the
+// raw CGI response (headers, blank line, body) written by the backend.
+func (c *Client) DoRequest(params map[string]string, stdin []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(c.transport, c.addr, c.dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s %s: %w", c.transport, c.addr, err)
+	}
+	defer conn.Close()
+
+	if c.rwTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.rwTimeout))
+	}
+
+	if _, err := conn.Write(EncodeHeaders(params, len(stdin))); err != nil {
+		return nil, fmt.Errorf("write headers: %w", err)
+	}
+	if len(stdin) > 0 {
+		if _, err := conn.Write(stdin); err != nil {
+			return nil, fmt.Errorf("write body: %w", err)
+		}
+	}
+
+	// The response ends when the backend closes the connection
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		return response, fmt.Errorf("read response: %w", err)
+	}
+	return response, nil
+}
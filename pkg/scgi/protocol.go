@@ -0,0 +1,115 @@
+package scgi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+var (
+	ErrInvalidNetstring = errors.New("invalid netstring")
+	ErrInvalidHeaders   = errors.New("invalid headers")
+)
+
+// MaxHeaderSize limits the size of the header netstring accepted by ReadRequest
+const MaxHeaderSize = 1 << 20
+
+// Request represents a decoded SCGI request
+type Request struct {
+	Headers map[string]string
+	Body    io.Reader
+}
+
+// EncodeHeaders encodes the request headers as a netstring. CONTENT_LENGTH and
+// SCGI are written first as required by the spec, the rest in sorted order.
+func EncodeHeaders(headers map[string]string, contentLength int) []byte {
+	var payload bytes.Buffer
+
+	writePair := func(name, value string) {
+		payload.WriteString(name)
+		payload.WriteByte(0)
+		payload.WriteString(value)
+		payload.WriteByte(0)
+	}
+
+	writePair("CONTENT_LENGTH", strconv.Itoa(contentLength))
+	writePair("SCGI", "1")
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		if name == "CONTENT_LENGTH" || name == "SCGI" {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writePair(name, headers[name])
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(strconv.Itoa(payload.Len()))
+	buf.WriteByte(':')
+	buf.Write(payload.Bytes())
+	buf.WriteByte(',')
+	return buf.Bytes()
+}
+
+// DecodeHeaders decodes the null separated header pairs of a netstring payload
+func DecodeHeaders(data []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	if len(data) == 0 {
+		return headers, nil
+	}
+	if data[len(data)-1] != 0 {
+		return nil, ErrInvalidHeaders
+	}
+
+	parts := bytes.Split(data[:len(data)-1], []byte{0})
+	if len(parts)%2 != 0 {
+		return nil, ErrInvalidHeaders
+	}
+	for i := 0; i < len(parts); i += 2 {
+		headers[string(parts[i])] = string(parts[i+1])
+	}
+	return headers, nil
+}
+
+// ReadRequest reads an SCGI request from r. The body is limited to CONTENT_LENGTH.
+func ReadRequest(r *bufio.Reader) (*Request, error) {
+	lenStr, err := r.ReadString(':')
+	if err != nil {
+		return nil, fmt.Errorf("read netstring length: %w", err)
+	}
+	length, err := strconv.Atoi(lenStr[:len(lenStr)-1])
+	if err != nil || length < 0 || length > MaxHeaderSize {
+		return nil, ErrInvalidNetstring
+	}
+
+	payload := make([]byte, length+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("read netstring: %w", err)
+	}
+	if payload[length] != ',' {
+		return nil, ErrInvalidNetstring
+	}
+
+	headers, err := DecodeHeaders(payload[:length])
+	if err != nil {
+		return nil, err
+	}
+
+	contentLength, err := strconv.ParseInt(headers["CONTENT_LENGTH"], 10, 64)
+	if err != nil || contentLength < 0 {
+		return nil, fmt.Errorf("%w: bad CONTENT_LENGTH", ErrInvalidHeaders)
+	}
+
+	return &Request{
+		Headers: headers,
+		Body:    io.LimitReader(r, contentLength),
+	}, nil
+}
@@ -0,0 +1,89 @@
+package scgi
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEncodeHeaders(t *testing.T) {
+	encoded := EncodeHeaders(map[string]string{
+		"REQUEST_METHOD": "POST",
+		"SCGI":           "ignored",
+	}, 5)
+
+	want := "44:CONTENT_LENGTH\x005\x00SCGI\x001\x00REQUEST_METHOD\x00POST\x00,"
+	if string(encoded) != want {
+		t.Errorf("EncodeHeaders = %q, want %q", encoded, want)
+	}
+}
+
+func TestReadRequestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(EncodeHeaders(map[string]string{"PATH_INFO": "/hello"}, 5))
+	buf.WriteString("hello")
+
+	req, err := ReadRequest(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("ReadRequest failed: %v", err)
+	}
+	if req.Headers["PATH_INFO"] != "/hello" {
+		t.Errorf("PATH_INFO = %q, want /hello", req.Headers["PATH_INFO"])
+	}
+	if req.Headers["SCGI"] != "1" {
+		t.Errorf("SCGI = %q, want 1", req.Headers["SCGI"])
+	}
+	body, _ := io.ReadAll(req.Body)
+	if string(body) != "hello" {
+		t.Errorf("body = %q, want hello", body)
+	}
+}
+
+func TestReadRequestInvalid(t *testing.T) {
+	tests := []string{
+		"abc:xyz,",
+		"4:ab\x00c;",
+		"6:a\x00b\x00c\x00,",
+	}
+	for _, input := range tests {
+		if _, err := ReadRequest(bufio.NewReader(bytes.NewBufferString(input))); err == nil {
+			t.Errorf("ReadRequest(%q) succeeded, want error", input)
+		}
+	}
+}
+
+func TestClientDoRequest(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		conn.Write([]byte("Status: 200 OK\r\nContent-Type: text/plain\r\n\r\n" + req.Headers["REQUEST_METHOD"] + " " + string(body)))
+	}()
+
+	client := NewClient(ln.Addr().String(), "tcp", 2*time.Second, 2*time.Second)
+	resp, err := client.DoRequest(map[string]string{"REQUEST_METHOD": "POST"}, []byte("payload"))
+	if err != nil {
+		t.Fatalf("DoRequest failed: %v", err)
+	}
+
+	want := "Status: 200 OK\r\nContent-Type: text/plain\r\n\r\nPOST payload"
+	if string(resp) != want {
+		t.Errorf("response = %q, want %q", resp, want)
+	}
+}
@@ -0,0 +1,676 @@
+// Package toml parses TOML v1.0 documents into a tree of values that keeps
+// the line of every key and value, for error messages.
+package toml
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Kind is the type of a value
+type Kind int
+
+// Value kinds
+const (
+	String Kind = iota
+	Integer
+	Float
+	Boolean
+	Datetime // Offset or local date-times, dates and times
+	Array
+	Table
+)
+
+// Value is a TOML value
+type Value struct {
+	Kind   Kind
+	Line   int
+	Str    string   // String, and Datetime as written
+	Int    int64    // Integer
+	Float  float64  // Float
+	Bool   bool     // Boolean
+	Items  []*Value // Array
+	Fields []*Field // Table, in document order
+
+	defined bool // Table: by a header or inline, cannot be defined again
+	dotted  bool // Table: created by a dotted key, cannot get a header
+	inline  bool // Table or Array: inline, cannot be extended
+	tables  bool // Array: of tables, from [[headers]]
+}
+
+// Field is a key of a table with its value
+type Field struct {
+	Key   string
+	Line  int
+	Value *Value
+}
+
+// Get returns the value of a key of a table, or nil
+func (v *Value) Get(key string) *Value {
+	for _, f := range v.Fields {
+		if f.Key == key {
+			return f.Value
+		}
+	}
+	return nil
+}
+
+// Error is a syntax error
+type Error struct {
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// Parse parses a document into its root table
+func Parse(data []byte) (root *Value, err error) {
+	if !utf8.Valid(data) {
+		return nil, &Error{Line: 1, Message: "document is not valid UTF-8"}
+	}
+	p := &parser{src: string(data), line: 1}
+	p.root = &Value{Kind: Table, Line: 1, defined: true}
+	p.current = p.root
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			root, err = nil, e
+		}
+	}()
+	p.document()
+	return p.root, nil
+}
+
+type parser struct {
+	src     string
+	pos     int
+	line    int
+	root    *Value
+	current *Value // Table of the last header
+}
+
+func (p *parser) fail(format string, args ...interface{}) {
+	panic(&Error{Line: p.line, Message: fmt.Sprintf(format, args...)})
+}
+
+func (p *parser) eof() bool { return p.pos >= len(p.src) }
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *parser) next() byte {
+	c := p.src[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+func (p *parser) expect(c byte) {
+	if p.peek() != c {
+		p.fail("expected %q", c)
+	}
+	p.next()
+}
+
+// space skips spaces and tabs
+func (p *parser) space() {
+	for c := p.peek(); c == ' ' || c == '\t'; c = p.peek() {
+		p.next()
+	}
+}
+
+// comment skips a comment up to the end of the line
+func (p *parser) comment() {
+	if p.peek() != '#' {
+		return
+	}
+	for !p.eof() && p.peek() != '\n' {
+		if c := p.next(); c < 0x20 && c != '\t' && !(c == '\r' && p.peek() == '\n') || c == 0x7f {
+			p.fail("control character in comment")
+		}
+	}
+}
+
+// endOfLine requires the rest of the line to be blank or a comment
+func (p *parser) endOfLine() {
+	p.space()
+	p.comment()
+	if p.eof() {
+		return
+	}
+	if p.peek() == '\r' {
+		p.next()
+	}
+	if p.peek() != '\n' {
+		p.fail("expected the end of the line")
+	}
+	p.next()
+}
+
+// blank skips whitespace, newlines and comments, within arrays
+func (p *parser) blank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.next()
+		case '#':
+			p.comment()
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) document() {
+	for {
+		p.blank()
+		if p.eof() {
+			return
+		}
+		if p.peek() == '[' {
+			p.header()
+		} else {
+			p.keyValue(p.current)
+		}
+		p.endOfLine()
+	}
+}
+
+// header parses a [table] or [[array of tables]] header
+func (p *parser) header() {
+	line := p.line
+	p.expect('[')
+	array := p.peek() == '['
+	if array {
+		p.next()
+	}
+	p.space()
+	keys := p.key()
+	p.space()
+	p.expect(']')
+	if array {
+		p.expect(']')
+	}
+
+	table := p.root
+	for _, key := range keys[:len(keys)-1] {
+		table = p.descend(table, key, line, false)
+	}
+	last := keys[len(keys)-1]
+	existing := table.Get(last)
+
+	if array {
+		if existing == nil {
+			existing = &Value{Kind: Array, Line: line, tables: true}
+			table.Fields = append(table.Fields, &Field{Key: last, Line: line, Value: existing})
+		} else if existing.Kind != Array || !existing.tables {
+			p.fail("key %q is already defined", last)
+		}
+		p.current = &Value{Kind: Table, Line: line, defined: true}
+		existing.Items = append(existing.Items, p.current)
+		return
+	}
+
+	switch {
+	case existing == nil:
+		existing = &Value{Kind: Table, Line: line}
+		table.Fields = append(table.Fields, &Field{Key: last, Line: line, Value: existing})
+	case existing.Kind != Table || existing.defined || existing.dotted || existing.inline:
+		p.fail("table %q is already defined", strings.Join(keys, "."))
+	}
+	existing.defined = true
+	p.current = existing
+}
+
+// descend returns the table under a key, creating it. Within headers the
+// last table of an array of tables is used.
+func (p *parser) descend(table *Value, key string, line int, dotted bool) *Value {
+	value := table.Get(key)
+	if value == nil {
+		value = &Value{Kind: Table, Line: line, dotted: dotted}
+		table.Fields = append(table.Fields, &Field{Key: key, Line: line, Value: value})
+		return value
+	}
+	if value.Kind == Array && value.tables && !dotted && len(value.Items) > 0 {
+		return value.Items[len(value.Items)-1]
+	}
+	if value.Kind != Table || value.inline || (dotted && value.defined && !value.dotted) {
+		p.fail("key %q is already defined", key)
+	}
+	return value
+}
+
+// keyValue parses "key = value" into a table
+func (p *parser) keyValue(table *Value) {
+	line := p.line
+	keys := p.key()
+	p.space()
+	p.expect('=')
+	p.space()
+	value := p.value()
+
+	for _, key := range keys[:len(keys)-1] {
+		table = p.descend(table, key, line, true)
+	}
+	last := keys[len(keys)-1]
+	if table.Get(last) != nil {
+		p.fail("key %q is already defined", last)
+	}
+	table.Fields = append(table.Fields, &Field{Key: last, Line: line, Value: value})
+}
+
+// key parses a possibly dotted key
+func (p *parser) key() []string {
+	var keys []string
+	for {
+		p.space()
+		switch c := p.peek(); {
+		case c == '"':
+			keys = append(keys, p.basicString())
+		case c == '\'':
+			keys = append(keys, p.literalString())
+		default:
+			start := p.pos
+			for c := p.peek(); c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'; c = p.peek() {
+				p.next()
+			}
+			if p.pos == start {
+				p.fail("expected a key")
+			}
+			keys = append(keys, p.src[start:p.pos])
+		}
+		p.space()
+		if p.peek() != '.' {
+			return keys
+		}
+		p.next()
+	}
+}
+
+func (p *parser) value() *Value {
+	line := p.line
+	switch c := p.peek(); {
+	case c == '"':
+		if strings.HasPrefix(p.src[p.pos:], `"""`) {
+			return &Value{Kind: String, Line: line, Str: p.multilineBasicString()}
+		}
+		return &Value{Kind: String, Line: line, Str: p.basicString()}
+	case c == '\'':
+		if strings.HasPrefix(p.src[p.pos:], `'''`) {
+			return &Value{Kind: String, Line: line, Str: p.multilineLiteralString()}
+		}
+		return &Value{Kind: String, Line: line, Str: p.literalString()}
+	case c == '[':
+		return p.array()
+	case c == '{':
+		return p.inlineTable()
+	}
+
+	// Booleans, numbers and date-times up to the next delimiter
+	start := p.pos
+	for !p.eof() {
+		c := p.peek()
+		if c == ',' || c == ']' || c == '}' || c == '#' || c == '\n' || c == '\r' || c == '\t' {
+			break
+		}
+		if c == ' ' && !isDateTimeSpace(p.src[start:p.pos], p.src[p.pos:]) {
+			break
+		}
+		p.next()
+	}
+	token := p.src[start:p.pos]
+	switch token {
+	case "":
+		p.fail("expected a value")
+	case "true", "false":
+		return &Value{Kind: Boolean, Line: line, Bool: token == "true"}
+	case "inf", "+inf", "nan", "+nan", "-nan":
+		f := math.Inf(1)
+		if strings.HasSuffix(token, "nan") {
+			f = math.NaN()
+		}
+		return &Value{Kind: Float, Line: line, Float: f}
+	case "-inf":
+		return &Value{Kind: Float, Line: line, Float: math.Inf(-1)}
+	}
+	if isDateTime(token) {
+		return &Value{Kind: Datetime, Line: line, Str: token}
+	}
+	if i, ok := parseInteger(token); ok {
+		return &Value{Kind: Integer, Line: line, Int: i}
+	}
+	if f, ok := parseFloat(token); ok {
+		return &Value{Kind: Float, Line: line, Float: f}
+	}
+	p.fail("invalid value %q", token)
+	return nil
+}
+
+// isDateTimeSpace reports whether a space separates the date and time of a
+// date-time, like "1979-05-27 07:32:00Z"
+func isDateTimeSpace(before, after string) bool {
+	return len(before) == 10 && isDate(before) && len(after) > 2 && after[1] >= '0' && after[1] <= '9'
+}
+
+func isDate(s string) bool {
+	return len(s) == 10 && s[4] == '-' && s[7] == '-' && digits(s[:4]) && digits(s[5:7]) && digits(s[8:])
+}
+
+func isTime(s string) bool {
+	return len(s) >= 8 && s[2] == ':' && s[5] == ':' && digits(s[:2]) && digits(s[3:5]) && digits(s[6:8])
+}
+
+// isDateTime reports whether a token is a date, time or date-time
+func isDateTime(token string) bool {
+	if isTime(token) {
+		return true
+	}
+	if len(token) < 10 || !isDate(token[:10]) {
+		return false
+	}
+	if len(token) == 10 {
+		return true
+	}
+	sep := token[10]
+	return (sep == 'T' || sep == 't' || sep == ' ') && isTime(token[11:])
+}
+
+func digits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// parseInteger parses decimal, hexadecimal, octal and binary integers with
+// underscores between digits
+func parseInteger(token string) (int64, bool) {
+	if !validUnderscores(token) {
+		return 0, false
+	}
+	clean := strings.ReplaceAll(token, "_", "")
+	base := 10
+	switch {
+	case strings.HasPrefix(clean, "0x"):
+		base, clean = 16, clean[2:]
+	case strings.HasPrefix(clean, "0o"):
+		base, clean = 8, clean[2:]
+	case strings.HasPrefix(clean, "0b"):
+		base, clean = 2, clean[2:]
+	default:
+		digits := strings.TrimLeft(clean, "+-")
+		if len(digits) > 1 && digits[0] == '0' {
+			return 0, false // Leading zeros are not allowed
+		}
+	}
+	if base != 10 && (clean == "" || clean[0] == '+' || clean[0] == '-') {
+		return 0, false
+	}
+	i, err := strconv.ParseInt(clean, base, 64)
+	return i, err == nil
+}
+
+// parseFloat parses a float with a fraction, an exponent or both
+func parseFloat(token string) (float64, bool) {
+	if !validUnderscores(token) || !strings.ContainsAny(token, ".eE") {
+		return 0, false
+	}
+	clean := strings.ReplaceAll(token, "_", "")
+	mantissa := strings.TrimLeft(clean, "+-")
+	if i := strings.IndexAny(mantissa, "eE"); i >= 0 {
+		mantissa = mantissa[:i]
+	}
+	whole, fraction, hasDot := strings.Cut(mantissa, ".")
+	if !digits(whole) || (hasDot && !digits(fraction)) || (len(whole) > 1 && whole[0] == '0') {
+		return 0, false
+	}
+	if strings.ContainsAny(clean, "xXpP") {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(clean, 64)
+	return f, err == nil
+}
+
+// validUnderscores requires each underscore to be between two digits
+func validUnderscores(token string) bool {
+	for i := 0; i < len(token); i++ {
+		if token[i] != '_' {
+			continue
+		}
+		if i == 0 || i == len(token)-1 || !isHexDigit(token[i-1]) || !isHexDigit(token[i+1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func (p *parser) array() *Value {
+	value := &Value{Kind: Array, Line: p.line, inline: true}
+	p.expect('[')
+	for {
+		p.blank()
+		if p.peek() == ']' {
+			p.next()
+			return value
+		}
+		value.Items = append(value.Items, p.value())
+		p.blank()
+		switch p.peek() {
+		case ',':
+			p.next()
+		case ']':
+			p.next()
+			return value
+		default:
+			p.fail("expected ',' or ']' in array")
+		}
+	}
+}
+
+func (p *parser) inlineTable() *Value {
+	table := &Value{Kind: Table, Line: p.line, defined: true, inline: true}
+	p.expect('{')
+	p.space()
+	if p.peek() == '}' {
+		p.next()
+		return table
+	}
+	for {
+		p.keyValue(table)
+		p.space()
+		switch p.peek() {
+		case ',':
+			p.next()
+			p.space()
+		case '}':
+			p.next()
+			markInline(table)
+			return table
+		default:
+			p.fail("expected ',' or '}' in inline table")
+		}
+	}
+}
+
+// markInline closes the tables created by dotted keys in an inline table
+func markInline(table *Value) {
+	table.inline = true
+	for _, f := range table.Fields {
+		if f.Value.Kind == Table {
+			markInline(f.Value)
+		}
+	}
+}
+
+func (p *parser) literalString() string {
+	p.expect('\'')
+	start := p.pos
+	for p.peek() != '\'' {
+		if p.eof() || p.peek() == '\n' {
+			p.fail("unterminated string")
+		}
+		p.checkControl(p.next())
+	}
+	s := p.src[start:p.pos]
+	p.next()
+	return s
+}
+
+func (p *parser) multilineLiteralString() string {
+	p.pos += 3
+	p.trimFirstNewline()
+	start := p.pos
+	for !strings.HasPrefix(p.src[p.pos:], "'''") {
+		if p.eof() {
+			p.fail("unterminated string")
+		}
+		if c := p.next(); c != '\n' && c != '\r' {
+			p.checkControl(c)
+		}
+	}
+	end := p.pos
+	p.pos += 3
+	// Up to two quotes may end the content
+	for i := 0; i < 2 && p.peek() == '\''; i++ {
+		p.next()
+		end++
+	}
+	return strings.ReplaceAll(p.src[start:end], "\r\n", "\n")
+}
+
+func (p *parser) basicString() string {
+	p.expect('"')
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			p.fail("unterminated string")
+		}
+		c := p.next()
+		switch c {
+		case '"':
+			return b.String()
+		case '\\':
+			p.escape(&b)
+		default:
+			p.checkControl(c)
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (p *parser) multilineBasicString() string {
+	p.pos += 3
+	p.trimFirstNewline()
+	var b strings.Builder
+	for {
+		if p.eof() {
+			p.fail("unterminated string")
+		}
+		if strings.HasPrefix(p.src[p.pos:], `"""`) {
+			p.pos += 3
+			for i := 0; i < 2 && p.peek() == '"'; i++ {
+				p.next()
+				b.WriteByte('"')
+			}
+			return b.String()
+		}
+		c := p.next()
+		switch c {
+		case '\\':
+			// A backslash at the end of a line trims the whitespace after it
+			rest := strings.TrimLeft(p.src[p.pos:], " \t")
+			if strings.HasPrefix(rest, "\n") || strings.HasPrefix(rest, "\r\n") {
+				for c := p.peek(); c == ' ' || c == '\t' || c == '\r' || c == '\n'; c = p.peek() {
+					p.next()
+				}
+				continue
+			}
+			p.escape(&b)
+		case '\r':
+			if p.peek() != '\n' {
+				p.fail("carriage return without newline in string")
+			}
+		case '\n':
+			b.WriteByte('\n')
+		default:
+			p.checkControl(c)
+			b.WriteByte(c)
+		}
+	}
+}
+
+// trimFirstNewline skips a newline right after the opening quotes
+func (p *parser) trimFirstNewline() {
+	if strings.HasPrefix(p.src[p.pos:], "\r\n") {
+		p.pos++
+	}
+	if p.peek() == '\n' {
+		p.next()
+	}
+}
+
+func (p *parser) checkControl(c byte) {
+	if c < 0x20 && c != '\t' || c == 0x7f {
+		p.fail("control character in string")
+	}
+}
+
+func (p *parser) escape(b *strings.Builder) {
+	if p.eof() {
+		p.fail("unterminated string")
+	}
+	switch c := p.next(); c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case 'e':
+		b.WriteByte(0x1b)
+	case '"':
+		b.WriteByte('"')
+	case '\\':
+		b.WriteByte('\\')
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.src) {
+			p.fail("invalid unicode escape")
+		}
+		code, err := strconv.ParseUint(p.src[p.pos:p.pos+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			p.fail("invalid unicode escape")
+		}
+		p.pos += n
+		b.WriteRune(rune(code))
+	default:
+		p.fail("invalid escape \\%c", c)
+	}
+}
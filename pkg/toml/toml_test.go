@@ -0,0 +1,139 @@
+package toml
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+const document = `# Server settings
+title = "TQServer"
+
+[server]
+port = 8_080
+read_timeout_seconds = 30 # comment
+ratio = 0.25
+enabled = true
+started = 1979-05-27 07:32:00Z
+
+[workers]
+directory = 'workers'
+ports = [
+  9000,
+  9999, # trailing comma
+]
+
+[[webhooks]]
+url = "https://example.com/a"
+events = ["crash_loop", "build_failed"]
+
+[[webhooks]]
+url = "https://example.com/b"
+headers = { Authorization = "Bearer x", "X-Team" = "ops" }
+
+[logging.server]
+output = "journald"
+syslog.address = "/dev/log"
+`
+
+func TestParse(t *testing.T) {
+	root, err := Parse([]byte(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := root.Get("title").Str; got != "TQServer" {
+		t.Errorf("title = %q", got)
+	}
+	server := root.Get("server")
+	if server.Line != 4 {
+		t.Errorf("server line = %d, want 4", server.Line)
+	}
+	if port := server.Get("port"); port.Kind != Integer || port.Int != 8080 || port.Line != 5 {
+		t.Errorf("port = %+v", port)
+	}
+	if ratio := server.Get("ratio"); ratio.Kind != Float || ratio.Float != 0.25 {
+		t.Errorf("ratio = %+v", ratio)
+	}
+	if enabled := server.Get("enabled"); enabled.Kind != Boolean || !enabled.Bool {
+		t.Errorf("enabled = %+v", enabled)
+	}
+	if started := server.Get("started"); started.Kind != Datetime || started.Str != "1979-05-27 07:32:00Z" {
+		t.Errorf("started = %+v", started)
+	}
+
+	ports := root.Get("workers").Get("ports")
+	if ports.Kind != Array || len(ports.Items) != 2 || ports.Items[1].Int != 9999 || ports.Items[1].Line != 15 {
+		t.Errorf("ports = %+v", ports)
+	}
+
+	webhooks := root.Get("webhooks")
+	if webhooks.Kind != Array || len(webhooks.Items) != 2 {
+		t.Fatalf("webhooks = %+v", webhooks)
+	}
+	if got := webhooks.Items[0].Get("events").Items[1].Str; got != "build_failed" {
+		t.Errorf("events[1] = %q", got)
+	}
+	headers := webhooks.Items[1].Get("headers")
+	if headers.Get("Authorization").Str != "Bearer x" || headers.Get("X-Team").Str != "ops" {
+		t.Errorf("headers = %+v", headers)
+	}
+
+	logging := root.Get("logging").Get("server")
+	if logging.Get("output").Str != "journald" || logging.Get("syslog").Get("address").Str != "/dev/log" {
+		t.Errorf("logging.server = %+v", logging)
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	for input, check := range map[string]func(*Value) bool{
+		`v = 0xff`:                     func(v *Value) bool { return v.Int == 255 },
+		`v = 0o17`:                     func(v *Value) bool { return v.Int == 15 },
+		`v = 0b101`:                    func(v *Value) bool { return v.Int == 5 },
+		`v = -42`:                      func(v *Value) bool { return v.Int == -42 },
+		`v = 6.02e23`:                  func(v *Value) bool { return v.Float == 6.02e23 },
+		`v = -inf`:                     func(v *Value) bool { return math.IsInf(v.Float, -1) },
+		`v = nan`:                      func(v *Value) bool { return math.IsNaN(v.Float) },
+		`v = "a\tb\u00e9"`:             func(v *Value) bool { return v.Str == "a\tbé" },
+		`v = 'C:\path'`:                func(v *Value) bool { return v.Str == `C:\path` },
+		`v = 07:32:00`:                 func(v *Value) bool { return v.Kind == Datetime },
+		`v = 1979-05-27`:               func(v *Value) bool { return v.Kind == Datetime },
+		`v = []`:                       func(v *Value) bool { return v.Kind == Array && len(v.Items) == 0 },
+		`v = {}`:                       func(v *Value) bool { return v.Kind == Table && len(v.Fields) == 0 },
+		"v = \"\"\"\nab\\\n   c\"\"\"": func(v *Value) bool { return v.Str == "abc" },
+		"v = '''\nline\nnext'''":       func(v *Value) bool { return v.Str == "line\nnext" },
+	} {
+		root, err := Parse([]byte(input))
+		if err != nil {
+			t.Errorf("Parse(%q): %v", input, err)
+			continue
+		}
+		if v := root.Get("v"); !check(v) {
+			t.Errorf("Parse(%q) = %+v", input, v)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for input, want := range map[string]string{
+		"a = 1\na = 2":         `line 2: key "a" is already defined`,
+		"[a]\n[a]":             `line 2: table "a" is already defined`,
+		"a = 1\n[a]":           `line 2: table "a" is already defined`,
+		"a.b = 1\n[a]":         `line 2: table "a" is already defined`,
+		"a = { b = 1 }\n[a.c]": `line 2: key "a" is already defined`,
+		"a = 01":               `line 1: invalid value "01"`,
+		"a = 1__0":             `line 1: invalid value "1__0"`,
+		"a = \"open":           "line 1: unterminated string",
+		"a = 1 b = 2":          "line 1: expected the end of the line",
+		"a = [1 2]":            "line 1: expected ',' or ']' in array",
+		"\n\na = \"\\x\"":      `line 3: invalid escape \x`,
+		"[[a]]\nb = 1\n[a]":    `line 3: table "a" is already defined`,
+		"= 1":                  "line 1: expected a key",
+		"a = ":                 "line 1: expected a value",
+	} {
+		_, err := Parse([]byte(input))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Parse(%q) = %v, want %q", input, err, want)
+		}
+	}
+}
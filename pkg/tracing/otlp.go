@@ -0,0 +1,242 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	queueSize     = 2048            // Ended spans waiting for export, more are dropped
+	batchSize     = 512             // Spans per export request
+	flushInterval = 5 * time.Second // Longest time an ended span waits
+)
+
+// exporter posts ended spans in batches to an OTLP/HTTP collector
+type exporter struct {
+	url     string
+	service string
+	headers map[string]string
+	client  *http.Client
+
+	queue chan *Span
+	flush chan chan struct{}
+	once  sync.Once
+}
+
+func newExporter(opts Options) *exporter {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	e := &exporter{
+		url:     strings.TrimSuffix(opts.Endpoint, "/") + "/v1/traces",
+		service: opts.ServiceName,
+		headers: opts.Headers,
+		client:  &http.Client{Timeout: timeout},
+		queue:   make(chan *Span, queueSize),
+		flush:   make(chan chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// add queues a span, it is dropped rather than blocking the request that
+// ended it when the collector falls behind
+func (e *exporter) add(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+	}
+}
+
+// run collects spans and exports them when a batch is full, on every tick
+// and on shutdown
+func (e *exporter) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	send := func() {
+		if len(batch) > 0 {
+			if err := e.export(batch); err != nil {
+				log.Printf("tracing: %v", err)
+			}
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-e.flush:
+			for len(e.queue) > 0 {
+				batch = append(batch, <-e.queue)
+			}
+			send()
+			close(flushed)
+			return
+		}
+	}
+}
+
+// shutdown exports the queued spans and stops the exporter, only the first
+// call has an effect
+func (e *exporter) shutdown(ctx context.Context) error {
+	var err error
+	e.once.Do(func() {
+		flushed := make(chan struct{})
+		select {
+		case e.flush <- flushed:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+		select {
+		case <-flushed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	})
+	return err
+}
+
+// export posts a batch in the OTLP JSON encoding
+func (e *exporter) export(batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValue{StringValue: &e.service}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/mevdschee/tqserver"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("export %d spans: %w", len(batch), err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("export %d spans: collector returned %s", len(batch), resp.Status)
+	}
+	return nil
+}
+
+// OTLP JSON encoding of ExportTraceServiceRequest, IDs are hex and 64-bit
+// integers are strings
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 = error
+	Message string `json:"message,omitempty"`
+}
+
+// otlp converts an ended span for export
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.ctx.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.ctx.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != (SpanID{}) {
+		out.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for _, a := range s.attrs {
+		var v otlpValue
+		switch value := a.value.(type) {
+		case string:
+			v.StringValue = &value
+		case int64:
+			i := strconv.FormatInt(value, 10)
+			v.IntValue = &i
+		case bool:
+			v.BoolValue = &value
+		}
+		out.Attributes = append(out.Attributes, otlpAttribute{Key: a.key, Value: v})
+	}
+	if s.failed {
+		out.Status = otlpStatus{Code: 2, Message: s.err}
+	}
+	return out
+}
@@ -0,0 +1,269 @@
+// Package tracing provides a minimal OpenTelemetry compatible tracer: spans
+// are propagated with W3C traceparent headers and exported to an OTLP/HTTP
+// collector in the JSON encoding.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanKind describes the relation of a span to its remote peers, with the
+// values of the OTLP protocol
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+// SpanContext is the part of a span that is propagated to other services
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid reports whether the trace and span ID are set
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats the span context as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent parses a W3C traceparent header value, it reports false
+// for values that are malformed or carry an invalid ID
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	// Version 00 has exactly four fields, later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&0x01 != 0
+	return sc, sc.IsValid()
+}
+
+// Options configures a tracer
+type Options struct {
+	Endpoint    string            // OTLP/HTTP base URL, spans are posted to Endpoint + "/v1/traces"
+	ServiceName string            // service.name resource attribute
+	SampleRatio float64           // Fraction of new traces that are sampled (0-1)
+	Headers     map[string]string // Extra request headers, e.g. for authentication
+	Timeout     time.Duration     // Export request timeout (default: 10s)
+}
+
+// Tracer starts spans and exports the sampled ones when they end. A nil
+// *Tracer is valid and starts no spans, so callers need no checks when
+// tracing is off.
+type Tracer struct {
+	service  string
+	ratio    float64
+	exporter *exporter
+}
+
+// New creates a tracer that exports to opts.Endpoint in the background
+func New(opts Options) *Tracer {
+	if opts.ServiceName == "" {
+		opts.ServiceName = "tqserver"
+	}
+	return &Tracer{
+		service:  opts.ServiceName,
+		ratio:    opts.SampleRatio,
+		exporter: newExporter(opts),
+	}
+}
+
+// Shutdown exports the pending spans, waiting until ctx is done at most
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	return t.exporter.shutdown(ctx)
+}
+
+// Start starts a span as a child of the span or remote parent in ctx, or as
+// the root of a new trace, and returns a context holding it
+func (t *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent, ok := spanContextFrom(ctx); ok {
+		s.ctx.TraceID = parent.TraceID
+		s.ctx.Sampled = parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		rand.Read(s.ctx.TraceID[:])
+		s.ctx.Sampled = t.sample(s.ctx.TraceID)
+	}
+	rand.Read(s.ctx.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// sample decides on a new trace by its ID, like the TraceIdRatioBased
+// sampler of OpenTelemetry
+func (t *Tracer) sample(id TraceID) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	if t.ratio <= 0 {
+		return false
+	}
+	return binary.BigEndian.Uint64(id[8:])>>1 < uint64(t.ratio*(1<<63))
+}
+
+type spanKey struct{}
+
+type remoteKey struct{}
+
+// ContextWithRemoteParent returns a context in which spans continue the
+// trace of a traceparent header value, ctx is returned when it is invalid
+func ContextWithRemoteParent(ctx context.Context, traceparent string) context.Context {
+	sc, ok := ParseTraceparent(traceparent)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// SpanFromContext returns the current span of ctx, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// spanContextFrom returns the parent for a new span in ctx
+func spanContextFrom(ctx context.Context) (SpanContext, bool) {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.ctx, true
+	}
+	sc, ok := ctx.Value(remoteKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Span is a timed operation within a trace. All methods are safe to call on
+// a nil *Span.
+type Span struct {
+	tracer *Tracer
+	name   string
+	kind   SpanKind
+	ctx    SpanContext
+	parent SpanID
+	start  time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  []attribute
+	err    string
+	failed bool
+	ended  bool
+}
+
+type attribute struct {
+	key   string
+	value any // string, int64 or bool
+}
+
+// Context returns the propagated part of the span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.ctx
+}
+
+// Traceparent returns the traceparent header value that makes a remote
+// span a child of this span
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return s.ctx.Traceparent()
+}
+
+// SetAttribute sets an attribute, value is a string, an integer or a bool
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	switch v := value.(type) {
+	case int:
+		value = int64(v)
+	case int64, string, bool:
+	default:
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.attrs {
+		if s.attrs[i].key == key {
+			s.attrs[i].value = value
+			return
+		}
+	}
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.failed, s.err = true, message
+	s.mu.Unlock()
+}
+
+// End ends the span and queues it for export when sampled, later calls
+// have no effect
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end = true, time.Now()
+	s.mu.Unlock()
+	if s.ctx.Sampled {
+		s.tracer.exporter.add(s)
+	}
+}
@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(value)
+	if !ok || !sc.Sampled {
+		t.Fatalf("ParseTraceparent(%q) = %v, %v", value, sc, ok)
+	}
+	if got := sc.Traceparent(); got != value {
+		t.Errorf("Traceparent() = %q, want %q", got, value)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(invalid); ok {
+			t.Errorf("ParseTraceparent(%q) succeeded", invalid)
+		}
+	}
+
+	// Later versions may carry more fields
+	if _, ok := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); !ok {
+		t.Error("ParseTraceparent rejected a future version")
+	}
+}
+
+func TestSpanParenting(t *testing.T) {
+	tracer := &Tracer{ratio: 1, exporter: &exporter{queue: make(chan *Span, 10)}}
+	remote := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+
+	ctx, server := tracer.Start(ContextWithRemoteParent(context.Background(), remote), "GET /", KindServer)
+	_, child := tracer.Start(ctx, "upstream", KindClient)
+
+	if server.Context().TraceID != child.Context().TraceID || child.parent != server.Context().SpanID {
+		t.Error("child span is not part of the server span's trace")
+	}
+	if got := server.otlp().ParentSpanID; got != "00f067aa0ba902b7" {
+		t.Errorf("server parent = %q, want the remote span", got)
+	}
+	// The remote parent was not sampled, so neither are its children
+	child.End()
+	server.End()
+	if len(tracer.exporter.queue) != 0 {
+		t.Errorf("%d unsampled spans queued", len(tracer.exporter.queue))
+	}
+
+	// A nil tracer starts nil spans, which are safe to use
+	var off *Tracer
+	ctx, span := off.Start(context.Background(), "noop", KindServer)
+	span.SetAttribute("key", "value")
+	span.End()
+	if span != nil || SpanFromContext(ctx) != nil || span.Traceparent() != "" {
+		t.Error("nil tracer started a span")
+	}
+}
+
+func TestExport(t *testing.T) {
+	received := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("request to %s with Authorization %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		var req otlpRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("invalid body: %v", err)
+		}
+		received <- req
+	}))
+	defer collector.Close()
+
+	tracer := New(Options{
+		Endpoint:    collector.URL,
+		ServiceName: "test",
+		SampleRatio: 1,
+		Headers:     map[string]string{"Authorization": "Bearer secret"},
+	})
+	_, span := tracer.Start(context.Background(), "GET /api", KindServer)
+	span.SetAttribute("http.response.status_code", 502)
+	span.SetError("bad gateway")
+	span.End()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracer.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	req := <-received
+	if got := *req.ResourceSpans[0].Resource.Attributes[0].Value.StringValue; got != "test" {
+		t.Errorf("service.name = %q, want test", got)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	s := spans[0]
+	if s.Name != "GET /api" || s.Kind != KindServer || s.Status.Code != 2 || s.ParentSpanID != "" {
+		t.Errorf("unexpected span %+v", s)
+	}
+	if len(s.Attributes) != 1 || *s.Attributes[0].Value.IntValue != "502" {
+		t.Errorf("attributes = %+v", s.Attributes)
+	}
+}
@@ -0,0 +1,72 @@
+package uwsgi
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client sends requests to a uwsgi backend. The backend closes the connection
+// after each response, so connections are not pooled.
+type Client struct {
+	addr        string
+	transport   string // "tcp" or "unix"
+	dialTimeout time.Duration
+	rwTimeout   time.Duration
+}
+
+// NewClient constructs a new Client. An empty transport is derived from the address.
+func NewClient(addr, transport string, dialTimeout, rwTimeout time.Duration) *Client {
+	if transport == "" {
+		if strings.Contains(addr, "/") {
+			transport = "unix"
+		} else {
+			transport = "tcp"
+		}
+	}
+	return &Client{
+		addr:        addr,
+		transport:   transport,
+		dialTimeout: dialTimeout,
+		rwTimeout:   rwTimeout,
+	}
+}
+
+// DoRequest sends a request with the given CGI vars and body and returns the
+// raw response. uWSGI replies with a full HTTP response including status line.
+func (c *Client) DoRequest(vars map[string]string, stdin []byte) ([]byte, error) {
+	withLength := make(map[string]string, len(vars)+1)
+	for k, v := range vars {
+		withLength[k] = v
+	}
+	withLength["CONTENT_LENGTH"] = strconv.Itoa(len(stdin))
+
+	packet, err := EncodeRequest(withLength)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout(c.transport, c.addr, c.dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s %s: %w", c.transport, c.addr, err)
+	}
+	defer conn.Close()
+
+	if c.rwTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.rwTimeout))
+	}
+
+	if _, err := conn.Write(append(packet, stdin...)); err != nil {
+		return nil, fmt.Errorf("write request: %w", err)
+	}
+
+	// The response ends when the backend closes the connection
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		return response, fmt.Errorf("read response: %w", err)
+	}
+	return response, nil
+}
@@ -0,0 +1,145 @@
+package uwsgi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var (
+	ErrVarsTooLarge = errors.New("uwsgi vars exceed 65535 bytes")
+	ErrInvalidVars  = errors.New("invalid uwsgi vars")
+)
+
+// uwsgi packet constants
+const (
+	// HeaderSize is the size of the packet header
+	HeaderSize = 4
+
+	// ModifierWSGI is modifier1 for a standard WSGI/CGI request
+	ModifierWSGI uint8 = 0
+
+	// MaxVarsSize is the maximum size of the vars block
+	MaxVarsSize = 65535
+)
+
+// Header represents a uwsgi packet header
+type Header struct {
+	Modifier1 uint8
+	DataSize  uint16
+	Modifier2 uint8
+}
+
+// Encode encodes a header into bytes. The data size is little endian.
+func (h *Header) Encode() []byte {
+	buf := make([]byte, HeaderSize)
+	buf[0] = h.Modifier1
+	binary.LittleEndian.PutUint16(buf[1:3], h.DataSize)
+	buf[3] = h.Modifier2
+	return buf
+}
+
+// DecodeHeader decodes a header from bytes
+func DecodeHeader(data []byte) (*Header, error) {
+	if len(data) < HeaderSize {
+		return nil, fmt.Errorf("header too short: %d bytes", len(data))
+	}
+	return &Header{
+		Modifier1: data[0],
+		DataSize:  binary.LittleEndian.Uint16(data[1:3]),
+		Modifier2: data[3],
+	}, nil
+}
+
+// EncodeVars encodes the vars block, keys in sorted order
+func EncodeVars(vars map[string]string) ([]byte, error) {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf []byte
+	for _, name := range names {
+		value := vars[name]
+		if len(name) > MaxVarsSize || len(value) > MaxVarsSize {
+			return nil, ErrVarsTooLarge
+		}
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(name)))
+		buf = append(buf, name...)
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(value)))
+		buf = append(buf, value...)
+	}
+	if len(buf) > MaxVarsSize {
+		return nil, ErrVarsTooLarge
+	}
+	return buf, nil
+}
+
+// DecodeVars decodes a vars block into a map
+func DecodeVars(data []byte) (map[string]string, error) {
+	vars := make(map[string]string)
+
+	readString := func(pos int) (string, int, error) {
+		if pos+2 > len(data) {
+			return "", 0, ErrInvalidVars
+		}
+		n := int(binary.LittleEndian.Uint16(data[pos:]))
+		pos += 2
+		if pos+n > len(data) {
+			return "", 0, ErrInvalidVars
+		}
+		return string(data[pos : pos+n]), pos + n, nil
+	}
+
+	pos := 0
+	for pos < len(data) {
+		name, next, err := readString(pos)
+		if err != nil {
+			return nil, err
+		}
+		value, next, err := readString(next)
+		if err != nil {
+			return nil, err
+		}
+		vars[name] = value
+		pos = next
+	}
+	return vars, nil
+}
+
+// EncodeRequest encodes the packet header and vars block of a request. The
+// body (CONTENT_LENGTH bytes) follows the packet on the wire.
+func EncodeRequest(vars map[string]string) ([]byte, error) {
+	data, err := EncodeVars(vars)
+	if err != nil {
+		return nil, err
+	}
+	header := &Header{Modifier1: ModifierWSGI, DataSize: uint16(len(data))}
+	return append(header.Encode(), data...), nil
+}
+
+// ReadRequest reads a request packet and returns its header and vars. The
+// caller reads the body from r.
+func ReadRequest(r io.Reader) (*Header, map[string]string, error) {
+	headerBuf := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, headerBuf); err != nil {
+		return nil, nil, fmt.Errorf("read header: %w", err)
+	}
+	header, err := DecodeHeader(headerBuf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data := make([]byte, header.DataSize)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, fmt.Errorf("read vars: %w", err)
+	}
+	vars, err := DecodeVars(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, vars, nil
+}
@@ -0,0 +1,93 @@
+package uwsgi
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHeaderEncodeDecode(t *testing.T) {
+	header := &Header{Modifier1: ModifierWSGI, DataSize: 0x1234, Modifier2: 0}
+	encoded := header.Encode()
+
+	if !bytes.Equal(encoded, []byte{0, 0x34, 0x12, 0}) {
+		t.Errorf("Encode = %v, want little endian data size", encoded)
+	}
+
+	decoded, err := DecodeHeader(encoded)
+	if err != nil {
+		t.Fatalf("DecodeHeader failed: %v", err)
+	}
+	if *decoded != *header {
+		t.Errorf("DecodeHeader = %+v, want %+v", decoded, header)
+	}
+}
+
+func TestVarsEncodeDecode(t *testing.T) {
+	vars := map[string]string{
+		"REQUEST_METHOD": "GET",
+		"PATH_INFO":      "/hello",
+		"EMPTY":          "",
+	}
+
+	encoded, err := EncodeVars(vars)
+	if err != nil {
+		t.Fatalf("EncodeVars failed: %v", err)
+	}
+	decoded, err := DecodeVars(encoded)
+	if err != nil {
+		t.Fatalf("DecodeVars failed: %v", err)
+	}
+	for k, v := range vars {
+		if decoded[k] != v {
+			t.Errorf("%s = %q, want %q", k, decoded[k], v)
+		}
+	}
+
+	if _, err := DecodeVars(encoded[:len(encoded)-1]); err == nil {
+		t.Error("DecodeVars of truncated data succeeded, want error")
+	}
+}
+
+func TestEncodeVarsTooLarge(t *testing.T) {
+	if _, err := EncodeVars(map[string]string{"X": string(make([]byte, MaxVarsSize))}); err != ErrVarsTooLarge {
+		t.Errorf("EncodeVars error = %v, want ErrVarsTooLarge", err)
+	}
+}
+
+func TestClientDoRequest(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, vars, err := ReadRequest(conn)
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(vars["CONTENT_LENGTH"])
+		body, _ := io.ReadAll(io.LimitReader(conn, int64(n)))
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n" + vars["REQUEST_METHOD"] + " " + string(body)))
+	}()
+
+	client := NewClient(ln.Addr().String(), "tcp", 2*time.Second, 2*time.Second)
+	resp, err := client.DoRequest(map[string]string{"REQUEST_METHOD": "PUT"}, []byte("payload"))
+	if err != nil {
+		t.Fatalf("DoRequest failed: %v", err)
+	}
+
+	want := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\nPUT payload"
+	if string(resp) != want {
+		t.Errorf("response = %q, want %q", resp, want)
+	}
+}
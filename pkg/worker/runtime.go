@@ -1,6 +1,9 @@
 package worker
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,6 +12,10 @@ import (
 	"time"
 )
 
+// ProxyTokenHeader carries the secret of the worker on the requests of the
+// proxy
+const ProxyTokenHeader = "X-TQServer-Proxy-Token"
+
 // Runtime provides common worker initialization and server management
 type Runtime struct {
 	Name         string
@@ -19,6 +26,14 @@ type Runtime struct {
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	IdleTimeout  time.Duration
+
+	// Certificate files for mutual TLS with the proxy, empty for plain HTTP
+	TLSCert string
+	TLSKey  string
+	TLSCA   string
+
+	// Secret the proxy sends, requests without it are rejected when set
+	ProxyToken string
 }
 
 // NewRuntime creates a new runtime with configuration from environment variables
@@ -62,6 +77,10 @@ func NewRuntime() *Runtime {
 		ReadTimeout:  readTimeout,
 		WriteTimeout: writeTimeout,
 		IdleTimeout:  idleTimeout,
+		TLSCert:      os.Getenv("WORKER_TLS_CERT"),
+		TLSKey:       os.Getenv("WORKER_TLS_KEY"),
+		TLSCA:        os.Getenv("WORKER_TLS_CA"),
+		ProxyToken:   os.Getenv("WORKER_PROXY_TOKEN"),
 	}
 }
 
@@ -78,6 +97,9 @@ func (r *Runtime) StartServer(handler http.Handler) error {
 
 	// Wrap with logging middleware
 	handler = r.loggingMiddleware(handler)
+	if r.ProxyToken != "" {
+		handler = RequireProxy(r.ProxyToken, handler)
+	}
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%s", r.Port),
@@ -87,10 +109,44 @@ func (r *Runtime) StartServer(handler http.Handler) error {
 		IdleTimeout:  r.IdleTimeout,
 	}
 
+	if r.TLSCert != "" {
+		// Only the proxy, with a certificate of the same CA, may connect
+		caPEM, err := os.ReadFile(r.TLSCA)
+		if err != nil {
+			return fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("no CA certificate in %s", r.TLSCA)
+		}
+		server.TLSConfig = &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
+			MinVersion: tls.VersionTLS12,
+		}
+		log.Printf("Worker starting on port %s for path %s with mutual TLS", r.Port, r.Path)
+		return server.ListenAndServeTLS(r.TLSCert, r.TLSKey)
+	}
+
 	log.Printf("Worker starting on port %s for path %s", r.Port, r.Path)
 	return server.ListenAndServe()
 }
 
+// RequireProxy rejects requests that do not come through the proxy, those
+// without the secret of the worker, with 403 Forbidden. Servers not started
+// with StartServer wrap their handler with it, with WORKER_PROXY_TOKEN.
+func RequireProxy(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get(ProxyTokenHeader)), []byte(token)) != 1 {
+			http.Error(w, "Forbidden: requests are only accepted through the proxy", http.StatusForbidden)
+			return
+		}
+		// Not visible to the application
+		req.Header.Del(ProxyTokenHeader)
+		next.ServeHTTP(w, req)
+	})
+}
+
 // loggingMiddleware captures and logs request details
 func (r *Runtime) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
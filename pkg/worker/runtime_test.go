@@ -0,0 +1,33 @@
+package worker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireProxy(t *testing.T) {
+	handler := RequireProxy("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ProxyTokenHeader) != "" {
+			t.Error("token visible to the handler")
+		}
+	}))
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{"secret", http.StatusOK},
+		{"", http.StatusForbidden},
+		{"guess", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.token != "" {
+			req.Header.Set(ProxyTokenHeader, tt.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("token %q: status %d, want %d", tt.token, rec.Code, tt.want)
+		}
+	}
+}
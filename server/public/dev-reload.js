@@ -9,6 +9,11 @@
     let reconnectInterval = 1000;
     let reconnectTimeout;
     let isReloading = false;
+
+    // The route of the worker that served this page, set when the server
+    // injected the client
+    const script = document.currentScript;
+    const pageRoute = script && script.dataset.route;
     
     function connect() {
         console.log('[TQServer] Connecting to live reload...');
@@ -21,6 +26,41 @@
         };
         
         ws.onmessage = function(event) {
+            let message;
+            try {
+                message = JSON.parse(event.data);
+            } catch (e) {
+                message = { type: 'reload' };
+            }
+            // Stylesheets and images are swapped in place, keeping the page state
+            if (message.type === 'css') {
+                schedule(message.path, function() { swapStylesheets(message.path); });
+                return;
+            }
+            if (message.type === 'asset') {
+                schedule(message.path, function() { refreshAsset(message.path); });
+                return;
+            }
+            // Build failures show in an overlay until the worker builds again
+            if (message.type === 'build-error') {
+                showBuildError(message);
+                return;
+            }
+            if (message.type === 'build-ok') {
+                delete buildErrors[message.worker];
+                renderOverlay();
+                return;
+            }
+            // Test runs after a rebuild show in a badge
+            if (message.type === 'test') {
+                testRuns[message.worker] = message;
+                renderBadge();
+                return;
+            }
+            if (!affectsPage(message.route)) {
+                console.log('[TQServer] Worker at ' + message.route + ' reloaded, not this page');
+                return;
+            }
             console.log('[TQServer] Reload signal received, reloading page...');
             isReloading = true;
             // Close WebSocket cleanly before reload
@@ -45,6 +85,201 @@
         };
     }
     
+    // A reload of a worker applies to the pages it serves, pages that load
+    // the client themselves match the route like the router, by prefix
+    function affectsPage(route) {
+        if (!route) {
+            return true;
+        }
+        if (pageRoute) {
+            return pageRoute === route;
+        }
+        return location.pathname.startsWith(route);
+    }
+
+    // Editors write a file in several steps, one swap follows the last
+    const pending = {};
+    function schedule(path, fn) {
+        clearTimeout(pending[path]);
+        pending[path] = setTimeout(fn, 50);
+    }
+
+    function isLocal(url) {
+        try {
+            return new URL(url, location.href).origin === location.origin;
+        } catch (e) {
+            return false;
+        }
+    }
+
+    function samePath(url, path) {
+        return isLocal(url) && new URL(url, location.href).pathname === path;
+    }
+
+    function bust(url) {
+        const parsed = new URL(url, location.href);
+        parsed.searchParams.set('tqreload', Date.now());
+        return parsed.href;
+    }
+
+    // The new stylesheet loads next to the old one, which is removed once
+    // the new one applies, so the page never shows unstyled
+    function swapLink(link) {
+        const clone = link.cloneNode();
+        clone.href = bust(link.href);
+        clone.onload = clone.onerror = function() { link.remove(); };
+        link.after(clone);
+    }
+
+    function localStylesheets() {
+        return Array.from(document.querySelectorAll('link[rel="stylesheet"]')).filter(function(link) {
+            return isLocal(link.href);
+        });
+    }
+
+    // A changed stylesheet that no link loads may be imported by one, then
+    // all local stylesheets are swapped
+    function swapStylesheets(path) {
+        const links = localStylesheets();
+        const matching = links.filter(function(link) { return samePath(link.href, path); });
+        (matching.length ? matching : links).forEach(swapLink);
+        console.log('[TQServer] Stylesheet ' + path + ' swapped');
+    }
+
+    // Images are refreshed where the page shows them, otherwise a stylesheet
+    // may use them
+    function refreshAsset(path) {
+        let found = false;
+        document.querySelectorAll('img, link[rel~="icon"]').forEach(function(el) {
+            const attr = el.tagName === 'IMG' ? 'src' : 'href';
+            if (samePath(el[attr], path)) {
+                el[attr] = bust(el[attr]);
+                found = true;
+            }
+        });
+        if (!found) {
+            localStylesheets().forEach(swapLink);
+        }
+        console.log('[TQServer] Asset ' + path + ' refreshed');
+    }
+
+    // The build error page of a worker shows its error already, a new
+    // failure reloads it and other workers use the overlay
+    const errorPage = document.querySelector('meta[name="tqserver-build-error"]');
+    const buildErrors = {};
+    let overlay;
+
+    function showBuildError(message) {
+        if (errorPage && errorPage.content === message.worker) {
+            if (!message.replay) {
+                isReloading = true;
+                location.reload();
+            }
+            return;
+        }
+        console.log('[TQServer] Build failed for worker ' + message.worker);
+        buildErrors[message.worker] = message.error;
+        renderOverlay();
+    }
+
+    // The overlay lives in a shadow root, page styles do not apply to it
+    function renderOverlay() {
+        const workers = Object.keys(buildErrors);
+        if (!workers.length) {
+            if (overlay) {
+                overlay.remove();
+                overlay = null;
+            }
+            return;
+        }
+        if (!overlay) {
+            overlay = document.createElement('tqserver-build-error');
+            overlay.attachShadow({ mode: 'open' });
+            document.documentElement.appendChild(overlay);
+        }
+        const root = overlay.shadowRoot;
+        root.innerHTML = '<style>' +
+            '.backdrop { position: fixed; inset: 0; z-index: 2147483647; overflow: auto; background: rgba(0, 0, 0, 0.66); }' +
+            '.panel { max-width: 960px; margin: 40px auto; background: #1e1e1e; color: #d4d4d4; border-top: 6px solid #d32f2f; border-radius: 6px;' +
+            ' box-shadow: 0 10px 40px rgba(0, 0, 0, 0.5); font: 14px -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; }' +
+            'header { display: flex; align-items: center; justify-content: space-between; padding: 16px 20px; }' +
+            'h1 { margin: 0; font-size: 18px; color: #ff6b6b; }' +
+            'button { background: none; border: 0; color: #d4d4d4; font-size: 22px; cursor: pointer; }' +
+            'h2 { margin: 0; padding: 0 20px; font-size: 14px; }' +
+            'pre { margin: 8px 20px 20px; padding: 14px; overflow-x: auto; background: #252525; border-left: 4px solid #d32f2f;' +
+            ' font: 13px/1.5 "Courier New", Courier, monospace; white-space: pre-wrap; word-wrap: break-word; }' +
+            'footer { padding: 0 20px 16px; color: #999; }' +
+            '</style>';
+        const backdrop = document.createElement('div');
+        backdrop.className = 'backdrop';
+        const panel = document.createElement('div');
+        panel.className = 'panel';
+        const header = document.createElement('header');
+        const title = document.createElement('h1');
+        title.textContent = 'Build failed';
+        const close = document.createElement('button');
+        close.title = 'Hide until the next build';
+        close.textContent = '\u00d7';
+        close.onclick = function() { overlay.remove(); overlay = null; };
+        header.append(title, close);
+        panel.appendChild(header);
+        workers.forEach(function(worker) {
+            const name = document.createElement('h2');
+            name.textContent = 'Worker: ' + worker;
+            const output = document.createElement('pre');
+            output.textContent = buildErrors[worker];
+            panel.append(name, output);
+        });
+        const footer = document.createElement('footer');
+        footer.textContent = 'Fix the errors and save the file, this overlay closes when the build succeeds.';
+        panel.appendChild(footer);
+        backdrop.appendChild(panel);
+        root.appendChild(backdrop);
+    }
+
+    // The badge lists the last test run of each worker, a click on a failed
+    // run shows its output
+    const testRuns = {};
+    let badge;
+    let showOutput = false;
+
+    function renderBadge() {
+        if (!badge) {
+            badge = document.createElement('tqserver-tests');
+            badge.attachShadow({ mode: 'open' });
+            document.documentElement.appendChild(badge);
+        }
+        const root = badge.shadowRoot;
+        root.innerHTML = '<style>' +
+            '.badge { position: fixed; right: 12px; bottom: 12px; z-index: 2147483646; max-width: min(720px, calc(100vw - 24px));' +
+            ' display: flex; flex-direction: column; align-items: flex-end; gap: 6px; font: 12px -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, sans-serif; }' +
+            'button { border: 0; border-radius: 12px; padding: 4px 10px; color: #fff; font: inherit; cursor: default; box-shadow: 0 2px 8px rgba(0, 0, 0, 0.3); }' +
+            '.running { background: #616161; } .passed { background: #2e7d32; } .failed { background: #d32f2f; cursor: pointer; }' +
+            'pre { margin: 0; max-height: 50vh; overflow: auto; padding: 12px; background: #1e1e1e; color: #d4d4d4; border-left: 4px solid #d32f2f;' +
+            ' border-radius: 6px; font: 12px/1.5 "Courier New", Courier, monospace; white-space: pre-wrap; word-wrap: break-word; }' +
+            '</style>';
+        const box = document.createElement('div');
+        box.className = 'badge';
+        const labels = { running: 'running', passed: '\u2713 passed', failed: '\u2717 failed' };
+        Object.keys(testRuns).sort().forEach(function(worker) {
+            const run = testRuns[worker];
+            if (run.status === 'failed' && showOutput) {
+                const output = document.createElement('pre');
+                output.textContent = run.error || '';
+                box.appendChild(output);
+            }
+            const item = document.createElement('button');
+            item.className = run.status;
+            item.textContent = worker + ' tests ' + (labels[run.status] || run.status);
+            if (run.status === 'failed') {
+                item.title = showOutput ? 'Hide the output' : 'Show the output';
+                item.onclick = function() { showOutput = !showOutput; renderBadge(); };
+            }
+            box.appendChild(item);
+        });
+        root.appendChild(box);
+    }
+
     function scheduleReconnect() {
         clearTimeout(reconnectTimeout);
         reconnectTimeout = setTimeout(function() {
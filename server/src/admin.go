@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	runtimemetrics "runtime/metrics"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mevdschee/tqserver/pkg/phpfpm"
+)
+
+// startAdmin serves the profiling and runtime debug endpoints on the admin
+// listener, which is kept apart from the public port
+func (p *Proxy) startAdmin() error {
+	cfg := p.config.Admin
+	runtime.SetBlockProfileRate(cfg.BlockProfileRate)
+	runtime.SetMutexProfileFraction(cfg.MutexProfileFraction)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/gc", handleGCStats)
+	p.registerAdminAPI(mux)
+	// The operations that change the server, and its logs, need the token
+	// here, without one they are only served on the control socket
+	if cfg.Token != "" {
+		control := http.NewServeMux()
+		p.registerControl(control)
+		mux.Handle("/admin/api/", adminTokenAuth(cfg.Token, control))
+	}
+	p.registerHealth(mux)
+	mux.HandleFunc("GET /admin/dashboard", p.handleDashboard)
+
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to start admin listener: %w", err)
+	}
+	// No write timeout, CPU profiles and traces take as long as requested
+	p.adminServer = &http.Server{Handler: mux, ReadTimeout: 30 * time.Second}
+	go func() {
+		if err := p.adminServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Admin listener failed: %v", err)
+		}
+	}()
+	log.Printf("Admin endpoints (pprof, expvar, GC stats, status API, dashboard) at http://%s/debug/ and /admin/", listener.Addr())
+	return nil
+}
+
+// adminTokenAuth requires the admin token as a bearer token
+func adminTokenAuth(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tqserver admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gcStats summarizes the garbage collector and heap of the server process
+type gcStats struct {
+	NumGC         uint32    `json:"num_gc"`
+	LastGC        time.Time `json:"last_gc"`
+	PauseTotalMs  float64   `json:"pause_total_ms"`
+	RecentPauseMs []float64 `json:"recent_pause_ms"` // Newest first
+	CPUFraction   float64   `json:"gc_cpu_fraction"`
+	HeapAlloc     uint64    `json:"heap_alloc_bytes"`
+	HeapSys       uint64    `json:"heap_sys_bytes"`
+	HeapObjects   uint64    `json:"heap_objects"`
+	NextGC        uint64    `json:"next_gc_bytes"`
+	Goroutines    int       `json:"goroutines"`
+	GOGC          int       `json:"gogc"`
+	MemoryLimit   int64     `json:"memory_limit_bytes"`
+}
+
+// handleGCStats returns the GC and heap statistics as JSON
+func handleGCStats(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+
+	stats := gcStats{
+		NumGC:         mem.NumGC,
+		LastGC:        gc.LastGC,
+		PauseTotalMs:  float64(gc.PauseTotal) / float64(time.Millisecond),
+		RecentPauseMs: []float64{},
+		CPUFraction:   mem.GCCPUFraction,
+		HeapAlloc:     mem.HeapAlloc,
+		HeapSys:       mem.HeapSys,
+		HeapObjects:   mem.HeapObjects,
+		NextGC:        mem.NextGC,
+		Goroutines:    runtime.NumGoroutine(),
+	}
+	for i, pause := range gc.Pause {
+		if i == 10 {
+			break
+		}
+		stats.RecentPauseMs = append(stats.RecentPauseMs, float64(pause)/float64(time.Millisecond))
+	}
+	settings := []runtimemetrics.Sample{{Name: "/gc/gogc:percent"}, {Name: "/gc/gomemlimit:bytes"}}
+	runtimemetrics.Read(settings)
+	stats.GOGC = int(settings[0].Value.Uint64())
+	stats.MemoryLimit = int64(settings[1].Value.Uint64())
+
+	writeJSON(w, stats)
+}
+
+// handlePHPSlowlog returns the recent slowlog entries of PHP workers as JSON,
+// keyed by worker name, or "worker/pool" for additional pools. The "worker"
+// query parameter selects a single worker.
+func (p *Proxy) handlePHPSlowlog(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("worker")
+
+	result := make(map[string][]phpfpm.SlowEntry)
+	for _, worker := range p.router.GetAllWorkers() {
+		if worker.Type != "php" || (name != "" && worker.Name != name) {
+			continue
+		}
+		worker.mu.RLock()
+		pools := worker.PHPPools
+		worker.mu.RUnlock()
+
+		result[worker.Name] = []phpfpm.SlowEntry{}
+		for _, pool := range pools {
+			key := worker.Name
+			if pool.Name != "" {
+				key += "/" + pool.Name
+			}
+			entries := []phpfpm.SlowEntry{}
+			if pool.Slowlog != nil {
+				entries = pool.Slowlog.Entries()
+			}
+			result[key] = entries
+		}
+	}
+
+	if name != "" && len(result) == 0 {
+		http.Error(w, "Unknown PHP worker", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+// registerAdminAPI adds the JSON status API to a mux, the machine-readable
+// counterpart to the logs
+func (p *Proxy) registerAdminAPI(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/api/status", p.handleAPIStatus)
+	mux.HandleFunc("GET /admin/api/routes", p.handleAPIRoutes)
+	mux.HandleFunc("GET /admin/api/workers", p.handleAPIWorkers)
+	mux.HandleFunc("GET /admin/api/workers/{name}", p.handleAPIWorker)
+	mux.HandleFunc("GET /admin/api/events", p.handleAPIEvents)
+	mux.HandleFunc("GET /admin/api/requests", p.handleAPIRequests)
+	mux.HandleFunc("GET /admin/api/egress", p.handleAPIEgress)
+	mux.HandleFunc("GET /admin/api/audit", p.handleAPIAudit)
+	mux.HandleFunc("GET /admin/api/cluster", p.handleAPICluster)
+	mux.HandleFunc("GET /admin/api/assets", p.handleAPIAssets)
+	mux.HandleFunc("GET /admin/api/php/slowlog", p.handlePHPSlowlog)
+}
+
+// writeJSON writes an indented JSON response, without resolved secrets
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	var buf strings.Builder
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	enc.Encode(value)
+	io.WriteString(w, redactSecrets(buf.String()))
+}
+
+// serverStatus summarizes the server process
+type serverStatus struct {
+	Mode          string    `json:"mode"`
+	Started       time.Time `json:"started"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	GoVersion     string    `json:"go_version"`
+	Goroutines    int       `json:"goroutines"`
+	Workers       int       `json:"workers"`
+	Instances     int       `json:"instances"`
+	Healthy       int       `json:"healthy_workers"`
+	Socks5        bool      `json:"socks5"`
+}
+
+// routeStatus is an entry of the routing table
+type routeStatus struct {
+	Path   string `json:"path"`
+	Worker string `json:"worker"`
+	Type   string `json:"type"`
+}
+
+// workerStatus describes a worker and its instances
+type workerStatus struct {
+	Name        string           `json:"name"`
+	Path        string           `json:"path"`
+	Type        string           `json:"type"`
+	Healthy     bool             `json:"healthy"`
+	QueueDepth  int              `json:"queue_depth"`
+	Queue       queueStatus      `json:"queue"`
+	Requests    int64            `json:"requests"`
+	MinWorkers  int              `json:"min_workers"`
+	MaxWorkers  int              `json:"max_workers"`
+	Pinned      int              `json:"pinned_instances,omitempty"` // Manual scaling override
+	PinnedUntil *time.Time       `json:"pinned_until,omitempty"`
+	Drain       string           `json:"drain,omitempty"` // "draining" or "drained"
+	NextRecycle *time.Time       `json:"next_recycle,omitempty"`
+	InFlight    int64            `json:"in_flight"`
+	Build       buildStatus      `json:"build"`
+	Tests       *testStatus      `json:"tests,omitempty"` // Dev mode, see test.on_change
+	Instances   []instanceStatus `json:"instances"`
+}
+
+// queueStatus describes the settings of a worker queue and the waits of
+// its recent requests
+type queueStatus struct {
+	Size        int    `json:"size"`
+	MaxWaitMs   int64  `json:"max_wait_ms"`
+	MaxInFlight int64  `json:"max_in_flight"` // Requests per instance at most, 0 for no limit
+	Shed        string `json:"shed"`
+	Waits       int    `json:"waits"`                 // Recent waits the percentiles are taken of
+	WaitP50Ms   *int64 `json:"wait_p50_ms,omitempty"` // None until a request waited
+	WaitP90Ms   *int64 `json:"wait_p90_ms,omitempty"`
+	WaitP99Ms   *int64 `json:"wait_p99_ms,omitempty"`
+}
+
+// scale returns the scaling limits, or the pinned instances of a manual
+// override with the time it ends
+func (ws workerStatus) scale() string {
+	if ws.PinnedUntil != nil {
+		return fmt.Sprintf("%d until %s", ws.Pinned, ws.PinnedUntil.Local().Format("15:04"))
+	}
+	return fmt.Sprintf("%d-%d", ws.MinWorkers, ws.MaxWorkers)
+}
+
+// state returns "draining" or "drained" during a drain, otherwise "build
+// failed", "unhealthy" or "healthy"
+func (ws workerStatus) state() string {
+	switch {
+	case ws.Drain != "":
+		return ws.Drain
+	case !ws.Build.OK:
+		return "build failed"
+	case !ws.Healthy:
+		return "unhealthy"
+	}
+	return "healthy"
+}
+
+// buildStatus is the result of the last build of a worker
+type buildStatus struct {
+	OK       bool       `json:"ok"`
+	Error    string     `json:"error,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// testStatus is the last test run of a worker
+type testStatus struct {
+	Status   string     `json:"status"` // "running", "passed" or "failed"
+	Output   string     `json:"output,omitempty"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// instanceStatus describes a worker process, or a php-fpm pool
+type instanceStatus struct {
+	ID            string    `json:"id"`
+	PID           int       `json:"pid,omitempty"`
+	Port          int       `json:"port"`
+	Host          string    `json:"host,omitempty"` // Of a remote instance
+	Container     string    `json:"container,omitempty"`
+	Started       time.Time `json:"started"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+	Healthy       bool      `json:"healthy"`
+	LastRequest   time.Time `json:"last_request"`
+	Requests      int64     `json:"requests"`
+	InFlight      int64     `json:"in_flight"`
+	Draining      bool      `json:"draining,omitempty"`   // Stopped once idle
+	DebugPort     int       `json:"debug_port,omitempty"` // Delve listens on 127.0.0.1 here, see go.debug
+}
+
+// sortedWorkers returns the workers ordered by name
+func (p *Proxy) sortedWorkers() []*Worker {
+	workers := p.router.GetAllWorkers()
+	sort.Slice(workers, func(i, j int) bool { return workers[i].Name < workers[j].Name })
+	return workers
+}
+
+// workerHealthy reports whether a worker can serve requests
+func workerHealthy(worker *Worker) bool {
+	if worker.Type == "wasm" {
+		// In-process, healthy when its module loaded
+		hasBuildError, _ := worker.GetBuildError()
+		return !hasBuildError
+	}
+	return worker.IsHealthy()
+}
+
+// workerStatus takes a snapshot of a worker
+func (p *Proxy) workerStatus(worker *Worker) workerStatus {
+	healthy := workerHealthy(worker)
+
+	worker.mu.RLock()
+	defer worker.mu.RUnlock()
+
+	status := workerStatus{
+		Name:       worker.Name,
+		Path:       worker.Path,
+		Type:       worker.Type,
+		Healthy:    healthy,
+		QueueDepth: worker.Queue.len(),
+		Queue:      newQueueStatus(worker.Queue),
+		InFlight:   atomic.LoadInt64(&worker.Active),
+		Requests:   atomic.LoadInt64(&worker.RequestCount),
+		MinWorkers: worker.MinWorkers,
+		MaxWorkers: worker.MaxWorkers,
+		Build:      buildStatus{OK: !worker.HasBuildError, Error: worker.BuildError},
+		Instances:  []instanceStatus{},
+	}
+	if !worker.BuildTime.IsZero() {
+		finished := worker.BuildTime
+		status.Build.Finished = &finished
+	}
+	if run := worker.Tests; run != nil {
+		status.Tests = &testStatus{Status: run.Status, Output: run.Output, Started: run.Started}
+		if !run.Finished.IsZero() {
+			finished := run.Finished
+			status.Tests.Finished = &finished
+		}
+	}
+	now := time.Now()
+	if worker.Pinned > 0 && now.Before(worker.PinnedUntil) {
+		until := worker.PinnedUntil
+		status.Pinned, status.PinnedUntil = worker.Pinned, &until
+	}
+	if worker.Draining {
+		status.Drain = worker.drainState()
+	}
+	if !worker.NextRecycle.IsZero() {
+		next := worker.NextRecycle
+		status.NextRecycle = &next
+	}
+	for _, inst := range slices.Concat(worker.Instances, worker.DrainingInstances) {
+		instance := instanceStatus{
+			ID:            inst.ID,
+			Port:          inst.Port,
+			Host:          inst.Host,
+			Container:     inst.ContainerName,
+			Started:       inst.StartTime,
+			UptimeSeconds: int64(now.Sub(inst.StartTime).Seconds()),
+			Healthy:       inst.Healthy,
+			LastRequest:   inst.LastRequest(),
+			Requests:      atomic.LoadInt64(&inst.Requests),
+			InFlight:      atomic.LoadInt64(&inst.Active),
+			Draining:      inst.Draining,
+			DebugPort:     inst.DebugPort,
+		}
+		if inst.Process != nil {
+			instance.PID = inst.Process.Pid
+		}
+		status.Instances = append(status.Instances, instance)
+	}
+	return status
+}
+
+// newQueueStatus takes a snapshot of a worker queue
+func newQueueStatus(q *requestQueue) queueStatus {
+	size, maxWait, shed := q.settings()
+	status := queueStatus{Size: size, MaxWaitMs: maxWait.Milliseconds(), MaxInFlight: q.limit(), Shed: shed}
+	waits, samples := q.percentiles(0.5, 0.9, 0.99)
+	if samples == 0 {
+		return status
+	}
+	ms := make([]int64, len(waits))
+	for i, wait := range waits {
+		ms[i] = wait.Milliseconds()
+	}
+	status.Waits = samples
+	status.WaitP50Ms, status.WaitP90Ms, status.WaitP99Ms = &ms[0], &ms[1], &ms[2]
+	return status
+}
+
+// handleAPIStatus returns a summary of the server
+func (p *Proxy) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
+	status := serverStatus{
+		Mode:          p.config.Mode,
+		Started:       p.started,
+		UptimeSeconds: int64(time.Since(p.started).Seconds()),
+		GoVersion:     runtime.Version(),
+		Goroutines:    runtime.NumGoroutine(),
+		Socks5:        p.config.Socks5.Enabled,
+	}
+	for _, worker := range p.sortedWorkers() {
+		ws := p.workerStatus(worker)
+		status.Workers++
+		status.Instances += len(ws.Instances)
+		if ws.Healthy {
+			status.Healthy++
+		}
+	}
+	writeJSON(w, status)
+}
+
+// handleAPIRoutes returns the routing table, ordered by path
+func (p *Proxy) handleAPIRoutes(w http.ResponseWriter, r *http.Request) {
+	routes := []routeStatus{}
+	for _, worker := range p.router.GetAllWorkers() {
+		routes = append(routes, routeStatus{Path: worker.Path, Worker: worker.Name, Type: worker.Type})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+	writeJSON(w, routes)
+}
+
+// handleAPIWorkers returns every worker with its instances
+func (p *Proxy) handleAPIWorkers(w http.ResponseWriter, r *http.Request) {
+	workers := []workerStatus{}
+	for _, worker := range p.sortedWorkers() {
+		workers = append(workers, p.workerStatus(worker))
+	}
+	writeJSON(w, workers)
+}
+
+// handleAPIWorker returns a single worker with its instances
+func (p *Proxy) handleAPIWorker(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	for _, worker := range p.router.GetAllWorkers() {
+		if worker.Name == name {
+			writeJSON(w, p.workerStatus(worker))
+			return
+		}
+	}
+	http.Error(w, "Unknown worker", http.StatusNotFound)
+}
+
+// handleAPIEvents returns the recent lifecycle events, oldest first. The
+// "worker" parameter selects a worker, "since" skips the events up to an
+// ID for polling and "limit" keeps only the newest ones.
+func (p *Proxy) handleAPIEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	since, _ := strconv.ParseInt(query.Get("since"), 10, 64)
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	events := []Event{}
+	if p.events != nil {
+		events = p.events.Recent(query.Get("worker"), since, limit)
+	}
+	writeJSON(w, events)
+}
+
+// handleAPIRequests returns the recent requests of the proxy, oldest first.
+// The "limit" parameter keeps only the newest ones.
+func (p *Proxy) handleAPIRequests(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	writeJSON(w, p.requests.Recent(limit))
+}
+
+// handleAPIAssets returns the asset manifests, the fingerprinted path of
+// each asset by public directory, empty when the asset cache is off
+func (p *Proxy) handleAPIAssets(w http.ResponseWriter, r *http.Request) {
+	manifests := map[string]map[string]string{}
+	if p.assets != nil {
+		manifests = p.assets.list(p.projectRoot)
+	}
+	writeJSON(w, manifests)
+}
+
+// handleAPIEgress returns the recent outbound connections of the workers
+// through the SOCKS5 proxy, oldest first. The "worker" parameter selects a
+// worker.
+func (p *Proxy) handleAPIEgress(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("worker")
+	entries := []*ConnectionLog{}
+	for _, entry := range p.traffic.Recent() {
+		if name == "" || entry.WorkerName == name {
+			entries = append(entries, entry)
+		}
+	}
+	writeJSON(w, entries)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sizes of the asset cache when the assets section does not set them
+const (
+	defaultAssetMaxFileSize  = 64 * 1024
+	defaultAssetMaxTotalSize = 64 * 1024 * 1024
+	defaultAssetMaxAge       = 365 * 24 * 60 * 60
+)
+
+var (
+	// assetFingerprinted matches a fingerprinted URL path, like
+	// "/css/app.3f2a9b1c.css", with the path before and after the hash
+	assetFingerprinted = regexp.MustCompile(`^(.*)\.[0-9a-f]{8}(\.[^./]+)$`)
+	// assetURLAttr matches a src or href attribute, with its URL up to the
+	// query or fragment
+	assetURLAttr = regexp.MustCompile(`(?i)(\s(?:src|href)\s*=\s*["']?)([^"'\s>?#]+)`)
+	// assetBaseTag matches a base element, which changes how relative URLs
+	// resolve
+	assetBaseTag = regexp.MustCompile(`(?i)<base\s`)
+)
+
+// asset is a public file held in memory
+type asset struct {
+	body        []byte
+	name        string // Base name, for the content type
+	modTime     time.Time
+	etag        string
+	fingerprint string // URL path with the content hash, empty without an extension
+}
+
+// assetManifest is the assets of a public directory by URL path, also by
+// their fingerprinted paths
+type assetManifest struct {
+	assets        map[string]*asset
+	fingerprinted map[string]*asset
+	size          int64
+}
+
+// assetCache holds the small files of the public directories in memory,
+// each directory is loaded again when the file watcher sees it change
+type assetCache struct {
+	config   *AssetCacheConfig
+	debounce time.Duration
+
+	mu        sync.RWMutex
+	manifests map[string]*assetManifest // By directory, nil while it is loaded again
+	php       map[string]bool           // Directories of PHP workers, scripts are no assets
+	size      int64
+	reloads   map[string]*time.Timer
+}
+
+// newAssetCache returns the asset cache, nil when it is off
+func newAssetCache(c *AssetCacheConfig, debounce time.Duration) *assetCache {
+	if c == nil || !c.Enabled {
+		return nil
+	}
+	return &assetCache{
+		config:    c,
+		debounce:  debounce,
+		manifests: make(map[string]*assetManifest),
+		php:       make(map[string]bool),
+		reloads:   make(map[string]*time.Timer),
+	}
+}
+
+// manifest returns the assets of a public directory, loading it on first
+// use. It returns nil while the directory is loaded again after a change.
+func (a *assetCache) manifest(dir string, php bool) *assetManifest {
+	a.mu.RLock()
+	m, ok := a.manifests[dir]
+	a.mu.RUnlock()
+	if ok {
+		return m
+	}
+	return a.load(dir, php, false)
+}
+
+// load reads the assets of a directory and replaces its manifest, a first
+// load keeps the manifest of a concurrent one
+func (a *assetCache) load(dir string, php bool, reload bool) *assetManifest {
+	a.mu.RLock()
+	budget := int64(a.config.MaxTotalSize) - a.size
+	if old := a.manifests[dir]; old != nil {
+		budget += old.size
+	}
+	a.mu.RUnlock()
+
+	m := loadAssetManifest(dir, php, int64(a.config.MaxFileSize), budget)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	old, ok := a.manifests[dir]
+	if ok && !reload {
+		return old
+	}
+	if old != nil {
+		a.size -= old.size
+	}
+	a.size += m.size
+	a.manifests[dir] = m
+	a.php[dir] = php
+	a.updateMetrics()
+	return m
+}
+
+// loadAssetManifest reads the files of dir up to maxFile bytes, together
+// not more than budget
+func loadAssetManifest(dir string, php bool, maxFile, budget int64) *assetManifest {
+	m := &assetManifest{assets: make(map[string]*asset), fingerprinted: make(map[string]*asset)}
+	filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := os.Stat(file)
+		if err != nil || !info.Mode().IsRegular() || info.Size() > maxFile || m.size+info.Size() > budget {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return nil
+		}
+		urlPath := "/" + filepath.ToSlash(rel)
+		if php && strings.Contains(urlPath, ".php") {
+			return nil
+		}
+		body, err := os.ReadFile(file)
+		if err != nil || int64(len(body)) > maxFile || m.size+int64(len(body)) > budget {
+			return nil
+		}
+		sum := sha256.Sum256(body)
+		hash := hex.EncodeToString(sum[:])
+		as := &asset{body: body, name: info.Name(), modTime: info.ModTime(), etag: `"` + hash[:16] + `"`}
+		if ext := path.Ext(urlPath); ext != "" && strings.TrimSuffix(path.Base(urlPath), ext) != "" {
+			as.fingerprint = strings.TrimSuffix(urlPath, ext) + "." + hash[:8] + ext
+			m.fingerprinted[as.fingerprint] = as
+		}
+		m.assets[urlPath] = as
+		m.size += int64(len(body))
+		return nil
+	})
+	return m
+}
+
+// changed forgets the manifests of the directories a changed path is in or
+// below, their files are served from disk until they are loaded again
+func (a *assetCache) changed(changed string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for dir, m := range a.manifests {
+		if !pathWithin(changed, dir) && !pathWithin(dir, changed) {
+			continue
+		}
+		if m != nil {
+			a.size -= m.size
+			a.manifests[dir] = nil
+			a.updateMetrics()
+		}
+		if timer := a.reloads[dir]; timer != nil {
+			timer.Stop()
+		}
+		php := a.php[dir]
+		a.reloads[dir] = time.AfterFunc(a.debounce, func() {
+			a.mu.Lock()
+			delete(a.reloads, dir)
+			a.mu.Unlock()
+			m := a.load(dir, php, true)
+			log.Printf("Asset manifest of %s regenerated: %d assets, %d bytes", dir, len(m.assets), m.size)
+		})
+	}
+}
+
+// purge forgets all manifests, each directory is loaded again on its next
+// request
+func (a *assetCache) purge() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for dir, timer := range a.reloads {
+		timer.Stop()
+		delete(a.reloads, dir)
+	}
+	clear(a.manifests)
+	a.size = 0
+	a.updateMetrics()
+}
+
+// pathWithin tells whether path is dir or below it
+func pathWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// serve serves a request for a file of the manifest, plain paths are
+// revalidated with their ETag and fingerprinted ones cached for max_age_seconds
+func (a *assetCache) serve(w http.ResponseWriter, r *http.Request, m *assetManifest) bool {
+	if m == nil || strings.HasSuffix(r.URL.Path, "/index.html") {
+		return false
+	}
+	as := m.assets[r.URL.Path]
+	cacheControl := "no-cache"
+	if as == nil {
+		if as = m.fingerprinted[r.URL.Path]; as != nil {
+			cacheControl = "public, max-age=" + strconv.Itoa(a.config.MaxAgeSeconds) + ", immutable"
+		} else if parts := assetFingerprinted.FindStringSubmatch(r.URL.Path); parts != nil {
+			// A fingerprint of before a change, the page is older than the file
+			as = m.assets[parts[1]+parts[2]]
+		}
+	}
+	if as == nil {
+		return false
+	}
+	setResponseSource(w, sourceStatic)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", as.etag)
+	http.ServeContent(w, r, as.name, as.modTime, bytes.NewReader(as.body))
+	return true
+}
+
+// rewrite replaces the paths of assets in the src and href attributes of a
+// page with their fingerprinted paths, the first manifest with a path wins.
+// Relative paths are resolved against the path of the page, pages with a
+// base element are kept.
+func (a *assetCache) rewrite(body []byte, page string, manifests ...*assetManifest) []byte {
+	if assetBaseTag.Match(body) {
+		return body
+	}
+	dir := page[:strings.LastIndex(page, "/")+1]
+	return assetURLAttr.ReplaceAllFunc(body, func(attr []byte) []byte {
+		parts := assetURLAttr.FindSubmatch(attr)
+		ref := string(parts[2])
+		if strings.Contains(ref, ":") || strings.HasPrefix(ref, "//") {
+			return attr
+		}
+		urlPath := ref
+		if !strings.HasPrefix(ref, "/") {
+			urlPath = path.Join(dir, ref)
+		}
+		for _, m := range manifests {
+			if m == nil {
+				continue
+			}
+			as := m.assets[urlPath]
+			if as == nil {
+				continue
+			}
+			name := path.Base(urlPath)
+			if as.fingerprint == "" || !strings.HasSuffix(ref, name) {
+				return attr
+			}
+			return slices.Concat(parts[1], []byte(strings.TrimSuffix(ref, name)+path.Base(as.fingerprint)))
+		}
+		return attr
+	})
+}
+
+// list returns the fingerprinted paths of the loaded directories by
+// directory, relative to the project
+func (a *assetCache) list(projectRoot string) map[string]map[string]string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	result := make(map[string]map[string]string)
+	for dir, m := range a.manifests {
+		if m == nil {
+			continue
+		}
+		if rel, err := filepath.Rel(projectRoot, dir); err == nil {
+			dir = filepath.ToSlash(rel)
+		}
+		paths := make(map[string]string)
+		for urlPath, as := range m.assets {
+			paths[urlPath] = as.fingerprint
+		}
+		result[dir] = paths
+	}
+	return result
+}
+
+// updateMetrics sets the size of the cache, a.mu is held
+func (a *assetCache) updateMetrics() {
+	files := 0
+	for _, m := range a.manifests {
+		if m != nil {
+			files += len(m.assets)
+		}
+	}
+	GetMetrics().SetAssetCache(files, a.size)
+}
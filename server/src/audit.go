@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditHistory is the number of audit entries kept for the admin API
+const auditHistory = 200
+
+// Administrative actions
+const (
+	AuditConfigReload  = "config_reload"
+	AuditModeSwitch    = "mode_switch"
+	AuditWorkerRestart = "worker_restart"
+	AuditWorkerScale   = "worker_scale"
+	AuditWorkerDrain   = "worker_drain"
+	AuditServerDrain   = "server_drain"
+	AuditDeploy        = "deploy"
+	AuditInstances     = "worker_instances"
+	AuditConfigDeploy  = "config_deploy"
+)
+
+// AuditEntry is an administrative action, who did it and what it changed
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Actor  string    `json:"actor"` // e.g. "signal:SIGHUP" or "api:admin@10.0.0.5"
+	Target string    `json:"target,omitempty"`
+	Before string    `json:"before,omitempty"`
+	After  string    `json:"after,omitempty"`
+	Result string    `json:"result"` // "ok" or the error
+}
+
+// AuditLog appends the administrative actions to a file as JSON lines, it
+// is never rotated or truncated by the server
+type AuditLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries []AuditEntry
+}
+
+// NewAuditLog opens the audit log, it is nil when disabled
+func NewAuditLog(config *Config, projectRoot string) (*AuditLog, error) {
+	if !config.Audit.Enabled || config.Audit.File == "" {
+		return nil, nil
+	}
+	path := config.Audit.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(projectRoot, path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("audit log: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("audit log: %w", err)
+	}
+	return &AuditLog{file: file}, nil
+}
+
+// Record appends an entry, the time is set when missing and the result is
+// "ok" when empty
+func (a *AuditLog) Record(entry AuditEntry) {
+	if a == nil {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.Result == "" {
+		entry.Result = "ok"
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.entries) == auditHistory {
+		a.entries = a.entries[1:]
+	}
+	a.entries = append(a.entries, entry)
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+// Recent returns up to limit of the newest entries, oldest first
+func (a *AuditLog) Recent(limit int) []AuditEntry {
+	if a == nil {
+		return []AuditEntry{}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := append([]AuditEntry{}, a.entries...)
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
+
+// Close closes the file
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// configSummary describes a configuration in one line, for the before and
+// after of a reload
+func configSummary(config *Config, workerConfigs []*WorkerConfigWithMeta) string {
+	workers := make([]string, 0, len(workerConfigs))
+	for _, wc := range workerConfigs {
+		worker := wc.Name
+		if scaling := wc.Config.Scaling; scaling != nil {
+			worker += fmt.Sprintf("(%d-%d)", scaling.MinWorkers, scaling.MaxWorkers)
+		}
+		workers = append(workers, worker)
+	}
+	sort.Strings(workers)
+	return fmt.Sprintf("mode=%s port=%d workers=%s", config.Mode, config.Server.Port, strings.Join(workers, ","))
+}
+
+// auditKey is the context key of the entry of an audited request
+type auditKey struct{}
+
+// audited records the calls of an admin API handler that changes the server.
+// The handler fills in the target and summaries with setAuditDetails, a
+// response of 400 or more is recorded as failed.
+func (p *Proxy) audited(action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entry := &AuditEntry{Time: time.Now(), Action: action, Actor: requestActor(r)}
+		wrapped := &statusCapturingWriter{ResponseWriter: w, statusCode: 200}
+		next(wrapped, r.WithContext(context.WithValue(r.Context(), auditKey{}, entry)))
+		if wrapped.statusCode >= 400 {
+			entry.Result = "failed: " + strconv.Itoa(wrapped.statusCode) + " " + http.StatusText(wrapped.statusCode)
+		}
+		p.audit.Record(*entry)
+	}
+}
+
+// setAuditDetails sets what an audited request changed
+func setAuditDetails(r *http.Request, target, before, after string) {
+	if entry, ok := r.Context().Value(auditKey{}).(*AuditEntry); ok {
+		entry.Target, entry.Before, entry.After = target, before, after
+	}
+}
+
+// requestActor names the client of an admin request, by its basic auth user
+// when there is one, or the user that ran "tqserver ctl"
+func requestActor(r *http.Request) string {
+	if fromControlSocket(r) {
+		if user := r.Header.Get(ctlUserHeader); user != "" {
+			return "ctl:" + user
+		}
+		return "ctl"
+	}
+	host := clientIP(r)
+	if username, _, ok := r.BasicAuth(); ok && username != "" {
+		return "api:" + username + "@" + host
+	}
+	return "api@" + host
+}
+
+// handleAPIAudit returns the recent administrative actions, oldest first.
+// The "limit" parameter keeps only the newest ones.
+func (p *Proxy) handleAPIAudit(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	writeJSON(w, p.audit.Recent(limit))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// buildResult is the outcome of building the server or a worker
+type buildResult struct {
+	Target     string `json:"target"` // "server" or the worker name
+	Type       string `json:"type"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// buildReport is the output of "tqserver build -json"
+type buildReport struct {
+	OK      bool          `json:"ok"`
+	Mode    string        `json:"mode"`
+	Results []buildResult `json:"results"`
+}
+
+// runBuild builds the server and the workers without starting them, with
+// the builder of the supervisor. It exits with status 1 when a build fails.
+func runBuild(args []string) {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	configPath := flags.String("config", "config/server.yaml", "Path to config file")
+	mode := flags.String("mode", "", "Server mode to build for: dev or prod")
+	jsonOutput := flags.Bool("json", false, "Print the results as JSON")
+	buildServer := flags.Bool("server", false, "Also build the server when workers are selected")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: tqserver build [-config path] [-mode dev|prod] [-json] [-server] [worker...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	projectRoot, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Failed to get working directory: %v", err)
+	}
+	config, workerConfigs, selected := loadBuildTargets("build", *configPath, *mode, flags.Args())
+	// Also for a config that runs prebuilt workers, which are built here
+	config.Workers.Prebuilt = false
+	// Without names, the server and every worker enabled in the mode are built
+	if flags.NArg() == 0 {
+		*buildServer = true
+	}
+
+	report := buildReport{OK: true, Mode: config.Mode}
+	record := func(result buildResult, err error, start time.Time) {
+		result.OK = err == nil
+		if err != nil {
+			result.Error = strings.TrimSpace(err.Error())
+			report.OK = false
+		}
+		result.DurationMs = time.Since(start).Milliseconds()
+		report.Results = append(report.Results, result)
+		if !*jsonOutput {
+			printBuildResult(result)
+		}
+	}
+
+	if *buildServer {
+		start := time.Now()
+		record(buildResult{Target: "server", Type: "go"}, buildServerBinary(config), start)
+	}
+	supervisor := NewSupervisor(config, projectRoot, NewRouter(config.Workers.Directory, projectRoot, workerConfigs), workerConfigs)
+	for _, workerMeta := range selected {
+		start := time.Now()
+		record(buildResult{Target: workerMeta.Name, Type: workerMeta.Config.Type}, supervisor.buildWorker(newWorker(workerMeta)), start)
+	}
+
+	if *jsonOutput {
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+	}
+	if !report.OK {
+		os.Exit(1)
+	}
+}
+
+// loadBuildTargets loads the server config for a mode and the configs of
+// the named workers, or of every worker enabled in the mode without names.
+// It exits on errors, with status 2 for an unknown worker.
+func loadBuildTargets(command, configPath, mode string, names []string) (*Config, []*WorkerConfigWithMeta, []*WorkerConfigWithMeta) {
+	configFile := findConfigFile(configPath)
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, errorProblem(configFile, err))
+		os.Exit(1)
+	}
+	if mode != "" {
+		config.Mode = mode
+	}
+	// The worker configs are read quietly, only the results are printed
+	log.SetOutput(io.Discard)
+	workerConfigs, err := LoadWorkerConfigs(config.Workers.Directory, config.SecretStore())
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load worker configs: %v\n", err)
+		os.Exit(1)
+	}
+
+	var selected []*WorkerConfigWithMeta
+	for _, name := range names {
+		workerMeta := findWorkerConfig(workerConfigs, name)
+		if workerMeta == nil {
+			fmt.Fprintf(os.Stderr, "tqserver %s: %v %q\n", command, errUnknownWorker, name)
+			os.Exit(2)
+		}
+		selected = append(selected, workerMeta)
+	}
+	if len(names) == 0 {
+		for _, workerMeta := range workerConfigs {
+			if workerMeta.Config.IsEnabled(config.Mode) {
+				selected = append(selected, workerMeta)
+			}
+		}
+	}
+	return config, workerConfigs, selected
+}
+
+// buildServerBinary builds the server to server/bin/tqserver, like
+// scripts/build.sh, stripped in production mode
+func buildServerBinary(config *Config) error {
+	return goBuild(".", "server/bin/tqserver", "./server/src", nil, !config.IsDevelopmentMode())
+}
+
+// goBuild builds the Go package pkg in dir to output, with extra environment
+// variables such as GOOS, stripped of symbols when strip is set
+func goBuild(dir, output, pkg string, env []string, strip bool) error {
+	args := []string{"build", "-o", output}
+	if strip {
+		args = append(args, "-ldflags=-s -w")
+	}
+	cmd := exec.Command("go", append(args, pkg)...)
+	cmd.Dir = dir
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("go build failed: %s", out)
+	}
+	return nil
+}
+
+// printBuildResult prints a build result as a line, with the error below it
+func printBuildResult(result buildResult) {
+	duration := (time.Duration(result.DurationMs) * time.Millisecond).String()
+	if result.OK {
+		fmt.Printf("✓ %s (%s) %s\n", result.Target, result.Type, duration)
+		return
+	}
+	fmt.Printf("✗ %s (%s) %s\n%s\n", result.Target, result.Type, duration, result.Error)
+}
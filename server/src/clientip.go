@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientIPKey is the context key of the client IP of a request
+type clientIPKey struct{}
+
+// clientIPResolver derives the client IP of requests from X-Forwarded-For or
+// X-Real-IP, only for requests from trusted proxies. A nil resolver trusts no
+// proxy.
+type clientIPResolver struct {
+	trusted []netip.Prefix
+}
+
+// newClientIPResolver creates a resolver for the trusted proxies, invalid
+// entries are skipped, they are reported by ValidateConfig
+func newClientIPResolver(trustedProxies []string) *clientIPResolver {
+	c := &clientIPResolver{}
+	for _, entry := range trustedProxies {
+		if prefix, err := parseTrustedProxy(entry); err == nil {
+			c.trusted = append(c.trusted, prefix)
+		}
+	}
+	return c
+}
+
+// parseTrustedProxy parses an IP address or a CIDR range
+func parseTrustedProxy(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%q is not a CIDR range", entry)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an IP address", entry)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// trusts reports whether an address is a trusted proxy
+func (c *clientIPResolver) trusts(ip string) bool {
+	if c == nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range c.trusted {
+		if prefix.Contains(addr.Unmap()) || prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the client IP of a request: the rightmost address in
+// X-Forwarded-For that is not a trusted proxy, or X-Real-IP, when the peer is
+// a trusted proxy. The forwarding headers of untrusted peers are removed, so
+// workers never see spoofed values, and X-Real-IP is set to the result.
+func (c *clientIPResolver) resolve(r *http.Request) string {
+	client := peerIP(r)
+	if !c.trusts(client) {
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Set("X-Real-IP", client)
+		return client
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		if real, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			client = real.String()
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		// A malformed hop ends the chain at the last valid address
+		if _, err := netip.ParseAddr(hops[i]); err != nil {
+			break
+		}
+		client = hops[i]
+		if !c.trusts(client) {
+			break
+		}
+	}
+	r.Header.Set("X-Real-IP", client)
+	return client
+}
+
+// withClientIP stores the client IP of a request in its context
+func withClientIP(r *http.Request, ip string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip))
+}
+
+// clientIP returns the client IP of a request, the peer address for requests
+// that were not resolved, like those of the admin listener
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
+
+// peerIP returns the address of the peer that connected
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clusterStatePath serves the workers of a node to its peers, on the public
+// port
+const clusterStatePath = "/_cluster/state"
+
+// clusterHopHeader names the node that forwarded a request, the receiving
+// node serves it and never forwards it again
+const clusterHopHeader = "X-TQServer-Cluster-Node"
+
+// clusterDownAfter is the number of failed polls after which a peer is no
+// longer routed to
+const clusterDownAfter = 3
+
+// clusterStateLimit is the size of the state read from a peer
+const clusterStateLimit = 1 << 20
+
+// clusterState is the routing and health state a node shares
+type clusterState struct {
+	Node    string          `json:"node"`
+	Workers []clusterWorker `json:"workers"`
+}
+
+// clusterWorker is a worker of a node as seen by its peers
+type clusterWorker struct {
+	Name       string `json:"name"`
+	Path       string `json:"path"`
+	Type       string `json:"type"`
+	Healthy    bool   `json:"healthy"`
+	Instances  int    `json:"instances"` // Healthy instances
+	QueueDepth int    `json:"queue_depth"`
+	Draining   bool   `json:"draining,omitempty"`
+}
+
+// clusterPeer is another node of the cluster and its last known state
+type clusterPeer struct {
+	URL      *url.URL
+	Node     string // Reported by the peer
+	Workers  []clusterWorker
+	Up       bool
+	Updated  time.Time // Last successful poll
+	Error    string    // Of the last failed poll
+	failures int
+}
+
+// Cluster polls the state of the peers and picks the peer that serves a
+// request this node cannot
+type Cluster struct {
+	config ClusterConfig
+	node   string
+	router *Router
+	events *EventLog
+	client *http.Client
+	peers  []*clusterPeer
+	next   atomic.Uint64 // Round robin over the peers serving a route
+	mu     sync.RWMutex
+	stop   chan struct{}
+}
+
+// NewCluster creates the cluster membership of this node
+func NewCluster(config ClusterConfig, router *Router, events *EventLog) (*Cluster, error) {
+	node := config.Node
+	if node == "" {
+		var err error
+		if node, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("no cluster.node and no host name: %v", err)
+		}
+	}
+	c := &Cluster{
+		config: config,
+		node:   node,
+		router: router,
+		events: events,
+		client: &http.Client{Timeout: 2 * time.Second},
+		stop:   make(chan struct{}),
+	}
+	for _, peer := range config.Peers {
+		u, err := url.Parse(strings.TrimSuffix(peer, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("cluster peer %q: %v", peer, err)
+		}
+		c.peers = append(c.peers, &clusterPeer{URL: u})
+	}
+	return c, nil
+}
+
+// Start polls the peers in the background
+func (c *Cluster) Start() {
+	log.Printf("Cluster node %s polling %d peer(s)", c.node, len(c.peers))
+	go func() {
+		ticker := time.NewTicker(time.Duration(c.config.IntervalMs) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			c.pollPeers()
+			select {
+			case <-ticker.C:
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the polling
+func (c *Cluster) Stop() {
+	close(c.stop)
+}
+
+// pollPeers fetches the state of all peers at once
+func (c *Cluster) pollPeers() {
+	var wg sync.WaitGroup
+	for _, peer := range c.peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state, err := c.fetchState(peer.URL)
+			c.updatePeer(peer, state, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// fetchState reads the state of a peer
+func (c *Cluster) fetchState(peer *url.URL) (*clusterState, error) {
+	req, err := http.NewRequest(http.MethodGet, peer.String()+clusterStatePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.config.Secret)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	var state clusterState
+	if err := json.NewDecoder(io.LimitReader(resp.Body, clusterStateLimit)).Decode(&state); err != nil {
+		return nil, fmt.Errorf("invalid state: %v", err)
+	}
+	if state.Node == c.node {
+		return nil, errors.New("the peer has the name of this node")
+	}
+	return &state, nil
+}
+
+// updatePeer applies the result of a poll, a peer is up from its first
+// answer and down after clusterDownAfter failed polls in a row
+func (c *Cluster) updatePeer(peer *clusterPeer, state *clusterState, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		peer.failures++
+		peer.Error = err.Error()
+		if peer.Up && peer.failures >= clusterDownAfter {
+			peer.Up = false
+			log.Printf("Cluster node %s (%s) is down: %v", peer.Node, peer.URL, err)
+			c.events.Record(EventClusterNodeDown, "", "", "%s (%s): %v", peer.Node, peer.URL, err)
+		}
+		return
+	}
+	peer.Node, peer.Workers = state.Node, state.Workers
+	peer.Updated, peer.Error, peer.failures = time.Now(), "", 0
+	if !peer.Up {
+		peer.Up = true
+		log.Printf("Cluster node %s (%s) is up with %d worker(s)", peer.Node, peer.URL, len(peer.Workers))
+		c.events.Record(EventClusterNodeUp, "", "", "%s (%s) with %d worker(s)", peer.Node, peer.URL, len(peer.Workers))
+	}
+}
+
+// localState returns the workers of this node
+func (c *Cluster) localState() clusterState {
+	state := clusterState{Node: c.node, Workers: []clusterWorker{}}
+	for _, w := range c.router.GetAllWorkers() {
+		healthy := workerHealthy(w)
+		w.mu.RLock()
+		worker := clusterWorker{
+			Name:       w.Name,
+			Path:       w.Path,
+			Type:       w.Type,
+			Healthy:    healthy,
+			QueueDepth: w.Queue.len(),
+			Draining:   w.Draining,
+		}
+		for _, inst := range w.Instances {
+			if inst.Healthy {
+				worker.Instances++
+			}
+		}
+		w.mu.RUnlock()
+		state.Workers = append(state.Workers, worker)
+	}
+	return state
+}
+
+// handleState serves the state of this node to the peers that know the
+// secret
+func (c *Cluster) handleState(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.config.Secret)) != 1 {
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, c.localState())
+}
+
+// peerFor returns a peer to forward a request for path to, or nil to serve
+// it here: a peer is used when it has a longer route for the path than the
+// local worker, or the same route while the local worker cannot serve it.
+// Peers with the same route take turns.
+func (c *Cluster) peerFor(path string, local *Worker, usable bool) *clusterPeer {
+	localRoute := -1
+	if local != nil {
+		localRoute = len(local.Path)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	best := -1
+	var candidates []*clusterPeer
+	for _, peer := range c.peers {
+		if !peer.Up {
+			continue
+		}
+		route := -1
+		for _, w := range peer.Workers {
+			if w.Healthy && !w.Draining && strings.HasPrefix(path, w.Path) && len(w.Path) > route {
+				route = len(w.Path)
+			}
+		}
+		switch {
+		case route < 0 || route < best:
+			continue
+		case route > best:
+			best, candidates = route, nil
+		}
+		candidates = append(candidates, peer)
+	}
+	if len(candidates) == 0 || best < localRoute || (best == localRoute && usable) {
+		return nil
+	}
+	return candidates[c.next.Add(1)%uint64(len(candidates))]
+}
+
+// clusterPeer returns the peer to forward a request to in cluster mode, a
+// forwarded request is always served here
+func (p *Proxy) clusterPeer(r *http.Request, worker *Worker) *clusterPeer {
+	if p.cluster == nil || r.Header.Get(clusterHopHeader) != "" {
+		return nil
+	}
+	usable := worker != nil && !worker.IsDraining() && workerHealthy(worker) && !worker.Queue.full()
+	return p.cluster.peerFor(r.URL.Path, worker, usable)
+}
+
+// forwardToPeer proxies a request to the public port of a peer, which routes
+// it to its own worker
+func (p *Proxy) forwardToPeer(w http.ResponseWriter, r *http.Request, peer *clusterPeer) {
+	p.cluster.mu.RLock()
+	node := peer.Node
+	p.cluster.mu.RUnlock()
+
+	proxy := httputil.NewSingleHostReverseProxy(peer.URL)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Proxy error for %s on node %s: %v", r.URL.Path, node, err)
+		p.serveErrorPage(w, r, http.StatusBadGateway, "Bad Gateway", "Failed to forward request to cluster node", map[string]interface{}{
+			"Error":   err.Error(),
+			"Node":    node,
+			"Address": peer.URL.String(),
+		})
+	}
+	forwarded := r.Clone(r.Context())
+	forwarded.Header.Set(clusterHopHeader, p.cluster.node)
+	forwarded.RequestURI = ""
+
+	log.Printf("%s %s -> node %s", r.Method, r.URL.Path, node)
+	proxy.ServeHTTP(w, forwarded)
+}
+
+// clusterStatus is the cluster membership in the admin API
+type clusterStatus struct {
+	Enabled bool                `json:"enabled"`
+	Node    string              `json:"node,omitempty"`
+	Peers   []clusterPeerStatus `json:"peers"`
+}
+
+// clusterPeerStatus is a peer and the workers it serves
+type clusterPeerStatus struct {
+	URL     string          `json:"url"`
+	Node    string          `json:"node,omitempty"`
+	Up      bool            `json:"up"`
+	Updated *time.Time      `json:"updated,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Workers []clusterWorker `json:"workers"`
+}
+
+// handleAPICluster lists the peers of this node
+func (p *Proxy) handleAPICluster(w http.ResponseWriter, r *http.Request) {
+	status := clusterStatus{Peers: []clusterPeerStatus{}}
+	if c := p.cluster; c != nil {
+		status.Enabled, status.Node = true, c.node
+		c.mu.RLock()
+		for _, peer := range c.peers {
+			ps := clusterPeerStatus{
+				URL:     peer.URL.String(),
+				Node:    peer.Node,
+				Up:      peer.Up,
+				Error:   peer.Error,
+				Workers: append([]clusterWorker{}, peer.Workers...),
+			}
+			if !peer.Updated.IsZero() {
+				updated := peer.Updated
+				ps.Updated = &updated
+			}
+			status.Peers = append(status.Peers, ps)
+		}
+		c.mu.RUnlock()
+	}
+	writeJSON(w, status)
+}
@@ -7,62 +7,191 @@ import (
 	"path/filepath"
 	"time"
 
-	"gopkg.in/yaml.v3"
+	"github.com/mevdschee/tqserver/pkg/logrotate"
+	"github.com/mevdschee/tqserver/pkg/phpfpm"
 )
 
 // WorkerConfig represents a worker's configuration from worker.yaml
 type WorkerConfig struct {
 	Path    string `yaml:"path"`
 	Name    string `yaml:"name"`
-	Type    string `yaml:"type"`     // "go", "bun" or "php"
+	Type    string `yaml:"type"`     // "go", "bun", "php", "container", "wasm" or "remote"
 	Enabled string `yaml:"enabled"`  // "true", "false", or "development"
 	LogFile string `yaml:"log_file"` // Deprecated: use Logging.LogFile
+	Recycle string `yaml:"recycle"`  // Cron expression of scheduled rolling restarts, e.g. "0 4 * * *" (server time zone)
 
 	Logging struct {
 		LogFile string `yaml:"log_file"`
 	} `yaml:"logging"`
 
+	// Filesystem confinement, Linux only: the processes of the worker only
+	// see its own directory, the system directories and read_only
+	Confine *struct {
+		Enabled  bool     `yaml:"enabled"`
+		ReadOnly []string `yaml:"read_only"` // Extra paths the worker can read, relative to the project
+	} `yaml:"confine"`
+
+	// Values written to files of each Go, Bun or container instance instead
+	// of its environment, the variable of a name has the path of its file
+	SecretFiles map[string]string `yaml:"secret_files"`
+
 	// Go runtime configuration
 	Go *struct {
-		GOMAXPROCS          int    `yaml:"go_max_procs"`
-		GOMEMLIMIT          string `yaml:"go_mem_limit"`
-		ReadTimeoutSeconds  int    `yaml:"read_timeout_seconds"`
-		WriteTimeoutSeconds int    `yaml:"write_timeout_seconds"`
-		IdleTimeoutSeconds  int    `yaml:"idle_timeout_seconds"`
-		MaxRequests         int    `yaml:"max_requests"`
+		GOMAXPROCS          int            `yaml:"go_max_procs"`
+		GOMEMLIMIT          string         `yaml:"go_mem_limit"`
+		ReadTimeoutSeconds  int            `yaml:"read_timeout_seconds"`
+		WriteTimeoutSeconds int            `yaml:"write_timeout_seconds"`
+		IdleTimeoutSeconds  int            `yaml:"idle_timeout_seconds"`
+		MaxRequests         int            `yaml:"max_requests"`
+		Debug               *GoDebugConfig `yaml:"debug"`
+		CachedTemplates     bool           `yaml:"cached_templates"` // Templates are parsed at startup, a change restarts the worker
 	} `yaml:"go"`
 	// Bun runtime configuration
 	Bun *struct {
 		Entrypoint string            `yaml:"entrypoint"` // Main file (e.g., "index.ts")
 		Env        map[string]string `yaml:"env"`
+		Watch      string            `yaml:"watch"`     // "hot", "watch" or "" - delegate reloads to Bun in dev mode
+		Typecheck  string            `yaml:"typecheck"` // "tsc", "build" or "" - fail the build on type or bundling errors
 	} `yaml:"bun"`
 
-	// Scaling configuration (for Go and Bun workers)
+	// Container runtime configuration (Docker or Podman)
+	Container *ContainerConfig `yaml:"container"`
+
+	// WASM runtime configuration (experimental, runs inside the server process)
+	Wasm *struct {
+		Module        string            `yaml:"module"`          // Compiled module (default: bin/{name}.wasm)
+		Build         string            `yaml:"build"`           // Build command, e.g. "tinygo build -o bin/app.wasm -target=wasi ./src"
+		MemoryLimitMB int               `yaml:"memory_limit_mb"` // Per-instance memory limit (0 = runtime default)
+		Env           map[string]string `yaml:"env"`
+	} `yaml:"wasm"`
+
+	// Remote instances, started on other machines, of a "remote" worker
+	Remote *struct {
+		Instances []string `yaml:"instances"` // "host:port" addresses, agents can register more
+		Protocol  string   `yaml:"protocol"`  // "http" (default), "scgi" or "uwsgi"
+	} `yaml:"remote"`
+
+	// Metrics configuration
+	Metrics *struct {
+		PathTemplates []string `yaml:"path_templates"` // Labels for paths below the route, e.g. "/users/{id}" (default: the route only)
+	} `yaml:"metrics"`
+
+	// Test suite, run after each rebuild in dev mode
+	Test *struct {
+		OnChange       bool   `yaml:"on_change"`       // Run the tests after each rebuild in dev mode
+		Command        string `yaml:"command"`         // Shell command (default: "go test ./..." for Go, "bun test" for Bun)
+		TimeoutSeconds int    `yaml:"timeout_seconds"` // Run time limit (default: 120)
+	} `yaml:"test"`
+
+	// Fake upstream services served by the server in dev mode
+	Mocks []MockConfig `yaml:"mocks"`
+
+	// Scaling configuration (for Go, Bun and container workers)
 	Scaling *struct {
 		MinWorkers     int `yaml:"min_workers"`      // Minimum operational workers
 		MaxWorkers     int `yaml:"max_workers"`      // Maximum operational workers
-		QueueThreshold int `yaml:"queue_threshold"`  // Queue depth to trigger scale up
-		ScaleDownDelay int `yaml:"scale_down_delay"` // Seconds idle before scaling down
+		QueueThreshold int `yaml:"queue_threshold"`  // Requests in flight or queued per instance to trigger scale up
+		ScaleDownDelay int `yaml:"scale_down_delay"` // Seconds of low load before an instance is stopped
 	} `yaml:"scaling"`
 
+	// Queue of the requests waiting for an instance when none is healthy
+	// or all are at max_in_flight (for Go, Bun and container workers)
+	Queue *struct {
+		Size        int    `yaml:"size"`          // Requests waiting at most (default: 1000)
+		MaxWaitMs   int    `yaml:"max_wait_ms"`   // Wait before a 504 response (default: 30000)
+		MaxInFlight int    `yaml:"max_in_flight"` // Requests per instance at most, the others wait (default: 0, no limit)
+		Shed        string `yaml:"shed"`          // When full: "reject" the new request (default) or shed the "oldest"
+	} `yaml:"queue"`
+
 	// PHP-specific configuration
 	PHP *struct {
-		Binary     string            `yaml:"binary"`
-		ConfigFile string            `yaml:"config_file"`
-		Settings   map[string]string `yaml:"settings"`
-		Pool       struct {
-			Manager        string `yaml:"manager"`
-			MinWorkers     int    `yaml:"min_workers"`
-			MaxWorkers     int    `yaml:"max_workers"`
-			StartWorkers   int    `yaml:"start_workers"`
-			MaxRequests    int    `yaml:"max_requests"`
-			RequestTimeout int    `yaml:"request_timeout"`
-			IdleTimeout    int    `yaml:"idle_timeout"`
-			ListenAddress  string `yaml:"listen_address"`
-		} `yaml:"pool"`
+		Binary      string               `yaml:"binary"`
+		ConfigFile  string               `yaml:"config_file"`
+		Settings    map[string]string    `yaml:"settings"`
+		Multiplex   int                  `yaml:"multiplex"`    // Concurrent requests per FastCGI connection (0 = off, php-fpm does not multiplex)
+		TryFiles    []string             `yaml:"try_files"`    // nginx-style script lookup, e.g. ["$uri", "$uri/", "/index.php?$query_string"]
+		Rewrites    []phpfpm.RewriteRule `yaml:"rewrites"`     // nginx-style rewrites applied before the script lookup
+		Reload      string               `yaml:"reload"`       // Applying code changes: "restart" (default), "graceful" or "opcache_reset"
+		Preload     string               `yaml:"preload"`      // opcache.preload script, relative to the worker directory
+		PreloadUser string               `yaml:"preload_user"` // opcache.preload_user, required when php-fpm runs as root
+		Xdebug      *struct {
+			Enabled          bool   `yaml:"enabled"`            // Only applied in dev mode
+			Mode             string `yaml:"mode"`               // xdebug.mode (default: "debug")
+			ClientHost       string `yaml:"client_host"`        // IDE host (default: 127.0.0.1)
+			ClientPort       int    `yaml:"client_port"`        // IDE port (default: 9003)
+			StartWithRequest string `yaml:"start_with_request"` // "yes", "no" or "trigger" (default: "trigger")
+			IDEKey           string `yaml:"idekey"`
+		} `yaml:"xdebug"`
+		Pool  PHPPoolConfig  `yaml:"pool"`  // Default pool
+		Pools []PHPExtraPool `yaml:"pools"` // Additional pools selected by path
 	} `yaml:"php"`
 }
 
+// PHPPoolConfig represents the php-fpm pool settings of a "php" worker
+type PHPPoolConfig struct {
+	Manager        string `yaml:"manager"`
+	MinWorkers     int    `yaml:"min_workers"`
+	MaxWorkers     int    `yaml:"max_workers"`
+	StartWorkers   int    `yaml:"start_workers"`
+	MaxRequests    int    `yaml:"max_requests"`
+	RequestTimeout int    `yaml:"request_timeout"`
+	IdleTimeout    int    `yaml:"idle_timeout"`
+	ListenAddress  string `yaml:"listen_address"`
+	ListenSocket   string `yaml:"listen_socket"` // Unix socket path, overrides listen_address
+
+	RequestSlowlogTimeout int    `yaml:"request_slowlog_timeout"` // Seconds before a request is traced to the slowlog (0 = off)
+	Slowlog               string `yaml:"slowlog"`                 // Slowlog file, relative to the worker directory
+}
+
+// PHPExtraPool is an additional php-fpm pool of a "php" worker that serves
+// the requests matching one of its path patterns
+type PHPExtraPool struct {
+	Name     string            `yaml:"name"`
+	Paths    []string          `yaml:"paths"`    // Patterns below the worker route, e.g. "/admin/*"
+	Settings map[string]string `yaml:"settings"` // PHP settings on top of php.settings
+	Pool     PHPPoolConfig     `yaml:"pool"`
+}
+
+// GoDebugConfig runs the instances of a Go worker under Delve in dev mode,
+// built without optimizations, for IDEs to attach to
+type GoDebugConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Port    int  `yaml:"port"` // Delve port of the first instance, others take the next free ports (default: 2345)
+}
+
+// MockConfig is a fake upstream service of a worker, served on an internal
+// port in dev mode. The worker reaches it through the variable named by Env,
+// or through the SOCKS5 proxy when it connects to Host.
+type MockConfig struct {
+	Name   string      `yaml:"name"`
+	Host   string      `yaml:"host"` // Upstream host answered by the mock through the SOCKS5 proxy, e.g. "api.stripe.com"
+	Env    string      `yaml:"env"`  // Variable set to the URL of the mock, e.g. "STRIPE_API_URL"
+	Routes []MockRoute `yaml:"routes"`
+}
+
+// MockRoute is a response of a mock, the first matching route answers
+type MockRoute struct {
+	Method    string            `yaml:"method"` // Default: any
+	Path      string            `yaml:"path"`   // "{name}" matches a segment, a trailing "/*" the remainder
+	Status    int               `yaml:"status"` // Default: 200
+	Headers   map[string]string `yaml:"headers"`
+	Body      string            `yaml:"body"`       // Template of the body, see mockTemplateData
+	File      string            `yaml:"file"`       // Template file, relative to the worker directory
+	LatencyMs int               `yaml:"latency_ms"` // Delay before responding
+}
+
+// ContainerConfig represents the settings for a "container" worker
+type ContainerConfig struct {
+	Runtime       string            `yaml:"runtime"`        // "docker" or "podman" (default: auto-detect)
+	Image         string            `yaml:"image"`          // Image to run (pulled if no build context is set)
+	Build         string            `yaml:"build"`          // Build context relative to the worker directory
+	Dockerfile    string            `yaml:"dockerfile"`     // Dockerfile relative to the build context
+	ContainerPort int               `yaml:"container_port"` // Port the container listens on (default: 8080)
+	Network       string            `yaml:"network"`        // Container network (e.g. "host")
+	Env           map[string]string `yaml:"env"`
+	Args          []string          `yaml:"args"` // Extra arguments passed to "run"
+}
+
 // IsEnabled returns true if the worker is enabled based on the server mode.
 // Possible values for Enabled are: "true", "false", "development".
 // - "true" or "" (empty): always enabled
@@ -93,12 +222,18 @@ type Config struct {
 	Mode string // "dev" or "prod" - not from YAML, set via flag or env
 
 	Server struct {
-		Port                int    `yaml:"port"`
-		ReadTimeoutSeconds  int    `yaml:"read_timeout_seconds"`
-		WriteTimeoutSeconds int    `yaml:"write_timeout_seconds"`
-		IdleTimeoutSeconds  int    `yaml:"idle_timeout_seconds"`
-		LogFile             string `yaml:"log_file"`
+		Port                int      `yaml:"port"`
+		ReadTimeoutSeconds  int      `yaml:"read_timeout_seconds"`
+		WriteTimeoutSeconds int      `yaml:"write_timeout_seconds"`
+		IdleTimeoutSeconds  int      `yaml:"idle_timeout_seconds"`
+		MaxBodySize         int64    `yaml:"max_body_size"` // Max request body in bytes for PHP workers (0 = unlimited)
+		LogFile             string   `yaml:"log_file"`
+		PidFile             string   `yaml:"pid_file"`        // Process ID of the running server, for "tqserver stop" and "tqserver reload"
+		TrustedProxies      []string `yaml:"trusted_proxies"` // IPs or CIDRs whose X-Forwarded-For and X-Real-IP are trusted (default: none)
+
+		TLS *ServerTLSConfig `yaml:"tls"` // HTTPS on the port (default: HTTP)
 	} `yaml:"server"`
+	clientIPs *clientIPResolver
 
 	Workers struct {
 		Directory                string `yaml:"directory"`
@@ -109,18 +244,243 @@ type Config struct {
 		ShutdownGracePeriodMs    int    `yaml:"shutdown_grace_period_ms"`
 		HealthCheckWaitTimeoutMs int    `yaml:"health_check_wait_timeout_ms"`
 		HealthCheckTimeoutMs     int    `yaml:"health_check_timeout_ms"`
+		Prebuilt                 bool   `yaml:"prebuilt"`                // Run the binaries of a package, never build (not in dev mode)
+		VerifyKey                string `yaml:"verify_key"`              // ed25519 public key (PEM) the package manifest must be signed with
+		RollbackWindowSeconds    int    `yaml:"rollback_window_seconds"` // Restore the last-known-good binary of a Go worker failing within this time after a deploy (0 = off)
+		KeepBinaries             int    `yaml:"keep_binaries"`           // Previous binaries of a Go worker kept on a rebuild, not in dev mode (0 = none)
+		BinaryMaxAgeHours        int    `yaml:"binary_max_age_hours"`    // Previous binaries built longer ago are removed (0 = no limit)
+		MTLS                     bool   `yaml:"mtls"`                    // Mutual TLS between the proxy and the Go, Bun and container instances (default: false)
+		ProxyToken               bool   `yaml:"proxy_token"`             // Instances reject requests without the secret of their worker the proxy adds (default: false)
+		SecretFilesDir           string `yaml:"secret_files_dir"`        // Where the secret_files of the instances are written (default: XDG_RUNTIME_DIR or /dev/shm)
 	} `yaml:"workers"`
 
 	FileWatcher struct {
 		DebounceMs int `yaml:"debounce_ms"`
 	} `yaml:"file_watcher"`
 
+	Static StaticConfig `yaml:"static"`
+
 	Socks5 Socks5Config `yaml:"socks5"`
 
 	Metrics struct {
 		Enabled bool   `yaml:"enabled"` // Default: true
 		Path    string `yaml:"path"`    // Default: "/metrics"
 	} `yaml:"metrics"`
+
+	Tracing *TracingConfig `yaml:"tracing"`
+
+	Health struct {
+		LivenessPath          string   `yaml:"liveness_path"`           // Default: "/healthz"
+		ReadinessPath         string   `yaml:"readiness_path"`          // Default: "/readyz"
+		RequiredWorkers       []string `yaml:"required_workers"`        // Must be healthy for readiness (default: all workers)
+		StartupGate           string   `yaml:"startup_gate"`            // "bind" or "unavailable": no requests until the workers are ready (default: "")
+		StartupTimeoutSeconds int      `yaml:"startup_timeout_seconds"` // Requests are accepted anyway after this (default: 120, 0 = wait forever)
+	} `yaml:"health"`
+
+	Admin struct {
+		Enabled              bool   `yaml:"enabled"`
+		Listen               string `yaml:"listen"`                 // Default: "127.0.0.1:6060", never the public port
+		Token                string `yaml:"token"`                  // Bearer token of the control operations here, without one they are only on the control socket
+		PushExecSecrets      bool   `yaml:"push_exec_secrets"`      // Pushed configs may add or change command, sops, vault and file secrets (default: false)
+		BlockProfileRate     int    `yaml:"block_profile_rate"`     // runtime.SetBlockProfileRate (0 = off)
+		MutexProfileFraction int    `yaml:"mutex_profile_fraction"` // runtime.SetMutexProfileFraction (0 = off)
+	} `yaml:"admin"`
+
+	Control struct {
+		Enabled bool   `yaml:"enabled"` // Default: true
+		Socket  string `yaml:"socket"`  // Default: "run/tqserver.sock", only accessible to the owner
+	} `yaml:"control"`
+
+	Audit struct {
+		Enabled bool   `yaml:"enabled"` // Default: true
+		File    string `yaml:"file"`    // Default: "logs/audit.log", JSON lines, never rotated
+	} `yaml:"audit"`
+
+	Dashboard *DashboardConfig `yaml:"dashboard"`
+
+	Deploy DeployConfig `yaml:"deploy"`
+
+	Cluster ClusterConfig `yaml:"cluster"`
+
+	WAF *WAFConfig `yaml:"waf"`
+	waf *wafEngine
+
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+	apiKeys   apiKeyTable
+
+	CSRF *CSRFConfig `yaml:"csrf"`
+
+	Env map[string]string `yaml:"env"` // Passed to every worker, the env of a worker overrides it
+
+	Secrets map[string]SecretConfig `yaml:"secrets"` // Referenced as "${secret:name}" in any config value
+	secrets *SecretStore
+
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+
+	Logging LoggingConfig `yaml:"logging"`
+}
+
+// ServerTLSConfig serves HTTPS on the server port, with client certificates
+// verified against client_ca when it is set
+type ServerTLSConfig struct {
+	CertFile      string            `yaml:"cert_file"`      // PEM certificate chain, required
+	KeyFile       string            `yaml:"key_file"`       // PEM private key, required
+	ClientCA      string            `yaml:"client_ca"`      // PEM CA certificates of the clients (default: none, no client certificates)
+	ClientAuth    string            `yaml:"client_auth"`    // "require" (default) or "optional": requests without a certificate are accepted
+	ClientHeaders map[string]string `yaml:"client_headers"` // Headers set for the workers from the client certificate, like X-Client-CN: subject.cn
+}
+
+// LoggingConfig selects the output of each log stream
+type LoggingConfig struct {
+	Server *LogOutputConfig `yaml:"server"` // Default: stderr
+	Access *LogOutputConfig `yaml:"access"` // Default: off
+	Worker *LogOutputConfig `yaml:"worker"` // Default: the file of the worker's logging.log_file
+	Socks5 *LogOutputConfig `yaml:"socks5"` // Default: the file of socks5.log_file
+	Syslog struct {
+		Network string `yaml:"network"` // "unixgram" (default), "unix", "udp" or "tcp"
+		Address string `yaml:"address"` // Default: "/dev/log"
+	} `yaml:"syslog"`
+}
+
+// LogOutputConfig is the output of a log stream
+type LogOutputConfig struct {
+	Output   string `yaml:"output"`   // "file", "stdout", "stderr", "syslog", "journald" or "off"
+	File     string `yaml:"file"`     // Not for workers (default: server.log_file, "logs/access_{date}.log", socks5.log_file)
+	Tag      string `yaml:"tag"`      // Syslog app name and journald identifier (default: "tqserver", "tqserver-access", ...)
+	Facility string `yaml:"facility"` // Syslog facility (default: "daemon")
+}
+
+// WebhookConfig posts lifecycle events to an HTTP endpoint
+type WebhookConfig struct {
+	URL            string            `yaml:"url"`
+	Events         []string          `yaml:"events"`          // Event types to send (default: all)
+	Workers        []string          `yaml:"workers"`         // Only events of these workers (default: all)
+	Format         string            `yaml:"format"`          // "json" (default) | "slack"
+	Headers        map[string]string `yaml:"headers"`         // Sent with every request, e.g. for authentication
+	Secret         string            `yaml:"secret"`          // Signs the body in the X-TQServer-Signature header
+	TimeoutSeconds int               `yaml:"timeout_seconds"` // Default: 5
+}
+
+// DeployConfig serves an endpoint for the push webhook of a git host, it
+// pulls a branch and rolls out the workers that changed
+type DeployConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"`   // Default: "/_deploy", on the public port
+	Secret  string `yaml:"secret"` // Of the webhook, required: GitHub and Gitea sign with it, GitLab sends it as token
+	Remote  string `yaml:"remote"` // Default: "origin"
+	Branch  string `yaml:"branch"` // Default: "main"
+}
+
+// WAFConfig inspects requests before they reach a worker, its rules block
+// or log the requests they match
+type WAFConfig struct {
+	Enabled            bool      `yaml:"enabled"`
+	KnownBadUserAgents bool      `yaml:"known_bad_user_agents"` // Adds rule "bad_user_agent" blocking scanners like sqlmap and nikto
+	InspectBodyBytes   int       `yaml:"inspect_body_bytes"`    // Body prefix matched by body rules (default: 65536)
+	Rules              []WAFRule `yaml:"rules"`
+}
+
+// WAFRule matches a request on all of its conditions, at least one is required
+type WAFRule struct {
+	Name      string   `yaml:"name"`       // In the log and the tqserver_waf_matches_total metric
+	Action    string   `yaml:"action"`     // "block" (default) with 403 Forbidden, or "log"
+	Workers   []string `yaml:"workers"`    // Only requests of these workers (default: all)
+	Methods   []string `yaml:"methods"`    // Request methods, like TRACE
+	Path      string   `yaml:"path"`       // Regular expression on the path
+	Query     string   `yaml:"query"`      // Regular expression on the decoded query string
+	Body      string   `yaml:"body"`       // Regular expression on the start of the body
+	UserAgent string   `yaml:"user_agent"` // Regular expression on the User-Agent header
+	MaxSize   int64    `yaml:"max_size"`   // Matches bodies larger than this many bytes (0 = any)
+}
+
+// RateLimitConfig limits the requests of API consumers by the key they
+// send, each key has a tier with a rate and a daily quota
+type RateLimitConfig struct {
+	Enabled   bool                     `yaml:"enabled"`
+	Header    string                   `yaml:"header"`    // Header with the API key (default: "X-API-Key")
+	Workers   []string                 `yaml:"workers"`   // Limited workers (default: all)
+	Anonymous string                   `yaml:"anonymous"` // Tier of requests without a key, per client IP (default: rejected with 401)
+	KeyFile   string                   `yaml:"key_file"`  // YAML file with more keys, read again when it changes
+	Tiers     map[string]RateLimitTier `yaml:"tiers"`
+	Keys      []APIKey                 `yaml:"keys"`
+}
+
+// RateLimitTier is the allowance of the consumers of a tier, 0 is unlimited
+type RateLimitTier struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`       // Requests allowed at once (default: requests_per_second, at least 1)
+	DailyQuota        int64   `yaml:"daily_quota"` // Requests per day, reset at local midnight
+}
+
+// CSRFConfig protects the forms of HTML workers: the proxy issues a token
+// in a cookie, adds it to the forms of their pages and rejects requests that
+// change state without it
+type CSRFConfig struct {
+	Enabled     bool     `yaml:"enabled"`
+	Workers     []string `yaml:"workers"`      // Protected workers (default: all)
+	Cookie      string   `yaml:"cookie"`       // Cookie with the token (default: "tqserver_csrf")
+	Header      string   `yaml:"header"`       // Request header with the token, also set on responses (default: "X-CSRF-Token")
+	Field       string   `yaml:"field"`        // Form field with the token (default: "_csrf")
+	ExemptPaths []string `yaml:"exempt_paths"` // Path templates that are not checked, like "/webhooks/*"
+}
+
+// StaticConfig controls how the files in the public directories are served
+type StaticConfig struct {
+	FileCache *FileCacheConfig  `yaml:"file_cache"`
+	Assets    *AssetCacheConfig `yaml:"assets"`
+}
+
+// FileCacheConfig keeps the lookups and open handles of public files between
+// requests, the file watcher tells when they change
+type FileCacheConfig struct {
+	Enabled      bool `yaml:"enabled"`
+	MaxEntries   int  `yaml:"max_entries"`    // Paths remembered, missing files included (default: 4096)
+	MaxOpenFiles int  `yaml:"max_open_files"` // Handles kept open between requests (default: 256)
+}
+
+// AssetCacheConfig holds the small public files in memory, served with
+// content hash ETags and under fingerprinted paths that are cached for long
+type AssetCacheConfig struct {
+	Enabled       bool `yaml:"enabled"`
+	MaxFileSize   int  `yaml:"max_file_size"`   // Larger files are served from disk (default: 65536)
+	MaxTotalSize  int  `yaml:"max_total_size"`  // Memory for the files of all public directories (default: 67108864)
+	MaxAgeSeconds int  `yaml:"max_age_seconds"` // Cache lifetime of fingerprinted paths (default: 31536000, a year)
+}
+
+// APIKey is the key of an API consumer, given as is or as its SHA-256
+type APIKey struct {
+	Key    string `yaml:"key"`
+	SHA256 string `yaml:"sha256"` // Hex SHA-256 of the key, keeps the key itself out of the config
+	Name   string `yaml:"name"`   // Consumer name in metrics and the X-API-Consumer header, keys with the same name share their usage
+	Tier   string `yaml:"tier"`
+}
+
+// ClusterConfig shares the workers of the nodes serving a project, the
+// proxy of a node forwards requests to the peers serving their route
+type ClusterConfig struct {
+	Enabled    bool     `yaml:"enabled"`
+	Node       string   `yaml:"node"`        // Name of this node (default: the host name)
+	Peers      []string `yaml:"peers"`       // Public URLs of the other nodes, like "http://10.0.0.2:8080"
+	Secret     string   `yaml:"secret"`      // Shared by the nodes, required
+	IntervalMs int      `yaml:"interval_ms"` // Between the polls of the peers' state (default: 1000)
+}
+
+// DashboardConfig serves the web dashboard in production mode, it is always
+// served in development mode
+type DashboardConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Username string `yaml:"username"` // Basic auth, required in production mode
+	Password string `yaml:"password"`
+}
+
+// TracingConfig configures the export of request traces to an
+// OpenTelemetry collector
+type TracingConfig struct {
+	Enabled     bool              `yaml:"enabled"`
+	Endpoint    string            `yaml:"endpoint"`     // OTLP/HTTP endpoint (default: "http://localhost:4318")
+	ServiceName string            `yaml:"service_name"` // Default: "tqserver"
+	SampleRatio *float64          `yaml:"sample_ratio"` // Fraction of new traces recorded (default: 1)
+	Headers     map[string]string `yaml:"headers"`      // Sent with every export, e.g. for authentication
 }
 
 // Socks5Config represents the SOCKS5 proxy configuration
@@ -130,20 +490,176 @@ type Socks5Config struct {
 	LogFile         string                 `yaml:"log_file"`
 	LogFormat       string                 `yaml:"log_format"` // "json" | "text"
 	HTTPSInspection *HTTPSInspectionConfig `yaml:"https_inspection"`
+	Egress          *EgressConfig          `yaml:"egress"`
+	Limits          *BandwidthConfig       `yaml:"limits"`
+	DNS             *DNSConfig             `yaml:"dns"`
+	Rotation        *LogRotationConfig     `yaml:"rotation"`
+	Chaos           *ChaosConfig           `yaml:"chaos"` // Development mode only
+	Enforce         *EnforceConfig         `yaml:"enforce"`
+}
+
+// EnforceConfig makes the proxy the only way out of the Go, Bun and PHP
+// workers, Linux only: they run in a network of their own that only
+// reaches the proxy
+type EnforceConfig struct {
+	Enabled    bool  `yaml:"enabled"`
+	LocalPorts []int `yaml:"local_ports"` // Ports on 127.0.0.1 of the host the workers can still connect to, like a database
+}
+
+// ChaosConfig injects faults into proxied connections, to exercise the
+// retry and timeout handling of workers
+type ChaosConfig struct {
+	ChaosRule    `yaml:",inline"`     // Applies to every destination
+	Destinations map[string]ChaosRule `yaml:"destinations"` // "host[:port]" rules, the most specific applies
+}
+
+// ChaosRule describes the faults injected into matching connections
+type ChaosRule struct {
+	LatencyMs int     `yaml:"latency_ms"` // Added before connecting
+	JitterMs  int     `yaml:"jitter_ms"`  // Random extra latency up to this
+	ErrorRate float64 `yaml:"error_rate"` // Fraction of connections refused (0-1)
+	ResetRate float64 `yaml:"reset_rate"` // Fraction of connections reset on the first response bytes (0-1)
+}
+
+// LogRotationConfig controls the rotation and retention of a log file
+type LogRotationConfig struct {
+	MaxSizeMB  int  `yaml:"max_size_mb"`  // Rotate when the file reaches this size (0 = daily only)
+	MaxAgeDays int  `yaml:"max_age_days"` // Remove rotated files older than this (0 = keep)
+	MaxFiles   int  `yaml:"max_files"`    // Rotated files to keep (0 = all)
+	Compress   bool `yaml:"compress"`     // Gzip rotated files
+}
+
+// Options converts the configuration for the log writer, c may be nil
+func (c *LogRotationConfig) Options() logrotate.Options {
+	if c == nil {
+		return logrotate.Options{}
+	}
+	return logrotate.Options{
+		MaxSize:  int64(c.MaxSizeMB) * 1024 * 1024,
+		MaxAge:   time.Duration(c.MaxAgeDays) * 24 * time.Hour,
+		MaxFiles: c.MaxFiles,
+		Compress: c.Compress,
+	}
+}
+
+// DNSConfig configures how the SOCKS5 proxy resolves domain targets
+type DNSConfig struct {
+	Servers   []string          `yaml:"servers"`   // DNS servers as "host[:port]" (default: system resolver)
+	DoH       string            `yaml:"doh"`       // DNS-over-HTTPS URL, takes precedence over servers
+	Overrides map[string]string `yaml:"overrides"` // Host or "*.domain" to comma-separated IPs
+}
+
+// BandwidthConfig holds the egress rate limits and daily byte quotas. The
+// inline limit applies to each worker separately, unless overridden under
+// workers. Destination limits are keyed by "host[:port]" pattern and shared
+// by all workers.
+type BandwidthConfig struct {
+	BandwidthLimit `yaml:",inline"`
+	Workers        map[string]BandwidthLimit `yaml:"workers"`
+	Destinations   map[string]BandwidthLimit `yaml:"destinations"`
+}
+
+// BandwidthLimit limits the traffic of a worker or destination, 0 is unlimited
+type BandwidthLimit struct {
+	RateBytesPerSecond int64 `yaml:"rate_bytes_per_second"`
+	DailyQuotaBytes    int64 `yaml:"daily_quota_bytes"`
+}
+
+// EgressConfig holds the global egress policy and per-worker overrides
+type EgressConfig struct {
+	EgressPolicy `yaml:",inline"`
+	Workers      map[string]EgressPolicy `yaml:"workers"`
+}
+
+// EgressPolicy lists the destinations a worker may connect to. Entries are
+// "host[:port]" where host is a name, "*.domain", "*", an IP or a CIDR.
+type EgressPolicy struct {
+	Default string   `yaml:"default"` // "allow" | "deny" (default: deny when allow rules exist)
+	Allow   []string `yaml:"allow"`
+	Deny    []string `yaml:"deny"`
 }
 
 // HTTPSInspectionConfig represents HTTPS MITM inspection settings
 type HTTPSInspectionConfig struct {
-	Enabled      bool   `yaml:"enabled"`
-	CACert       string `yaml:"ca_cert"`
-	CAKey        string `yaml:"ca_key"`
-	AutoGenerate bool   `yaml:"auto_generate"`
-	LogBody      bool   `yaml:"log_body"`
-	MaxBodySize  int    `yaml:"max_body_size"`
+	Enabled          bool                 `yaml:"enabled"`
+	CACert           string               `yaml:"ca_cert"`
+	CAKey            string               `yaml:"ca_key"`
+	AutoGenerate     bool                 `yaml:"auto_generate"`
+	KeyType          string               `yaml:"key_type"`           // "ecdsa" | "rsa" (default: "ecdsa")
+	CertValidityDays int                  `yaml:"cert_validity_days"` // Default: 30
+	WildcardCerts    bool                 `yaml:"wildcard_certs"`     // Issue one "*.parent" certificate per parent domain
+	CertCacheDir     string               `yaml:"cert_cache_dir"`     // Persist issued certificates across restarts
+	LogBody          bool                 `yaml:"log_body"`
+	MaxBodySize      int                  `yaml:"max_body_size"`
+	Bypass           []string             `yaml:"bypass"` // Hosts or "*.domain" tunnelled without interception
+	HAR              *HARConfig           `yaml:"har"`
+	Redact           *RedactConfig        `yaml:"redact"`
+	Upstream         *UpstreamTLSConfig   `yaml:"upstream"`
+	Replay           *ReplayConfig        `yaml:"replay"`
+	WebSocket        *WebSocketConfig     `yaml:"websocket"`
+	Cache            *ResponseCacheConfig `yaml:"cache"`
+}
+
+// ResponseCacheConfig caches GET responses of intercepted hosts, to serve
+// them when the destination is unreachable or failing
+type ResponseCacheConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	Directory     string `yaml:"directory"`       // Default: "cache/socks5"
+	MaxAgeHours   int    `yaml:"max_age_hours"`   // Oldest response served (0 = any age)
+	ServeOnStatus []int  `yaml:"serve_on_status"` // Upstream statuses answered from the cache (default: 429, 502, 503, 504)
+}
+
+// WebSocketConfig controls the logging of intercepted WebSocket sessions
+type WebSocketConfig struct {
+	LogPayloads bool `yaml:"log_payloads"` // Capture message payloads, truncated at max_body_size
+	MaxMessages int  `yaml:"max_messages"` // Payloads captured per session (default: 100)
+}
+
+// ReplayConfig records intercepted requests to cassettes or answers them
+// from the cassettes without network access
+type ReplayConfig struct {
+	Mode      string `yaml:"mode"`       // "record" | "replay" | "off" (default: "off")
+	Directory string `yaml:"directory"`  // Default: "testdata/cassettes"
+	MatchBody bool   `yaml:"match_body"` // Match requests on their body besides method and URI
+}
+
+// UpstreamTLSConfig controls how intercepted servers are verified
+type UpstreamTLSConfig struct {
+	Verify   string              `yaml:"verify"`    // "strict" | "log" (default: "strict")
+	RootCA   string              `yaml:"root_ca"`   // PEM bundle used instead of the system roots
+	LogChain bool                `yaml:"log_chain"` // Log the certificate chain of each server
+	Pins     map[string][]string `yaml:"pins"`      // Host or "*.domain" to SPKI SHA-256 hashes
+}
+
+// RedactConfig masks sensitive data in logged headers and bodies
+type RedactConfig struct {
+	Headers   []string `yaml:"headers"`    // Headers to mask besides Authorization and Cookie
+	Patterns  []string `yaml:"patterns"`   // Regular expressions, only the first group is masked if present
+	JSONPaths []string `yaml:"json_paths"` // Fields in JSON bodies, e.g. "user.password" or "items[*].token"
 }
 
-// LoadConfig loads configuration from a YAML file
+// HARConfig configures the HAR export of intercepted HTTPS traffic
+type HARConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	Directory     string `yaml:"directory"`      // Default: "logs/har"
+	WindowMinutes int    `yaml:"window_minutes"` // Minutes per HAR file (default: 60)
+}
+
+// LoadConfig loads configuration from a YAML file, unknown settings are
+// logged as warnings
 func LoadConfig(configPath string) (*Config, error) {
+	config, unknown, err := loadConfigFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, problem := range unknown {
+		log.Printf("Warning: %s", problem)
+	}
+	return config, nil
+}
+
+// loadConfigFile loads the configuration and returns its unknown settings
+func loadConfigFile(configPath string) (*Config, []ConfigProblem, error) {
 	// Set defaults
 	config := &Config{}
 	config.Server.Port = 8080
@@ -151,6 +667,7 @@ func LoadConfig(configPath string) (*Config, error) {
 	config.Server.WriteTimeoutSeconds = 30
 	config.Server.IdleTimeoutSeconds = 120
 	config.Server.LogFile = "logs/tqserver_{date}.log"
+	config.Server.PidFile = "run/tqserver.pid"
 	config.Workers.Directory = "workers"
 	config.Workers.PortRangeStart = 9000
 	config.Workers.PortRangeEnd = 9999
@@ -171,6 +688,30 @@ func LoadConfig(configPath string) (*Config, error) {
 	config.Metrics.Enabled = true
 	config.Metrics.Path = "/metrics"
 
+	// Server health endpoint defaults
+	config.Health.LivenessPath = "/healthz"
+	config.Health.ReadinessPath = "/readyz"
+	config.Health.StartupTimeoutSeconds = 120
+
+	// Audit log defaults
+	config.Audit.Enabled = true
+	config.Audit.File = "logs/audit.log"
+
+	// Admin listener defaults
+	config.Admin.Listen = "127.0.0.1:6060"
+
+	// Control socket defaults
+	config.Control.Enabled = true
+	config.Control.Socket = "run/tqserver.sock"
+
+	// Deploy endpoint defaults
+	config.Deploy.Path = "/_deploy"
+	config.Deploy.Remote = "origin"
+	config.Deploy.Branch = "main"
+
+	// Cluster defaults
+	config.Cluster.IntervalMs = 1000
+
 	// Set mode from environment variable (defaults to "dev")
 	config.Mode = os.Getenv("TQSERVER_MODE")
 	if config.Mode == "" {
@@ -178,22 +719,59 @@ func LoadConfig(configPath string) (*Config, error) {
 	}
 
 	// If config file exists, load it
+	config.secrets = NewSecretStore(nil)
+	var unknown []ConfigProblem
 	if _, err := os.Stat(configPath); err == nil {
 		data, err := os.ReadFile(configPath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read config file: %w", err)
+			return nil, nil, fmt.Errorf("failed to read config file: %w", err)
 		}
 
-		if err := yaml.Unmarshal(data, config); err != nil {
-			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		node, err := parseConfigNode(configPath, data)
+		if err == nil {
+			config.secrets, err = secretsFromNode(node)
+		}
+		if err == nil {
+			unknown, err = decodeConfigNode(configPath, node, config, config.secrets)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+	}
+	config.clientIPs = newClientIPResolver(config.Server.TrustedProxies)
+	config.waf = newWAF(config.WAF)
+	if config.RateLimit != nil {
+		config.apiKeys = newAPIKeyTable(config.RateLimit.Keys)
+	}
+	if c := config.Static.Assets; c != nil {
+		if c.MaxFileSize == 0 {
+			c.MaxFileSize = defaultAssetMaxFileSize
+		}
+		if c.MaxTotalSize == 0 {
+			c.MaxTotalSize = defaultAssetMaxTotalSize
+		}
+		if c.MaxAgeSeconds == 0 {
+			c.MaxAgeSeconds = defaultAssetMaxAge
+		}
+	}
+	if c := config.CSRF; c != nil {
+		if c.Cookie == "" {
+			c.Cookie = defaultCSRFCookie
+		}
+		if c.Header == "" {
+			c.Header = defaultCSRFHeader
+		}
+		if c.Field == "" {
+			c.Field = defaultCSRFField
 		}
 	}
 
-	return config, nil
+	return config, unknown, nil
 }
 
-// LoadWorkerConfigs scans the workers directory and loads all worker configs
-func LoadWorkerConfigs(workersDir string) ([]*WorkerConfigWithMeta, error) {
+// LoadWorkerConfigs scans the workers directory and loads all worker configs,
+// resolving their references to the secrets of the server config
+func LoadWorkerConfigs(workersDir string, secrets *SecretStore) ([]*WorkerConfigWithMeta, error) {
 	var configs []*WorkerConfigWithMeta
 
 	entries, err := os.ReadDir(workersDir)
@@ -205,46 +783,99 @@ func LoadWorkerConfigs(workersDir string) ([]*WorkerConfigWithMeta, error) {
 		if !entry.IsDir() {
 			continue
 		}
-
-		workerName := entry.Name()
-		configPath := filepath.Join(workersDir, workerName, "config", "worker.yaml")
-
-		// Check if worker.yaml exists
-		stat, err := os.Stat(configPath)
+		workerMeta, err := loadWorkerDir(workersDir, entry.Name(), secrets)
 		if err != nil {
-			if os.IsNotExist(err) {
-				log.Printf("Warning: Worker '%s' has no config/worker.yaml, skipping", workerName)
-				continue
-			}
-			return nil, fmt.Errorf("failed to stat config for worker '%s': %w", workerName, err)
+			return nil, err
 		}
-
-		// Load worker config
-		workerConfig, err := LoadWorkerConfig(configPath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load config for worker '%s': %w", workerName, err)
+		if workerMeta != nil {
+			configs = append(configs, workerMeta)
 		}
+	}
+
+	return configs, nil
+}
+
+// LoadSingleWorkerConfig loads the config of one worker, the rest of the
+// workers directory is not read
+func LoadSingleWorkerConfig(workersDir, workerName string, secrets *SecretStore) ([]*WorkerConfigWithMeta, error) {
+	if _, err := os.Stat(filepath.Join(workersDir, workerName)); err != nil {
+		return nil, fmt.Errorf("%w %q in %s", errUnknownWorker, workerName, workersDir)
+	}
+	workerMeta, err := loadWorkerDir(workersDir, workerName, secrets)
+	if err != nil {
+		return nil, err
+	}
+	if workerMeta == nil {
+		return nil, fmt.Errorf("worker '%s' has no config/worker.yaml (or .toml, .json)", workerName)
+	}
+	return []*WorkerConfigWithMeta{workerMeta}, nil
+}
+
+// loadRunWorkers loads the worker configs of a server run, only the config of
+// the given worker when it is set
+func loadRunWorkers(config *Config, only string) ([]*WorkerConfigWithMeta, error) {
+	if only == "" {
+		return LoadWorkerConfigs(config.Workers.Directory, config.SecretStore())
+	}
+	workerConfigs, err := LoadSingleWorkerConfig(config.Workers.Directory, only, config.SecretStore())
+	if err != nil {
+		return nil, err
+	}
+	if !workerConfigs[0].Config.IsEnabled(config.Mode) {
+		return nil, fmt.Errorf("worker '%s' is not enabled in %s mode", only, config.Mode)
+	}
+	return workerConfigs, nil
+}
 
-		// Validate path is set
-		if workerConfig.Path == "" {
-			return nil, fmt.Errorf("worker '%s' has no path configured", workerName)
+// loadWorkerDir loads the config of a worker directory, nil when it has none
+func loadWorkerDir(workersDir, workerName string, secrets *SecretStore) (*WorkerConfigWithMeta, error) {
+	configPath := findConfigFile(filepath.Join(workersDir, workerName, "config", "worker.yaml"))
+
+	// Check if worker.yaml exists
+	stat, err := os.Stat(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("Warning: Worker '%s' has no config/worker.yaml (or .toml, .json), skipping", workerName)
+			return nil, nil
 		}
+		return nil, fmt.Errorf("failed to stat config for worker '%s': %w", workerName, err)
+	}
 
-		configs = append(configs, &WorkerConfigWithMeta{
-			Name:       workerName,
-			ConfigPath: configPath,
-			Config:     *workerConfig,
-			ModTime:    stat.ModTime(),
-		})
+	// Load worker config
+	workerConfig, err := LoadWorkerConfig(configPath, secrets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config for worker '%s': %w", workerName, err)
+	}
 
-		log.Printf("Loaded worker '%s' at path '%s'", workerName, workerConfig.Path)
+	// Validate path is set
+	if workerConfig.Path == "" {
+		return nil, fmt.Errorf("worker '%s' has no path configured", workerName)
 	}
 
-	return configs, nil
+	log.Printf("Loaded worker '%s' at path '%s'", workerName, workerConfig.Path)
+	return &WorkerConfigWithMeta{
+		Name:       workerName,
+		ConfigPath: configPath,
+		Config:     *workerConfig,
+		ModTime:    stat.ModTime(),
+	}, nil
 }
 
-// loadWorkerConfig loads a single worker config file
-func LoadWorkerConfig(configPath string) (*WorkerConfig, error) {
+// LoadWorkerConfig loads a single worker config file, unknown settings are
+// logged as warnings
+func LoadWorkerConfig(configPath string, secrets *SecretStore) (*WorkerConfig, error) {
+	config, unknown, err := loadWorkerConfigFile(configPath, secrets)
+	if err != nil {
+		return nil, err
+	}
+	for _, problem := range unknown {
+		log.Printf("Warning: %s", problem)
+	}
+	return config, nil
+}
+
+// loadWorkerConfigFile loads a worker config and returns its unknown settings
+func loadWorkerConfigFile(configPath string, secrets *SecretStore) (*WorkerConfig, []ConfigProblem, error) {
 	// Set defaults and pre-initialize nested structs so unmarshalling
 	// only overrides supplied fields (avoids nil deref when `go` section
 	// is omitted from worker.yaml).
@@ -253,12 +884,14 @@ func LoadWorkerConfig(configPath string) (*WorkerConfig, error) {
 
 	// Pre-create the Go runtime config with sensible defaults.
 	config.Go = &struct {
-		GOMAXPROCS          int    `yaml:"go_max_procs"`
-		GOMEMLIMIT          string `yaml:"go_mem_limit"`
-		ReadTimeoutSeconds  int    `yaml:"read_timeout_seconds"`
-		WriteTimeoutSeconds int    `yaml:"write_timeout_seconds"`
-		IdleTimeoutSeconds  int    `yaml:"idle_timeout_seconds"`
-		MaxRequests         int    `yaml:"max_requests"`
+		GOMAXPROCS          int            `yaml:"go_max_procs"`
+		GOMEMLIMIT          string         `yaml:"go_mem_limit"`
+		ReadTimeoutSeconds  int            `yaml:"read_timeout_seconds"`
+		WriteTimeoutSeconds int            `yaml:"write_timeout_seconds"`
+		IdleTimeoutSeconds  int            `yaml:"idle_timeout_seconds"`
+		MaxRequests         int            `yaml:"max_requests"`
+		Debug               *GoDebugConfig `yaml:"debug"`
+		CachedTemplates     bool           `yaml:"cached_templates"`
 	}{
 		GOMAXPROCS:          2,
 		GOMEMLIMIT:          "",
@@ -270,18 +903,19 @@ func LoadWorkerConfig(configPath string) (*WorkerConfig, error) {
 
 	data, err := os.ReadFile(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return nil, nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	if err := yaml.Unmarshal(data, config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	unknown, err := decodeConfig(configPath, data, config, secrets)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
-	return config, nil
+	return config, unknown, nil
 }
 
 // CheckWorkerConfigChanges checks if any worker configs have been modified
-func CheckWorkerConfigChanges(configs []*WorkerConfigWithMeta) ([]string, error) {
+func CheckWorkerConfigChanges(configs []*WorkerConfigWithMeta, secrets *SecretStore) ([]string, error) {
 	var changed []string
 
 	for _, meta := range configs {
@@ -299,7 +933,7 @@ func CheckWorkerConfigChanges(configs []*WorkerConfigWithMeta) ([]string, error)
 			meta.ModTime = stat.ModTime()
 
 			// Reload the config
-			newConfig, err := LoadWorkerConfig(meta.ConfigPath)
+			newConfig, err := LoadWorkerConfig(meta.ConfigPath, secrets)
 			if err != nil {
 				log.Printf("Error reloading config for worker '%s': %v", meta.Name, err)
 				continue
@@ -357,7 +991,30 @@ func (c *Config) GetHealthCheckTimeout() time.Duration {
 	return time.Duration(c.Workers.HealthCheckTimeoutMs) * time.Millisecond
 }
 
+// SecretStore returns the secrets of the configuration, for the worker
+// configs that reference them
+func (c *Config) SecretStore() *SecretStore {
+	return c.secrets
+}
+
 // IsDevelopmentMode returns true if the server is running in development mode
 func (c *Config) IsDevelopmentMode() bool {
 	return c.Mode == "dev" || c.Mode == "development"
 }
+
+// RollbackWindow returns the time a newly built Go worker binary may still
+// be rolled back, zero when rollbacks are off: in dev mode, where a failing
+// build should show, and for prebuilt workers, which are deployed as a
+// package
+func (c *Config) RollbackWindow() time.Duration {
+	if c.IsDevelopmentMode() || c.UsesPrebuiltWorkers() {
+		return 0
+	}
+	return time.Duration(c.Workers.RollbackWindowSeconds) * time.Second
+}
+
+// UsesPrebuiltWorkers reports whether workers run from the artifacts of an
+// unpacked package instead of being built, see checkPrebuiltWorker
+func (c *Config) UsesPrebuiltWorkers() bool {
+	return c.Workers.Prebuilt && !c.IsDevelopmentMode()
+}
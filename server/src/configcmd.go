@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// effectiveConfig is the configuration as the server runs it: defaults,
+// config file, TQSERVER_MODE and flags merged, with the worker configs
+type effectiveConfig struct {
+	File    string `yaml:"config_file"`
+	*Config `yaml:",inline"`
+	Workers map[string]effectiveWorker `yaml:"worker_configs"`
+}
+
+// effectiveWorker is the config of a worker with the settings derived from it
+type effectiveWorker struct {
+	File          string `yaml:"config_file"`
+	EnabledInMode bool   `yaml:"enabled_in_mode"`
+	WorkerConfig  `yaml:",inline"`
+	Effective     struct {
+		MinWorkers     int `yaml:"min_workers"`
+		MaxWorkers     int `yaml:"max_workers"`
+		QueueThreshold int `yaml:"queue_threshold"`
+		ScaleDownDelay int `yaml:"scale_down_delay"`
+	} `yaml:"effective_scaling"` // Scaling after defaults and limits
+	EffectiveQueue struct {
+		Size        int    `yaml:"size"`
+		MaxWaitMs   int64  `yaml:"max_wait_ms"`
+		MaxInFlight int64  `yaml:"max_in_flight"`
+		Shed        string `yaml:"shed"`
+	} `yaml:"effective_queue"` // Queue after defaults
+}
+
+// runConfig runs "tqserver config <command>"
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: tqserver config print [-config path] [-mode dev|prod]")
+		os.Exit(2)
+	}
+	runConfigPrint(args[1:])
+}
+
+// runConfigPrint prints the effective configuration as YAML, resolved
+// secrets are redacted
+func runConfigPrint(args []string) {
+	flags := flag.NewFlagSet("config print", flag.ExitOnError)
+	configPath := flags.String("config", "config/server.yaml", "Path to config file")
+	mode := flags.String("mode", "", "Server mode: dev or prod (defaults to TQSERVER_MODE env var or 'dev')")
+	flags.Parse(args)
+
+	configFile := findConfigFile(*configPath)
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, errorProblem(configFile, err))
+		os.Exit(1)
+	}
+	if *mode != "" {
+		config.Mode = *mode
+	}
+	workerConfigs, err := LoadWorkerConfigs(config.Workers.Directory, config.SecretStore())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load worker configs: %v\n", err)
+		os.Exit(1)
+	}
+
+	effective := effectiveConfig{File: configFile, Config: config, Workers: map[string]effectiveWorker{}}
+	for _, workerMeta := range workerConfigs {
+		worker := newWorker(workerMeta)
+		ew := effectiveWorker{
+			File:          workerMeta.ConfigPath,
+			EnabledInMode: workerMeta.Config.IsEnabled(config.Mode),
+			WorkerConfig:  workerMeta.Config,
+		}
+		ew.Effective.MinWorkers = worker.MinWorkers
+		ew.Effective.MaxWorkers = worker.MaxWorkers
+		ew.Effective.QueueThreshold = worker.QueueThreshold
+		ew.Effective.ScaleDownDelay = worker.ScaleDownDelay
+		size, maxWait, shed := worker.Queue.settings()
+		ew.EffectiveQueue.Size, ew.EffectiveQueue.MaxWaitMs, ew.EffectiveQueue.Shed = size, maxWait.Milliseconds(), shed
+		ew.EffectiveQueue.MaxInFlight = worker.Queue.limit()
+		effective.Workers[workerMeta.Name] = ew
+	}
+
+	out, err := yaml.Marshal(effective)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print config: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Print(redactSecrets(string(out)))
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// configDeployLimit is the size of the config set read from a request
+const configDeployLimit = 1 << 20
+
+// configDeploy is a set of config files pushed through the admin API, the
+// files it leaves out are kept. Each file is written in the format of the
+// file it replaces, new worker configs as worker.yaml.
+type configDeploy struct {
+	Server  *string           `json:"server"`  // Content of the server config
+	Workers map[string]string `json:"workers"` // Content of worker configs by worker name
+	DryRun  bool              `json:"dry_run"`
+}
+
+// configDeployResult is the response of a config deploy
+type configDeployResult struct {
+	Result   string       `json:"result"`
+	Applied  bool         `json:"applied"`
+	Problems []string     `json:"problems,omitempty"`
+	Workers  []workerPlan `json:"workers,omitempty"`
+	Restart  []string     `json:"restart_required,omitempty"` // Settings that apply on a server restart
+}
+
+// deployFile is a config file of a deploy, staged before it is written
+type deployFile struct {
+	target string // Replaced file
+	staged string
+	data   []byte
+}
+
+// SetConfigDeploy sets the config deploy used by the admin API, it runs
+// with the configuration reloads
+func (p *Proxy) SetConfigDeploy(deploy func(actor string, d *configDeploy) (*configDeployResult, error)) {
+	p.deployConfig = deploy
+}
+
+// handleAPIConfig validates the config files in a JSON body and applies them
+// like SIGHUP, unless "dry_run" is set. Invalid files are not written.
+func (p *Proxy) handleAPIConfig(w http.ResponseWriter, r *http.Request) {
+	var d configDeploy
+	if err := json.NewDecoder(io.LimitReader(r.Body, configDeployLimit)).Decode(&d); err != nil || (d.Server == nil && len(d.Workers) == 0) {
+		setAuditDetails(r, "", "", "")
+		http.Error(w, "invalid request body, \"server\" or \"workers\" is required", http.StatusBadRequest)
+		return
+	}
+	var files []string
+	if d.Server != nil {
+		files = append(files, "server")
+	}
+	for _, name := range slices.Sorted(maps.Keys(d.Workers)) {
+		files = append(files, "workers/"+name)
+	}
+	target := strings.Join(files, ",")
+	setAuditDetails(r, target, "", "")
+	if p.deployConfig == nil {
+		controlError(w, errControlUnavailable)
+		return
+	}
+	result, err := p.deployConfig(requestActor(r), &d)
+	if err != nil {
+		controlError(w, err)
+		return
+	}
+	setAuditDetails(r, target, "", result.Result)
+	if len(result.Problems) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	writeJSON(w, result)
+}
+
+// run validates the deploy with the rest of the project config and, unless
+// it is a dry run, writes its files and applies them with reload. The
+// previous files are put back when the reload fails.
+func (d *configDeploy) run(configFile, mode, only string, s *Supervisor, reload func() error) (*configDeployResult, error) {
+	stageDir, err := os.MkdirTemp("", "tqserver-config-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stageDir)
+
+	var files []deployFile
+	stage := func(target, content string) (string, error) {
+		staged := filepath.Join(stageDir, fmt.Sprint(len(files)), filepath.Base(target))
+		if err := os.MkdirAll(filepath.Dir(staged), 0700); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(staged, []byte(content), 0600); err != nil {
+			return "", err
+		}
+		files = append(files, deployFile{target: target, staged: staged, data: []byte(content)})
+		return staged, nil
+	}
+
+	serverPath := configFile
+	if d.Server != nil {
+		if serverPath, err = stage(configFile, *d.Server); err != nil {
+			return nil, err
+		}
+	}
+	// Loading the config resolves its secrets, those that reach into the
+	// host are checked before
+	problems := d.checkHostSecrets(serverPath, s)
+	var config *Config
+	if len(problems) == 0 {
+		if config, problems, err = loadConfigFile(serverPath); err != nil {
+			problems = []ConfigProblem{errorProblem(serverPath, err)}
+		}
+	}
+	if config != nil {
+		if mode != "" {
+			config.Mode = mode
+		}
+		workerConfigs, workerProblems, err := d.loadWorkers(config, only, stage)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, workerProblems...)
+		problems = append(problems, ValidateConfig(config, serverPath, workerConfigs)...)
+		if len(problems) == 0 {
+			result := &configDeployResult{}
+			result.Workers, result.Restart = s.PlanReload(config, workerConfigs)
+			if d.DryRun {
+				result.Result = "valid, not applied (dry run)"
+				return result, nil
+			}
+			if err := applyDeployFiles(files, reload); err != nil {
+				return nil, err
+			}
+			result.Result, result.Applied = fmt.Sprintf("applied %d file(s)", len(files)), true
+			return result, nil
+		}
+	}
+
+	// Problems point at the files they were pushed for
+	result := &configDeployResult{Result: fmt.Sprintf("invalid: %d problem(s), nothing applied", len(problems))}
+	sortProblems(problems)
+	for _, problem := range problems {
+		for _, file := range files {
+			if problem.File == file.staged {
+				problem.File = file.target
+			}
+		}
+		result.Problems = append(result.Problems, problem.String())
+	}
+	return result, nil
+}
+
+// checkHostSecrets refuses the command, sops, vault and file secrets that a
+// pushed server config adds or changes, unless the running config has
+// admin.push_exec_secrets: as it is validated they would run on the host,
+// send the Vault token of the server or read any of its files
+func (d *configDeploy) checkHostSecrets(path string, s *Supervisor) []ConfigProblem {
+	if d.Server == nil {
+		return nil
+	}
+	s.mu.Lock()
+	current := s.config
+	s.mu.Unlock()
+	if current.Admin.PushExecSecrets {
+		return nil
+	}
+	node, err := parseConfigNode(path, []byte(*d.Server))
+	if err != nil {
+		return nil // Reported by the load
+	}
+	pushed, err := secretsFromNode(node)
+	if err != nil {
+		return nil
+	}
+	var problems []ConfigProblem
+	for _, name := range slices.Sorted(maps.Keys(pushed.configs)) {
+		secret := pushed.configs[name]
+		if secret.Command == "" && secret.SOPS == nil && secret.Vault == nil && secret.File == "" || reflect.DeepEqual(secret, current.Secrets[name]) {
+			continue
+		}
+		problems = append(problems, ConfigProblem{
+			File:    path,
+			Message: "secrets." + name + ": command, sops, vault and file secrets are only pushed with admin.push_exec_secrets",
+		})
+	}
+	return problems
+}
+
+// loadWorkers loads the worker configs of the workers directory with the
+// ones of the deploy staged in place of theirs, like validateProject
+func (d *configDeploy) loadWorkers(config *Config, only string, stage func(target, content string) (string, error)) ([]*WorkerConfigWithMeta, []ConfigProblem, error) {
+	var problems []ConfigProblem
+	var names []string
+	entries, err := os.ReadDir(config.Workers.Directory)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	for name := range d.Workers {
+		if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+			return nil, nil, fmt.Errorf("%q is not a worker name", name)
+		}
+		if only != "" && name != only {
+			return nil, nil, fmt.Errorf("the server runs only worker %s, the config of %s is not applied", only, name)
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var workerConfigs []*WorkerConfigWithMeta
+	for _, name := range names {
+		if only != "" && name != only {
+			continue
+		}
+		path := findConfigFile(filepath.Join(config.Workers.Directory, name, "config", "worker.yaml"))
+		if content, ok := d.Workers[name]; ok {
+			if path, err = stage(path, content); err != nil {
+				return nil, nil, err
+			}
+		} else if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		workerConfig, unknown, err := loadWorkerConfigFile(path, config.SecretStore())
+		problems = append(problems, unknown...)
+		if err != nil {
+			problems = append(problems, errorProblem(path, err))
+			continue
+		}
+		workerConfigs = append(workerConfigs, &WorkerConfigWithMeta{Name: name, ConfigPath: path, Config: *workerConfig})
+	}
+	return workerConfigs, problems, nil
+}
+
+// applyDeployFiles writes the files of a deploy over their targets, each
+// through a rename, and reloads. On a failure the previous files are put
+// back and the directories created for new ones are removed.
+func applyDeployFiles(files []deployFile, reload func() error) error {
+	var restores []func()
+	restore := func() {
+		for _, undo := range slices.Backward(restores) {
+			undo()
+		}
+	}
+	for _, file := range files {
+		previous, err := os.ReadFile(file.target)
+		existed := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			restore()
+			return err
+		}
+		perm := os.FileMode(0644)
+		if info, err := os.Stat(file.target); err == nil {
+			perm = info.Mode().Perm()
+		}
+		created := firstMissingDir(filepath.Dir(file.target))
+		if err := os.MkdirAll(filepath.Dir(file.target), 0755); err != nil {
+			restore()
+			return err
+		}
+		if err := writeFileAtomic(file.target, file.data, perm); err != nil {
+			if created != "" {
+				os.RemoveAll(created)
+			}
+			restore()
+			return err
+		}
+		restores = append(restores, func() {
+			switch {
+			case existed:
+				if err := writeFileAtomic(file.target, previous, perm); err != nil {
+					log.Printf("Failed to restore %s: %v", file.target, err)
+				}
+			case created != "":
+				os.RemoveAll(created)
+			default:
+				os.Remove(file.target)
+			}
+		})
+	}
+	if err := reload(); err != nil {
+		restore()
+		return fmt.Errorf("%v, the previous files are restored", err)
+	}
+	return nil
+}
+
+// firstMissingDir returns the outermost directory of a path that does not
+// exist, empty when it exists
+func firstMissingDir(dir string) string {
+	missing := ""
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return missing
+		}
+		missing = dir
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return missing
+		}
+		dir = parent
+	}
+}
+
+// writeFileAtomic replaces a file through a temporary file, the server and
+// the file watcher see the old or the new content
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
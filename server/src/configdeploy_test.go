@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckHostSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.yaml")
+	current := &Config{Secrets: map[string]SecretConfig{
+		"kept": {Vault: &VaultSecretConfig{Address: "https://vault.internal:8200", Path: "secret/data/app", Field: "password"}},
+	}}
+
+	tests := []struct {
+		name, secret, source string
+		refused              bool
+	}{
+		{"new vault", "token", "{vault: {address: 'https://attacker.example', path: secret/data/app, field: password}}", true},
+		{"changed vault", "kept", "{vault: {address: 'https://attacker.example', path: secret/data/app, field: password}}", true},
+		{"file", "shadow", "{file: /etc/shadow}", true},
+		{"command", "shadow", "{command: 'cat /etc/shadow'}", true},
+		{"sops", "db", "{sops: {file: secrets.enc.yaml, key: db.password}}", true},
+		{"env", "db", "{env: DB_PASSWORD}", false},
+		{"kept vault", "kept", "{vault: {address: 'https://vault.internal:8200', path: secret/data/app, field: password}}", false},
+	}
+	for _, tt := range tests {
+		server := "secrets:\n  " + tt.secret + ": " + tt.source + "\n"
+		if err := os.WriteFile(path, []byte(server), 0600); err != nil {
+			t.Fatal(err)
+		}
+		d := &configDeploy{Server: &server}
+		problems := d.checkHostSecrets(path, &Supervisor{config: current})
+		if refused := len(problems) > 0; refused != tt.refused {
+			t.Errorf("%s: refused = %v, want %v (%v)", tt.name, refused, tt.refused, problems)
+		}
+		if tt.refused && len(problems) > 0 && !strings.Contains(problems[0].Message, "admin.push_exec_secrets") {
+			t.Errorf("%s: problem %q does not name admin.push_exec_secrets", tt.name, problems[0].Message)
+		}
+	}
+
+	current.Admin.PushExecSecrets = true
+	server := "secrets:\n  vault: {vault: {address: 'https://attacker.example', path: secret/data/app, field: password}}\n  file: {file: /etc/shadow}\n"
+	d := &configDeploy{Server: &server}
+	if problems := d.checkHostSecrets(path, &Supervisor{config: current}); len(problems) > 0 {
+		t.Errorf("with admin.push_exec_secrets: %v", problems)
+	}
+}
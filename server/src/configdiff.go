@@ -0,0 +1,151 @@
+package main
+
+import (
+	"reflect"
+)
+
+// workerChange is how the config of a worker changed on a reload
+type workerChange int
+
+const (
+	workerUnchanged workerChange = iota
+	workerRescaled               // Only scaling, queue or metrics, applied in place
+	workerChanged                // Needs a rolling restart of its instances
+	workerReplaced               // Route or type changed, stopped and started again
+	workerRemoved                // Removed or disabled, stopped
+	workerAdded                  // New or enabled, started
+)
+
+// String returns the change as written in the log
+func (c workerChange) String() string {
+	switch c {
+	case workerRescaled:
+		return "scaling updated"
+	case workerChanged:
+		return "restarting"
+	case workerReplaced:
+		return "replacing"
+	case workerRemoved:
+		return "stopping"
+	case workerAdded:
+		return "starting"
+	}
+	return "unchanged"
+}
+
+// diffWorkerConfig compares the config of a worker before and after a reload
+func diffWorkerConfig(old, new WorkerConfig) workerChange {
+	if old.Path != new.Path || old.Type != new.Type {
+		return workerReplaced
+	}
+	if reflect.DeepEqual(old, new) {
+		return workerUnchanged
+	}
+	// Enabled only decides whether the worker runs in the current mode
+	old.Scaling, new.Scaling = nil, nil
+	old.Queue, new.Queue = nil, nil
+	old.Metrics, new.Metrics = nil, nil
+	old.Test, new.Test = nil, nil // Read on each run
+	old.Mocks, new.Mocks = mockEnvs(old.Mocks), mockEnvs(new.Mocks)
+	old.Enabled, new.Enabled = "", ""
+	old.Recycle, new.Recycle = "", "" // Rescheduled in place
+	if reflect.DeepEqual(old, new) {
+		return workerRescaled
+	}
+	return workerChanged
+}
+
+// reloadChange returns how a reload from the old to the new configs changes
+// a running worker
+func reloadChange(name string, oldConfig, newConfig *Config, oldWorkerConfigs, newWorkerConfigs []*WorkerConfigWithMeta) workerChange {
+	newMeta := findWorkerConfig(newWorkerConfigs, name)
+	if newMeta == nil || !newMeta.Config.IsEnabled(newConfig.Mode) {
+		return workerRemoved
+	}
+	change := workerChanged
+	if oldMeta := findWorkerConfig(oldWorkerConfigs, name); oldMeta != nil {
+		change = diffWorkerConfig(oldMeta.Config, newMeta.Config)
+	}
+	if change == workerUnchanged && workerEnvironmentChanged(oldConfig, newConfig) {
+		change = workerChanged
+	}
+	return change
+}
+
+// workerPlan is what a reload does to a worker
+type workerPlan struct {
+	Name   string `json:"name"`
+	Change string `json:"change"`
+}
+
+// mockEnvs keeps what the instances of a worker see of its mocks, the
+// variables and ports, routes apply without a restart
+func mockEnvs(mocks []MockConfig) []MockConfig {
+	var envs []MockConfig
+	for _, mock := range mocks {
+		envs = append(envs, MockConfig{Name: mock.Name, Env: mock.Env})
+	}
+	return envs
+}
+
+// workerEnvironmentChanged reports whether server settings passed to every
+// worker instance changed, all workers restart then
+func workerEnvironmentChanged(old, new *Config) bool {
+	return old.Mode != new.Mode ||
+		!reflect.DeepEqual(old.Env, new.Env) ||
+		!reflect.DeepEqual(old.Logging.Worker, new.Logging.Worker) ||
+		old.Logging.Syslog != new.Logging.Syslog
+}
+
+// restartSettings returns the changed server settings that only apply when
+// the server restarts: listeners, endpoints and their background services
+func restartSettings(old, new *Config) []string {
+	var changed []string
+	for _, setting := range []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"server.port", old.Server.Port, new.Server.Port},
+		{"server.idle_timeout_seconds", old.Server.IdleTimeoutSeconds, new.Server.IdleTimeoutSeconds},
+		{"server.pid_file", old.Server.PidFile, new.Server.PidFile},
+		{"server.tls", old.Server.TLS, new.Server.TLS},
+		{"workers.directory", old.Workers.Directory, new.Workers.Directory},
+		{"workers.mtls", old.Workers.MTLS, new.Workers.MTLS},
+		{"workers.secret_files_dir", old.Workers.SecretFilesDir, new.Workers.SecretFilesDir},
+		{"static.file_cache", old.Static.FileCache, new.Static.FileCache},
+		{"static.assets", old.Static.Assets, new.Static.Assets},
+		{"socks5", old.Socks5, new.Socks5},
+		{"logging.socks5", old.Logging.Socks5, new.Logging.Socks5},
+		{"metrics", old.Metrics, new.Metrics},
+		{"tracing", old.Tracing, new.Tracing},
+		{"health.liveness_path", old.Health.LivenessPath, new.Health.LivenessPath},
+		{"health.readiness_path", old.Health.ReadinessPath, new.Health.ReadinessPath},
+		{"health.startup_gate", old.Health.StartupGate, new.Health.StartupGate},
+		{"health.startup_timeout_seconds", old.Health.StartupTimeoutSeconds, new.Health.StartupTimeoutSeconds},
+		{"admin", old.Admin, new.Admin},
+		{"control", old.Control, new.Control},
+		{"audit", old.Audit, new.Audit},
+		{"dashboard", old.Dashboard, new.Dashboard},
+		{"deploy", old.Deploy, new.Deploy},
+		{"cluster", old.Cluster, new.Cluster},
+		{"webhooks", old.Webhooks, new.Webhooks},
+	} {
+		if !reflect.DeepEqual(setting.old, setting.new) {
+			changed = append(changed, setting.name)
+		}
+	}
+	return changed
+}
+
+// serverLogChanged reports whether the server log must be reopened
+func serverLogChanged(old, new *Config) bool {
+	return !reflect.DeepEqual(old.Logging.Server, new.Logging.Server) ||
+		old.Server.LogFile != new.Server.LogFile ||
+		(new.Logging.Server != nil && old.Logging.Syslog != new.Logging.Syslog)
+}
+
+// accessLogChanged reports whether the access log must be reopened
+func accessLogChanged(old, new *Config) bool {
+	return !reflect.DeepEqual(old.Logging.Access, new.Logging.Access) ||
+		(new.Logging.Access != nil && old.Logging.Syslog != new.Logging.Syslog)
+}
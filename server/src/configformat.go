@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/mevdschee/tqserver/pkg/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configExtensions are the supported config file formats, in order of
+// preference when looking for a file
+var configExtensions = []string{".yaml", ".yml", ".toml", ".json"}
+
+// findConfigFile returns the path of a config file in any of the supported
+// formats, e.g. "config/worker.toml" for "config/worker.yaml". It returns
+// the path itself when it exists or none of the alternatives do.
+func findConfigFile(path string) string {
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	for _, ext := range configExtensions {
+		if _, err := os.Stat(base + ext); err == nil {
+			return base + ext
+		}
+	}
+	return path
+}
+
+// parseConfigNode parses a config file into a YAML node tree, whatever its
+// format, so all formats share the typed decoding and line numbers. JSON is
+// parsed as YAML, which it is a subset of. The result is nil for an empty
+// document.
+func parseConfigNode(path string, data []byte) (*yaml.Node, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		root, err := toml.Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("toml: %w", err)
+		}
+		return tomlNode(root), nil
+	case ".json":
+		var v interface{}
+		var syntaxErr *json.SyntaxError
+		if err := json.Unmarshal(data, &v); errors.As(err, &syntaxErr) {
+			line := bytes.Count(data[:syntaxErr.Offset], []byte("\n")) + 1
+			return nil, fmt.Errorf("json: line %d: %w", line, err)
+		} else if err != nil {
+			return nil, fmt.Errorf("json: %w", err)
+		}
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	return doc.Content[0], nil
+}
+
+// tomlNode converts a TOML value to a YAML node
+func tomlNode(v *toml.Value) *yaml.Node {
+	node := &yaml.Node{Line: v.Line}
+	switch v.Kind {
+	case toml.String, toml.Datetime:
+		node.Kind, node.Tag, node.Value = yaml.ScalarNode, "!!str", v.Str
+	case toml.Integer:
+		node.Kind, node.Tag, node.Value = yaml.ScalarNode, "!!int", strconv.FormatInt(v.Int, 10)
+	case toml.Float:
+		node.Kind, node.Tag = yaml.ScalarNode, "!!float"
+		switch {
+		case math.IsNaN(v.Float):
+			node.Value = ".nan"
+		case math.IsInf(v.Float, 1):
+			node.Value = ".inf"
+		case math.IsInf(v.Float, -1):
+			node.Value = "-.inf"
+		default:
+			node.Value = strconv.FormatFloat(v.Float, 'g', -1, 64)
+		}
+	case toml.Boolean:
+		node.Kind, node.Tag, node.Value = yaml.ScalarNode, "!!bool", strconv.FormatBool(v.Bool)
+	case toml.Array:
+		node.Kind, node.Tag = yaml.SequenceNode, "!!seq"
+		for _, item := range v.Items {
+			node.Content = append(node.Content, tomlNode(item))
+		}
+	case toml.Table:
+		node.Kind, node.Tag = yaml.MappingNode, "!!map"
+		for _, f := range v.Fields {
+			key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: f.Key, Line: f.Line}
+			node.Content = append(node.Content, key, tomlNode(f.Value))
+		}
+	}
+	return node
+}
+
+// decodeConfig decodes a config file into out, resolving its secret
+// references. Unknown settings are returned as problems and the other
+// settings are still decoded; any other error is returned.
+func decodeConfig(path string, data []byte, out interface{}, secrets *SecretStore) ([]ConfigProblem, error) {
+	node, err := parseConfigNode(path, data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeConfigNode(path, node, out, secrets)
+}
+
+// decodeConfigNode decodes a parsed config file, see decodeConfig
+func decodeConfigNode(path string, node *yaml.Node, out interface{}, secrets *SecretStore) ([]ConfigProblem, error) {
+	if node == nil {
+		return nil, nil
+	}
+	if err := secrets.resolveNode(node); err != nil {
+		return nil, err
+	}
+	problems := unknownSettings(path, node, reflect.TypeOf(out))
+	return problems, node.Decode(out)
+}
+
+// unknownSettings returns the keys of a node that have no field in the
+// type it is decoded into, following the yaml struct tags
+func unknownSettings(path string, node *yaml.Node, t reflect.Type) []ConfigProblem {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+
+	var problems []ConfigProblem
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := map[string]reflect.Type{}
+		collectYAMLFields(t, fields)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				continue
+			}
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				problems = append(problems, ConfigProblem{File: path, Line: key.Line, Message: fmt.Sprintf("unknown setting %q", key.Value)})
+				continue
+			}
+			problems = append(problems, unknownSettings(path, value, fieldType)...)
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			problems = append(problems, unknownSettings(path, node.Content[i], t.Elem())...)
+		}
+	case (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			problems = append(problems, unknownSettings(path, item, t.Elem())...)
+		}
+	}
+	return problems
+}
+
+// collectYAMLFields maps the keys of a struct to their field types, with the
+// fields of inlined structs
+func collectYAMLFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("yaml")
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(","+options+",", ",inline,") {
+			inner := field.Type
+			for inner.Kind() == reflect.Pointer {
+				inner = inner.Elem()
+			}
+			if inner.Kind() == reflect.Struct {
+				collectYAMLFields(inner, fields)
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+}
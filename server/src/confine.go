@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// confineSystemPaths are the directories of the host a confined worker can
+// read, for its shared libraries, certificates and name resolution
+var confineSystemPaths = []string{"/bin", "/sbin", "/lib", "/lib32", "/lib64", "/usr", "/etc"}
+
+// confinement is what a worker process is limited to, see confineCommand
+type confinement struct {
+	Mounts  []confineMount  // Paths it sees, all of the host when empty
+	Network *confineNetwork // Only loopback, the network of the host when nil
+}
+
+// confineNetwork is the network of a worker that can only connect out
+// through the SOCKS5 proxy: a loopback of its own, with ports forwarded from
+// and to the loopback of the host
+type confineNetwork struct {
+	Inbound  []int // Ports the worker listens on, forwarded from the host
+	Outbound []int // Ports of the host it can connect to, the proxy first
+}
+
+// confineMount is a path of the host that a confined worker sees, at the
+// same location
+type confineMount struct {
+	Path     string
+	Writable bool
+}
+
+// confineMounts returns the paths a confined worker sees: the system
+// directories and the read_only paths of the worker, its own directory
+// and the extra paths the server gives it. It returns nil when the worker
+// is not confined.
+func (s *Supervisor) confineMounts(workerMeta *WorkerConfigWithMeta, workerRoot string, extra ...confineMount) []confineMount {
+	if workerMeta == nil || workerMeta.Config.Confine == nil || !workerMeta.Config.Confine.Enabled {
+		return nil
+	}
+	var mounts []confineMount
+	for _, path := range confineSystemPaths {
+		mounts = append(mounts, confineMount{Path: path})
+	}
+	for _, path := range workerMeta.Config.Confine.ReadOnly {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(s.projectRoot, path)
+		}
+		mounts = append(mounts, confineMount{Path: path})
+	}
+	mounts = append(mounts, confineMount{Path: workerRoot, Writable: true})
+	return normalizeConfineMounts(append(mounts, extra...))
+}
+
+// confinement returns the limits of a worker process: the paths it sees
+// when the worker is confined, and its own network when socks5.enforce is
+// on, with the ports it listens on forwarded. It returns nil without limits.
+func (s *Supervisor) confinement(workerMeta *WorkerConfigWithMeta, workerRoot string, inbound []int, extra ...confineMount) *confinement {
+	c := &confinement{Mounts: s.confineMounts(workerMeta, workerRoot, extra...)}
+	if enforce := s.config.Socks5.Enforce; s.config.Socks5.Enabled && enforce != nil && enforce.Enabled {
+		c.Network = &confineNetwork{Inbound: inbound, Outbound: []int{s.config.Socks5.Port}}
+		c.Network.Outbound = append(c.Network.Outbound, enforce.LocalPorts...)
+		if workerMeta != nil {
+			c.Network.Outbound = append(c.Network.Outbound, s.mocks.ports(workerMeta.Name)...)
+		}
+	}
+	if c.Mounts == nil && c.Network == nil {
+		return nil
+	}
+	return c
+}
+
+// normalizeConfineMounts sorts mounts parents first and drops the ones
+// already covered by a parent with the same access
+func normalizeConfineMounts(mounts []confineMount) []confineMount {
+	for i := range mounts {
+		mounts[i].Path = filepath.Clean(mounts[i].Path)
+	}
+	slices.SortStableFunc(mounts, func(a, b confineMount) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	var result []confineMount
+	for _, m := range mounts {
+		covered := false
+		for i := len(result) - 1; i >= 0; i-- {
+			parent := result[i]
+			if parent.Path == m.Path || strings.HasPrefix(m.Path, parent.Path+"/") {
+				covered = parent.Writable || !m.Writable
+				if parent.Path == m.Path && !covered {
+					// Writable wins over read-only on the same path
+					result[i].Writable = true
+					covered = true
+				}
+				break
+			}
+		}
+		if !covered {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// confineCommand makes cmd start through the hidden "confine" command of
+// the server, which applies the confinement. The process keeps the pid of
+// cmd as the command replaces the confine process, with a network of its
+// own the confine process stays to forward the ports.
+func confineCommand(cmd *exec.Cmd, c *confinement) error {
+	if cmd.Err != nil {
+		return cmd.Err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the server binary: %w", err)
+	}
+	args := []string{self, "confine"}
+	if c.Mounts != nil {
+		// The command itself may live outside the paths, e.g. ~/.bun/bin/bun
+		for _, m := range normalizeConfineMounts(append(slices.Clone(c.Mounts), confineMount{Path: cmd.Path})) {
+			if m.Writable {
+				args = append(args, "-rw", m.Path)
+			} else {
+				args = append(args, "-ro", m.Path)
+			}
+		}
+	}
+	if c.Network != nil {
+		args = append(args, "-net")
+		for _, port := range c.Network.Inbound {
+			args = append(args, "-in", strconv.Itoa(port))
+		}
+		for _, port := range c.Network.Outbound {
+			args = append(args, "-out", strconv.Itoa(port))
+		}
+	}
+	args = append(args, "--", cmd.Path)
+	args = append(args, cmd.Args[1:]...)
+	if err := setConfineAttr(cmd, c.Network != nil); err != nil {
+		return err
+	}
+	cmd.Path = self
+	cmd.Args = args
+	return nil
+}
+
+// runConfine is the hidden "confine" command: it builds the root of a
+// confined worker from the given paths and executes the worker in it, or
+// runs it in a network of its own and forwards the given ports
+func runConfine(args []string) {
+	var c confinement
+	for len(args) > 0 && args[0] != "--" {
+		switch {
+		case len(args) >= 2 && (args[0] == "-ro" || args[0] == "-rw"):
+			c.Mounts = append(c.Mounts, confineMount{Path: args[1], Writable: args[0] == "-rw"})
+			args = args[2:]
+		case args[0] == "-net":
+			c.Network = &confineNetwork{}
+			args = args[1:]
+		case len(args) >= 2 && c.Network != nil && (args[0] == "-in" || args[0] == "-out"):
+			port, err := strconv.Atoi(args[1])
+			if err != nil {
+				confineUsage()
+			}
+			if args[0] == "-in" {
+				c.Network.Inbound = append(c.Network.Inbound, port)
+			} else {
+				c.Network.Outbound = append(c.Network.Outbound, port)
+			}
+			args = args[2:]
+		default:
+			confineUsage()
+		}
+	}
+	if len(args) < 2 {
+		confineUsage()
+	}
+	command := args[1:]
+	if err := enterConfinement(c.Mounts); err != nil {
+		fmt.Fprintf(os.Stderr, "confine: %v\n", err)
+		os.Exit(1)
+	}
+	if c.Network != nil {
+		status, err := runIsolated(command, c.Network)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "confine: %v\n", err)
+		}
+		os.Exit(status)
+	}
+	if err := dropCapabilities(); err != nil {
+		fmt.Fprintf(os.Stderr, "confine: %v\n", err)
+		os.Exit(1)
+	}
+	err := syscall.Exec(command[0], command, os.Environ())
+	fmt.Fprintf(os.Stderr, "confine: %s: %v\n", command[0], err)
+	os.Exit(1)
+}
+
+// confineUsage reports wrong arguments of the confine command
+func confineUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: tqserver confine [-ro path] [-rw path]... [-net [-in port]... [-out port]...] -- command [args...]")
+	os.Exit(2)
+}
+
+// forwardConn copies between two connections until both sides are done,
+// a side that finishes sending closes the writing half of the other
+func forwardConn(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(a, b)
+		closeWrite(a)
+		close(done)
+	}()
+	io.Copy(b, a)
+	closeWrite(b)
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// closeWrite closes the writing half of a TCP connection
+func closeWrite(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Capability and prctl values that are missing from package syscall
+const (
+	capSetPCap           = 8
+	capNetAdmin          = 12
+	capSysAdmin          = 21
+	capVersion3          = 0x20080522
+	prSetNoNewPrivs      = 38
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+	prCapBoundingSetDrop = syscall.PR_CAPBSET_DROP
+)
+
+// confineDevices are the device files of a confined worker
+var confineDevices = []string{"/dev/null", "/dev/zero", "/dev/full", "/dev/random", "/dev/urandom", "/dev/tty"}
+
+// setConfineAttr starts cmd in its own user, mount and pid namespaces. The
+// user namespace only maps the user of the server, the confine process
+// keeps the capabilities to mount and to empty its bounding set in it, and
+// to set up the network of the worker, and drops all before the worker
+// runs.
+func setConfineAttr(cmd *exec.Cmd, network bool) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Geteuid(), HostID: os.Geteuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getegid(), HostID: os.Getegid(), Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	cmd.SysProcAttr.AmbientCaps = append(cmd.SysProcAttr.AmbientCaps, capSetPCap, capSysAdmin)
+	if network {
+		cmd.SysProcAttr.AmbientCaps = append(cmd.SysProcAttr.AmbientCaps, capNetAdmin)
+	}
+	return nil
+}
+
+// enterConfinement replaces the root of the process with a new one that
+// only has the mounts, a private /tmp and /proc and the basic devices, the
+// root stays without mounts. The host root is mounted below a tmpfs on /tmp
+// while the new root is built. The calling thread stays locked, it has to
+// drop the capabilities and start the worker.
+func enterConfinement(mounts []confineMount) error {
+	// Capabilities and the network are per thread
+	runtime.LockOSThread()
+	if len(mounts) == 0 {
+		return nil
+	}
+	cwd, _ := os.Getwd()
+
+	// No mount made here propagates back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("make mounts private: %w", err)
+	}
+	if err := syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("mount build root: %w", err)
+	}
+	for _, dir := range []string{"/tmp/oldroot", "/tmp/newroot"} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := syscall.PivotRoot("/tmp", "/tmp/oldroot"); err != nil {
+		return fmt.Errorf("pivot to build root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+
+	if err := syscall.Mount("tmpfs", "/newroot", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("mount root: %w", err)
+	}
+	for _, dir := range []string{"/newroot/tmp", "/newroot/proc", "/newroot/dev"} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Mount("tmpfs", "/newroot/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("mount /tmp: %w", err)
+	}
+	if err := syscall.Mount("proc", "/newroot/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("mount /proc: %w", err)
+	}
+	for _, device := range confineDevices {
+		if err := bindConfineMount(confineMount{Path: device, Writable: true}); err != nil {
+			return err
+		}
+	}
+	for name, target := range map[string]string{"fd": "/proc/self/fd", "stdin": "/proc/self/fd/0", "stdout": "/proc/self/fd/1", "stderr": "/proc/self/fd/2"} {
+		if err := os.Symlink(target, filepath.Join("/newroot/dev", name)); err != nil {
+			return err
+		}
+	}
+	for _, m := range mounts {
+		if err := bindConfineMount(m); err != nil {
+			return err
+		}
+	}
+
+	// Switch to the new root and drop the host root
+	if err := os.Chdir("/newroot"); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("pivot to root: %w", err)
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmount host root: %w", err)
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("make root read-only: %w", err)
+	}
+	if cwd == "" || os.Chdir(cwd) != nil {
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// innerDial asks the thread in the network of the worker for a connection
+// to a port of the worker
+type innerDial struct {
+	port  int
+	reply chan net.Conn
+}
+
+// runIsolated runs the worker in a network of its own that only has a
+// loopback, and forwards the ports between it and the loopback of the
+// host. Only the calling thread, locked by enterConfinement, moves to the
+// new network: it makes the connections to the worker, the other threads
+// make the ones to the host. It returns the exit status of the worker.
+func runIsolated(command []string, network *confineNetwork) (int, error) {
+	// Listen on the host before the thread leaves its network
+	var inbound []net.Listener
+	for _, port := range network.Inbound {
+		ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			return 1, err
+		}
+		inbound = append(inbound, ln)
+	}
+	if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+		return 1, fmt.Errorf("create network: %w", err)
+	}
+	if err := loopbackUp(); err != nil {
+		return 1, err
+	}
+	for _, port := range network.Outbound {
+		addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return 1, err
+		}
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					host, err := net.DialTimeout("tcp", addr, 5*time.Second)
+					if err != nil {
+						conn.Close()
+						return
+					}
+					forwardConn(conn, host)
+				}()
+			}
+		}()
+	}
+	dials := make(chan innerDial)
+	for i, ln := range inbound {
+		port := network.Inbound[i]
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					reply := make(chan net.Conn, 1)
+					dials <- innerDial{port: port, reply: reply}
+					if worker := <-reply; worker != nil {
+						forwardConn(conn, worker)
+					} else {
+						conn.Close()
+					}
+				}()
+			}
+		}()
+	}
+
+	if err := dropCapabilities(); err != nil {
+		return 1, err
+	}
+	// Started from this thread, the worker is in the new network
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return 1, err
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	// As the first process of its pid namespace, this one reaps orphans
+	exited := make(chan syscall.WaitStatus)
+	go func() {
+		for {
+			var status syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &status, 0, nil)
+			if pid == cmd.Process.Pid || err == syscall.ECHILD {
+				exited <- status
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case d := <-dials:
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(d.port)), 5*time.Second)
+			if err != nil {
+				conn = nil
+			}
+			d.reply <- conn
+		case status := <-exited:
+			if status.Signaled() {
+				return 128 + int(status.Signal()), nil
+			}
+			return status.ExitStatus(), nil
+		}
+	}
+}
+
+// loopbackUp brings up the loopback interface in the network of the thread
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	ifr.flags = syscall.IFF_UP | syscall.IFF_LOOPBACK
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return fmt.Errorf("bring up loopback: %w", errno)
+	}
+	return nil
+}
+
+// dropCapabilities empties the capability sets of the thread and its
+// bounding set, the worker it executes has none, also when it runs as root
+func dropCapabilities() error {
+	for c := uintptr(0); ; c++ {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapBoundingSetDrop, c, 0); errno == syscall.EINVAL {
+			break
+		} else if errno != 0 {
+			return fmt.Errorf("drop capability %d: %w", c, errno)
+		}
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0); errno != 0 {
+		return fmt.Errorf("clear ambient capabilities: %w", errno)
+	}
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: capVersion3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("drop capabilities: %w", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("set no_new_privs: %w", errno)
+	}
+	return nil
+}
+
+// bindConfineMount mounts a path of the host root, below /oldroot, at the
+// same path of the new root. Symlinks are copied, missing paths skipped.
+func bindConfineMount(m confineMount) error {
+	source := filepath.Join("/oldroot", m.Path)
+	target := filepath.Join("/newroot", m.Path)
+	info, err := os.Lstat(source)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(source)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0755)
+	} else if _, err = os.Stat(target); os.IsNotExist(err) {
+		err = os.WriteFile(target, nil, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("mount %s: %w", m.Path, err)
+	}
+	if m.Writable {
+		return nil
+	}
+	// A read-only remount has to keep the flags the host mount is locked with
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err != nil {
+		return err
+	}
+	flags := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC | syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME)
+	if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|flags, ""); err != nil {
+		return fmt.Errorf("make %s read-only: %w", m.Path, err)
+	}
+	return nil
+}
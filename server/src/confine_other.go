@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// errConfineUnsupported is returned for confined workers on other systems,
+// confinement is built on Linux namespaces
+var errConfineUnsupported = errors.New("confinement is only supported on Linux")
+
+func setConfineAttr(cmd *exec.Cmd, network bool) error {
+	return errConfineUnsupported
+}
+
+func enterConfinement(mounts []confineMount) error {
+	return errConfineUnsupported
+}
+
+func dropCapabilities() error {
+	return errConfineUnsupported
+}
+
+func runIsolated(command []string, network *confineNetwork) (int, error) {
+	return 1, errConfineUnsupported
+}
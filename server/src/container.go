@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultContainerPort is the port a container is expected to listen on
+// when container_port is not configured
+const defaultContainerPort = 8080
+
+// findContainerRuntime locates the docker or podman CLI
+func findContainerRuntime(preferred string) (string, error) {
+	if preferred != "" {
+		if p, err := exec.LookPath(preferred); err == nil {
+			return p, nil
+		}
+		return "", fmt.Errorf("container runtime %q not found in PATH", preferred)
+	}
+
+	for _, candidate := range []string{"docker", "podman"} {
+		if p, err := exec.LookPath(candidate); err == nil {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("no container runtime found in PATH; install docker or podman or set container.runtime in worker config")
+}
+
+// containerImage returns the image name used for a container worker
+func containerImage(workerName string, cfg *ContainerConfig) string {
+	// Built images are tagged with the configured image name when set
+	if cfg.Image != "" {
+		return cfg.Image
+	}
+	return fmt.Sprintf("tqserver-%s:latest", workerName)
+}
+
+// containerListenPort returns the port the containerized process listens on
+func containerListenPort(cfg *ContainerConfig, hostPort int) int {
+	if cfg.Network == "host" {
+		return hostPort
+	}
+	if cfg.ContainerPort > 0 {
+		return cfg.ContainerPort
+	}
+	return defaultContainerPort
+}
+
+// containerRunArgs builds the arguments for "<runtime> run" of a single
+// instance, the certificate files in tlsDir and the secret files in
+// secretsDir are mounted when they are set. Only the names of the env vars
+// are passed, the runtime reads their values from its own environment so
+// secrets do not show up in the process list.
+func containerRunArgs(cfg *ContainerConfig, image, name string, hostPort int, env []string, tlsDir, secretsDir string) []string {
+	args := []string{"run", "--rm", "--name", name}
+
+	if cfg.Network != "" {
+		args = append(args, "--network", cfg.Network)
+	}
+	if cfg.Network != "host" {
+		// Publish on loopback only, the proxy is the public entry point
+		args = append(args, "-p", fmt.Sprintf("127.0.0.1:%d:%d", hostPort, containerListenPort(cfg, hostPort)))
+	}
+
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		args = append(args, "-e", key)
+	}
+	if tlsDir != "" {
+		args = append(args, "-v", tlsDir+":"+containerTLSDir+":ro")
+	}
+	if secretsDir != "" {
+		args = append(args, "-v", secretsDir+":"+containerSecretsDir+":ro")
+	}
+
+	args = append(args, cfg.Args...)
+	args = append(args, image)
+	return args
+}
+
+// buildContainerImage builds the worker image from its build context, or
+// pulls the configured image when no build context is set
+func buildContainerImage(workerName, workerRoot string, cfg *ContainerConfig) error {
+	runtime, err := findContainerRuntime(cfg.Runtime)
+	if err != nil {
+		return err
+	}
+
+	image := containerImage(workerName, cfg)
+
+	var cmd *exec.Cmd
+	if cfg.Build != "" {
+		contextDir := cfg.Build
+		if !filepath.IsAbs(contextDir) {
+			contextDir = filepath.Join(workerRoot, contextDir)
+		}
+		args := []string{"build", "-t", image}
+		if cfg.Dockerfile != "" {
+			args = append(args, "-f", filepath.Join(contextDir, cfg.Dockerfile))
+		}
+		args = append(args, contextDir)
+		cmd = exec.Command(runtime, args...)
+		log.Printf("Building container image %s for worker %s", image, workerName)
+	} else if cfg.Image != "" {
+		// Only pull when the image is not present locally
+		if err := exec.Command(runtime, "image", "inspect", image).Run(); err == nil {
+			return nil
+		}
+		cmd = exec.Command(runtime, "pull", image)
+		log.Printf("Pulling container image %s for worker %s", image, workerName)
+	} else {
+		return fmt.Errorf("container worker %s needs either container.image or container.build", workerName)
+	}
+
+	cmd.Dir = workerRoot
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s failed: %s", filepath.Base(runtime), cmd.Args[1], out)
+	}
+	return nil
+}
+
+// stopContainer stops a running container, giving it the grace period to exit
+func stopContainer(runtime, name string, gracePeriod time.Duration) {
+	seconds := int(gracePeriod.Round(time.Second).Seconds())
+	cmd := exec.Command(runtime, "stop", "-t", strconv.Itoa(seconds), name)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Failed to stop container %s: %v (%s)", name, err, out)
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ctlUserHeader carries the user that ran "tqserver ctl", for the audit log
+const ctlUserHeader = "X-Tqserver-User"
+
+// drainTimeout is the default time a drain waits for the requests in flight
+// before it stops the instances
+const drainTimeout = 30 * time.Second
+
+// Errors of the control operations
+var (
+	errUnknownWorker      = errors.New("unknown worker")
+	errUnknownInstance    = errors.New("unknown instance")
+	errControlUnavailable = errors.New("the server is still starting")
+)
+
+// controlSocketKey marks the requests of the control socket
+type controlSocketKey struct{}
+
+// fromControlSocket reports whether a request came in on the control socket
+func fromControlSocket(r *http.Request) bool {
+	fromSocket, _ := r.Context().Value(controlSocketKey{}).(bool)
+	return fromSocket
+}
+
+// controlResult is the response of a control operation
+type controlResult struct {
+	Result string `json:"result"`
+}
+
+// SetControl sets the supervisor and the configuration reload used by the
+// control operations
+func (p *Proxy) SetControl(supervisor *Supervisor, reload func(actor string) error) {
+	p.supervisor = supervisor
+	p.reload = reload
+}
+
+// startControl serves the admin API and the control operations on a unix
+// socket that only the owner can use, for "tqserver ctl"
+func (p *Proxy) startControl() error {
+	path := p.config.Control.Socket
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.projectRoot, path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create control socket: %w", err)
+	}
+	// The socket of a previous run is removed, unless that server still runs
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %s is in use by another server", path)
+	}
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to create control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to create control socket: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	p.registerAdminAPI(mux)
+	p.registerControl(mux)
+	p.controlServer = &http.Server{
+		Handler:     mux,
+		ReadTimeout: 30 * time.Second,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, controlSocketKey{}, true)
+		},
+	}
+	go func() {
+		if err := p.controlServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Control socket failed: %v", err)
+		}
+	}()
+	log.Printf("Control socket at %s", path)
+	return nil
+}
+
+// registerControl adds the operations that change the running server, they
+// are recorded in the audit log
+func (p *Proxy) registerControl(mux *http.ServeMux) {
+	mux.HandleFunc("POST /admin/api/workers/{name}/restart", p.audited(AuditWorkerRestart, p.handleAPIRestart))
+	mux.HandleFunc("POST /admin/api/workers/{name}/scale", p.audited(AuditWorkerScale, p.handleAPIScale))
+	mux.HandleFunc("DELETE /admin/api/workers/{name}/scale", p.audited(AuditWorkerScale, p.handleAPIScale))
+	mux.HandleFunc("POST /admin/api/workers/{name}/drain", p.audited(AuditWorkerDrain, p.handleAPIDrainWorker))
+	mux.HandleFunc("DELETE /admin/api/workers/{name}/drain", p.audited(AuditWorkerDrain, p.handleAPIDrainWorker))
+	mux.HandleFunc("POST /admin/api/drain", p.audited(AuditServerDrain, p.handleAPIDrain))
+	mux.HandleFunc("POST /admin/api/workers/{name}/instances", p.audited(AuditInstances, p.handleAPIInstances))
+	mux.HandleFunc("DELETE /admin/api/workers/{name}/instances", p.audited(AuditInstances, p.handleAPIInstances))
+	mux.HandleFunc("POST /admin/api/reload", p.handleAPIReload)
+	mux.HandleFunc("POST /admin/api/config", p.audited(AuditConfigDeploy, p.handleAPIConfig))
+	mux.HandleFunc("GET /admin/api/logs", p.handleAPILogs)
+}
+
+// controlError writes the error of a control operation
+func controlError(w http.ResponseWriter, err error) {
+	status := http.StatusUnprocessableEntity
+	switch {
+	case errors.Is(err, errUnknownWorker), errors.Is(err, errUnknownInstance):
+		status = http.StatusNotFound
+	case errors.Is(err, errControlUnavailable):
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// handleAPIRestart restarts the instances of a worker one by one
+func (p *Proxy) handleAPIRestart(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	setAuditDetails(r, name, "", "")
+	if p.supervisor == nil {
+		controlError(w, errControlUnavailable)
+		return
+	}
+	if err := p.supervisor.RestartWorker(name); err != nil {
+		controlError(w, err)
+		return
+	}
+	writeJSON(w, controlResult{Result: "restarting " + name})
+}
+
+// handleAPIScale pins the number of instances of a worker, from the
+// "instances" and "duration" (default 1h) fields of a JSON body. DELETE ends
+// the override.
+func (p *Proxy) handleAPIScale(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var request struct {
+		Instances int    `json:"instances"`
+		Duration  string `json:"duration"`
+	}
+	duration := time.Hour
+	if r.Method != http.MethodDelete {
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err == nil && request.Duration != "" {
+			duration, err = time.ParseDuration(request.Duration)
+		}
+		if err != nil || request.Instances < 1 || duration <= 0 {
+			setAuditDetails(r, name, "", "")
+			http.Error(w, "instances must be 1 or more and duration positive, like \"30m\"", http.StatusBadRequest)
+			return
+		}
+	}
+	if p.supervisor == nil {
+		controlError(w, errControlUnavailable)
+		return
+	}
+	before, after, err := p.supervisor.ScaleWorker(name, request.Instances, duration)
+	setAuditDetails(r, name, before, after)
+	if err != nil {
+		controlError(w, err)
+		return
+	}
+	writeJSON(w, controlResult{Result: fmt.Sprintf("%s: %s", name, after)})
+}
+
+// handleAPIDrainWorker drains a worker, or the instance in the "instance"
+// field of a JSON body: no new requests are routed to it and its processes
+// are stopped once the requests in flight finished, or after "timeout"
+// (default 30s). DELETE ends the drain of a worker.
+func (p *Proxy) handleAPIDrainWorker(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var request struct {
+		Instance string `json:"instance"`
+		Timeout  string `json:"timeout"`
+	}
+	timeout := drainTimeout
+	if r.Method != http.MethodDelete && r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err == nil && request.Timeout != "" {
+			timeout, err = time.ParseDuration(request.Timeout)
+		}
+		if err != nil || timeout <= 0 {
+			setAuditDetails(r, name, "", "")
+			http.Error(w, "invalid request body, timeout must be positive, like \"1m\"", http.StatusBadRequest)
+			return
+		}
+	}
+	if p.supervisor == nil {
+		controlError(w, errControlUnavailable)
+		return
+	}
+
+	var before, after, result string
+	var err error
+	target := name
+	switch {
+	case r.Method == http.MethodDelete:
+		before, after, err = p.supervisor.CancelDrain(name)
+		result = "drain of " + name + " cancelled, instances are starting"
+	case request.Instance != "":
+		target = name + "/" + request.Instance
+		before, after, err = p.supervisor.DrainWorker(name, request.Instance, timeout)
+		result = fmt.Sprintf("draining instance %s, stopped when idle or after %s", request.Instance, timeout)
+	default:
+		before, after, err = p.supervisor.DrainWorker(name, "", timeout)
+		result = fmt.Sprintf("draining %s, stopped when idle or after %s", name, timeout)
+	}
+	setAuditDetails(r, target, before, after)
+	if err != nil {
+		controlError(w, err)
+		return
+	}
+	writeJSON(w, controlResult{Result: result})
+}
+
+// handleAPIDrain fails the readiness check, so load balancers stop sending
+// traffic before the server is stopped. The "draining" field of a JSON body
+// set to false ends it.
+func (p *Proxy) handleAPIDrain(w http.ResponseWriter, r *http.Request) {
+	request := struct {
+		Draining bool `json:"draining"`
+	}{Draining: true}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	before := strconv.FormatBool(p.draining.Load())
+	p.draining.Store(request.Draining)
+	setAuditDetails(r, "server", "draining="+before, "draining="+strconv.FormatBool(request.Draining))
+	if request.Draining {
+		log.Printf("Draining: the readiness check fails until the drain is cancelled")
+		writeJSON(w, controlResult{Result: "draining, readiness check fails"})
+		return
+	}
+	log.Printf("Drain cancelled")
+	writeJSON(w, controlResult{Result: "drain cancelled"})
+}
+
+// handleAPIReload reloads the configuration like SIGHUP, the reload records
+// itself in the audit log
+func (p *Proxy) handleAPIReload(w http.ResponseWriter, r *http.Request) {
+	if p.reload == nil {
+		controlError(w, errControlUnavailable)
+		return
+	}
+	if err := p.reload(requestActor(r)); err != nil {
+		controlError(w, err)
+		return
+	}
+	writeJSON(w, controlResult{Result: "configuration reloaded"})
+}
+
+// handleAPILogs returns the recent lines of the server log as text, or
+// those of the output of a worker and its php-fpm pools for the "worker"
+// parameter. The "lines" parameter limits them (default 100), "follow"
+// keeps the response open for new lines until the client disconnects.
+func (p *Proxy) handleAPILogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	lines := 100
+	if n, err := strconv.Atoi(query.Get("lines")); err == nil {
+		lines = n
+	}
+	follow, _ := strconv.ParseBool(query.Get("follow"))
+	tail := serverLogTail
+	if name := query.Get("worker"); name != "" {
+		tail = nil
+		for _, worker := range p.router.GetAllWorkers() {
+			if worker.Name == name {
+				tail = worker.Logs
+			}
+		}
+		if tail == nil {
+			http.Error(w, "Unknown worker", http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !follow {
+		for _, line := range tail.Lines(lines) {
+			fmt.Fprintln(w, redactSecrets(line))
+		}
+		return
+	}
+	recent, newLines, cancel := tail.Subscribe(lines)
+	defer cancel()
+	for _, line := range recent {
+		fmt.Fprintln(w, redactSecrets(line))
+	}
+	rc := http.NewResponseController(w)
+	for {
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case line := <-newLines:
+			fmt.Fprintln(w, redactSecrets(line))
+		}
+	}
+}
+
+// findWorker returns a running worker by name
+func (s *Supervisor) findWorker(name string) (*Worker, error) {
+	for _, w := range s.router.GetAllWorkers() {
+		if w.Name == name {
+			return w, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownWorker, name)
+}
+
+// RestartWorker restarts the instances of a worker one by one, like a
+// configuration change of the worker
+func (s *Supervisor) RestartWorker(name string) error {
+	w, err := s.findWorker(name)
+	if err != nil {
+		return err
+	}
+	log.Printf("Restarting worker %s on request", name)
+	s.events.Record(EventWorkerReloaded, name, "", "restart requested")
+	GetMetrics().RecordWorkerRestart(name)
+	go s.rollingRestart(w)
+	return nil
+}
+
+// ScaleWorker pins a worker to a number of instances for a duration, the
+// autoscaler resumes afterwards, or right away for 0 instances. The
+// dispatcher starts or stops the instances. It returns the scaling before
+// and after.
+func (s *Supervisor) ScaleWorker(name string, instances int, duration time.Duration) (string, string, error) {
+	w, err := s.findWorker(name)
+	if err != nil {
+		return "", "", err
+	}
+	if w.Type == "php" || w.Type == "wasm" || w.Type == "remote" {
+		return "", "", fmt.Errorf("%s workers are not scaled by instances", w.Type)
+	}
+
+	w.mu.Lock()
+	before := w.scaling()
+	w.Pinned, w.PinnedUntil = instances, time.Time{}
+	if instances > 0 {
+		w.PinnedUntil = time.Now().Add(duration).Truncate(time.Second)
+	}
+	after := w.scaling()
+	w.mu.Unlock()
+
+	log.Printf("[Scaling] %s: scaling changed from %s to %s on request", name, before, after)
+	return before, after, nil
+}
+
+// DrainWorker stops routing requests to a worker, or to one of its
+// instances, and stops its processes in the background once the requests in
+// flight finished or the timeout passed. A drained instance is replaced by
+// the autoscaler, a drained worker stays stopped until CancelDrain. It
+// returns the state before and after.
+func (s *Supervisor) DrainWorker(name, instanceID string, timeout time.Duration) (string, string, error) {
+	w, err := s.findWorker(name)
+	if err != nil {
+		return "", "", err
+	}
+	if instanceID != "" && (w.Type == "php" || w.Type == "wasm") {
+		return "", "", fmt.Errorf("%s workers are drained as a whole", w.Type)
+	}
+
+	w.mu.Lock()
+	var instances []*WorkerInstance
+	if instanceID == "" {
+		if w.Draining {
+			state := w.drainState()
+			w.mu.Unlock()
+			return "", "", fmt.Errorf("worker %s is already %s", name, state)
+		}
+		w.Draining = true
+		instances, w.Instances = w.Instances, nil
+	} else {
+		i := slices.IndexFunc(w.Instances, func(inst *WorkerInstance) bool { return inst.ID == instanceID })
+		if i < 0 {
+			w.mu.Unlock()
+			return "", "", fmt.Errorf("%w %q of worker %s", errUnknownInstance, instanceID, name)
+		}
+		instances = []*WorkerInstance{w.Instances[i]}
+		w.Instances = slices.Delete(slices.Clone(w.Instances), i, i+1)
+	}
+	for _, inst := range instances {
+		inst.Draining = true
+	}
+	w.DrainingInstances = append(w.DrainingInstances, instances...)
+	w.mu.Unlock()
+
+	if instanceID == "" {
+		log.Printf("Draining worker %s: no new requests, %d instance(s) stop when idle", name, len(instances))
+		s.events.Record(EventWorkerDrained, name, "", "drain started, %d instance(s)", len(instances))
+	} else {
+		log.Printf("Draining instance %s of worker %s: no new requests, stops when idle", instanceID, name)
+	}
+	go s.finishDrain(w, instanceID == "", instances, timeout)
+	return "serving", "draining", nil
+}
+
+// finishDrain waits until the drained requests finished or the timeout
+// passed, then stops the drained instances, and the php-fpm pools for a
+// drain of a whole PHP worker
+func (s *Supervisor) finishDrain(w *Worker, whole bool, instances []*WorkerInstance, timeout time.Duration) {
+	start := time.Now()
+	for {
+		inFlight := drainInFlight(w, whole, instances)
+		if inFlight == 0 {
+			break
+		}
+		if time.Since(start) >= timeout {
+			log.Printf("Drain of %s: %d request(s) still in flight after %s, stopping anyway", w.Name, inFlight, timeout)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// A scale up that was running when the drain started adds an instance
+	// afterwards, unless the drain was cancelled it is stopped as well
+	w.mu.Lock()
+	stillDraining := whole && w.Draining
+	if stillDraining {
+		for _, inst := range w.Instances {
+			inst.Draining = true
+		}
+		instances = append(instances, w.Instances...)
+		w.Instances = nil
+	}
+	w.mu.Unlock()
+
+	for _, inst := range instances {
+		s.terminateInstance(inst)
+		s.events.Record(EventInstanceDrained, w.Name, inst.ID, "stopped after %s", time.Since(start).Round(time.Millisecond))
+	}
+	if stillDraining && w.Type == "php" {
+		s.stopPHPPools(w)
+	}
+
+	w.mu.Lock()
+	w.DrainingInstances = slices.DeleteFunc(w.DrainingInstances, func(inst *WorkerInstance) bool {
+		return slices.Contains(instances, inst)
+	})
+	w.mu.Unlock()
+
+	if whole {
+		log.Printf("Worker %s drained, %d instance(s) stopped", w.Name, len(instances))
+		s.events.Record(EventWorkerDrained, w.Name, "", "drained, %d instance(s) stopped", len(instances))
+	} else {
+		log.Printf("Instance %s of worker %s drained and stopped", instances[0].ID, w.Name)
+	}
+}
+
+// drainInFlight returns the requests a drain waits for: all requests of the
+// worker, or those on the drained instances
+func drainInFlight(w *Worker, whole bool, instances []*WorkerInstance) int64 {
+	if whole {
+		return atomic.LoadInt64(&w.Active)
+	}
+	var inFlight int64
+	for _, inst := range instances {
+		inFlight += atomic.LoadInt64(&inst.Active)
+	}
+	return inFlight
+}
+
+// CancelDrain routes requests to a drained worker again, the dispatcher
+// starts its instances, or its php-fpm pools are started. It returns the
+// state before and after.
+func (s *Supervisor) CancelDrain(name string) (string, string, error) {
+	w, err := s.findWorker(name)
+	if err != nil {
+		return "", "", err
+	}
+	w.mu.Lock()
+	before := w.drainState()
+	if !w.Draining {
+		w.mu.Unlock()
+		return "", "", fmt.Errorf("worker %s is not draining", name)
+	}
+	w.Draining = false
+	w.mu.Unlock()
+
+	log.Printf("Drain of worker %s cancelled, starting its instances", name)
+	s.events.Record(EventWorkerDrained, name, "", "drain cancelled")
+	if w.Type == "remote" {
+		s.syncRemoteInstances(w)
+	}
+	if workerMeta := s.getWorkerConfig(name); w.Type == "php" && workerMeta != nil {
+		go func() {
+			if err := s.startPHPWorker(w, workerMeta); err != nil {
+				log.Printf("Failed to start PHP worker %s: %v", name, err)
+			}
+		}()
+	}
+	return before, "serving", nil
+}
+
+// drainState returns "serving", or "draining" until the requests and
+// instances of a drained worker are gone and "drained" afterwards. The
+// caller holds w.mu.
+func (w *Worker) drainState() string {
+	switch {
+	case !w.Draining:
+		return "serving"
+	case len(w.DrainingInstances) > 0 || atomic.LoadInt64(&w.Active) > 0:
+		return "draining"
+	}
+	return "drained"
+}
+
+// scaling describes the scaling of a worker, for the audit log and ctl. The
+// caller holds w.mu.
+func (w *Worker) scaling() string {
+	if w.Pinned > 0 {
+		return fmt.Sprintf("pinned to %d until %s", w.Pinned, w.PinnedUntil.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("autoscaling %d-%d", w.MinWorkers, w.MaxWorkers)
+}
+
+// controlSocketPath returns the socket of the server config at configPath,
+// without resolving its secrets
+func controlSocketPath(configPath string) string {
+	var config struct {
+		Control struct {
+			Socket string `yaml:"socket"`
+		} `yaml:"control"`
+	}
+	if decodeRawConfig(configPath, &config) == nil && strings.TrimSpace(config.Control.Socket) != "" {
+		return config.Control.Socket
+	}
+	return "run/tqserver.sock"
+}
+
+// decodeRawConfig decodes the server config at configPath into out, without
+// defaults and secrets, for commands that talk to a running server
+func decodeRawConfig(configPath string, out interface{}) error {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	root, err := parseConfigNode(configPath, data)
+	if err != nil {
+		return err
+	}
+	return root.Decode(out)
+}
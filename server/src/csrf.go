@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+)
+
+// Names of the token when the csrf section does not set them
+const (
+	defaultCSRFCookie = "tqserver_csrf"
+	defaultCSRFHeader = "X-CSRF-Token"
+	defaultCSRFField  = "_csrf"
+)
+
+// csrfBodyScan is the start of a form body searched for the token field,
+// the field added to forms comes first
+const csrfBodyScan = 64 * 1024
+
+// csrfTokenLength is the length of a token, hex encoded
+const csrfTokenLength = 64
+
+var (
+	// csrfFormTag matches the opening tag of a form
+	csrfFormTag = regexp.MustCompile(`(?i)<form\b[^>]*>`)
+	// csrfPostMethod matches the method attribute of a form that posts
+	csrfPostMethod = regexp.MustCompile(`(?i)\smethod\s*=\s*["']?post\b`)
+)
+
+// protects tells whether the requests of a worker are checked
+func (c *CSRFConfig) protects(worker string) bool {
+	return c != nil && c.Enabled && (len(c.Workers) == 0 || slices.Contains(c.Workers, worker))
+}
+
+// checkCSRF returns the token of the client, a new one is set in the cookie
+// and every response has it in the header. Requests that change state have
+// to send it back in the header or the form field, it returns false for the
+// ones that do not and should be rejected.
+func checkCSRF(w http.ResponseWriter, r *http.Request, c *CSRFConfig, worker string) (string, bool) {
+	token := ""
+	if cookie, err := r.Cookie(c.Cookie); err == nil && validCSRFToken(cookie.Value) {
+		token = cookie.Value
+	}
+	issued := token == ""
+	if issued {
+		token = newCSRFToken()
+		http.SetCookie(w, &http.Cookie{
+			Name:     c.Cookie,
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	w.Header().Set(c.Header, token)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return token, true
+	}
+	for _, template := range c.ExemptPaths {
+		if matchPathTemplate(template, r.URL.Path) {
+			return token, true
+		}
+	}
+
+	reason := ""
+	sent := r.Header.Get(c.Header)
+	if sent == "" {
+		sent = csrfFormToken(r, c.Field)
+	}
+	switch {
+	case issued:
+		reason = "missing_cookie"
+	case sent == "":
+		reason = "missing_token"
+	case subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1:
+		reason = "invalid_token"
+	default:
+		return token, true
+	}
+	GetMetrics().RecordCSRFRejection(worker, reason)
+	log.Printf("CSRF: rejected %s %s from %s (worker %s): %s", r.Method, r.URL.Path, clientIP(r), worker, reason)
+	return token, false
+}
+
+// newCSRFToken returns a random token
+func newCSRFToken() string {
+	b := make([]byte, csrfTokenLength/2)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validCSRFToken tells whether a cookie value can be a token
+func validCSRFToken(value string) bool {
+	if len(value) != csrfTokenLength {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+// csrfFormToken returns the token field of a form body, searched in its
+// first csrfBodyScan bytes. The worker still gets all of the body.
+func csrfFormToken(r *http.Request, field string) string {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		values, _ := url.ParseQuery(string(peekBody(r, csrfBodyScan)))
+		return values.Get(field)
+	case "multipart/form-data":
+		if params["boundary"] == "" {
+			return ""
+		}
+		reader := multipart.NewReader(bytes.NewReader(peekBody(r, csrfBodyScan)), params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				return ""
+			}
+			if part.FormName() == field && part.FileName() == "" {
+				value, _ := io.ReadAll(io.LimitReader(part, csrfTokenLength+1))
+				return string(value)
+			}
+		}
+	}
+	return ""
+}
+
+// injectCSRFToken adds the token as a hidden field at the start of every
+// form of a page that posts
+func injectCSRFToken(body []byte, field, token string) []byte {
+	input := []byte(`<input type="hidden" name="` + html.EscapeString(field) + `" value="` + token + `">`)
+	return csrfFormTag.ReplaceAllFunc(body, func(tag []byte) []byte {
+		if !csrfPostMethod.Match(tag) {
+			return tag
+		}
+		return slices.Concat(tag, input)
+	})
+}
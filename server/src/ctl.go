@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// ctlUsage lists the commands of "tqserver ctl"
+const ctlUsage = `usage: tqserver ctl [-config path] [-socket path] <command>
+
+commands:
+  status [worker]         show the server and its workers, or the instances
+                          of a worker
+  restart <worker>        restart the instances of a worker one by one
+  scale <worker> <n>      run n instances of a worker for an hour (-for 30m),
+                          ignoring the autoscaler
+  scale <worker> auto     resume autoscaling
+  drain [-cancel]         fail the readiness check before a shutdown
+  drain <worker> [instance] [-timeout 30s]
+                          stop routing requests to a worker or instance and
+                          stop it once its requests finished
+  drain <worker> -cancel  route requests to a drained worker again
+  reload-config           reload the configuration, like SIGHUP
+  logs [worker] [-n lines] [-f]
+                          show the recent lines of the server log, or the
+                          output of a worker and its php-fpm, -f follows it`
+
+// ctlClient sends requests to the control socket of a running server
+type ctlClient struct {
+	http   *http.Client
+	socket string
+}
+
+// newCtlClient creates a client for the control socket at path
+func newCtlClient(socket string) *ctlClient {
+	return &ctlClient{
+		socket: socket,
+		http: &http.Client{
+			Timeout: 60 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// do sends a request and returns the response body, a status other than 2xx
+// is returned as an error with the body as message
+func (c *ctlClient) do(method, path string, body interface{}) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://tqserver"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(ctlUserHeader, os.Getenv("USER"))
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("server not reachable on %s: %w", c.socket, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// stream copies the text response of a GET request to out until the server
+// ends it, without a timeout
+func (c *ctlClient) stream(path string, out io.Writer) error {
+	req, err := http.NewRequest(http.MethodGet, "http://tqserver"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(ctlUserHeader, os.Getenv("USER"))
+	client := *c.http
+	client.Timeout = 0
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("server not reachable on %s: %w", c.socket, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s", strings.TrimSpace(string(data)))
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return fmt.Errorf("the server closed the connection: %w", err)
+	}
+	return nil
+}
+
+// result sends a control operation and returns its result message
+func (c *ctlClient) result(method, path string, body interface{}) (string, error) {
+	data, err := c.do(method, path, body)
+	if err != nil {
+		return "", err
+	}
+	var result controlResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return "", err
+	}
+	return result.Result, nil
+}
+
+// runCtl runs "tqserver ctl <command>" against a running server
+func runCtl(args []string) {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	configPath := flags.String("config", "config/server.yaml", "Path to config file")
+	socket := flags.String("socket", "", "Path to the control socket (defaults to control.socket of the config)")
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, ctlUsage) }
+	flags.Parse(args)
+	args = flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *socket == "" {
+		*socket = controlSocketPath(findConfigFile(*configPath))
+	}
+	client := newCtlClient(*socket)
+
+	var err error
+	switch args[0] {
+	case "status":
+		switch len(args) {
+		case 1:
+			err = ctlStatus(client)
+		case 2:
+			err = ctlWorkerStatus(client, args[1])
+		default:
+			ctlUsageError("usage: tqserver ctl status [worker]")
+		}
+	case "restart":
+		if len(args) != 2 {
+			ctlUsageError("usage: tqserver ctl restart <worker>")
+		}
+		err = ctlPrint(client.result(http.MethodPost, "/admin/api/workers/"+url.PathEscape(args[1])+"/restart", nil))
+	case "scale":
+		scaleFlags := flag.NewFlagSet("ctl scale", flag.ExitOnError)
+		duration := scaleFlags.Duration("for", time.Hour, "How long the instance count holds")
+		positional := parseInterspersed(scaleFlags, args[1:])
+		if len(positional) != 2 {
+			ctlUsageError("usage: tqserver ctl scale <worker> <n> [-for duration] | tqserver ctl scale <worker> auto")
+		}
+		path := "/admin/api/workers/" + url.PathEscape(positional[0]) + "/scale"
+		if positional[1] == "auto" {
+			err = ctlPrint(client.result(http.MethodDelete, path, nil))
+			break
+		}
+		instances, convErr := strconv.Atoi(positional[1])
+		if convErr != nil || instances < 1 {
+			ctlUsageError("tqserver ctl scale: n must be 1 or more")
+		}
+		err = ctlPrint(client.result(http.MethodPost, path, map[string]interface{}{"instances": instances, "duration": duration.String()}))
+	case "drain":
+		drainFlags := flag.NewFlagSet("ctl drain", flag.ExitOnError)
+		cancel := drainFlags.Bool("cancel", false, "End the drain")
+		timeout := drainFlags.Duration("timeout", drainTimeout, "Time to wait for the requests in flight of a worker")
+		positional := parseInterspersed(drainFlags, args[1:])
+		if len(positional) > 2 || *cancel && len(positional) > 1 {
+			ctlUsageError("usage: tqserver ctl drain [-cancel] | tqserver ctl drain <worker> [instance] [-timeout duration] | tqserver ctl drain <worker> -cancel")
+		}
+		switch {
+		case len(positional) == 0:
+			err = ctlPrint(client.result(http.MethodPost, "/admin/api/drain", map[string]bool{"draining": !*cancel}))
+		case *cancel:
+			err = ctlPrint(client.result(http.MethodDelete, "/admin/api/workers/"+url.PathEscape(positional[0])+"/drain", nil))
+		default:
+			instance := ""
+			if len(positional) == 2 {
+				instance = positional[1]
+			}
+			err = ctlDrainWorker(client, positional[0], instance, *timeout)
+		}
+	case "reload-config":
+		err = ctlPrint(client.result(http.MethodPost, "/admin/api/reload", nil))
+	case "logs":
+		logsFlags := flag.NewFlagSet("ctl logs", flag.ExitOnError)
+		lines := logsFlags.Int("n", 100, "Number of lines")
+		follow := logsFlags.Bool("f", false, "Follow the log until interrupted")
+		positional := parseInterspersed(logsFlags, args[1:])
+		if len(positional) > 1 {
+			ctlUsageError("usage: tqserver ctl logs [worker] [-n lines] [-f]")
+		}
+		query := url.Values{"lines": {strconv.Itoa(*lines)}}
+		if len(positional) == 1 {
+			query.Set("worker", positional[0])
+		}
+		if *follow {
+			query.Set("follow", "true")
+		}
+		err = client.stream("/admin/api/logs?"+query.Encode(), os.Stdout)
+	default:
+		ctlUsageError(fmt.Sprintf("tqserver ctl: unknown command %q\n\n%s", args[0], ctlUsage))
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tqserver ctl %s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+// parseInterspersed parses flags that come before, between or after the
+// positional arguments, which it returns
+func parseInterspersed(flags *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		flags.Parse(args)
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// ctlUsageError prints a usage message and exits
+func ctlUsageError(message string) {
+	fmt.Fprintln(os.Stderr, message)
+	os.Exit(2)
+}
+
+// ctlPrint prints the result of a control operation
+func ctlPrint(result string, err error) error {
+	if err == nil {
+		fmt.Println(result)
+	}
+	return err
+}
+
+// ctlStatus prints the server status and a table of the workers
+func ctlStatus(client *ctlClient) error {
+	data, err := client.do(http.MethodGet, "/admin/api/status", nil)
+	if err != nil {
+		return err
+	}
+	var status serverStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return err
+	}
+	if data, err = client.do(http.MethodGet, "/admin/api/workers", nil); err != nil {
+		return err
+	}
+	var workers []workerStatus
+	if err := json.Unmarshal(data, &workers); err != nil {
+		return err
+	}
+
+	fmt.Printf("Mode: %s, up %s, %d/%d worker(s) healthy, %d instance(s)\n\n",
+		status.Mode, (time.Duration(status.UptimeSeconds) * time.Second).String(),
+		status.Healthy, status.Workers, status.Instances)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPATH\tTYPE\tSTATE\tINSTANCES\tSCALE\tREQUESTS")
+	for _, w := range workers {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%d\n",
+			w.Name, w.Path, w.Type, w.state(), len(w.Instances), w.scale(), w.Requests)
+	}
+	return tw.Flush()
+}
+
+// ctlWorker returns the status of a worker
+func ctlWorker(client *ctlClient, name string) (workerStatus, error) {
+	var status workerStatus
+	data, err := client.do(http.MethodGet, "/admin/api/workers/"+url.PathEscape(name), nil)
+	if err == nil {
+		err = json.Unmarshal(data, &status)
+	}
+	return status, err
+}
+
+// ctlWorkerStatus prints a worker and a table of its instances
+func ctlWorkerStatus(client *ctlClient, name string) error {
+	status, err := ctlWorker(client, name)
+	if err != nil {
+		return err
+	}
+	details := ""
+	if status.Tests != nil {
+		details = ", tests " + status.Tests.Status
+	}
+	if status.NextRecycle != nil {
+		details += ", next recycle " + status.NextRecycle.Local().Format("Mon 15:04")
+	}
+	if q := status.Queue; q.WaitP99Ms != nil {
+		details += fmt.Sprintf(", queue wait p50 %dms p99 %dms", *q.WaitP50Ms, *q.WaitP99Ms)
+	}
+	fmt.Printf("%s (%s) on %s: %s, scale %s, %d request(s) in flight%s\n\n",
+		status.Name, status.Type, status.Path, status.state(), status.scale(), status.InFlight, details)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tPID\tPORT\tHEALTHY\tUPTIME\tIN FLIGHT\tREQUESTS")
+	for _, inst := range status.Instances {
+		id := inst.ID
+		if inst.Draining {
+			id += " (draining)"
+		}
+		port := strconv.Itoa(inst.Port)
+		if inst.Host != "" {
+			port = net.JoinHostPort(inst.Host, port)
+		}
+		if inst.DebugPort != 0 {
+			port += fmt.Sprintf(" (dlv %d)", inst.DebugPort)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%t\t%s\t%d\t%d\n", id, inst.PID, port, inst.Healthy,
+			(time.Duration(inst.UptimeSeconds) * time.Second).String(), inst.InFlight, inst.Requests)
+	}
+	return tw.Flush()
+}
+
+// ctlDrainWorker drains a worker or one of its instances and prints the
+// progress until the drained instances stopped
+func ctlDrainWorker(client *ctlClient, name, instance string, timeout time.Duration) error {
+	body := map[string]string{"timeout": timeout.String()}
+	if instance != "" {
+		body["instance"] = instance
+	}
+	if err := ctlPrint(client.result(http.MethodPost, "/admin/api/workers/"+url.PathEscape(name)+"/drain", body)); err != nil {
+		return err
+	}
+
+	// Instances are stopped at the latest after the timeout
+	deadline := time.Now().Add(timeout + 30*time.Second)
+	last := ""
+	for time.Now().Before(deadline) {
+		status, err := ctlWorker(client, name)
+		if err != nil {
+			return err
+		}
+		inFlight, stopping := status.InFlight, 0
+		if instance != "" {
+			inFlight = 0
+		}
+		for _, inst := range status.Instances {
+			if inst.Draining && (instance == "" || inst.ID == instance) {
+				stopping++
+				if instance != "" {
+					inFlight += inst.InFlight
+				}
+			}
+		}
+		switch {
+		case instance != "" && stopping == 0:
+			fmt.Printf("instance %s drained and stopped\n", instance)
+			return nil
+		case instance == "" && status.Drain == "drained":
+			fmt.Printf("%s drained, \"tqserver ctl drain %s -cancel\" starts it again\n", name, name)
+			return nil
+		case instance == "" && status.Drain == "":
+			return fmt.Errorf("the drain of %s was cancelled", name)
+		}
+		progress := fmt.Sprintf("waiting for %d request(s) in flight, %d instance(s) to stop", inFlight, stopping)
+		if progress != last {
+			fmt.Println(progress)
+			last = progress
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("%s did not finish draining, see \"tqserver ctl status %s\"", name, name)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// daemonOutput receives the console output of a daemon, configure
+// logging.server to send the server log elsewhere
+const daemonOutput = "logs/tqserver_daemon.log"
+
+// daemonStartTimeout limits the wait for a daemon to build its workers and
+// write its pid file
+const daemonStartTimeout = 2 * time.Minute
+
+// daemonize starts the server again in the background, without -daemon and
+// detached from the terminal, and returns once it wrote its pid file
+func daemonize(config *Config, projectRoot string) error {
+	pidFile := resolvePidFile(config.Server.PidFile, projectRoot)
+	if pidFile == "" {
+		return fmt.Errorf("server.pid_file is required to run in the background")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var args []string
+	for _, arg := range os.Args[1:] {
+		switch strings.TrimLeft(arg, "-") {
+		case "daemon", "daemon=true":
+			continue
+		}
+		args = append(args, arg)
+	}
+
+	outputPath := filepath.Join(projectRoot, daemonOutput)
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return err
+	}
+	output, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	cmd := exec.Command(executable, args...)
+	cmd.Dir = projectRoot
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	deadline := time.After(daemonStartTimeout)
+	for {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("server exited during startup (%v), see %s", err, outputPath)
+		case <-deadline:
+			return fmt.Errorf("server did not start within %s, see %s", daemonStartTimeout, outputPath)
+		case <-time.After(100 * time.Millisecond):
+			if pid, err := readPidFile(pidFile); err == nil && pid == cmd.Process.Pid {
+				fmt.Printf("TQServer started in the background (pid %d), output in %s\n", pid, outputPath)
+				return nil
+			}
+		}
+	}
+}
+
+// resolvePidFile returns the absolute path of the pid file, empty when
+// disabled
+func resolvePidFile(path, projectRoot string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(projectRoot, path)
+}
+
+// writePidFile writes the process ID of the server. It fails when the file
+// belongs to another running server.
+func writePidFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	if pid, err := readPidFile(path); err == nil && pid != os.Getpid() && processRunning(pid) {
+		return fmt.Errorf("%s belongs to running server %d", path, pid)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePidFile removes the pid file, when it is still that of this process
+func removePidFile(path string) {
+	if pid, err := readPidFile(path); err == nil && pid == os.Getpid() {
+		os.Remove(path)
+	}
+}
+
+// readPidFile returns the process ID in a pid file
+func readPidFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid < 1 {
+		return 0, fmt.Errorf("%s has no process ID", path)
+	}
+	return pid, nil
+}
+
+// processRunning reports whether a process exists
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// runningServer returns the process ID of the server of the config at
+// configPath, from its pid file
+func runningServer(configPath string) (int, error) {
+	var config struct {
+		Server struct {
+			PidFile *string `yaml:"pid_file"`
+		} `yaml:"server"`
+	}
+	path := "run/tqserver.pid"
+	if decodeRawConfig(configPath, &config) == nil && config.Server.PidFile != nil {
+		path = *config.Server.PidFile
+	}
+	if path == "" {
+		return 0, fmt.Errorf("server.pid_file is disabled in %s", configPath)
+	}
+	pid, err := readPidFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("no server running, %s does not exist", path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !processRunning(pid) {
+		return 0, fmt.Errorf("no server running, process %d of %s has exited", pid, path)
+	}
+	return pid, nil
+}
+
+// runSignal runs "tqserver stop" and "tqserver reload", which signal the
+// server of the pid file
+func runSignal(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	configPath := flags.String("config", "config/server.yaml", "Path to config file")
+	timeout := flags.Duration("timeout", 30*time.Second, "Time to wait for the server to stop")
+	flags.Parse(args)
+
+	pid, err := runningServer(findConfigFile(*configPath))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tqserver %s: %v\n", command, err)
+		os.Exit(1)
+	}
+
+	if command == "reload" {
+		if err := syscall.Kill(pid, syscall.SIGHUP); err != nil {
+			fmt.Fprintf(os.Stderr, "tqserver reload: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Reload signalled to server %d, see its log for the result\n", pid)
+		return
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		fmt.Fprintf(os.Stderr, "tqserver stop: %v\n", err)
+		os.Exit(1)
+	}
+	deadline := time.Now().Add(*timeout)
+	for processRunning(pid) {
+		if time.Now().After(deadline) {
+			fmt.Fprintf(os.Stderr, "tqserver stop: server %d still running after %s\n", pid, *timeout)
+			os.Exit(1)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fmt.Printf("Server %d stopped\n", pid)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// requestHistory is the number of requests kept for the dashboard
+const requestHistory = 100
+
+// RecentRequest is a request handled by the proxy
+type RecentRequest struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Worker     string    `json:"worker,omitempty"`
+	Status     int       `json:"status"`
+	DurationMs float64   `json:"duration_ms"`
+	Bytes      int64     `json:"bytes"`
+}
+
+// RequestLog keeps the recent requests of the proxy
+type RequestLog struct {
+	mu       sync.Mutex
+	requests []RecentRequest
+}
+
+// Record adds a request, dropping the oldest one when full
+func (l *RequestLog) Record(req RecentRequest) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.requests) == requestHistory {
+		l.requests = l.requests[1:]
+	}
+	l.requests = append(l.requests, req)
+}
+
+// Recent returns up to limit of the newest requests, oldest first
+func (l *RequestLog) Recent(limit int) []RecentRequest {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := append([]RecentRequest{}, l.requests...)
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
+
+// registerDashboard serves the dashboard on the public port. It is always
+// served in development mode, in production mode only when enabled and
+// behind basic auth, together with the admin API it shows.
+func (p *Proxy) registerDashboard(mux *http.ServeMux) error {
+	cfg := p.config.Dashboard
+	if p.config.IsDevelopmentMode() {
+		mux.Handle("GET /admin/dashboard", p.dashboardAuth(http.HandlerFunc(p.handleDashboard)))
+		log.Printf("Dashboard enabled at http://localhost:%d/admin/dashboard", p.config.Server.Port)
+		return nil
+	}
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	if cfg.Username == "" || cfg.Password == "" {
+		return fmt.Errorf("dashboard: username and password are required in production mode")
+	}
+
+	api := http.NewServeMux()
+	p.registerAdminAPI(api)
+	mux.Handle("/admin/api/", p.dashboardAuth(api))
+	mux.Handle("GET /admin/dashboard", p.dashboardAuth(http.HandlerFunc(p.handleDashboard)))
+	log.Printf("Dashboard enabled at http://localhost:%d/admin/dashboard", p.config.Server.Port)
+	return nil
+}
+
+// dashboardAuth requires the configured credentials, when there are any
+func (p *Proxy) dashboardAuth(next http.Handler) http.Handler {
+	cfg := p.config.Dashboard
+	if cfg == nil || cfg.Username == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(cfg.Username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(password), []byte(cfg.Password)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="TQServer dashboard"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleDashboard renders the dashboard from the snapshots of the admin API,
+// the page refreshes itself
+func (p *Proxy) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	templatePath := filepath.Join(p.projectRoot, "server", "views", "dashboard.html")
+	output, err := p.tmpl.RenderFile(templatePath, p.dashboardData())
+	if err != nil {
+		log.Printf("Failed to render dashboard template: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(len(output)))
+	w.Write([]byte(output))
+}
+
+// dashboardData collects the template data, newest entries first
+func (p *Proxy) dashboardData() map[string]interface{} {
+	now := time.Now()
+	workers := []interface{}{}
+	instances := []interface{}{}
+	healthy := 0
+	for _, worker := range p.sortedWorkers() {
+		ws := p.workerStatus(worker)
+		status := ws.state()
+		if status == "healthy" {
+			healthy++
+		}
+		tests, testOutput := "-", ""
+		if ws.Tests != nil {
+			tests = ws.Tests.Status
+			if ws.Tests.Finished != nil {
+				tests += " " + formatAge(now.Sub(*ws.Tests.Finished)) + " ago"
+			}
+			testOutput = ws.Tests.Output
+		}
+		workers = append(workers, map[string]interface{}{
+			"Name":        ws.Name,
+			"Path":        ws.Path,
+			"Type":        ws.Type,
+			"Status":      status,
+			"Healthy":     status == "healthy",
+			"QueueDepth":  ws.QueueDepth,
+			"Requests":    ws.Requests,
+			"Instances":   len(ws.Instances),
+			"Scale":       ws.scale(),
+			"BuildError":  ws.Build.Error,
+			"Tests":       tests,
+			"TestsFailed": ws.Tests != nil && ws.Tests.Status == "failed",
+			"TestOutput":  testOutput,
+		})
+		for _, inst := range ws.Instances {
+			lastRequest := "never"
+			if !inst.LastRequest.IsZero() {
+				lastRequest = formatAge(now.Sub(inst.LastRequest)) + " ago"
+			}
+			pid := "-"
+			if inst.PID != 0 {
+				pid = strconv.Itoa(inst.PID)
+			}
+			port := strconv.Itoa(inst.Port)
+			if inst.Host != "" {
+				port = net.JoinHostPort(inst.Host, port)
+			}
+			if inst.DebugPort != 0 {
+				port += fmt.Sprintf(" (dlv %d)", inst.DebugPort)
+			}
+			instances = append(instances, map[string]interface{}{
+				"Worker":      ws.Name,
+				"ID":          inst.ID,
+				"PID":         pid,
+				"Port":        port,
+				"Uptime":      formatAge(now.Sub(inst.Started)),
+				"Healthy":     inst.Healthy,
+				"Requests":    inst.Requests,
+				"LastRequest": lastRequest,
+			})
+		}
+	}
+
+	events := []interface{}{}
+	if p.events != nil {
+		recent := p.events.Recent("", 0, 50)
+		for i := len(recent) - 1; i >= 0; i-- {
+			event := recent[i]
+			events = append(events, map[string]interface{}{
+				"Time":    event.Time.Format("15:04:05"),
+				"Type":    event.Type,
+				"Worker":  event.Worker,
+				"Message": event.Message,
+				"Problem": isProblemEvent(event.Type),
+			})
+		}
+	}
+
+	requests := []interface{}{}
+	recentRequests := p.requests.Recent(50)
+	for i := len(recentRequests) - 1; i >= 0; i-- {
+		req := recentRequests[i]
+		requests = append(requests, map[string]interface{}{
+			"Time":     req.Time.Format("15:04:05"),
+			"Method":   req.Method,
+			"Path":     req.Path,
+			"Worker":   req.Worker,
+			"Status":   req.Status,
+			"Duration": fmt.Sprintf("%.1f ms", req.DurationMs),
+			"Error":    req.Status >= 500,
+		})
+	}
+
+	egress := []interface{}{}
+	recentEgress := p.traffic.Recent()
+	for i := len(recentEgress) - 1; i >= 0 && len(egress) < 50; i-- {
+		entry := recentEgress[i]
+		status := strconv.Itoa(entry.StatusCode)
+		if entry.Error != "" {
+			status = "error"
+		} else if entry.StatusCode == 0 {
+			status = "-"
+		}
+		method := entry.Method
+		if method == "" {
+			method = "CONNECT"
+		}
+		egress = append(egress, map[string]interface{}{
+			"Time":     entry.Timestamp.Format("15:04:05"),
+			"Worker":   entry.WorkerName,
+			"Method":   method,
+			"Host":     fmt.Sprintf("%s:%d", entry.DestHost, entry.DestPort),
+			"Path":     entry.Path,
+			"Status":   status,
+			"Duration": fmt.Sprintf("%d ms", entry.DurationMs),
+			"Error":    entry.Error != "" || entry.StatusCode >= 500,
+		})
+	}
+
+	return map[string]interface{}{
+		"DevMode":   p.config.IsDevelopmentMode(),
+		"Mode":      p.config.Mode,
+		"Uptime":    formatAge(now.Sub(p.started)),
+		"GoVersion": runtime.Version(),
+		"Healthy":   healthy,
+		"Workers":   workers,
+		"Instances": instances,
+		"Events":    events,
+		"Requests":  requests,
+		"Socks5":    p.config.Socks5.Enabled,
+		"Egress":    egress,
+	}
+}
+
+// isProblemEvent reports whether an event type is highlighted
+func isProblemEvent(eventType string) bool {
+	switch eventType {
+	case EventInstanceFailed, EventInstanceExited, EventInstanceUnhealthy, EventBuildFailed, EventTestsFailed,
+		EventWorkerRestarted, EventCrashLoop, EventHealthFlapping, EventWorkerRolledBack, EventDeployFailed,
+		EventClusterNodeDown:
+		return true
+	}
+	return false
+}
+
+// formatAge formats a duration in whole seconds
+func formatAge(d time.Duration) string {
+	if d < time.Second {
+		return "0s"
+	}
+	return d.Truncate(time.Second).String()
+}
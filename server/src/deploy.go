@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// deployBodyLimit is the size of the webhook payloads read, the limit of
+// GitHub
+const deployBodyLimit = 25 << 20
+
+// deployGitTimeout bounds the git commands of a deploy
+const deployGitTimeout = 2 * time.Minute
+
+// deployState serializes the deploys, a push during a deploy is pulled
+// right after it
+type deployState struct {
+	mu      sync.Mutex
+	running bool
+	pending bool
+	active  atomic.Bool // Source changes do not reload workers while set
+}
+
+// registerDeploy serves the deploy endpoint on the public port, for the git
+// host to reach it
+func (p *Proxy) registerDeploy(mux *http.ServeMux) {
+	cfg := p.config.Deploy
+	if !cfg.Enabled {
+		return
+	}
+	mux.HandleFunc("POST "+cfg.Path, p.audited(AuditDeploy, p.handleDeploy))
+	log.Printf("Deploy endpoint enabled at http://localhost:%d%s for %s/%s", p.config.Server.Port, cfg.Path, cfg.Remote, cfg.Branch)
+}
+
+// handleDeploy starts a deploy on an authenticated push to the configured
+// branch, it answers before the deploy runs, git hosts wait only seconds
+func (p *Proxy) handleDeploy(w http.ResponseWriter, r *http.Request) {
+	cfg := p.config.Deploy
+	target := cfg.Remote + "/" + cfg.Branch
+	setAuditDetails(r, target, "", "")
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, deployBodyLimit))
+	if err != nil {
+		http.Error(w, "failed to read the payload", http.StatusBadRequest)
+		return
+	}
+	if err := verifyDeployRequest(r, body, cfg.Secret); err != nil {
+		log.Printf("Deploy request from %s refused: %v", clientIP(r), err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	if event == "" {
+		event = r.Header.Get("X-Gitea-Event")
+	}
+	if event == "ping" {
+		writeJSON(w, controlResult{Result: "pong"})
+		return
+	}
+	var payload struct {
+		Ref string `json:"ref"`
+	}
+	if len(body) > 0 && json.Unmarshal(body, &payload) != nil {
+		http.Error(w, "the payload is not JSON", http.StatusBadRequest)
+		return
+	}
+	// Without a ref, like from a script, the branch is deployed
+	if payload.Ref != "" && payload.Ref != "refs/heads/"+cfg.Branch {
+		writeJSON(w, controlResult{Result: fmt.Sprintf("ignored, %s is not %s", payload.Ref, cfg.Branch)})
+		return
+	}
+
+	if p.supervisor == nil {
+		controlError(w, errControlUnavailable)
+		return
+	}
+	reload := func() error {
+		if p.reload == nil {
+			return errControlUnavailable
+		}
+		return p.reload("deploy:" + target)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if p.supervisor.RequestDeploy(cfg, reload) {
+		writeJSON(w, controlResult{Result: "deploy of " + target + " queued after the running one"})
+		return
+	}
+	writeJSON(w, controlResult{Result: "deploying " + target})
+}
+
+// verifyDeployRequest checks the secret of a webhook: the HMAC-SHA256 of the
+// body in X-Hub-Signature-256 (GitHub, Gitea) or the X-Gitlab-Token
+func verifyDeployRequest(r *http.Request, body []byte, secret string) error {
+	if signature := r.Header.Get("X-Hub-Signature-256"); signature != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if !hmac.Equal([]byte(signature), []byte("sha256="+hex.EncodeToString(mac.Sum(nil)))) {
+			return errors.New("X-Hub-Signature-256 does not match the secret")
+		}
+		return nil
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return errors.New("X-Gitlab-Token does not match the secret")
+		}
+		return nil
+	}
+	return errors.New("no X-Hub-Signature-256 or X-Gitlab-Token header")
+}
+
+// RequestDeploy starts a deploy in the background, or queues one when a
+// deploy runs, and reports whether it was queued
+func (s *Supervisor) RequestDeploy(cfg DeployConfig, reloadConfig func() error) bool {
+	s.deploys.mu.Lock()
+	defer s.deploys.mu.Unlock()
+	if s.deploys.running {
+		s.deploys.pending = true
+		return true
+	}
+	s.deploys.running = true
+	go func() {
+		for {
+			s.deploy(cfg, reloadConfig)
+			s.deploys.mu.Lock()
+			if !s.deploys.pending {
+				s.deploys.running = false
+				s.deploys.mu.Unlock()
+				return
+			}
+			s.deploys.pending = false
+			s.deploys.mu.Unlock()
+		}
+	}()
+	return false
+}
+
+// deploy fast-forwards the project to the branch of the remote, rebuilds the
+// workers with changed files and restarts them with a rolling restart. A
+// worker that fails to build keeps running its previous version. Changes
+// outside the workers directory reload the configuration, like SIGHUP.
+func (s *Supervisor) deploy(cfg DeployConfig, reloadConfig func() error) {
+	s.deploys.active.Store(true)
+	defer s.deploys.active.Store(false)
+
+	start := time.Now()
+	target := cfg.Remote + "/" + cfg.Branch
+	fail := func(err error) {
+		log.Printf("Deploy of %s failed: %v", target, err)
+		s.events.Record(EventDeployFailed, "", "", "%s: %v", target, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deployGitTimeout)
+	defer cancel()
+	git := func(args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = s.projectRoot
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	before, err := git("rev-parse", "HEAD")
+	if err != nil {
+		fail(err)
+		return
+	}
+	if _, err := git("fetch", "--quiet", cfg.Remote, cfg.Branch); err != nil {
+		fail(err)
+		return
+	}
+	after, err := git("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		fail(err)
+		return
+	}
+	if after == before {
+		log.Printf("Deploy of %s: already at %s", target, shortCommit(after))
+		return
+	}
+	// Relative to the project root, files outside it are left out
+	diff, err := git("diff", "--name-only", "--relative", before, after)
+	if err != nil {
+		fail(err)
+		return
+	}
+	// Local commits or changes to tracked files stop the deploy
+	if _, err := git("merge", "--ff-only", "--quiet", after); err != nil {
+		fail(err)
+		return
+	}
+	log.Printf("Deploy of %s: updated %s..%s", target, shortCommit(before), shortCommit(after))
+
+	var changed []string
+	reload := false
+	workersDir := filepath.Join(s.projectRoot, s.config.Workers.Directory)
+	for _, file := range strings.Split(diff, "\n") {
+		if file == "" {
+			continue
+		}
+		rel, err := filepath.Rel(workersDir, filepath.Join(s.projectRoot, filepath.FromSlash(file)))
+		if err != nil || strings.HasPrefix(rel, "..") {
+			reload = true
+			continue
+		}
+		name, path, _ := strings.Cut(filepath.ToSlash(rel), "/")
+		// Configs and public files apply without a rebuild, see handleFileEvent
+		if strings.HasPrefix(path, "config/") || strings.HasPrefix(path, "public/") {
+			continue
+		}
+		if !slices.Contains(changed, name) {
+			changed = append(changed, name)
+		}
+	}
+	if reload {
+		if err := reloadConfig(); err != nil {
+			log.Printf("Deploy of %s: configuration not reloaded: %v", target, err)
+		}
+	}
+
+	// New and removed worker directories are picked up by the file watcher
+	var rolledOut, failed []string
+	for _, w := range s.router.GetAllWorkers() {
+		if !slices.Contains(changed, w.Name) || w.IsDraining() {
+			continue
+		}
+		log.Printf("Deploy of %s: rebuilding worker %s", target, w.Name)
+		if w.Type != "wasm" {
+			// WASM workers are built by their restart
+			err := s.buildWorker(w)
+			s.setBuildResult(w, err)
+			if err != nil {
+				log.Printf("Build failed for worker %s, it keeps running its previous version: %v", w.Name, err)
+				failed = append(failed, w.Name)
+				continue
+			}
+		}
+		s.events.Record(EventWorkerReloaded, w.Name, "", "deploy of %s", shortCommit(after))
+		GetMetrics().RecordWorkerRestart(w.Name)
+		s.startProbation(w)
+		s.rollingRestart(w)
+		rolledOut = append(rolledOut, w.Name)
+	}
+
+	names := "none"
+	if len(rolledOut) > 0 {
+		names = strings.Join(rolledOut, ", ")
+	}
+	summary := fmt.Sprintf("%s %s..%s in %s, rolled out: %s", target, shortCommit(before), shortCommit(after), time.Since(start).Round(time.Millisecond), names)
+	if len(failed) > 0 {
+		summary += ", failed to build: " + strings.Join(failed, ", ")
+		log.Printf("Deployed %s", summary)
+		s.events.Record(EventDeployFailed, "", "", "%s", summary)
+		return
+	}
+	log.Printf("✅ Deployed %s", summary)
+	s.events.Record(EventDeployed, "", "", "%s", summary)
+}
+
+// shortCommit abbreviates a commit hash
+func shortCommit(hash string) string {
+	if len(hash) > 7 {
+		return hash[:7]
+	}
+	return hash
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// workersRoot returns the directory holding the worker directories
+func (s *Supervisor) workersRoot() string {
+	return filepath.Join(s.projectRoot, s.config.Workers.Directory)
+}
+
+// watchWorkersRoot watches the workers directory for worker directories that
+// are created or removed while the server runs. Directories without a config
+// are watched too, for when it is added.
+func (s *Supervisor) watchWorkersRoot() error {
+	root := s.workersRoot()
+	if err := s.watcher.Add(root); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && !unwatchedDir(entry.Name()) && s.getWorkerConfig(entry.Name()) == nil {
+			if err := s.watchDirectory(filepath.Join(root, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unknownWorkerDir returns the name of the worker directory holding a path
+// when it is not a configured worker, empty otherwise
+func (s *Supervisor) unknownWorkerDir(path string) string {
+	rel, err := filepath.Rel(s.workersRoot(), path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	name, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	if unwatchedDir(name) || s.getWorkerConfig(name) != nil {
+		return ""
+	}
+	return name
+}
+
+// scheduleWorkerDiscovery debounces the registration of a new worker
+// directory, its files are usually created in quick succession
+func (s *Supervisor) scheduleWorkerDiscovery(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := name + "/discover"
+	if t, ok := s.reloadTimers[key]; ok {
+		t.Stop()
+	}
+	s.reloadTimers[key] = time.AfterFunc(500*time.Millisecond, func() {
+		s.discoverWorker(name)
+	})
+}
+
+// discoverWorker registers and starts a worker directory created while the
+// server runs, once it has a valid config
+func (s *Supervisor) discoverWorker(name string) {
+	dir := s.workerDir(name)
+	if _, err := os.Stat(dir); err != nil {
+		return
+	}
+	// Subdirectories created since the directory itself
+	if err := s.watchDirectory(dir); err != nil {
+		log.Printf("Failed to watch worker %s: %v", name, err)
+	}
+	if _, err := os.Stat(findConfigFile(filepath.Join(dir, "config", "worker.yaml"))); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	config := s.config
+	known := findWorkerConfig(s.workerConfigs, name) != nil
+	s.mu.Unlock()
+	if known {
+		return
+	}
+
+	workerMeta, err := loadWorkerDir(s.workersRoot(), name, config.SecretStore())
+	if err != nil {
+		log.Printf("Failed to load new worker %s: %v", name, err)
+		return
+	}
+	if workerMeta == nil {
+		return
+	}
+
+	// Only the problems of the new worker's file, a path taken by another
+	// worker is one of them
+	s.mu.Lock()
+	workerConfigs := append(append([]*WorkerConfigWithMeta(nil), s.workerConfigs...), workerMeta)
+	s.mu.Unlock()
+	problems := 0
+	for _, problem := range ValidateConfig(config, "", workerConfigs) {
+		if problem.File == workerMeta.ConfigPath {
+			log.Printf("Config problem: %s", problem)
+			problems++
+		}
+	}
+	if problems > 0 {
+		log.Printf("Not starting new worker %s, %d problem(s) found", name, problems)
+		return
+	}
+
+	s.mu.Lock()
+	if findWorkerConfig(s.workerConfigs, name) != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.workerConfigs = append(s.workerConfigs, workerMeta)
+	s.mu.Unlock()
+
+	if !workerMeta.Config.IsEnabled(config.Mode) {
+		log.Printf("New worker %s is disabled, skipping", name)
+		return
+	}
+	log.Printf("New worker %s found at %s, starting...", name, workerMeta.Config.Path)
+	s.events.Record(EventWorkerAdded, name, "", "directory created, serving %s", workerMeta.Config.Path)
+	worker := newWorker(workerMeta)
+	s.router.RegisterWorker(worker)
+	go s.startWorker(worker, workerMeta)
+}
+
+// handleRemovedPath stops and unregisters a worker whose directory was
+// removed or renamed away
+func (s *Supervisor) handleRemovedPath(path string) {
+	if filepath.Dir(path) != s.workersRoot() {
+		return
+	}
+	name := filepath.Base(path)
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	known := findWorkerConfig(s.workerConfigs, name) != nil
+	workerConfigs := make([]*WorkerConfigWithMeta, 0, len(s.workerConfigs))
+	for _, wc := range s.workerConfigs {
+		if wc.Name != name {
+			workerConfigs = append(workerConfigs, wc)
+		}
+	}
+	s.workerConfigs = workerConfigs
+	s.mu.Unlock()
+	if !known {
+		return
+	}
+
+	log.Printf("Worker directory %s removed, stopping worker %s", path, name)
+	s.events.Record(EventWorkerRemoved, name, "", "directory removed")
+	for _, w := range s.router.GetAllWorkers() {
+		if w.Name == name {
+			s.removeWorker(w)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/version"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// minGoVersion is the Go version the server and the Go workers need
+const minGoVersion = "go1.24"
+
+// minWatchHeadroom is the number of inotify watches left for editors and
+// other tools, on top of the directories watched by the server
+const minWatchHeadroom = 8192
+
+// doctorCheck is the outcome of one check of "tqserver doctor"
+type doctorCheck struct {
+	Name   string
+	Status string // "ok", "warn", "fail" or "skip"
+	Detail string
+	Notes  []string // Lines below the detail, like the config problems
+	Fix    string   // What to do about a warning or a failure
+}
+
+// runDoctor runs "tqserver doctor": it checks the toolchains the configured
+// workers need, the ports, the file watcher limits and the configuration,
+// and prints how to fix what is missing. It exits with status 1 when a
+// check fails, warnings do not fail.
+func runDoctor(args []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := flags.String("config", "config/server.yaml", "Path to config file")
+	mode := flags.String("mode", "", "Server mode to check for: dev or prod")
+	flags.Parse(args)
+
+	configFile := findConfigFile(*configPath)
+	config, workerConfigs, problems, err := validateProject(configFile, *mode)
+
+	var checks []doctorCheck
+	switch {
+	case err != nil:
+		checks = append(checks, doctorCheck{Name: "config", Status: "fail", Detail: problems[0].String(),
+			Fix: "fix the config file, the other checks assume no workers until it loads"})
+		workerConfigs = nil
+	case len(problems) > 0:
+		check := doctorCheck{Name: "config", Status: "fail", Detail: fmt.Sprintf("%d problem(s) found", len(problems)),
+			Fix: "correct the settings above, tqserver validate checks them again"}
+		for _, problem := range problems {
+			check.Notes = append(check.Notes, problem.String())
+		}
+		checks = append(checks, check)
+	default:
+		checks = append(checks, doctorCheck{Name: "config", Status: "ok",
+			Detail: fmt.Sprintf("%s is valid, %d worker(s), %s mode", configFile, len(workerConfigs), config.Mode)})
+	}
+
+	// The workers of each type decide which toolchains are required
+	users := map[string][]string{}
+	var phpBinaries, runtimes []string
+	needTinygo := false
+	for _, workerMeta := range workerConfigs {
+		cfg := workerMeta.Config
+		if !cfg.IsEnabled(config.Mode) {
+			continue
+		}
+		users[cfg.Type] = append(users[cfg.Type], workerMeta.Name)
+		switch cfg.Type {
+		case "go":
+			if cfg.Go != nil && cfg.Go.Debug != nil && cfg.Go.Debug.Enabled && config.IsDevelopmentMode() {
+				users["dlv"] = append(users["dlv"], workerMeta.Name)
+			}
+		case "php":
+			binary := ""
+			if cfg.PHP != nil {
+				binary = cfg.PHP.Binary
+			}
+			if !slices.Contains(phpBinaries, binary) {
+				phpBinaries = append(phpBinaries, binary)
+			}
+		case "container":
+			preferred := ""
+			if cfg.Container != nil {
+				preferred = cfg.Container.Runtime
+			}
+			if !slices.Contains(runtimes, preferred) {
+				runtimes = append(runtimes, preferred)
+			}
+		case "wasm":
+			if cfg.Wasm == nil || cfg.Wasm.Build == "" {
+				needTinygo = true
+				users["tinygo"] = append(users["tinygo"], workerMeta.Name)
+			}
+		}
+	}
+
+	// Prebuilt workers run from the package, without toolchains
+	prebuilt := config != nil && config.UsesPrebuiltWorkers()
+	if prebuilt {
+		delete(users, "go")
+		delete(users, "wasm")
+		delete(users, "tinygo")
+		needTinygo = false
+	}
+	checks = append(checks, checkGo(append(users["go"], users["wasm"]...)))
+	checks = append(checks, checkTool("bun", users["bun"], findBunBinary,
+		"install Bun with: curl -fsSL https://bun.sh/install | bash", "--version"))
+	checks = append(checks, checkTool("node", nil, func() (string, error) { return exec.LookPath("node") },
+		"", "--version"))
+	if len(phpBinaries) == 0 {
+		phpBinaries = []string{""}
+	}
+	for _, binary := range phpBinaries {
+		checks = append(checks, checkPHP(binary, users["php"]))
+	}
+	if len(runtimes) == 0 {
+		runtimes = []string{""}
+	}
+	for _, preferred := range runtimes {
+		checks = append(checks, checkTool("container", users["container"], func() (string, error) { return findContainerRuntime(preferred) },
+			"install docker or podman, or set container.runtime in the worker config", "--version"))
+	}
+	if len(users["dlv"]) > 0 {
+		checks = append(checks, checkTool("dlv", users["dlv"], findDelveBinary,
+			"install Delve with: go install github.com/go-delve/delve/cmd/dlv@latest, or disable go.debug", "version"))
+	}
+	if needTinygo {
+		checks = append(checks, checkTool("tinygo", users["tinygo"], func() (string, error) { return exec.LookPath("tinygo") },
+			"install TinyGo from https://tinygo.org/getting-started/install/ or set wasm.build in the worker config", "version"))
+	}
+
+	if config != nil {
+		checks = append(checks, checkServerPort(config, configFile))
+		checks = append(checks, checkPortRange(config, workerConfigs))
+		checks = append(checks, checkWatchLimits(config, workerConfigs))
+	}
+	if prebuilt {
+		checks = append(checks, checkPackage(config, workerConfigs))
+	}
+
+	failed := 0
+	for _, check := range checks {
+		status := check.Status
+		if status == "fail" {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Printf("%-5s %-10s %s\n", status, check.Name, check.Detail)
+		for _, note := range check.Notes {
+			fmt.Printf("%-5s %-10s %s\n", "", "", note)
+		}
+		if check.Fix != "" && (check.Status == "warn" || check.Status == "fail") {
+			fmt.Printf("%-5s %-10s fix: %s\n", "", "", check.Fix)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("\n%d check(s) failed\n", failed)
+		os.Exit(1)
+	}
+	fmt.Println("\nNo problems found")
+}
+
+// toolVersion runs a tool with the arguments that print its version and
+// returns the first line of the output
+func toolVersion(path string, args ...string) string {
+	out, err := exec.Command(path, args...).CombinedOutput()
+	if err != nil {
+		return "version unknown"
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return strings.TrimSpace(line)
+}
+
+// checkTool checks a toolchain found by find, it fails when workers need it
+func checkTool(name string, workers []string, find func() (string, error), fix string, versionArgs ...string) doctorCheck {
+	path, err := find()
+	if err != nil {
+		if len(workers) == 0 {
+			return doctorCheck{Name: name, Status: "skip", Detail: "not found, no worker needs it"}
+		}
+		return doctorCheck{Name: name, Status: "fail", Detail: fmt.Sprintf("not found, needed by %s", strings.Join(workers, ", ")), Fix: fix}
+	}
+	return doctorCheck{Name: name, Status: "ok", Detail: fmt.Sprintf("%s (%s)", toolVersion(path, versionArgs...), path)}
+}
+
+// checkGo checks that go is installed and recent enough to build the server
+// and the Go and wasm workers
+func checkGo(workers []string) doctorCheck {
+	check := checkTool("go", workers, func() (string, error) { return exec.LookPath("go") },
+		"install Go from https://go.dev/dl/", "version")
+	if check.Status != "ok" {
+		return check
+	}
+	// "go version go1.24.1 linux/amd64"
+	fields := strings.Fields(check.Detail)
+	if len(fields) >= 3 && version.IsValid(fields[2]) && version.Compare(fields[2], minGoVersion) < 0 {
+		check.Status = "warn"
+		check.Fix = fmt.Sprintf("upgrade to %s or later from https://go.dev/dl/", minGoVersion)
+		if len(workers) > 0 {
+			check.Status = "fail"
+		}
+	}
+	return check
+}
+
+// checkPHP checks the php-fpm binary the PHP workers would run, php-cgi and
+// php are found as a fallback but cannot run pools
+func checkPHP(preferred string, workers []string) doctorCheck {
+	name := "php-fpm"
+	fix := "install php-fpm (apt install php-fpm, brew install php) or set php.binary in the worker config"
+	if preferred != "" {
+		name = "php-fpm (" + preferred + ")"
+		fix = "install php-fpm or correct php.binary in the worker config"
+	}
+	path, err := findPHPBinary(preferred)
+	check := checkTool(name, workers, func() (string, error) { return path, err }, fix, "-v")
+	if err == nil && !strings.HasPrefix(filepath.Base(path), "php-fpm") {
+		check.Status = "warn"
+		check.Detail += ", not php-fpm"
+		check.Fix = fix
+		if len(workers) > 0 {
+			check.Status = "fail"
+		}
+	}
+	return check
+}
+
+// checkServerPort checks that the server port is free, or in use by the
+// server of this config
+func checkServerPort(config *Config, configFile string) doctorCheck {
+	check := doctorCheck{Name: "port", Detail: fmt.Sprintf("%d is free", config.Server.Port)}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.Server.Port))
+	if err == nil {
+		listener.Close()
+		check.Status = "ok"
+		return check
+	}
+	if pid, err := runningServer(configFile); err == nil {
+		check.Status = "ok"
+		check.Detail = fmt.Sprintf("%d is in use by the running server (pid %d)", config.Server.Port, pid)
+		return check
+	}
+	check.Status = "fail"
+	check.Detail = fmt.Sprintf("%d is in use: %v", config.Server.Port, err)
+	check.Fix = fmt.Sprintf("stop the process listening on it (lsof -i :%d) or change server.port", config.Server.Port)
+	return check
+}
+
+// checkPackage checks the artifacts of the enabled workers against the
+// manifest of the package when workers are prebuilt
+func checkPackage(config *Config, workerConfigs []*WorkerConfigWithMeta) doctorCheck {
+	check := doctorCheck{Name: "package", Status: "ok"}
+	projectRoot, err := os.Getwd()
+	if err != nil {
+		check.Status, check.Detail = "fail", err.Error()
+		return check
+	}
+	manifest, err := readPackageManifest(projectRoot, config.Workers.VerifyKey)
+	if err != nil {
+		check.Status, check.Detail = "fail", err.Error()
+		check.Fix = "unpack a package made by tqserver package for this platform, or disable workers.prebuilt"
+		if config.Workers.VerifyKey != "" {
+			check.Fix = "unpack a package signed with the key of workers.verify_key, made by tqserver package -sign"
+		}
+		return check
+	}
+	for _, workerMeta := range workerConfigs {
+		if !workerMeta.Config.IsEnabled(config.Mode) {
+			continue
+		}
+		workerRoot := filepath.Join(projectRoot, config.Workers.Directory, workerMeta.Name)
+		if err := checkPrebuiltWorker(projectRoot, workerRoot, config.Workers.VerifyKey, workerMeta); err != nil {
+			check.Notes = append(check.Notes, err.Error())
+		}
+	}
+	check.Detail = fmt.Sprintf("%s for %s/%s, %d worker(s)", manifest.Version, manifest.OS, manifest.Arch, len(manifest.Workers))
+	if config.Workers.VerifyKey != "" {
+		check.Detail += ", signature verified"
+	}
+	if len(check.Notes) > 0 {
+		check.Status = "fail"
+		check.Fix = "deploy the complete package, with the dependencies of Bun and PHP workers installed"
+	}
+	return check
+}
+
+// checkPortRange checks that the worker port range has a free port for every
+// instance the enabled workers may scale to
+func checkPortRange(config *Config, workerConfigs []*WorkerConfigWithMeta) doctorCheck {
+	start, end := config.Workers.PortRangeStart, config.Workers.PortRangeEnd
+	check := doctorCheck{Name: "ports", Status: "ok"}
+	if start < 1 || end > 65535 || start > end {
+		check.Status = "skip"
+		check.Detail = fmt.Sprintf("%d-%d is not a valid range", start, end)
+		return check
+	}
+	needed := 0
+	for _, workerMeta := range workerConfigs {
+		if workerMeta.Config.IsEnabled(config.Mode) {
+			needed += newWorker(workerMeta).MaxWorkers
+		}
+	}
+	free := 0
+	for port := start; port <= end; port++ {
+		if listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port)); err == nil {
+			listener.Close()
+			free++
+		}
+	}
+	check.Detail = fmt.Sprintf("%d-%d has %d free port(s), the workers scale to %d instance(s)", start, end, free, needed)
+	if free < needed {
+		check.Status = "fail"
+		check.Fix = "widen workers.port_range_start and workers.port_range_end, or free ports in the range"
+	}
+	return check
+}
+
+// checkWatchLimits checks that inotify allows a watch for every directory of
+// the workers, with room for editors. Other systems have no such limit.
+func checkWatchLimits(config *Config, workerConfigs []*WorkerConfigWithMeta) doctorCheck {
+	check := doctorCheck{Name: "watcher"}
+	if runtime.GOOS != "linux" {
+		check.Status = "skip"
+		check.Detail = "no inotify limits on " + runtime.GOOS
+		return check
+	}
+	data, err := os.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	if err != nil {
+		check.Status = "skip"
+		check.Detail = fmt.Sprintf("cannot read the inotify limit: %v", err)
+		return check
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		check.Status = "skip"
+		check.Detail = "cannot parse the inotify limit"
+		return check
+	}
+
+	dirs := 0
+	for _, workerMeta := range workerConfigs {
+		filepath.WalkDir(filepath.Join(config.Workers.Directory, workerMeta.Name), func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || !entry.IsDir() {
+				return nil
+			}
+			if unwatchedDir(entry.Name()) {
+				return filepath.SkipDir
+			}
+			dirs++
+			return nil
+		})
+	}
+	check.Status = "ok"
+	check.Detail = fmt.Sprintf("max_user_watches is %d, the workers have %d directories", limit, dirs)
+	if limit < dirs+minWatchHeadroom {
+		check.Status = "warn"
+		check.Fix = "raise the limit: sudo sysctl fs.inotify.max_user_watches=524288, and add it to /etc/sysctl.d/ to keep it"
+		if limit < dirs {
+			check.Status = "fail"
+		}
+	}
+	return check
+}
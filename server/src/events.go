@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// eventHistory is the number of events kept for the admin API
+const eventHistory = 500
+
+// Worker lifecycle event types
+const (
+	EventInstanceStarted   = "instance_started"
+	EventInstanceFailed    = "instance_failed" // Did not pass its startup health check
+	EventInstanceExited    = "instance_exited"
+	EventInstanceUnhealthy = "instance_unhealthy"
+	EventScaleUp           = "scale_up"
+	EventScaleDown         = "scale_down"
+	EventBuildFailed       = "build_failed"
+	EventBuildSucceeded    = "build_succeeded"
+	EventTestsPassed       = "tests_passed" // After a rebuild in dev mode, see test.on_change
+	EventTestsFailed       = "tests_failed"
+	EventWorkerReloaded    = "worker_reloaded"
+	EventWorkerRestarted   = "worker_restarted" // After failing its health checks
+	EventWorkerDrained     = "worker_drained"   // Drain started, finished or cancelled
+	EventInstanceDrained   = "instance_drained" // Stopped by a drain once idle
+	EventConfigReloaded    = "config_reloaded"
+	EventWorkerAdded       = "worker_added"       // Directory created while running
+	EventWorkerRemoved     = "worker_removed"     // Directory removed while running
+	EventCrashLoop         = "crash_loop"         // Instances keep exiting shortly after starting
+	EventHealthFlapping    = "health_flapping"    // Instances keep failing their health checks
+	EventWorkerRolledBack  = "worker_rolled_back" // Last-known-good binary restored after a failed deploy
+	EventDeployed          = "deployed"           // A pushed commit was pulled and rolled out
+	EventDeployFailed      = "deploy_failed"
+	EventClusterNodeUp     = "cluster_node_up" // A peer answered, its workers are routed to
+	EventClusterNodeDown   = "cluster_node_down"
+	EventInstanceAdded     = "instance_added" // Remote instance from the config or an agent
+	EventInstanceRemoved   = "instance_removed"
+)
+
+// Crash loop and flapping detection: an alert is raised when a worker has
+// this many crashes or health check failures within the window, at most
+// once per window
+const (
+	crashLoopCount     = 3
+	crashLoopWindow    = 5 * time.Minute
+	crashLoopMinUptime = 30 * time.Second // Exits of older instances are not crashes
+	flappingCount      = 3
+	flappingWindow     = 10 * time.Minute
+)
+
+// Event is a change in the state of a worker or the server
+type Event struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Worker   string    `json:"worker,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// EventLog keeps the recent lifecycle events, the machine-readable
+// counterpart to the log lines of the supervisor
+type EventLog struct {
+	mu          sync.Mutex
+	events      []Event
+	nextID      int64
+	subscribers []func(Event)
+	detector    *eventDetector
+}
+
+// NewEventLog creates an empty event log
+func NewEventLog() *EventLog {
+	return &EventLog{nextID: 1, detector: newEventDetector()}
+}
+
+// Subscribe calls fn with every event recorded from now on, fn must not
+// block
+func (l *EventLog) Subscribe(fn func(Event)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscribers = append(l.subscribers, fn)
+}
+
+// Record adds an event, the message is formatted like fmt.Sprintf
+func (l *EventLog) Record(eventType, worker, instance, format string, args ...interface{}) Event {
+	l.mu.Lock()
+	event := Event{
+		ID:       l.nextID,
+		Time:     time.Now(),
+		Type:     eventType,
+		Worker:   worker,
+		Instance: instance,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	l.nextID++
+	if len(l.events) == eventHistory {
+		l.events = l.events[1:]
+	}
+	l.events = append(l.events, event)
+	subscribers := l.subscribers
+	derived := l.detector.observe(event)
+	l.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(event)
+	}
+	for _, d := range derived {
+		l.Record(d.Type, d.Worker, "", "%s", d.Message)
+	}
+	return event
+}
+
+// Recent returns up to limit events after the event with ID since, oldest
+// first, optionally of a single worker
+func (l *EventLog) Recent(worker string, since int64, limit int) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := []Event{}
+	for _, event := range l.events {
+		if event.ID <= since || (worker != "" && event.Worker != worker) {
+			continue
+		}
+		result = append(result, event)
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
+
+// eventDetector derives crash loop and health flapping events from the
+// lifecycle events of the workers
+type eventDetector struct {
+	started  map[string]time.Time   // Start time by instance ID
+	stopping map[string]bool        // Instances terminated on purpose
+	crashes  map[string][]time.Time // Recent crashes by worker
+	failures map[string][]time.Time // Recent health check failures by worker
+	alerted  map[string]time.Time   // Last alert by event type and worker
+}
+
+func newEventDetector() *eventDetector {
+	return &eventDetector{
+		started:  make(map[string]time.Time),
+		stopping: make(map[string]bool),
+		crashes:  make(map[string][]time.Time),
+		failures: make(map[string][]time.Time),
+		alerted:  make(map[string]time.Time),
+	}
+}
+
+// observe tracks an event and returns the events it gives rise to, callers
+// hold the lock of the event log
+func (d *eventDetector) observe(event Event) []Event {
+	switch event.Type {
+	case EventBuildSucceeded:
+		// A new build gets alerts of its own
+		delete(d.crashes, event.Worker)
+		delete(d.failures, event.Worker)
+		delete(d.alerted, EventCrashLoop+"/"+event.Worker)
+		delete(d.alerted, EventHealthFlapping+"/"+event.Worker)
+	case EventInstanceStarted:
+		d.started[event.Instance] = event.Time
+	case EventScaleDown:
+		d.stopping[event.Instance] = true
+	case EventInstanceFailed, EventInstanceExited:
+		started, known := d.started[event.Instance]
+		stopping := d.stopping[event.Instance]
+		delete(d.started, event.Instance)
+		delete(d.stopping, event.Instance)
+		if stopping || (known && event.Time.Sub(started) >= crashLoopMinUptime) {
+			return nil
+		}
+		if event.Type == EventInstanceExited && !known {
+			return nil
+		}
+		count := d.count(d.crashes, event.Worker, event.Time, crashLoopWindow)
+		if count >= crashLoopCount && d.alert(EventCrashLoop, event.Worker, event.Time, crashLoopWindow) {
+			return []Event{{Type: EventCrashLoop, Worker: event.Worker, Message: fmt.Sprintf(
+				"%d instances crashed within %s, last: %s", count, crashLoopWindow, event.Message)}}
+		}
+	case EventInstanceUnhealthy, EventWorkerRestarted:
+		count := d.count(d.failures, event.Worker, event.Time, flappingWindow)
+		if count >= flappingCount && d.alert(EventHealthFlapping, event.Worker, event.Time, flappingWindow) {
+			return []Event{{Type: EventHealthFlapping, Worker: event.Worker, Message: fmt.Sprintf(
+				"%d health check failures within %s, last: %s", count, flappingWindow, event.Message)}}
+		}
+	}
+	return nil
+}
+
+// count adds an occurrence for a worker and returns the number within the
+// window
+func (d *eventDetector) count(times map[string][]time.Time, worker string, now time.Time, window time.Duration) int {
+	recent := []time.Time{}
+	for _, t := range times[worker] {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	times[worker] = append(recent, now)
+	return len(times[worker])
+}
+
+// alert reports whether an alert may be raised, at most once per window
+func (d *eventDetector) alert(eventType, worker string, now time.Time, window time.Duration) bool {
+	key := eventType + "/" + worker
+	if last, ok := d.alerted[key]; ok && now.Sub(last) < window {
+		return false
+	}
+	d.alerted[key] = now
+	return true
+}
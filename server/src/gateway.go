@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mevdschee/tqserver/pkg/fastcgi"
+	"github.com/mevdschee/tqserver/pkg/scgi"
+	"github.com/mevdschee/tqserver/pkg/uwsgi"
+)
+
+// Protocols of remote instances next to HTTP, see remote.protocol
+const (
+	protocolSCGI  = "scgi"
+	protocolUWSGI = "uwsgi"
+)
+
+// gatewayDialTimeout limits the connect to an SCGI or uwsgi instance
+const gatewayDialTimeout = 5 * time.Second
+
+// gatewayClient sends a request with CGI params to an SCGI or uwsgi
+// instance and returns its raw response
+type gatewayClient interface {
+	DoRequest(params map[string]string, stdin []byte) ([]byte, error)
+}
+
+// newGatewayClient returns the client of the protocol of an instance, nil
+// for HTTP
+func newGatewayClient(inst *WorkerInstance, timeout time.Duration) gatewayClient {
+	switch inst.Protocol {
+	case protocolSCGI:
+		return scgi.NewClient(inst.Addr(), "tcp", gatewayDialTimeout, timeout)
+	case protocolUWSGI:
+		return uwsgi.NewClient(inst.Addr(), "tcp", gatewayDialTimeout, timeout)
+	}
+	return nil
+}
+
+// gatewayParams returns the CGI params of a request to a worker, with the
+// route prefix in SCRIPT_NAME and the rest of the path in PATH_INFO
+func (p *Proxy) gatewayParams(r *http.Request, header http.Header, worker *Worker, contentLength int) map[string]string {
+	pathInfo := strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(worker.Path, "/"))
+	if pathInfo == "" {
+		pathInfo = "/"
+	}
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "TQServer",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       r.Host,
+		"SERVER_PORT":       fmt.Sprintf("%d", p.config.Server.Port),
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"SCRIPT_NAME":       strings.TrimSuffix(worker.Path, "/"),
+		"PATH_INFO":         pathInfo,
+		"QUERY_STRING":      r.URL.RawQuery,
+		"REMOTE_ADDR":       clientIP(r),
+		"CONTENT_TYPE":      header.Get("Content-Type"),
+		"CONTENT_LENGTH":    fmt.Sprintf("%d", contentLength),
+	}
+	for key, values := range header {
+		headerName := "HTTP_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		params[headerName] = strings.Join(values, ", ")
+	}
+	return params
+}
+
+// parseGatewayResponse parses the response of an SCGI or uwsgi instance,
+// either an HTTP response with a status line or a CGI response
+func parseGatewayResponse(data []byte) (int, http.Header, io.Reader, error) {
+	if bytes.HasPrefix(data, []byte("HTTP/")) {
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		return resp.StatusCode, resp.Header, resp.Body, nil
+	}
+	status, headers, body, err := fastcgi.ParseCGIResponse(data)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return status, headers, bytes.NewReader(body), nil
+}
+
+// handleGatewayRequest sends a request to a remote instance over SCGI or
+// uwsgi, the body is read first as both protocols send its length up front
+func (p *Proxy) handleGatewayRequest(w http.ResponseWriter, r *http.Request, worker *Worker, instance *WorkerInstance) {
+	settings, _ := p.current()
+	var body []byte
+	if r.Body != nil {
+		reader := io.Reader(r.Body)
+		if maxBodySize := settings.Server.MaxBodySize; maxBodySize > 0 {
+			reader = http.MaxBytesReader(w, r.Body, maxBodySize)
+		}
+		var err error
+		if body, err = io.ReadAll(reader); err != nil {
+			p.serveBodyReadError(w, r, worker, err)
+			return
+		}
+	}
+
+	header := r.Header.Clone()
+	setProxyToken(header, instance.ProxyToken)
+	upstreamSpan := p.startUpstreamSpan(r, header, worker)
+	upstreamSpan.SetAttribute("tqserver.instance", instance.ID)
+	defer upstreamSpan.End()
+
+	client := newGatewayClient(instance, settings.GetWriteTimeout())
+	response, err := client.DoRequest(p.gatewayParams(r, header, worker, len(body)), body)
+	var status int
+	var headers http.Header
+	var respBody io.Reader
+	if err == nil {
+		status, headers, respBody, err = parseGatewayResponse(response)
+	}
+	endUpstreamSpan(upstreamSpan, status, err)
+	if err != nil {
+		p.serveErrorPage(w, r, http.StatusBadGateway, "Bad Gateway", "Request to worker failed", map[string]interface{}{
+			"Error":      err.Error(),
+			"WorkerName": worker.Name,
+			"InstanceID": instance.ID,
+			"Address":    instance.Protocol + "://" + instance.Addr(),
+		})
+		log.Printf("%s request to %s failed: %v", instance.Protocol, instance.Addr(), err)
+		return
+	}
+
+	log.Printf("%s %s -> worker %s (%s %s)", r.Method, r.URL.Path, instance.ID, instance.Protocol, instance.Addr())
+	writeResponse(w, status, headers, respBody)
+	worker.IncrementRequestCount()
+}
+
+// checkGatewayHealth requests /health of an SCGI or uwsgi instance
+func checkGatewayHealth(inst *WorkerInstance, timeout time.Duration) error {
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "TQServer",
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		"SERVER_NAME":       "localhost",
+		"REQUEST_METHOD":    http.MethodGet,
+		"REQUEST_URI":       "/health",
+		"SCRIPT_NAME":       "",
+		"PATH_INFO":         "/health",
+		"QUERY_STRING":      "",
+		"CONTENT_LENGTH":    "0",
+	}
+	response, err := newGatewayClient(inst, timeout).DoRequest(params, nil)
+	if err != nil {
+		return err
+	}
+	status, _, _, err := parseGatewayResponse(response)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("%d %s", status, http.StatusText(status))
+	}
+	return nil
+}
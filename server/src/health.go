@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// startupRetryAfter is the Retry-After, in seconds, of the requests refused
+// until the workers are ready
+const startupRetryAfter = "5"
+
+// readiness is the response of the readiness endpoint
+type readiness struct {
+	Status  string            `json:"status"` // "ready" or "not ready"
+	Reason  string            `json:"reason,omitempty"`
+	Workers map[string]string `json:"workers"` // "healthy", "unhealthy" or "missing" by name
+}
+
+// registerHealth adds the liveness and readiness endpoints of the server
+// itself, for load balancers and orchestrators
+func (p *Proxy) registerHealth(mux *http.ServeMux) {
+	if path := p.config.Health.LivenessPath; path != "" {
+		mux.HandleFunc("GET "+path, p.handleHealthz)
+	}
+	if path := p.config.Health.ReadinessPath; path != "" {
+		mux.HandleFunc("GET "+path, p.handleReadyz)
+	}
+}
+
+// handleHealthz reports that the process is alive and serving
+func (p *Proxy) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the server can take traffic: the routes are
+// loaded and the required workers, by default all, are healthy
+func (p *Proxy) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	result := readiness{Status: "ready", Workers: map[string]string{}}
+	workers := p.router.GetAllWorkers()
+	required := p.config.Health.RequiredWorkers
+
+	if len(workers) == 0 {
+		result.Reason = "no workers loaded"
+	}
+	for _, worker := range workers {
+		if len(required) > 0 && !slices.Contains(required, worker.Name) {
+			continue
+		}
+		if workerHealthy(worker) {
+			result.Workers[worker.Name] = "healthy"
+		} else {
+			result.Workers[worker.Name] = "unhealthy"
+			result.Reason = "required workers are unhealthy"
+		}
+	}
+	for _, name := range required {
+		if _, ok := result.Workers[name]; !ok {
+			result.Workers[name] = "missing"
+			result.Reason = "required workers are missing"
+		}
+	}
+	if p.starting.Load() {
+		result.Reason = "starting"
+	}
+	if p.draining.Load() {
+		result.Reason = "draining"
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if result.Reason != "" {
+		result.Status = "not ready"
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, result)
+}
+
+// workerReady reports whether a worker has its min_workers healthy
+// instances, workers without instances of their own when they are healthy
+func workerReady(worker *Worker) bool {
+	switch worker.Type {
+	case "php", "wasm", "remote":
+		return workerHealthy(worker)
+	}
+	worker.mu.RLock()
+	defer worker.mu.RUnlock()
+	healthy := 0
+	for _, inst := range worker.Instances {
+		if inst.Healthy {
+			healthy++
+		}
+	}
+	return healthy >= worker.MinWorkers
+}
+
+// awaitWorkers blocks until every worker is ready, or until the startup
+// timeout passed, for health.startup_gate
+func (p *Proxy) awaitWorkers() {
+	start := time.Now()
+	timeout := time.Duration(p.config.Health.StartupTimeoutSeconds) * time.Second
+	for {
+		var waiting []string
+		for _, worker := range p.router.GetAllWorkers() {
+			if !workerReady(worker) {
+				waiting = append(waiting, worker.Name)
+			}
+		}
+		if len(waiting) == 0 {
+			log.Printf("Workers ready after %s, accepting requests", time.Since(start).Round(time.Millisecond))
+			return
+		}
+		if timeout > 0 && time.Since(start) >= timeout {
+			log.Printf("Workers not ready after %s: %s, accepting requests anyway", timeout, strings.Join(waiting, ", "))
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
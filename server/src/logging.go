@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqserver/pkg/logrotate"
+	"github.com/mevdschee/tqserver/pkg/logsink"
+)
+
+// logStream is the output of a log stream: a writer, or a syslog or journald
+// sink that keeps the priority of each line
+type logStream struct {
+	out    io.Writer    // Nil when there is a sink
+	sink   logsink.Sink // Nil for files and the console
+	closer io.Closer
+}
+
+// logStreamOptions are the defaults of a stream
+type logStreamOptions struct {
+	output   string            // When not configured
+	file     string            // Path for the "file" output, may contain {date}
+	rotation logrotate.Options // For the "file" output
+	tag      string            // Syslog app name and journald identifier
+	fields   map[string]string // Extra journald fields
+}
+
+// openLogStream opens the configured output of a stream, cfg may be nil for
+// the default output
+func openLogStream(logging *LoggingConfig, cfg *LogOutputConfig, projectRoot string, opts logStreamOptions) (*logStream, error) {
+	output, tag, facility := opts.output, opts.tag, ""
+	if cfg != nil {
+		if cfg.Output != "" {
+			output = cfg.Output
+		}
+		if cfg.File != "" {
+			opts.file = cfg.File
+		}
+		if cfg.Tag != "" {
+			tag = cfg.Tag
+		}
+		facility = cfg.Facility
+	}
+
+	switch output {
+	case "off":
+		return &logStream{out: io.Discard}, nil
+	case "stdout":
+		return &logStream{out: os.Stdout}, nil
+	case "stderr":
+		return &logStream{out: os.Stderr}, nil
+	case "file":
+		path := opts.file
+		if path == "" {
+			return nil, fmt.Errorf("no log file configured")
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(projectRoot, path)
+		}
+		w, err := logrotate.New(path, opts.rotation)
+		if err != nil {
+			return nil, err
+		}
+		return &logStream{out: w, closer: w}, nil
+	case "syslog":
+		code, err := logsink.ParseFacility(facility)
+		if err != nil {
+			return nil, err
+		}
+		sink, err := logsink.NewSyslog(logsink.SyslogOptions{
+			Network:  logging.Syslog.Network,
+			Address:  logging.Syslog.Address,
+			Facility: code,
+			AppName:  tag,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &logStream{sink: sink, closer: sink}, nil
+	case "journald":
+		sink, err := logsink.NewJournald(logsink.JournaldOptions{Identifier: tag, Fields: opts.fields})
+		if err != nil {
+			return nil, err
+		}
+		return &logStream{sink: sink, closer: sink}, nil
+	}
+	return nil, fmt.Errorf("unknown log output %q", output)
+}
+
+// Log writes a line, with its priority for sinks
+func (s *logStream) Log(priority logsink.Priority, line string) {
+	if s.sink != nil {
+		s.sink.Log(priority, line)
+		return
+	}
+	fmt.Fprintln(s.out, line)
+}
+
+// Writer returns a writer of lines, the priority of each is guessed for
+// sinks. Flush the result when it is a *logsink.Writer.
+func (s *logStream) Writer() io.Writer {
+	if s.sink != nil {
+		return logsink.NewWriter(s.sink, nil)
+	}
+	return s.out
+}
+
+// Close closes the file or sink
+func (s *logStream) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// setupServerLog sends the log of the server to its configured output, it
+// stays on stderr when unconfigured
+func setupServerLog(config *Config, projectRoot string) (*logStream, error) {
+	cfg := config.Logging.Server
+	if cfg == nil {
+		return nil, nil
+	}
+	stream, err := openLogStream(&config.Logging, cfg, projectRoot, logStreamOptions{
+		output: "stderr",
+		file:   config.Server.LogFile,
+		tag:    "tqserver",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("server log: %w", err)
+	}
+	if stream.sink != nil {
+		// Syslog and the journal add their own timestamps
+		log.SetFlags(0)
+	}
+	log.SetOutput(stream.Writer())
+	return stream, nil
+}
+
+// serverLogTail keeps the recent lines of the server log for "tqserver ctl logs"
+var serverLogTail = newLogTail(1000)
+
+// workerLogLines is the number of recent output lines kept per worker
+const workerLogLines = 1000
+
+// setServerLogOutput sends the server log to w and the tail, without
+// resolved secrets
+func setServerLogOutput(w io.Writer) {
+	log.SetOutput(redactingWriter{io.MultiWriter(w, serverLogTail)})
+}
+
+// logTail is a ring of the last lines written to it, new lines are also
+// sent to its subscribers
+type logTail struct {
+	mu          sync.Mutex
+	lines       []string
+	max         int
+	partial     []byte
+	subscribers map[chan string]struct{}
+}
+
+// newLogTail creates a tail of up to max lines
+func newLogTail(max int) *logTail {
+	return &logTail{max: max, subscribers: make(map[chan string]struct{})}
+}
+
+// Write adds the complete lines, a partial line is kept for the next write
+func (t *logTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial = t.addLines(t.partial, p, "")
+	return len(p), nil
+}
+
+// addLines adds the complete lines of a partial line followed by p, with a
+// prefix, and returns the new partial line. The caller holds t.mu.
+func (t *logTail) addLines(partial, p []byte, prefix string) []byte {
+	data := append(partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		t.add(prefix + strings.TrimRight(string(data[:i]), "\r"))
+		data = data[i+1:]
+	}
+	return append([]byte(nil), data...)
+}
+
+// add adds a line, a subscriber that does not keep up misses lines. The
+// caller holds t.mu.
+func (t *logTail) add(line string) {
+	if len(t.lines) == t.max {
+		t.lines = t.lines[1:]
+	}
+	t.lines = append(t.lines, line)
+	for ch := range t.subscribers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// AddLine adds a single line
+func (t *logTail) AddLine(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.add(line)
+}
+
+// Writer returns a writer that adds its lines with a prefix, each process
+// writes to its own so partial lines are not mixed
+func (t *logTail) Writer(prefix string) io.Writer {
+	return &prefixedTailWriter{tail: t, prefix: prefix}
+}
+
+// prefixedTailWriter adds the lines written to it to a tail
+type prefixedTailWriter struct {
+	tail    *logTail
+	prefix  string
+	partial []byte
+}
+
+func (w *prefixedTailWriter) Write(p []byte) (int, error) {
+	w.tail.mu.Lock()
+	defer w.tail.mu.Unlock()
+	w.partial = w.tail.addLines(w.partial, p, w.prefix)
+	return len(p), nil
+}
+
+// Subscribe returns up to n of the last lines, like Lines, and a channel
+// that receives the lines added afterwards until cancel is called
+func (t *logTail) Subscribe(n int) ([]string, <-chan string, func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := t.lines
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	ch := make(chan string, 256)
+	t.subscribers[ch] = struct{}{}
+	cancel := func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.subscribers, ch)
+	}
+	return append([]string(nil), lines...), ch, cancel
+}
+
+// Lines returns up to n of the last lines, all for n <= 0
+func (t *logTail) Lines(n int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := t.lines
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return append([]string(nil), lines...)
+}
+
+// reopenServerLog switches the server log to the output of a reloaded
+// config, the current output stays when the new one fails to open
+func reopenServerLog(current *logStream, config *Config, projectRoot string) (*logStream, error) {
+	out, flags := log.Writer(), log.Flags()
+	log.SetOutput(os.Stderr)
+	log.SetFlags(log.LstdFlags)
+	stream, err := setupServerLog(config, projectRoot)
+	if err != nil {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+		return current, err
+	}
+	setServerLogOutput(log.Writer())
+	if current != nil {
+		current.Close()
+	}
+	return stream, nil
+}
+
+// AccessLog writes a line per request in the combined log format, with the
+// duration and worker appended
+type AccessLog struct {
+	stream *logStream
+}
+
+// NewAccessLog opens the access log, it is nil when the stream is off
+func NewAccessLog(config *Config, projectRoot string) (*AccessLog, error) {
+	cfg := config.Logging.Access
+	if cfg == nil || cfg.Output == "" || cfg.Output == "off" {
+		return nil, nil
+	}
+	stream, err := openLogStream(&config.Logging, cfg, projectRoot, logStreamOptions{
+		file: "logs/access_{date}.log",
+		tag:  "tqserver-access",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("access log: %w", err)
+	}
+	return &AccessLog{stream: stream}, nil
+}
+
+// Log writes the line of a request, server errors are logged as errors and
+// client errors as warnings
+func (a *AccessLog) Log(r *http.Request, status int, written int64, duration time.Duration, worker string) {
+	if a == nil {
+		return
+	}
+	host := clientIP(r)
+	user := "-"
+	if username, _, ok := r.BasicAuth(); ok && username != "" {
+		user = username
+	}
+	if worker == "" {
+		worker = "-"
+	}
+	line := fmt.Sprintf("%s - %s [%s] %q %d %d %q %q %.3f %s",
+		host, user, time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.URL.RequestURI()+" "+r.Proto, status, written,
+		orDash(r.Referer()), orDash(r.UserAgent()), duration.Seconds(), worker)
+
+	priority := logsink.Info
+	switch {
+	case status >= 500:
+		priority = logsink.Err
+	case status >= 400:
+		priority = logsink.Warning
+	}
+	a.stream.Log(priority, line)
+}
+
+// Close closes the access log
+func (a *AccessLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	return a.stream.Close()
+}
+
+// orDash returns "-" for empty values, as in the combined log format
+func orDash(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "-"
+	}
+	return value
+}
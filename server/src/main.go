@@ -2,16 +2,62 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
 	"syscall"
 )
 
 func main() {
+	// "tqserver run" is the same as "tqserver", it reads better with -worker
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "stop" || os.Args[1] == "reload") {
+		runSignal(os.Args[1], os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		runValidate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfig(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "build" {
+		runBuild(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "package" {
+		runPackage(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		runDoctor(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "new" {
+		runNew(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		runCtl(os.Args[2:])
+		return
+	}
+	// Internal: started by the server for confined workers
+	if len(os.Args) > 1 && os.Args[1] == "confine" {
+		runConfine(os.Args[2:])
+		return
+	}
+
 	configPath := flag.String("config", "config/server.yaml", "Path to config file")
 	mode := flag.String("mode", "", "Server mode: dev or prod (defaults to TQSERVER_MODE env var or 'dev')")
+	only := flag.String("worker", "", "Run a single worker, the rest of the workers directory is skipped")
+	daemon := flag.Bool("daemon", false, "Run in the background, see tqserver stop and tqserver reload")
 	flag.Parse()
 
 	// Get project root (current working directory)
@@ -21,7 +67,7 @@ func main() {
 	}
 
 	// Load configuration
-	configFile := filepath.Join(projectRoot, *configPath)
+	configFile := findConfigFile(filepath.Join(projectRoot, *configPath))
 	config, err := LoadConfig(configFile)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
@@ -32,6 +78,30 @@ func main() {
 		config.Mode = *mode
 	}
 
+	// Detach, the started process continues below
+	if *daemon {
+		if err := daemonize(config, projectRoot); err != nil {
+			log.Fatalf("Failed to start in the background: %v", err)
+		}
+		return
+	}
+
+	// Send the server log to its configured output
+	serverLog, err := setupServerLog(config, projectRoot)
+	if err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	// Resolved secrets never reach the log, the recent lines are kept for ctl
+	setServerLogOutput(log.Writer())
+	accessLog, err := NewAccessLog(config, projectRoot)
+	if err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	audit, err := NewAuditLog(config, projectRoot)
+	if err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+
 	log.Printf("TQServer starting...")
 	log.Printf("Mode: %s", config.Mode)
 	log.Printf("Project root: %s", projectRoot)
@@ -41,17 +111,46 @@ func main() {
 	log.Printf("Worker port range: %d-%d", config.Workers.PortRangeStart, config.Workers.PortRangeEnd)
 
 	// Load worker configs
-	workerConfigs, err := LoadWorkerConfigs(config.Workers.Directory)
+	workerConfigs, err := loadRunWorkers(config, *only)
 	if err != nil {
 		log.Fatalf("Failed to load worker configs: %v", err)
 	}
+	if *only != "" {
+		log.Printf("Running only worker %s at %s", *only, workerConfigs[0].Config.Path)
+	}
 	log.Printf("Loaded %d worker(s)", len(workerConfigs))
+	if problems := ValidateConfig(config, configFile, workerConfigs); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Printf("Config problem: %s", problem)
+		}
+		log.Fatalf("Invalid configuration, %d problem(s) found", len(problems))
+	}
+	// Signals are handled once the server is ready, from the moment the pid
+	// file can be used to send them
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	pidFile := resolvePidFile(config.Server.PidFile, projectRoot)
+	if err := writePidFile(pidFile); err != nil {
+		log.Fatalf("Failed to write pid file: %v", err)
+	}
 
 	// Initialize router
 	router := NewRouter(config.Workers.Directory, projectRoot, workerConfigs)
 
 	// Initialize supervisor
 	supervisor := NewSupervisor(config, projectRoot, router, workerConfigs)
+	supervisor.SetAutoRegister(*only == "")
+
+	// Post lifecycle events to the configured webhooks, from the first build on
+	var webhooks *WebhookSender
+	if len(config.Webhooks) > 0 {
+		webhooks, err = NewWebhookSender(config.Webhooks, config.Mode)
+		if err != nil {
+			log.Fatalf("Failed to configure webhooks: %v", err)
+		}
+		supervisor.Events().Subscribe(webhooks.Send)
+		log.Printf("Sending lifecycle events to %d webhook(s)", len(config.Webhooks))
+	}
 
 	// Start supervisor (watches for changes and builds workers)
 	if err := supervisor.Start(); err != nil {
@@ -63,17 +162,120 @@ func main() {
 
 	// Connect supervisor with proxy for reload broadcasting
 	supervisor.SetProxy(proxy)
+	proxy.SetEvents(supervisor.Events())
+	proxy.SetAccessLog(accessLog)
+	proxy.SetAudit(audit)
+
+	// Share the workers with the other nodes and route to theirs
+	var cluster *Cluster
+	if config.Cluster.Enabled {
+		cluster, err = NewCluster(config.Cluster, router, supervisor.Events())
+		if err != nil {
+			log.Fatalf("Failed to configure cluster: %v", err)
+		}
+		proxy.SetCluster(cluster)
+		cluster.Start()
+	}
 
 	// Initialize SOCKS5 proxy if enabled
 	var socks5Server *Socks5Server
 	if config.Socks5.Enabled {
 		socks5Server = NewSocks5Server(&config.Socks5, projectRoot)
+		socks5Server.SetLogging(&config.Logging)
+		if config.IsDevelopmentMode() {
+			socks5Server.SetDevelopmentMode(true)
+			socks5Server.SetMocks(supervisor.Mocks())
+		}
+		if config.IsDevelopmentMode() || (config.Dashboard != nil && config.Dashboard.Enabled) {
+			socks5Server.SetTraffic(proxy.Traffic())
+		}
 		if err := socks5Server.Start(); err != nil {
 			log.Fatalf("Failed to start SOCKS5 proxy: %v", err)
 		}
 		log.Printf("SOCKS5 proxy enabled on port %d", config.Socks5.Port)
 	}
 
+	// Reload the configuration on SIGHUP or "tqserver ctl reload-config", one
+	// reload at a time
+	var reloadMu sync.Mutex
+	reloadLocked := func(actor string) error {
+		entry := AuditEntry{Action: AuditConfigReload, Actor: actor, Before: configSummary(config, workerConfigs)}
+
+		// Reload configuration
+		newConfig, err := LoadConfig(configFile)
+		if err != nil {
+			log.Printf("Failed to reload config: %v", err)
+			entry.Result = err.Error()
+			audit.Record(entry)
+			return err
+		}
+		// Override mode if specified via flag
+		if *mode != "" {
+			newConfig.Mode = *mode
+		}
+
+		// Reload worker configs
+		newWorkerConfigs, err := loadRunWorkers(newConfig, *only)
+		if err != nil {
+			log.Printf("Failed to reload worker configs: %v", err)
+			entry.Result = err.Error()
+			audit.Record(entry)
+			return err
+		}
+		if problems := ValidateConfig(newConfig, configFile, newWorkerConfigs); len(problems) > 0 {
+			for _, problem := range problems {
+				log.Printf("Config problem: %s", problem)
+			}
+			err := fmt.Errorf("%d problem(s) found, keeping the current configuration", len(problems))
+			log.Printf("Failed to reload config: %v", err)
+			entry.Result = fmt.Sprintf("invalid: %d problem(s)", len(problems))
+			audit.Record(entry)
+			return err
+		}
+		log.Printf("Reloaded %d worker(s)", len(newWorkerConfigs))
+
+		// Only what changed is applied, see Supervisor.Reload
+		supervisor.Reload(newConfig, newWorkerConfigs)
+		proxy.ApplyConfig(newConfig)
+		if serverLogChanged(config, newConfig) {
+			if serverLog, err = reopenServerLog(serverLog, newConfig, projectRoot); err != nil {
+				log.Printf("Failed to reopen the server log: %v", err)
+			}
+		}
+		if accessLogChanged(config, newConfig) {
+			if newAccessLog, err := NewAccessLog(newConfig, projectRoot); err != nil {
+				log.Printf("Failed to reopen the access log: %v", err)
+			} else {
+				proxy.SetAccessLog(newAccessLog)
+				accessLog.Close()
+				accessLog = newAccessLog
+			}
+		}
+		for _, setting := range restartSettings(config, newConfig) {
+			log.Printf("Setting %s changed, restart the server to apply it", setting)
+		}
+		entry.After = configSummary(newConfig, newWorkerConfigs)
+		audit.Record(entry)
+		if newConfig.Mode != config.Mode {
+			audit.Record(AuditEntry{Action: AuditModeSwitch, Actor: entry.Actor, Before: config.Mode, After: newConfig.Mode})
+		}
+		config, workerConfigs = newConfig, newWorkerConfigs
+		return nil
+	}
+	reload := func(actor string) error {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		return reloadLocked(actor)
+	}
+	proxy.SetControl(supervisor, reload)
+	// Config files pushed through the admin API are written and reloaded
+	// between the other reloads
+	proxy.SetConfigDeploy(func(actor string, d *configDeploy) (*configDeployResult, error) {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		return d.run(configFile, *mode, *only, supervisor, func() error { return reloadLocked(actor) })
+	})
+
 	// Start proxy in a goroutine
 	go func() {
 		if err := proxy.Start(); err != nil {
@@ -81,50 +283,43 @@ func main() {
 		}
 	}()
 
-	log.Printf("✅ TQServer ready on http://localhost:%d", config.Server.Port)
+	scheme := "http"
+	if config.Server.TLS != nil {
+		scheme = "https"
+	}
+	log.Printf("✅ TQServer ready on %s://localhost:%d", scheme, config.Server.Port)
 
 	// Wait for interrupt signal
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
-
-	for {
-		sig := <-sigChan
-		if sig == syscall.SIGHUP {
-			log.Println("Received SIGHUP, reloading configuration...")
-
-			// Reload configuration
-			newConfig, err := LoadConfig(configFile)
-			if err != nil {
-				log.Printf("Failed to reload config: %v", err)
-				continue
-			}
-			// Override mode if specified via flag
-			if *mode != "" {
-				newConfig.Mode = *mode
-			}
-
-			// Reload worker configs
-			newWorkerConfigs, err := LoadWorkerConfigs(newConfig.Workers.Directory)
-			if err != nil {
-				log.Printf("Failed to reload worker configs: %v", err)
-				continue
-			}
-			log.Printf("Reloaded %d worker(s)", len(newWorkerConfigs))
-
-			supervisor.Reload(newConfig, newWorkerConfigs)
-		} else {
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
 			break
 		}
+		log.Println("Received SIGHUP, reloading configuration...")
+		reload("signal:SIGHUP")
 	}
 
 	log.Println("Shutting down...")
+	// No reload runs while shutting down
+	reloadMu.Lock()
 
 	// Cleanup
 	if socks5Server != nil {
 		socks5Server.Stop()
 	}
+	if cluster != nil {
+		cluster.Stop()
+	}
 	supervisor.Stop()
 	proxy.Stop()
+	if webhooks != nil {
+		webhooks.Close()
+	}
+	accessLog.Close()
+	audit.Close()
 
+	removePidFile(pidFile)
 	log.Println("Goodbye!")
+	if serverLog != nil {
+		serverLog.Close()
+	}
 }
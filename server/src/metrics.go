@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 	"runtime"
+	"strconv"
 	"sync"
 	"time"
 
@@ -30,11 +31,14 @@ type Metrics struct {
 	// Backend/Worker metrics
 	WorkerRequestsTotal      *prometheus.CounterVec
 	WorkerHTTPResponsesTotal *prometheus.CounterVec
+	WorkerResponsesTotal     *prometheus.CounterVec
 	WorkerInstances          *prometheus.GaugeVec
 	WorkerInstancesHealthy   *prometheus.GaugeVec
 	WorkerQueueDepth         *prometheus.GaugeVec
+	WorkerQueueWait          *prometheus.HistogramVec
 	WorkerMemoryBytes        *prometheus.GaugeVec
 	WorkerRestartsTotal      *prometheus.CounterVec
+	WorkerRollbacksTotal     *prometheus.CounterVec
 	WorkerBuildErrorsTotal   *prometheus.CounterVec
 	WorkerUp                 *prometheus.GaugeVec
 
@@ -42,6 +46,27 @@ type Metrics struct {
 	HealthCheckDuration      *prometheus.HistogramVec
 	HealthCheckFailuresTotal *prometheus.CounterVec
 
+	// SOCKS5 proxy metrics
+	Socks5DeniedTotal        *prometheus.CounterVec
+	Socks5QuotaUsedBytes     *prometheus.GaugeVec
+	Socks5QuotaExceededTotal *prometheus.CounterVec
+	Socks5ChaosTotal         *prometheus.CounterVec
+
+	// WAF metrics
+	WAFMatchesTotal *prometheus.CounterVec
+
+	// Rate limit metrics
+	APIKeyRequestsTotal *prometheus.CounterVec
+	APIKeyQuotaUsed     *prometheus.GaugeVec
+
+	// CSRF metrics
+	CSRFRejectionsTotal *prometheus.CounterVec
+
+	// Static file metrics
+	FileCacheLookupsTotal *prometheus.CounterVec
+	AssetCacheFiles       prometheus.Gauge
+	AssetCacheBytes       prometheus.Gauge
+
 	startTime time.Time
 	mu        sync.RWMutex
 }
@@ -121,6 +146,10 @@ func newMetrics() *Metrics {
 			Name: "tqserver_worker_http_responses_total",
 			Help: "Total responses per worker by status group",
 		}, []string{"worker", "status_group"}),
+		WorkerResponsesTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "tqserver_worker_responses_total",
+			Help: "Total responses per worker by source (worker, static or error_page) and status",
+		}, []string{"worker", "source", "status"}),
 		WorkerInstances: promauto.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "tqserver_worker_instances",
 			Help: "Current number of instances per worker",
@@ -133,6 +162,11 @@ func newMetrics() *Metrics {
 			Name: "tqserver_worker_queue_depth",
 			Help: "Current queue depth per worker",
 		}, []string{"worker"}),
+		WorkerQueueWait: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "tqserver_worker_queue_wait_seconds",
+			Help:    "Time requests waited in the queue for an instance, by result: instance, unavailable, rejected, shed or timeout",
+			Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"worker", "result"}),
 		WorkerMemoryBytes: promauto.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "tqserver_worker_memory_bytes",
 			Help: "Memory usage per worker instance in bytes",
@@ -141,6 +175,10 @@ func newMetrics() *Metrics {
 			Name: "tqserver_worker_restarts_total",
 			Help: "Total worker restarts",
 		}, []string{"worker"}),
+		WorkerRollbacksTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "tqserver_worker_rollbacks_total",
+			Help: "Total rollbacks to the last-known-good binary",
+		}, []string{"worker"}),
 		WorkerBuildErrorsTotal: promauto.NewCounterVec(prometheus.CounterOpts{
 			Name: "tqserver_worker_build_errors_total",
 			Help: "Total build errors",
@@ -160,6 +198,52 @@ func newMetrics() *Metrics {
 			Name: "tqserver_health_check_failures_total",
 			Help: "Total health check failures",
 		}, []string{"worker"}),
+
+		// SOCKS5 proxy metrics
+		Socks5DeniedTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "tqserver_socks5_denied_total",
+			Help: "Total outgoing connections denied by an egress policy",
+		}, []string{"worker"}),
+		Socks5QuotaUsedBytes: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tqserver_socks5_quota_used_bytes",
+			Help: "Bytes relayed today per worker or destination limit",
+		}, []string{"scope", "name"}),
+		Socks5QuotaExceededTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "tqserver_socks5_quota_exceeded_total",
+			Help: "Total connections refused or cut off by a daily byte quota",
+		}, []string{"scope", "name"}),
+		Socks5ChaosTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "tqserver_socks5_chaos_total",
+			Help: "Total faults injected into outgoing connections",
+		}, []string{"kind"}),
+		WAFMatchesTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "tqserver_waf_matches_total",
+			Help: "Total requests matched by a WAF rule",
+		}, []string{"rule", "action"}),
+		APIKeyRequestsTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "tqserver_api_key_requests_total",
+			Help: "Total rate limited requests by API consumer, tier and result",
+		}, []string{"consumer", "tier", "result"}),
+		APIKeyQuotaUsed: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "tqserver_api_key_quota_used",
+			Help: "Requests of the day of an API consumer",
+		}, []string{"consumer"}),
+		CSRFRejectionsTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "tqserver_csrf_rejections_total",
+			Help: "Total requests rejected for a missing or invalid CSRF token",
+		}, []string{"worker", "reason"}),
+		FileCacheLookupsTotal: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "tqserver_file_cache_lookups_total",
+			Help: "Total lookups of public files by result (hit or miss)",
+		}, []string{"result"}),
+		AssetCacheFiles: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "tqserver_asset_cache_files",
+			Help: "Public files held in memory by the asset cache",
+		}),
+		AssetCacheBytes: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "tqserver_asset_cache_bytes",
+			Help: "Size of the public files held in memory by the asset cache",
+		}),
 	}
 
 	// Set process start time
@@ -208,9 +292,11 @@ func GetStatusGroup(statusCode int) string {
 	}
 }
 
-// RecordRequest records a completed request with all relevant metrics
-func (m *Metrics) RecordRequest(method, path string, statusCode int, duration time.Duration, workerName string) {
-	statusStr := string(rune('0'+statusCode/100)) + "xx"
+// RecordRequest records a completed request with all relevant metrics, the
+// source tells whether the worker, a static file or an error page of the
+// server answered it
+func (m *Metrics) RecordRequest(method, path string, statusCode int, duration time.Duration, workerName, source string) {
+	statusStr := strconv.Itoa(statusCode)
 	statusGroup := GetStatusGroup(statusCode)
 
 	// Frontend metrics
@@ -222,6 +308,7 @@ func (m *Metrics) RecordRequest(method, path string, statusCode int, duration ti
 	if workerName != "" {
 		m.WorkerRequestsTotal.WithLabelValues(workerName, statusStr).Inc()
 		m.WorkerHTTPResponsesTotal.WithLabelValues(workerName, statusGroup).Inc()
+		m.WorkerResponsesTotal.WithLabelValues(workerName, source, statusStr).Inc()
 	}
 }
 
@@ -238,11 +325,21 @@ func (m *Metrics) UpdateWorkerMetrics(workerName string, instanceCount, healthyC
 	}
 }
 
+// RecordQueueWait records the wait of a queued request
+func (m *Metrics) RecordQueueWait(workerName, result string, wait time.Duration) {
+	m.WorkerQueueWait.WithLabelValues(workerName, result).Observe(wait.Seconds())
+}
+
 // RecordWorkerRestart increments the restart counter for a worker
 func (m *Metrics) RecordWorkerRestart(workerName string) {
 	m.WorkerRestartsTotal.WithLabelValues(workerName).Inc()
 }
 
+// RecordWorkerRollback increments the rollback counter for a worker
+func (m *Metrics) RecordWorkerRollback(workerName string) {
+	m.WorkerRollbacksTotal.WithLabelValues(workerName).Inc()
+}
+
 // RecordBuildError increments the build error counter for a worker
 func (m *Metrics) RecordBuildError(workerName string) {
 	m.WorkerBuildErrorsTotal.WithLabelValues(workerName).Inc()
@@ -256,24 +353,97 @@ func (m *Metrics) RecordHealthCheck(workerName string, duration time.Duration, s
 	}
 }
 
+// RecordSocks5Denied increments the denied connection counter for a worker
+func (m *Metrics) RecordSocks5Denied(workerName string) {
+	m.Socks5DeniedTotal.WithLabelValues(workerName).Inc()
+}
+
+// SetSocks5QuotaUsed sets today's byte usage of a worker or destination limit
+func (m *Metrics) SetSocks5QuotaUsed(scope, name string, bytes int64) {
+	m.Socks5QuotaUsedBytes.WithLabelValues(scope, name).Set(float64(bytes))
+}
+
+// RecordSocks5Chaos increments the injected fault counter, kind is
+// "latency", "refused" or "reset"
+func (m *Metrics) RecordSocks5Chaos(kind string) {
+	m.Socks5ChaosTotal.WithLabelValues(kind).Inc()
+}
+
+// RecordWAFMatch increments the match counter of a WAF rule, action is
+// "block" or "log"
+func (m *Metrics) RecordWAFMatch(rule, action string) {
+	m.WAFMatchesTotal.WithLabelValues(rule, action).Inc()
+}
+
+// RecordAPIKeyRequest increments the requests of an API consumer, result is
+// "allowed", "rate_limited", "quota_exceeded" or "unauthorized"
+func (m *Metrics) RecordAPIKeyRequest(consumer, tier, result string) {
+	m.APIKeyRequestsTotal.WithLabelValues(consumer, tier, result).Inc()
+}
+
+// SetAPIKeyQuotaUsed sets the requests of the day of an API consumer
+func (m *Metrics) SetAPIKeyQuotaUsed(consumer string, used int64) {
+	m.APIKeyQuotaUsed.WithLabelValues(consumer).Set(float64(used))
+}
+
+// RecordCSRFRejection increments the rejected requests of a worker, reason
+// is "missing_cookie", "missing_token" or "invalid_token"
+func (m *Metrics) RecordCSRFRejection(worker, reason string) {
+	m.CSRFRejectionsTotal.WithLabelValues(worker, reason).Inc()
+}
+
+// RecordFileCacheLookup counts a lookup of a public file in the file cache
+func (m *Metrics) RecordFileCacheLookup(hit bool) {
+	if hit {
+		m.FileCacheLookupsTotal.WithLabelValues("hit").Inc()
+	} else {
+		m.FileCacheLookupsTotal.WithLabelValues("miss").Inc()
+	}
+}
+
+// SetAssetCache sets the files and bytes held by the asset cache
+func (m *Metrics) SetAssetCache(files int, size int64) {
+	m.AssetCacheFiles.Set(float64(files))
+	m.AssetCacheBytes.Set(float64(size))
+}
+
+// RecordSocks5QuotaExceeded increments the quota exceeded counter
+func (m *Metrics) RecordSocks5QuotaExceeded(scope, name string) {
+	m.Socks5QuotaExceededTotal.WithLabelValues(scope, name).Inc()
+}
+
 // SetWorkerInstanceMemory sets the memory usage for a specific worker instance
 func (m *Metrics) SetWorkerInstanceMemory(workerName, instanceID string, memoryBytes uint64) {
 	m.WorkerMemoryBytes.WithLabelValues(workerName, instanceID).Set(float64(memoryBytes))
 }
 
+// Response sources of the per-worker metrics
+const (
+	sourceWorker    = "worker"
+	sourceStatic    = "static"
+	sourceErrorPage = "error_page"
+)
+
 // statusCapturingWriter wraps http.ResponseWriter to capture the status code
 type statusCapturingWriter struct {
 	http.ResponseWriter
-	statusCode int
-	written    int64
+	statusCode  int
+	written     int64
+	source      string
+	wroteHeader bool
 }
 
+// WriteHeader keeps the first final status, like the ResponseWriter does
 func (w *statusCapturingWriter) WriteHeader(code int) {
-	w.statusCode = code
+	if !w.wroteHeader && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		w.statusCode = code
+		w.wroteHeader = true
+	}
 	w.ResponseWriter.WriteHeader(code)
 }
 
 func (w *statusCapturingWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
 	n, err := w.ResponseWriter.Write(b)
 	w.written += int64(n)
 	return n, err
@@ -283,3 +453,18 @@ func (w *statusCapturingWriter) Write(b []byte) (int, error) {
 func (w *statusCapturingWriter) Unwrap() http.ResponseWriter {
 	return w.ResponseWriter
 }
+
+// setResponseSource marks who answered a request, for the metrics
+func setResponseSource(w http.ResponseWriter, source string) {
+	for {
+		switch rw := w.(type) {
+		case *statusCapturingWriter:
+			rw.source = source
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return
+		}
+	}
+}
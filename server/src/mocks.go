@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mevdschee/tqtemplate"
+)
+
+// applyMocks starts and updates the mocks of a worker, they only run in dev
+// mode
+func (s *Supervisor) applyMocks(w *Worker, workerMeta *WorkerConfigWithMeta) {
+	var mocks []MockConfig
+	if s.config.IsDevelopmentMode() && workerMeta != nil {
+		mocks = workerMeta.Config.Mocks
+	}
+	s.mocks.apply(w.Name, s.workerDir(w.Name), mocks)
+}
+
+// mockServers serves the mocks of the workers in dev mode, each mock on a
+// port of its own on 127.0.0.1
+type mockServers struct {
+	mu       sync.RWMutex
+	services map[string]*mockService // By "worker/name"
+	tmpl     *tqtemplate.Template
+}
+
+// mockService is a running mock of a worker
+type mockService struct {
+	worker   string
+	dir      string // Worker directory, route files are relative to it
+	config   MockConfig
+	listener net.Listener
+	server   *http.Server
+	mocks    *mockServers
+}
+
+// newMockServers creates the mock registry, templates get a "json" filter
+// that writes a value as JSON
+func newMockServers() *mockServers {
+	return &mockServers{
+		services: make(map[string]*mockService),
+		tmpl: tqtemplate.NewTemplateWithLoaderAndFilters(nil, map[string]any{
+			"json": func(value any) tqtemplate.RawValue {
+				data, _ := json.Marshal(value)
+				return tqtemplate.RawValue{Value: string(data)}
+			},
+		}),
+	}
+}
+
+// apply starts, updates and stops the mocks of a worker to match mocks. A
+// mock keeps its port while its name stays, new routes apply right away.
+func (m *mockServers) apply(worker, dir string, mocks []MockConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keep := make(map[string]bool)
+	for _, config := range mocks {
+		key := worker + "/" + config.Name
+		keep[key] = true
+		if svc, ok := m.services[key]; ok {
+			svc.config, svc.dir = config, dir
+			continue
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Printf("Failed to start mock %s of worker %s: %v", config.Name, worker, err)
+			continue
+		}
+		svc := &mockService{worker: worker, dir: dir, config: config, listener: listener, mocks: m}
+		svc.server = &http.Server{Handler: svc, ReadHeaderTimeout: 10 * time.Second}
+		m.services[key] = svc
+		go svc.server.Serve(listener)
+		log.Printf("Mock %s of worker %s listening on %s", config.Name, worker, svc.url())
+	}
+	for key, svc := range m.services {
+		if svc.worker == worker && !keep[key] {
+			svc.server.Close()
+			delete(m.services, key)
+			log.Printf("Mock %s of worker %s stopped", svc.config.Name, worker)
+		}
+	}
+}
+
+// stop stops all mocks
+func (m *mockServers) stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, svc := range m.services {
+		svc.server.Close()
+		delete(m.services, key)
+	}
+}
+
+// env returns the variables that point a worker at its mocks
+func (m *mockServers) env(worker string) map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	vars := make(map[string]string)
+	for _, svc := range m.services {
+		if svc.worker == worker && svc.config.Env != "" {
+			vars[svc.config.Env] = svc.url()
+		}
+	}
+	return vars
+}
+
+// ports returns the ports of the mocks of a worker
+func (m *mockServers) ports(worker string) []int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var ports []int
+	for _, svc := range m.services {
+		if svc.worker == worker {
+			ports = append(ports, svc.listener.Addr().(*net.TCPAddr).Port)
+		}
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// hostAddr returns the address of the mock answering for host through the
+// SOCKS5 proxy, a mock of the connecting worker comes first. m may be nil.
+func (m *mockServers) hostAddr(worker, host string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	addr := ""
+	for _, svc := range m.services {
+		if svc.config.Host == "" || !strings.EqualFold(svc.config.Host, host) {
+			continue
+		}
+		if svc.worker == worker {
+			return svc.listener.Addr().String(), true
+		}
+		addr = svc.listener.Addr().String()
+	}
+	return addr, addr != ""
+}
+
+// url returns the base URL of the mock
+func (svc *mockService) url() string {
+	return "http://" + svc.listener.Addr().String()
+}
+
+// ServeHTTP answers with the first route matching the request, or a 404
+func (svc *mockService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	svc.mocks.mu.RLock()
+	config, dir := svc.config, svc.dir
+	svc.mocks.mu.RUnlock()
+
+	for _, route := range config.Routes {
+		if route.Method != "" && !strings.EqualFold(route.Method, r.Method) {
+			continue
+		}
+		params, ok := mockPathParams(route.Path, r.URL.Path)
+		if !ok {
+			continue
+		}
+		status := svc.respond(w, r, route, dir, params)
+		log.Printf("Mock %s of worker %s: %s %s %d", config.Name, svc.worker, r.Method, r.URL.RequestURI(), status)
+		return
+	}
+	log.Printf("Mock %s of worker %s: %s %s has no route", config.Name, svc.worker, r.Method, r.URL.RequestURI())
+	http.Error(w, fmt.Sprintf("mock %s has no route for %s %s", config.Name, r.Method, r.URL.Path), http.StatusNotFound)
+}
+
+// respond writes the response of a route after its latency and returns the
+// status written
+func (svc *mockService) respond(w http.ResponseWriter, r *http.Request, route MockRoute, dir string, params map[string]string) int {
+	if route.LatencyMs > 0 {
+		select {
+		case <-time.After(time.Duration(route.LatencyMs) * time.Millisecond):
+		case <-r.Context().Done():
+			return 499
+		}
+	}
+
+	// Files are read on every request, edits apply without a reload
+	source := route.Body
+	if route.File != "" {
+		data, err := os.ReadFile(filepath.Join(dir, route.File))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return http.StatusInternalServerError
+		}
+		source = string(data)
+	}
+	body, err := svc.mocks.tmpl.Render(source, mockTemplateData(r, params))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("mock template: %v", err), http.StatusInternalServerError)
+		return http.StatusInternalServerError
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	for name, value := range route.Headers {
+		header.Set(name, value)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(body))
+	return status
+}
+
+// mockPathParams matches a request path against a route path in which a
+// "{name}" segment matches any single segment and a trailing "/*" any
+// remainder, and returns the named segments
+func mockPathParams(template, requestPath string) (map[string]string, bool) {
+	if !matchPathTemplate(template, requestPath) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	got := strings.Split(requestPath, "/")
+	for i, segment := range strings.Split(strings.TrimSuffix(template, "/*"), "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			params[segment[1:len(segment)-1]] = got[i]
+		}
+	}
+	return params, true
+}
+
+// mockTemplateData returns the data of a body template: the "method" and
+// "path", the path "params", the first value of each "query" parameter and
+// request header (lowercase), and the request "body", decoded when it is JSON
+func mockTemplateData(r *http.Request, params map[string]string) map[string]any {
+	pathParams := make(map[string]any, len(params))
+	for name, value := range params {
+		pathParams[name] = value
+	}
+	query := make(map[string]any)
+	for name, values := range r.URL.Query() {
+		query[name] = values[0]
+	}
+	headers := make(map[string]any)
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = values[0]
+	}
+	var body any
+	if data, err := io.ReadAll(io.LimitReader(r.Body, mockBodyLimit)); err == nil && len(data) > 0 {
+		if json.Unmarshal(data, &body) != nil {
+			body = string(data)
+		}
+	}
+	return map[string]any{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"params":  pathParams,
+		"query":   query,
+		"headers": headers,
+		"body":    body,
+	}
+}
+
+// mockBodyLimit is the size of the request bodies read by mocks
+const mockBodyLimit = 1 << 20
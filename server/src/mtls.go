@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// containerTLSDir is where the certificate files of a container instance
+// are mounted
+const containerTLSDir = "/run/tqserver-tls"
+
+// instanceTLS mints the certificates of mutual TLS between the proxy and
+// the worker instances: a CA that lives as long as the server, a client
+// certificate for the proxy and a server certificate per instance start
+type instanceTLS struct {
+	dir       string // Holds the files of each instance, removed on stop
+	caCert    *x509.Certificate
+	caKey     crypto.Signer
+	caPEM     []byte
+	transport *http.Transport
+}
+
+// newInstanceTLS creates the CA and the client certificate of the proxy
+func newInstanceTLS(dir string) (*instanceTLS, error) {
+	t := &instanceTLS{dir: dir}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "TQServer Worker CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	if t.caCert, err = x509.ParseCertificate(der); err != nil {
+		return nil, err
+	}
+	t.caKey = key
+	t.caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	certPEM, keyPEM, err := t.issue("tqserver-proxy", x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	client, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(t.caCert)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		Certificates: []tls.Certificate{client},
+		RootCAs:      roots,
+		MinVersion:   tls.VersionTLS12,
+	}
+	t.transport = transport
+	return t, nil
+}
+
+// issue mints a certificate signed by the CA, valid for the loopback
+// addresses the instances are reached on
+func (t *instanceTLS) issue(name string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if certPEM, err = t.sign(name, usage, key.Public(), "localhost", "127.0.0.1", "::1"); err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// sign mints a certificate for a public key signed by the CA, valid for
+// the host names and IP addresses in hosts
+func (t *instanceTLS) sign(name string, usage x509.ExtKeyUsage, pub crypto.PublicKey, hosts ...string) ([]byte, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     t.caCert.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, t.caCert, pub, t.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// signRemote mints the server certificate of a remote instance from the
+// PEM certificate request of its agent, valid for the host the instance is
+// reached on whatever names the request has. The key stays on its machine.
+func (t *instanceTLS) signRemote(name, host string, csrPEM []byte) ([]byte, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("csr is not a PEM certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid csr: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("invalid csr: %w", err)
+	}
+	return t.sign(name, x509.ExtKeyUsageServerAuth, csr.PublicKey, host)
+}
+
+// issueInstance writes a new certificate, its key and the CA for an
+// instance to its own directory and returns that directory. An instance
+// gets a new certificate on every start.
+func (t *instanceTLS) issueInstance(workerName string, port int) (string, error) {
+	certPEM, keyPEM, err := t.issue(fmt.Sprintf("%s-%d", workerName, port), x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return "", fmt.Errorf("failed to issue instance certificate: %w", err)
+	}
+	dir := filepath.Join(t.dir, fmt.Sprintf("%s-%d", workerName, port))
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	for name, data := range map[string][]byte{"cert.pem": certPEM, "key.pem": keyPEM, "ca.pem": t.caPEM} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// env returns the variables that point an instance at its certificate
+// files, in dir as the instance sees it
+func (t *instanceTLS) env(dir string) []string {
+	return []string{
+		"WORKER_TLS_CERT=" + filepath.Join(dir, "cert.pem"),
+		"WORKER_TLS_KEY=" + filepath.Join(dir, "key.pem"),
+		"WORKER_TLS_CA=" + filepath.Join(dir, "ca.pem"),
+	}
+}
+
+// workerTLS returns the mutual TLS of the connections to an instance, nil
+// for plain HTTP. Remote instances only have a certificate of the server
+// when their agent registered them with a certificate request.
+func (p *Proxy) workerTLS(inst *WorkerInstance) *instanceTLS {
+	if p.supervisor == nil {
+		return nil
+	}
+	return p.supervisor.instanceTLS(inst)
+}
+
+// instanceTLS returns the mutual TLS of the connections to an instance,
+// nil for plain HTTP
+func (s *Supervisor) instanceTLS(inst *WorkerInstance) *instanceTLS {
+	if inst.Host != "" && !inst.TLS {
+		return nil
+	}
+	return s.mtls
+}
+
+// scheme returns the URL scheme the instances are reached with
+func (t *instanceTLS) scheme() string {
+	if t == nil {
+		return "http"
+	}
+	return "https"
+}
+
+// client returns an HTTP client for the instances, plain when mutual TLS
+// is off
+func (t *instanceTLS) client(timeout time.Duration) *http.Client {
+	if t == nil {
+		return &http.Client{Timeout: timeout}
+	}
+	return &http.Client{Timeout: timeout, Transport: t.transport}
+}
+
+// roundTripper returns the transport of proxied requests, nil for the
+// default one when mutual TLS is off
+func (t *instanceTLS) roundTripper() http.RoundTripper {
+	if t == nil {
+		return nil
+	}
+	return t.transport
+}
+
+// close removes the certificate files
+func (t *instanceTLS) close() {
+	if t != nil {
+		os.RemoveAll(t.dir)
+	}
+}
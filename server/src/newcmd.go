@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// scaffolds holds the templates of "tqserver new worker", one directory per
+// worker type. Files end in ".tmpl" and use [[ ]] delimiters, the {{ }} of
+// the view templates are copied as is.
+//
+//go:embed scaffold
+var scaffolds embed.FS
+
+// workerNamePattern matches the worker names the generator accepts, they are
+// used as directory, binary and package names
+var workerNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// scaffoldData is passed to the templates of a new worker
+type scaffoldData struct {
+	Name  string // Directory name, e.g. "user-admin"
+	Title string // Display name, e.g. "User Admin"
+	Path  string // Route, e.g. "/user-admin"
+}
+
+// runNew runs "tqserver new <kind>"
+func runNew(args []string) {
+	if len(args) == 0 || args[0] != "worker" {
+		fmt.Fprintln(os.Stderr, "usage: tqserver new worker <name> [-type go|bun|php] [-path /route] [-config path]")
+		os.Exit(2)
+	}
+	runNewWorker(args[1:])
+}
+
+// runNewWorker creates a worker directory from the scaffold of its type
+func runNewWorker(args []string) {
+	flags := flag.NewFlagSet("new worker", flag.ExitOnError)
+	configPath := flags.String("config", "config/server.yaml", "Path to config file")
+	workerType := flags.String("type", "go", "Worker type: go, bun or php")
+	route := flags.String("path", "", "Route of the worker (default: /{name})")
+	flags.Parse(args)
+	// The name may come before or after the flags
+	var name string
+	if flags.NArg() > 0 {
+		name = flags.Arg(0)
+		flags.Parse(flags.Args()[1:])
+	}
+	if name == "" || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: tqserver new worker <name> [-type go|bun|php] [-path /route] [-config path]")
+		os.Exit(2)
+	}
+
+	files, err := scaffoldWorker(findConfigFile(*configPath), name, *workerType, *route)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tqserver new worker: %v\n", err)
+		os.Exit(1)
+	}
+	for _, file := range files {
+		fmt.Printf("created %s\n", file)
+	}
+	fmt.Printf("\nWorker %s is started with the server, run \"tqserver ctl reload-config\" to add it to a running server.\n", name)
+}
+
+// scaffoldWorker writes a new worker to the workers directory of the server
+// config and returns the files it created
+func scaffoldWorker(configPath, name, workerType, route string) ([]string, error) {
+	if !workerNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%q is not a valid name, use lowercase letters, digits, - and _", name)
+	}
+	if _, err := fs.Stat(scaffolds, "scaffold/"+workerType); err != nil {
+		return nil, fmt.Errorf("no scaffold for type %q, expected go, bun or php", workerType)
+	}
+	if route == "" {
+		route = "/" + name
+	}
+	if !strings.HasPrefix(route, "/") {
+		return nil, fmt.Errorf("path %q must start with /", route)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(config.Workers.Directory, name)
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("%s already exists", dir)
+	}
+	workerConfigs, err := LoadWorkerConfigs(config.Workers.Directory, config.SecretStore())
+	if err != nil {
+		return nil, err
+	}
+	for _, workerMeta := range workerConfigs {
+		if workerMeta.Config.Path == route {
+			return nil, fmt.Errorf("path %s is already routed to worker %s", route, workerMeta.Name)
+		}
+	}
+
+	data := scaffoldData{Name: name, Title: workerTitle(name), Path: route}
+	root := "scaffold/" + workerType
+	var files []string
+	err = fs.WalkDir(scaffolds, root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(scaffolds, name)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New(name).Delims("[[", "]]").Parse(string(content))
+		if err != nil {
+			return err
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, data); err != nil {
+			return err
+		}
+
+		// Dot files are stored without the dot, embed skips them
+		target := strings.TrimSuffix(strings.TrimPrefix(name, root+"/"), ".tmpl")
+		if path.Base(target) == "gitignore" {
+			target = path.Join(path.Dir(target), ".gitignore")
+		}
+		file := filepath.Join(dir, filepath.FromSlash(target))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, out.Bytes(), 0644); err != nil {
+			return err
+		}
+		files = append(files, file)
+		return nil
+	})
+	return files, err
+}
+
+// workerTitle turns a worker name into a display name, "user-admin" becomes
+// "User Admin"
+func workerTitle(name string) string {
+	words := strings.FieldsFunc(name, func(r rune) bool { return r == '-' || r == '_' })
+	for i, word := range words {
+		words[i] = strings.ToUpper(word[:1]) + word[1:]
+	}
+	return strings.Join(words, " ")
+}
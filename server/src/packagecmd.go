@@ -0,0 +1,351 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// manifestFile is the name of the manifest at the root of a package
+const manifestFile = "manifest.json"
+
+// signatureFile holds the base64 ed25519 signature of the manifest of a
+// signed package
+const signatureFile = manifestFile + ".sig"
+
+// packageManifest describes the contents of a deployment package
+type packageManifest struct {
+	Version   string            `json:"version"`
+	Created   time.Time         `json:"created"`
+	Mode      string            `json:"mode"`
+	OS        string            `json:"os"`
+	Arch      string            `json:"arch"`
+	GoVersion string            `json:"go_version"`
+	Server    packageBinary     `json:"server"`
+	Workers   []packageWorker   `json:"workers"`
+	Files     map[string]string `json:"files"` // Path in the package -> SHA-256
+}
+
+// packageBinary is a binary built for the target of a package
+type packageBinary struct {
+	Binary string `json:"binary"`
+	SHA256 string `json:"sha256"`
+}
+
+// packageWorker is a worker in a package, Go workers with their binary
+type packageWorker struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Path   string `json:"path"`
+	Binary string `json:"binary,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// packageSkipped lists the directories of a worker that are not packaged,
+// per worker type: build output, dependencies installed on the host, logs
+// and sources of binaries built for the target
+var packageSkipped = map[string][]string{
+	"go":        {"src", "bin", "logs"},
+	"wasm":      {"src", "logs"},
+	"bun":       {"bin", "node_modules", "logs"},
+	"php":       {"bin", "vendor", "logs"},
+	"container": {"bin", "logs"},
+	"remote":    {"bin", "logs"},
+}
+
+// runPackage runs "tqserver package": it builds the server and the Go
+// workers for a target platform and writes them, with the other workers,
+// the config and the public assets, to a versioned tarball with a manifest
+func runPackage(args []string) {
+	flags := flag.NewFlagSet("package", flag.ExitOnError)
+	configPath := flags.String("config", "config/server.yaml", "Path to config file")
+	mode := flags.String("mode", "prod", "Server mode to package for: dev or prod")
+	goos := flags.String("os", runtime.GOOS, "Target operating system, like GOOS")
+	goarch := flags.String("arch", runtime.GOARCH, "Target architecture, like GOARCH")
+	version := flags.String("version", "", "Version of the package (default: git describe, or a timestamp)")
+	output := flags.String("output", "dist", "Directory to write the package to")
+	sign := flags.String("sign", "", "ed25519 private key (PEM) to sign the manifest with")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: tqserver package [-config path] [-mode dev|prod] [-os os] [-arch arch] [-version v] [-output dir] [-sign key] [worker...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	projectRoot, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Failed to get working directory: %v", err)
+	}
+	config, _, selected := loadBuildTargets("package", *configPath, *mode, flags.Args())
+	var signingKey ed25519.PrivateKey
+	if *sign != "" {
+		if signingKey, err = readSigningKey(*sign); err != nil {
+			fmt.Fprintf(os.Stderr, "tqserver package: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *version == "" {
+		*version = packageVersion()
+	}
+
+	manifest := packageManifest{
+		Version:   *version,
+		Created:   time.Now().UTC().Truncate(time.Second),
+		Mode:      config.Mode,
+		OS:        *goos,
+		Arch:      *goarch,
+		GoVersion: runtime.Version(),
+		Files:     map[string]string{},
+	}
+	archive := filepath.Join(*output, fmt.Sprintf("tqserver-%s-%s-%s.tar.gz", *version, *goos, *goarch))
+	if err := writePackage(archive, projectRoot, findConfigFile(*configPath), config, selected, &manifest, signingKey); err != nil {
+		os.Remove(archive)
+		fmt.Fprintf(os.Stderr, "tqserver package: %v\n", err)
+		os.Exit(1)
+	}
+	signed := ""
+	if signingKey != nil {
+		signed = "signed, "
+	}
+	fmt.Printf("\nPackaged %s %s for %s/%s, %d worker(s), %sto %s\n", manifest.Mode, manifest.Version, *goos, *goarch, len(manifest.Workers), signed, archive)
+}
+
+// packageVersion returns the git description of the project, or the time
+// for a project without tags or git
+func packageVersion() string {
+	out, err := exec.Command("git", "describe", "--tags", "--always", "--dirty").Output()
+	if version := strings.TrimSpace(string(out)); err == nil && version != "" {
+		return version
+	}
+	return time.Now().Format("20060102-150405")
+}
+
+// writePackage builds the binaries into a temporary directory and writes
+// the package with its manifest to archive, and the signature of the
+// manifest when a signing key is given
+func writePackage(archive, projectRoot, configFile string, config *Config, workers []*WorkerConfigWithMeta, manifest *packageManifest, signingKey ed25519.PrivateKey) error {
+	workersDir := filepath.Clean(config.Workers.Directory)
+	if filepath.IsAbs(workersDir) || strings.HasPrefix(workersDir, "..") {
+		return fmt.Errorf("workers.directory %s must be inside the project to package it", config.Workers.Directory)
+	}
+	buildDir, err := os.MkdirTemp("", "tqserver-package-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(buildDir)
+
+	// Binaries first, a failed build leaves no package behind
+	env := []string{"GOOS=" + manifest.OS, "GOARCH=" + manifest.Arch}
+	strip := manifest.Mode != "dev"
+	binaries := map[string]string{} // Path in the package -> built file
+	build := func(target, workerType string, builder func() error) error {
+		start := time.Now()
+		err := builder()
+		result := buildResult{Target: target, Type: workerType, OK: err == nil, DurationMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			result.Error = strings.TrimSpace(err.Error())
+		}
+		printBuildResult(result)
+		return err
+	}
+	serverBinary := filepath.Join(buildDir, "tqserver")
+	if err := build("server", "go", func() error {
+		return goBuild(projectRoot, serverBinary, "./server/src", env, strip)
+	}); err != nil {
+		return fmt.Errorf("building the server failed")
+	}
+	binaries["server/bin/tqserver"] = serverBinary
+	manifest.Server.Binary = "server/bin/tqserver"
+
+	for _, workerMeta := range workers {
+		workerRoot := filepath.Join(projectRoot, workersDir, workerMeta.Name)
+		entry := packageWorker{Name: workerMeta.Name, Type: workerMeta.Config.Type, Path: workerMeta.Config.Path}
+		var err error
+		switch entry.Type {
+		case "go":
+			binary := filepath.Join(buildDir, workerMeta.Name)
+			err = build(entry.Name, entry.Type, func() error {
+				return goBuild(workerRoot, binary, "./src", env, strip)
+			})
+			entry.Binary = filepath.ToSlash(filepath.Join(workersDir, entry.Name, "bin", entry.Name))
+			binaries[entry.Binary] = binary
+		case "wasm":
+			// Modules are portable, built here and packaged without sources
+			err = build(entry.Name, entry.Type, func() error {
+				return buildWasmWorker(entry.Name, workerRoot, workerMeta)
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("building worker %s failed", entry.Name)
+		}
+		manifest.Workers = append(manifest.Workers, entry)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	pkg := &packageWriter{tw: tw, root: "tqserver-" + manifest.Version, manifest: manifest}
+
+	for _, name := range slices.Sorted(maps.Keys(binaries)) {
+		if err := pkg.addFile(binaries[name], name); err != nil {
+			return err
+		}
+	}
+	for i := range manifest.Workers {
+		worker := &manifest.Workers[i]
+		if worker.Binary != "" {
+			worker.SHA256 = manifest.Files[worker.Binary]
+		}
+		skipped := packageSkipped[worker.Type]
+		if worker.Type == "wasm" {
+			if meta := findWorkerConfig(workers, worker.Name); meta.Config.Wasm != nil && meta.Config.Wasm.Build != "" {
+				// A custom build command may need more than src
+				skipped = []string{"logs"}
+			}
+		}
+		dir := filepath.Join(workersDir, worker.Name)
+		if err := pkg.addDir(filepath.Join(projectRoot, dir), dir, skipped); err != nil {
+			return err
+		}
+	}
+	manifest.Server.SHA256 = manifest.Files[manifest.Server.Binary]
+
+	// The config directory, and the public assets and views of the server
+	configDir, err := filepath.Rel(projectRoot, filepath.Dir(configFile))
+	if err != nil || strings.HasPrefix(configDir, "..") {
+		configDir = "config"
+	}
+	if err := pkg.addDir(filepath.Dir(configFile), configDir, nil); err != nil {
+		return err
+	}
+	for _, dir := range []string{"server/public", "server/views"} {
+		if _, err := os.Stat(filepath.Join(projectRoot, dir)); err == nil {
+			if err := pkg.addDir(filepath.Join(projectRoot, dir), dir, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := pkg.addData(data, manifestFile, 0644); err != nil {
+		return err
+	}
+	if signingKey != nil {
+		signature := base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, data))
+		if err := pkg.addData([]byte(signature+"\n"), signatureFile, 0644); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// packageWriter adds files below a root directory to a tar archive and
+// records their checksums in the manifest
+type packageWriter struct {
+	tw       *tar.Writer
+	root     string
+	manifest *packageManifest
+}
+
+// addDir adds a directory tree, without the directories named in skipped at
+// its top level and without .git directories
+func (p *packageWriter) addDir(src, name string, skipped []string) error {
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == ".git" || !strings.Contains(rel, string(filepath.Separator)) && slices.Contains(skipped, rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(name, rel)
+		if entry.Type()&fs.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return p.tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     p.root + "/" + filepath.ToSlash(target),
+				Linkname: link,
+				Mode:     0777,
+			})
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		return p.addFile(path, target)
+	})
+}
+
+// addFile adds a regular file as name
+func (p *packageWriter) addFile(path, name string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return p.addData(data, name, int64(info.Mode().Perm()))
+}
+
+// addData adds a file with the given content and permissions
+func (p *packageWriter) addData(data []byte, name string, mode int64) error {
+	name = filepath.ToSlash(name)
+	if name != manifestFile && name != signatureFile {
+		sum := sha256.Sum256(data)
+		p.manifest.Files[name] = hex.EncodeToString(sum[:])
+	}
+	err := p.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     p.root + "/" + name,
+		Size:     int64(len(data)),
+		Mode:     mode,
+		ModTime:  p.manifest.Created,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = p.tw.Write(data)
+	return err
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// readPackageManifest reads the manifest of the package unpacked in the
+// project root and checks that it was built for this platform. With a
+// verify key the manifest must carry a valid signature of that key.
+func readPackageManifest(projectRoot, verifyKey string) (*packageManifest, error) {
+	data, err := os.ReadFile(filepath.Join(projectRoot, manifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no %s in %s, workers.prebuilt needs a package made by tqserver package", manifestFile, projectRoot)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if verifyKey != "" {
+		if err := verifyManifestSignature(projectRoot, verifyKey, data); err != nil {
+			return nil, err
+		}
+	}
+	var manifest packageManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", manifestFile, err)
+	}
+	if manifest.OS != runtime.GOOS || manifest.Arch != runtime.GOARCH {
+		return nil, fmt.Errorf("package %s is built for %s/%s, this host is %s/%s", manifest.Version, manifest.OS, manifest.Arch, runtime.GOOS, runtime.GOARCH)
+	}
+	return &manifest, nil
+}
+
+// packagedWorker returns the entry of a worker in a manifest, or nil
+func (m *packageManifest) packagedWorker(name string) *packageWorker {
+	for i := range m.Workers {
+		if m.Workers[i].Name == name {
+			return &m.Workers[i]
+		}
+	}
+	return nil
+}
+
+// checkPrebuiltWorker takes the place of the build of a worker when workers
+// are prebuilt: the worker must be in the package as the type it is
+// configured with and its artifacts must be in place. No toolchain runs,
+// dependencies of Bun and PHP workers are installed when deploying.
+func checkPrebuiltWorker(projectRoot, workerRoot, verifyKey string, workerMeta *WorkerConfigWithMeta) error {
+	manifest, err := readPackageManifest(projectRoot, verifyKey)
+	if err != nil {
+		return err
+	}
+	name, cfg := workerMeta.Name, &workerMeta.Config
+	entry := manifest.packagedWorker(name)
+	if entry == nil {
+		return fmt.Errorf("worker %s is not in package %s", name, manifest.Version)
+	}
+	if entry.Type != cfg.Type {
+		return fmt.Errorf("worker %s is a %s worker in package %s, not %s", name, entry.Type, manifest.Version, cfg.Type)
+	}
+
+	exists := func(rel string) bool {
+		_, err := os.Stat(filepath.Join(workerRoot, rel))
+		return err == nil
+	}
+	switch cfg.Type {
+	case "go":
+		binary := filepath.Join(workerRoot, "bin", name)
+		info, err := os.Stat(binary)
+		if entry.Binary == "" || err != nil {
+			return fmt.Errorf("binary of worker %s is missing from package %s: %s", name, manifest.Version, binary)
+		}
+		if info.Mode().Perm()&0111 == 0 {
+			return fmt.Errorf("binary of worker %s is not executable: %s", name, binary)
+		}
+		return verifyPackagedFile(manifest, projectRoot, binary)
+	case "wasm":
+		module := wasmModulePath(workerRoot, name, workerMeta)
+		if _, err := os.Stat(module); err != nil {
+			return fmt.Errorf("module of worker %s is missing from package %s: %s", name, manifest.Version, module)
+		}
+		return verifyPackagedFile(manifest, projectRoot, module)
+	case "bun":
+		if exists("package.json") && !exists("node_modules") {
+			return fmt.Errorf("node_modules of worker %s is missing, run bun install --production when deploying", name)
+		}
+	case "php":
+		if exists("composer.json") && !exists("vendor") {
+			return fmt.Errorf("vendor of worker %s is missing, run composer install --no-dev when deploying", name)
+		}
+	case "container":
+		if cfg.Container == nil || cfg.Container.Build != "" {
+			return fmt.Errorf("container worker %s is built from container.build, prebuilt workers run a container.image", name)
+		}
+	}
+	return nil
+}
+
+// verifyPrebuiltBinary checks the binary of a Go worker against the manifest
+// right before it is started, it may have changed since the worker started
+func verifyPrebuiltBinary(projectRoot, verifyKey, binary string) error {
+	manifest, err := readPackageManifest(projectRoot, verifyKey)
+	if err != nil {
+		return err
+	}
+	return verifyPackagedFile(manifest, projectRoot, binary)
+}
+
+// verifyPackagedFile checks the SHA-256 of a file against its checksum in
+// the manifest, a tampered or partially copied file does not match
+func verifyPackagedFile(manifest *packageManifest, projectRoot, path string) error {
+	rel, err := filepath.Rel(projectRoot, path)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+	expected, ok := manifest.Files[rel]
+	if !ok {
+		return fmt.Errorf("%s has no checksum in package %s", rel, manifest.Version)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != expected {
+		return fmt.Errorf("%s does not match package %s, refusing to start it: SHA-256 %s (%d bytes), expected %s; it was modified or partially copied, deploy the package again", rel, manifest.Version, sum, size, expected)
+	}
+	return nil
+}
+
+// verifyManifestSignature checks the ed25519 signature of the manifest
+// data, in the signature file next to it, with the public key in keyFile
+func verifyManifestSignature(projectRoot, keyFile string, data []byte) error {
+	if !filepath.IsAbs(keyFile) {
+		keyFile = filepath.Join(projectRoot, keyFile)
+	}
+	key, err := readVerifyKey(keyFile)
+	if err != nil {
+		return err
+	}
+	encoded, err := os.ReadFile(filepath.Join(projectRoot, signatureFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s is not signed, no %s next to it, sign the package with tqserver package -sign", manifestFile, signatureFile)
+	}
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", signatureFile, err)
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return fmt.Errorf("signature of %s does not match key %s, the manifest was modified or signed with another key", manifestFile, keyFile)
+	}
+	return nil
+}
+
+// readVerifyKey reads an ed25519 public key from a PEM file, like one written
+// by "openssl pkey -pubout"
+func readVerifyKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", path)
+	}
+	return publicKey, nil
+}
+
+// readSigningKey reads an ed25519 private key from a PEM file, like one
+// written by "openssl genpkey -algorithm ed25519"
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", path)
+	}
+	return privateKey, nil
+}
@@ -2,22 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mevdschee/tqserver/pkg/fastcgi"
+	"github.com/mevdschee/tqserver/pkg/filecache"
+	"github.com/mevdschee/tqserver/pkg/phpfpm"
+	"github.com/mevdschee/tqserver/pkg/tracing"
 	"github.com/mevdschee/tqtemplate"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -25,11 +29,30 @@ import (
 // Proxy handles incoming HTTP requests and routes them to backend workers
 type Proxy struct {
 	config            *Config
+	settings          *Config // Latest reloaded config, for timeouts and limits
 	router            *Router
 	server            *http.Server
+	adminServer       *http.Server
+	controlServer     *http.Server
+	supervisor        *Supervisor              // For the control operations
+	reload            func(actor string) error // Reloads the configuration like SIGHUP
+	draining          atomic.Bool              // Readiness fails while draining
+	starting          atomic.Bool              // Requests are refused until the workers are ready
 	projectRoot       string
+	deployConfig      func(actor string, d *configDeploy) (*configDeployResult, error) // Validates and applies pushed config files
 	tmpl              *tqtemplate.Template
 	reloadBroadcaster *ReloadBroadcaster
+	traffic           *TrafficBroadcaster
+	tracer            *tracing.Tracer // nil when tracing is off
+	events            *EventLog
+	requests          *RequestLog
+	accessLog         *AccessLog // nil when the access log is off
+	audit             *AuditLog  // nil when the audit log is off
+	cluster           *Cluster   // nil when cluster mode is off
+	limiter           *rateLimiter
+	files             *filecache.Cache // nil when the file cache is off
+	assets            *assetCache      // nil when the asset cache is off
+	started           time.Time
 	mu                sync.RWMutex
 }
 
@@ -44,22 +67,71 @@ func NewProxy(config *Config, router *Router, projectRoot string) *Proxy {
 
 	return &Proxy{
 		config:            config,
+		settings:          config,
 		router:            router,
 		projectRoot:       projectRoot,
 		tmpl:              tmpl,
 		reloadBroadcaster: NewReloadBroadcaster(),
+		traffic:           NewTrafficBroadcaster(),
+		tracer:            newTracer(config.Tracing),
+		requests:          &RequestLog{},
+		limiter:           newRateLimiter(projectRoot),
+		files:             newFileCache(config.Static.FileCache),
+		assets:            newAssetCache(config.Static.Assets, config.GetDebounceDelay()),
+		started:           time.Now(),
 	}
 }
 
+// newFileCache returns the cache of public files, nil when it is off
+func newFileCache(c *FileCacheConfig) *filecache.Cache {
+	if c == nil || !c.Enabled {
+		return nil
+	}
+	return filecache.New(filecache.Options{MaxEntries: c.MaxEntries, MaxOpen: c.MaxOpenFiles})
+}
+
 // Start starts the HTTP server
 func (p *Proxy) Start() error {
+	// Assets are in memory before the first request
+	if p.assets != nil {
+		for _, worker := range p.router.GetAllWorkers() {
+			p.assets.manifest(filepath.Join(p.projectRoot, p.config.Workers.Directory, worker.Name, "public"), worker.Type == "php")
+		}
+		p.assets.manifest(filepath.Join(p.projectRoot, "server", "public"), false)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", p.instrumentedHandler(p.handleRequest))
+	p.registerHealth(mux)
 
 	// Add WebSocket endpoint for live reload (dev mode only)
 	if p.config.IsDevelopmentMode() {
+		p.reloadBroadcaster.state = p.reloadState
 		mux.HandleFunc("/ws/reload", p.reloadBroadcaster.HandleWebSocket)
 		log.Printf("Live reload WebSocket enabled at ws://localhost:%d/ws/reload", p.config.Server.Port)
+
+		// The client injected into worker pages, also without a root worker
+		mux.HandleFunc(reloadClientPath, func(w http.ResponseWriter, r *http.Request) {
+			http.ServeFile(w, r, filepath.Join(p.projectRoot, "server", "public", reloadClientPath))
+		})
+
+		// Worker status as JSON, also served on the admin listener
+		p.registerAdminAPI(mux)
+
+		// Live view of the workers' outbound calls through the SOCKS5 proxy
+		if p.config.Socks5.Enabled {
+			mux.HandleFunc("/ws/traffic", p.traffic.HandleWebSocket)
+			mux.HandleFunc("/admin/traffic", p.traffic.HandlePage)
+			log.Printf("Outbound traffic viewer enabled at http://localhost:%d/admin/traffic", p.config.Server.Port)
+		}
+	}
+
+	if err := p.registerDashboard(mux); err != nil {
+		return err
+	}
+	p.registerDeploy(mux)
+	if p.cluster != nil {
+		mux.HandleFunc("GET "+clusterStatePath, p.cluster.handleState)
 	}
 
 	// Add Prometheus metrics endpoint
@@ -70,6 +142,17 @@ func (p *Proxy) Start() error {
 		log.Printf("Prometheus metrics enabled at http://localhost:%d%s", p.config.Server.Port, p.config.Metrics.Path)
 	}
 
+	if p.config.Admin.Enabled {
+		if err := p.startAdmin(); err != nil {
+			return err
+		}
+	}
+	if p.config.Control.Enabled {
+		if err := p.startControl(); err != nil {
+			return err
+		}
+	}
+
 	p.server = &http.Server{
 		Addr:         fmt.Sprintf(":%d", p.config.Server.Port),
 		Handler:      mux,
@@ -77,20 +160,165 @@ func (p *Proxy) Start() error {
 		WriteTimeout: p.config.GetWriteTimeout(),
 		IdleTimeout:  p.config.GetIdleTimeout(),
 	}
+	if t := p.config.Server.TLS; t != nil {
+		tlsConfig, err := serverTLSConfig(t, p.projectRoot)
+		if err != nil {
+			return err
+		}
+		p.server.TLSConfig = tlsConfig
+	}
+
+	// Requests only reach the workers once they are ready
+	switch p.config.Health.StartupGate {
+	case "bind":
+		log.Printf("Waiting for the workers before listening on port %d...", p.config.Server.Port)
+		p.awaitWorkers()
+	case "unavailable":
+		p.starting.Store(true)
+		go func() {
+			p.awaitWorkers()
+			p.starting.Store(false)
+		}()
+	}
 
-	log.Printf("Proxy listening on http://localhost:%d", p.config.Server.Port)
-	return p.server.ListenAndServe()
+	// Stop closes the server, that is no failure
+	var err error
+	if t := p.config.Server.TLS; t != nil {
+		log.Printf("Proxy listening on https://localhost:%d", p.config.Server.Port)
+		err = p.server.ListenAndServeTLS(resolveTLSFile(p.projectRoot, t.CertFile), resolveTLSFile(p.projectRoot, t.KeyFile))
+	} else {
+		log.Printf("Proxy listening on http://localhost:%d", p.config.Server.Port)
+		err = p.server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
-// BroadcastReload sends reload message to all connected WebSocket clients
-func (p *Proxy) BroadcastReload() {
+// BroadcastReload tells the WebSocket clients showing pages of the worker
+// at route to reload
+func (p *Proxy) BroadcastReload(route string) {
 	if p.reloadBroadcaster != nil {
-		p.reloadBroadcaster.BroadcastReload()
+		p.reloadBroadcaster.BroadcastReload(route)
 	}
 }
 
-// Stop gracefully stops the proxy
+// BroadcastBuildResult tells the WebSocket clients that a worker failed to
+// build or was fixed
+func (p *Proxy) BroadcastBuildResult(worker string, err error) {
+	if p.reloadBroadcaster != nil {
+		p.reloadBroadcaster.BroadcastBuildResult(worker, err)
+	}
+}
+
+// BroadcastTestRun tells the WebSocket clients that the tests of a worker
+// started or finished
+func (p *Proxy) BroadcastTestRun(worker string, run *TestRun) {
+	if p.reloadBroadcaster != nil {
+		p.reloadBroadcaster.BroadcastTestRun(worker, run)
+	}
+}
+
+// reloadState returns the build failures and the last test runs of the
+// workers as reload messages
+func (p *Proxy) reloadState() []reloadMessage {
+	var messages []reloadMessage
+	for _, worker := range p.router.GetAllWorkers() {
+		if hasBuildError, buildError := worker.GetBuildError(); hasBuildError {
+			messages = append(messages, reloadMessage{Type: "build-error", Worker: worker.Name, Error: buildError})
+		}
+		if run := worker.GetTestRun(); run != nil {
+			messages = append(messages, testRunMessage(worker.Name, run))
+		}
+	}
+	return messages
+}
+
+// BroadcastAsset tells the WebSocket clients that a public file changed
+func (p *Proxy) BroadcastAsset(urlPath string) {
+	if p.reloadBroadcaster != nil {
+		p.reloadBroadcaster.BroadcastAsset(urlPath)
+	}
+}
+
+// InvalidateFile tells the file and asset caches that a file or directory
+// changed
+func (p *Proxy) InvalidateFile(path string) {
+	if p.files != nil {
+		p.files.Invalidate(path)
+	}
+	if p.assets != nil {
+		p.assets.changed(path)
+	}
+}
+
+// PurgeFiles empties the file and asset caches, when the file watcher
+// missed changes
+func (p *Proxy) PurgeFiles() {
+	if p.files != nil {
+		p.files.Purge()
+	}
+	if p.assets != nil {
+		p.assets.purge()
+	}
+}
+
+// SetEvents sets the worker lifecycle events served by the admin API
+func (p *Proxy) SetEvents(events *EventLog) {
+	p.events = events
+}
+
+// SetAccessLog sets the access log, nil turns it off
+func (p *Proxy) SetAccessLog(accessLog *AccessLog) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.accessLog = accessLog
+}
+
+// ApplyConfig applies the timeouts and limits of a reloaded configuration,
+// listeners and endpoints keep the settings they started with
+func (p *Proxy) ApplyConfig(config *Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.settings = config
+}
+
+// current returns the latest reloaded config and the access log
+func (p *Proxy) current() (*Config, *AccessLog) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.settings, p.accessLog
+}
+
+// SetAudit sets the audit log of administrative actions, nil turns it off
+func (p *Proxy) SetAudit(audit *AuditLog) {
+	p.audit = audit
+}
+
+// SetCluster routes requests to the peers of a cluster, before Start
+func (p *Proxy) SetCluster(cluster *Cluster) {
+	p.cluster = cluster
+}
+
+// Traffic returns the broadcaster of the live traffic viewer
+func (p *Proxy) Traffic() *TrafficBroadcaster {
+	return p.traffic
+}
+
+// Stop gracefully stops the proxy and exports the remaining traces
 func (p *Proxy) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.tracer.Shutdown(ctx); err != nil {
+		log.Printf("Failed to export traces: %v", err)
+	}
+	if p.adminServer != nil {
+		p.adminServer.Close()
+	}
+	if p.controlServer != nil {
+		p.controlServer.Close()
+	}
 	if p.server != nil {
 		return p.server.Close()
 	}
@@ -115,39 +343,82 @@ func (p *Proxy) instrumentedHandler(next http.HandlerFunc) http.HandlerFunc {
 
 		metrics := GetMetrics()
 		start := time.Now()
+		settings, accessLog := p.current()
+		r = withClientIP(r, settings.clientIPs.resolve(r))
+
+		// The server's timeouts are those at startup, reloads apply per request
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(deadline(start, settings.GetReadTimeout()))
+		rc.SetWriteDeadline(deadline(start, settings.GetWriteTimeout()))
 
 		// Track active requests
 		metrics.ActiveRequests.Inc()
 		defer metrics.ActiveRequests.Dec()
 
+		// Normalize path to avoid high cardinality (use worker path if available)
+		path, workerName := p.normalizePathForMetrics(r.URL.Path)
+		if r.ContentLength > 0 {
+			metrics.BytesInTotal.Add(float64(r.ContentLength))
+		}
+
+		// Start the server span, continuing the trace of the caller
+		var span *tracing.Span
+		if p.tracer != nil {
+			ctx := tracing.ContextWithRemoteParent(r.Context(), r.Header.Get("traceparent"))
+			ctx, span = p.tracer.Start(ctx, r.Method+" "+path, tracing.KindServer)
+			span.SetAttribute("http.request.method", r.Method)
+			span.SetAttribute("http.route", path)
+			span.SetAttribute("url.path", r.URL.Path)
+			span.SetAttribute("user_agent.original", r.UserAgent())
+			r = r.WithContext(ctx)
+		}
+
 		// Wrap ResponseWriter to capture status code and bytes written
-		wrapped := &statusCapturingWriter{ResponseWriter: w, statusCode: 200}
+		wrapped := &statusCapturingWriter{ResponseWriter: w, statusCode: 200, source: sourceWorker}
 
 		// Call the actual handler
 		next(wrapped, r)
 
 		// Record metrics
 		duration := time.Since(start)
-		statusStr := strconv.Itoa(wrapped.statusCode)
-		statusGroup := GetStatusGroup(wrapped.statusCode)
+		metrics.RecordRequest(r.Method, path, wrapped.statusCode, duration, workerName, wrapped.source)
+		metrics.BytesOutTotal.Add(float64(wrapped.written))
+		accessLog.Log(r, wrapped.statusCode, wrapped.written, duration, workerName)
+		p.requests.Record(RecentRequest{
+			Time:       start,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Worker:     workerName,
+			Status:     wrapped.statusCode,
+			DurationMs: float64(duration.Microseconds()) / 1000,
+			Bytes:      wrapped.written,
+		})
 
-		// Normalize path to avoid high cardinality (use worker path if available)
-		path := p.normalizePathForMetrics(r.URL.Path)
+		span.SetAttribute("http.response.status_code", wrapped.statusCode)
+		if wrapped.statusCode >= 500 {
+			span.SetError(http.StatusText(wrapped.statusCode))
+		}
+		span.End()
+	}
+}
 
-		metrics.RequestsTotal.WithLabelValues(r.Method, path, statusStr).Inc()
-		metrics.HTTPResponsesTotal.WithLabelValues(statusGroup).Inc()
-		metrics.RequestDuration.WithLabelValues(r.Method, path).Observe(duration.Seconds())
-		metrics.BytesOutTotal.Add(float64(wrapped.written))
+// deadline returns the time a timeout expires, zero for no timeout
+func deadline(start time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
 	}
+	return start.Add(timeout)
 }
 
-// normalizePathForMetrics returns a normalized path to avoid high cardinality
-func (p *Proxy) normalizePathForMetrics(path string) string {
+// normalizePathForMetrics returns the route or path template of a request
+// and the name of its worker, paths without a worker share one label to
+// avoid high cardinality
+func (p *Proxy) normalizePathForMetrics(path string) (string, string) {
 	worker := p.router.GetWorker(path)
 	if worker != nil {
-		return worker.Path
+		return worker.MetricsPath(path), worker.Name
 	}
-	return path
+	return "unmatched", ""
 }
 
 // handleRequest routes incoming requests to appropriate workers
@@ -159,31 +430,105 @@ func (p *Proxy) handleRequest(w http.ResponseWriter, r *http.Request) {
 		r.Header.Set("X-Correlation-ID", correlationID)
 	}
 	w.Header().Set("X-Correlation-ID", correlationID)
+	if t := p.config.Server.TLS; t != nil {
+		setClientCertHeaders(r, t.ClientHeaders)
+	}
+	span := tracing.SpanFromContext(r.Context())
+	span.SetAttribute("tqserver.correlation_id", correlationID)
 
 	// Get worker for this route
 	worker := p.router.GetWorker(r.URL.Path)
 
+	// In cluster mode, a peer serves the routes without a usable worker here
+	if peer := p.clusterPeer(r, worker); peer != nil {
+		span.SetAttribute("tqserver.cluster_node", peer.URL.Host)
+		p.forwardToPeer(w, r, peer)
+		return
+	}
+
+	if p.starting.Load() {
+		w.Header().Set("Retry-After", startupRetryAfter)
+		p.serveErrorPage(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Server is starting, the workers are not ready yet", nil)
+		return
+	}
+
 	if worker == nil {
 		http.Error(w, "404 Not Found", http.StatusNotFound)
 		log.Printf("No worker found for path: %s", r.URL.Path)
 		return
 	}
+	span.SetAttribute("tqserver.worker", worker.Name)
 
-	// Priority 1: Try to serve from worker's public directory
-	workerPublicPath := filepath.Join(p.projectRoot, p.config.Workers.Directory, worker.Name, "public", r.URL.Path)
-	if p.serveFile(w, r, workerPublicPath) {
+	settings, _ := p.current()
+	if rule := settings.waf.inspect(r, worker.Name); rule != nil {
+		span.SetAttribute("tqserver.waf_rule", rule.name)
+		p.serveErrorPage(w, r, http.StatusForbidden, "Forbidden", "The request was blocked", nil)
+		return
+	}
+	if !p.limiter.limit(w, r, settings, worker.Name) {
+		return
+	}
+	// Pages get the CSRF token in their forms, static ones too
+	if csrf := settings.CSRF; csrf.protects(worker.Name) {
+		token, ok := checkCSRF(w, r, csrf, worker.Name)
+		if !ok {
+			p.serveErrorPage(w, r, http.StatusForbidden, "Forbidden", "Invalid or missing CSRF token", nil)
+			return
+		}
+		if r.Method != http.MethodHead {
+			injector := &htmlRewriter{ResponseWriter: w, rewrite: func(body []byte) []byte {
+				return injectCSRFToken(body, csrf.Field, token)
+			}}
+			defer injector.finish()
+			w = injector
+		}
+	}
+
+	// Pages refer to assets by their fingerprinted paths, not in dev mode
+	// where the live reload finds assets by their paths
+	workerPublicDir := filepath.Join(p.projectRoot, p.config.Workers.Directory, worker.Name, "public")
+	serverPublicDir := filepath.Join(p.projectRoot, "server", "public")
+	if p.assets != nil && !p.config.IsDevelopmentMode() && r.Method != http.MethodHead {
+		manifests := []*assetManifest{p.assets.manifest(workerPublicDir, worker.Type == "php"), p.assets.manifest(serverPublicDir, false)}
+		injector := &htmlRewriter{ResponseWriter: w}
+		injector.rewrite = func(body []byte) []byte {
+			rewritten := p.assets.rewrite(body, r.URL.Path, manifests...)
+			if !bytes.Equal(rewritten, body) {
+				// The page changes with the assets, not only with itself
+				injector.Header().Del("ETag")
+				injector.Header().Del("Last-Modified")
+			}
+			return rewritten
+		}
+		defer injector.finish()
+		w = injector
+	}
+
+	// Priority 1: Try to serve from worker's public directory, PHP scripts
+	// are executed, never served as source
+	isPHPScript := worker.Type == "php" && strings.Contains(r.URL.Path, ".php")
+	if !isPHPScript && p.serveStatic(w, r, workerPublicDir, worker.Type == "php") {
 		log.Printf("%s %s -> static file (worker: %s)", r.Method, r.URL.Path, worker.Name)
 		return
 	}
 
 	// Priority 2: Try to serve from server's public directory
-	serverPublicPath := filepath.Join(p.projectRoot, "server", "public", r.URL.Path)
-	if p.serveFile(w, r, serverPublicPath) {
+	if p.serveStatic(w, r, serverPublicDir, false) {
 		log.Printf("%s %s -> static file (server)", r.Method, r.URL.Path)
 		return
 	}
 
-	// Priority 3: Let the worker handle the request (proxy to worker)
+	// Priority 3: Let the worker handle the request (proxy to worker), a
+	// drain waits for the requests counted here
+	atomic.AddInt64(&worker.Active, 1)
+	defer atomic.AddInt64(&worker.Active, -1)
+	if worker.IsDraining() {
+		p.serveErrorPage(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Worker is draining for maintenance", map[string]interface{}{
+			"WorkerName": worker.Name,
+		})
+		return
+	}
+
 	// In dev mode, check if there's a build error and serve error page
 	if p.config.IsDevelopmentMode() {
 		if hasBuildError, buildError := worker.GetBuildError(); hasBuildError {
@@ -192,6 +537,15 @@ func (p *Proxy) handleRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// In dev mode, HTML pages of workers get the live reload client
+	if p.config.IsDevelopmentMode() && r.Method != http.MethodHead {
+		injector := &htmlRewriter{ResponseWriter: w, rewrite: func(body []byte) []byte {
+			return injectReloadClient(body, worker.Path)
+		}}
+		defer injector.finish()
+		w = injector
+	}
+
 	// In dev mode, set X-TQServer-Worker-* headers for all worker types (helper function)
 	devHeadersSet := p.config.IsDevelopmentMode()
 	setDevHeaders := func(header http.Header) {
@@ -212,42 +566,29 @@ func (p *Proxy) handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// For Go/Bun workers: Load Balancing via Supervisor Queue
-	// Create request
-	req := &WorkerRequest{
-		ResponseChan: make(chan *WorkerInstance),
-	}
-
-	// Send to queue
-	select {
-	case worker.Queue <- req:
-		// Request queued
-	default:
-		// Queue full
-		p.serveErrorPage(w, r, http.StatusServiceUnavailable, "Service Busy", "Worker queue is full", map[string]interface{}{
-			"WorkerName": worker.Name,
-			"QueueDepth": len(worker.Queue),
-		})
-		log.Printf("Worker queue full for: %s", worker.Name)
+	// WASM workers are executed in-process
+	if worker.Type == "wasm" {
+		if devHeadersSet {
+			setDevHeaders(w.Header())
+		}
+		p.handleWasmRequest(w, r, worker)
 		return
 	}
 
-	// Wait for instance
+	// For Go/Bun workers: the request picks an instance, or waits in the
+	// queue when there is no healthy one below max_in_flight or requests
+	// wait already
 	var instance *WorkerInstance
-	select {
-	case instance = <-req.ResponseChan:
-		if instance == nil {
-			p.serveErrorPage(w, r, http.StatusServiceUnavailable, "Service Unavailable", "No workers available", map[string]interface{}{
-				"WorkerName": worker.Name,
-			})
+	if worker.Queue.len() == 0 {
+		instance = worker.pickInstance()
+	}
+	if instance == nil {
+		if instance = p.waitForInstance(w, r, worker); instance == nil {
 			return
 		}
-	case <-time.After(30 * time.Second): // Wait timeout
-		p.serveErrorPage(w, r, http.StatusGatewayTimeout, "Gateway Timeout", "Timed out waiting for worker", map[string]interface{}{
-			"WorkerName": worker.Name,
-		})
-		return
 	}
+	// Counted by the picker, so a drain cannot stop it before this request
+	defer worker.releaseInstance(instance)
 
 	// In dev mode, set X-TQServer-Worker-* headers based on the assigned instance
 	if devHeadersSet {
@@ -256,11 +597,14 @@ func (p *Proxy) handleRequest(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-TQServer-Worker-Path", worker.Path)
 		w.Header().Set("X-TQServer-Worker-Port", fmt.Sprintf("%d", instance.Port))
 		w.Header().Set("X-TQServer-Worker-ID", instance.ID) // New: Show Instance ID
+		if instance.DebugPort != 0 {
+			w.Header().Set("X-TQServer-Worker-Debug", fmt.Sprintf("127.0.0.1:%d", instance.DebugPort))
+		}
 	}
 
 	// Check if worker is healthy (double check instance)
 	if !instance.Healthy {
-		// Should not happen as dispatcher filters, but good practice
+		// Should not happen as the picker filters, but good practice
 		p.serveErrorPage(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Assigned worker instance is unhealthy", map[string]interface{}{
 			"WorkerName": worker.Name,
 			"InstanceID": instance.ID,
@@ -268,8 +612,15 @@ func (p *Proxy) handleRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Remote instances may speak SCGI or uwsgi instead of HTTP
+	if instance.Protocol != "" {
+		p.handleGatewayRequest(w, r, worker, instance)
+		return
+	}
+
 	// Proxy request to worker instance
-	target, err := url.Parse(fmt.Sprintf("http://localhost:%d", instance.Port))
+	mtls := p.workerTLS(instance)
+	target, err := url.Parse(mtls.scheme() + "://" + instance.Addr())
 	if err != nil {
 		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
 		log.Printf("Failed to parse worker URL: %v", err)
@@ -277,13 +628,14 @@ func (p *Proxy) handleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = mtls.roundTripper()
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
 		log.Printf("Proxy error for %s: %v", r.URL.Path, err)
 		p.serveErrorPage(w, r, http.StatusBadGateway, "Bad Gateway", "Failed to proxy request to worker", map[string]interface{}{
 			"Error":      err.Error(),
 			"WorkerName": worker.Name,
 			"InstanceID": instance.ID,
-			"Address":    fmt.Sprintf("http://localhost:%d", instance.Port),
+			"Address":    target.String(),
 		})
 	}
 
@@ -304,30 +656,153 @@ func (p *Proxy) handleRequest(w http.ResponseWriter, r *http.Request) {
 	proxiedReq.URL.Path = trimmedPath
 	proxiedReq.URL.RawPath = trimmedPath
 	proxiedReq.RequestURI = ""
+	setProxyToken(proxiedReq.Header, instance.ProxyToken)
+
+	// Trace the call, the worker continues the trace from its traceparent
+	upstreamSpan := p.startUpstreamSpan(r, proxiedReq.Header, worker)
+	upstreamSpan.SetAttribute("tqserver.instance", instance.ID)
+	if upstreamSpan != nil {
+		errorHandler := proxy.ErrorHandler
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			upstreamSpan.SetError(err.Error())
+			errorHandler(w, r, err)
+		}
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			upstreamSpan.SetAttribute("http.response.status_code", resp.StatusCode)
+			return nil
+		}
+	}
 
-	log.Printf("%s %s -> worker %s (port %d)", r.Method, r.URL.Path, instance.ID, instance.Port)
+	if instance.Host != "" {
+		log.Printf("%s %s -> worker %s (%s)", r.Method, r.URL.Path, instance.ID, instance.Addr())
+	} else {
+		log.Printf("%s %s -> worker %s (port %d)", r.Method, r.URL.Path, instance.ID, instance.Port)
+	}
 	proxy.ServeHTTP(w, proxiedReq)
+	upstreamSpan.End()
 
 	// Increment request count
 	worker.IncrementRequestCount()
 }
 
+// waitForInstance queues a request that found no healthy instance until the
+// dispatcher has one for it, the wait is traced as a child span. It serves an
+// error page and returns nil when no instance became available.
+func (p *Proxy) waitForInstance(w http.ResponseWriter, r *http.Request, worker *Worker) *WorkerInstance {
+	req := &WorkerRequest{
+		ResponseChan: make(chan *WorkerInstance, 1),
+	}
+	_, maxWait, _ := worker.Queue.settings()
+	queued := time.Now()
+	result := "instance"
+	defer func() {
+		wait := time.Since(queued)
+		if result != "rejected" {
+			worker.Queue.observe(wait)
+		}
+		GetMetrics().RecordQueueWait(worker.Name, result, wait)
+	}()
+
+	_, queueSpan := p.tracer.Start(r.Context(), "queue wait", tracing.KindInternal)
+	queueSpan.SetAttribute("tqserver.worker", worker.Name)
+	queueSpan.SetAttribute("tqserver.queue_depth", worker.Queue.len())
+	defer queueSpan.End()
+	if !worker.Queue.push(req) {
+		result = "rejected"
+		queueSpan.SetError("worker queue is full")
+		p.serveErrorPage(w, r, http.StatusServiceUnavailable, "Service Busy", "Worker queue is full", map[string]interface{}{
+			"WorkerName": worker.Name,
+			"QueueDepth": worker.Queue.len(),
+		})
+		log.Printf("Worker queue full for: %s", worker.Name)
+		return nil
+	}
+
+	// Wait for instance
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case instance := <-req.ResponseChan:
+		switch {
+		case req.Shed:
+			result = "shed"
+			queueSpan.SetError("shed by a full worker queue")
+			p.serveErrorPage(w, r, http.StatusServiceUnavailable, "Service Busy", "Worker queue is full", map[string]interface{}{
+				"WorkerName": worker.Name,
+				"QueueDepth": worker.Queue.len(),
+			})
+			return nil
+		case instance == nil:
+			result = "unavailable"
+			queueSpan.SetError("no workers available")
+			p.serveErrorPage(w, r, http.StatusServiceUnavailable, "Service Unavailable", "No workers available", map[string]interface{}{
+				"WorkerName": worker.Name,
+			})
+			return nil
+		}
+		queueSpan.SetAttribute("tqserver.instance", instance.ID)
+		return instance
+	case <-timer.C: // Wait timeout
+		if !worker.Queue.remove(req) {
+			// Taken by the dispatcher or shed meanwhile, an instance
+			// picked after all is not used
+			go func() {
+				if instance := <-req.ResponseChan; instance != nil {
+					worker.releaseInstance(instance)
+				}
+			}()
+		}
+		result = "timeout"
+		queueSpan.SetError("timed out waiting for worker")
+		p.serveErrorPage(w, r, http.StatusGatewayTimeout, "Gateway Timeout", "Timed out waiting for worker", map[string]interface{}{
+			"WorkerName": worker.Name,
+		})
+		return nil
+	}
+}
+
+// serveStatic serves a file of a public directory, from memory when it is
+// an asset. Returns true if the file was served.
+func (p *Proxy) serveStatic(w http.ResponseWriter, r *http.Request, dir string, php bool) bool {
+	if p.assets != nil && p.assets.serve(w, r, p.assets.manifest(dir, php)) {
+		return true
+	}
+	return p.serveFile(w, r, filepath.Join(dir, r.URL.Path))
+}
+
 // serveFile attempts to serve a file from the given path
 // Returns true if the file was served successfully, false otherwise
 func (p *Proxy) serveFile(w http.ResponseWriter, r *http.Request, filePath string) bool {
 	// Check if file exists
-	info, err := os.Stat(filePath)
-	if err != nil || info.IsDir() {
+	var info os.FileInfo
+	if p.files != nil {
+		var cached bool
+		info, cached = p.files.Stat(filePath)
+		GetMetrics().RecordFileCacheLookup(cached)
+	} else if fi, err := os.Stat(filePath); err == nil && !fi.IsDir() {
+		info = fi
+	}
+	if info == nil {
 		return false
 	}
 
 	// Serve the file
-	http.ServeFile(w, r, filePath)
+	setResponseSource(w, sourceStatic)
+	_, span := p.tracer.Start(r.Context(), "static file", tracing.KindInternal)
+	span.SetAttribute("file.path", filePath)
+	span.SetAttribute("file.size", info.Size())
+	if p.files != nil {
+		p.files.ServeFile(w, r, filePath)
+	} else {
+		http.ServeFile(w, r, filePath)
+	}
+	span.End()
 	return true
 }
 
 // serveBuildErrorPage serves an HTML error page showing compilation errors
 func (p *Proxy) serveBuildErrorPage(w http.ResponseWriter, r *http.Request, workerName string, buildError string) {
+	setResponseSource(w, sourceErrorPage)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK) // Use 200 so browser doesn't show its own error page
 
@@ -354,6 +829,7 @@ func (p *Proxy) serveBuildErrorPage(w http.ResponseWriter, r *http.Request, work
 
 // serveErrorPage serves a branded HTML error page
 func (p *Proxy) serveErrorPage(w http.ResponseWriter, r *http.Request, statusCode int, title string, message string, details map[string]interface{}) {
+	setResponseSource(w, sourceErrorPage)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(statusCode)
 
@@ -398,32 +874,71 @@ func (p *Proxy) handlePHPRequest(w http.ResponseWriter, r *http.Request, worker
 	// Determine script filename
 	documentRoot := filepath.Join(p.projectRoot, p.config.Workers.Directory, worker.Name, "public")
 
-	// Remove route prefix from URL path
-	scriptPath := strings.TrimPrefix(r.URL.Path, worker.Path)
-	if scriptPath == "" || scriptPath == "/" {
-		scriptPath = "/index.php"
+	worker.mu.RLock()
+	rewriter := worker.PHPRewriter
+	tryFiles := worker.PHPTryFiles
+	worker.mu.RUnlock()
+
+	// Apply rewrites to the path below the route prefix
+	routePrefix := strings.TrimSuffix(worker.Path, "/")
+	requestPath := "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, routePrefix), "/")
+	rewrite := rewriter.Rewrite(requestPath, r.URL.RawQuery)
+	if rewrite.Redirect != 0 {
+		location := rewrite.Location()
+		if strings.HasPrefix(location, "/") {
+			location = routePrefix + location
+		}
+		http.Redirect(w, r, location, rewrite.Redirect)
+		log.Printf("%s %s -> redirect %d %s", r.Method, r.URL.Path, rewrite.Redirect, location)
+		return
 	}
 
-	// If path doesn't end in .php, assume it's a directory request for index.php
-	if !strings.HasSuffix(scriptPath, ".php") {
-		scriptPath = filepath.Join(scriptPath, "index.php")
+	// Resolve the script, with PATH_INFO split off. Missing scripts are not
+	// sent to php-fpm, which would only log "Primary script unknown".
+	script, ok := phpfpm.ResolveScript(documentRoot, rewrite.Path, rewrite.Query, tryFiles)
+	if !ok || !script.Exists(documentRoot) {
+		p.serveErrorPage(w, r, http.StatusNotFound, "Not Found", "No PHP script found for this path", map[string]interface{}{
+			"WorkerName": worker.Name,
+		})
+		return
 	}
+	scriptName := routePrefix + script.Name
 
-	scriptFilename := filepath.Join(documentRoot, scriptPath)
-
-	// Read request body
-	var requestBody []byte
+	// Request body is streamed to php-fpm, bounded by max_body_size
+	settings, _ := p.current()
+	maxBodySize := settings.Server.MaxBodySize
+	if maxBodySize > 0 && r.ContentLength > maxBodySize {
+		p.serveErrorPage(w, r, http.StatusRequestEntityTooLarge, "Request Entity Too Large", "Request body exceeds max_body_size", map[string]interface{}{
+			"WorkerName": worker.Name,
+		})
+		return
+	}
+	var body io.Reader = http.NoBody
+	contentLength := int64(0)
 	if r.Body != nil {
-		var err error
-		requestBody, err = io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
-			log.Printf("Failed to read request body: %v", err)
-			return
+		body = r.Body
+		if maxBodySize > 0 {
+			body = http.MaxBytesReader(w, r.Body, maxBodySize)
+		}
+		contentLength = r.ContentLength
+		if contentLength < 0 {
+			// Chunked request: PHP needs CONTENT_LENGTH, so spool it to disk
+			spooled, size, err := spoolBody(body)
+			if err != nil {
+				p.serveBodyReadError(w, r, worker, err)
+				return
+			}
+			defer spooled.Close()
+			body = spooled
+			contentLength = size
 		}
-		r.Body.Close()
 	}
 
+	// Trace the call, PHP reads the traceparent from the HTTP_TRACEPARENT
+	// FastCGI param
+	upstreamSpan := p.startUpstreamSpan(r, r.Header, worker)
+	defer upstreamSpan.End()
+
 	// Build FastCGI parameters from HTTP request
 	params := make(map[string]string)
 	params["GATEWAY_INTERFACE"] = "CGI/1.1"
@@ -433,15 +948,19 @@ func (p *Proxy) handlePHPRequest(w http.ResponseWriter, r *http.Request, worker
 	params["SERVER_PORT"] = fmt.Sprintf("%d", p.config.Server.Port)
 	params["REQUEST_METHOD"] = r.Method
 	params["REQUEST_URI"] = r.URL.RequestURI()
-	params["SCRIPT_FILENAME"] = scriptFilename
-	params["SCRIPT_NAME"] = scriptPath
+	params["SCRIPT_FILENAME"] = script.Filename
+	params["SCRIPT_NAME"] = scriptName
 	params["DOCUMENT_ROOT"] = documentRoot
-	params["DOCUMENT_URI"] = scriptPath
-	params["QUERY_STRING"] = r.URL.RawQuery
-	params["REMOTE_ADDR"] = r.RemoteAddr
+	params["DOCUMENT_URI"] = scriptName + script.PathInfo
+	params["QUERY_STRING"] = script.Query
+	if script.PathInfo != "" {
+		params["PATH_INFO"] = script.PathInfo
+		params["PATH_TRANSLATED"] = filepath.Join(documentRoot, filepath.FromSlash(script.PathInfo))
+	}
+	params["REMOTE_ADDR"] = clientIP(r)
 	params["REMOTE_PORT"] = "0"
 	params["CONTENT_TYPE"] = r.Header.Get("Content-Type")
-	params["CONTENT_LENGTH"] = fmt.Sprintf("%d", len(requestBody))
+	params["CONTENT_LENGTH"] = fmt.Sprintf("%d", contentLength)
 	params["REDIRECT_STATUS"] = "200" // Required by CGI-based runtimes (e.g., php-cgi)
 
 	// Add HTTP headers as FastCGI params
@@ -450,162 +969,99 @@ func (p *Proxy) handlePHPRequest(w http.ResponseWriter, r *http.Request, worker
 		params[headerName] = strings.Join(values, ", ")
 	}
 
-	// Connect to FastCGI server
-	// Connect to FastCGI server
-	// Use explicit IPv4 loopback to avoid resolving to ::1 when php-fpm
-	// is bound to 127.0.0.1 only.
-	if len(worker.Instances) == 0 {
+	// Requests are served by the pool matching the path they were made for
+	pool := worker.PHPPoolFor(requestPath)
+	if pool == nil {
 		p.serveErrorPage(w, r, http.StatusServiceUnavailable, "Service Unavailable", "PHP worker not initialized", map[string]interface{}{
 			"WorkerName": worker.Name,
 		})
-		log.Printf("PHP worker %s has no instances", worker.Name)
+		log.Printf("PHP worker %s has no FastCGI client", worker.Name)
+		return
+	}
+
+	// Send the request over a pooled, kept-alive FastCGI connection
+	client := pool.Client
+	status, headers, respBody, err := client.DoRequest(r.Context(), params, body)
+	endUpstreamSpan(upstreamSpan, status, err)
+	if r.Context().Err() != nil {
+		// Client disconnected, php-fpm was sent FCGI_ABORT_REQUEST
+		log.Printf("%s %s -> PHP worker %s aborted: client disconnected", r.Method, r.URL.Path, worker.Name)
+		return
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		p.serveBodyReadError(w, r, worker, err)
 		return
 	}
-	port := worker.Instances[0].Port
-	fcgiAddress := fmt.Sprintf("127.0.0.1:%d", port)
-	conn, err := net.DialTimeout("tcp", fcgiAddress, 5*time.Second)
 	if err != nil {
-		p.serveErrorPage(w, r, http.StatusServiceUnavailable, "Service Unavailable", "Could not connect to PHP worker", map[string]interface{}{
+		p.serveErrorPage(w, r, http.StatusBadGateway, "Bad Gateway", "FastCGI request to PHP worker failed", map[string]interface{}{
 			"Error":      err.Error(),
 			"WorkerName": worker.Name,
-			"Address":    fcgiAddress,
+			"Address":    client.Address(),
 		})
-		log.Printf("Failed to connect to FastCGI server at %s: %v", fcgiAddress, err)
+		log.Printf("FastCGI request to %s failed: %v", client.Address(), err)
 		return
 	}
-	defer conn.Close()
-
-	// Create FastCGI connection
-	fcgiConn := fastcgi.NewConn(conn, 60*time.Second, 60*time.Second)
 
-	// Send FastCGI request
-	requestID := uint16(1)
+	writeResponse(w, status, headers, respBody)
 
-	// Send BeginRequest
-	if err := fcgiConn.SendBeginRequest(requestID, fastcgi.RoleResponder, false); err != nil {
-		http.Error(w, "Failed to send FastCGI request", http.StatusInternalServerError)
-		log.Printf("Failed to send BeginRequest: %v", err)
-		return
-	}
+	// Increment request count
+	worker.IncrementRequestCount()
 
-	// Send Params
-	if err := fcgiConn.SendParams(requestID, params); err != nil {
-		http.Error(w, "Failed to send FastCGI parameters", http.StatusInternalServerError)
-		log.Printf("Failed to send Params: %v", err)
-		return
-	}
+	log.Printf("%s %s -> PHP worker (FastCGI: %s)", r.Method, r.URL.Path, client.Address())
+}
 
-	// Send empty params to signal end
-	if err := fcgiConn.SendParams(requestID, nil); err != nil {
-		http.Error(w, "Failed to send FastCGI parameters", http.StatusInternalServerError)
-		log.Printf("Failed to send empty Params: %v", err)
+// serveBodyReadError responds to a request body that could not be read or
+// exceeded max_body_size
+func (p *Proxy) serveBodyReadError(w http.ResponseWriter, r *http.Request, worker *Worker, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		p.serveErrorPage(w, r, http.StatusRequestEntityTooLarge, "Request Entity Too Large", "Request body exceeds max_body_size", map[string]interface{}{
+			"WorkerName": worker.Name,
+		})
 		return
 	}
+	http.Error(w, "Failed to read request body", http.StatusBadRequest)
+	log.Printf("Failed to read request body: %v", err)
+}
 
-	// Send Stdin (request body)
-	if len(requestBody) > 0 {
-		if err := fcgiConn.SendStdin(requestID, requestBody); err != nil {
-			http.Error(w, "Failed to send request body", http.StatusInternalServerError)
-			log.Printf("Failed to send Stdin: %v", err)
-			return
-		}
-	}
-
-	// Send empty stdin to signal end
-	if err := fcgiConn.SendStdin(requestID, nil); err != nil {
-		http.Error(w, "Failed to send request body", http.StatusInternalServerError)
-		log.Printf("Failed to send empty Stdin: %v", err)
-		return
+// spoolBody copies a request body of unknown length to an unlinked temp
+// file, so it is not held in memory, and returns it rewound with its size
+func spoolBody(body io.Reader) (*os.File, int64, error) {
+	file, err := os.CreateTemp("", "tqserver-body-*")
+	if err != nil {
+		return nil, 0, err
 	}
-
-	// Read response
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-
-	readDone := false
-	for !readDone {
-		record, err := fcgiConn.ReadRecord()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Printf("Failed to read FastCGI response: %v", err)
-			break
-		}
-
-		switch record.Header.Type {
-		case fastcgi.TypeStdout:
-			if len(record.Content) > 0 {
-				stdout.Write(record.Content)
-			}
-		case fastcgi.TypeStderr:
-			if len(record.Content) > 0 {
-				stderr.Write(record.Content)
-			}
-		case fastcgi.TypeEndRequest:
-			// Request complete
-			readDone = true
-		}
+	os.Remove(file.Name())
+	size, err := io.Copy(file, body)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
 	}
-
-	// Log any stderr output
-	if stderr.Len() > 0 {
-		log.Printf("[PHP stderr] %s", stderr.String())
+	if err != nil {
+		file.Close()
+		return nil, 0, err
 	}
+	return file, size, nil
+}
 
-	// Parse response headers and body
-	responseData := stdout.Bytes()
-	headerEnd := bytes.Index(responseData, []byte("\r\n\r\n"))
-	if headerEnd == -1 {
-		// Try just \n\n
-		headerEnd = bytes.Index(responseData, []byte("\n\n"))
-		if headerEnd != -1 {
-			headerEnd += 2
-		}
-	} else {
-		headerEnd += 4
+// writeCGIResponse writes a CGI-style response (headers, blank line, body)
+// produced by a PHP or WASM worker to the client
+func writeCGIResponse(w http.ResponseWriter, responseData []byte) error {
+	status, headers, body, err := fastcgi.ParseCGIResponse(responseData)
+	if err != nil {
+		return err
 	}
+	writeResponse(w, status, headers, bytes.NewReader(body))
+	return nil
+}
 
-	if headerEnd > 0 {
-		// Parse headers
-		headerLines := bytes.Split(responseData[:headerEnd], []byte("\n"))
-		for _, line := range headerLines {
-			line = bytes.TrimSpace(line)
-			if len(line) == 0 {
-				continue
-			}
-
-			parts := bytes.SplitN(line, []byte(":"), 2)
-			if len(parts) == 2 {
-				key := string(bytes.TrimSpace(parts[0]))
-				value := string(bytes.TrimSpace(parts[1]))
-
-				// Handle special headers
-				if strings.ToLower(key) == "status" {
-					// Parse status code
-					statusParts := strings.SplitN(value, " ", 2)
-					if len(statusParts) > 0 {
-						var statusCode int
-						fmt.Sscanf(statusParts[0], "%d", &statusCode)
-						if statusCode > 0 {
-							w.WriteHeader(statusCode)
-						}
-					}
-				} else {
-					w.Header().Set(key, value)
-				}
-			}
+// writeResponse copies a parsed worker response to the client
+func writeResponse(w http.ResponseWriter, status int, headers http.Header, body io.Reader) {
+	for key, values := range headers {
+		for _, value := range values {
+			w.Header().Add(key, value)
 		}
-
-		// Write body
-		w.Write(responseData[headerEnd:])
-	} else {
-		// No headers, just write all output
-		w.Write(responseData)
 	}
-
-	// Increment request count
-	worker.IncrementRequestCount()
-
-	log.Printf("%s %s -> PHP worker (FastCGI: %s)", r.Method, r.URL.Path, fcgiAddress)
+	w.WriteHeader(status)
+	io.Copy(w, body)
 }
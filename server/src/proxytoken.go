@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// proxyTokenHeader carries the secret of a worker on the requests of the
+// proxy, workers.proxy_token has the instances reject requests without it
+const proxyTokenHeader = "X-TQServer-Proxy-Token"
+
+// newProxyToken returns a random secret for the instances of a worker
+func newProxyToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// setProxyToken sets the secret of an instance on a request to it, a value
+// sent by the client is never passed on
+func setProxyToken(header http.Header, token string) {
+	header.Del(proxyTokenHeader)
+	if token != "" {
+		header.Set(proxyTokenHeader, token)
+	}
+}
+
+// getHealth requests the health endpoint of an instance with its secret
+func getHealth(client *http.Client, url, proxyToken string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	setProxyToken(req.Header, proxyToken)
+	return client.Do(req)
+}
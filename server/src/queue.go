@@ -0,0 +1,182 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the queue section of a worker
+const (
+	defaultQueueSize      = 1000
+	defaultQueueMaxWaitMs = 30000
+)
+
+// What a full queue does with a new request, see queue.shed
+const (
+	queueShedReject = "reject" // Refuses the new request
+	queueShedOldest = "oldest" // Refuses the request waiting longest, queues the new one
+)
+
+// queueWaitSamples is the number of recent waits the percentiles are taken of
+const queueWaitSamples = 1024
+
+// requestQueue holds the requests of a worker that found no healthy
+// instance below its max_in_flight, in arrival order, until the dispatcher
+// hands them one. Its settings change in place on a configuration reload.
+type requestQueue struct {
+	ready       chan struct{} // Wakes the dispatcher when requests were queued or an instance freed up
+	maxInFlight atomic.Int64  // Requests per instance at most, 0 for no limit
+
+	mu      sync.Mutex
+	waiting []*WorkerRequest
+	size    int
+	maxWait time.Duration
+	shed    string
+	waits   []time.Duration // Ring of the recent waits
+	next    int             // Position in waits of the next wait
+}
+
+// newRequestQueue returns an empty queue with the default settings
+func newRequestQueue() *requestQueue {
+	q := &requestQueue{ready: make(chan struct{}, 1)}
+	q.configure(0, 0, 0, "")
+	return q
+}
+
+// configure sets the settings of the queue, zero values select the
+// defaults. Requests above a lowered size keep waiting.
+func (q *requestQueue) configure(size, maxWaitMs, maxInFlight int, shed string) {
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	if maxWaitMs <= 0 {
+		maxWaitMs = defaultQueueMaxWaitMs
+	}
+	if shed == "" {
+		shed = queueShedReject
+	}
+	q.maxInFlight.Store(int64(maxInFlight))
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.size, q.maxWait, q.shed = size, time.Duration(maxWaitMs)*time.Millisecond, shed
+	q.signal()
+}
+
+// push queues a request and reports whether it was queued. When the queue
+// is full the request waiting longest is shed instead, if so configured.
+func (q *requestQueue) push(req *WorkerRequest) bool {
+	q.mu.Lock()
+	if len(q.waiting) >= q.size {
+		if q.shed != queueShedOldest || len(q.waiting) == 0 {
+			q.mu.Unlock()
+			return false
+		}
+		oldest := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		oldest.Shed = true
+		oldest.ResponseChan <- nil
+	}
+	q.waiting = append(q.waiting, req)
+	q.mu.Unlock()
+	q.signal()
+	return true
+}
+
+// wake has the dispatcher retry the waiting requests, after an instance
+// finished a request or was added
+func (q *requestQueue) wake() {
+	if q.len() > 0 {
+		q.signal()
+	}
+}
+
+// signal wakes the dispatcher unless a wake is pending
+func (q *requestQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the request waiting longest, nil when none waits
+func (q *requestQueue) pop() *WorkerRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) == 0 {
+		return nil
+	}
+	req := q.waiting[0]
+	q.waiting[0] = nil
+	q.waiting = q.waiting[1:]
+	return req
+}
+
+// remove takes a request that gave up out of the queue, it reports false
+// when the request was already taken and gets a reply
+func (q *requestQueue) remove(req *WorkerRequest) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := slices.Index(q.waiting, req)
+	if i < 0 {
+		return false
+	}
+	q.waiting = slices.Delete(q.waiting, i, i+1)
+	return true
+}
+
+// len returns the number of waiting requests
+func (q *requestQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
+
+// full reports whether a new request would be refused
+func (q *requestQueue) full() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting) >= q.size && q.shed == queueShedReject
+}
+
+// limit returns the requests per instance at most, 0 for no limit
+func (q *requestQueue) limit() int64 {
+	return q.maxInFlight.Load()
+}
+
+// settings returns the size, the longest wait and the shed behavior
+func (q *requestQueue) settings() (int, time.Duration, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size, q.maxWait, q.shed
+}
+
+// observe records how long a request waited, with an instance or without
+func (q *requestQueue) observe(wait time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waits) < queueWaitSamples {
+		q.waits = append(q.waits, wait)
+		return
+	}
+	q.waits[q.next] = wait
+	q.next = (q.next + 1) % queueWaitSamples
+}
+
+// percentiles returns the waits at the percentiles of the recent waits and
+// the number of waits they are taken of, nil when no request waited yet
+func (q *requestQueue) percentiles(ps ...float64) ([]time.Duration, int) {
+	q.mu.Lock()
+	waits := slices.Clone(q.waits)
+	q.mu.Unlock()
+	if len(waits) == 0 {
+		return nil, 0
+	}
+	slices.Sort(waits)
+	result := make([]time.Duration, len(ps))
+	for i, p := range ps {
+		result[i] = waits[min(int(p*float64(len(waits))), len(waits)-1)]
+	}
+	return result, len(waits)
+}
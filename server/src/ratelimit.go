@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultAPIKeyHeader carries the API key when rate_limit.header is not set
+const defaultAPIKeyHeader = "X-API-Key"
+
+// anonymousConsumer is the consumer of requests without an API key, in
+// metrics and responses
+const anonymousConsumer = "anonymous"
+
+// apiConsumerHeader tells the worker the consumer of a request, a value
+// sent by the client is removed
+const apiConsumerHeader = "X-API-Consumer"
+
+// apiKeyFileCheck is how often the key file is checked for changes
+const apiKeyFileCheck = 2 * time.Second
+
+// apiBucketIdle is how long an anonymous client stays tracked after its
+// last request, when its tier has no daily quota
+const apiBucketIdle = time.Minute
+
+// apiConsumer is the owner of an API key
+type apiConsumer struct {
+	name string
+	tier string
+}
+
+// apiKeyTable maps the SHA-256 of API keys to their consumers
+type apiKeyTable map[[sha256.Size]byte]apiConsumer
+
+// newAPIKeyTable hashes the keys, invalid keys are skipped, they are
+// reported by ValidateConfig
+func newAPIKeyTable(keys []APIKey) apiKeyTable {
+	table := apiKeyTable{}
+	for _, key := range keys {
+		if hash, err := key.hash(); err == nil && key.Name != "" {
+			table[hash] = apiConsumer{name: key.Name, tier: key.Tier}
+		}
+	}
+	return table
+}
+
+// hash returns the SHA-256 of the key, given or computed
+func (k APIKey) hash() ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	switch {
+	case k.Key != "" && k.SHA256 != "":
+		return hash, fmt.Errorf("has both key and sha256")
+	case k.Key != "":
+		return sha256.Sum256([]byte(k.Key)), nil
+	case k.SHA256 != "":
+		decoded, err := hex.DecodeString(k.SHA256)
+		if err != nil || len(decoded) != sha256.Size {
+			return hash, fmt.Errorf("sha256 %q is not 64 hex digits", k.SHA256)
+		}
+		copy(hash[:], decoded)
+		return hash, nil
+	}
+	return hash, fmt.Errorf("key or sha256 is required")
+}
+
+// loadAPIKeyFile reads the keys of rate_limit.key_file
+func loadAPIKeyFile(path string) ([]APIKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Keys []APIKey `yaml:"keys"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return file.Keys, nil
+}
+
+// apiBucket is the usage of one consumer: a token bucket for the rate and
+// the requests of the day for the quota, which resets at local midnight
+type apiBucket struct {
+	tokens float64
+	last   time.Time
+	used   int64
+	day    string
+}
+
+// rateLimiter enforces the tiers of rate_limit. The usage outlives config
+// reloads, the key file is read again when it changes.
+type rateLimiter struct {
+	projectRoot string
+
+	mu        sync.Mutex
+	buckets   map[string]*apiBucket // By consumer name, anonymous clients by IP
+	lastSweep time.Time
+
+	file        string
+	fileMod     time.Time
+	fileChecked time.Time
+	fileKeys    apiKeyTable
+}
+
+func newRateLimiter(projectRoot string) *rateLimiter {
+	return &rateLimiter{projectRoot: projectRoot, buckets: map[string]*apiBucket{}}
+}
+
+// rateLimitError is the body of a rejected request
+type rateLimitError struct {
+	Error      string `json:"error"`
+	Message    string `json:"message"`
+	Consumer   string `json:"consumer,omitempty"`
+	Tier       string `json:"tier,omitempty"`
+	Limit      int64  `json:"limit,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+// limit applies the tier of the API key of a request to a worker. It sets
+// the quota headers and returns false after writing the rejection when the
+// request may not pass.
+func (l *rateLimiter) limit(w http.ResponseWriter, r *http.Request, cfg *Config, worker string) bool {
+	rl := cfg.RateLimit
+	if rl == nil || !rl.Enabled || (len(rl.Workers) > 0 && !slices.Contains(rl.Workers, worker)) {
+		return true
+	}
+	header := rl.Header
+	if header == "" {
+		header = defaultAPIKeyHeader
+	}
+	key := r.Header.Get(header)
+	r.Header.Del(apiConsumerHeader)
+
+	var consumer apiConsumer
+	bucketKey := ""
+	if key == "" {
+		if rl.Anonymous == "" {
+			GetMetrics().RecordAPIKeyRequest("", "", "unauthorized")
+			writeRateLimitError(w, http.StatusUnauthorized, rateLimitError{Error: "missing_api_key", Message: "An API key is required in the " + header + " header"})
+			return false
+		}
+		consumer = apiConsumer{name: anonymousConsumer, tier: rl.Anonymous}
+		bucketKey = anonymousConsumer + ":" + clientIP(r)
+	} else {
+		var ok bool
+		if consumer, ok = l.lookup(cfg, sha256.Sum256([]byte(key))); !ok {
+			GetMetrics().RecordAPIKeyRequest("", "", "unauthorized")
+			writeRateLimitError(w, http.StatusUnauthorized, rateLimitError{Error: "invalid_api_key", Message: "The API key is not valid"})
+			return false
+		}
+		bucketKey = consumer.name
+	}
+	tier, ok := rl.Tiers[consumer.tier]
+	if !ok {
+		GetMetrics().RecordAPIKeyRequest(consumer.name, consumer.tier, "unauthorized")
+		writeRateLimitError(w, http.StatusUnauthorized, rateLimitError{Error: "invalid_api_key", Message: "The API key has no valid tier", Consumer: consumer.name})
+		return false
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	l.sweep(now, rl)
+	b := l.buckets[bucketKey]
+	if b == nil {
+		b = &apiBucket{tokens: tier.burst(), last: now}
+		l.buckets[bucketKey] = b
+	}
+	if day := now.Format("2006-01-02"); day != b.day {
+		b.day = day
+		b.used = 0
+	}
+	if tier.RequestsPerSecond > 0 {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*tier.RequestsPerSecond, tier.burst())
+	}
+	b.last = now
+
+	result := "allowed"
+	var rejection *rateLimitError
+	switch {
+	case tier.DailyQuota > 0 && b.used >= tier.DailyQuota:
+		result = "quota_exceeded"
+		rejection = &rateLimitError{
+			Error:      result,
+			Message:    fmt.Sprintf("The daily quota of %d requests is used up", tier.DailyQuota),
+			Limit:      tier.DailyQuota,
+			RetryAfter: untilMidnight(now),
+		}
+	case tier.RequestsPerSecond > 0 && b.tokens < 1:
+		result = "rate_limited"
+		rejection = &rateLimitError{
+			Error:      result,
+			Message:    fmt.Sprintf("The rate limit of %g requests per second is exceeded", tier.RequestsPerSecond),
+			Limit:      int64(math.Ceil(tier.RequestsPerSecond)),
+			RetryAfter: int(math.Ceil((1 - b.tokens) / tier.RequestsPerSecond)),
+		}
+	default:
+		if tier.RequestsPerSecond > 0 {
+			b.tokens--
+		}
+		b.used++
+	}
+	used := b.used
+	l.mu.Unlock()
+
+	GetMetrics().RecordAPIKeyRequest(consumer.name, consumer.tier, result)
+	if consumer.name != anonymousConsumer {
+		GetMetrics().SetAPIKeyQuotaUsed(consumer.name, used)
+	}
+	if tier.DailyQuota > 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.FormatInt(tier.DailyQuota, 10))
+		w.Header().Set("X-RateLimit-Remaining", strconv.FormatInt(max(tier.DailyQuota-used, 0), 10))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(untilMidnight(now)))
+	}
+	if rejection == nil {
+		r.Header.Set(apiConsumerHeader, consumer.name)
+		return true
+	}
+	rejection.Consumer = consumer.name
+	rejection.Tier = consumer.tier
+	log.Printf("Rate limit: %s %s from %s (consumer %s, tier %s): %s", r.Method, r.URL.Path, clientIP(r), consumer.name, consumer.tier, result)
+	w.Header().Set("Retry-After", strconv.Itoa(max(rejection.RetryAfter, 1)))
+	writeRateLimitError(w, http.StatusTooManyRequests, *rejection)
+	return false
+}
+
+// lookup finds the consumer of a key hash, in the config first and then in
+// the key file
+func (l *rateLimiter) lookup(cfg *Config, hash [sha256.Size]byte) (apiConsumer, bool) {
+	if consumer, ok := cfg.apiKeys[hash]; ok {
+		return consumer, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reloadKeyFile(cfg.RateLimit.KeyFile)
+	consumer, ok := l.fileKeys[hash]
+	return consumer, ok
+}
+
+// reloadKeyFile reads the key file when it is new or changed, a file that
+// fails to load keeps the keys it had. Callers hold l.mu.
+func (l *rateLimiter) reloadKeyFile(path string) {
+	if path == "" {
+		l.file, l.fileKeys = "", nil
+		return
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(l.projectRoot, path)
+	}
+	now := time.Now()
+	if path == l.file && now.Sub(l.fileChecked) < apiKeyFileCheck {
+		return
+	}
+	l.fileChecked = now
+	info, err := os.Stat(path)
+	if err != nil {
+		if path != l.file {
+			log.Printf("Rate limit: key file: %v", err)
+			l.file, l.fileKeys = path, nil
+		}
+		return
+	}
+	if path == l.file && info.ModTime().Equal(l.fileMod) {
+		return
+	}
+	keys, err := loadAPIKeyFile(path)
+	l.file, l.fileMod = path, info.ModTime()
+	if err != nil {
+		log.Printf("Rate limit: key file not reloaded: %v", err)
+		return
+	}
+	l.fileKeys = newAPIKeyTable(keys)
+	log.Printf("Rate limit: loaded %d keys from %s", len(l.fileKeys), path)
+}
+
+// sweep forgets the anonymous clients that have nothing left to track,
+// once a minute. Callers hold l.mu.
+func (l *rateLimiter) sweep(now time.Time, rl *RateLimitConfig) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	day := now.Format("2006-01-02")
+	quota := rl.Tiers[rl.Anonymous].DailyQuota > 0
+	for key, b := range l.buckets {
+		if !strings.HasPrefix(key, anonymousConsumer+":") {
+			continue
+		}
+		if b.day != day || (!quota && now.Sub(b.last) > apiBucketIdle) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// burst returns the requests a tier allows at once
+func (t RateLimitTier) burst() float64 {
+	if t.Burst > 0 {
+		return float64(t.Burst)
+	}
+	return max(math.Ceil(t.RequestsPerSecond), 1)
+}
+
+// untilMidnight returns the seconds until the daily quotas reset
+func untilMidnight(now time.Time) int {
+	year, month, day := now.Date()
+	midnight := time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+	return int(math.Ceil(midnight.Sub(now).Seconds()))
+}
+
+// writeRateLimitError writes a rejected request as JSON
+func writeRateLimitError(w http.ResponseWriter, status int, body rateLimitError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/mevdschee/tqserver/pkg/cron"
+)
+
+// scheduleRecycle sets the timer of the next scheduled restart of a worker
+// after from, by its recycle setting, replacing the timer it had
+func (s *Supervisor) scheduleRecycle(w *Worker, from time.Time) {
+	var next time.Time
+	if workerMeta := s.getWorkerConfig(w.Name); workerMeta != nil && workerMeta.Config.Recycle != "" {
+		schedule, err := cron.Parse(workerMeta.Config.Recycle)
+		if err != nil {
+			log.Printf("Worker %s is not recycled: %v", w.Name, err)
+		} else {
+			next = schedule.Next(from)
+		}
+	}
+	w.mu.Lock()
+	w.NextRecycle = next
+	w.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := w.Name + "/recycle"
+	if t, ok := s.reloadTimers[key]; ok {
+		t.Stop()
+		delete(s.reloadTimers, key)
+	}
+	if !next.IsZero() {
+		s.reloadTimers[key] = time.AfterFunc(time.Until(next), func() {
+			s.recycleWorker(w, next)
+		})
+	}
+}
+
+// recycleWorker restarts a worker on its schedule, to clear slow leaks, with
+// a rolling restart. PHP pools are reloaded gracefully, whatever php.reload
+// says, for php-fpm to replace its processes.
+func (s *Supervisor) recycleWorker(w *Worker, scheduled time.Time) {
+	select {
+	case <-s.stopChan:
+		return
+	default:
+	}
+	// Removed or replaced since it was scheduled
+	if current, err := s.findWorker(w.Name); err != nil || current != w {
+		return
+	}
+	// The next one is counted from the scheduled time, the timer may fire
+	// early by the wall clock
+	s.scheduleRecycle(w, scheduled)
+	if w.IsDraining() {
+		log.Printf("Worker %s is drained, scheduled recycle skipped", w.Name)
+		return
+	}
+
+	log.Printf("Recycling worker %s on its schedule", w.Name)
+	s.events.Record(EventWorkerReloaded, w.Name, "", "scheduled recycle")
+	GetMetrics().RecordWorkerRestart(w.Name)
+	if w.Type == "php" {
+		err := s.reloadPHPPools(w, "graceful")
+		if err == nil {
+			return
+		}
+		log.Printf("PHP worker %s graceful reload failed, restarting: %v", w.Name, err)
+	}
+	s.rollingRestart(w)
+}
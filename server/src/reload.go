@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/json"
+	"html"
 	"log"
 	"net"
 	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -18,6 +25,10 @@ type wsConn struct {
 type ReloadBroadcaster struct {
 	clients map[*wsConn]bool
 	mu      sync.RWMutex
+
+	// state returns the current build failures and test runs, sent to new
+	// clients
+	state func() []reloadMessage
 }
 
 // NewReloadBroadcaster creates a new reload broadcaster
@@ -70,6 +81,15 @@ func (rb *ReloadBroadcaster) HandleWebSocket(w http.ResponseWriter, r *http.Requ
 	rb.mu.Lock()
 	rb.clients[wsConn] = true
 	clientCount := len(rb.clients)
+	// Pages opened during a failed build show it too
+	if rb.state != nil {
+		for _, msg := range rb.state() {
+			msg.Replay = true
+			if message, err := json.Marshal(msg); err == nil {
+				conn.Write(makeTextFrame(message))
+			}
+		}
+	}
 	rb.mu.Unlock()
 
 	log.Printf("WebSocket client connected (total: %d)", clientCount)
@@ -102,8 +122,84 @@ func (rb *ReloadBroadcaster) HandleWebSocket(w http.ResponseWriter, r *http.Requ
 	}
 }
 
-// BroadcastReload sends a reload message to all connected clients
-func (rb *ReloadBroadcaster) BroadcastReload() {
+// reloadMessage is a message to the live reload clients: a full "reload",
+// a changed public "css" or "asset" file that is swapped in place, a
+// "build-error" of a worker shown in an overlay until its "build-ok", or a
+// "test" run of a worker shown in a badge
+type reloadMessage struct {
+	Type   string `json:"type"`
+	Path   string `json:"path,omitempty"`   // URL path of the changed file
+	Route  string `json:"route,omitempty"`  // Route of the reloaded worker, all pages without
+	Worker string `json:"worker,omitempty"` // Worker of a build result
+	Status string `json:"status,omitempty"` // Of a test run: "running", "passed" or "failed"
+	Error  string `json:"error,omitempty"`  // Compiler or test output of a failure
+	Replay bool   `json:"replay,omitempty"` // Sent on connect, not a new failure
+}
+
+// swappableAssets are the extensions of public files that pages refresh
+// without reloading, by type of message
+var swappableAssets = map[string]string{
+	".css":   "css",
+	".png":   "asset",
+	".jpg":   "asset",
+	".jpeg":  "asset",
+	".gif":   "asset",
+	".svg":   "asset",
+	".webp":  "asset",
+	".avif":  "asset",
+	".ico":   "asset",
+	".woff":  "asset",
+	".woff2": "asset",
+	".ttf":   "asset",
+	".otf":   "asset",
+}
+
+// assetMessage returns the message for a changed public file served at
+// urlPath, scripts and documents need a full reload
+func assetMessage(urlPath string) reloadMessage {
+	kind, ok := swappableAssets[strings.ToLower(path.Ext(urlPath))]
+	if !ok {
+		return reloadMessage{Type: "reload"}
+	}
+	return reloadMessage{Type: kind, Path: urlPath}
+}
+
+// BroadcastReload tells all connected clients that the worker serving route
+// was reloaded, only the pages of that worker reload. An empty route
+// reloads all pages.
+func (rb *ReloadBroadcaster) BroadcastReload(route string) {
+	rb.broadcast(reloadMessage{Type: "reload", Route: route})
+}
+
+// BroadcastAsset tells all connected clients that the public file served at
+// urlPath changed
+func (rb *ReloadBroadcaster) BroadcastAsset(urlPath string) {
+	rb.broadcast(assetMessage(urlPath))
+}
+
+// BroadcastBuildResult tells all connected clients that a worker failed to
+// build, or built again after a failure
+func (rb *ReloadBroadcaster) BroadcastBuildResult(worker string, err error) {
+	if err != nil {
+		rb.broadcast(reloadMessage{Type: "build-error", Worker: worker, Error: err.Error()})
+		return
+	}
+	rb.broadcast(reloadMessage{Type: "build-ok", Worker: worker})
+}
+
+// BroadcastTestRun tells all connected clients that the tests of a worker
+// started or finished
+func (rb *ReloadBroadcaster) BroadcastTestRun(worker string, run *TestRun) {
+	rb.broadcast(testRunMessage(worker, run))
+}
+
+// testRunMessage returns the message for a test run of a worker
+func testRunMessage(worker string, run *TestRun) reloadMessage {
+	return reloadMessage{Type: "test", Worker: worker, Status: run.Status, Error: run.Output}
+}
+
+// broadcast sends a message to all connected clients
+func (rb *ReloadBroadcaster) broadcast(msg reloadMessage) {
 	rb.mu.Lock()
 	defer rb.mu.Unlock()
 
@@ -111,10 +207,12 @@ func (rb *ReloadBroadcaster) BroadcastReload() {
 		return
 	}
 
-	log.Printf("Broadcasting reload to %d client(s)", len(rb.clients))
+	log.Printf("Broadcasting %s to %d client(s)", msg.Type, len(rb.clients))
 
-	// Create WebSocket text frame with "reload" message
-	message := []byte("reload")
+	message, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
 	frame := makeTextFrame(message)
 
 	// Collect dead connections
@@ -122,7 +220,7 @@ func (rb *ReloadBroadcaster) BroadcastReload() {
 
 	for client := range rb.clients {
 		if _, err := client.conn.Write(frame); err != nil {
-			log.Printf("Failed to send reload message: %v", err)
+			log.Printf("Failed to send %s message: %v", msg.Type, err)
 			client.conn.Close()
 			deadClients = append(deadClients, client)
 		}
@@ -138,6 +236,92 @@ func (rb *ReloadBroadcaster) BroadcastReload() {
 	}
 }
 
+// reloadClientPath is the live reload client, served from server/public
+const reloadClientPath = "/dev-reload.js"
+
+// htmlRewriter changes the HTML responses of workers, like to add the live
+// reload client in dev mode. HTML is buffered to rewrite it at once, other
+// responses pass through.
+type htmlRewriter struct {
+	http.ResponseWriter
+	rewrite func(body []byte) []byte
+	status  int
+	decided bool // The response was found HTML or not
+	html    bool
+	buf     bytes.Buffer
+}
+
+// WriteHeader decides on the final status whether the response is HTML
+// that can be changed, compressed and partial responses are passed through
+func (hr *htmlRewriter) WriteHeader(status int) {
+	if hr.decided {
+		return
+	}
+	if status >= 100 && status < 200 && status != http.StatusSwitchingProtocols {
+		hr.ResponseWriter.WriteHeader(status)
+		return
+	}
+	hr.decided = true
+	header := hr.Header()
+	encoding := header.Get("Content-Encoding")
+	hr.html = status != http.StatusNoContent && status != http.StatusNotModified && status != http.StatusPartialContent &&
+		strings.HasPrefix(header.Get("Content-Type"), "text/html") && (encoding == "" || encoding == "identity")
+	if !hr.html {
+		hr.ResponseWriter.WriteHeader(status)
+		return
+	}
+	hr.status = status
+}
+
+// Write buffers HTML and writes anything else
+func (hr *htmlRewriter) Write(data []byte) (int, error) {
+	if !hr.decided {
+		hr.WriteHeader(http.StatusOK)
+	}
+	if hr.html {
+		return hr.buf.Write(data)
+	}
+	return hr.ResponseWriter.Write(data)
+}
+
+// Flush is delayed for HTML until the response is complete
+func (hr *htmlRewriter) Flush() {
+	if hr.decided && !hr.html {
+		http.NewResponseController(hr.ResponseWriter).Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection, to hijack it
+func (hr *htmlRewriter) Unwrap() http.ResponseWriter {
+	return hr.ResponseWriter
+}
+
+// finish writes the buffered HTML once rewritten
+func (hr *htmlRewriter) finish() {
+	if !hr.html {
+		return
+	}
+	body := hr.rewrite(hr.buf.Bytes())
+	hr.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	hr.ResponseWriter.WriteHeader(hr.status)
+	hr.ResponseWriter.Write(body)
+}
+
+// injectReloadClient adds the live reload client to a page before the last
+// </body>, or at the end without one. Pages loading the client already are
+// kept. The route of the worker tells the client which reloads apply.
+func injectReloadClient(body []byte, route string) []byte {
+	if bytes.Contains(body, []byte(reloadClientPath)) {
+		return body
+	}
+	tag := []byte(`<script src="` + reloadClientPath + `" data-route="` + html.EscapeString(route) + `"></script>`)
+	at := max(bytes.LastIndex(body, []byte("</body>")), bytes.LastIndex(body, []byte("</BODY>")))
+	if at < 0 {
+		at = len(body)
+	}
+	return slices.Concat(body[:at:at], tag, body[at:])
+}
+
 // computeAcceptKey computes the Sec-WebSocket-Accept key
 func computeAcceptKey(key string) string {
 	const magic = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
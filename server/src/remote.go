@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkRemoteAddress checks the "host:port" address of a remote instance
+func checkRemoteAddress(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return fmt.Errorf("%q is not a host:port address", addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%q: %s is not a port number (1-65535)", addr, port)
+	}
+	return nil
+}
+
+// remoteProtocol returns the protocol of the instances of a remote worker,
+// empty for HTTP
+func (s *Supervisor) remoteProtocol(w *Worker) string {
+	if workerMeta := s.getWorkerConfig(w.Name); workerMeta != nil && workerMeta.Config.Remote != nil && workerMeta.Config.Remote.Protocol != "http" {
+		return workerMeta.Config.Remote.Protocol
+	}
+	return ""
+}
+
+// remoteAddresses returns the instance addresses of a remote worker: those
+// in its config, then those registered through the API
+func (s *Supervisor) remoteAddresses(w *Worker) (configured, all []string) {
+	if workerMeta := s.getWorkerConfig(w.Name); workerMeta != nil && workerMeta.Config.Remote != nil {
+		configured = workerMeta.Config.Remote.Instances
+	}
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, addr := range slices.Concat(configured, w.Registered) {
+		if !slices.Contains(all, addr) {
+			all = append(all, addr)
+		}
+	}
+	return configured, all
+}
+
+// syncRemoteInstances adds and removes the instances of a remote worker to
+// match its addresses. New instances get requests once they pass a health
+// check, which runs right away.
+func (s *Supervisor) syncRemoteInstances(w *Worker) {
+	_, addrs := s.remoteAddresses(w)
+	protocol := s.remoteProtocol(w)
+
+	w.mu.Lock()
+	if w.Draining {
+		w.mu.Unlock()
+		return
+	}
+	var kept, removed, added []*WorkerInstance
+	for _, inst := range w.Instances {
+		// An instance registered again with or without a certificate
+		// request is replaced, like those of a changed protocol
+		if slices.Contains(addrs, inst.Addr()) && inst.TLS == slices.Contains(w.RegisteredTLS, inst.Addr()) && inst.Protocol == protocol {
+			kept = append(kept, inst)
+		} else {
+			removed = append(removed, inst)
+		}
+	}
+	for _, addr := range addrs {
+		if slices.ContainsFunc(kept, func(inst *WorkerInstance) bool { return inst.Addr() == addr }) {
+			continue
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		n, _ := strconv.Atoi(port)
+		inst := &WorkerInstance{
+			ID:        w.Name + "@" + addr,
+			Host:      host,
+			Port:      n,
+			TLS:       slices.Contains(w.RegisteredTLS, addr),
+			Protocol:  protocol,
+			StartTime: time.Now(),
+		}
+		kept = append(kept, inst)
+		added = append(added, inst)
+	}
+	w.Instances = kept
+	w.mu.Unlock()
+
+	for _, inst := range removed {
+		log.Printf("Remote instance %s of worker %s removed", inst.Addr(), w.Name)
+		s.events.Record(EventInstanceRemoved, w.Name, inst.ID, "%s", inst.Addr())
+	}
+	for _, inst := range added {
+		log.Printf("Remote instance %s of worker %s added, waiting for health...", inst.Addr(), w.Name)
+		s.events.Record(EventInstanceAdded, w.Name, inst.ID, "%s", inst.Addr())
+	}
+	if len(added) > 0 {
+		go s.checkRemoteHealth(w)
+	}
+}
+
+// checkRemoteHealth probes the /health endpoint of the instances of a
+// remote worker at once. An unhealthy instance gets no requests until it
+// passes again, it is restarted on its own host, not by the server.
+func (s *Supervisor) checkRemoteHealth(w *Worker) {
+	w.mu.RLock()
+	instances := slices.Clone(w.Instances)
+	w.mu.RUnlock()
+
+	timeout := s.config.GetHealthCheckTimeout()
+	metrics := GetMetrics()
+	results := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for i, inst := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			var err error
+			if inst.Protocol != "" {
+				err = checkGatewayHealth(inst, timeout)
+			} else {
+				mtls := s.instanceTLS(inst)
+				var resp *http.Response
+				if resp, err = mtls.client(timeout).Get(mtls.scheme() + "://" + inst.Addr() + "/health"); err == nil {
+					if resp.StatusCode != http.StatusOK {
+						err = fmt.Errorf("%s", resp.Status)
+					}
+					resp.Body.Close()
+				}
+			}
+			metrics.RecordHealthCheck(w.Name, time.Since(start), err == nil)
+			results[i] = err
+		}()
+	}
+	wg.Wait()
+
+	healthyCount := 0
+	for i, inst := range instances {
+		err := results[i]
+		w.mu.Lock()
+		wasHealthy := inst.Healthy
+		inst.Healthy = err == nil
+		w.mu.Unlock()
+		switch {
+		case err == nil:
+			healthyCount++
+			if !wasHealthy {
+				log.Printf("Remote instance %s of worker %s is healthy", inst.Addr(), w.Name)
+				w.Queue.wake()
+			}
+		case wasHealthy:
+			log.Printf("Remote instance %s of worker %s failed its health check, no requests until it passes: %v", inst.Addr(), w.Name, err)
+			s.events.Record(EventInstanceUnhealthy, w.Name, inst.ID, "health check of %s failed: %v", inst.Addr(), err)
+		}
+	}
+	metrics.UpdateWorkerMetrics(w.Name, len(instances), healthyCount, w.Queue.len(), healthyCount > 0)
+}
+
+// RegisterInstance adds a remote instance to a remote worker, for agents on
+// the machines that run them. With a PEM certificate request and
+// workers.mtls on, the instance is reached with mutual TLS and the server
+// certificate for its host is returned. It returns the addresses before and
+// after.
+func (s *Supervisor) RegisterInstance(name, addr string, csr []byte) (string, string, []byte, error) {
+	w, err := s.findWorker(name)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if w.Type != "remote" {
+		return "", "", nil, fmt.Errorf("%s workers start their own instances, only remote workers are registered", w.Type)
+	}
+	if err := checkRemoteAddress(addr); err != nil {
+		return "", "", nil, err
+	}
+	var cert []byte
+	if csr != nil {
+		if s.mtls == nil {
+			return "", "", nil, fmt.Errorf("workers.mtls is off, register %s without a csr", addr)
+		}
+		if protocol := s.remoteProtocol(w); protocol != "" {
+			return "", "", nil, fmt.Errorf("%s instances are not reached with mutual TLS, register %s without a csr", protocol, addr)
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		if cert, err = s.mtls.signRemote(name+"@"+addr, host, csr); err != nil {
+			return "", "", nil, err
+		}
+	}
+	_, before := s.remoteAddresses(w)
+	w.mu.Lock()
+	if !slices.Contains(before, addr) {
+		w.Registered = append(w.Registered, addr)
+	}
+	w.RegisteredTLS = slices.DeleteFunc(slices.Clone(w.RegisteredTLS), func(a string) bool { return a == addr })
+	if cert != nil {
+		w.RegisteredTLS = append(w.RegisteredTLS, addr)
+	}
+	w.mu.Unlock()
+	_, after := s.remoteAddresses(w)
+	s.syncRemoteInstances(w)
+	return strings.Join(before, ","), strings.Join(after, ","), cert, nil
+}
+
+// DeregisterInstance removes a remote instance registered through the API,
+// requests in flight on it finish. It returns the addresses before and
+// after.
+func (s *Supervisor) DeregisterInstance(name, addr string) (string, string, error) {
+	w, err := s.findWorker(name)
+	if err != nil {
+		return "", "", err
+	}
+	configured, before := s.remoteAddresses(w)
+	if slices.Contains(configured, addr) {
+		return "", "", fmt.Errorf("%s is in the config of worker %s, remove it there", addr, name)
+	}
+	w.mu.Lock()
+	i := slices.Index(w.Registered, addr)
+	if i >= 0 {
+		w.Registered = slices.Delete(slices.Clone(w.Registered), i, i+1)
+		w.RegisteredTLS = slices.DeleteFunc(slices.Clone(w.RegisteredTLS), func(a string) bool { return a == addr })
+	}
+	w.mu.Unlock()
+	if i < 0 {
+		return "", "", fmt.Errorf("%w %s of worker %s", errUnknownInstance, addr, name)
+	}
+	_, after := s.remoteAddresses(w)
+	s.syncRemoteInstances(w)
+	return strings.Join(before, ","), strings.Join(after, ","), nil
+}
+
+// remoteCertificate is the reply to a registration with a certificate
+// request: the server certificate of the instance and the CA that signed
+// it, which also signed the client certificate of the proxy
+type remoteCertificate struct {
+	Result      string `json:"result"`
+	Certificate string `json:"certificate"`
+	CA          string `json:"ca"`
+}
+
+// handleAPIInstances registers the remote instance in the "address" field
+// of a JSON body with a remote worker, with mutual TLS when the body has a
+// PEM certificate request in "csr". DELETE removes it.
+func (p *Proxy) handleAPIInstances(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var request struct {
+		Address string `json:"address"`
+		CSR     string `json:"csr"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Address == "" {
+		setAuditDetails(r, name, "", "")
+		http.Error(w, "invalid request body, address is required, like \"10.0.0.5:9000\"", http.StatusBadRequest)
+		return
+	}
+	if p.supervisor == nil {
+		controlError(w, errControlUnavailable)
+		return
+	}
+	target := name + "/" + request.Address
+	register := r.Method != http.MethodDelete
+	var before, after string
+	var cert []byte
+	var err error
+	if register {
+		var csr []byte
+		if request.CSR != "" {
+			csr = []byte(request.CSR)
+		}
+		before, after, cert, err = p.supervisor.RegisterInstance(name, request.Address, csr)
+	} else {
+		before, after, err = p.supervisor.DeregisterInstance(name, request.Address)
+	}
+	setAuditDetails(r, target, before, after)
+	if err != nil {
+		controlError(w, err)
+		return
+	}
+	if register {
+		result := fmt.Sprintf("%s registered with %s, routed to once healthy", request.Address, name)
+		if cert != nil {
+			writeJSON(w, remoteCertificate{Result: result, Certificate: string(cert), CA: string(p.supervisor.mtls.caPEM)})
+			return
+		}
+		writeJSON(w, controlResult{Result: result})
+		return
+	}
+	writeJSON(w, controlResult{Result: fmt.Sprintf("%s removed from %s", request.Address, name)})
+}
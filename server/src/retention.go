@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// keptBinaryLayout is the build time in the name of a previous binary of a
+// Go worker, like bin/api.20261017-101203
+const keptBinaryLayout = "20060102-150405"
+
+// keptBinary is a previous binary of a Go worker
+type keptBinary struct {
+	path  string
+	built time.Time
+}
+
+// keepPreviousBinary copies the binary of a Go worker before it is rebuilt,
+// when previous binaries are kept. Not in dev mode, where every save builds.
+func (s *Supervisor) keepPreviousBinary(w *Worker) {
+	if s.config.IsDevelopmentMode() || s.config.Workers.KeepBinaries == 0 {
+		return
+	}
+	binary := filepath.Join(s.workerDir(w.Name), "bin", w.Name)
+	info, err := os.Stat(binary)
+	if err != nil {
+		return
+	}
+	kept := binary + "." + info.ModTime().Format(keptBinaryLayout)
+	if _, err := os.Stat(kept); err == nil {
+		return
+	}
+	if err := copyBinary(binary, kept); err != nil {
+		log.Printf("Failed to keep the previous binary of worker %s: %v", w.Name, err)
+	}
+}
+
+// keptBinaries returns the previous binaries of a Go worker, newest first
+func keptBinaries(binDir, name string) []keptBinary {
+	entries, err := os.ReadDir(binDir)
+	if err != nil {
+		return nil
+	}
+	var kept []keptBinary
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), name+".")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		built, err := time.ParseInLocation(keptBinaryLayout, stamp, time.Local)
+		if err != nil {
+			continue
+		}
+		kept = append(kept, keptBinary{path: filepath.Join(binDir, entry.Name()), built: built})
+	}
+	slices.SortFunc(kept, func(a, b keptBinary) int { return b.built.Compare(a.built) })
+	return kept
+}
+
+// cleanupBinaries removes the previous binaries of a Go worker beyond
+// keep_binaries or older than binary_max_age_hours. The binary the instances
+// run and the last-known-good one are never removed, also not when a kept
+// binary is the same file.
+func (s *Supervisor) cleanupBinaries(w *Worker) {
+	binDir := filepath.Join(s.workerDir(w.Name), "bin")
+	var protected []os.FileInfo
+	for _, path := range []string{filepath.Join(binDir, w.Name), filepath.Join(binDir, w.Name+goodBinarySuffix)} {
+		if info, err := os.Stat(path); err == nil {
+			protected = append(protected, info)
+		}
+	}
+
+	maxAge := time.Duration(s.config.Workers.BinaryMaxAgeHours) * time.Hour
+	removed := 0
+	for i, kept := range keptBinaries(binDir, w.Name) {
+		if i < s.config.Workers.KeepBinaries && (maxAge == 0 || time.Since(kept.built) <= maxAge) {
+			continue
+		}
+		info, err := os.Stat(kept.path)
+		if err != nil || slices.ContainsFunc(protected, func(p os.FileInfo) bool { return os.SameFile(p, info) }) {
+			continue
+		}
+		if err := os.Remove(kept.path); err != nil {
+			log.Printf("Failed to remove previous binary %s: %v", kept.path, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Removed %d previous binary(s) of worker %s", removed, w.Name)
+	}
+}
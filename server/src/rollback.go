@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// goodBinarySuffix is appended to the binary of a Go worker for its
+// last-known-good copy, kept next to it across restarts of the server
+const goodBinarySuffix = ".good"
+
+// rollbackGuard tracks the Go workers whose binary was deployed within the
+// rollback window. A binary that stays up for the window becomes the
+// last-known-good one, a crash loop or flapping health checks within it
+// restore the previous one.
+type rollbackGuard struct {
+	mu        sync.Mutex
+	probation map[string]*time.Timer // By worker
+}
+
+func newRollbackGuard() *rollbackGuard {
+	return &rollbackGuard{probation: make(map[string]*time.Timer)}
+}
+
+// start puts a worker on probation, after window keep is called
+func (g *rollbackGuard) start(worker string, window time.Duration, keep func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if t, ok := g.probation[worker]; ok {
+		t.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(window, func() {
+		g.mu.Lock()
+		current := g.probation[worker] == timer
+		if current {
+			delete(g.probation, worker)
+		}
+		g.mu.Unlock()
+		if current {
+			keep()
+		}
+	})
+	g.probation[worker] = timer
+}
+
+// end takes a worker off probation and reports whether it was on it
+func (g *rollbackGuard) end(worker string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	t, ok := g.probation[worker]
+	if ok {
+		t.Stop()
+		delete(g.probation, worker)
+	}
+	return ok
+}
+
+// startProbation watches a Go worker after a build of its binary was
+// started, when rollbacks are enabled
+func (s *Supervisor) startProbation(w *Worker) {
+	window := s.config.RollbackWindow()
+	if window == 0 || w.Type != "go" {
+		return
+	}
+	s.rollbacks.start(w.Name, window, func() {
+		binary := filepath.Join(s.workerDir(w.Name), "bin", w.Name)
+		if err := copyBinary(binary, binary+goodBinarySuffix); err != nil {
+			log.Printf("Failed to keep the binary of worker %s: %v", w.Name, err)
+			return
+		}
+		log.Printf("Worker %s stayed up for %s, binary kept as last-known-good", w.Name, window)
+	})
+}
+
+// handleRollbackEvent rolls back a worker on probation that crash-loops or
+// flaps, events are delivered without blocking
+func (s *Supervisor) handleRollbackEvent(event Event) {
+	if event.Type != EventCrashLoop && event.Type != EventHealthFlapping {
+		return
+	}
+	if !s.rollbacks.end(event.Worker) {
+		return
+	}
+	go s.rollbackWorker(event.Worker, fmt.Sprintf("%s: %s", event.Type, event.Message))
+}
+
+// rollbackWorker restores the last-known-good binary of a worker that failed
+// after a deploy and restarts its instances on it
+func (s *Supervisor) rollbackWorker(name, reason string) {
+	var worker *Worker
+	for _, w := range s.router.GetAllWorkers() {
+		if w.Name == name {
+			worker = w
+		}
+	}
+	if worker == nil {
+		return
+	}
+	binary := filepath.Join(s.workerDir(name), "bin", name)
+	if _, err := os.Stat(binary + goodBinarySuffix); err != nil {
+		log.Printf("Worker %s failed after its deploy (%s), no last-known-good binary to roll back to", name, reason)
+		return
+	}
+	if err := copyBinary(binary+goodBinarySuffix, binary); err != nil {
+		log.Printf("Failed to roll back worker %s: %v", name, err)
+		return
+	}
+	log.Printf("⏪ Rolled back worker %s to its last-known-good binary after %s", name, reason)
+	s.events.Record(EventWorkerRolledBack, name, "", "%s", reason)
+	GetMetrics().RecordWorkerRollback(name)
+
+	// The dispatcher starts new instances on the restored binary
+	s.stopWorker(worker)
+}
+
+// copyBinary copies an executable through a temporary file, running
+// instances keep the file they were started from
+func copyBinary(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0755); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"log"
+	"math/rand/v2"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/mevdschee/tqserver/pkg/fastcgi"
+	"github.com/mevdschee/tqserver/pkg/phpfpm"
 )
 
 // WorkerInstance represents a single process instance of a worker service
@@ -15,40 +22,174 @@ type WorkerInstance struct {
 	Port        int
 	Process     *os.Process
 	StartTime   time.Time
-	LastRequest time.Time
+	lastRequest atomic.Int64 // Unix nanoseconds, see LastRequest
+	Requests    int64        // Requests picked for it, updated atomically
+	Active      int64        // Requests in flight, updated atomically
 	Healthy     bool
+	Draining    bool // Removed from the pool, stopped once idle
+
+	// Container instances are stopped through the runtime CLI
+	ContainerName    string
+	ContainerRuntime string
+
+	// Delve listens here for a debugged Go instance, see go.debug
+	DebugPort int
+
+	// Host of a "remote" instance, which runs on another machine, reached
+	// with mutual TLS when its agent registered it with a certificate
+	// request
+	Host string
+	TLS  bool
+
+	// Protocol of a "remote" instance, "scgi" or "uwsgi", empty for HTTP
+	Protocol string
+
+	// Secret the proxy sends to the instance, empty when not required
+	ProxyToken string
+}
+
+// Addr returns the address the instance listens on
+func (inst *WorkerInstance) Addr() string {
+	host := inst.Host
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(inst.Port))
+}
+
+// LastRequest returns when the instance was last picked for a request, zero
+// when it never was
+func (inst *WorkerInstance) LastRequest() time.Time {
+	if ns := inst.lastRequest.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
 }
 
-// WorkerRequest represents a request for a worker instance
+// WorkerRequest represents a request that found no healthy instance and
+// waits for the dispatcher to start one
 type WorkerRequest struct {
 	ResponseChan chan *WorkerInstance
+	Shed         bool // Refused by a full queue, set before the nil reply
 }
 
 // Worker represents a worker service (load balancer)
 type Worker struct {
 	Name string // Worker name
 	Path string // URL route
-	Type string // Worker type: "go", "bun", "php"
+	Type string // Worker type: "go", "bun", "php", "container", "wasm", "remote"
 
 	// Cluster state
-	Instances    []*WorkerInstance
-	NextInstance int                 // Round robin index
-	Queue        chan *WorkerRequest // Request queue
+	Instances []*WorkerInstance
+	next      atomic.Uint64 // Round robin position of pickInstance
+	Queue     *requestQueue // Requests waiting for an instance
+	starting  atomic.Bool   // An emergency scale up for the queue runs
 
 	// Configuration (snapshot)
 	MinWorkers     int
 	MaxWorkers     int
 	QueueThreshold int
 	ScaleDownDelay int
+	PathTemplates  []string // Metrics labels for paths below the route
+
+	// Manual scaling override: this many instances until PinnedUntil, the
+	// autoscaler is ignored meanwhile (0 = none)
+	Pinned      int
+	PinnedUntil time.Time
+
+	// Next scheduled rolling restart, see recycle (zero when none)
+	NextRecycle time.Time
+
+	// Drain: no requests are routed while Draining, DrainingInstances are
+	// removed from the pool and stopped once their requests finished
+	Draining          bool
+	DrainingInstances []*WorkerInstance
+	Active            int64 // Requests in flight, updated atomically
+
+	// Closed when the worker is removed from the config, ends its dispatcher
+	stopped chan struct{}
 
 	// Health & Status
 	HasBuildError bool
 	BuildError    string
+	BuildTime     time.Time // When the last build finished
 	RequestCount  int64
 
+	// Last test run in dev mode, see test.on_change
+	Tests       *TestRun
+	cancelTests context.CancelFunc
+
+	// Recent output of the instances and php-fpm, for "tqserver ctl logs"
+	Logs *logTail
+
+	// Compiled module for "wasm" workers
+	Wasm *WasmModule
+
+	// Instance addresses of a "remote" worker registered through the API,
+	// next to those in its config, and those with a certificate of the
+	// server
+	Registered    []string
+	RegisteredTLS []string
+
+	// php-fpm pools of "php" workers, the default pool and those selected by path
+	PHPPools []*PHPPool
+	// Rewrites and script lookup of "php" workers
+	PHPRewriter *phpfpm.Rewriter
+	PHPTryFiles []string
+
+	// Secret of the instances, they reject requests without it when
+	// workers.proxy_token is on
+	ProxyToken string
+
 	mu sync.RWMutex
 }
 
+// PHPPool is a php-fpm pool of a "php" worker
+type PHPPool struct {
+	Name  string   // Empty for the default pool
+	Paths []string // Path patterns below the route served by this pool
+
+	// Pooled FastCGI client
+	Client *fastcgi.Client
+	// Slow request traces, if a slowlog is enabled
+	Slowlog *phpfpm.SlowlogTail
+	// Follows the php-fpm error log into the log tail of the worker
+	ErrorLog *phpfpm.LogTail
+	// Limits of php-fpm, nil without
+	Confine *confinement
+}
+
+func (p *PHPPool) close() {
+	p.Client.Close()
+	if p.Slowlog != nil {
+		p.Slowlog.Stop()
+	}
+	if p.ErrorLog != nil {
+		p.ErrorLog.Stop()
+	}
+}
+
+// PHPPoolFor returns the pool serving a request path below the route: the
+// first pool with a matching path pattern, otherwise the default pool
+func (w *Worker) PHPPoolFor(requestPath string) *PHPPool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	var defaultPool *PHPPool
+	for _, pool := range w.PHPPools {
+		if pool.Name == "" {
+			defaultPool = pool
+			continue
+		}
+		for _, pattern := range pool.Paths {
+			if phpfpm.MatchPath(pattern, requestPath) {
+				return pool
+			}
+		}
+	}
+	return defaultPool
+}
+
 // IsHealthy checks if the worker service has at least one healthy instance
 func (w *Worker) IsHealthy() bool {
 	w.mu.RLock()
@@ -74,22 +215,120 @@ func (w *Worker) IsHealthy() bool {
 	return false
 }
 
+// MetricsPath returns the label of a request path in the request metrics:
+// the route followed by the first path template matching the path below
+// it, or just the route. Raw paths would give every ID its own series.
+func (w *Worker) MetricsPath(requestPath string) string {
+	route := strings.TrimSuffix(w.Path, "/")
+	below := "/" + strings.TrimPrefix(strings.TrimPrefix(requestPath, route), "/")
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, template := range w.PathTemplates {
+		if matchPathTemplate(template, below) {
+			return route + template
+		}
+	}
+	return w.Path
+}
+
+// matchPathTemplate matches a path against a template in which a "{name}"
+// segment matches any single segment and a trailing "/*" any remainder
+func matchPathTemplate(template, requestPath string) bool {
+	base, wildcard := strings.CutSuffix(template, "/*")
+	want := strings.Split(base, "/")
+	got := strings.Split(requestPath, "/")
+	if len(got) < len(want) || !wildcard && len(got) != len(want) {
+		return false
+	}
+	for i, segment := range want {
+		isParam := strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+		if isParam && got[i] == "" || !isParam && segment != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pickInstance returns a healthy instance for a request, counted as active,
+// or nil when there is none below the max_in_flight of the queue or the
+// worker drains. Of the next instance in round robin order and a random
+// one, the one with fewer requests in flight is picked: the power of two
+// choices, without a lock held across requests.
+func (w *Worker) pickInstance() *WorkerInstance {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	n := len(w.Instances)
+	if w.Draining || n == 0 {
+		return nil
+	}
+	// Remote instances stay in the pool while they fail their health
+	// checks, instances at the limit wait for a request to finish
+	limit := w.Queue.limit()
+	available := func(inst *WorkerInstance) bool {
+		return inst.Healthy && (limit == 0 || atomic.LoadInt64(&inst.Active) < limit)
+	}
+	var instance *WorkerInstance
+	start := int(w.next.Add(1) % uint64(n))
+	for i := range n {
+		if candidate := w.Instances[(start+i)%n]; available(candidate) {
+			instance = candidate
+			break
+		}
+	}
+	if instance == nil {
+		return nil
+	}
+	if other := w.Instances[rand.IntN(n)]; available(other) && atomic.LoadInt64(&other.Active) < atomic.LoadInt64(&instance.Active) {
+		instance = other
+	}
+	// Counted under the lock, so a drain cannot stop the instance before
+	// the request reaches it. A concurrent request may have taken the
+	// last place below the limit meanwhile.
+	for {
+		active := atomic.LoadInt64(&instance.Active)
+		if limit > 0 && active >= limit {
+			return nil
+		}
+		if atomic.CompareAndSwapInt64(&instance.Active, active, active+1) {
+			break
+		}
+	}
+	atomic.AddInt64(&instance.Requests, 1)
+	instance.lastRequest.Store(time.Now().UnixNano())
+	return instance
+}
+
+// releaseInstance ends a request picked by pickInstance, a request waiting
+// in the queue may take its place
+func (w *Worker) releaseInstance(instance *WorkerInstance) {
+	atomic.AddInt64(&instance.Active, -1)
+	w.Queue.wake()
+}
+
 // IncrementRequestCount increments the global request counter
 func (w *Worker) IncrementRequestCount() int64 {
 	return atomic.AddInt64(&w.RequestCount, 1)
 }
 
+// IsDraining reports whether the worker is drained, requests are refused
+func (w *Worker) IsDraining() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.Draining
+}
+
 // GetStats returns current worker stats
 func (w *Worker) GetStats() (int, int, int64) {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
-	return len(w.Instances), len(w.Queue), w.RequestCount
+	return len(w.Instances), w.Queue.len(), w.RequestCount
 }
 
 // SetBuildError sets the build error status and message
 func (w *Worker) SetBuildError(err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	w.BuildTime = time.Now()
 	if err != nil {
 		w.HasBuildError = true
 		w.BuildError = err.Error()
@@ -106,6 +345,50 @@ func (w *Worker) GetBuildError() (bool, string) {
 	return w.HasBuildError, w.BuildError
 }
 
+// TestRun is a run of the tests of a worker, replaced when it finishes
+type TestRun struct {
+	Status   string // "running", "passed" or "failed"
+	Output   string // The end of the output of a failed run
+	Started  time.Time
+	Finished time.Time
+}
+
+// startTestRun records a new test run, a run still going is cancelled
+func (w *Worker) startTestRun(cancel context.CancelFunc) *TestRun {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancelTests != nil {
+		w.cancelTests()
+	}
+	w.cancelTests = cancel
+	w.Tests = &TestRun{Status: "running", Started: time.Now()}
+	return w.Tests
+}
+
+// finishTestRun records the outcome of a test run, unless a newer run
+// replaced it
+func (w *Worker) finishTestRun(run *TestRun, passed bool, output string) (*TestRun, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.Tests != run {
+		return nil, false
+	}
+	finished := &TestRun{Status: "passed", Started: run.Started, Finished: time.Now()}
+	if !passed {
+		finished.Status = "failed"
+		finished.Output = output
+	}
+	w.Tests, w.cancelTests = finished, nil
+	return finished, true
+}
+
+// GetTestRun returns the last test run, nil before the first
+func (w *Worker) GetTestRun() *TestRun {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.Tests
+}
+
 // Router manages routing from URL paths to workers
 type Router struct {
 	workersDir    string
@@ -199,6 +482,17 @@ func (r *Router) UpdateWorker(route string, worker *Worker) {
 	r.workers[route] = worker
 }
 
+// UnregisterWorker removes a worker from its route
+func (r *Router) UnregisterWorker(worker *Worker) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.workers[worker.Path] == worker {
+		delete(r.workers, worker.Path)
+		log.Printf("Unregistered worker: %s -> %s", worker.Path, worker.Name)
+	}
+}
+
 // hasGoSourceFiles checks if a directory contains .go files
 func hasGoSourceFiles(dir string) (bool, error) {
 	entries, err := os.ReadDir(dir)
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// containerSecretsDir is where the secret files of a container instance
+// are mounted
+const containerSecretsDir = "/run/tqserver-secrets"
+
+// secretFiles writes the secret_files of the worker instances, each
+// instance to its own directory that is removed when it exits. The files
+// live in memory where the system has a place for it.
+type secretFiles struct {
+	dir string
+
+	mu      sync.Mutex
+	created bool
+}
+
+// newSecretFiles returns the secret files of the server of a project, in
+// base or by default in XDG_RUNTIME_DIR or /dev/shm
+func newSecretFiles(base, projectRoot string) *secretFiles {
+	if base == "" {
+		base = defaultSecretFilesBase()
+	} else if !filepath.IsAbs(base) {
+		base = filepath.Join(projectRoot, base)
+	}
+	hash := sha256.Sum256([]byte(projectRoot))
+	return &secretFiles{dir: filepath.Join(base, "tqserver-secrets-"+hex.EncodeToString(hash[:8]))}
+}
+
+// defaultSecretFilesBase returns a tmpfs directory when there is one, the
+// temporary directory otherwise
+func defaultSecretFilesBase() string {
+	for _, dir := range []string{os.Getenv("XDG_RUNTIME_DIR"), "/dev/shm"} {
+		if info, err := os.Stat(dir); dir != "" && err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return os.TempDir()
+}
+
+// write writes the files of an instance and returns their directory. The
+// directory of the server is created on first use, one left by a previous
+// run is removed. It must be created by the server, not found.
+func (f *secretFiles) write(workerName string, port int, files map[string]string) (string, error) {
+	f.mu.Lock()
+	if !f.created {
+		os.RemoveAll(f.dir)
+		if err := os.Mkdir(f.dir, 0700); err != nil {
+			f.mu.Unlock()
+			return "", fmt.Errorf("failed to create the secret files directory: %w", err)
+		}
+		f.created = true
+	}
+	f.mu.Unlock()
+
+	dir := filepath.Join(f.dir, fmt.Sprintf("%s-%d", workerName, port))
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", err
+	}
+	for name, value := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0400); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("failed to write secret file %s: %w", name, err)
+		}
+	}
+	return dir, nil
+}
+
+// close removes the files of all instances
+func (f *secretFiles) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.created {
+		os.RemoveAll(f.dir)
+		f.created = false
+	}
+}
+
+// secretFilesEnv returns the variables that point an instance at its secret
+// files, in dir as the instance sees it
+func secretFilesEnv(files map[string]string, dir string) []string {
+	var env []string
+	for name := range files {
+		env = append(env, name+"="+filepath.Join(dir, name))
+	}
+	sort.Strings(env)
+	return env
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretTimeout limits the commands and Vault requests that resolve secrets
+const secretTimeout = 10 * time.Second
+
+// secretMinLength is the length from which resolved values are redacted,
+// shorter values would mask unrelated text
+const secretMinLength = 4
+
+// secretPattern matches references like "${secret:db_password}"
+var secretPattern = regexp.MustCompile(`\$\{secret:([A-Za-z0-9_.-]+)\}`)
+
+// SecretConfig is the source of a secret, exactly one must be set
+type SecretConfig struct {
+	File    string             `yaml:"file"`    // Contents of a file, without the trailing newline
+	Command string             `yaml:"command"` // Output of a shell command, without the trailing newline
+	Env     string             `yaml:"env"`     // Environment variable of the server
+	Vault   *VaultSecretConfig `yaml:"vault"`
+	SOPS    *SOPSSecretConfig  `yaml:"sops"`
+	Default *string            `yaml:"default"` // Used when the source is empty or missing
+}
+
+// check requires a single source
+func (c SecretConfig) check() error {
+	sources := 0
+	for _, set := range []bool{c.File != "", c.Command != "", c.Env != "", c.Vault != nil, c.SOPS != nil} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("exactly one of file, command, env, vault or sops is required")
+	}
+	return nil
+}
+
+// VaultSecretConfig reads a field of a HashiCorp Vault KV secret
+type VaultSecretConfig struct {
+	Address   string `yaml:"address"`    // Default: VAULT_ADDR
+	Path      string `yaml:"path"`       // e.g. "secret/data/app" (KV v2) or "secret/app" (KV v1)
+	Field     string `yaml:"field"`      // Key within the secret
+	TokenFile string `yaml:"token_file"` // Default: VAULT_TOKEN, then ~/.vault-token
+}
+
+// SOPSSecretConfig reads a value from a SOPS encrypted file, decrypted with
+// the sops binary
+type SOPSSecretConfig struct {
+	File string `yaml:"file"`
+	Key  string `yaml:"key"` // Dotted path, e.g. "database.password"
+}
+
+// SecretStore resolves the secrets referenced in config files, each once.
+// Paths and commands are relative to the working directory, the project
+// root.
+type SecretStore struct {
+	configs map[string]SecretConfig
+	mu      sync.Mutex
+	values  map[string]string
+}
+
+// NewSecretStore creates a store for the configured secrets
+func NewSecretStore(configs map[string]SecretConfig) *SecretStore {
+	return &SecretStore{configs: configs, values: map[string]string{}}
+}
+
+// secretsFromNode creates the store for the "secrets" section of a server
+// config tree, before the rest of the tree is decoded
+func secretsFromNode(root *yaml.Node) (*SecretStore, error) {
+	configs := map[string]SecretConfig{}
+	if root != nil && root.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value == "secrets" {
+				if err := root.Content[i+1].Decode(&configs); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return NewSecretStore(configs), nil
+}
+
+// Resolve returns the value of a secret, resolving it on first use
+func (s *SecretStore) Resolve(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value, ok := s.values[name]; ok {
+		return value, nil
+	}
+	cfg, ok := s.configs[name]
+	if !ok {
+		return "", fmt.Errorf("secret %q is not defined", name)
+	}
+	value, err := s.fetch(cfg)
+	if err == nil && value == "" && cfg.Default == nil {
+		err = fmt.Errorf("is empty")
+	}
+	if err != nil {
+		if cfg.Default == nil {
+			return "", fmt.Errorf("secret %q: %w", name, err)
+		}
+		value = *cfg.Default
+	}
+	s.values[name] = value
+	addRedaction(value)
+	return value, nil
+}
+
+// fetch reads a secret from its source
+func (s *SecretStore) fetch(cfg SecretConfig) (string, error) {
+	if err := cfg.check(); err != nil {
+		return "", err
+	}
+
+	switch {
+	case cfg.File != "":
+		data, err := os.ReadFile(cfg.File)
+		return strings.TrimRight(string(data), "\r\n"), err
+	case cfg.Command != "":
+		return s.run("sh", "-c", cfg.Command)
+	case cfg.Env != "":
+		return os.Getenv(cfg.Env), nil
+	case cfg.Vault != nil:
+		return s.fetchVault(cfg.Vault)
+	default:
+		if cfg.SOPS.File == "" || cfg.SOPS.Key == "" {
+			return "", fmt.Errorf("sops: file and key are required")
+		}
+		extract := ""
+		for _, part := range strings.Split(cfg.SOPS.Key, ".") {
+			extract += fmt.Sprintf("[%q]", part)
+		}
+		return s.run("sops", "--decrypt", "--extract", extract, cfg.SOPS.File)
+	}
+}
+
+// run returns the output of a command, with its error output on failure
+func (s *SecretStore) run(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %w: %s", name, err, msg)
+		}
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// fetchVault reads a field of a KV secret over the Vault HTTP API
+func (s *SecretStore) fetchVault(cfg *VaultSecretConfig) (string, error) {
+	address := cfg.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" || cfg.Path == "" || cfg.Field == "" {
+		return "", fmt.Errorf("vault: address (or VAULT_ADDR), path and field are required")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	tokenFile := cfg.TokenFile
+	if tokenFile == "" && token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			tokenFile = filepath.Join(home, ".vault-token")
+		}
+	}
+	if tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("vault: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+	url := strings.TrimRight(address, "/") + "/v1/" + strings.TrimLeft(cfg.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault: %s: %s", cfg.Path, resp.Status)
+	}
+
+	// KV v2 nests the fields in data.data, KV v1 has them in data
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("vault: %w", err)
+	}
+	fields := secret.Data
+	if nested, ok := fields["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := fields["metadata"]; hasMetadata {
+			fields = nested
+		}
+	}
+	value, ok := fields[cfg.Field]
+	if !ok {
+		return "", fmt.Errorf("vault: %s has no field %q", cfg.Path, cfg.Field)
+	}
+	if str, ok := value.(string); ok {
+		return str, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// resolveNode replaces the secret references in the string values of a
+// config tree, the top-level "secrets" section itself is skipped
+func (s *SecretStore) resolveNode(root *yaml.Node) error {
+	if root.Kind != yaml.MappingNode {
+		return s.resolveValue(root)
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "secrets" {
+			continue
+		}
+		if err := s.resolveValue(root.Content[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveValue replaces the secret references in a value and its children
+func (s *SecretStore) resolveValue(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		for _, child := range node.Content {
+			if err := s.resolveValue(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !strings.Contains(node.Value, "${secret:") {
+		return nil
+	}
+	var resolveErr error
+	node.Value = secretPattern.ReplaceAllStringFunc(node.Value, func(ref string) string {
+		value, err := s.Resolve(secretPattern.FindStringSubmatch(ref)[1])
+		if err != nil && resolveErr == nil {
+			resolveErr = fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		return value
+	})
+	if _, err := strconv.ParseFloat(node.Value, 64); err == nil || node.Value == "true" || node.Value == "false" {
+		// Numbers and booleans also decode into typed settings, e.g. a port
+		node.Tag, node.Style = "", 0
+	}
+	return resolveErr
+}
+
+// redactions are the resolved secret values, longest first
+var redactions struct {
+	sync.RWMutex
+	values []string
+}
+
+// addRedaction masks a value in logs and admin API responses from now on
+func addRedaction(value string) {
+	if len(value) < secretMinLength {
+		return
+	}
+	redactions.Lock()
+	defer redactions.Unlock()
+	for _, v := range redactions.values {
+		if v == value {
+			return
+		}
+	}
+	redactions.values = append(redactions.values, value)
+	sort.Slice(redactions.values, func(i, j int) bool {
+		return len(redactions.values[i]) > len(redactions.values[j])
+	})
+}
+
+// redactSecrets masks the resolved secret values in a text
+func redactSecrets(text string) string {
+	redactions.RLock()
+	defer redactions.RUnlock()
+	for _, value := range redactions.values {
+		text = strings.ReplaceAll(text, value, "[redacted]")
+	}
+	return text
+}
+
+// redactingWriter masks the resolved secret values in what it writes
+type redactingWriter struct {
+	w io.Writer
+}
+
+// Write writes the masked text, reporting the length of p on success
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write([]byte(redactSecrets(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
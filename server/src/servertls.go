@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// clientCertFields are the values of a client certificate that can be
+// forwarded to the workers in a header, see server.tls.client_headers
+var clientCertFields = map[string]func(cert *x509.Certificate) string{
+	"subject":     func(cert *x509.Certificate) string { return cert.Subject.String() },
+	"subject.cn":  func(cert *x509.Certificate) string { return cert.Subject.CommonName },
+	"subject.o":   func(cert *x509.Certificate) string { return strings.Join(cert.Subject.Organization, ",") },
+	"subject.ou":  func(cert *x509.Certificate) string { return strings.Join(cert.Subject.OrganizationalUnit, ",") },
+	"issuer":      func(cert *x509.Certificate) string { return cert.Issuer.String() },
+	"serial":      func(cert *x509.Certificate) string { return cert.SerialNumber.Text(16) },
+	"san.dns":     func(cert *x509.Certificate) string { return strings.Join(cert.DNSNames, ",") },
+	"san.email":   func(cert *x509.Certificate) string { return strings.Join(cert.EmailAddresses, ",") },
+	"san.uri":     joinURIs,
+	"not_after":   func(cert *x509.Certificate) string { return cert.NotAfter.UTC().Format(time.RFC3339) },
+	"fingerprint": certFingerprint,
+}
+
+// certFingerprint returns the SHA-256 of a certificate, in hex
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// joinURIs returns the URI names of a certificate, comma separated
+func joinURIs(cert *x509.Certificate) string {
+	uris := make([]string, len(cert.URIs))
+	for i, uri := range cert.URIs {
+		uris[i] = uri.String()
+	}
+	return strings.Join(uris, ",")
+}
+
+// resolveTLSFile returns a path of the TLS config relative to the project
+func resolveTLSFile(projectRoot, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(projectRoot, path)
+}
+
+// serverTLSConfig returns the TLS config of the main listener, which
+// requires and verifies client certificates when a client CA is set
+func serverTLSConfig(cfg *ServerTLSConfig, projectRoot string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.ClientCA == "" {
+		return tlsConfig, nil
+	}
+	caPEM, err := os.ReadFile(resolveTLSFile(projectRoot, cfg.ClientCA))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no CA certificate in %s", cfg.ClientCA)
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if cfg.ClientAuth == "optional" {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// setClientCertHeaders sets the headers of server.tls.client_headers from
+// the verified client certificate of a request. Values sent by the client
+// under those names are always removed.
+func setClientCertHeaders(r *http.Request, headers map[string]string) {
+	for name := range headers {
+		r.Header.Del(name)
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	for name, field := range headers {
+		if value, ok := clientCertFields[field]; ok {
+			if v := value(cert); v != "" {
+				r.Header.Set(name, v)
+			}
+		}
+	}
+}
@@ -1,18 +1,31 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"os"
+	"net/http"
+	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/mevdschee/tqserver/pkg/logsink"
 )
 
 // SOCKS5 protocol constants
@@ -20,7 +33,12 @@ const (
 	socks5Version = 0x05
 
 	// Authentication methods
-	authNoAuth = 0x00
+	authNoAuth       = 0x00
+	authUserPass     = 0x02
+	authNoAcceptable = 0xFF
+
+	// Username/password sub-negotiation (RFC 1929)
+	userPassVersion = 0x01
 
 	// Commands
 	cmdConnect = 0x01
@@ -44,20 +62,30 @@ const (
 
 // ConnectionLog represents a logged connection through the SOCKS5 proxy
 type ConnectionLog struct {
-	Timestamp     time.Time `json:"timestamp"`
-	CorrelationID string    `json:"correlation_id,omitempty"`
-	WorkerName    string    `json:"worker_name,omitempty"`
-	UserAgent     string    `json:"user_agent,omitempty"`
-	DestHost      string    `json:"dest_host"`
-	DestPort      int       `json:"dest_port"`
-	Protocol      string    `json:"protocol"` // "http" | "https" | "tcp"
-	Method        string    `json:"method,omitempty"`
-	Path          string    `json:"path,omitempty"`
-	StatusCode    int       `json:"status_code,omitempty"`
-	BytesSent     int64     `json:"bytes_sent"`
-	BytesRecv     int64     `json:"bytes_recv"`
-	DurationMs    int64     `json:"duration_ms"`
-	Error         string    `json:"error,omitempty"`
+	Timestamp           time.Time     `json:"timestamp"`
+	CorrelationID       string        `json:"correlation_id,omitempty"`
+	WorkerName          string        `json:"worker_name,omitempty"`
+	UserAgent           string        `json:"user_agent,omitempty"`
+	DestHost            string        `json:"dest_host"`
+	DestPort            int           `json:"dest_port"`
+	ResolvedIPs         []string      `json:"resolved_ips,omitempty"`
+	Protocol            string        `json:"protocol"` // "http" | "https" | "wss" | "tcp"
+	Method              string        `json:"method,omitempty"`
+	Path                string        `json:"path,omitempty"`
+	StatusCode          int           `json:"status_code,omitempty"`
+	BytesSent           int64         `json:"bytes_sent"`
+	BytesRecv           int64         `json:"bytes_recv"`
+	DurationMs          int64         `json:"duration_ms"`
+	ThrottledMs         int64         `json:"throttled_ms,omitempty"`
+	Chaos               string        `json:"chaos,omitempty"`                 // Injected fault
+	QuotaUsedBytes      int64         `json:"quota_used_bytes,omitempty"`      // Worker's bytes relayed today
+	UpstreamCerts       []string      `json:"upstream_certs,omitempty"`        // Intercepted server's chain
+	UpstreamVerifyError string        `json:"upstream_verify_error,omitempty"` // Failure ignored in "log" mode
+	Replayed            bool          `json:"replayed,omitempty"`              // Answered from a cassette
+	Cached              bool          `json:"cached,omitempty"`                // Answered from the response cache
+	Mocked              bool          `json:"mocked,omitempty"`                // Answered by a worker mock
+	WebSocket           *WebSocketLog `json:"websocket,omitempty"`
+	Error               string        `json:"error,omitempty"`
 }
 
 // Socks5Server implements a SOCKS5 proxy server for logging outgoing API calls
@@ -65,12 +93,60 @@ type Socks5Server struct {
 	config         *Socks5Config
 	projectRoot    string
 	listener       net.Listener
-	logger         *log.Logger
-	logFile        *os.File
+	logOut         *logStream
+	logging        *LoggingConfig      // Output of the connection log, nil for the file
+	traffic        *TrafficBroadcaster // Live traffic viewer and dashboard, nil when neither is served
+	devMode        bool
+	chaos          *chaosRules
 	mu             sync.Mutex
 	running        atomic.Bool
 	wg             sync.WaitGroup
 	tlsInterceptor *TLSInterceptor
+	egress         *egressPolicies
+	limits         *bandwidthLimits
+	resolver       *socks5Resolver
+	mocks          *mockServers // Mock upstreams in dev mode, nil when none
+}
+
+// socks5AuthKey signs the proxy passwords handed to workers. It is random per
+// process, so the credentials are only valid for workers started by it.
+var socks5AuthKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// socks5Password returns the proxy password of a worker
+func socks5Password(workerName string) string {
+	mac := hmac.New(sha256.New, socks5AuthKey)
+	mac.Write([]byte(workerName))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// socks5ProxyURL returns the proxy URL for a worker, with the worker name and
+// its password as credentials so the proxy can apply its egress policy
+func socks5ProxyURL(port int, workerName string) string {
+	u := url.URL{
+		Scheme: "socks5",
+		User:   url.UserPassword(workerName, socks5Password(workerName)),
+		Host:   net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+	}
+	return u.String()
+}
+
+// socks5CACert returns the CA certificate workers trust for HTTPS inspection
+// by the SOCKS5 proxy, empty when it is off
+func (s *Supervisor) socks5CACert() string {
+	inspection := s.config.Socks5.HTTPSInspection
+	if !s.config.Socks5.Enabled || inspection == nil || !inspection.Enabled {
+		return ""
+	}
+	if filepath.IsAbs(inspection.CACert) {
+		return inspection.CACert
+	}
+	return filepath.Join(s.projectRoot, inspection.CACert)
 }
 
 // NewSocks5Server creates a new SOCKS5 proxy server
@@ -103,6 +179,37 @@ func (s *Socks5Server) Start() error {
 		}
 		s.tlsInterceptor = interceptor
 		log.Printf("SOCKS5: HTTPS inspection enabled with CA: %s", s.config.HTTPSInspection.CACert)
+		if interceptor.cassettes != nil {
+			log.Printf("SOCKS5: Record and replay in %s mode: %s", s.config.HTTPSInspection.Replay.Mode, interceptor.cassettes.dir)
+		}
+	}
+
+	egress, err := newEgressPolicies(s.config.Egress)
+	if err != nil {
+		return fmt.Errorf("invalid egress policy: %w", err)
+	}
+	s.egress = egress
+
+	limits, err := newBandwidthLimits(s.config.Limits)
+	if err != nil {
+		return fmt.Errorf("invalid bandwidth limits: %w", err)
+	}
+	s.limits = limits
+
+	resolver, err := newSocks5Resolver(s.config.DNS)
+	if err != nil {
+		return fmt.Errorf("invalid dns config: %w", err)
+	}
+	s.resolver = resolver
+
+	if s.config.Chaos != nil && !s.devMode {
+		log.Printf("SOCKS5: Chaos injection is ignored outside development mode")
+	} else {
+		chaos, err := newChaosRules(s.config.Chaos)
+		if err != nil {
+			return fmt.Errorf("invalid chaos config: %w", err)
+		}
+		s.chaos = chaos
 	}
 
 	// Start listening
@@ -166,41 +273,38 @@ func (s *Socks5Server) Stop() {
 		log.Printf("SOCKS5: Timeout waiting for connections to close")
 	}
 
-	if s.logFile != nil {
-		s.logFile.Close()
+	if s.logOut != nil {
+		s.logOut.Close()
+	}
+	if s.tlsInterceptor != nil {
+		s.tlsInterceptor.Close()
 	}
 
 	log.Printf("SOCKS5 proxy stopped")
 }
 
-// setupLogging sets up the log file
+// setupLogging opens the connection log, by default the log file where a
+// {date} placeholder starts a new file every day
 func (s *Socks5Server) setupLogging() error {
 	logPath := s.config.LogFile
 	if logPath == "" {
 		logPath = "logs/socks5_{date}.log"
 	}
 
-	// Replace {date} placeholder
-	logPath = strings.ReplaceAll(logPath, "{date}", time.Now().Format("2006-01-02"))
-
-	// Make path absolute
-	if !filepath.IsAbs(logPath) {
-		logPath = filepath.Join(s.projectRoot, logPath)
-	}
-
-	// Create directory if needed
-	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
-		return err
+	logging := s.logging
+	if logging == nil {
+		logging = &LoggingConfig{}
 	}
-
-	// Open log file
-	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	stream, err := openLogStream(logging, logging.Socks5, s.projectRoot, logStreamOptions{
+		output:   "file",
+		file:     logPath,
+		rotation: s.config.Rotation.Options(),
+		tag:      "tqserver-socks5",
+	})
 	if err != nil {
 		return err
 	}
-	s.logFile = f
-	s.logger = log.New(f, "", 0)
-
+	s.logOut = stream
 	return nil
 }
 
@@ -212,7 +316,8 @@ func (s *Socks5Server) handleConnection(conn net.Conn) {
 	conn.SetDeadline(time.Now().Add(60 * time.Second))
 
 	// Step 1: Version/method negotiation
-	if err := s.handleHandshake(conn); err != nil {
+	workerName, err := s.handleHandshake(conn)
+	if err != nil {
 		log.Printf("SOCKS5: Handshake failed: %v", err)
 		return
 	}
@@ -224,13 +329,29 @@ func (s *Socks5Server) handleConnection(conn net.Conn) {
 		return
 	}
 
-	// Step 3: Connect to destination
+	// Step 3: Resolve the destination
 	startTime := time.Now()
-	destAddr := fmt.Sprintf("%s:%d", destHost, destPort)
-	destConn, err := net.DialTimeout("tcp", destAddr, 10*time.Second)
-	if err != nil {
-		s.sendReply(conn, replyHostUnreach, nil)
-		s.logConnection(&ConnectionLog{
+	var resolved []string
+	var throttled *throttledConn
+	var chaos chaosPlan
+	// The authenticated worker takes precedence over one sniffed from the
+	// User-Agent of a request
+	logFn := func(entry *ConnectionLog) {
+		if workerName != "" {
+			entry.WorkerName = workerName
+		}
+		entry.ResolvedIPs = resolved
+		if entry.Chaos == "" {
+			entry.Chaos = chaos.describe()
+		}
+		if throttled != nil {
+			throttled.annotate(entry)
+		}
+		s.logConnection(entry)
+	}
+	fail := func(reply byte, err error) {
+		s.sendReply(conn, reply, nil)
+		logFn(&ConnectionLog{
 			Timestamp:  startTime,
 			DestHost:   destHost,
 			DestPort:   destPort,
@@ -238,6 +359,100 @@ func (s *Socks5Server) handleConnection(conn net.Conn) {
 			DurationMs: time.Since(startTime).Milliseconds(),
 			Error:      err.Error(),
 		})
+	}
+
+	// Answer connections to mocked hosts from the mock
+	if addr, ok := s.mocks.hostAddr(workerName, destHost); ok {
+		if destPort == 443 && s.tlsInterceptor == nil {
+			fail(replyConnNotAllowed, errMockNeedsInspection)
+			return
+		}
+		if err := s.sendReply(conn, replySuccess, nil); err != nil {
+			log.Printf("SOCKS5: Failed to send reply: %v", err)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		s.serveMock(conn, addr, destHost, destPort, startTime, logFn)
+		return
+	}
+
+	// Answer intercepted connections from the cassettes when replaying,
+	// without resolving or connecting to the destination
+	if s.tlsInterceptor != nil && destPort == 443 && s.tlsInterceptor.replaying() && !s.tlsInterceptor.bypassed(destHost) {
+		if err := s.checkEgress(workerName, destHost, nil, destPort); err != nil {
+			fail(replyConnNotAllowed, err)
+			return
+		}
+		if err := s.sendReply(conn, replySuccess, nil); err != nil {
+			log.Printf("SOCKS5: Failed to send reply: %v", err)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		s.tlsInterceptor.Replay(conn, destHost, destPort, startTime, logFn)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ips, err := s.resolver.lookup(ctx, destHost)
+	cancel()
+	if err != nil {
+		if !s.serveOffline(conn, workerName, destHost, destPort, startTime, logFn) {
+			fail(replyHostUnreach, err)
+		}
+		return
+	}
+	if net.ParseIP(destHost) == nil {
+		for _, ip := range ips {
+			resolved = append(resolved, ip.String())
+		}
+	}
+
+	// Step 4: Apply the egress policy
+	if err := s.checkEgress(workerName, destHost, ips, destPort); err != nil {
+		fail(replyConnNotAllowed, err)
+		return
+	}
+
+	// Refuse the connection when a daily quota is used up
+	var limiters []*bandwidthLimiter
+	if s.limits != nil {
+		limiters = s.limits.limitersFor(workerName, destHost, ips, destPort)
+		for _, limiter := range limiters {
+			if limiter.exceeded() {
+				GetMetrics().RecordSocks5QuotaExceeded(limiter.scope, limiter.name)
+				fail(replyConnNotAllowed, fmt.Errorf("%w for %s %s", errQuotaExceeded, limiter.scope, limiter.name))
+				return
+			}
+		}
+	}
+
+	// Inject the configured faults
+	if s.chaos != nil {
+		chaos = s.chaos.plan(destHost, ips, destPort)
+		if chaos.delay > 0 {
+			GetMetrics().RecordSocks5Chaos("latency")
+			time.Sleep(chaos.delay)
+		}
+		if chaos.refuse {
+			GetMetrics().RecordSocks5Chaos("refused")
+			fail(replyConnRefused, errChaosRefused)
+			return
+		}
+	}
+
+	// Step 5: Connect to the resolved addresses in turn, so the checked
+	// addresses are the ones dialed
+	var destConn net.Conn
+	for _, ip := range ips {
+		destConn, err = net.DialTimeout("tcp", net.JoinHostPort(ip.String(), strconv.Itoa(destPort)), 10*time.Second)
+		if err == nil {
+			break
+		}
+	}
+	if destConn == nil {
+		if !s.serveOffline(conn, workerName, destHost, destPort, startTime, logFn) {
+			fail(replyHostUnreach, err)
+		}
 		return
 	}
 	defer destConn.Close()
@@ -252,66 +467,253 @@ func (s *Socks5Server) handleConnection(conn net.Conn) {
 	conn.SetDeadline(time.Time{})
 	destConn.SetDeadline(time.Time{})
 
-	// Check if we should intercept HTTPS
+	// Throttle the destination side, which covers every relay below
+	if len(limiters) > 0 {
+		throttled = &throttledConn{Conn: destConn, limiters: limiters}
+		destConn = throttled
+	}
+	if chaos.reset {
+		destConn = &resetConn{Conn: destConn, client: conn}
+	}
+
+	// Check if we should intercept HTTPS. A destination given as an IP
+	// address is matched against the bypass list by its SNI name.
+	var sniffed int64
 	if s.tlsInterceptor != nil && destPort == 443 {
-		s.tlsInterceptor.Intercept(conn, destConn, destHost, destPort, startTime, s.logConnection)
-		return
+		serverName, consumed := destHost, []byte(nil)
+		if net.ParseIP(destHost) != nil && len(s.tlsInterceptor.config.Bypass) > 0 {
+			serverName, consumed = sniffServerName(conn)
+		}
+		if !s.tlsInterceptor.bypassed(serverName) {
+			var clientConn net.Conn = conn
+			if consumed != nil {
+				clientConn = &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(consumed), conn)}
+			}
+			s.tlsInterceptor.Intercept(clientConn, destConn, destHost, destPort, startTime, logFn)
+			return
+		}
+		// Tunnel without interception, after the sniffed ClientHello
+		n, err := destConn.Write(consumed)
+		sniffed = int64(n)
+		if err != nil {
+			return
+		}
+	}
+
+	// Sniff the first request of plain HTTP connections for its identity
+	var correlationID, sniffedWorker string
+	if s.detectProtocol(destPort) == "http" {
+		header, consumed := sniffHTTPRequest(conn)
+		if header != nil {
+			correlationID, sniffedWorker = requestIdentity(header)
+		}
+		n, err := destConn.Write(consumed)
+		sniffed = int64(n)
+		if err != nil {
+			return
+		}
 	}
 
 	// Relay data
 	bytesSent, bytesRecv := s.relay(conn, destConn)
 
 	// Log connection
-	s.logConnection(&ConnectionLog{
-		Timestamp:  startTime,
-		DestHost:   destHost,
-		DestPort:   destPort,
-		Protocol:   s.detectProtocol(destPort),
-		BytesSent:  bytesSent,
-		BytesRecv:  bytesRecv,
-		DurationMs: time.Since(startTime).Milliseconds(),
+	logFn(&ConnectionLog{
+		Timestamp:     startTime,
+		CorrelationID: correlationID,
+		WorkerName:    sniffedWorker,
+		DestHost:      destHost,
+		DestPort:      destPort,
+		Protocol:      s.detectProtocol(destPort),
+		BytesSent:     sniffed + bytesSent,
+		BytesRecv:     bytesRecv,
+		DurationMs:    time.Since(startTime).Milliseconds(),
 	})
 }
 
-// handleHandshake performs SOCKS5 handshake
-func (s *Socks5Server) handleHandshake(conn net.Conn) error {
+// correlationHeader carries the ID of the inbound request, workers forward
+// it on their outgoing calls
+const correlationHeader = "X-Correlation-ID"
+
+// requestIdentity returns the correlation ID of an outgoing request and the
+// worker named by a "TQServer/{worker}" User-Agent
+func requestIdentity(header http.Header) (correlationID, workerName string) {
+	correlationID = header.Get(correlationHeader)
+	if ua, ok := strings.CutPrefix(header.Get("User-Agent"), "TQServer/"); ok {
+		workerName, _, _ = strings.Cut(ua, " ")
+	}
+	return correlationID, workerName
+}
+
+// sniffHTTPRequest reads the head of the first request on a plain HTTP
+// connection. It returns the header, or nil when it could not be parsed,
+// and the bytes consumed, which must be forwarded before relaying the rest.
+func sniffHTTPRequest(conn net.Conn) (http.Header, []byte) {
+	var consumed bytes.Buffer
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	req, err := http.ReadRequest(bufio.NewReader(io.TeeReader(conn, &consumed)))
+	if err != nil {
+		return nil, consumed.Bytes()
+	}
+	return req.Header, consumed.Bytes()
+}
+
+// sniffServerName reads the TLS ClientHello of a connection for its SNI
+// name, "" when there is none. It returns the bytes consumed, which must be
+// forwarded or read again before relaying the rest.
+func sniffServerName(conn net.Conn) (string, []byte) {
+	var consumed bytes.Buffer
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var serverName string
+	tls.Server(&helloConn{Conn: conn, r: io.TeeReader(conn, &consumed)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errHelloSniffed
+		},
+	}).Handshake()
+	return serverName, consumed.Bytes()
+}
+
+// errHelloSniffed stops the handshake of sniffServerName after the ClientHello
+var errHelloSniffed = errors.New("client hello sniffed")
+
+// helloConn reads from r and discards writes, so a sniffing handshake sends
+// nothing to the client
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *helloConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *helloConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// prefixConn reads from r, which yields sniffed bytes before the rest of
+// the connection
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// closeWriter is a connection that supports half-closing
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// egressDeniedError is returned when an egress policy denies a connection
+type egressDeniedError struct {
+	rule string
+}
+
+func (e *egressDeniedError) Error() string {
+	return fmt.Sprintf("denied by egress policy (%s)", e.rule)
+}
+
+// checkEgress applies the egress policy to a destination and its resolved
+// addresses
+func (s *Socks5Server) checkEgress(workerName, destHost string, ips []net.IP, destPort int) error {
+	if s.egress == nil {
+		return nil
+	}
+
+	allowed, rule := s.egress.check(workerName, destHost, ips, destPort)
+	if !allowed {
+		label := workerName
+		if label == "" {
+			label = "anonymous"
+		}
+		log.Printf("SOCKS5: Denied %s connection to %s (%s)", label, net.JoinHostPort(destHost, strconv.Itoa(destPort)), rule)
+		GetMetrics().RecordSocks5Denied(workerName)
+		return &egressDeniedError{rule: rule}
+	}
+	return nil
+}
+
+// handleHandshake performs SOCKS5 handshake and returns the authenticated
+// worker name. Workers authenticate with the username and password from
+// their proxy URL, other clients may connect without authentication and
+// are subject to the global egress policy only.
+func (s *Socks5Server) handleHandshake(conn net.Conn) (string, error) {
 	// Read version and number of methods
 	buf := make([]byte, 2)
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		return fmt.Errorf("failed to read handshake: %w", err)
+		return "", fmt.Errorf("failed to read handshake: %w", err)
 	}
 
 	if buf[0] != socks5Version {
-		return fmt.Errorf("unsupported SOCKS version: %d", buf[0])
+		return "", fmt.Errorf("unsupported SOCKS version: %d", buf[0])
 	}
 
 	numMethods := int(buf[1])
 	methods := make([]byte, numMethods)
 	if _, err := io.ReadFull(conn, methods); err != nil {
-		return fmt.Errorf("failed to read methods: %w", err)
+		return "", fmt.Errorf("failed to read methods: %w", err)
 	}
 
-	// Check for no-auth method
-	hasNoAuth := false
+	// Prefer username/password, fall back to no-auth
+	hasNoAuth, hasUserPass := false, false
 	for _, m := range methods {
-		if m == authNoAuth {
+		switch m {
+		case authNoAuth:
 			hasNoAuth = true
-			break
+		case authUserPass:
+			hasUserPass = true
 		}
 	}
 
-	if !hasNoAuth {
+	switch {
+	case hasUserPass:
+		if _, err := conn.Write([]byte{socks5Version, authUserPass}); err != nil {
+			return "", fmt.Errorf("failed to send handshake response: %w", err)
+		}
+		return s.handleUserPassAuth(conn)
+	case hasNoAuth:
+		if _, err := conn.Write([]byte{socks5Version, authNoAuth}); err != nil {
+			return "", fmt.Errorf("failed to send handshake response: %w", err)
+		}
+		return "", nil
+	default:
 		// Send no acceptable methods
-		conn.Write([]byte{socks5Version, 0xFF})
-		return fmt.Errorf("no acceptable authentication method")
+		conn.Write([]byte{socks5Version, authNoAcceptable})
+		return "", fmt.Errorf("no acceptable authentication method")
 	}
+}
 
-	// Send no-auth response
-	if _, err := conn.Write([]byte{socks5Version, authNoAuth}); err != nil {
-		return fmt.Errorf("failed to send handshake response: %w", err)
+// handleUserPassAuth performs the username/password sub-negotiation
+func (s *Socks5Server) handleUserPassAuth(conn net.Conn) (string, error) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return "", fmt.Errorf("failed to read credentials: %w", err)
+	}
+	if buf[0] != userPassVersion {
+		return "", fmt.Errorf("unsupported auth version: %d", buf[0])
+	}
+	username := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return "", fmt.Errorf("failed to read username: %w", err)
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return "", fmt.Errorf("failed to read password length: %w", err)
+	}
+	password := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
 	}
 
-	return nil
+	workerName := string(username)
+	if !hmac.Equal(password, []byte(socks5Password(workerName))) {
+		conn.Write([]byte{userPassVersion, 0x01})
+		return "", fmt.Errorf("invalid credentials for worker %q", workerName)
+	}
+	if _, err := conn.Write([]byte{userPassVersion, 0x00}); err != nil {
+		return "", fmt.Errorf("failed to send auth response: %w", err)
+	}
+	return workerName, nil
 }
 
 // handleRequest handles SOCKS5 CONNECT request
@@ -402,7 +804,9 @@ func (s *Socks5Server) relay(client, server net.Conn) (bytesSent, bytesRecv int6
 		defer wg.Done()
 		n, _ := io.Copy(server, client)
 		atomic.AddInt64(&bytesSent, n)
-		server.(*net.TCPConn).CloseWrite()
+		if cw, ok := server.(closeWriter); ok {
+			cw.CloseWrite()
+		}
 	}()
 
 	// Server -> Client
@@ -410,7 +814,9 @@ func (s *Socks5Server) relay(client, server net.Conn) (bytesSent, bytesRecv int6
 		defer wg.Done()
 		n, _ := io.Copy(client, server)
 		atomic.AddInt64(&bytesRecv, n)
-		client.(*net.TCPConn).CloseWrite()
+		if cw, ok := client.(closeWriter); ok {
+			cw.CloseWrite()
+		}
 	}()
 
 	wg.Wait()
@@ -429,23 +835,53 @@ func (s *Socks5Server) detectProtocol(port int) string {
 	}
 }
 
+// SetDevelopmentMode enables the features that are only for development,
+// like chaos injection
+func (s *Socks5Server) SetDevelopmentMode(devMode bool) {
+	s.devMode = devMode
+}
+
+// SetTraffic sets the broadcaster that streams log entries to the live
+// traffic viewer
+func (s *Socks5Server) SetTraffic(traffic *TrafficBroadcaster) {
+	s.traffic = traffic
+}
+
+// SetLogging sets the output configuration of the connection log
+func (s *Socks5Server) SetLogging(logging *LoggingConfig) {
+	s.logging = logging
+}
+
 // logConnection logs a connection event
 func (s *Socks5Server) logConnection(entry *ConnectionLog) {
-	if s.logger == nil {
+	if s.traffic != nil {
+		s.traffic.Publish(entry)
+	}
+	if s.logOut == nil {
 		return
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// Failed connections are warnings for syslog and journald
+	priority := logsink.Info
+	if entry.Error != "" {
+		priority = logsink.Warning
+	}
+
 	if s.config.LogFormat == "text" {
-		s.logger.Printf("[%s] [%s] CONNECT %s:%d -> %d sent, %d recv, %dms",
+		correlation := ""
+		if entry.CorrelationID != "" {
+			correlation = " [" + entry.CorrelationID + "]"
+		}
+		s.logOut.Log(priority, fmt.Sprintf("[%s] [%s]%s CONNECT %s:%d -> %d sent, %d recv, %dms",
 			entry.Timestamp.Format("2006-01-02 15:04:05"),
-			entry.WorkerName,
+			entry.WorkerName, correlation,
 			entry.DestHost, entry.DestPort,
-			entry.BytesSent, entry.BytesRecv, entry.DurationMs)
+			entry.BytesSent, entry.BytesRecv, entry.DurationMs))
 	} else {
 		data, _ := json.Marshal(entry)
-		s.logger.Println(string(data))
+		s.logOut.Log(priority, string(data))
 	}
 }
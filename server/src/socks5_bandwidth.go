@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errQuotaExceeded ends a relay when a daily byte quota is used up
+var errQuotaExceeded = errors.New("daily byte quota exceeded")
+
+// bandwidthLimiter enforces a rate limit and a daily quota for one worker or
+// destination. The rate limit is a token bucket holding one second of
+// traffic, the quota resets at local midnight.
+type bandwidthLimiter struct {
+	scope string // "worker" | "destination"
+	name  string
+	rate  int64
+	quota int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	used   int64
+	day    string
+}
+
+func newBandwidthLimiter(scope, name string, limit BandwidthLimit) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		scope:  scope,
+		name:   name,
+		rate:   limit.RateBytesPerSecond,
+		quota:  limit.DailyQuotaBytes,
+		tokens: float64(limit.RateBytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// resetDay clears the usage when the day changed, callers hold l.mu
+func (l *bandwidthLimiter) resetDay(now time.Time) {
+	if day := now.Format("2006-01-02"); day != l.day {
+		l.day = day
+		l.used = 0
+	}
+}
+
+// exceeded reports whether the daily quota is used up
+func (l *bandwidthLimiter) exceeded() bool {
+	if l.quota <= 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.resetDay(time.Now())
+	return l.used >= l.quota
+}
+
+// take accounts for n bytes and returns how long to wait before sending
+// them. Taking more than is available puts the bucket in debt, which later
+// callers wait out.
+func (l *bandwidthLimiter) take(n int) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.resetDay(now)
+	if l.quota > 0 && l.used >= l.quota {
+		return 0, errQuotaExceeded
+	}
+	l.used += int64(n)
+	GetMetrics().SetSocks5QuotaUsed(l.scope, l.name, l.used)
+
+	if l.rate <= 0 {
+		return 0, nil
+	}
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0, nil
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second)), nil
+}
+
+// usage returns the bytes used today
+func (l *bandwidthLimiter) usage() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.resetDay(time.Now())
+	return l.used
+}
+
+// bandwidthDestination is a destination pattern with its shared limiter
+type bandwidthDestination struct {
+	rule    egressRule
+	limiter *bandwidthLimiter
+}
+
+// bandwidthLimits holds the limiters of all workers and destinations
+type bandwidthLimits struct {
+	config       *BandwidthConfig
+	mu           sync.Mutex
+	workers      map[string]*bandwidthLimiter
+	destinations []bandwidthDestination
+}
+
+// newBandwidthLimits compiles the limits configuration, nil means unlimited
+func newBandwidthLimits(cfg *BandwidthConfig) (*bandwidthLimits, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	b := &bandwidthLimits{config: cfg, workers: make(map[string]*bandwidthLimiter)}
+
+	patterns := make([]string, 0, len(cfg.Destinations))
+	for pattern := range cfg.Destinations {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		rule, err := parseEgressRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		b.destinations = append(b.destinations, bandwidthDestination{
+			rule:    rule,
+			limiter: newBandwidthLimiter("destination", pattern, cfg.Destinations[pattern]),
+		})
+	}
+	return b, nil
+}
+
+// limitersFor returns the limiters of a connection: the worker's own
+// limiter and those of every matching destination
+func (b *bandwidthLimits) limitersFor(workerName, destHost string, ips []net.IP, destPort int) []*bandwidthLimiter {
+	var limiters []*bandwidthLimiter
+
+	limit, ok := b.config.Workers[workerName]
+	if !ok {
+		limit = b.config.BandwidthLimit
+	}
+	if limit.RateBytesPerSecond > 0 || limit.DailyQuotaBytes > 0 {
+		b.mu.Lock()
+		limiter, ok := b.workers[workerName]
+		if !ok {
+			limiter = newBandwidthLimiter("worker", workerName, limit)
+			b.workers[workerName] = limiter
+		}
+		b.mu.Unlock()
+		limiters = append(limiters, limiter)
+	}
+
+	for i := range b.destinations {
+		if b.destinations[i].rule.matches(destHost, ips, destPort) {
+			limiters = append(limiters, b.destinations[i].limiter)
+		}
+	}
+	return limiters
+}
+
+// throttledConn applies rate limits and quotas to the traffic of a
+// destination connection, in both directions
+type throttledConn struct {
+	net.Conn
+	limiters []*bandwidthLimiter
+
+	mu        sync.Mutex
+	throttled time.Duration
+	err       error
+}
+
+// maxThrottleChunk bounds the bytes accounted at once, so slow rates are
+// spread out instead of sending a full buffer in one burst
+const maxThrottleChunk = 16 * 1024
+
+func (c *throttledConn) wait(n int) error {
+	var delay time.Duration
+	for _, limiter := range c.limiters {
+		d, err := limiter.take(n)
+		if err != nil {
+			c.mu.Lock()
+			c.err = fmt.Errorf("%w for %s %s", err, limiter.scope, limiter.name)
+			c.mu.Unlock()
+			GetMetrics().RecordSocks5QuotaExceeded(limiter.scope, limiter.name)
+			return c.err
+		}
+		delay = max(delay, d)
+	}
+	if delay > 0 {
+		c.mu.Lock()
+		c.throttled += delay
+		c.mu.Unlock()
+		time.Sleep(delay)
+	}
+	return nil
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxThrottleChunk)]
+		if err := c.wait(len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if len(p) > maxThrottleChunk {
+		p = p[:maxThrottleChunk]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if werr := c.wait(n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the underlying TCP connection
+func (c *throttledConn) CloseWrite() error {
+	if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
+		return tcpConn.CloseWrite()
+	}
+	return nil
+}
+
+// annotate adds the throttling time, the worker's quota usage and a quota
+// error to a log entry
+func (c *throttledConn) annotate(entry *ConnectionLog) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.ThrottledMs = c.throttled.Milliseconds()
+	for _, limiter := range c.limiters {
+		if limiter.scope == "worker" {
+			entry.QuotaUsedBytes = limiter.usage()
+		}
+	}
+	if c.err != nil && entry.Error == "" {
+		entry.Error = c.err.Error()
+	}
+}
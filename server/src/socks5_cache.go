@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// defaultServeOnStatus are the upstream statuses answered from the cache
+var defaultServeOnStatus = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// cachedResponse is a GET response stored in the response cache
+type cachedResponse struct {
+	URL      string      `json:"url"`
+	StoredAt time.Time   `json:"stored_at"`
+	Status   int         `json:"status"`
+	Headers  http.Header `json:"headers"`
+	Body     string      `json:"body,omitempty"`
+	Encoding string      `json:"encoding,omitempty"` // "base64" for binary bodies
+}
+
+// responseCache stores successful GET responses per URL, one file each, and
+// serves them when the destination is unreachable or failing
+type responseCache struct {
+	dir           string
+	maxAge        time.Duration // 0 serves responses of any age
+	serveOnStatus []int
+}
+
+// newResponseCache creates the cache for a configuration, it returns nil
+// when caching is off
+func newResponseCache(cfg *ResponseCacheConfig, projectRoot string) (*responseCache, error) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+	c := &responseCache{
+		dir:           cfg.Directory,
+		maxAge:        time.Duration(cfg.MaxAgeHours) * time.Hour,
+		serveOnStatus: cfg.ServeOnStatus,
+	}
+	if c.dir == "" {
+		c.dir = "cache/socks5"
+	}
+	if !filepath.IsAbs(c.dir) {
+		c.dir = filepath.Join(projectRoot, c.dir)
+	}
+	if c.serveOnStatus == nil {
+		c.serveOnStatus = defaultServeOnStatus
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// path returns the file of a URL, in a directory per host
+func (c *responseCache) path(host, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.dir, safeFileName(host), hex.EncodeToString(sum[:16])+".json")
+}
+
+// store saves a successful GET response
+func (c *responseCache) store(host string, req *http.Request, resp *http.Response, respBody []byte) error {
+	if req.Method != http.MethodGet || resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil
+	}
+	url := "https://" + host + req.URL.RequestURI()
+	cached := cachedResponse{
+		URL:      url,
+		StoredAt: time.Now(),
+		Status:   resp.StatusCode,
+		Headers:  resp.Header.Clone(),
+	}
+	cached.Body, cached.Encoding = encodeCassetteBody(respBody)
+	// The cached body is written whole, with its own length
+	cached.Headers.Del("Content-Length")
+	cached.Headers.Del("Transfer-Encoding")
+
+	data, err := json.MarshalIndent(cached, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := c.path(host, url)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a response is never half written
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// lookup returns the cached response to a GET request, with an Age header
+func (c *responseCache) lookup(host string, req *http.Request, _ []byte) (*http.Response, error) {
+	url := "https://" + host + req.URL.RequestURI()
+	if req.Method != http.MethodGet {
+		return nil, fmt.Errorf("destination unreachable, only GET responses are cached: %s %s", req.Method, url)
+	}
+	data, err := os.ReadFile(c.path(host, url))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("destination unreachable, no cached response for %s", url)
+		}
+		return nil, err
+	}
+	var cached cachedResponse
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, fmt.Errorf("invalid cached response for %s: %w", url, err)
+	}
+	age := time.Since(cached.StoredAt)
+	if c.maxAge > 0 && age > c.maxAge {
+		return nil, fmt.Errorf("destination unreachable, cached response for %s is %s old", url, age.Round(time.Minute))
+	}
+	body, err := decodeCassetteBody(cached.Body, cached.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("cached response for %s: %w", url, err)
+	}
+
+	header := cached.Headers.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	return &http.Response{
+		StatusCode:    cached.Status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// fallback returns the cached response to use instead of a failed upstream
+// response, or nil to keep the upstream response
+func (c *responseCache) fallback(host string, req *http.Request, resp *http.Response) *http.Response {
+	if req.Method != http.MethodGet || !slices.Contains(c.serveOnStatus, resp.StatusCode) {
+		return nil
+	}
+	cached, err := c.lookup(host, req, nil)
+	if err != nil {
+		return nil
+	}
+	return cached
+}
+
+// ServeCached answers the requests of an intercepted connection to an
+// unreachable destination from the response cache. A request without a
+// cached response gets a 502 response.
+func (t *TLSInterceptor) ServeCached(clientConn net.Conn, destHost string, destPort int, startTime time.Time, logFn func(*ConnectionLog)) {
+	t.serveLocal(clientConn, destHost, destPort, startTime, t.cache.lookup, func(entry *ConnectionLog) {
+		entry.Cached = true
+		logFn(entry)
+	})
+}
+
+// serveOffline answers an intercepted connection to an unreachable
+// destination from the response cache, it returns false when the cache does
+// not apply and the connection should fail as usual
+func (s *Socks5Server) serveOffline(conn net.Conn, workerName, destHost string, destPort int, startTime time.Time, logFn func(*ConnectionLog)) bool {
+	t := s.tlsInterceptor
+	if t == nil || t.cache == nil || destPort != 443 || t.bypassed(destHost) {
+		return false
+	}
+	if err := s.checkEgress(workerName, destHost, nil, destPort); err != nil {
+		return false
+	}
+	if err := s.sendReply(conn, replySuccess, nil); err != nil {
+		log.Printf("SOCKS5: Failed to send reply: %v", err)
+		return true
+	}
+	conn.SetDeadline(time.Time{})
+	t.ServeCached(conn, destHost, destPort, startTime, logFn)
+	return true
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// cassette holds the recorded exchanges with one host
+type cassette struct {
+	Host         string                `json:"host"`
+	Interactions []cassetteInteraction `json:"interactions"`
+}
+
+type cassetteInteraction struct {
+	RecordedAt time.Time        `json:"recorded_at"`
+	Request    cassetteRequest  `json:"request"`
+	Response   cassetteResponse `json:"response"`
+}
+
+type cassetteRequest struct {
+	Method   string            `json:"method"`
+	URI      string            `json:"uri"`
+	Headers  map[string]string `json:"headers,omitempty"` // Informational, not matched
+	Body     string            `json:"body,omitempty"`
+	Encoding string            `json:"encoding,omitempty"` // "base64" for binary bodies
+}
+
+type cassetteResponse struct {
+	Status   int         `json:"status"`
+	Headers  http.Header `json:"headers"`
+	Body     string      `json:"body,omitempty"`
+	Encoding string      `json:"encoding,omitempty"` // "base64" for binary bodies
+}
+
+// cassetteStore records intercepted exchanges to one cassette file per host,
+// or answers requests from those files without contacting the host
+type cassetteStore struct {
+	dir       string
+	recording bool
+	matchBody bool
+	redact    *redactor
+
+	mu        sync.Mutex
+	cassettes map[string]*cassette
+	played    map[string]int // Host and request key -> times replayed
+}
+
+// newCassetteStore creates the store for a configuration, it returns nil
+// when record and replay is off
+func newCassetteStore(cfg *ReplayConfig, projectRoot string, redact *redactor) (*cassetteStore, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	switch cfg.Mode {
+	case "", "off":
+		return nil, nil
+	case "record", "replay":
+	default:
+		return nil, fmt.Errorf("unknown replay mode %q, use \"record\", \"replay\" or \"off\"", cfg.Mode)
+	}
+
+	c := &cassetteStore{
+		recording: cfg.Mode == "record",
+		matchBody: cfg.MatchBody,
+		redact:    redact,
+		cassettes: make(map[string]*cassette),
+		played:    make(map[string]int),
+	}
+
+	c.dir = cfg.Directory
+	if c.dir == "" {
+		c.dir = "testdata/cassettes"
+	}
+	if !filepath.IsAbs(c.dir) {
+		c.dir = filepath.Join(projectRoot, c.dir)
+	}
+	if c.recording {
+		if err := os.MkdirAll(c.dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// cassetteHost returns the host a request is recorded under, from its Host
+// header or else the SOCKS5 destination
+func cassetteHost(req *http.Request, destHost string) string {
+	host := req.Host
+	if host == "" {
+		host = destHost
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// path returns the cassette file of a host
+func (c *cassetteStore) path(host string) string {
+	return filepath.Join(c.dir, safeFileName(host)+".json")
+}
+
+// safeFileName replaces the characters of a host name that are not safe in
+// file names
+func safeFileName(host string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, host)
+}
+
+// key identifies the requests that replay the same interactions
+func (c *cassetteStore) key(method, uri, body string) string {
+	if c.matchBody {
+		return method + " " + uri + "\n" + body
+	}
+	return method + " " + uri
+}
+
+// record appends an exchange to the cassette of its host. The first
+// recording of a host in a run replaces the cassette from an earlier run.
+func (c *cassetteStore) record(host string, req *http.Request, reqBody []byte, resp *http.Response, respBody []byte) error {
+	interaction := cassetteInteraction{
+		RecordedAt: time.Now(),
+		Request: cassetteRequest{
+			Method:  req.Method,
+			URI:     req.URL.RequestURI(),
+			Headers: c.redact.headerMap(req.Header),
+		},
+		Response: cassetteResponse{
+			Status:  resp.StatusCode,
+			Headers: resp.Header.Clone(),
+		},
+	}
+	interaction.Request.Body, interaction.Request.Encoding = encodeCassetteBody(c.redact.body(reqBody))
+	interaction.Response.Body, interaction.Response.Encoding = encodeCassetteBody(respBody)
+	// The replayed body is written whole, with its own length
+	interaction.Response.Headers.Del("Content-Length")
+	interaction.Response.Headers.Del("Transfer-Encoding")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cas := c.cassettes[host]
+	if cas == nil {
+		cas = &cassette{Host: host}
+		c.cassettes[host] = cas
+	}
+	cas.Interactions = append(cas.Interactions, interaction)
+
+	data, err := json.MarshalIndent(cas, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a cassette is never half written
+	path := c.path(host)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// lookup returns the recorded response to a request. Repeated requests get
+// the recorded responses in order, the last one is repeated when they run out.
+func (c *cassetteStore) lookup(host string, req *http.Request, reqBody []byte) (*http.Response, error) {
+	body, _ := encodeCassetteBody(c.redact.body(reqBody))
+	key := c.key(req.Method, req.URL.RequestURI(), body)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cas, err := c.load(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []*cassetteInteraction
+	for i := range cas.Interactions {
+		r := cas.Interactions[i].Request
+		if c.key(r.Method, r.URI, r.Body) == key {
+			matches = append(matches, &cas.Interactions[i])
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no recorded response for %s %s on %s", req.Method, req.URL.RequestURI(), host)
+	}
+	played := c.played[host+" "+key]
+	c.played[host+" "+key]++
+	recorded := matches[min(played, len(matches)-1)].Response
+
+	respBody, err := decodeCassetteBody(recorded.Body, recorded.Encoding)
+	if err != nil {
+		return nil, fmt.Errorf("cassette %s: %w", c.path(host), err)
+	}
+	return &http.Response{
+		StatusCode:    recorded.Status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        recorded.Headers.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(respBody)),
+		ContentLength: int64(len(respBody)),
+		Request:       req,
+	}, nil
+}
+
+// load returns the cassette of a host, reading it on first use, callers
+// hold c.mu
+func (c *cassetteStore) load(host string) (*cassette, error) {
+	if cas := c.cassettes[host]; cas != nil {
+		return cas, nil
+	}
+	data, err := os.ReadFile(c.path(host))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no cassette recorded for %s", host)
+		}
+		return nil, err
+	}
+	cas := &cassette{}
+	if err := json.Unmarshal(data, cas); err != nil {
+		return nil, fmt.Errorf("invalid cassette %s: %w", c.path(host), err)
+	}
+	c.cassettes[host] = cas
+	return cas, nil
+}
+
+// encodeCassetteBody stores text bodies as is and binary ones as base64
+func encodeCassetteBody(data []byte) (string, string) {
+	if utf8.Valid(data) {
+		return string(data), ""
+	}
+	return base64.StdEncoding.EncodeToString(data), "base64"
+}
+
+func decodeCassetteBody(body, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return []byte(body), nil
+	case "base64":
+		return base64.StdEncoding.DecodeString(body)
+	default:
+		return nil, fmt.Errorf("unknown body encoding %q", encoding)
+	}
+}
+
+// replaying reports whether intercepted connections are answered from the
+// cassettes instead of the network
+func (t *TLSInterceptor) replaying() bool {
+	return t.cassettes != nil && !t.cassettes.recording
+}
+
+// Replay answers the requests of an intercepted connection from the
+// cassettes, without connecting to the destination. A request that was not
+// recorded gets a 502 response.
+func (t *TLSInterceptor) Replay(clientConn net.Conn, destHost string, destPort int, startTime time.Time, logFn func(*ConnectionLog)) {
+	t.serveLocal(clientConn, destHost, destPort, startTime, t.cassettes.lookup, func(entry *ConnectionLog) {
+		entry.Replayed = true
+		logFn(entry)
+	})
+}
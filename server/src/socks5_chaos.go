@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+var (
+	errChaosRefused = errors.New("refused by chaos injection")
+	errChaosReset   = errors.New("reset by chaos injection")
+)
+
+// chaosRules holds the fault injection rules of the SOCKS5 proxy
+type chaosRules struct {
+	global       ChaosRule
+	destinations []chaosDestination
+}
+
+// chaosDestination applies a rule to the destinations matching a pattern
+type chaosDestination struct {
+	rule  egressRule
+	chaos ChaosRule
+}
+
+// chaosPlan is what chaos injection does to one connection
+type chaosPlan struct {
+	delay  time.Duration
+	refuse bool
+	reset  bool
+}
+
+// newChaosRules parses the chaos configuration, cfg may be nil
+func newChaosRules(cfg *ChaosConfig) (*chaosRules, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	c := &chaosRules{global: cfg.ChaosRule}
+	if err := c.global.validate("chaos"); err != nil {
+		return nil, err
+	}
+
+	patterns := make([]string, 0, len(cfg.Destinations))
+	for pattern := range cfg.Destinations {
+		patterns = append(patterns, pattern)
+	}
+	sortHostPatterns(patterns)
+	for _, pattern := range patterns {
+		rule, err := parseEgressRule(pattern)
+		if err != nil {
+			return nil, err
+		}
+		chaos := cfg.Destinations[pattern]
+		if err := chaos.validate("chaos " + pattern); err != nil {
+			return nil, err
+		}
+		c.destinations = append(c.destinations, chaosDestination{rule: rule, chaos: chaos})
+	}
+	return c, nil
+}
+
+// validate checks that the rates are fractions
+func (r ChaosRule) validate(name string) error {
+	if r.ErrorRate < 0 || r.ErrorRate > 1 || r.ResetRate < 0 || r.ResetRate > 1 {
+		return fmt.Errorf("%s: error_rate and reset_rate must be between 0 and 1", name)
+	}
+	if r.LatencyMs < 0 || r.JitterMs < 0 {
+		return fmt.Errorf("%s: latency_ms and jitter_ms must not be negative", name)
+	}
+	return nil
+}
+
+// plan rolls the dice for a connection, with the rule of the most specific
+// matching destination or else the global rule
+func (c *chaosRules) plan(destHost string, ips []net.IP, destPort int) chaosPlan {
+	rule := c.global
+	for _, d := range c.destinations {
+		if d.rule.matches(destHost, ips, destPort) {
+			rule = d.chaos
+			break
+		}
+	}
+
+	var p chaosPlan
+	p.delay = time.Duration(rule.LatencyMs) * time.Millisecond
+	if rule.JitterMs > 0 {
+		p.delay += time.Duration(rand.IntN(rule.JitterMs+1)) * time.Millisecond
+	}
+	p.refuse = rand.Float64() < rule.ErrorRate
+	p.reset = !p.refuse && rand.Float64() < rule.ResetRate
+	return p
+}
+
+// describe summarizes the faults for the log entry
+func (p chaosPlan) describe() string {
+	switch {
+	case p.refuse:
+		return "refused"
+	case p.reset:
+		return "reset"
+	case p.delay > 0:
+		return fmt.Sprintf("latency %dms", p.delay.Milliseconds())
+	}
+	return ""
+}
+
+// resetConn resets the client connection when the destination first sends
+// data, so the client sees its request fail with a connection reset
+type resetConn struct {
+	net.Conn
+	client net.Conn
+}
+
+func (c *resetConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n == 0 && err != nil {
+		return n, err
+	}
+	if tcp, ok := c.client.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	c.client.Close()
+	c.Conn.Close()
+	GetMetrics().RecordSocks5Chaos("reset")
+	return 0, errChaosReset
+}
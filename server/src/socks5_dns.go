@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dnsOverride points a host pattern at fixed addresses
+type dnsOverride struct {
+	pattern string // Exact host or "*.domain"
+	ips     []net.IP
+}
+
+// socks5Resolver resolves the domain targets of SOCKS5 connections, through
+// static overrides first and then the system resolver, configured DNS
+// servers or DNS-over-HTTPS
+type socks5Resolver struct {
+	resolver  *net.Resolver
+	overrides []dnsOverride
+	servers   []string
+	next      atomic.Uint32
+	doh       string
+	client    *http.Client
+}
+
+// newSocks5Resolver creates the resolver for a DNS configuration
+func newSocks5Resolver(cfg *DNSConfig) (*socks5Resolver, error) {
+	r := &socks5Resolver{resolver: net.DefaultResolver}
+	if cfg == nil {
+		return r, nil
+	}
+
+	patterns := make([]string, 0, len(cfg.Overrides))
+	for pattern := range cfg.Overrides {
+		patterns = append(patterns, pattern)
+	}
+	sortHostPatterns(patterns)
+	for _, pattern := range patterns {
+		override := dnsOverride{pattern: strings.ToLower(strings.TrimSuffix(pattern, "."))}
+		for _, addr := range strings.Split(cfg.Overrides[pattern], ",") {
+			ip := net.ParseIP(strings.TrimSpace(addr))
+			if ip == nil {
+				return nil, fmt.Errorf("dns override %s: invalid address %q", pattern, addr)
+			}
+			override.ips = append(override.ips, ip)
+		}
+		r.overrides = append(r.overrides, override)
+	}
+
+	switch {
+	case cfg.DoH != "":
+		if !strings.HasPrefix(cfg.DoH, "https://") {
+			return nil, fmt.Errorf("dns doh must be an https:// URL: %s", cfg.DoH)
+		}
+		r.doh = cfg.DoH
+		r.client = &http.Client{Timeout: 5 * time.Second}
+		r.resolver = &net.Resolver{PreferGo: true, Dial: r.dialDoH}
+	case len(cfg.Servers) > 0:
+		for _, server := range cfg.Servers {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			r.servers = append(r.servers, server)
+		}
+		r.resolver = &net.Resolver{PreferGo: true, Dial: r.dialServer}
+	}
+	return r, nil
+}
+
+// lookup returns the addresses of a host, an IP literal resolves to itself
+func (r *socks5Resolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	for _, override := range r.overrides {
+		if matchHost(override.pattern, host) {
+			return override.ips, nil
+		}
+	}
+
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// dialServer connects to the configured DNS servers in turn
+func (r *socks5Resolver) dialServer(ctx context.Context, network, _ string) (net.Conn, error) {
+	server := r.servers[int(r.next.Add(1)-1)%len(r.servers)]
+	var d net.Dialer
+	return d.DialContext(ctx, network, server)
+}
+
+// dialDoH returns a connection that carries the resolver's queries over
+// DNS-over-HTTPS (RFC 8484)
+func (r *socks5Resolver) dialDoH(ctx context.Context, _, _ string) (net.Conn, error) {
+	return &dohConn{ctx: ctx, resolver: r}, nil
+}
+
+// dohConn is a DNS stream connection that posts each query to the DoH
+// server. Like DNS over TCP, messages are prefixed with a 2-byte length.
+type dohConn struct {
+	ctx      context.Context
+	resolver *socks5Resolver
+	query    bytes.Buffer
+	answer   bytes.Reader
+}
+
+func (c *dohConn) Write(p []byte) (int, error) {
+	c.query.Write(p)
+	buf := c.query.Bytes()
+	if len(buf) < 2 || len(buf) < 2+int(binary.BigEndian.Uint16(buf)) {
+		return len(p), nil
+	}
+	msg := buf[2 : 2+int(binary.BigEndian.Uint16(buf))]
+
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.resolver.doh, bytes.NewReader(msg))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.resolver.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return 0, err
+	}
+
+	framed := make([]byte, 2+len(answer))
+	binary.BigEndian.PutUint16(framed, uint16(len(answer)))
+	copy(framed[2:], answer)
+	c.answer.Reset(framed)
+	c.query.Reset()
+	return len(p), nil
+}
+
+func (c *dohConn) Read(p []byte) (int, error) {
+	return c.answer.Read(p)
+}
+
+func (c *dohConn) Close() error                     { return nil }
+func (c *dohConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+func (c *dohConn) SetDeadline(time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// httpProtos keeps the ALPN protocols the interceptor can parse, in the
+// client's order of preference
+func httpProtos(protos []string) []string {
+	var supported []string
+	for _, proto := range protos {
+		if proto == "h2" || proto == "http/1.1" {
+			supported = append(supported, proto)
+		}
+	}
+	return supported
+}
+
+// errUpstreamClosed is returned when the upstream connection of an HTTP/2
+// relay is gone, it is not redialed
+var errUpstreamClosed = errors.New("upstream connection closed")
+
+// relayHTTP2 relays an HTTP/2 connection, negotiated on both legs, through
+// the standard library's HTTP/2 server and transport, logging each stream
+// like an HTTP/1.1 request. Bodies are streamed, so gRPC and other
+// streaming calls keep working.
+func (t *TLSInterceptor) relayHTTP2(clientConn, serverConn *tls.Conn, destHost string, destPort int, logFn func(*ConnectionLog)) {
+	var dialed atomic.Bool
+	transport := &http.Transport{
+		ForceAttemptHTTP2: true,
+		DialTLSContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+			if dialed.Swap(true) {
+				return nil, errUpstreamClosed
+			}
+			return serverConn, nil
+		},
+	}
+	defer transport.CloseIdleConnections()
+
+	listener := &connListener{conn: clientConn, closed: make(chan struct{})}
+	server := &http.Server{
+		Handler: &http2Proxy{
+			t:         t,
+			transport: transport,
+			destHost:  destHost,
+			destPort:  destPort,
+			serverIP:  serverConn.RemoteAddr(),
+			logFn:     logFn,
+		},
+		// The listener ends with the connection
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	server.Serve(listener)
+}
+
+// connListener accepts a single connection
+type connListener struct {
+	conn     net.Conn
+	accepted atomic.Bool
+	once     sync.Once
+	closed   chan struct{}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if !l.accepted.Swap(true) {
+		return l.conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// http2Proxy forwards the streams of an intercepted HTTP/2 connection
+type http2Proxy struct {
+	t         *TLSInterceptor
+	transport *http.Transport
+	destHost  string
+	destPort  int
+	serverIP  net.Addr
+	logFn     func(*ConnectionLog)
+}
+
+func (p *http2Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqStartTime := time.Now()
+	correlationID, workerName := requestIdentity(r.Header)
+	entry := &ConnectionLog{
+		Timestamp:     reqStartTime,
+		CorrelationID: correlationID,
+		WorkerName:    workerName,
+		DestHost:      p.destHost,
+		DestPort:      p.destPort,
+		Protocol:      "https",
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		UserAgent:     r.Header.Get("User-Agent"),
+	}
+
+	// Forward the request, its body is captured while it streams
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.URL.Scheme = "https"
+	out.URL.Host = r.Host
+	reqBody := p.t.newBodyCapture(r.Body)
+	if r.Body != http.NoBody {
+		out.Body = reqBody
+	}
+
+	resp, err := p.transport.RoundTrip(out)
+
+	// Answer a failing GET from the response cache
+	if p.t.cache != nil {
+		host := cassetteHost(r, p.destHost)
+		var cached *http.Response
+		if err != nil {
+			cached, _ = p.t.cache.lookup(host, r, nil)
+		} else if cached = p.t.cache.fallback(host, r, resp); cached != nil {
+			resp.Body.Close()
+		}
+		if cached != nil {
+			resp, err = cached, nil
+			entry.Cached = true
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		entry.DurationMs = time.Since(reqStartTime).Milliseconds()
+		entry.Error = fmt.Sprintf("failed to forward request: %v", err)
+		p.logFn(entry)
+		return
+	}
+	defer resp.Body.Close()
+	respHeadersTime := time.Now()
+
+	// Copy the response, flushing every read for streaming responses, and
+	// its trailers, which gRPC uses for the call status
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	for name := range resp.Trailer {
+		w.Header().Add("Trailer", name)
+	}
+	w.WriteHeader(resp.StatusCode)
+	respBody := p.t.newBodyCapture(resp.Body)
+	controller := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := respBody.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				break
+			}
+			controller.Flush()
+		}
+		if err != nil {
+			break
+		}
+	}
+	for name, values := range resp.Trailer {
+		w.Header()[name] = values
+	}
+
+	entry.StatusCode = resp.StatusCode
+	entry.BytesSent = reqBody.size()
+	entry.BytesRecv = respBody.size()
+	entry.DurationMs = time.Since(reqStartTime).Milliseconds()
+
+	serverIP, _, _ := net.SplitHostPort(p.serverIP.String())
+	p.t.exportExchange(&harExchange{
+		req:      r,
+		reqBody:  reqBody.bytes(),
+		resp:     resp,
+		respBody: respBody.bytes(),
+		destHost: p.destHost,
+		serverIP: serverIP,
+		started:  reqStartTime,
+		sent:     reqStartTime,
+		headers:  respHeadersTime,
+		done:     time.Now(),
+		comment:  harComment(correlationID, workerName),
+	}, entry)
+	p.logFn(entry)
+}
+
+// bodyCapture keeps the start of a body as it is read, up to max_body_size
+// or all of it when recording or caching
+type bodyCapture struct {
+	io.ReadCloser
+	limit int
+
+	mu   sync.Mutex
+	data []byte
+	n    int64
+}
+
+func (t *TLSInterceptor) newBodyCapture(body io.ReadCloser) *bodyCapture {
+	if body == nil {
+		body = http.NoBody
+	}
+	limit := t.maxBodySize()
+	if t.captureWhole() {
+		limit = math.MaxInt
+	}
+	return &bodyCapture{ReadCloser: body, limit: limit}
+}
+
+func (b *bodyCapture) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	b.n += int64(n)
+	if keep := min(n, b.limit-len(b.data)); keep > 0 {
+		b.data = append(b.data, p[:keep]...)
+	}
+	b.mu.Unlock()
+	return n, err
+}
+
+// bytes returns the captured start of the body
+func (b *bodyCapture) bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.data)
+}
+
+// size returns the number of bytes read
+func (b *bodyCapture) size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 structures, see http://www.softwareishard.com/blog/har-12-spec/
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harExchange is an intercepted request and response with their timing
+type harExchange struct {
+	req      *http.Request
+	reqBody  []byte
+	resp     *http.Response
+	respBody []byte
+	destHost string
+	serverIP string
+	started  time.Time
+	sent     time.Time // Request written to the server
+	headers  time.Time // Response headers received
+	done     time.Time // Response written to the client
+	comment  string    // Correlation ID and worker
+}
+
+// harWriter appends intercepted traffic to one HAR file per time window.
+// Each file is a complete HAR document after every entry, so it can be
+// opened while the window is still being written.
+type harWriter struct {
+	dir    string
+	window time.Duration
+	redact *redactor
+
+	mu      sync.Mutex
+	file    *os.File
+	current time.Time
+	entries int
+}
+
+const (
+	harHeader = `{"log":{"version":"1.2","creator":{"name":"TQServer","version":"1.0"},"entries":[` + "\n"
+	harFooter = "\n]}}\n"
+)
+
+// newHARWriter creates a HAR writer for the configuration
+func newHARWriter(cfg *HARConfig, projectRoot string, redact *redactor) (*harWriter, error) {
+	dir := cfg.Directory
+	if dir == "" {
+		dir = "logs/har"
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(projectRoot, dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	window := time.Duration(cfg.WindowMinutes) * time.Minute
+	if window <= 0 {
+		window = time.Hour
+	}
+	return &harWriter{dir: dir, window: window, redact: redact}, nil
+}
+
+// add writes an exchange to the HAR file of its time window
+func (w *harWriter) add(x *harExchange) error {
+	data, err := json.Marshal(newHAREntry(x, w.redact))
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.rotate(x.started); err != nil {
+		return err
+	}
+
+	// Overwrite the footer with the entry and write the footer again
+	if _, err := w.file.Seek(-int64(len(harFooter)), io.SeekEnd); err != nil {
+		return err
+	}
+	if w.entries > 0 {
+		data = append([]byte(",\n"), data...)
+	}
+	data = append(data, harFooter...)
+	if _, err := w.file.Write(data); err != nil {
+		return err
+	}
+	w.entries++
+	return nil
+}
+
+// rotate opens the file of the window containing t, callers hold w.mu
+func (w *harWriter) rotate(t time.Time) error {
+	start := t.Truncate(w.window)
+	if w.file != nil && start.Equal(w.current) {
+		return nil
+	}
+	w.closeFile()
+
+	name := filepath.Join(w.dir, fmt.Sprintf("socks5_%s.har", start.Format("2006-01-02_1504")))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// Continue a file from before a restart, its entries are kept
+	entries := 0
+	if size := info.Size(); size > int64(len(harHeader+harFooter)) {
+		entries = 1
+	} else if _, err := f.WriteString(harHeader + harFooter); err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.current, w.entries = f, start, entries
+	return nil
+}
+
+func (w *harWriter) closeFile() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+// Close closes the current HAR file
+func (w *harWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closeFile()
+}
+
+// newHAREntry converts an exchange to a HAR entry, with the redaction rules
+// applied to headers, query and bodies
+func newHAREntry(x *harExchange, r *redactor) harEntry {
+	host := x.req.Host
+	if host == "" {
+		host = x.destHost
+	}
+
+	entry := harEntry{
+		StartedDateTime: x.started.Format(time.RFC3339Nano),
+		Time:            milliseconds(x.done.Sub(x.started)),
+		Request: harRequest{
+			Method:      x.req.Method,
+			URL:         r.text("https://" + host + x.req.URL.RequestURI()),
+			HTTPVersion: x.req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(x.req.Header, r),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    x.req.ContentLength,
+		},
+		Response: harResponse{
+			Status:      x.resp.StatusCode,
+			StatusText:  http.StatusText(x.resp.StatusCode),
+			HTTPVersion: x.resp.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(x.resp.Header, r),
+			RedirectURL: x.resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    x.resp.ContentLength,
+			Content: harContent{
+				Size:     int64(len(x.respBody)),
+				MimeType: x.resp.Header.Get("Content-Type"),
+			},
+		},
+		Timings: harTimings{
+			Send:    milliseconds(x.sent.Sub(x.started)),
+			Wait:    milliseconds(x.headers.Sub(x.sent)),
+			Receive: milliseconds(x.done.Sub(x.headers)),
+		},
+		ServerIPAddress: x.serverIP,
+		Comment:         x.comment,
+	}
+
+	for name, values := range x.req.URL.Query() {
+		for _, value := range values {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: r.text(value)})
+		}
+	}
+	if len(x.reqBody) > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: x.req.Header.Get("Content-Type"),
+			Text:     string(r.body(x.reqBody)),
+		}
+	}
+	if utf8.Valid(x.respBody) {
+		entry.Response.Content.Text = string(r.body(x.respBody))
+	} else {
+		entry.Response.Content.Text = base64.StdEncoding.EncodeToString(x.respBody)
+		entry.Response.Content.Encoding = "base64"
+	}
+	return entry
+}
+
+// harHeaders lists headers with sensitive values redacted
+func harHeaders(header http.Header, r *redactor) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			if r.header(name) {
+				value = redactedValue
+			} else {
+				value = r.text(value)
+			}
+			headers = append(headers, harNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// errMockNeedsInspection refuses HTTPS connections to a mocked host, the
+// mock can only answer them when the proxy terminates TLS
+var errMockNeedsInspection = errors.New("mocked host needs socks5.https_inspection for HTTPS")
+
+// SetMocks sets the mock upstreams that answer for their hosts in dev mode
+func (s *Socks5Server) SetMocks(mocks *mockServers) {
+	s.mocks = mocks
+}
+
+// serveMock answers a connection to a mocked host from the mock listening on
+// addr, without resolving or connecting to the destination. HTTPS is
+// terminated with the inspection CA and forwarded to the mock as HTTP.
+func (s *Socks5Server) serveMock(conn net.Conn, addr, destHost string, destPort int, startTime time.Time, logFn func(*ConnectionLog)) {
+	mockLogFn := func(entry *ConnectionLog) {
+		entry.Mocked = true
+		logFn(entry)
+	}
+	if destPort == 443 {
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+		defer transport.CloseIdleConnections()
+		lookup := func(host string, req *http.Request, reqBody []byte) (*http.Response, error) {
+			out, err := http.NewRequest(req.Method, "http://"+addr+req.URL.RequestURI(), bytes.NewReader(reqBody))
+			if err != nil {
+				return nil, err
+			}
+			out.Header = req.Header.Clone()
+			out.Host = host
+			return transport.RoundTrip(out)
+		}
+		s.tlsInterceptor.serveLocal(conn, destHost, destPort, startTime, lookup, mockLogFn)
+		return
+	}
+
+	mockConn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		log.Printf("SOCKS5: Failed to connect to mock for %s: %v", destHost, err)
+		return
+	}
+	defer mockConn.Close()
+	bytesSent, bytesRecv := s.relay(conn, mockConn)
+	mockLogFn(&ConnectionLog{
+		Timestamp:  startTime,
+		DestHost:   destHost,
+		DestPort:   destPort,
+		Protocol:   s.detectProtocol(destPort),
+		BytesSent:  bytesSent,
+		BytesRecv:  bytesRecv,
+		DurationMs: time.Since(startTime).Milliseconds(),
+	})
+}
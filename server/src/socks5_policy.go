@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// egressRule is a parsed allow or deny entry of an egress policy
+type egressRule struct {
+	text     string
+	host     string     // Exact host, "*.domain" for subdomains or "*" for any
+	network  *net.IPNet // Set for IP and CIDR entries
+	portLow  int        // 0 matches any port
+	portHigh int
+}
+
+// parseEgressRule parses "host", "*.domain", "10.0.0.0/8" or "*", each with
+// an optional ":port" or ":low-high". IPv6 addresses with a port are written
+// in brackets, e.g. "[fd00::/8]:443".
+func parseEgressRule(text string) (egressRule, error) {
+	rule := egressRule{text: text}
+	host, port := text, ""
+	if strings.HasPrefix(text, "[") {
+		end := strings.Index(text, "]")
+		if end < 0 {
+			return rule, fmt.Errorf("invalid egress rule %q: missing ]", text)
+		}
+		host, port = text[1:end], strings.TrimPrefix(text[end+1:], ":")
+	} else if strings.Count(text, ":") == 1 {
+		host, port, _ = strings.Cut(text, ":")
+	}
+
+	if port != "" && port != "*" {
+		low, high, isRange := strings.Cut(port, "-")
+		var err error
+		if rule.portLow, err = strconv.Atoi(low); err != nil {
+			return rule, fmt.Errorf("invalid egress rule %q: bad port", text)
+		}
+		rule.portHigh = rule.portLow
+		if isRange {
+			if rule.portHigh, err = strconv.Atoi(high); err != nil || rule.portHigh < rule.portLow {
+				return rule, fmt.Errorf("invalid egress rule %q: bad port range", text)
+			}
+		}
+	}
+
+	if _, network, err := net.ParseCIDR(host); err == nil {
+		rule.network = network
+	} else if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else if host == "" {
+		return rule, fmt.Errorf("invalid egress rule %q: missing host", text)
+	} else {
+		rule.host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	return rule, nil
+}
+
+// matches reports whether the rule matches a destination host, the addresses
+// it resolved to and the port
+func (r *egressRule) matches(host string, ips []net.IP, port int) bool {
+	if r.portLow != 0 && (port < r.portLow || port > r.portHigh) {
+		return false
+	}
+	if r.network != nil {
+		for _, ip := range ips {
+			if r.network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return matchHost(r.host, host)
+}
+
+// matchHost reports whether a host matches a lowercase pattern: an exact
+// name, "*.domain" for its subdomains or "*" for any host
+func matchHost(pattern, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	default:
+		return host == pattern
+	}
+}
+
+// sortHostPatterns orders host patterns from most to least specific: exact
+// names first, then wildcards by length
+func sortHostPatterns(patterns []string) {
+	sort.Slice(patterns, func(i, j int) bool {
+		wi, wj := strings.HasPrefix(patterns[i], "*"), strings.HasPrefix(patterns[j], "*")
+		if wi != wj {
+			return wj
+		}
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+}
+
+// egressPolicy is a compiled EgressPolicy
+type egressPolicy struct {
+	allow        []egressRule
+	deny         []egressRule
+	defaultAllow *bool
+}
+
+func newEgressPolicy(cfg EgressPolicy) (*egressPolicy, error) {
+	p := &egressPolicy{}
+	for _, text := range cfg.Allow {
+		rule, err := parseEgressRule(text)
+		if err != nil {
+			return nil, err
+		}
+		p.allow = append(p.allow, rule)
+	}
+	for _, text := range cfg.Deny {
+		rule, err := parseEgressRule(text)
+		if err != nil {
+			return nil, err
+		}
+		p.deny = append(p.deny, rule)
+	}
+	switch cfg.Default {
+	case "":
+	case "allow", "deny":
+		allow := cfg.Default == "allow"
+		p.defaultAllow = &allow
+	default:
+		return nil, fmt.Errorf("invalid egress default %q, use \"allow\" or \"deny\"", cfg.Default)
+	}
+	return p, nil
+}
+
+// match returns the verdict of the first matching rule, deny rules first
+func (p *egressPolicy) match(host string, ips []net.IP, port int) (matched, allowed bool, rule string) {
+	for i := range p.deny {
+		if p.deny[i].matches(host, ips, port) {
+			return true, false, "deny " + p.deny[i].text
+		}
+	}
+	for i := range p.allow {
+		if p.allow[i].matches(host, ips, port) {
+			return true, true, "allow " + p.allow[i].text
+		}
+	}
+	return false, false, ""
+}
+
+// egressPolicies holds the global and per-worker egress policies
+type egressPolicies struct {
+	global  *egressPolicy
+	workers map[string]*egressPolicy
+}
+
+// newEgressPolicies compiles the egress configuration, nil means no policy
+func newEgressPolicies(cfg *EgressConfig) (*egressPolicies, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	global, err := newEgressPolicy(cfg.EgressPolicy)
+	if err != nil {
+		return nil, err
+	}
+	p := &egressPolicies{global: global, workers: make(map[string]*egressPolicy)}
+	for name, workerCfg := range cfg.Workers {
+		policy, err := newEgressPolicy(workerCfg)
+		if err != nil {
+			return nil, fmt.Errorf("worker %s: %w", name, err)
+		}
+		p.workers[name] = policy
+	}
+	return p, nil
+}
+
+// check decides whether a worker may connect to a destination. The rules of
+// the worker are checked before the global rules. Without a matching rule
+// the default applies, which is "deny" when there are allow rules and
+// "allow" otherwise. The returned reason names the deciding rule.
+func (p *egressPolicies) check(worker, host string, ips []net.IP, port int) (bool, string) {
+	policies := []*egressPolicy{p.global}
+	if policy, ok := p.workers[worker]; ok && worker != "" {
+		policies = []*egressPolicy{policy, p.global}
+	}
+
+	hasAllow := false
+	for _, policy := range policies {
+		if matched, allowed, rule := policy.match(host, ips, port); matched {
+			return allowed, rule
+		}
+		hasAllow = hasAllow || len(policy.allow) > 0
+	}
+	for _, policy := range policies {
+		if policy.defaultAllow != nil {
+			return *policy.defaultAllow, "default"
+		}
+	}
+	return !hasAllow, "default"
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// redactedValue replaces sensitive values in logs
+const redactedValue = "[REDACTED]"
+
+// defaultRedactedHeaders are always masked
+var defaultRedactedHeaders = []string{"Authorization", "Cookie"}
+
+// redactor masks sensitive headers and body content of intercepted traffic
+// before it is logged
+type redactor struct {
+	headers   map[string]bool // Canonical header names
+	patterns  []*regexp.Regexp
+	jsonPaths [][]string
+}
+
+// newRedactor compiles the redaction rules, cfg may be nil
+func newRedactor(cfg *RedactConfig) (*redactor, error) {
+	r := &redactor{headers: make(map[string]bool)}
+	for _, name := range defaultRedactedHeaders {
+		r.headers[name] = true
+	}
+	if cfg == nil {
+		return r, nil
+	}
+
+	for _, name := range cfg.Headers {
+		r.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, pattern := range cfg.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %q: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	for _, path := range cfg.JSONPaths {
+		segments, err := parseJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+		r.jsonPaths = append(r.jsonPaths, segments)
+	}
+	return r, nil
+}
+
+// header reports whether the value of a header is masked
+func (r *redactor) header(name string) bool {
+	return r.headers[http.CanonicalHeaderKey(name)]
+}
+
+// headerMap returns the first value of each header, masking sensitive ones
+func (r *redactor) headerMap(header http.Header) map[string]string {
+	m := make(map[string]string)
+	for name, values := range header {
+		if len(values) == 0 {
+			continue
+		}
+		if r.header(name) {
+			m[name] = redactedValue
+		} else {
+			m[name] = r.text(values[0])
+		}
+	}
+	return m
+}
+
+// text masks the pattern matches in a string
+func (r *redactor) text(s string) string {
+	if len(r.patterns) == 0 {
+		return s
+	}
+	return string(r.applyPatterns([]byte(s)))
+}
+
+// body masks the JSON paths of a JSON body and the pattern matches of any
+// body. A body that does not parse as JSON, for instance because it was
+// truncated, only gets the patterns applied.
+func (r *redactor) body(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+	if len(r.jsonPaths) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var doc any
+		if decoder.Decode(&doc) == nil {
+			for _, path := range r.jsonPaths {
+				redactJSONPath(doc, path)
+			}
+			if masked, err := json.Marshal(doc); err == nil {
+				data = masked
+			}
+		}
+	}
+	return r.applyPatterns(data)
+}
+
+// applyPatterns replaces every match, or only the first capturing group of
+// a pattern that has one
+func (r *redactor) applyPatterns(data []byte) []byte {
+	for _, re := range r.patterns {
+		if re.NumSubexp() == 0 {
+			data = re.ReplaceAllLiteral(data, []byte(redactedValue))
+			continue
+		}
+		var out []byte
+		last := 0
+		for _, match := range re.FindAllSubmatchIndex(data, -1) {
+			if match[2] < 0 {
+				continue
+			}
+			out = append(out, data[last:match[2]]...)
+			out = append(out, redactedValue...)
+			last = match[3]
+		}
+		data = append(out, data[last:]...)
+	}
+	return data
+}
+
+// parseJSONPath splits "$.user.password", "items[*].token" or "list[0]"
+// into segments, where "*" matches every array element or object field
+func parseJSONPath(path string) ([]string, error) {
+	p := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if p == "" {
+		return nil, fmt.Errorf("redact json path %q is empty", path)
+	}
+	var segments []string
+	for _, part := range strings.Split(p, ".") {
+		name, rest, _ := strings.Cut(part, "[")
+		if name != "" {
+			segments = append(segments, name)
+		}
+		for rest != "" {
+			index, after, ok := strings.Cut(rest, "]")
+			if !ok {
+				return nil, fmt.Errorf("redact json path %q: missing ]", path)
+			}
+			if _, err := strconv.Atoi(index); err != nil && index != "*" {
+				return nil, fmt.Errorf("redact json path %q: invalid index %q", path, index)
+			}
+			segments = append(segments, index)
+			rest = strings.TrimPrefix(after, "[")
+		}
+		if name == "" && !strings.HasPrefix(part, "[") {
+			return nil, fmt.Errorf("redact json path %q: empty segment", path)
+		}
+	}
+	return segments, nil
+}
+
+// redactJSONPath masks the values at a path in a decoded JSON document
+func redactJSONPath(node any, path []string) {
+	if len(path) == 0 {
+		return
+	}
+	key, rest := path[0], path[1:]
+
+	switch v := node.(type) {
+	case map[string]any:
+		for name, child := range v {
+			if key != "*" && name != key {
+				continue
+			}
+			if len(rest) == 0 {
+				v[name] = redactedValue
+			} else {
+				redactJSONPath(child, rest)
+			}
+		}
+	case []any:
+		for i, child := range v {
+			if key != "*" && key != strconv.Itoa(i) {
+				continue
+			}
+			if len(rest) == 0 {
+				v[i] = redactedValue
+			} else {
+				redactJSONPath(child, rest)
+			}
+		}
+	}
+}
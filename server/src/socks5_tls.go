@@ -3,6 +3,9 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -12,29 +15,46 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io"
+	"log"
 	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
 // TLSInterceptor handles HTTPS MITM inspection
 type TLSInterceptor struct {
-	config    *HTTPSInspectionConfig
-	caCert    *x509.Certificate
-	caKey     *rsa.PrivateKey
-	certCache sync.Map // domain -> *tls.Certificate
+	config       *HTTPSInspectionConfig
+	caCert       *x509.Certificate
+	caKey        crypto.Signer
+	certCache    sync.Map // certificate name -> *tls.Certificate
+	certCacheDir string   // Persists issued certificates, "" disables
+	har          *harWriter
+	redact       *redactor
+	upstream     *upstreamVerifier
+	cassettes    *cassetteStore // Record and replay, nil when off
+	cache        *responseCache // Offline responses, nil when off
 }
 
+// defaultMaxBodySize is the body capture limit when max_body_size is not set
+const defaultMaxBodySize = 1024 * 1024
+
 // NewTLSInterceptor creates a new TLS interceptor with CA certificate
 func NewTLSInterceptor(config *HTTPSInspectionConfig, projectRoot string) (*TLSInterceptor, error) {
 	t := &TLSInterceptor{
 		config: config,
 	}
 
+	switch config.KeyType {
+	case "", "ecdsa", "rsa":
+	default:
+		return nil, fmt.Errorf("unknown key type %q, use \"ecdsa\" or \"rsa\"", config.KeyType)
+	}
+
 	// Resolve paths
 	certPath := config.CACert
 	keyPath := config.CAKey
@@ -64,34 +84,156 @@ func NewTLSInterceptor(config *HTTPSInspectionConfig, projectRoot string) (*TLSI
 		return nil, fmt.Errorf("failed to load CA: %w", err)
 	}
 
+	// Set up the certificate disk cache
+	if config.CertCacheDir != "" {
+		t.certCacheDir = config.CertCacheDir
+		if !filepath.IsAbs(t.certCacheDir) {
+			t.certCacheDir = filepath.Join(projectRoot, t.certCacheDir)
+		}
+		if err := os.MkdirAll(t.certCacheDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create certificate cache: %w", err)
+		}
+	}
+
+	upstream, err := newUpstreamVerifier(config.Upstream, projectRoot)
+	if err != nil {
+		return nil, err
+	}
+	t.upstream = upstream
+
+	redact, err := newRedactor(config.Redact)
+	if err != nil {
+		return nil, err
+	}
+	t.redact = redact
+
+	cassettes, err := newCassetteStore(config.Replay, projectRoot, redact)
+	if err != nil {
+		return nil, err
+	}
+	t.cassettes = cassettes
+
+	cache, err := newResponseCache(config.Cache, projectRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up response cache: %w", err)
+	}
+	t.cache = cache
+
+	// Set up HAR export
+	if config.HAR != nil && config.HAR.Enabled {
+		har, err := newHARWriter(config.HAR, projectRoot, redact)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up HAR export: %w", err)
+		}
+		t.har = har
+	}
+
 	return t, nil
 }
 
+// Close closes the HAR file, if any
+func (t *TLSInterceptor) Close() {
+	if t.har != nil {
+		t.har.Close()
+	}
+}
+
+// captureBodies reports whether request and response bodies are captured,
+// for the body log, the HAR export, recording or the response cache
+func (t *TLSInterceptor) captureBodies() bool {
+	return t.config.LogBody || t.har != nil || t.captureWhole()
+}
+
+// captureWhole reports whether bodies are captured whole, for recording or
+// the response cache
+func (t *TLSInterceptor) captureWhole() bool {
+	return t.cassettes != nil || t.cache != nil
+}
+
+// bypassed reports whether connections to a host are tunnelled without
+// interception, e.g. for SDKs that pin certificates
+func (t *TLSInterceptor) bypassed(host string) bool {
+	for _, pattern := range t.config.Bypass {
+		if matchHost(strings.ToLower(pattern), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxBodySize returns the body capture limit for logging
+func (t *TLSInterceptor) maxBodySize() int {
+	if t.config.MaxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return t.config.MaxBodySize
+}
+
+// logBody truncates a captured body to max_body_size, recorded and cached
+// bodies are captured whole
+func (t *TLSInterceptor) logBody(body []byte) []byte {
+	return body[:min(len(body), t.maxBodySize())]
+}
+
+// captureBody reads up to max_body_size bytes of a body for logging, or all
+// of it when recording or caching, and returns them along with a body that
+// still yields the complete content
+func (t *TLSInterceptor) captureBody(body io.ReadCloser) ([]byte, io.ReadCloser) {
+	var captured []byte
+	if t.captureWhole() {
+		captured, _ = io.ReadAll(body)
+	} else {
+		captured, _ = io.ReadAll(io.LimitReader(body, int64(t.maxBodySize())))
+	}
+	return captured, struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(captured), body), body}
+}
+
+// generateKey creates a private key of the configured type
+func (t *TLSInterceptor) generateKey() (crypto.Signer, error) {
+	if t.config.KeyType == "rsa" {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// randomSerial returns a random 128-bit certificate serial number
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
 // generateCA generates a new CA certificate
 func (t *TLSInterceptor) generateCA(certPath, keyPath string) error {
 	// Generate private key
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privateKey, err := t.generateKey()
 	if err != nil {
 		return fmt.Errorf("failed to generate private key: %w", err)
 	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
 
 	// Create certificate template
 	template := &x509.Certificate{
-		SerialNumber: big.NewInt(1),
+		SerialNumber: serial,
 		Subject: pkix.Name{
 			Organization: []string{"TQServer Development CA"},
 			CommonName:   "TQServer Proxy CA",
 		},
-		NotBefore:             time.Now(),
+		NotBefore:             time.Now().Add(-time.Hour),
 		NotAfter:              time.Now().AddDate(10, 0, 0), // 10 years
 		IsCA:                  true,
 		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
 		BasicConstraintsValid: true,
-		MaxPathLen:            1,
+		MaxPathLen:            0,
+		MaxPathLenZero:        true,
 	}
 
 	// Self-sign certificate
-	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
 	if err != nil {
 		return fmt.Errorf("failed to create certificate: %w", err)
 	}
@@ -122,8 +264,11 @@ func (t *TLSInterceptor) generateCA(certPath, keyPath string) error {
 	}
 	defer keyFile.Close()
 
-	keyDER := x509.MarshalPKCS1PrivateKey(privateKey)
-	if err := pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: keyDER}); err != nil {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	if err := pem.Encode(keyFile, &pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}); err != nil {
 		return fmt.Errorf("failed to encode private key: %w", err)
 	}
 
@@ -161,7 +306,7 @@ func (t *TLSInterceptor) loadCA(certPath, keyPath string) error {
 		return fmt.Errorf("failed to decode private key PEM")
 	}
 
-	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	key, err := parsePrivateKey(block.Bytes)
 	if err != nil {
 		return fmt.Errorf("failed to parse private key: %w", err)
 	}
@@ -170,34 +315,104 @@ func (t *TLSInterceptor) loadCA(certPath, keyPath string) error {
 	return nil
 }
 
-// generateDomainCert creates a certificate for a specific domain, signed by our CA
-func (t *TLSInterceptor) generateDomainCert(domain string) (*tls.Certificate, error) {
+// parsePrivateKey parses a PKCS#8, PKCS#1 RSA or SEC 1 EC private key
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return x509.ParseECPrivateKey(der)
+}
+
+// certName returns the name a certificate is issued and cached for. With
+// wildcard certificates enabled, hosts share a "*.parent" certificate per
+// parent domain of at least two labels.
+func (t *TLSInterceptor) certName(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !t.config.WildcardCerts || net.ParseIP(host) != nil {
+		return host
+	}
+	if _, parent, ok := strings.Cut(host, "."); ok && strings.Contains(parent, ".") {
+		return "*." + parent
+	}
+	return host
+}
+
+// certValidity returns the validity period of issued certificates
+func (t *TLSInterceptor) certValidity() time.Duration {
+	if t.config.CertValidityDays > 0 {
+		return time.Duration(t.config.CertValidityDays) * 24 * time.Hour
+	}
+	return 30 * 24 * time.Hour
+}
+
+// usableCert reports whether a cached certificate was issued by the current
+// CA and does not expire within the next hour
+func (t *TLSInterceptor) usableCert(cert *tls.Certificate) bool {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return false
+		}
+		cert.Leaf = leaf
+	}
+	return time.Now().Add(time.Hour).Before(leaf.NotAfter) && leaf.CheckSignatureFrom(t.caCert) == nil
+}
+
+// generateDomainCert returns a certificate for a host, signed by our CA. It
+// is taken from the memory cache, the disk cache or newly issued.
+func (t *TLSInterceptor) generateDomainCert(host string) (*tls.Certificate, error) {
+	name := t.certName(host)
+
 	// Check cache first
-	if cached, ok := t.certCache.Load(domain); ok {
+	if cached, ok := t.certCache.Load(name); ok && t.usableCert(cached.(*tls.Certificate)) {
 		return cached.(*tls.Certificate), nil
 	}
+	if cert := t.loadCachedCert(name); cert != nil {
+		t.certCache.Store(name, cert)
+		return cert, nil
+	}
 
 	// Generate new key for this domain
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privateKey, err := t.generateKey()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate domain key: %w", err)
 	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
 
-	// Create certificate template
+	// Create certificate template, backdated for clock skew
 	template := &x509.Certificate{
-		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		SerialNumber: serial,
 		Subject: pkix.Name{
-			CommonName: domain,
+			CommonName: name,
 		},
-		DNSNames:    []string{domain},
-		NotBefore:   time.Now(),
-		NotAfter:    time.Now().AddDate(0, 0, 1), // 1 day validity
-		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(t.certValidity()),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else if parent, ok := strings.CutPrefix(name, "*."); ok {
+		template.DNSNames = []string{name, parent}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	if _, ok := privateKey.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
 
 	// Sign with our CA
-	certDER, err := x509.CreateCertificate(rand.Reader, template, t.caCert, &privateKey.PublicKey, t.caKey)
+	certDER, err := x509.CreateCertificate(rand.Reader, template, t.caCert, privateKey.Public(), t.caKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create domain certificate: %w", err)
 	}
@@ -209,81 +424,122 @@ func (t *TLSInterceptor) generateDomainCert(domain string) (*tls.Certificate, er
 	}
 
 	// Cache it
-	t.certCache.Store(domain, cert)
+	t.certCache.Store(name, cert)
+	if err := t.storeCachedCert(name, certDER, privateKey); err != nil {
+		log.Printf("SOCKS5: Failed to cache certificate for %s: %v", name, err)
+	}
 
 	return cert, nil
 }
 
-// Intercept performs HTTPS MITM interception
-func (t *TLSInterceptor) Intercept(clientConn, serverConn net.Conn, destHost string, destPort int, startTime time.Time, logFn func(*ConnectionLog)) {
-	// Close the pre-connected server connection - we'll establish our own TLS connection
-	serverConn.Close()
+// certCachePath returns the disk cache file of a certificate name, or ""
+// when the disk cache is disabled
+func (t *TLSInterceptor) certCachePath(name string) string {
+	if t.certCacheDir == "" {
+		return ""
+	}
+	file := strings.ReplaceAll(name, "*", "_wildcard")
+	file = strings.ReplaceAll(file, ":", "_")
+	return filepath.Join(t.certCacheDir, file+".pem")
+}
 
-	// Generate certificate for the destination domain
-	cert, err := t.generateDomainCert(destHost)
+// loadCachedCert reads a usable certificate from the disk cache
+func (t *TLSInterceptor) loadCachedCert(name string) *tls.Certificate {
+	path := t.certCachePath(name)
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
 	if err != nil {
-		logFn(&ConnectionLog{
-			Timestamp:  startTime,
-			DestHost:   destHost,
-			DestPort:   destPort,
-			Protocol:   "https",
-			DurationMs: time.Since(startTime).Milliseconds(),
-			Error:      fmt.Sprintf("failed to generate cert: %v", err),
-		})
-		return
+		return nil
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil || !t.usableCert(&cert) {
+		return nil
+	}
+	return &cert
+}
+
+// storeCachedCert writes a certificate and its key to the disk cache
+func (t *TLSInterceptor) storeCachedCert(name string, certDER []byte, key crypto.Signer) error {
+	path := t.certCachePath(name)
+	if path == "" {
+		return nil
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
 	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	return os.WriteFile(path, data, 0600)
+}
 
-	// Wrap client connection with TLS (we become the "server")
+// Intercept performs HTTPS MITM interception over the connection already
+// established to the destination
+func (t *TLSInterceptor) Intercept(clientConn, serverConn net.Conn, destHost string, destPort int, startTime time.Time, logFn func(*ConnectionLog)) {
+	// Annotate log entries with what was learned about the upstream
+	var upstream upstreamInfo
+	clientLogFn := logFn
+	logFn = func(entry *ConnectionLog) {
+		entry.UpstreamCerts = upstream.chain
+		entry.UpstreamVerifyError = upstream.verifyErr
+		clientLogFn(entry)
+	}
+
+	// Wrap client connection with TLS (we become the "server"). The
+	// upstream handshake happens first, so a server that fails verification
+	// is refused before the client gets a certificate. The certificate is
+	// issued for the SNI name, or the destination when the client sends
+	// none, e.g. when connecting to an IP address. The client's ALPN offer
+	// is passed on and the client gets the protocol the server chose.
+	var tlsDestConn *tls.Conn
+	var upstreamErr error
 	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{*cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName := destHost
+			if hello.ServerName != "" {
+				serverName = hello.ServerName
+			}
+			tlsDestConn, upstreamErr = t.upstream.handshake(serverConn, serverName, httpProtos(hello.SupportedProtos), &upstream)
+			if upstreamErr != nil {
+				return nil, upstreamErr
+			}
+			cert, err := t.generateDomainCert(serverName)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate cert: %w", err)
+			}
+			config := &tls.Config{Certificates: []tls.Certificate{*cert}}
+			if proto := tlsDestConn.ConnectionState().NegotiatedProtocol; proto != "" {
+				config.NextProtos = []string{proto}
+			}
+			return config, nil
+		},
 	}
 	tlsClientConn := tls.Server(clientConn, tlsConfig)
 	if err := tlsClientConn.Handshake(); err != nil {
+		message := fmt.Sprintf("client TLS handshake failed: %v", err)
+		if upstreamErr != nil {
+			message = fmt.Sprintf("server TLS handshake failed: %v", upstreamErr)
+		}
 		logFn(&ConnectionLog{
 			Timestamp:  startTime,
 			DestHost:   destHost,
 			DestPort:   destPort,
 			Protocol:   "https",
 			DurationMs: time.Since(startTime).Milliseconds(),
-			Error:      fmt.Sprintf("client TLS handshake failed: %v", err),
+			Error:      message,
 		})
 		return
 	}
 	defer tlsClientConn.Close()
-
-	// Connect to the real destination
-	destAddr := fmt.Sprintf("%s:%d", destHost, destPort)
-	realConn, err := net.DialTimeout("tcp", destAddr, 10*time.Second)
-	if err != nil {
-		logFn(&ConnectionLog{
-			Timestamp:  startTime,
-			DestHost:   destHost,
-			DestPort:   destPort,
-			Protocol:   "https",
-			DurationMs: time.Since(startTime).Milliseconds(),
-			Error:      fmt.Sprintf("failed to connect to destination: %v", err),
-		})
-		return
-	}
-	defer realConn.Close()
-
-	// Establish TLS with the real server (we become the "client")
-	tlsDestConn := tls.Client(realConn, &tls.Config{ServerName: destHost})
-	if err := tlsDestConn.Handshake(); err != nil {
-		logFn(&ConnectionLog{
-			Timestamp:  startTime,
-			DestHost:   destHost,
-			DestPort:   destPort,
-			Protocol:   "https",
-			DurationMs: time.Since(startTime).Milliseconds(),
-			Error:      fmt.Sprintf("server TLS handshake failed: %v", err),
-		})
-		return
-	}
 	defer tlsDestConn.Close()
 
-	// If body logging is enabled, use HTTP-aware relay
-	if t.config.LogBody {
+	// If body logging, HAR export or recording is enabled, use HTTP-aware
+	// relay for the negotiated protocol
+	if t.captureBodies() && tlsClientConn.ConnectionState().NegotiatedProtocol == "h2" {
+		t.relayHTTP2(tlsClientConn, tlsDestConn, destHost, destPort, logFn)
+	} else if t.captureBodies() {
 		t.relayHTTPWithLogging(tlsClientConn, tlsDestConn, destHost, destPort, startTime, logFn)
 	} else {
 		// Simple relay with byte counting
@@ -327,6 +583,7 @@ func (t *TLSInterceptor) relayWithLogging(clientConn, serverConn net.Conn, destH
 // relayHTTPWithLogging parses HTTP requests/responses and logs full details
 func (t *TLSInterceptor) relayHTTPWithLogging(clientConn, serverConn net.Conn, destHost string, destPort int, startTime time.Time, logFn func(*ConnectionLog)) {
 	clientReader := bufio.NewReader(clientConn)
+	serverReader := bufio.NewReader(serverConn)
 
 	for {
 		// Read HTTP request from client
@@ -346,54 +603,81 @@ func (t *TLSInterceptor) relayHTTPWithLogging(clientConn, serverConn net.Conn, d
 		}
 
 		reqStartTime := time.Now()
+		correlationID, workerName := requestIdentity(req.Header)
 
 		// Capture request body if needed
 		var reqBody []byte
-		if t.config.LogBody && req.Body != nil {
-			reqBody, _ = io.ReadAll(io.LimitReader(req.Body, int64(t.config.MaxBodySize)))
-			req.Body.Close()
-			req.Body = io.NopCloser(bytes.NewReader(reqBody))
+		if t.captureBodies() && req.Body != nil {
+			reqBody, req.Body = t.captureBody(req.Body)
 		}
 
 		// Forward request to server
 		if err := req.Write(serverConn); err != nil {
 			logFn(&ConnectionLog{
-				Timestamp:  reqStartTime,
-				DestHost:   destHost,
-				DestPort:   destPort,
-				Protocol:   "https",
-				Method:     req.Method,
-				Path:       req.URL.Path,
-				UserAgent:  req.Header.Get("User-Agent"),
-				DurationMs: time.Since(reqStartTime).Milliseconds(),
-				Error:      fmt.Sprintf("failed to forward request: %v", err),
+				Timestamp:     reqStartTime,
+				CorrelationID: correlationID,
+				WorkerName:    workerName,
+				DestHost:      destHost,
+				DestPort:      destPort,
+				Protocol:      "https",
+				Method:        req.Method,
+				Path:          req.URL.Path,
+				UserAgent:     req.Header.Get("User-Agent"),
+				DurationMs:    time.Since(reqStartTime).Milliseconds(),
+				Error:         fmt.Sprintf("failed to forward request: %v", err),
 			})
 			return
 		}
 
+		reqSentTime := time.Now()
+
 		// Read response from server
-		resp, err := http.ReadResponse(bufio.NewReader(serverConn), req)
+		resp, err := http.ReadResponse(serverReader, req)
 		if err != nil {
 			logFn(&ConnectionLog{
-				Timestamp:  reqStartTime,
-				DestHost:   destHost,
-				DestPort:   destPort,
-				Protocol:   "https",
-				Method:     req.Method,
-				Path:       req.URL.Path,
-				UserAgent:  req.Header.Get("User-Agent"),
-				DurationMs: time.Since(reqStartTime).Milliseconds(),
-				Error:      fmt.Sprintf("failed to read response: %v", err),
+				Timestamp:     reqStartTime,
+				CorrelationID: correlationID,
+				WorkerName:    workerName,
+				DestHost:      destHost,
+				DestPort:      destPort,
+				Protocol:      "https",
+				Method:        req.Method,
+				Path:          req.URL.Path,
+				UserAgent:     req.Header.Get("User-Agent"),
+				DurationMs:    time.Since(reqStartTime).Milliseconds(),
+				Error:         fmt.Sprintf("failed to read response: %v", err),
 			})
 			return
 		}
 
+		respHeadersTime := time.Now()
+
+		// Relay WebSocket frames after an upgrade, the session is logged
+		// when it ends
+		if isWebSocketUpgrade(resp) {
+			if err := resp.Write(clientConn); err != nil {
+				return
+			}
+			t.relayWebSocket(clientConn, clientReader, serverConn, serverReader, req, destHost, destPort, reqStartTime, logFn)
+			return
+		}
+
+		// Answer a failing GET from the response cache, the upstream body
+		// is drained to keep the connection usable
+		cached := false
+		if t.cache != nil {
+			if fallback := t.cache.fallback(cassetteHost(req, destHost), req, resp); fallback != nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				fallback.Close = resp.Close
+				resp, cached = fallback, true
+			}
+		}
+
 		// Capture response body if needed
 		var respBody []byte
-		if t.config.LogBody && resp.Body != nil {
-			respBody, _ = io.ReadAll(io.LimitReader(resp.Body, int64(t.config.MaxBodySize)))
-			resp.Body.Close()
-			resp.Body = io.NopCloser(bytes.NewReader(respBody))
+		if t.captureBodies() && resp.Body != nil {
+			respBody, resp.Body = t.captureBody(resp.Body)
 		}
 
 		// Forward response to client
@@ -403,65 +687,190 @@ func (t *TLSInterceptor) relayHTTPWithLogging(clientConn, serverConn net.Conn, d
 
 		// Build log entry
 		entry := &ConnectionLog{
-			Timestamp:  reqStartTime,
+			Timestamp:     reqStartTime,
+			CorrelationID: correlationID,
+			WorkerName:    workerName,
+			DestHost:      destHost,
+			DestPort:      destPort,
+			Protocol:      "https",
+			Method:        req.Method,
+			Path:          req.URL.Path,
+			UserAgent:     req.Header.Get("User-Agent"),
+			StatusCode:    resp.StatusCode,
+			BytesSent:     int64(len(reqBody)),
+			BytesRecv:     int64(len(respBody)),
+			DurationMs:    time.Since(reqStartTime).Milliseconds(),
+			Cached:        cached,
+		}
+
+		serverIP, _, _ := net.SplitHostPort(serverConn.RemoteAddr().String())
+		t.exportExchange(&harExchange{
+			req:      req,
+			reqBody:  reqBody,
+			resp:     resp,
+			respBody: respBody,
+			destHost: destHost,
+			serverIP: serverIP,
+			started:  reqStartTime,
+			sent:     reqSentTime,
+			headers:  respHeadersTime,
+			done:     time.Now(),
+			comment:  harComment(correlationID, workerName),
+		}, entry)
+
+		logFn(entry)
+
+		// Check if connection should be closed
+		if resp.Close || req.Close {
+			return
+		}
+	}
+}
+
+// exportExchange records an exchange to the cassette of its host, the HAR
+// file and the body log, as far as enabled
+func (t *TLSInterceptor) exportExchange(x *harExchange, entry *ConnectionLog) {
+	if t.cassettes != nil {
+		if err := t.cassettes.record(cassetteHost(x.req, x.destHost), x.req, x.reqBody, x.resp, x.respBody); err != nil {
+			log.Printf("SOCKS5: Failed to record cassette: %v", err)
+		}
+	}
+	if t.cache != nil && !entry.Cached {
+		if err := t.cache.store(cassetteHost(x.req, x.destHost), x.req, x.resp, x.respBody); err != nil {
+			log.Printf("SOCKS5: Failed to cache response: %v", err)
+		}
+	}
+
+	// Bodies are captured whole when recording, log them truncated
+	reqBody, respBody := t.logBody(x.reqBody), t.logBody(x.respBody)
+
+	if t.har != nil {
+		logged := *x
+		logged.reqBody, logged.respBody = reqBody, respBody
+		if err := t.har.add(&logged); err != nil {
+			log.Printf("SOCKS5: Failed to write HAR entry: %v", err)
+		}
+	}
+
+	// Add request/response bodies as additional data if logging enabled
+	if t.config.LogBody {
+		// Create extended log with body data
+		type ExtendedLog struct {
+			*ConnectionLog
+			RequestHeaders  map[string]string `json:"request_headers,omitempty"`
+			RequestBody     string            `json:"request_body,omitempty"`
+			ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+			ResponseBody    string            `json:"response_body,omitempty"`
+		}
+
+		// Redact sensitive headers and body content
+		extLog := ExtendedLog{ConnectionLog: entry}
+		extLog.RequestHeaders = t.redact.headerMap(x.req.Header)
+		if len(reqBody) > 0 {
+			extLog.RequestBody = string(t.redact.body(reqBody))
+		}
+		extLog.ResponseHeaders = t.redact.headerMap(x.resp.Header)
+		if len(respBody) > 0 {
+			extLog.ResponseBody = string(t.redact.body(respBody))
+		}
+
+		// Log extended entry
+		data, _ := json.Marshal(extLog)
+		fmt.Println(string(data)) // TODO: use proper logger
+	}
+}
+
+// localLookup answers a request without the destination
+type localLookup func(host string, req *http.Request, reqBody []byte) (*http.Response, error)
+
+// serveLocal answers the requests of an intercepted connection with lookup,
+// without connecting to the destination. A request lookup fails for gets a
+// 502 response.
+func (t *TLSInterceptor) serveLocal(clientConn net.Conn, destHost string, destPort int, startTime time.Time, lookup localLookup, logFn func(*ConnectionLog)) {
+	tlsClientConn := tls.Server(clientConn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverName := destHost
+			if hello.ServerName != "" {
+				serverName = hello.ServerName
+			}
+			return t.generateDomainCert(serverName)
+		},
+	})
+	if err := tlsClientConn.Handshake(); err != nil {
+		logFn(&ConnectionLog{
+			Timestamp:  startTime,
 			DestHost:   destHost,
 			DestPort:   destPort,
 			Protocol:   "https",
-			Method:     req.Method,
-			Path:       req.URL.Path,
-			UserAgent:  req.Header.Get("User-Agent"),
-			StatusCode: resp.StatusCode,
-			BytesSent:  int64(len(reqBody)),
-			BytesRecv:  int64(len(respBody)),
-			DurationMs: time.Since(reqStartTime).Milliseconds(),
+			DurationMs: time.Since(startTime).Milliseconds(),
+			Error:      fmt.Sprintf("client TLS handshake failed: %v", err),
+		})
+		return
+	}
+	defer tlsClientConn.Close()
+
+	clientReader := bufio.NewReader(tlsClientConn)
+	for {
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			return
 		}
 
-		// Add request/response bodies as additional data if logging enabled
-		if t.config.LogBody {
-			// Create extended log with body data
-			type ExtendedLog struct {
-				*ConnectionLog
-				RequestHeaders  map[string]string `json:"request_headers,omitempty"`
-				RequestBody     string            `json:"request_body,omitempty"`
-				ResponseHeaders map[string]string `json:"response_headers,omitempty"`
-				ResponseBody    string            `json:"response_body,omitempty"`
-			}
+		reqStartTime := time.Now()
+		correlationID, workerName := requestIdentity(req.Header)
+		reqBody, err := io.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
 
-			extLog := ExtendedLog{ConnectionLog: entry}
-			extLog.RequestHeaders = make(map[string]string)
-			for k, v := range req.Header {
-				if len(v) > 0 {
-					// Redact sensitive headers
-					if k == "Authorization" || k == "Cookie" {
-						extLog.RequestHeaders[k] = "[REDACTED]"
-					} else {
-						extLog.RequestHeaders[k] = v[0]
-					}
-				}
-			}
-			if len(reqBody) > 0 {
-				extLog.RequestBody = string(reqBody)
-			}
-			extLog.ResponseHeaders = make(map[string]string)
-			for k, v := range resp.Header {
-				if len(v) > 0 {
-					extLog.ResponseHeaders[k] = v[0]
-				}
-			}
-			if len(respBody) > 0 {
-				extLog.ResponseBody = string(respBody)
-			}
+		entry := &ConnectionLog{
+			Timestamp:     reqStartTime,
+			CorrelationID: correlationID,
+			WorkerName:    workerName,
+			DestHost:      destHost,
+			DestPort:      destPort,
+			Protocol:      "https",
+			Method:        req.Method,
+			Path:          req.URL.Path,
+			UserAgent:     req.Header.Get("User-Agent"),
+			BytesSent:     int64(len(reqBody)),
+		}
 
-			// Log extended entry
-			data, _ := json.Marshal(extLog)
-			fmt.Println(string(data)) // TODO: use proper logger
+		resp, err := lookup(cassetteHost(req, destHost), req, reqBody)
+		if err != nil {
+			message := err.Error() + "\n"
+			resp = &http.Response{
+				StatusCode:    http.StatusBadGateway,
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+				Body:          io.NopCloser(strings.NewReader(message)),
+				ContentLength: int64(len(message)),
+				Request:       req,
+			}
+			entry.Error = err.Error()
 		}
 
+		entry.StatusCode = resp.StatusCode
+		entry.BytesRecv = resp.ContentLength
+		writeErr := resp.Write(tlsClientConn)
+		entry.DurationMs = time.Since(reqStartTime).Milliseconds()
 		logFn(entry)
 
-		// Check if connection should be closed
-		if resp.Close || req.Close {
+		if writeErr != nil || req.Close {
 			return
 		}
 	}
 }
+
+// harComment describes the origin of an exchange in its HAR entry
+func harComment(correlationID, workerName string) string {
+	var parts []string
+	if workerName != "" {
+		parts = append(parts, "worker "+workerName)
+	}
+	if correlationID != "" {
+		parts = append(parts, "correlation ID "+correlationID)
+	}
+	return strings.Join(parts, ", ")
+}
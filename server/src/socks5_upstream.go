@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// upstreamVerifier verifies the certificates of intercepted servers against
+// the system or a custom root store and optional SPKI pins
+type upstreamVerifier struct {
+	roots    *x509.CertPool // nil uses the system roots
+	logOnly  bool           // Log verification failures instead of refusing
+	logChain bool
+	pins     []upstreamPin
+}
+
+// upstreamPin holds the accepted SPKI hashes of a host pattern
+type upstreamPin struct {
+	pattern string
+	hashes  []string
+}
+
+// upstreamInfo is what the verifier learned about an upstream server
+type upstreamInfo struct {
+	chain     []string
+	verifyErr string
+}
+
+// newUpstreamVerifier creates the verifier for a configuration, cfg may be nil
+func newUpstreamVerifier(cfg *UpstreamTLSConfig, projectRoot string) (*upstreamVerifier, error) {
+	v := &upstreamVerifier{}
+	if cfg == nil {
+		return v, nil
+	}
+
+	switch cfg.Verify {
+	case "", "strict":
+	case "log":
+		v.logOnly = true
+	default:
+		return nil, fmt.Errorf("unknown upstream verify mode %q, use \"strict\" or \"log\"", cfg.Verify)
+	}
+	v.logChain = cfg.LogChain
+
+	if cfg.RootCA != "" {
+		path := cfg.RootCA
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(projectRoot, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream root CA: %w", err)
+		}
+		v.roots = x509.NewCertPool()
+		if !v.roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in upstream root CA %s", path)
+		}
+	}
+
+	patterns := make([]string, 0, len(cfg.Pins))
+	for pattern := range cfg.Pins {
+		patterns = append(patterns, pattern)
+	}
+	sortHostPatterns(patterns)
+	for _, pattern := range patterns {
+		pin := upstreamPin{pattern: strings.ToLower(pattern)}
+		for _, hash := range cfg.Pins[pattern] {
+			hash = strings.TrimPrefix(hash, "sha256/")
+			if raw, err := base64.StdEncoding.DecodeString(hash); err != nil || len(raw) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin for %s: %q is not a base64 SHA-256 hash", pattern, hash)
+			}
+			pin.hashes = append(pin.hashes, hash)
+		}
+		v.pins = append(v.pins, pin)
+	}
+	return v, nil
+}
+
+// handshake performs the TLS handshake with the upstream server, offering
+// the given ALPN protocols, and verifies its certificate. In log mode a
+// failed verification is recorded in info instead of failing the handshake.
+func (v *upstreamVerifier) handshake(conn net.Conn, serverName string, protos []string, info *upstreamInfo) (*tls.Conn, error) {
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: serverName,
+		NextProtos: protos,
+		// Verification is done in VerifyConnection, with our roots and pins
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if v.logChain {
+				info.chain = describeChain(state.PeerCertificates)
+			}
+			err := v.verify(state.PeerCertificates, serverName)
+			if err != nil && v.logOnly {
+				info.verifyErr = err.Error()
+				return nil
+			}
+			return err
+		},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// verify checks the chain against the roots and the pins of the host
+func (v *upstreamVerifier) verify(certs []*x509.Certificate, serverName string) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("upstream sent no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         v.roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, pin := range v.pins {
+		if !matchHost(pin.pattern, serverName) {
+			continue
+		}
+		for _, chain := range chains {
+			for _, cert := range chain {
+				if slices.Contains(pin.hashes, spkiHash(cert)) {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("no certificate of %s matches the pins for %s", serverName, pin.pattern)
+	}
+	return nil
+}
+
+// spkiHash returns the base64 SHA-256 hash of a certificate's public key,
+// the format used for pins
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// describeChain lists the subject and pin of each certificate
+func describeChain(certs []*x509.Certificate) []string {
+	chain := make([]string, len(certs))
+	for i, cert := range certs {
+		chain[i] = fmt.Sprintf("%s (sha256/%s)", cert.Subject.String(), spkiHash(cert))
+	}
+	return chain
+}
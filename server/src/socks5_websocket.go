@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes (RFC 6455)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+)
+
+// defaultMaxWebSocketMessages limits the payloads captured per session
+const defaultMaxWebSocketMessages = 100
+
+// WebSocketLog summarizes an intercepted WebSocket session
+type WebSocketLog struct {
+	MessagesSent int64              `json:"messages_sent"`
+	MessagesRecv int64              `json:"messages_recv"`
+	CloseCode    int                `json:"close_code,omitempty"`
+	Messages     []WebSocketMessage `json:"messages,omitempty"` // With websocket.log_payloads
+}
+
+// WebSocketMessage is a captured WebSocket message
+type WebSocketMessage struct {
+	Time       time.Time `json:"time"`
+	Direction  string    `json:"direction"` // "sent" | "recv"
+	Type       string    `json:"type"`      // "text" | "binary"
+	Size       int64     `json:"size"`
+	Payload    string    `json:"payload,omitempty"`    // Truncated at max_body_size, binary as base64
+	Compressed bool      `json:"compressed,omitempty"` // permessage-deflate, payload is not inflated
+}
+
+// isWebSocketUpgrade reports whether a response switches to WebSocket
+func isWebSocketUpgrade(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusSwitchingProtocols &&
+		strings.EqualFold(resp.Header.Get("Upgrade"), "websocket")
+}
+
+// webSocketSession collects the messages of a session from both directions
+type webSocketSession struct {
+	t           *TLSInterceptor
+	capture     bool
+	maxMessages int
+
+	mu  sync.Mutex
+	log WebSocketLog
+}
+
+// relayWebSocket relays the frames of an upgraded connection in both
+// directions and logs the session when both sides are done. The readers
+// hold any frames read along with the upgrade.
+func (t *TLSInterceptor) relayWebSocket(clientConn net.Conn, clientReader *bufio.Reader, serverConn net.Conn, serverReader *bufio.Reader, req *http.Request, destHost string, destPort int, startTime time.Time, logFn func(*ConnectionLog)) {
+	session := &webSocketSession{t: t, maxMessages: defaultMaxWebSocketMessages}
+	if cfg := t.config.WebSocket; cfg != nil {
+		session.capture = cfg.LogPayloads
+		if cfg.MaxMessages > 0 {
+			session.maxMessages = cfg.MaxMessages
+		}
+	}
+
+	var bytesSent, bytesRecv int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Client -> Server
+	go func() {
+		defer wg.Done()
+		bytesSent = session.relay(serverConn, clientReader, "sent")
+		if cw, ok := serverConn.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+	}()
+
+	// Server -> Client
+	go func() {
+		defer wg.Done()
+		bytesRecv = session.relay(clientConn, serverReader, "recv")
+		if cw, ok := clientConn.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+	}()
+
+	wg.Wait()
+
+	correlationID, workerName := requestIdentity(req.Header)
+	logFn(&ConnectionLog{
+		Timestamp:     startTime,
+		CorrelationID: correlationID,
+		WorkerName:    workerName,
+		DestHost:      destHost,
+		DestPort:      destPort,
+		Protocol:      "wss",
+		Method:        req.Method,
+		Path:          req.URL.Path,
+		UserAgent:     req.Header.Get("User-Agent"),
+		StatusCode:    http.StatusSwitchingProtocols,
+		BytesSent:     bytesSent,
+		BytesRecv:     bytesRecv,
+		DurationMs:    time.Since(startTime).Milliseconds(),
+		WebSocket:     &session.log,
+	})
+}
+
+// relay copies frames from src to dst until either side fails, it returns
+// the number of bytes copied
+func (s *webSocketSession) relay(dst io.Writer, src *bufio.Reader, direction string) int64 {
+	var total int64
+	var message *WebSocketMessage // Data message in progress
+	var header [14]byte
+
+	for {
+		// Frame header: flags and opcode, mask bit and 7-bit length,
+		// extended length and masking key
+		if _, err := io.ReadFull(src, header[:2]); err != nil {
+			return total
+		}
+		fin := header[0]&0x80 != 0
+		compressed := header[0]&0x40 != 0
+		opcode := header[0] & 0x0F
+		masked := header[1]&0x80 != 0
+		n := 2
+		length := int64(header[1] & 0x7F)
+		switch length {
+		case 126:
+			if _, err := io.ReadFull(src, header[n:n+2]); err != nil {
+				return total
+			}
+			length = int64(binary.BigEndian.Uint16(header[n:]))
+			n += 2
+		case 127:
+			if _, err := io.ReadFull(src, header[n:n+8]); err != nil {
+				return total
+			}
+			length = int64(binary.BigEndian.Uint64(header[n:]) & (1<<63 - 1))
+			n += 8
+		}
+		var mask []byte
+		if masked {
+			if _, err := io.ReadFull(src, header[n:n+4]); err != nil {
+				return total
+			}
+			mask = header[n : n+4]
+			n += 4
+		}
+		if _, err := dst.Write(header[:n]); err != nil {
+			return total
+		}
+		total += int64(n)
+
+		// Payload, captured as far as needed
+		var captured []byte
+		want := int64(0)
+		switch {
+		case opcode == wsOpClose:
+			want = 2
+		case s.capture && opcode != wsOpContinuation && opcode < wsOpClose:
+			want = int64(s.t.maxBodySize())
+		case s.capture && opcode == wsOpContinuation && message != nil:
+			want = int64(s.t.maxBodySize()) - int64(len(message.Payload))
+		}
+		want = max(0, min(want, length))
+		if want > 0 {
+			captured = make([]byte, want)
+			if _, err := io.ReadFull(src, captured); err != nil {
+				return total
+			}
+			if _, err := dst.Write(captured); err != nil {
+				return total
+			}
+			if mask != nil {
+				for i := range captured {
+					captured[i] ^= mask[i%4]
+				}
+			}
+		}
+		copied, err := io.CopyN(dst, src, length-want)
+		total += want + copied
+		if err != nil {
+			return total
+		}
+
+		// Count messages, a fragmented message starts with a text or
+		// binary frame and ends with a final continuation frame
+		switch opcode {
+		case wsOpText, wsOpBinary:
+			message = &WebSocketMessage{Time: time.Now(), Direction: direction, Type: "text", Compressed: compressed}
+			if opcode == wsOpBinary {
+				message.Type = "binary"
+			}
+			fallthrough
+		case wsOpContinuation:
+			if message == nil {
+				continue
+			}
+			message.Size += length
+			message.Payload += string(captured)
+			if fin {
+				s.finish(message)
+				message = nil
+			}
+		case wsOpClose:
+			if len(captured) == 2 {
+				s.mu.Lock()
+				s.log.CloseCode = int(binary.BigEndian.Uint16(captured))
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// finish counts a complete message and captures its payload
+func (s *webSocketSession) finish(message *WebSocketMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if message.Direction == "sent" {
+		s.log.MessagesSent++
+	} else {
+		s.log.MessagesRecv++
+	}
+	if !s.capture || len(s.log.Messages) >= s.maxMessages {
+		return
+	}
+	if message.Type == "text" && !message.Compressed {
+		// Truncation may have split the last character
+		message.Payload = string(s.t.redact.body([]byte(strings.ToValidUTF8(message.Payload, ""))))
+	} else {
+		message.Payload = base64.StdEncoding.EncodeToString([]byte(message.Payload))
+	}
+	s.log.Messages = append(s.log.Messages, *message)
+}
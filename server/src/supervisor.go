@@ -1,19 +1,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/mevdschee/tqserver/pkg/config/php"
+	"github.com/mevdschee/tqserver/pkg/fastcgi"
+	"github.com/mevdschee/tqserver/pkg/logsink"
 	"github.com/mevdschee/tqserver/pkg/phpfpm"
 )
 
@@ -32,11 +42,32 @@ type Supervisor struct {
 
 	// PHP support
 	// php-fpm supervised instances + clients (single-port per worker)
-	phpLaunchers map[string]*phpfpm.Launcher
-	phpClients   map[string]*phpfpm.Client
+	phpLaunchers map[string][]*phpfpm.Launcher
 
 	// Hot reload support
 	reloadTimers map[string]*time.Timer
+
+	// Lifecycle events for the admin API
+	events *EventLog
+
+	// Mock upstreams of the workers in dev mode
+	mocks *mockServers
+
+	// Go workers whose new binary may still be rolled back
+	rollbacks *rollbackGuard
+
+	// Deploys pulled through the deploy endpoint, one at a time
+	deploys deployState
+
+	// Worker directories created while running are registered, off when
+	// running a single worker
+	autoRegister bool
+
+	// Certificates of mutual TLS with the instances, nil when off
+	mtls *instanceTLS
+
+	// Files with the secret_files of the instances
+	secretFiles *secretFiles
 }
 
 // getFreePort returns the next available port for a worker instance
@@ -60,9 +91,12 @@ func NewSupervisor(config *Config, projectRoot string, router *Router, workerCon
 		workerConfigs: workerConfigs,
 		nextPort:      config.Workers.PortRangeStart,
 		stopChan:      make(chan struct{}),
-		phpLaunchers:  make(map[string]*phpfpm.Launcher),
-		phpClients:    make(map[string]*phpfpm.Client),
+		phpLaunchers:  make(map[string][]*phpfpm.Launcher),
 		reloadTimers:  make(map[string]*time.Timer),
+		events:        NewEventLog(),
+		mocks:         newMockServers(),
+		rollbacks:     newRollbackGuard(),
+		secretFiles:   newSecretFiles(config.Workers.SecretFilesDir, projectRoot),
 	}
 }
 
@@ -71,6 +105,38 @@ func (s *Supervisor) SetProxy(proxy *Proxy) {
 	s.proxy = proxy
 }
 
+// SetAutoRegister enables the registration of worker directories created
+// while the server runs, see discoverWorker
+func (s *Supervisor) SetAutoRegister(enabled bool) {
+	s.autoRegister = enabled
+}
+
+// Events returns the log of worker lifecycle events
+func (s *Supervisor) Events() *EventLog {
+	return s.events
+}
+
+// Mocks returns the mock upstreams of the workers
+func (s *Supervisor) Mocks() *mockServers {
+	return s.mocks
+}
+
+// setBuildResult records the outcome of building or loading a worker
+func (s *Supervisor) setBuildResult(w *Worker, err error) {
+	hadError, _ := w.GetBuildError()
+	w.SetBuildError(err)
+	if err != nil {
+		GetMetrics().RecordBuildError(w.Name)
+		s.events.Record(EventBuildFailed, w.Name, "", "%v", err)
+	} else {
+		s.events.Record(EventBuildSucceeded, w.Name, "", "")
+	}
+	// Open pages show the failure in an overlay until a build succeeds
+	if s.proxy != nil && (err != nil || hadError) {
+		s.proxy.BroadcastBuildResult(w.Name, err)
+	}
+}
+
 // Start starts the supervisor
 func (s *Supervisor) Start() error {
 	// Discover all routes
@@ -78,6 +144,25 @@ func (s *Supervisor) Start() error {
 		return fmt.Errorf("failed to discover routes: %w", err)
 	}
 
+	s.events.Subscribe(s.handleRollbackEvent)
+
+	if s.config.Workers.MTLS {
+		mtls, err := newInstanceTLS(filepath.Join(s.projectRoot, "run", "tls"))
+		if err != nil {
+			return fmt.Errorf("failed to set up mutual TLS with the workers: %w", err)
+		}
+		s.mtls = mtls
+		log.Printf("Mutual TLS with the worker instances enabled")
+	}
+
+	if s.config.UsesPrebuiltWorkers() {
+		if manifest, err := readPackageManifest(s.projectRoot, s.config.Workers.VerifyKey); err != nil {
+			log.Printf("Prebuilt workers: %v", err)
+		} else {
+			log.Printf("Running prebuilt workers of package %s (%s/%s, built %s)", manifest.Version, manifest.OS, manifest.Arch, manifest.Created.Format(time.RFC3339))
+		}
+	}
+
 	// Initialize and start all workers
 	for _, workerMeta := range s.workerConfigs {
 		if !workerMeta.Config.IsEnabled(s.config.Mode) {
@@ -85,65 +170,9 @@ func (s *Supervisor) Start() error {
 			continue
 		}
 
-		worker := &Worker{
-			Name:           workerMeta.Name,
-			Path:           workerMeta.Config.Path,
-			Type:           workerMeta.Config.Type,
-			Instances:      make([]*WorkerInstance, 0),
-			Queue:          make(chan *WorkerRequest, 1000), // Default buffer
-			MinWorkers:     1,
-			MaxWorkers:     5,
-			QueueThreshold: 10,
-			ScaleDownDelay: 60,
-		}
-
-		// Apply scaling config
-		if workerMeta.Config.Scaling != nil {
-			worker.MinWorkers = workerMeta.Config.Scaling.MinWorkers
-			worker.MaxWorkers = workerMeta.Config.Scaling.MaxWorkers
-			worker.QueueThreshold = workerMeta.Config.Scaling.QueueThreshold
-			worker.ScaleDownDelay = workerMeta.Config.Scaling.ScaleDownDelay
-		}
-		if worker.MinWorkers < 1 {
-			worker.MinWorkers = 1
-		}
-		if worker.MaxWorkers < worker.MinWorkers {
-			worker.MaxWorkers = worker.MinWorkers
-		}
-
+		worker := newWorker(workerMeta)
 		s.router.RegisterWorker(worker)
-
-		if worker.Type == "php" {
-			// PHP uses its own manager (php-fpm)
-			if err := s.startPHPWorker(worker, workerMeta); err != nil {
-				log.Printf("Failed to start PHP worker %s: %v", workerMeta.Name, err)
-			}
-		} else {
-			// Start Service (Bun/Go)
-			if err := s.buildWorker(worker); err != nil {
-				log.Printf("Failed to build worker %s: %v", worker.Name, err)
-				worker.SetBuildError(err)
-				GetMetrics().RecordBuildError(worker.Name)
-				// Continue to start dispatcher anyway so we can serve error pages
-			}
-
-			// Initial startup: start workers sequentially to avoid load spikes
-			// We try to start up to MinWorkers here. If any fail, the dispatcher will handle retries.
-			for i := 0; i < worker.MinWorkers; i++ {
-				if _, err := s.scaleUp(worker); err != nil {
-					log.Printf("Failed to start initial worker instance for %s: %v", worker.Name, err)
-					break // Stop synchronous startup on error, let dispatcher retry
-				}
-				// Add a small delay between starts to spread the load
-				if i < worker.MinWorkers-1 {
-					time.Sleep(s.config.GetStartupDelay())
-				}
-			}
-
-			// Start the dispatcher loop for scaling and request handling
-			s.wg.Add(1)
-			go s.runWorkerDispatcher(worker)
-		}
+		s.startWorker(worker, workerMeta)
 	}
 
 	// Setup file watcher
@@ -153,10 +182,21 @@ func (s *Supervisor) Start() error {
 	}
 	s.watcher = watcher
 
-	workersPath := filepath.Join(s.projectRoot, s.config.Workers.Directory)
-	if err := s.watchDirectory(workersPath); err != nil {
+	// Only the directories of configured workers, others are never served
+	for _, workerMeta := range s.workerConfigs {
+		if err := s.watchDirectory(s.workerDir(workerMeta.Name)); err != nil {
+			return fmt.Errorf("failed to watch directory: %w", err)
+		}
+	}
+	// The public files of the server, for the file cache of the proxy
+	if err := s.watchDirectory(s.serverPublicDir()); err != nil {
 		return fmt.Errorf("failed to watch directory: %w", err)
 	}
+	if s.autoRegister {
+		if err := s.watchWorkersRoot(); err != nil {
+			return fmt.Errorf("failed to watch workers directory: %w", err)
+		}
+	}
 
 	s.wg.Add(1)
 	go s.watchForChanges()
@@ -168,6 +208,110 @@ func (s *Supervisor) Start() error {
 	return nil
 }
 
+// newWorker creates a worker from its config
+func newWorker(workerMeta *WorkerConfigWithMeta) *Worker {
+	worker := &Worker{
+		Name:       workerMeta.Name,
+		Path:       workerMeta.Config.Path,
+		Type:       workerMeta.Config.Type,
+		Instances:  make([]*WorkerInstance, 0),
+		Queue:      newRequestQueue(),
+		Logs:       newLogTail(workerLogLines),
+		stopped:    make(chan struct{}),
+		ProxyToken: newProxyToken(),
+	}
+	worker.applyScaling(workerMeta)
+	return worker
+}
+
+// applyScaling sets the scaling limits, queue settings and metrics labels of
+// a worker from its config, the dispatcher picks them up on its next tick
+func (w *Worker) applyScaling(workerMeta *WorkerConfigWithMeta) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.MinWorkers, w.MaxWorkers, w.QueueThreshold, w.ScaleDownDelay = 1, 5, 10, 60
+	if workerMeta.Config.Scaling != nil {
+		w.MinWorkers = workerMeta.Config.Scaling.MinWorkers
+		w.MaxWorkers = workerMeta.Config.Scaling.MaxWorkers
+		w.QueueThreshold = workerMeta.Config.Scaling.QueueThreshold
+		w.ScaleDownDelay = workerMeta.Config.Scaling.ScaleDownDelay
+	}
+	if q := workerMeta.Config.Queue; q != nil {
+		w.Queue.configure(q.Size, q.MaxWaitMs, q.MaxInFlight, q.Shed)
+	} else {
+		w.Queue.configure(0, 0, 0, "")
+	}
+	w.PathTemplates = nil
+	if workerMeta.Config.Metrics != nil {
+		w.PathTemplates = workerMeta.Config.Metrics.PathTemplates
+	}
+	if w.MinWorkers < 1 {
+		w.MinWorkers = 1
+	}
+	if w.MaxWorkers < w.MinWorkers {
+		w.MaxWorkers = w.MinWorkers
+	}
+}
+
+// startWorker builds and starts a registered worker
+func (s *Supervisor) startWorker(worker *Worker, workerMeta *WorkerConfigWithMeta) {
+	s.applyMocks(worker, workerMeta)
+	if worker.Type == "php" {
+		err := s.buildWorker(worker)
+		if err != nil {
+			log.Printf("Failed to build worker %s: %v", worker.Name, err)
+		}
+		s.setBuildResult(worker, err)
+		// PHP uses its own manager (php-fpm)
+		if err := s.startPHPWorker(worker, workerMeta); err != nil {
+			log.Printf("Failed to start PHP worker %s: %v", workerMeta.Name, err)
+		}
+	} else if worker.Type == "wasm" {
+		// WASM modules run in-process, no instances or dispatcher needed
+		err := s.buildWorker(worker)
+		if err != nil {
+			log.Printf("Failed to build worker %s: %v", worker.Name, err)
+		} else if err = s.loadWasmModule(worker); err != nil {
+			log.Printf("Failed to load WASM worker %s: %v", worker.Name, err)
+		}
+		s.setBuildResult(worker, err)
+	} else if worker.Type == "remote" {
+		// Instances run on other machines, they are routed to and checked
+		s.syncRemoteInstances(worker)
+		s.wg.Add(1)
+		go s.runWorkerDispatcher(worker)
+	} else {
+		// Start Service (Bun/Go)
+		err := s.buildWorker(worker)
+		if err != nil {
+			log.Printf("Failed to build worker %s: %v", worker.Name, err)
+			// Continue to start dispatcher anyway so we can serve error pages
+		} else {
+			s.startProbation(worker)
+		}
+		s.setBuildResult(worker, err)
+
+		// Initial startup: start workers sequentially to avoid load spikes
+		// We try to start up to MinWorkers here. If any fail, the dispatcher will handle retries.
+		for i := 0; i < worker.MinWorkers; i++ {
+			if _, err := s.scaleUp(worker); err != nil {
+				log.Printf("Failed to start initial worker instance for %s: %v", worker.Name, err)
+				break // Stop synchronous startup on error, let dispatcher retry
+			}
+			// Add a small delay between starts to spread the load
+			if i < worker.MinWorkers-1 {
+				time.Sleep(s.config.GetStartupDelay())
+			}
+		}
+
+		// Start the dispatcher loop for scaling and request handling
+		s.wg.Add(1)
+		go s.runWorkerDispatcher(worker)
+	}
+	s.scheduleRecycle(worker, time.Now())
+}
+
 // Stop stops the supervisor
 func (s *Supervisor) Stop() {
 	close(s.stopChan)
@@ -182,27 +326,29 @@ func (s *Supervisor) Stop() {
 	}
 
 	// Stop PHP
-	s.mu.Lock()
-	shutdownTimeout := time.Duration(s.config.Workers.ShutdownGracePeriodMs) * time.Millisecond
-	for _, launcher := range s.phpLaunchers {
-		if launcher != nil {
-			launcher.Stop(shutdownTimeout)
+	for _, worker := range workers {
+		if worker.Type == "php" {
+			s.stopPHPPools(worker)
 		}
 	}
-	s.mu.Unlock()
+	s.mocks.stop()
 
 	s.wg.Wait()
+	s.mtls.close()
+	s.secretFiles.close()
 }
 
-// runWorkerDispatcher manages the worker pool, request distribution, and scaling
+// runWorkerDispatcher manages the worker pool and its scaling, requests pick
+// their instance themselves and only those that found none are queued here
 func (s *Supervisor) runWorkerDispatcher(w *Worker) {
 	defer s.wg.Done()
 
 	ticker := time.NewTicker(2 * time.Second) // Scaling check interval
 	defer ticker.Stop()
+	var lowLoadSince time.Time // Since when an instance less could take the load
 
-	// Initial scale up to min workers
-	for len(w.Instances) < w.MinWorkers {
+	// Initial scale up to min workers, remote workers are not scaled
+	for w.Type != "remote" && len(w.Instances) < w.MinWorkers {
 		if _, err := s.scaleUp(w); err != nil {
 			log.Printf("Failed to start initial worker for %s: %v", w.Name, err)
 			time.Sleep(1 * time.Second)
@@ -214,70 +360,114 @@ func (s *Supervisor) runWorkerDispatcher(w *Worker) {
 		case <-s.stopChan:
 			return
 
-		case req := <-w.Queue:
-			// Handle request
-			// Simple Load Balancer: Round Robin
-			// Note: This logic runs in the dispatcher goroutine, serialized.
-			// It ensures we don't pick a dead instance, but doesn't block heavily.
+		case <-w.stopped:
+			return
 
-			// If no instances, try to start one frantically
-			// Check for instances safely
-			w.mu.Lock()
-			if len(w.Instances) == 0 {
-				w.mu.Unlock()
-				log.Printf("No instances for %s! Attempting emergency scale up.", w.Name)
-				if _, err := s.scaleUp(w); err != nil {
-					log.Printf("Emergency scale up failed: %v", err)
-					req.ResponseChan <- nil // Return nil to signal failure
-					continue
-				}
-				w.mu.Lock()
-			}
+		case <-w.Queue.ready:
+			s.serveQueue(w)
 
-			// Re-check inside lock
-			if len(w.Instances) == 0 {
+		case <-ticker.C:
+			// Auto-scaling on the load: the requests in flight on the
+			// instances and those waiting for one. Scaling limits change
+			// on configuration reloads, a manual override replaces them
+			// until it expires. A drained worker runs no instances, a
+			// remote worker those registered.
+			w.mu.Lock()
+			if w.Draining || w.Type == "remote" {
 				w.mu.Unlock()
-				req.ResponseChan <- nil
 				continue
 			}
-
-			// Round Robin
-			idx := w.NextInstance % len(w.Instances)
-			instance := w.Instances[idx]
-			w.NextInstance++
-
-			// Update stats
-			instance.LastRequest = time.Now()
-			w.mu.Unlock()
-
-			req.ResponseChan <- instance
-
-		case <-ticker.C:
-			// Auto-scaling logic
-			queueDepth := len(w.Queue)
-
-			w.mu.Lock()
 			numWorkers := len(w.Instances)
+			load := int64(w.Queue.len())
+			for _, inst := range w.Instances {
+				load += atomic.LoadInt64(&inst.Active)
+			}
+			expired := w.Pinned > 0 && !time.Now().Before(w.PinnedUntil)
+			if expired {
+				w.Pinned = 0
+			}
+			minWorkers, maxWorkers, queueThreshold := w.MinWorkers, w.MaxWorkers, w.QueueThreshold
+			scaleDownDelay := time.Duration(w.ScaleDownDelay) * time.Second
+			if w.Pinned > 0 {
+				minWorkers, maxWorkers = w.Pinned, w.Pinned
+			}
 			w.mu.Unlock()
+			s.serveQueue(w) // In case a wake was missed
+			if expired {
+				log.Printf("[Scaling] %s: manual scaling expired, autoscaling between %d and %d", w.Name, minWorkers, maxWorkers)
+			}
 
-			// Scale UP
-			if queueDepth > w.QueueThreshold && numWorkers < w.MaxWorkers {
-				log.Printf("[Scaling] %s: Queue depth %d > %d. Scaling up.", w.Name, queueDepth, w.QueueThreshold)
+			// Scale UP, above queue_threshold requests per instance
+			if load > int64(queueThreshold*numWorkers) && numWorkers < maxWorkers {
+				log.Printf("[Scaling] %s: Load %d > %d per instance with %d instances. Scaling up.", w.Name, load, queueThreshold, numWorkers)
+				s.events.Record(EventScaleUp, w.Name, "", "load %d > %d per instance with %d instances", load, queueThreshold, numWorkers)
 				go s.scaleUp(w) // prevent blocking dispatcher
 			}
 
 			// Maintain MinWorkers (Healing)
-			if numWorkers < w.MinWorkers {
-				log.Printf("[Scaling] %s: Workers %d < Min %d. Scaling up (healing).", w.Name, numWorkers, w.MinWorkers)
+			if numWorkers < minWorkers {
+				log.Printf("[Scaling] %s: Workers %d < Min %d. Scaling up (healing).", w.Name, numWorkers, minWorkers)
+				s.events.Record(EventScaleUp, w.Name, "", "%d instances < min %d", numWorkers, minWorkers)
 				go s.scaleUp(w)
 			}
 
 			// Scale DOWN
-			// If queue is empty and workers are idle
-			if queueDepth == 0 && numWorkers > w.MinWorkers {
-				s.scaleDown(w)
+			// Down to a lowered max_workers at once, otherwise an instance
+			// once one less could take the load at half the threshold for
+			// scale_down_delay
+			switch {
+			case numWorkers > maxWorkers:
+				s.trimInstances(w, maxWorkers)
+				lowLoadSince = time.Time{}
+			case numWorkers > minWorkers && load*2 <= int64(queueThreshold*(numWorkers-1)):
+				if lowLoadSince.IsZero() {
+					lowLoadSince = time.Now()
+				} else if time.Since(lowLoadSince) >= scaleDownDelay {
+					s.scaleDown(w, minWorkers, load)
+					lowLoadSince = time.Time{}
+				}
+			default:
+				lowLoadSince = time.Time{}
+			}
+		}
+	}
+}
+
+// serveQueue hands the waiting requests an instance in arrival order, the
+// rest keeps waiting until an instance frees up or becomes healthy, or
+// until max_wait_ms. Without instances one is started in the background,
+// unless the worker drains or its instances are remote.
+func (s *Supervisor) serveQueue(w *Worker) {
+	for w.Queue.len() > 0 {
+		w.mu.RLock()
+		draining, startInstance := w.Draining, len(w.Instances) == 0 && w.Type != "remote"
+		w.mu.RUnlock()
+		if draining {
+			for req := w.Queue.pop(); req != nil; req = w.Queue.pop() {
+				req.ResponseChan <- nil
 			}
+			return
+		}
+		if startInstance && w.starting.CompareAndSwap(false, true) {
+			log.Printf("No instances for %s! Attempting emergency scale up.", w.Name)
+			go func() {
+				defer w.starting.Store(false)
+				if _, err := s.scaleUp(w); err != nil {
+					log.Printf("Emergency scale up failed: %v", err)
+				}
+			}()
 		}
+		instance := w.pickInstance()
+		if instance == nil {
+			return
+		}
+		req := w.Queue.pop()
+		if req == nil {
+			// The requests gave up meanwhile
+			w.releaseInstance(instance)
+			return
+		}
+		req.ResponseChan <- instance
 	}
 }
 
@@ -288,34 +478,44 @@ func (s *Supervisor) scaleUp(w *Worker) (*WorkerInstance, error) {
 	return s.spawnWorkerInstance(w)
 }
 
-// scaleDown stops idle worker instances
-func (s *Supervisor) scaleDown(w *Worker) {
+// scaleDown drains the least busy instance above minWorkers, it is stopped
+// once its requests in flight finished
+func (s *Supervisor) scaleDown(w *Worker, minWorkers int, load int64) {
 	w.mu.Lock()
-	defer w.mu.Unlock()
+	if len(w.Instances) <= minWorkers {
+		w.mu.Unlock()
+		return
+	}
+	i := 0
+	for j, inst := range w.Instances {
+		if atomic.LoadInt64(&inst.Active) < atomic.LoadInt64(&w.Instances[i].Active) {
+			i = j
+		}
+	}
+	inst := w.Instances[i]
+	w.Instances = slices.Delete(slices.Clone(w.Instances), i, i+1)
+	inst.Draining = true
+	w.DrainingInstances = append(w.DrainingInstances, inst)
+	remaining, delay := len(w.Instances), w.ScaleDownDelay
+	w.mu.Unlock()
 
-	// Find idle instances
-	now := time.Now()
-	activeInstances := make([]*WorkerInstance, 0)
+	log.Printf("[Scaling] %s: Scaling down instance %s (load %d for %ds)", w.Name, inst.ID, load, delay)
+	s.events.Record(EventScaleDown, w.Name, inst.ID, "load %d for %ds, %d instances left", load, delay, remaining)
+	go s.finishDrain(w, false, []*WorkerInstance{inst}, drainTimeout)
+}
 
-	for _, inst := range w.Instances {
-		// Keep instance if:
-		// 1. We are at or below min workers (safety)
-		// 2. Instance is active (LastRequest < ScaleDownDelay)
-		if len(activeInstances) < w.MinWorkers {
-			activeInstances = append(activeInstances, inst)
-			continue
-		}
+// trimInstances stops the newest instances above a limit
+func (s *Supervisor) trimInstances(w *Worker, limit int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-		idleDuration := now.Sub(inst.LastRequest)
-		if idleDuration.Seconds() < float64(w.ScaleDownDelay) {
-			activeInstances = append(activeInstances, inst)
-		} else {
-			// Terminate
-			log.Printf("[Scaling] %s: Scaling down instance %s (Idle %.0fs)", w.Name, inst.ID, idleDuration.Seconds())
-			go s.terminateInstance(inst)
-		}
+	for len(w.Instances) > limit {
+		inst := w.Instances[len(w.Instances)-1]
+		w.Instances = w.Instances[:len(w.Instances)-1]
+		log.Printf("[Scaling] %s: Scaling down instance %s (above max %d)", w.Name, inst.ID, limit)
+		s.events.Record(EventScaleDown, w.Name, inst.ID, "above max %d", limit)
+		go s.terminateInstance(inst)
 	}
-	w.Instances = activeInstances
 }
 
 // spawnWorkerInstance starts a single process for the worker
@@ -327,129 +527,254 @@ func (s *Supervisor) spawnWorkerInstance(w *Worker) (*WorkerInstance, error) {
 	workerRoot := filepath.Join(s.projectRoot, s.config.Workers.Directory, w.Name)
 	workerMeta := s.getWorkerConfig(w.Name)
 
-	// Prepare command
-	var cmd *exec.Cmd
-
-	if w.Type == "bun" {
-		entrypoint := "index.ts" // Default
-		if workerMeta != nil && workerMeta.Config.Bun != nil && workerMeta.Config.Bun.Entrypoint != "" {
-			entrypoint = workerMeta.Config.Bun.Entrypoint
-		}
-		// Find bun binary
-		bunPath, err := s.findBunBinary()
-		if err != nil {
-			return nil, err
-		}
-		cmd = exec.Command(bunPath, "run", entrypoint)
-	} else {
-		// "go" default
-		binaryPath := filepath.Join(workerRoot, "bin", w.Name)
-		cmd = exec.Command(binaryPath)
+	// Port the process listens on. Containers on a bridge network listen on
+	// their own port, which is published on the allocated worker port.
+	listenPort := port
+	if w.Type == "container" && workerMeta != nil && workerMeta.Config.Container != nil {
+		listenPort = containerListenPort(workerMeta.Config.Container, port)
 	}
 
-	cmd.Dir = workerRoot
-
-	// Environment
-	env := os.Environ()
-	env = append(env, fmt.Sprintf("WORKER_PORT=%d", port))
+	// Environment: the server-wide env, the built-in variables and the
+	// worker's own env, later values win
+	env := []string{}
+	for k, v := range s.config.Env {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	env = append(env, fmt.Sprintf("WORKER_PORT=%d", listenPort))
 	env = append(env, fmt.Sprintf("WORKER_NAME=%s", w.Name))
 	env = append(env, fmt.Sprintf("WORKER_PATH=%s", w.Path))
 	env = append(env, fmt.Sprintf("WORKER_TYPE=%s", w.Type))
 	env = append(env, fmt.Sprintf("WORKER_MODE=%s", s.config.Mode))
-	env = append(env, fmt.Sprintf("PORT=%d", port)) // Standard for many libs
+	env = append(env, fmt.Sprintf("PORT=%d", listenPort)) // Standard for many libs
+
+	// The instance rejects requests without the secret of its worker
+	proxyToken := ""
+	if s.config.Workers.ProxyToken {
+		proxyToken = w.ProxyToken
+		env = append(env, "WORKER_PROXY_TOKEN="+proxyToken)
+	}
 
 	if w.Type == "bun" && workerMeta != nil && workerMeta.Config.Bun != nil {
 		for k, v := range workerMeta.Config.Bun.Env {
 			env = append(env, fmt.Sprintf("%s=%s", k, v))
 		}
 	}
+	if w.Type == "container" && workerMeta != nil && workerMeta.Config.Container != nil {
+		for k, v := range workerMeta.Config.Container.Env {
+			env = append(env, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	for k, v := range s.mocks.env(w.Name) {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
 
 	// SOCKS5 proxy environment variables
 	if s.config.Socks5.Enabled {
-		env = append(env, fmt.Sprintf("SOCKS5_PROXY=socks5://127.0.0.1:%d", s.config.Socks5.Port))
-		env = append(env, fmt.Sprintf("ALL_PROXY=socks5://127.0.0.1:%d", s.config.Socks5.Port))
+		proxyURL := socks5ProxyURL(s.config.Socks5.Port, w.Name)
+		env = append(env, "SOCKS5_PROXY="+proxyURL)
+		env = append(env, "ALL_PROXY="+proxyURL)
 		env = append(env, fmt.Sprintf("TQSERVER_WORKER_UA=TQServer/%s", w.Name))
-		if s.config.Socks5.HTTPSInspection != nil && s.config.Socks5.HTTPSInspection.Enabled {
-			caCert := s.config.Socks5.HTTPSInspection.CACert
-			if !filepath.IsAbs(caCert) {
-				caCert = filepath.Join(s.projectRoot, caCert)
-			}
+		if caCert := s.socks5CACert(); caCert != "" {
 			env = append(env, fmt.Sprintf("SSL_CERT_FILE=%s", caCert))
 			env = append(env, fmt.Sprintf("NODE_EXTRA_CA_CERTS=%s", caCert))
 		}
 	}
 
-	cmd.Env = env
+	// A new certificate per start, the instance serves HTTPS with it and
+	// only accepts the proxy
+	tlsDir := ""
+	if s.mtls != nil {
+		var err error
+		if tlsDir, err = s.mtls.issueInstance(w.Name, port); err != nil {
+			return nil, err
+		}
+		if w.Type == "container" {
+			env = append(env, s.mtls.env(containerTLSDir)...)
+		} else {
+			env = append(env, s.mtls.env(tlsDir)...)
+		}
+	}
 
-	// Determine log file path
-	logPath := fmt.Sprintf("logs/%s_%d.log", w.Name, port) // Default
-	if workerMeta != nil {
-		if workerMeta.Config.Logging.LogFile != "" {
-			logPath = workerMeta.Config.Logging.LogFile
-		} else if workerMeta.Config.LogFile != "" {
-			logPath = workerMeta.Config.LogFile
+	// Secrets in files of the instance instead of its environment
+	secretsDir := ""
+	if workerMeta != nil && len(workerMeta.Config.SecretFiles) > 0 {
+		var err error
+		if secretsDir, err = s.secretFiles.write(w.Name, port, workerMeta.Config.SecretFiles); err != nil {
+			if tlsDir != "" {
+				os.RemoveAll(tlsDir)
+			}
+			return nil, err
+		}
+		if w.Type == "container" {
+			env = append(env, secretFilesEnv(workerMeta.Config.SecretFiles, containerSecretsDir)...)
+		} else {
+			env = append(env, secretFilesEnv(workerMeta.Config.SecretFiles, secretsDir)...)
+		}
+	}
+	removeFiles := func() {
+		for _, dir := range []string{tlsDir, secretsDir} {
+			if dir != "" {
+				os.RemoveAll(dir)
+			}
 		}
 	}
 
-	// Replace placeholders
-	logPath = strings.ReplaceAll(logPath, "{name}", w.Name)
-	logPath = strings.ReplaceAll(logPath, "{port}", fmt.Sprintf("%d", port))
-	logPath = strings.ReplaceAll(logPath, "{date}", time.Now().Format("2006-01-02"))
+	// Prepare command
+	var cmd *exec.Cmd
+	var containerName, containerRuntime string
+	debugPort := 0
 
-	// Resolve absolute path
-	if !filepath.IsAbs(logPath) {
-		logPath = filepath.Join(s.projectRoot, logPath)
+	if w.Type == "bun" {
+		entrypoint := bunEntrypoint(workerMeta)
+		// Find bun binary
+		bunPath, err := findBunBinary()
+		if err != nil {
+			removeFiles()
+			return nil, err
+		}
+		if flag := s.bunWatchFlag(workerMeta); flag != "" {
+			cmd = exec.Command(bunPath, flag, "run", entrypoint)
+		} else {
+			cmd = exec.Command(bunPath, "run", entrypoint)
+		}
+		cmd.Env = append(os.Environ(), env...)
+	} else if w.Type == "container" {
+		if workerMeta == nil || workerMeta.Config.Container == nil {
+			removeFiles()
+			return nil, fmt.Errorf("container worker %s has no container section", w.Name)
+		}
+		runtime, err := findContainerRuntime(workerMeta.Config.Container.Runtime)
+		if err != nil {
+			removeFiles()
+			return nil, err
+		}
+		containerName = fmt.Sprintf("tqserver-%s-%d", w.Name, port)
+		containerRuntime = runtime
+		args := containerRunArgs(workerMeta.Config.Container, containerImage(w.Name, workerMeta.Config.Container), containerName, port, env, tlsDir, secretsDir)
+		cmd = exec.Command(runtime, args...)
+		cmd.Env = append(os.Environ(), env...)
+	} else {
+		// "go" default
+		binaryPath := filepath.Join(workerRoot, "bin", w.Name)
+		if s.config.UsesPrebuiltWorkers() {
+			// Also logged here, healing scale ups do not report errors
+			if err := verifyPrebuiltBinary(s.projectRoot, s.config.Workers.VerifyKey, binaryPath); err != nil {
+				log.Printf("Not starting worker %s: %v", w.Name, err)
+				s.events.Record(EventInstanceFailed, w.Name, "", "%v", err)
+				removeFiles()
+				return nil, err
+			}
+		}
+		if base := s.goDebugPort(workerMeta); base != 0 {
+			dlvPath, err := findDelveBinary()
+			if err != nil {
+				removeFiles()
+				return nil, err
+			}
+			debugPort = freeDebugPort(base)
+			cmd = exec.Command(dlvPath, "exec", binaryPath, "--headless", "--continue", "--accept-multiclient",
+				"--api-version=2", fmt.Sprintf("--listen=127.0.0.1:%d", debugPort))
+			// Delve and the worker it runs are stopped together
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		} else {
+			cmd = exec.Command(binaryPath)
+		}
+		cmd.Env = append(os.Environ(), env...)
 	}
 
-	// Ensure directory exists
-	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
-		log.Printf("Failed to create log directory: %v", err)
-	}
+	cmd.Dir = workerRoot
 
-	// Create/Open log file
-	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err == nil {
-		cmd.Stdout = logFile
-		cmd.Stderr = logFile
-	} else {
-		log.Printf("Failed to open log file %s: %v", logPath, err)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr // Fallback
+	// A confined worker only sees its own directory and the files it is
+	// given, with socks5.enforce it only reaches the ports it is given
+	if w.Type != "container" {
+		var extra []confineMount
+		for _, dir := range []string{tlsDir, secretsDir} {
+			if dir != "" {
+				extra = append(extra, confineMount{Path: dir})
+			}
+		}
+		if caCert := s.socks5CACert(); caCert != "" {
+			extra = append(extra, confineMount{Path: caCert})
+		}
+		inbound := []int{port}
+		if debugPort != 0 {
+			inbound = append(inbound, debugPort)
+		}
+		if c := s.confinement(workerMeta, workerRoot, inbound, extra...); c != nil {
+			if err := confineCommand(cmd, c); err != nil {
+				removeFiles()
+				return nil, err
+			}
+		}
 	}
 
+	var closeLog func()
+	cmd.Stdout, cmd.Stderr, closeLog = s.openWorkerLog(w, workerMeta, port)
+	// The recent output is also kept in memory, the lines prefixed with the port
+	prefix := fmt.Sprintf("[%d] ", port)
+	cmd.Stdout = io.MultiWriter(cmd.Stdout, w.Logs.Writer(prefix))
+	cmd.Stderr = io.MultiWriter(cmd.Stderr, w.Logs.Writer(prefix))
+
 	if err := cmd.Start(); err != nil {
+		closeLog()
+		removeFiles()
 		return nil, err
 	}
 
 	inst := &WorkerInstance{
-		ID:          fmt.Sprintf("%s-%d-%d", w.Name, port, time.Now().UnixNano()), // Manual ID using time
-		Port:        port,
-		Process:     cmd.Process,
-		StartTime:   time.Now(),
-		LastRequest: time.Now(),
-		Healthy:     true,
+		ID:               fmt.Sprintf("%s-%d-%d", w.Name, port, time.Now().UnixNano()), // Manual ID using time
+		Port:             port,
+		Process:          cmd.Process,
+		StartTime:        time.Now(),
+		Healthy:          true,
+		ContainerName:    containerName,
+		ContainerRuntime: containerRuntime,
+		DebugPort:        debugPort,
+		ProxyToken:       proxyToken,
 	}
 
 	log.Printf("Spawned worker instance %s for %s on port %d, waiting for health...", inst.ID, w.Name, port)
+	if debugPort != 0 {
+		log.Printf("Worker instance %s runs under Delve, debugger listening on 127.0.0.1:%d", inst.ID, debugPort)
+	}
 
 	// Wait for health check to pass
-	if err := s.waitForHealth(port); err != nil {
+	if err := s.waitForHealth(port, proxyToken); err != nil {
 		log.Printf("Worker %s failed health check: %v", inst.ID, err)
+		s.events.Record(EventInstanceFailed, w.Name, inst.ID, "%v", err)
 		// Cleanup failed process
+		if inst.ContainerName != "" {
+			stopContainer(inst.ContainerRuntime, inst.ContainerName, s.config.GetShutdownGracePeriod())
+		}
 		cmd.Process.Kill()
+		if debugPort != 0 {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+		cmd.Wait()
+		closeLog()
+		removeFiles()
 		return nil, fmt.Errorf("worker failed health check: %w", err)
 	}
 
 	w.mu.Lock()
 	w.Instances = append(w.Instances, inst)
 	w.mu.Unlock()
+	w.Queue.wake()
 
 	log.Printf("Worker instance %s is ready and added to pool", inst.ID)
+	s.events.Record(EventInstanceStarted, w.Name, inst.ID, "pid %d, port %d", cmd.Process.Pid, port)
 
 	// Monitor process exit
 	go func() {
-		_ = cmd.Wait()
+		err := cmd.Wait()
+		closeLog()
+		removeFiles()
 		log.Printf("Worker instance %s exited", inst.ID)
+		if err != nil {
+			s.events.Record(EventInstanceExited, w.Name, inst.ID, "%v", err)
+		} else {
+			s.events.Record(EventInstanceExited, w.Name, inst.ID, "exit status 0")
+		}
 
 		w.mu.Lock()
 		defer w.mu.Unlock()
@@ -466,40 +791,105 @@ func (s *Supervisor) spawnWorkerInstance(w *Worker) (*WorkerInstance, error) {
 	return inst, nil
 }
 
-func (s *Supervisor) waitForHealth(port int) error {
-	timeoutDuration := s.config.GetHealthCheckWaitTimeout()
-	timeout := time.After(timeoutDuration)
-	ticker := time.NewTicker(100 * time.Millisecond)
-	defer ticker.Stop()
-
-	url := fmt.Sprintf("http://localhost:%d/health", port)
-	client := http.Client{
-		Timeout: 500 * time.Millisecond,
-	}
-
-	for {
-		select {
-		case <-timeout:
-			return fmt.Errorf("timeout waiting for port %d after %v", port, timeoutDuration)
-		case <-ticker.C:
-			resp, err := client.Get(url)
-			if err == nil {
-				if resp.StatusCode == http.StatusOK {
-					resp.Body.Close()
-					return nil
+// openWorkerLog opens the output of a worker instance: its log file, or the
+// configured worker log stream. The returned function closes it once the
+// process has exited.
+func (s *Supervisor) openWorkerLog(w *Worker, workerMeta *WorkerConfigWithMeta, port int) (io.Writer, io.Writer, func()) {
+	if cfg := s.config.Logging.Worker; cfg != nil && cfg.Output != "" && cfg.Output != "file" {
+		out := *cfg
+		out.Tag = strings.ReplaceAll(out.Tag, "{name}", w.Name)
+		stream, err := openLogStream(&s.config.Logging, &out, s.projectRoot, logStreamOptions{
+			tag:    "tqserver-" + w.Name,
+			fields: map[string]string{"TQSERVER_WORKER": w.Name, "TQSERVER_PORT": strconv.Itoa(port)},
+		})
+		if err == nil {
+			stdout, stderr := stream.Writer(), stream.Writer()
+			return stdout, stderr, func() {
+				// Send the last lines without a newline
+				for _, w := range []io.Writer{stdout, stderr} {
+					if sw, ok := w.(*logsink.Writer); ok {
+						sw.Flush()
+					}
 				}
-				resp.Body.Close()
+				stream.Close()
 			}
 		}
+		log.Printf("Failed to open %s log of worker %s, using its log file: %v", cfg.Output, w.Name, err)
 	}
-}
 
-// terminateInstance stops a worker process
-func (s *Supervisor) terminateInstance(inst *WorkerInstance) {
-	if inst.Process != nil {
+	// Determine log file path
+	logPath := fmt.Sprintf("logs/%s_%d.log", w.Name, port) // Default
+	if workerMeta != nil {
+		if workerMeta.Config.Logging.LogFile != "" {
+			logPath = workerMeta.Config.Logging.LogFile
+		} else if workerMeta.Config.LogFile != "" {
+			logPath = workerMeta.Config.LogFile
+		}
+	}
+
+	// Replace placeholders
+	logPath = strings.ReplaceAll(logPath, "{name}", w.Name)
+	logPath = strings.ReplaceAll(logPath, "{port}", fmt.Sprintf("%d", port))
+	logPath = strings.ReplaceAll(logPath, "{date}", time.Now().Format("2006-01-02"))
+
+	// Resolve absolute path
+	if !filepath.IsAbs(logPath) {
+		logPath = filepath.Join(s.projectRoot, logPath)
+	}
+
+	// Ensure directory exists
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		log.Printf("Failed to create log directory: %v", err)
+	}
+
+	// Create/Open log file
+	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Failed to open log file %s: %v", logPath, err)
+		return os.Stdout, os.Stderr, func() {} // Fallback
+	}
+	return logFile, logFile, func() { logFile.Close() }
+}
+
+func (s *Supervisor) waitForHealth(port int, proxyToken string) error {
+	timeoutDuration := s.config.GetHealthCheckWaitTimeout()
+	timeout := time.After(timeoutDuration)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	url := fmt.Sprintf("%s://localhost:%d/health", s.mtls.scheme(), port)
+	client := s.mtls.client(500 * time.Millisecond)
+
+	for {
+		select {
+		case <-timeout:
+			return fmt.Errorf("timeout waiting for port %d after %v", port, timeoutDuration)
+		case <-ticker.C:
+			resp, err := getHealth(client, url, proxyToken)
+			if err == nil {
+				if resp.StatusCode == http.StatusOK {
+					resp.Body.Close()
+					return nil
+				}
+				resp.Body.Close()
+			}
+		}
+	}
+}
+
+// terminateInstance stops a worker process
+func (s *Supervisor) terminateInstance(inst *WorkerInstance) {
+	if inst.ContainerName != "" {
+		stopContainer(inst.ContainerRuntime, inst.ContainerName, s.config.GetShutdownGracePeriod())
+	}
+	if inst.Process != nil {
 		inst.Process.Signal(os.Interrupt)
 		time.Sleep(100 * time.Millisecond)
 		inst.Process.Kill()
+		if inst.DebugPort != 0 {
+			// The worker is a child of Delve
+			syscall.Kill(-inst.Process.Pid, syscall.SIGKILL)
+		}
 	}
 }
 
@@ -521,31 +911,39 @@ func (s *Supervisor) scheduleReload(w *Worker) {
 // reloadWorker rebuilds and restarts the worker
 func (s *Supervisor) reloadWorker(w *Worker) {
 	log.Printf("Reloading worker %s (change detected)", w.Name)
+	s.events.Record(EventWorkerReloaded, w.Name, "", "change detected")
 
 	// Rebuild
 	if err := s.buildWorker(w); err != nil {
-		w.SetBuildError(err)
-		GetMetrics().RecordBuildError(w.Name)
+		s.setBuildResult(w, err)
 		log.Printf("Build failed for worker %s: %v", w.Name, err)
-		if s.proxy != nil {
-			s.proxy.BroadcastReload()
-		}
 		return
 	}
-	w.SetBuildError(nil)
+	s.setBuildResult(w, nil)
+
+	// A drained worker starts from the new build when the drain is cancelled
+	if w.IsDraining() {
+		log.Printf("Worker %s is drained, restart skipped", w.Name)
+		return
+	}
 
 	// Record restart metric
 	GetMetrics().RecordWorkerRestart(w.Name)
+	s.startProbation(w)
 
 	// Rolling Restart:
 	// For each instance, kill it. Logic in dispatcher will respawn it if needed.
 	// Or we can just call stopWorker and let dispatcher respawn.
 	// But dispatcher is running.
 	// Let's just kill all instances. Dispatcher loop will see MinWorkers > len(Instances) and spawn new ones.
-	s.stopWorker(w)
+	if w.Type == "php" {
+		s.reloadPHPWorker(w)
+	} else {
+		s.stopWorker(w)
+	}
 
 	if s.proxy != nil {
-		s.proxy.BroadcastReload()
+		s.proxy.BroadcastReload(w.Path)
 	}
 }
 
@@ -567,34 +965,80 @@ func (s *Supervisor) buildWorker(worker *Worker) error {
 
 	workerRoot := filepath.Join(s.projectRoot, s.config.Workers.Directory, worker.Name)
 
+	if s.config.UsesPrebuiltWorkers() {
+		workerMeta := s.getWorkerConfig(worker.Name)
+		if workerMeta == nil {
+			return fmt.Errorf("worker %s has no config", worker.Name)
+		}
+		if err := checkPrebuiltWorker(s.projectRoot, workerRoot, s.config.Workers.VerifyKey, workerMeta); err != nil {
+			return err
+		}
+		if worker.Type == "container" {
+			// Pulled when the host does not have it yet
+			return buildContainerImage(worker.Name, workerRoot, workerMeta.Config.Container)
+		}
+		return nil
+	}
+
 	if worker.Type == "bun" {
 		// Install dependencies
 		if _, err := os.Stat(filepath.Join(workerRoot, "package.json")); err == nil {
 			// Find bun binary
-			bunPath, err := s.findBunBinary()
+			bunPath, err := findBunBinary()
 			if err != nil {
 				return err
 			}
 			cmd := exec.Command(bunPath, "install")
 			cmd.Dir = workerRoot
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			if err := cmd.Run(); err != nil {
-				return fmt.Errorf("bun install failed: %w", err)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("bun install failed: %s", out)
 			}
 		}
-		return nil
+		return bunTypecheck(workerRoot, s.getWorkerConfig(worker.Name))
 	} else if worker.Type == "go" {
 		// Go build
 		binDir := filepath.Join(workerRoot, "bin")
 		os.MkdirAll(binDir, 0755)
 		binPath := filepath.Join(binDir, worker.Name)
 
-		cmd := exec.Command("go", "build", "-o", binPath, "./src")
+		args := []string{"build", "-o", binPath}
+		if s.goDebugPort(s.getWorkerConfig(worker.Name)) != 0 {
+			// Without optimizations and inlining, for breakpoints and variables
+			args = append(args, "-gcflags=all=-N -l")
+		}
+		s.keepPreviousBinary(worker)
+		cmd := exec.Command("go", append(args, "./src")...)
 		cmd.Dir = workerRoot
 		if out, err := cmd.CombinedOutput(); err != nil {
 			return fmt.Errorf("go build failed: %s", out)
 		}
+		s.cleanupBinaries(worker)
+		return nil
+	} else if worker.Type == "container" {
+		workerMeta := s.getWorkerConfig(worker.Name)
+		if workerMeta == nil || workerMeta.Config.Container == nil {
+			return fmt.Errorf("container worker %s has no container section", worker.Name)
+		}
+		return buildContainerImage(worker.Name, workerRoot, workerMeta.Config.Container)
+	} else if worker.Type == "wasm" {
+		return buildWasmWorker(worker.Name, workerRoot, s.getWorkerConfig(worker.Name))
+	} else if worker.Type == "php" {
+		// Install Composer dependencies, without dev packages in production
+		if _, err := os.Stat(filepath.Join(workerRoot, "composer.json")); err == nil {
+			composerPath, err := exec.LookPath("composer")
+			if err != nil {
+				return fmt.Errorf("composer not found in PATH; install composer to build PHP worker %s", worker.Name)
+			}
+			args := []string{"install", "--no-interaction", "--no-progress"}
+			if !s.config.IsDevelopmentMode() {
+				args = append(args, "--no-dev", "--optimize-autoloader")
+			}
+			cmd := exec.Command(composerPath, args...)
+			cmd.Dir = workerRoot
+			if out, err := cmd.CombinedOutput(); err != nil {
+				return fmt.Errorf("composer install failed: %s", out)
+			}
+		}
 		return nil
 	}
 
@@ -603,12 +1047,12 @@ func (s *Supervisor) buildWorker(worker *Worker) error {
 
 // Helper: getWorkerConfig
 func (s *Supervisor) getWorkerConfig(name string) *WorkerConfigWithMeta {
-	for _, wc := range s.workerConfigs {
-		if wc.Name == name {
-			return wc
-		}
-	}
-	return nil
+	return findWorkerConfig(s.workerConfigs, name)
+}
+
+// workerDir returns the directory of a worker
+func (s *Supervisor) workerDir(name string) string {
+	return filepath.Join(s.projectRoot, s.config.Workers.Directory, name)
 }
 
 // watchDirectory recursively watches a directory and its subdirectories
@@ -624,9 +1068,7 @@ func (s *Supervisor) watchDirectory(dir string) error {
 			return err
 		}
 		if info.IsDir() {
-			base := filepath.Base(path)
-			// Skip hidden dirs, bin, and node_modules
-			if strings.HasPrefix(base, ".") || base == "bin" || base == "node_modules" {
+			if unwatchedDir(filepath.Base(path)) {
 				return filepath.SkipDir
 			}
 			s.watcher.Add(path)
@@ -635,6 +1077,12 @@ func (s *Supervisor) watchDirectory(dir string) error {
 	})
 }
 
+// unwatchedDir reports whether a directory is skipped by the file watcher:
+// hidden directories, bin, and installed dependencies
+func unwatchedDir(name string) bool {
+	return strings.HasPrefix(name, ".") || name == "bin" || name == "node_modules" || name == "vendor"
+}
+
 // watchForChanges monitors file system changes
 func (s *Supervisor) watchForChanges() {
 	defer s.wg.Done()
@@ -646,22 +1094,44 @@ func (s *Supervisor) watchForChanges() {
 			if !ok {
 				return
 			}
+			// The file cache of the proxy looks up changed files again
+			if s.proxy != nil {
+				s.proxy.InvalidateFile(event.Name)
+			}
+			if event.Op&fsnotify.Create != 0 {
+				s.watchPublicDir(event.Name)
+			}
 			// Build artifacts might still trigger events if the parent dir is watched,
 			// or if the ignore logic above missed something.
 			// Double check in handleFileEvent.
 			if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
 				s.handleFileEvent(event.Name)
+			} else if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && s.autoRegister {
+				s.handleRemovedPath(event.Name)
+			}
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been lost, like on a queue overflow, so
+			// the caches cannot tell which files changed
+			log.Printf("File watcher error, purging the file caches: %v", err)
+			if s.proxy != nil {
+				s.proxy.PurgeFiles()
 			}
-		case <-s.watcher.Errors:
-			return
 		}
 	}
 }
 
 // handleFileEvent
 func (s *Supervisor) handleFileEvent(path string) {
-	// Ignore changes in bin or node_modules (extra safety)
-	if strings.Contains(path, "/bin/") || strings.Contains(path, "/node_modules/") {
+	// Ignore changes in bin, node_modules or vendor (extra safety)
+	if strings.Contains(path, "/bin/") || strings.Contains(path, "/node_modules/") || strings.Contains(path, "/vendor/") {
+		return
+	}
+	switch filepath.Base(path) {
+	case "bin", "node_modules", "vendor":
+		// Created by the first build or install
 		return
 	}
 
@@ -669,257 +1139,1048 @@ func (s *Supervisor) handleFileEvent(path string) {
 	workers := s.router.GetAllWorkers()
 	for _, w := range workers {
 		workerDir := filepath.Join(s.projectRoot, s.config.Workers.Directory, w.Name)
-		if strings.HasPrefix(path, workerDir) {
-			log.Printf("Change detected in %s, reloading worker %s", path, w.Name)
+		if strings.HasPrefix(path, workerDir+string(filepath.Separator)) {
+			// Config changes apply to the running worker, see reloadWorkerConfig.
+			// Other files in the config directory are editor temporaries.
+			if filepath.Dir(path) == filepath.Join(workerDir, "config") {
+				if isWorkerConfigFile(path) {
+					s.scheduleConfigReload(w)
+				}
+				return
+			}
+
+			// Public files are served from disk, the pages using them
+			// refresh without a rebuild. PHP scripts are no assets.
+			if urlPath, ok := publicURLPath(workerDir, path); ok && !(w.Type == "php" && strings.Contains(urlPath, ".php")) {
+				log.Printf("Change detected in %s, refreshing %s for worker %s", path, urlPath, w.Name)
+				if s.proxy != nil {
+					s.proxy.BroadcastAsset(urlPath)
+				}
+				return
+			}
+
+			// Templates read on each render only reload the pages of the
+			// worker, without a rebuild
+			if s.isTemplateOnlyChange(w, workerDir, path) {
+				log.Printf("Template change detected in %s, reloading pages of worker %s", path, w.Name)
+				if s.proxy != nil {
+					s.proxy.BroadcastReload(w.Path)
+				}
+				return
+			}
 
-			// Rebuild
-			if err := s.buildWorker(w); err != nil {
-				w.SetBuildError(err)
-				GetMetrics().RecordBuildError(w.Name)
-				log.Printf("Build failed: %v", err)
+			// Bun reloads its own modules in watch/hot mode, only dependency
+			// changes still need an install and a restart
+			if w.Type == "bun" && s.bunWatchFlag(s.getWorkerConfig(w.Name)) != "" && !isBunDependencyFile(path) {
+				log.Printf("Change detected in %s, reload delegated to bun for worker %s", path, w.Name)
+				if workerMeta := s.getWorkerConfig(w.Name); workerMeta.Config.Bun.Typecheck != "" {
+					// Bun runs the new code anyway, the check only reports
+					go s.setBuildResult(w, bunTypecheck(workerDir, workerMeta))
+				}
 				if s.proxy != nil {
-					s.proxy.BroadcastReload()
+					time.AfterFunc(s.config.GetStartupDelay(), func() { s.proxy.BroadcastReload(w.Path) })
 				}
+				s.runTests(w)
+				return
+			}
+
+			// Remote workers are deployed on their own machines, a deploy
+			// rolls out the workers it changes itself
+			if w.Type == "remote" || s.deploys.active.Load() {
 				return
 			}
-			w.SetBuildError(nil)
+
+			log.Printf("Change detected in %s, reloading worker %s", path, w.Name)
+			s.events.Record(EventWorkerReloaded, w.Name, "", "change detected in %s", path)
+
+			// Rebuild, PHP workers only when their dependencies change
+			if w.Type != "php" || isComposerFile(path) {
+				if err := s.buildWorker(w); err != nil {
+					s.setBuildResult(w, err)
+					log.Printf("Build failed: %v", err)
+					return
+				}
+				s.setBuildResult(w, nil)
+			}
 
 			// Record restart metric
 			GetMetrics().RecordWorkerRestart(w.Name)
-
-			// Rolling Restart:
-			// For each instance, kill it. Logic in dispatcher will respawn it if needed.
-			s.stopWorker(w)
+			s.startProbation(w)
+
+			if w.Type == "wasm" {
+				// Swap in the new module, in-flight requests finish on the old one
+				if err := s.loadWasmModule(w); err != nil {
+					w.SetBuildError(err)
+					s.events.Record(EventBuildFailed, w.Name, "", "failed to load WASM module: %v", err)
+					log.Printf("Failed to load WASM module: %v", err)
+				}
+			} else if w.Type == "php" {
+				// php-fpm is reloaded in place or restarted, see php.reload
+				s.reloadPHPWorker(w)
+			} else {
+				// Rolling Restart:
+				// For each instance, kill it. Logic in dispatcher will respawn it if needed.
+				s.stopWorker(w)
+			}
 
 			if s.proxy != nil {
-				s.proxy.BroadcastReload()
+				s.proxy.BroadcastReload(w.Path)
+			}
+			s.runTests(w)
+			return
+		}
+	}
+
+	// A worker directory that is not registered yet, see discoverWorker
+	if s.autoRegister {
+		if name := s.unknownWorkerDir(path); name != "" {
+			s.scheduleWorkerDiscovery(name)
+		}
+	}
+}
+
+// serverPublicDir returns the public directory of the server
+func (s *Supervisor) serverPublicDir() string {
+	return filepath.Join(s.projectRoot, "server", "public")
+}
+
+// watchPublicDir watches a directory created below a public directory, the
+// changes of its files invalidate the file cache of the proxy
+func (s *Supervisor) watchPublicDir(path string) {
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return
+	}
+	public := strings.HasPrefix(path, s.serverPublicDir()+string(filepath.Separator))
+	if rel, err := filepath.Rel(s.workersRoot(), path); err == nil && !public {
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		public = len(parts) > 2 && parts[0] != ".." && parts[1] == "public"
+	}
+	if public {
+		s.watchDirectory(path)
+	}
+}
+
+// publicURLPath returns the URL path a file below the public directory of a
+// worker is served at, see handleRequest
+func publicURLPath(workerDir, path string) (string, bool) {
+	rel, err := filepath.Rel(filepath.Join(workerDir, "public"), path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return "/" + filepath.ToSlash(rel), true
+}
+
+// phpPoolSpec describes one php-fpm pool of a PHP worker
+type phpPoolSpec struct {
+	name     string // empty for the default pool
+	paths    []string
+	pool     PHPPoolConfig
+	settings map[string]string
+}
+
+// phpPoolSpecs returns the default pool of a PHP worker followed by the
+// additional pools, with their settings merged over php.settings
+func phpPoolSpecs(workerMeta *WorkerConfigWithMeta) ([]phpPoolSpec, error) {
+	phpCfg := workerMeta.Config.PHP
+	specs := []phpPoolSpec{{pool: phpCfg.Pool, settings: phpCfg.Settings}}
+	for _, extra := range phpCfg.Pools {
+		if extra.Name == "" || len(extra.Paths) == 0 {
+			return nil, fmt.Errorf("invalid php pool %q: name and paths are required", extra.Name)
+		}
+		settings := make(map[string]string, len(phpCfg.Settings)+len(extra.Settings))
+		for k, v := range phpCfg.Settings {
+			settings[k] = v
+		}
+		for k, v := range extra.Settings {
+			settings[k] = v
+		}
+		specs = append(specs, phpPoolSpec{name: extra.Name, paths: extra.Paths, pool: extra.Pool, settings: settings})
+	}
+	return specs, nil
+}
+
+// names returns the php-fpm pool name, the name used in log messages and
+// the pseudo-instance ID of a pool. Extra pools are named after the worker
+// and the pool.
+func (spec phpPoolSpec) names(worker *Worker) (poolName, label, instanceID string) {
+	if spec.name == "" {
+		return worker.Name, worker.Name, "php-master"
+	}
+	return worker.Name + "-" + spec.name, worker.Name + "/" + spec.name, "php-" + spec.name
+}
+
+// findPHPBinary determines the php-fpm binary to execute. Prefer the
+// worker-specified binary, otherwise try common names (php-fpm, php-cgi, php)
+// and scan PATH for php-fpm* executables.
+func findPHPBinary(preferred string) (string, error) {
+	if preferred != "" {
+		if p, err := exec.LookPath(preferred); err == nil {
+			return p, nil
+		}
+		// try as provided path
+		if _, err := os.Stat(preferred); err == nil {
+			return preferred, nil
+		}
+	}
+
+	candidates := []string{"php-fpm", "php-fpm8.3", "php-fpm8.2", "php-fpm8.1", "php-fpm8.0", "php-fpm7.4", "php-cgi", "php"}
+	for _, c := range candidates {
+		if p, err := exec.LookPath(c); err == nil {
+			return p, nil
+		}
+	}
+
+	// Scan PATH directories for files starting with php-fpm
+	pathEnv := os.Getenv("PATH")
+	for _, dir := range strings.Split(pathEnv, ":") {
+		if dir == "" {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if strings.HasPrefix(name, "php-fpm") {
+				full := filepath.Join(dir, name)
+				if st, err := os.Stat(full); err == nil {
+					if st.Mode().Perm()&0111 != 0 {
+						return full, nil
+					}
+				}
+			}
+		}
+	}
+
+	// Also check common sbin directories where system packages may install php-fpm
+	sbinDirs := []string{"/usr/sbin", "/sbin", "/usr/local/sbin"}
+	for _, dir := range sbinDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if strings.HasPrefix(name, "php-fpm") || strings.HasPrefix(name, "php") {
+				full := filepath.Join(dir, name)
+				if st, err := os.Stat(full); err == nil {
+					if st.Mode().Perm()&0111 != 0 {
+						return full, nil
+					}
+				}
+			}
+		}
+	}
+
+	return "", fmt.Errorf("php-fpm binary not found in PATH; install php-fpm or set php.binary in worker config")
+}
+
+// startPHPWorker starts the php-fpm pools of a PHP worker: the default pool
+// configured by php.pool and one more for each entry of php.pools.
+func (s *Supervisor) startPHPWorker(worker *Worker, workerMeta *WorkerConfigWithMeta) error {
+	// PHP is special because php-fpm manages its own processes. We treat the
+	// listener of each pool as an "Instance".
+	workerRoot := filepath.Join(s.projectRoot, s.config.Workers.Directory, worker.Name)
+	phpCfg := workerMeta.Config.PHP
+
+	// Stop the pools of a previous start, a unix socket can only be bound once
+	s.stopPHPPools(worker)
+
+	binaryPath, err := findPHPBinary(phpCfg.Binary)
+	if err != nil {
+		return err
+	}
+
+	rewriter, err := phpfpm.NewRewriter(phpCfg.Rewrites)
+	if err != nil {
+		return fmt.Errorf("invalid php rewrites: %w", err)
+	}
+
+	switch phpCfg.Reload {
+	case "", "restart", "graceful", "opcache_reset":
+	default:
+		return fmt.Errorf("invalid php reload strategy %q", phpCfg.Reload)
+	}
+
+	specs, err := phpPoolSpecs(workerMeta)
+	if err != nil {
+		return err
+	}
+
+	var pools []*PHPPool
+	var launchers []*phpfpm.Launcher
+	var instances []*WorkerInstance
+	for _, spec := range specs {
+		pool, launcher, inst, err := s.startPHPPool(worker, workerMeta, workerRoot, binaryPath, spec)
+		if err != nil {
+			for i, launcher := range launchers {
+				pools[i].close()
+				_ = launcher.Stop(1 * time.Second)
+			}
+			return err
+		}
+		pools = append(pools, pool)
+		launchers = append(launchers, launcher)
+		instances = append(instances, inst)
+	}
+
+	s.mu.Lock()
+	s.phpLaunchers[worker.Name] = launchers
+	s.mu.Unlock()
+
+	worker.mu.Lock()
+	worker.PHPPools = pools
+	worker.PHPRewriter = rewriter
+	worker.PHPTryFiles = phpCfg.TryFiles
+	// Register pseudo-instances for proxy to find
+	worker.Instances = append(worker.Instances, instances...)
+	worker.mu.Unlock()
+
+	return nil
+}
+
+// startPHPPool starts php-fpm for one pool of a PHP worker and connects a
+// FastCGI client to it
+func (s *Supervisor) startPHPPool(worker *Worker, workerMeta *WorkerConfigWithMeta, workerRoot, binaryPath string, spec phpPoolSpec) (*PHPPool, *phpfpm.Launcher, *WorkerInstance, error) {
+	_, label, instanceID := spec.names(worker)
+
+	var port int
+	var fcgiServerAddr, transport string
+	if socket := spec.pool.ListenSocket; socket != "" {
+		// Unix socket: no port needed
+		if !filepath.IsAbs(socket) {
+			socket = filepath.Join(workerRoot, socket)
+		}
+		if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to create socket directory: %w", err)
+		}
+		// Remove a stale socket left behind by a previous run
+		_ = os.Remove(socket)
+		fcgiServerAddr = socket
+		transport = "unix"
+	} else {
+		port = s.getFreePort()
+
+		// Build listen address: prefer configured listen_address, fall back to localhost
+		host := spec.pool.ListenAddress
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		fcgiServerAddr = net.JoinHostPort(host, strconv.Itoa(port))
+		transport = "tcp"
+
+		// If the chosen port is already bound by another process (e.g., system php-fpm),
+		// probe and pick the next free port. This avoids falsely succeeding when
+		// `net.Dial` connects to an unrelated service on the same port.
+		maxAttempts := s.config.Workers.PortRangeEnd - s.config.Workers.PortRangeStart + 1
+		tried := 0
+		for tried < maxAttempts {
+			// try to listen briefly to check availability
+			ln, err := net.Listen("tcp", fcgiServerAddr)
+			if err == nil {
+				_ = ln.Close()
+				break
 			}
+			// port in use, pick next
+			port = s.getFreePort()
+			fcgiServerAddr = net.JoinHostPort(host, strconv.Itoa(port))
+			tried++
+		}
+		if tried >= maxAttempts {
+			return nil, nil, nil, fmt.Errorf("no free port available in range %d-%d", s.config.Workers.PortRangeStart, s.config.Workers.PortRangeEnd)
+		}
+	}
+
+	log.Printf("Starting PHP worker pool for %s (dynamic manager)", label)
+
+	cfg, err := s.phpFPMConfig(worker, workerMeta, workerRoot, binaryPath, spec, fcgiServerAddr, transport, port)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if mode := cfg.PHPFPM.Env["XDEBUG_MODE"]; mode != "" {
+		log.Printf("PHP worker %s: xdebug %s mode, connecting to %s", label, mode, net.JoinHostPort(cfg.Settings["xdebug.client_host"], cfg.Settings["xdebug.client_port"]))
+	}
+
+	// Start php-fpm via launcher, its error log is followed from the start
+	launcher := phpfpm.NewLauncher(cfg)
+	confine := s.phpConfinement(workerMeta, workerRoot, cfg)
+	if confine != nil {
+		launcher.Prepare = func(cmd *exec.Cmd) error {
+			return confineCommand(cmd, confine)
+		}
+	}
+	errorLog := phpfpm.NewLogTail(launcher.ErrorLogPath())
+	errorLog.OnLine = func(line string) {
+		worker.Logs.AddLine("[php-fpm " + label + "] " + line)
+	}
+	errorLog.Start()
+
+	if err := launcher.Start(); err != nil {
+		errorLog.Stop()
+		return nil, nil, nil, fmt.Errorf("failed to start php-fpm for %s: %w", label, err)
+	}
+
+	// Wait for php-fpm
+	ready := false
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout(cfg.PHPFPM.Transport, cfg.PHPFPM.Listen, 250*time.Millisecond)
+		if err == nil {
+			conn.Close()
+			ready = true
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !ready {
+		errorLog.Stop()
+		_ = launcher.Stop(1 * time.Second)
+		return nil, nil, nil, fmt.Errorf("php-fpm did not become ready on %s", cfg.PHPFPM.Listen)
+	}
+
+	client := newPHPClient(label, cfg, workerMeta.Config.PHP.Multiplex)
+	slowlog := startPHPSlowlog(label, cfg, launcher)
+
+	pool := &PHPPool{
+		Name:     spec.name,
+		Paths:    spec.paths,
+		Client:   client,
+		Slowlog:  slowlog,
+		ErrorLog: errorLog,
+		Confine:  confine,
+	}
+	inst := &WorkerInstance{
+		ID:        instanceID,
+		Port:      port,
+		Healthy:   true,
+		StartTime: time.Now(),
+	}
+
+	log.Printf("✅ PHP Worker pool started for %s on %s", label, fcgiServerAddr)
+	return pool, launcher, inst, nil
+}
+
+// phpFPMConfig builds the php-fpm configuration of one pool of a PHP worker
+// listening on addr
+func (s *Supervisor) phpFPMConfig(worker *Worker, workerMeta *WorkerConfigWithMeta, workerRoot, binaryPath string, spec phpPoolSpec, addr, transport string, port int) (*php.Config, error) {
+	phpCfg := workerMeta.Config.PHP
+	poolName, label, _ := spec.names(worker)
+
+	// Determine document root
+	documentRoot := filepath.Join(workerRoot, "public")
+
+	// Prepare environment variables for PHP worker, over the server-wide env
+	envVars := map[string]string{}
+	for k, v := range s.config.Env {
+		envVars[k] = v
+	}
+	envVars["WORKER_SERVER_MODE"] = s.config.Mode
+	envVars["WORKER_NAME"] = worker.Name
+	envVars["WORKER_PATH"] = worker.Path
+	envVars["WORKER_PORT"] = fmt.Sprintf("%d", port)
+	envVars["WORKER_TYPE"] = worker.Type
+	if transport == "unix" {
+		envVars["WORKER_SOCKET"] = addr
+	}
+	if spec.name != "" {
+		envVars["WORKER_POOL"] = spec.name
+	}
+	for k, v := range s.mocks.env(worker.Name) {
+		envVars[k] = v
+	}
+
+	// SOCKS5 proxy environment variables for PHP
+	if s.config.Socks5.Enabled {
+		proxyURL := socks5ProxyURL(s.config.Socks5.Port, worker.Name)
+		envVars["SOCKS5_PROXY"] = proxyURL
+		envVars["ALL_PROXY"] = proxyURL
+		envVars["TQSERVER_WORKER_UA"] = fmt.Sprintf("TQServer/%s", worker.Name)
+		if caCert := s.socks5CACert(); caCert != "" {
+			envVars["SSL_CERT_FILE"] = caCert
+		}
+	}
+
+	// Step debugging, xdebug.mode can only be set through the environment
+	settings := spec.settings
+	if xdebug := phpCfg.Xdebug; xdebug != nil && xdebug.Enabled && s.config.IsDevelopmentMode() {
+		mode := xdebug.Mode
+		if mode == "" {
+			mode = "debug"
+		}
+		clientHost := xdebug.ClientHost
+		if clientHost == "" {
+			clientHost = "127.0.0.1"
+		}
+		clientPort := xdebug.ClientPort
+		if clientPort == 0 {
+			clientPort = 9003
+		}
+		startWithRequest := xdebug.StartWithRequest
+		if startWithRequest == "" {
+			startWithRequest = "trigger"
+		}
+		envVars["XDEBUG_MODE"] = mode
+		envVars["XDEBUG_CONFIG"] = fmt.Sprintf("client_host=%s client_port=%d", clientHost, clientPort)
+
+		settings = make(map[string]string, len(spec.settings)+4)
+		for k, v := range spec.settings {
+			settings[k] = v
+		}
+		settings["xdebug.client_host"] = clientHost
+		settings["xdebug.client_port"] = strconv.Itoa(clientPort)
+		settings["xdebug.start_with_request"] = startWithRequest
+		if xdebug.IDEKey != "" {
+			settings["xdebug.idekey"] = xdebug.IDEKey
+		}
+	}
+
+	cfg := &php.Config{
+		PHPFPMBinary: binaryPath,
+		PHPIni:       phpCfg.ConfigFile,
+		DocumentRoot: documentRoot,
+		Settings:     settings,
+		PreloadUser:  phpCfg.PreloadUser,
+		PHPFPM: php.PHPFPMConfig{
+			Enabled:            true,
+			Listen:             addr,
+			Transport:          transport,
+			GeneratedConfigDir: filepath.Join(os.TempDir(), "tqserver-phpfpm", poolName),
+			NoDaemonize:        true,
+			Env:                envVars,
+		},
+	}
+
+	if preload := phpCfg.Preload; preload != "" {
+		if !filepath.IsAbs(preload) {
+			preload = filepath.Join(workerRoot, preload)
+		}
+		cfg.Preload = preload
+	}
+
+	// Map pool fields
+	cfg.PHPFPM.Pool = php.PoolConfig{
+		Name:                    poolName,
+		PM:                      spec.pool.Manager,
+		MaxChildren:             spec.pool.MaxWorkers,
+		StartServers:            spec.pool.StartWorkers,
+		MinSpareServers:         spec.pool.MinWorkers,
+		MaxSpareServers:         spec.pool.MaxWorkers,
+		MaxRequests:             spec.pool.MaxRequests,
+		RequestTerminateTimeout: time.Duration(spec.pool.RequestTimeout) * time.Second,
+		ProcessIdleTimeout:      time.Duration(spec.pool.IdleTimeout) * time.Second,
+		RequestSlowlogTimeout:   time.Duration(spec.pool.RequestSlowlogTimeout) * time.Second,
+	}
+	if slowlog := spec.pool.Slowlog; slowlog != "" {
+		if !filepath.IsAbs(slowlog) {
+			slowlog = filepath.Join(workerRoot, slowlog)
+		}
+		cfg.PHPFPM.Pool.Slowlog = slowlog
+	}
+
+	// Validate config
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid php-fpm config for %s: %w", label, err)
+	}
+	return cfg, nil
+}
+
+// phpConfinement returns the limits of php-fpm, nil without limits. Besides
+// the paths of every worker a confined php-fpm gets its generated
+// configuration, socket, slowlog and php.ini, a FastCGI port is forwarded.
+func (s *Supervisor) phpConfinement(workerMeta *WorkerConfigWithMeta, workerRoot string, cfg *php.Config) *confinement {
+	extra := []confineMount{{Path: cfg.PHPFPM.GeneratedConfigDir, Writable: true}}
+	if cfg.PHPFPM.Transport == "unix" {
+		extra = append(extra, confineMount{Path: filepath.Dir(cfg.PHPFPM.Listen), Writable: true})
+	}
+	if slowlog := cfg.PHPFPM.Pool.Slowlog; slowlog != "" {
+		extra = append(extra, confineMount{Path: filepath.Dir(slowlog), Writable: true})
+	}
+	if ini := cfg.PHPIni; ini != "" {
+		if !filepath.IsAbs(ini) {
+			ini = filepath.Join(s.projectRoot, ini)
+		}
+		extra = append(extra, confineMount{Path: ini})
+	}
+	if caCert := s.socks5CACert(); caCert != "" {
+		extra = append(extra, confineMount{Path: caCert})
+	}
+	var inbound []int
+	if cfg.PHPFPM.Transport == "tcp" {
+		_, port, _ := net.SplitHostPort(cfg.PHPFPM.Listen)
+		if n, err := strconv.Atoi(port); err == nil {
+			inbound = append(inbound, n)
+		}
+	}
+	return s.confinement(workerMeta, workerRoot, inbound, extra...)
+}
+
+// newPHPClient creates the pooled FastCGI client for a php-fpm pool, sized
+// by what php-fpm reports it accepts
+func newPHPClient(label string, cfg *php.Config, multiplex int) *fastcgi.Client {
+	poolSize := cfg.PHPFPM.Pool.MaxChildren
+	if poolSize <= 0 {
+		poolSize = 2
+	}
+
+	// Ask php-fpm how many connections it accepts and whether it multiplexes
+	probe := fastcgi.NewClient(cfg.PHPFPM.Listen, cfg.PHPFPM.Transport, 0, 1*time.Second, 0)
+	if values, err := probe.GetValues(fastcgi.ValueMaxConns, fastcgi.ValueMpxsConns); err == nil {
+		if maxConns, err := strconv.Atoi(values[fastcgi.ValueMaxConns]); err == nil && maxConns > 0 {
+			poolSize = maxConns
+		}
+		if multiplex > 0 && values[fastcgi.ValueMpxsConns] == "0" {
+			log.Printf("PHP worker %s: backend does not support multiplexing, disabling it", label)
+			multiplex = 0
+		}
+	} else {
+		log.Printf("PHP worker %s: FCGI_GET_VALUES failed, using pool size %d: %v", label, poolSize, err)
+	}
+
+	client := fastcgi.NewClient(cfg.PHPFPM.Listen, cfg.PHPFPM.Transport, poolSize, 5*time.Second, cfg.PHPFPM.Pool.RequestTerminateTimeout)
+	client.OnStderr = func(stderr []byte) {
+		log.Printf("[PHP stderr] %s", stderr)
+	}
+	if multiplex > 0 {
+		client.SetMultiplex(multiplex)
+	}
+	return client
+}
+
+// startPHPSlowlog follows the slowlog of a php-fpm pool so slow scripts show
+// up in the server log. It returns nil when the slowlog is disabled.
+func startPHPSlowlog(label string, cfg *php.Config, launcher *phpfpm.Launcher) *phpfpm.SlowlogTail {
+	if cfg.PHPFPM.Pool.RequestSlowlogTimeout <= 0 {
+		return nil
+	}
+	slowlog := phpfpm.NewSlowlogTail(launcher.SlowlogPath(), 100)
+	slowlog.OnEntry = func(entry phpfpm.SlowEntry) {
+		log.Printf("[PHP slow] %s: %s (pid %d) exceeded %s\n  %s", label, entry.ScriptFilename, entry.PID,
+			cfg.PHPFPM.Pool.RequestSlowlogTimeout, strings.Join(entry.Trace, "\n  "))
+	}
+	slowlog.Start()
+	log.Printf("PHP worker %s: tracing requests slower than %s to %s", label, cfg.PHPFPM.Pool.RequestSlowlogTimeout, slowlog.Path())
+	return slowlog
+}
+
+// reloadPHPWorker applies code changes to a PHP worker using the strategy
+// configured in php.reload, falling back to a restart when that fails
+func (s *Supervisor) reloadPHPWorker(w *Worker) {
+	workerMeta := s.getWorkerConfig(w.Name)
+	if workerMeta == nil || workerMeta.Config.PHP == nil {
+		return
+	}
+	strategy := workerMeta.Config.PHP.Reload
+
+	// Changed pool settings are applied without dropping requests, which
+	// also picks up code changes
+	changed, err := s.reconfigurePHPWorker(w, workerMeta)
+	if err != nil {
+		log.Printf("PHP worker %s can not be reconfigured in place, restarting: %v", w.Name, err)
+		s.stopWorker(w)
+		if err := s.startPHPWorker(w, workerMeta); err != nil {
+			log.Printf("Failed to restart PHP worker %s: %v", w.Name, err)
+		}
+		return
+	}
+	if changed {
+		log.Printf("PHP worker %s reloaded with new configuration", w.Name)
+		return
+	}
+
+	if strategy == "graceful" || strategy == "opcache_reset" {
+		err := s.reloadPHPPools(w, strategy)
+		if err == nil {
+			log.Printf("PHP worker %s reloaded (%s)", w.Name, strategy)
 			return
 		}
-	}
-}
+		log.Printf("PHP worker %s %s reload failed, restarting: %v", w.Name, strategy, err)
+	}
+
+	s.stopWorker(w)
+	if err := s.startPHPWorker(w, workerMeta); err != nil {
+		log.Printf("Failed to restart PHP worker %s: %v", w.Name, err)
+	}
+}
+
+// reconfigurePHPWorker regenerates the php-fpm configuration of the pools of
+// a PHP worker and reloads them gracefully when it changed. It returns an
+// error when a change requires a restart: a different listen address, binary,
+// command line or environment, or pools that were added or removed.
+func (s *Supervisor) reconfigurePHPWorker(w *Worker, workerMeta *WorkerConfigWithMeta) (bool, error) {
+	workerRoot := filepath.Join(s.projectRoot, s.config.Workers.Directory, w.Name)
+	phpCfg := workerMeta.Config.PHP
+
+	specs, err := phpPoolSpecs(workerMeta)
+	if err != nil {
+		return false, err
+	}
+	binaryPath, err := findPHPBinary(phpCfg.Binary)
+	if err != nil {
+		return false, err
+	}
+	rewriter, err := phpfpm.NewRewriter(phpCfg.Rewrites)
+	if err != nil {
+		return false, fmt.Errorf("invalid php rewrites: %w", err)
+	}
+
+	s.mu.Lock()
+	launchers := s.phpLaunchers[w.Name]
+	s.mu.Unlock()
+
+	w.mu.RLock()
+	pools := w.PHPPools
+	w.mu.RUnlock()
+
+	if len(launchers) == 0 || len(launchers) != len(pools) {
+		return false, fmt.Errorf("php-fpm is not running")
+	}
+	if len(specs) != len(pools) {
+		return false, fmt.Errorf("pools were added or removed")
+	}
+
+	changed := false
+	oldCfgs := make([]*php.Config, len(specs))
+	newCfgs := make([]*php.Config, len(specs))
+	for i, spec := range specs {
+		_, label, _ := spec.names(w)
+		if spec.name != pools[i].Name {
+			return false, fmt.Errorf("pools were renamed or reordered")
+		}
+
+		// php-fpm keeps its listening socket over a reload
+		old := launchers[i].Config()
+		if socket := spec.pool.ListenSocket; socket != "" {
+			if !filepath.IsAbs(socket) {
+				socket = filepath.Join(workerRoot, socket)
+			}
+			if old.PHPFPM.Transport != "unix" || old.PHPFPM.Listen != socket {
+				return false, fmt.Errorf("listen address of %s changed", label)
+			}
+		} else {
+			host := spec.pool.ListenAddress
+			if host == "" {
+				host = "127.0.0.1"
+			}
+			if oldHost, _, _ := net.SplitHostPort(old.PHPFPM.Listen); old.PHPFPM.Transport != "tcp" || oldHost != host {
+				return false, fmt.Errorf("listen address of %s changed", label)
+			}
+		}
+
+		port := 0
+		if old.PHPFPM.Transport == "tcp" {
+			_, portStr, _ := net.SplitHostPort(old.PHPFPM.Listen)
+			port, _ = strconv.Atoi(portStr)
+		}
+		cfg, err := s.phpFPMConfig(w, workerMeta, workerRoot, binaryPath, spec, old.PHPFPM.Listen, old.PHPFPM.Transport, port)
+		if err != nil {
+			return false, err
+		}
+
+		// A reload re-executes php-fpm with the same arguments and environment
+		if cfg.PHPFPMBinary != old.PHPFPMBinary || cfg.PHPIni != old.PHPIni || cfg.Preload != old.Preload ||
+			cfg.PreloadUser != old.PreloadUser || !maps.Equal(cfg.PHPFPM.Env, old.PHPFPM.Env) {
+			return false, fmt.Errorf("php-fpm command line or environment of %s changed", label)
+		}
+		if !reflect.DeepEqual(s.phpConfinement(workerMeta, workerRoot, cfg), pools[i].Confine) {
+			return false, fmt.Errorf("confinement of %s changed", label)
+		}
+
+		if !reflect.DeepEqual(cfg, old) || !slices.Equal(spec.paths, pools[i].Paths) {
+			changed = true
+		}
+		oldCfgs[i] = old
+		newCfgs[i] = cfg
+	}
+
+	if !changed {
+		w.mu.Lock()
+		w.PHPRewriter = rewriter
+		w.PHPTryFiles = phpCfg.TryFiles
+		w.mu.Unlock()
+		return false, nil
+	}
+
+	newPools := make([]*PHPPool, len(specs))
+	for i, spec := range specs {
+		_, label, _ := spec.names(w)
+		cfg, old := newCfgs[i], oldCfgs[i]
+		if err := launchers[i].Reconfigure(cfg); err != nil {
+			return false, err
+		}
+
+		slowlog := pools[i].Slowlog
+		if cfg.PHPFPM.Pool.RequestSlowlogTimeout != old.PHPFPM.Pool.RequestSlowlogTimeout ||
+			phpfpm.SlowlogPath(cfg, cfg.PHPFPM.GeneratedConfigDir) != phpfpm.SlowlogPath(old, old.PHPFPM.GeneratedConfigDir) {
+			if slowlog != nil {
+				slowlog.Stop()
+			}
+			slowlog = startPHPSlowlog(label, cfg, launchers[i])
+		}
 
-// startPHPWorker (legacy PHP support, keeping minimal)
-func (s *Supervisor) startPHPWorker(worker *Worker, workerMeta *WorkerConfigWithMeta) error {
-	// Simplified PHP starter
-	port := s.getFreePort()
-	// In new structs, Worker doesn't have Port. We need to create an Instance.
-	// But PHP is special because it manages its own pool.
-	// We can treat the PHP-FPM Listener as the "Instance".
-
-	// Build listen address: prefer configured listen_address, fall back to localhost
-	host := workerMeta.Config.PHP.Pool.ListenAddress
-	if host == "" {
-		host = "127.0.0.1"
-	}
-	fcgiServerAddr := fmt.Sprintf("%s:%d", host, port)
-
-	// If the chosen port is already bound by another process (e.g., system php-fpm),
-	// probe and pick the next free port. This avoids falsely succeeding when
-	// `net.Dial` connects to an unrelated service on the same port.
-	maxAttempts := s.config.Workers.PortRangeEnd - s.config.Workers.PortRangeStart + 1
-	tried := 0
-	for tried < maxAttempts {
-		// try to listen briefly to check availability
-		ln, err := net.Listen("tcp", fcgiServerAddr)
-		if err == nil {
-			_ = ln.Close()
-			break
+		newPools[i] = &PHPPool{
+			Name:     spec.name,
+			Paths:    spec.paths,
+			Client:   newPHPClient(label, cfg, phpCfg.Multiplex),
+			Slowlog:  slowlog,
+			ErrorLog: pools[i].ErrorLog,
 		}
-		// port in use, pick next
-		port = s.getFreePort()
-		fcgiServerAddr = fmt.Sprintf("%s:%d", host, port)
-		tried++
 	}
-	if tried >= maxAttempts {
-		return fmt.Errorf("no free port available in range %d-%d", s.config.Workers.PortRangeStart, s.config.Workers.PortRangeEnd)
+
+	w.mu.Lock()
+	w.PHPPools = newPools
+	w.PHPRewriter = rewriter
+	w.PHPTryFiles = phpCfg.TryFiles
+	w.mu.Unlock()
+
+	// Requests in flight finish on the old connections
+	for _, pool := range pools {
+		pool.Client.Close()
 	}
+	return true, nil
+}
 
-	log.Printf("Starting PHP worker pool for %s (dynamic manager)", worker.Name)
+// reloadPHPPools reloads every php-fpm pool of a PHP worker in place, either
+// gracefully with SIGUSR2 or by resetting the opcache
+func (s *Supervisor) reloadPHPPools(w *Worker, strategy string) error {
+	s.mu.Lock()
+	launchers := s.phpLaunchers[w.Name]
+	s.mu.Unlock()
 
-	// Determine document root
-	workerRoot := filepath.Join(s.projectRoot, s.config.Workers.Directory, worker.Name)
-	documentRoot := filepath.Join(workerRoot, "public")
+	w.mu.RLock()
+	pools := w.PHPPools
+	w.mu.RUnlock()
 
-	// Determine php-fpm binary to execute. Prefer worker-specified binary,
-	// otherwise try common names (php-fpm, php-cgi, php) and scan PATH for
-	// php-fpm* executables.
-	findPHPBinary := func(preferred string) (string, error) {
-		if preferred != "" {
-			if p, err := exec.LookPath(preferred); err == nil {
-				return p, nil
-			}
-			// try as provided path
-			if _, err := os.Stat(preferred); err == nil {
-				return preferred, nil
-			}
-		}
+	if len(launchers) == 0 || len(launchers) != len(pools) {
+		return fmt.Errorf("php-fpm is not running")
+	}
 
-		candidates := []string{"php-fpm", "php-fpm8.3", "php-fpm8.2", "php-fpm8.1", "php-fpm8.0", "php-fpm7.4", "php-cgi", "php"}
-		for _, c := range candidates {
-			if p, err := exec.LookPath(c); err == nil {
-				return p, nil
+	for i, launcher := range launchers {
+		if strategy == "graceful" {
+			if err := launcher.Reload(); err != nil {
+				return err
 			}
+			continue
 		}
-
-		// Scan PATH directories for files starting with php-fpm
-		pathEnv := os.Getenv("PATH")
-		for _, dir := range strings.Split(pathEnv, ":") {
-			if dir == "" {
-				continue
-			}
-			entries, err := os.ReadDir(dir)
-			if err != nil {
-				continue
-			}
-			for _, e := range entries {
-				name := e.Name()
-				if strings.HasPrefix(name, "php-fpm") {
-					full := filepath.Join(dir, name)
-					if st, err := os.Stat(full); err == nil {
-						if st.Mode().Perm()&0111 != 0 {
-							return full, nil
-						}
-					}
-				}
-			}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := launcher.ResetOpcache(ctx, pools[i].Client)
+		cancel()
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		// Also check common sbin directories where system packages may install php-fpm
-		sbinDirs := []string{"/usr/sbin", "/sbin", "/usr/local/sbin"}
-		for _, dir := range sbinDirs {
-			entries, err := os.ReadDir(dir)
-			if err != nil {
-				continue
-			}
-			for _, e := range entries {
-				name := e.Name()
-				if strings.HasPrefix(name, "php-fpm") || strings.HasPrefix(name, "php") {
-					full := filepath.Join(dir, name)
-					if st, err := os.Stat(full); err == nil {
-						if st.Mode().Perm()&0111 != 0 {
-							return full, nil
-						}
-					}
-				}
-			}
-		}
+// stopPHPPools stops the php-fpm pools of a PHP worker and closes their clients
+func (s *Supervisor) stopPHPPools(worker *Worker) {
+	s.mu.Lock()
+	launchers := s.phpLaunchers[worker.Name]
+	delete(s.phpLaunchers, worker.Name)
+	s.mu.Unlock()
+
+	worker.mu.Lock()
+	pools := worker.PHPPools
+	worker.PHPPools = nil
+	worker.mu.Unlock()
 
-		return "", fmt.Errorf("php-fpm binary not found in PATH; install php-fpm or set php.binary in worker config")
+	for _, pool := range pools {
+		pool.close()
+	}
+	shutdownTimeout := time.Duration(s.config.Workers.ShutdownGracePeriodMs) * time.Millisecond
+	for _, launcher := range launchers {
+		_ = launcher.Stop(shutdownTimeout)
 	}
+}
 
-	binaryPath, err := findPHPBinary(workerMeta.Config.PHP.Binary)
-	if err != nil {
-		return err
+// bunWatchFlag returns the Bun CLI flag ("--hot" or "--watch") when the
+// worker delegates reloads to Bun, which is only done in dev mode
+func (s *Supervisor) bunWatchFlag(workerMeta *WorkerConfigWithMeta) string {
+	if !s.config.IsDevelopmentMode() || workerMeta == nil || workerMeta.Config.Bun == nil {
+		return ""
 	}
+	switch workerMeta.Config.Bun.Watch {
+	case "hot":
+		return "--hot"
+	case "watch":
+		return "--watch"
+	default:
+		return ""
+	}
+}
 
-	// Prepare environment variables for PHP worker
-	envVars := map[string]string{
-		"WORKER_SERVER_MODE": s.config.Mode,
-		"WORKER_NAME":        worker.Name,
-		"WORKER_PATH":        worker.Path,
-		"WORKER_PORT":        fmt.Sprintf("%d", port),
-		"WORKER_TYPE":        worker.Type,
+// goDebugPort returns the first Delve port of a Go worker with go.debug,
+// which only applies in dev mode, or 0 when it is not debugged
+func (s *Supervisor) goDebugPort(workerMeta *WorkerConfigWithMeta) int {
+	if !s.config.IsDevelopmentMode() || workerMeta == nil || workerMeta.Config.Go == nil {
+		return 0
 	}
+	debug := workerMeta.Config.Go.Debug
+	if debug == nil || !debug.Enabled {
+		return 0
+	}
+	if debug.Port == 0 {
+		return 2345
+	}
+	return debug.Port
+}
 
-	// SOCKS5 proxy environment variables for PHP
-	if s.config.Socks5.Enabled {
-		envVars["SOCKS5_PROXY"] = fmt.Sprintf("socks5://127.0.0.1:%d", s.config.Socks5.Port)
-		envVars["ALL_PROXY"] = fmt.Sprintf("socks5://127.0.0.1:%d", s.config.Socks5.Port)
-		envVars["TQSERVER_WORKER_UA"] = fmt.Sprintf("TQServer/%s", worker.Name)
-		if s.config.Socks5.HTTPSInspection != nil && s.config.Socks5.HTTPSInspection.Enabled {
-			caCert := s.config.Socks5.HTTPSInspection.CACert
-			if !filepath.IsAbs(caCert) {
-				caCert = filepath.Join(s.projectRoot, caCert)
-			}
-			envVars["SSL_CERT_FILE"] = caCert
+// freeDebugPort returns the first port from base that nothing listens on,
+// the instances of a worker are debugged on consecutive ports
+func freeDebugPort(base int) int {
+	for port := base; port < base+100 && port <= 65535; port++ {
+		if listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+			listener.Close()
+			return port
 		}
 	}
+	return base
+}
 
-	cfg := &php.Config{
-		PHPFPMBinary: binaryPath,
-		PHPIni:       workerMeta.Config.PHP.ConfigFile,
-		DocumentRoot: documentRoot,
-		Settings:     workerMeta.Config.PHP.Settings,
-		PHPFPM: php.PHPFPMConfig{
-			Enabled:            true,
-			Listen:             fcgiServerAddr,
-			Transport:          "tcp",
-			GeneratedConfigDir: filepath.Join(os.TempDir(), "tqserver-phpfpm", worker.Name),
-			NoDaemonize:        true,
-			Env:                envVars,
-		},
+// findDelveBinary attempts to locate the Delve debugger
+func findDelveBinary() (string, error) {
+	if p, err := exec.LookPath("dlv"); err == nil {
+		return p, nil
 	}
-
-	// Map pool fields
-	cfg.PHPFPM.Pool = php.PoolConfig{
-		Name:                    worker.Name,
-		PM:                      workerMeta.Config.PHP.Pool.Manager,
-		MaxChildren:             workerMeta.Config.PHP.Pool.MaxWorkers,
-		StartServers:            workerMeta.Config.PHP.Pool.StartWorkers,
-		MinSpareServers:         workerMeta.Config.PHP.Pool.MinWorkers,
-		MaxSpareServers:         workerMeta.Config.PHP.Pool.MaxWorkers,
-		MaxRequests:             workerMeta.Config.PHP.Pool.MaxRequests,
-		RequestTerminateTimeout: time.Duration(workerMeta.Config.PHP.Pool.RequestTimeout) * time.Second,
-		ProcessIdleTimeout:      time.Duration(workerMeta.Config.PHP.Pool.IdleTimeout) * time.Second,
+	if homeDir, err := os.UserHomeDir(); err == nil {
+		dlvPath := filepath.Join(homeDir, "go", "bin", "dlv")
+		if _, err := os.Stat(dlvPath); err == nil {
+			return dlvPath, nil
+		}
 	}
+	return "", fmt.Errorf("dlv not found in PATH or ~/go/bin; install it with go install github.com/go-delve/delve/cmd/dlv@latest or disable go.debug")
+}
 
-	// Validate config
-	if err := cfg.Validate(); err != nil {
-		return fmt.Errorf("invalid php-fpm config: %w", err)
+// bunEntrypoint returns the main file of a Bun worker
+func bunEntrypoint(workerMeta *WorkerConfigWithMeta) string {
+	if workerMeta != nil && workerMeta.Config.Bun != nil && workerMeta.Config.Bun.Entrypoint != "" {
+		return workerMeta.Config.Bun.Entrypoint
 	}
+	return "index.ts"
+}
 
-	// Start php-fpm via launcher
-	launcher := phpfpm.NewLauncher(cfg)
-
-	if err := launcher.Start(); err != nil {
-		return fmt.Errorf("failed to start php-fpm: %w", err)
+// bunTypecheck runs the check of bun.typecheck, Bun itself runs TypeScript
+// without checking types: "tsc" type-checks the project of tsconfig.json
+// and "build" bundles the entrypoint, which finds syntax errors and
+// unresolved imports
+func bunTypecheck(workerRoot string, workerMeta *WorkerConfigWithMeta) error {
+	if workerMeta == nil || workerMeta.Config.Bun == nil || workerMeta.Config.Bun.Typecheck == "" {
+		return nil
+	}
+	bunPath, err := findBunBinary()
+	if err != nil {
+		return err
 	}
 
-	// Wait for php-fpm
-	ready := false
-	deadline := time.Now().Add(3 * time.Second)
-	for time.Now().Before(deadline) {
-		conn, err := net.DialTimeout("tcp", cfg.PHPFPM.Listen, 250*time.Millisecond)
-		if err == nil {
-			conn.Close()
-			ready = true
-			break
+	var cmd *exec.Cmd
+	switch check := workerMeta.Config.Bun.Typecheck; check {
+	case "tsc":
+		if _, err := os.Stat(filepath.Join(workerRoot, "tsconfig.json")); err != nil {
+			return fmt.Errorf("bun.typecheck tsc needs a tsconfig.json in %s", workerRoot)
 		}
-		time.Sleep(100 * time.Millisecond)
+		cmd = exec.Command(bunPath, "x", "tsc", "--noEmit", "--pretty", "false")
+	case "build":
+		outDir, err := os.MkdirTemp("", "tqserver-bun-build-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(outDir)
+		cmd = exec.Command(bunPath, "build", bunEntrypoint(workerMeta), "--target", "bun", "--outdir", outDir)
+	default:
+		return fmt.Errorf("unknown bun.typecheck %q", check)
 	}
-	if !ready {
-		_ = launcher.Stop(1 * time.Second)
-		return fmt.Errorf("php-fpm did not become ready on %s", cfg.PHPFPM.Listen)
+	cmd.Dir = workerRoot
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("bun typecheck failed: %s", out)
 	}
+	return nil
+}
 
-	// Create client
-	poolSize := cfg.PHPFPM.Pool.MaxChildren
-	if poolSize <= 0 {
-		poolSize = 2
+// isBunDependencyFile reports whether a change requires a bun install
+func isBunDependencyFile(path string) bool {
+	switch filepath.Base(path) {
+	case "package.json", "bun.lockb", "bun.lock", "bunfig.toml":
+		return true
 	}
-	client := phpfpm.NewClient(cfg.PHPFPM.Listen, cfg.PHPFPM.Transport, poolSize, 5*time.Second, cfg.PHPFPM.Pool.RequestTerminateTimeout)
+	return false
+}
 
-	s.mu.Lock()
-	s.phpLaunchers[worker.Name] = launcher
-	s.phpClients[worker.Name] = client
-	s.mu.Unlock()
+// isComposerFile reports whether a change requires a composer install
+func isComposerFile(path string) bool {
+	switch filepath.Base(path) {
+	case "composer.json", "composer.lock":
+		return true
+	}
+	return false
+}
 
-	// Register pseudo-instance for proxy to find
-	inst := &WorkerInstance{
-		ID:        "php-master",
-		Port:      port,
-		Healthy:   true,
-		StartTime: time.Now(),
+// templateExtensions are the file extensions of the templates of Go workers
+var templateExtensions = map[string]bool{
+	".html": true, ".htm": true, ".tmpl": true, ".tpl": true, ".gohtml": true,
+}
+
+// isTemplateOnlyChange reports whether a change is to a template of a Go
+// worker that reads its templates from disk, the running instances render
+// the new version. Templates embedded in the binary need a rebuild.
+func (s *Supervisor) isTemplateOnlyChange(w *Worker, workerDir, path string) bool {
+	if w.Type != "go" || !templateExtensions[strings.ToLower(filepath.Ext(path))] {
+		return false
+	}
+	if workerMeta := s.getWorkerConfig(w.Name); workerMeta != nil && workerMeta.Config.Go != nil && workerMeta.Config.Go.CachedTemplates {
+		return false
 	}
-	worker.Instances = append(worker.Instances, inst)
+	return !isGoEmbedded(workerDir, path)
+}
 
-	log.Printf("✅ PHP Worker pool started for %s on %s", worker.Path, fcgiServerAddr)
-	return nil
+// isGoEmbedded reports whether a file matches a //go:embed directive in the
+// Go files of its directory or a parent directory within the worker
+func isGoEmbedded(workerDir, path string) bool {
+	for dir := filepath.Dir(path); strings.HasPrefix(dir, workerDir); dir = filepath.Dir(dir) {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return false
+		}
+		for _, pattern := range goEmbedPatterns(dir) {
+			// A pattern names the file or one of the directories holding it
+			for name := rel; name != "."; name = filepath.Dir(name) {
+				if ok, _ := filepath.Match(pattern, name); ok {
+					return true
+				}
+			}
+		}
+		if dir == workerDir {
+			break
+		}
+	}
+	return false
+}
+
+// goEmbedPatterns returns the patterns of the //go:embed directives in the
+// Go files of a directory
+func goEmbedPatterns(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.go"))
+	var patterns []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			args, ok := strings.CutPrefix(strings.TrimSpace(line), "//go:embed ")
+			if !ok {
+				continue
+			}
+			for _, pattern := range strings.Fields(args) {
+				pattern = strings.TrimPrefix(strings.Trim(pattern, "\"`"), "all:")
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+	return patterns
 }
 
 // findBunBinary attempts to locate the Bun binary
-func (s *Supervisor) findBunBinary() (string, error) {
+func findBunBinary() (string, error) {
 	// 1. Try PATH
 	if p, err := exec.LookPath("bun"); err == nil {
 		return p, nil
@@ -937,39 +2198,230 @@ func (s *Supervisor) findBunBinary() (string, error) {
 	return "", fmt.Errorf("bun executable not found in PATH or ~/.bun/bin/bun")
 }
 
-// Reload reloads configuration and restarts workers
+// Reload applies a new configuration: workers whose own config changed
+// restart, scaling limits apply in place and the others keep running
 func (s *Supervisor) Reload(newConfig *Config, newWorkerConfigs []*WorkerConfigWithMeta) {
 	log.Println("Reloading supervisor configuration...")
+	s.events.Record(EventConfigReloaded, "", "", "%d worker(s) configured", len(newWorkerConfigs))
 	s.mu.Lock()
+	oldConfig, oldWorkerConfigs := s.config, s.workerConfigs
 	s.config = newConfig
 	s.workerConfigs = newWorkerConfigs
 	s.mu.Unlock()
 
-	// Trigger rolling restart for all active workers
-	workers := s.router.GetAllWorkers()
-	for _, w := range workers {
-		// Find config for this worker
-		found := false
-		for _, wc := range newWorkerConfigs {
-			if wc.Name == w.Name {
-				found = true
-				break
+	if workerEnvironmentChanged(oldConfig, newConfig) {
+		log.Println("Mode, env or worker logging changed, restarting all workers")
+	}
+
+	running := make(map[string]bool)
+	for _, w := range s.router.GetAllWorkers() {
+		running[w.Name] = true
+		change := reloadChange(w.Name, oldConfig, newConfig, oldWorkerConfigs, newWorkerConfigs)
+		if change == workerRemoved {
+			log.Printf("Worker %s removed from config, stopping...", w.Name)
+			s.removeWorker(w)
+			continue
+		}
+		s.applyWorkerChange(w, findWorkerConfig(newWorkerConfigs, w.Name), change)
+	}
+
+	// New and re-enabled workers
+	for _, workerMeta := range newWorkerConfigs {
+		if running[workerMeta.Name] || !workerMeta.Config.IsEnabled(newConfig.Mode) {
+			continue
+		}
+		log.Printf("Worker %s added to config, starting...", workerMeta.Name)
+		if s.watcher != nil {
+			if err := s.watchDirectory(s.workerDir(workerMeta.Name)); err != nil {
+				log.Printf("Failed to watch worker %s: %v", workerMeta.Name, err)
 			}
 		}
+		worker := newWorker(workerMeta)
+		s.router.RegisterWorker(worker)
+		go s.startWorker(worker, workerMeta)
+	}
+}
+
+// PlanReload returns what Reload would do to each worker with the new
+// configs, and the changed settings that only apply on a server restart
+func (s *Supervisor) PlanReload(newConfig *Config, newWorkerConfigs []*WorkerConfigWithMeta) ([]workerPlan, []string) {
+	s.mu.Lock()
+	oldConfig, oldWorkerConfigs := s.config, s.workerConfigs
+	s.mu.Unlock()
+
+	var plan []workerPlan
+	running := make(map[string]bool)
+	for _, w := range s.router.GetAllWorkers() {
+		if running[w.Name] {
+			continue
+		}
+		running[w.Name] = true
+		change := reloadChange(w.Name, oldConfig, newConfig, oldWorkerConfigs, newWorkerConfigs)
+		plan = append(plan, workerPlan{Name: w.Name, Change: change.String()})
+	}
+	for _, workerMeta := range newWorkerConfigs {
+		if !running[workerMeta.Name] && workerMeta.Config.IsEnabled(newConfig.Mode) {
+			plan = append(plan, workerPlan{Name: workerMeta.Name, Change: workerAdded.String()})
+		}
+	}
+	slices.SortFunc(plan, func(a, b workerPlan) int { return strings.Compare(a.Name, b.Name) })
+	return plan, restartSettings(oldConfig, newConfig)
+}
 
-		if found {
-			go s.rollingRestart(w)
-		} else {
-			log.Printf("Worker %s removed from config, stopping...", w.Name)
-			s.stopWorker(w)
+// applyWorkerChange applies the changed config of a running worker
+func (s *Supervisor) applyWorkerChange(w *Worker, workerMeta *WorkerConfigWithMeta, change workerChange) {
+	log.Printf("Worker %s: %s", w.Name, change)
+
+	switch change {
+	case workerReplaced:
+		s.removeWorker(w)
+		worker := newWorker(workerMeta)
+		s.router.RegisterWorker(worker)
+		go s.startWorker(worker, workerMeta)
+	case workerRescaled:
+		s.applyMocks(w, workerMeta)
+		w.applyScaling(workerMeta)
+	case workerChanged:
+		s.applyMocks(w, workerMeta)
+		w.applyScaling(workerMeta)
+		go s.rollingRestart(w)
+	}
+	if change != workerReplaced {
+		s.scheduleRecycle(w, time.Now())
+	}
+}
+
+// scheduleConfigReload debounces the reload of a worker's config file
+func (s *Supervisor) scheduleConfigReload(w *Worker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := w.Name + "/config"
+	if t, ok := s.reloadTimers[key]; ok {
+		t.Stop()
+	}
+	s.reloadTimers[key] = time.AfterFunc(500*time.Millisecond, func() {
+		s.reloadWorkerConfig(w)
+	})
+}
+
+// reloadWorkerConfig applies the changed config file of a worker to that
+// worker only, an invalid config is kept out
+func (s *Supervisor) reloadWorkerConfig(w *Worker) {
+	s.mu.Lock()
+	config := s.config
+	oldMeta := findWorkerConfig(s.workerConfigs, w.Name)
+	s.mu.Unlock()
+	if oldMeta == nil {
+		return
+	}
+
+	newMeta := *oldMeta
+	changed, err := CheckWorkerConfigChanges([]*WorkerConfigWithMeta{&newMeta}, config.SecretStore())
+	if err != nil {
+		log.Printf("Failed to reload config of worker %s: %v", w.Name, err)
+		return
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	workerConfigs := make([]*WorkerConfigWithMeta, len(s.workerConfigs))
+	for i, wc := range s.workerConfigs {
+		if wc.Name == w.Name {
+			wc = &newMeta
+		}
+		workerConfigs[i] = wc
+	}
+	s.mu.Unlock()
+
+	// Only the problems of this worker's file, the rest was checked at startup
+	problems := 0
+	for _, problem := range ValidateConfig(config, "", workerConfigs) {
+		if problem.File == newMeta.ConfigPath {
+			log.Printf("Config problem: %s", problem)
+			problems++
+		}
+	}
+	if problems > 0 {
+		log.Printf("Keeping the current config of worker %s, %d problem(s) found", w.Name, problems)
+		return
+	}
+
+	s.mu.Lock()
+	s.workerConfigs = workerConfigs
+	s.mu.Unlock()
+
+	change := diffWorkerConfig(oldMeta.Config, newMeta.Config)
+	s.events.Record(EventWorkerReloaded, w.Name, "", "config changed, %s", change)
+	if !newMeta.Config.IsEnabled(config.Mode) {
+		log.Printf("Worker %s disabled in config, stopping...", w.Name)
+		s.removeWorker(w)
+		return
+	}
+	s.applyWorkerChange(w, &newMeta, change)
+}
+
+// isWorkerConfigFile reports whether a path is a worker config file, in any
+// of the config formats
+func isWorkerConfigFile(path string) bool {
+	switch filepath.Base(path) {
+	case "worker.yaml", "worker.yml", "worker.toml", "worker.json":
+		return true
+	}
+	return false
+}
+
+// findWorkerConfig returns the config of a worker by name, or nil
+func findWorkerConfig(workerConfigs []*WorkerConfigWithMeta, name string) *WorkerConfigWithMeta {
+	for _, wc := range workerConfigs {
+		if wc.Name == name {
+			return wc
 		}
 	}
+	return nil
+}
+
+// removeWorker stops a worker and its dispatcher and removes its route
+func (s *Supervisor) removeWorker(w *Worker) {
+	s.router.UnregisterWorker(w)
+	if w.stopped != nil {
+		close(w.stopped)
+	}
+	s.stopWorker(w)
+	if w.Type == "php" {
+		s.stopPHPPools(w)
+	}
+	s.mocks.apply(w.Name, "", nil)
 }
 
 // rollingRestart performs a zero-downtime restart of a worker
 func (s *Supervisor) rollingRestart(w *Worker) {
+	if w.Type != "wasm" && w.IsDraining() {
+		log.Printf("Worker %s is drained, restart skipped", w.Name)
+		return
+	}
 	if w.Type == "php" {
-		log.Printf("Rolling restart not fully implemented for PHP worker %s", w.Name)
+		// php-fpm manages its own processes, see php.reload
+		s.reloadPHPWorker(w)
+		return
+	}
+	if w.Type == "remote" {
+		// Restarted on their own machines, the configured addresses apply
+		s.syncRemoteInstances(w)
+		return
+	}
+	if w.Type == "wasm" {
+		// Swap in the module with its new settings, in-flight requests finish on the old one
+		err := s.buildWorker(w)
+		if err == nil {
+			err = s.loadWasmModule(w)
+		}
+		s.setBuildResult(w, err)
+		if err != nil {
+			log.Printf("Failed to reload WASM worker %s: %v", w.Name, err)
+		}
 		return
 	}
 
@@ -980,6 +2432,9 @@ func (s *Supervisor) rollingRestart(w *Worker) {
 	if currentCount < w.MinWorkers {
 		currentCount = w.MinWorkers
 	}
+	if w.Pinned > 0 {
+		currentCount = w.Pinned
+	}
 	w.mu.Unlock()
 
 	newInstances := make([]*WorkerInstance, 0)
@@ -1016,7 +2471,7 @@ func (s *Supervisor) rollingRestart(w *Worker) {
 
 		// Broadcast reload in dev mode so browser updates
 		if s.config.Mode == "dev" && s.proxy != nil {
-			s.proxy.BroadcastReload()
+			s.proxy.BroadcastReload(w.Path)
 		}
 	}
 }
@@ -1036,10 +2491,22 @@ func (s *Supervisor) monitorWorkerHealth() {
 			// Check all workers
 			workers := s.router.GetAllWorkers()
 			for _, worker := range workers {
+				// WASM workers run in-process, there is nothing to probe, a
+				// drained worker is stopped on purpose
+				if worker.Type == "wasm" || worker.IsDraining() {
+					continue
+				}
+				// Remote instances are never restarted, unhealthy ones only
+				// get no requests
+				if worker.Type == "remote" {
+					s.checkRemoteHealth(worker)
+					continue
+				}
 				// For PHP workers, perform active health check via TCP
 				if worker.Type == "php" {
 					if !s.checkPHPHealth(worker) {
 						log.Printf("PHP worker active health check failed for %s, restarting...", worker.Name)
+						s.events.Record(EventWorkerRestarted, worker.Name, "", "php-fpm is unreachable")
 						// Restart the worker
 						// Note: This is a bit aggressive, but consistent with previous behavior
 						// We run this in a goroutine to not block the monitor loop
@@ -1058,6 +2525,7 @@ func (s *Supervisor) monitorWorkerHealth() {
 					// For Bun/Go workers, check HTTP health endpoint
 					if !s.checkHTTPHealth(worker) {
 						log.Printf("Worker active health check failed for %s, restarting...", worker.Name)
+						s.events.Record(EventWorkerRestarted, worker.Name, "", "no healthy instances")
 						go func(w *Worker) {
 							// Rolling restart: stop all instances and let dispatcher respawn them
 							// Or we could restart specific instances if we tracked which one failed.
@@ -1096,15 +2564,13 @@ func (s *Supervisor) checkHTTPHealth(worker *Worker) bool {
 	// Let's change the pattern: checkHTTPHealth cleans up bad instances and returns true if at least one remains healthy.
 
 	healthyCount := 0
-	client := http.Client{
-		Timeout: 500 * time.Millisecond,
-	}
+	client := s.mtls.client(500 * time.Millisecond)
 	metrics := GetMetrics()
 
 	for _, inst := range instances {
 		start := time.Now()
-		url := fmt.Sprintf("http://localhost:%d/health", inst.Port)
-		resp, err := client.Get(url)
+		url := fmt.Sprintf("%s://localhost:%d/health", s.mtls.scheme(), inst.Port)
+		resp, err := getHealth(client, url, inst.ProxyToken)
 		duration := time.Since(start)
 		isHealthy := false
 		if err == nil {
@@ -1121,6 +2587,7 @@ func (s *Supervisor) checkHTTPHealth(worker *Worker) bool {
 			healthyCount++
 		} else {
 			log.Printf("Broadcasting health check failure for instance %s (%s)", inst.ID, url)
+			s.events.Record(EventInstanceUnhealthy, worker.Name, inst.ID, "health check of %s failed", url)
 			// We can proactively terminate this specific bad instance
 			// and let the dispatcher replace it.
 			go s.terminateInstance(inst)
@@ -1128,7 +2595,7 @@ func (s *Supervisor) checkHTTPHealth(worker *Worker) bool {
 	}
 
 	// Update worker gauge metrics
-	metrics.UpdateWorkerMetrics(worker.Name, len(instances), healthyCount, len(worker.Queue), healthyCount > 0)
+	metrics.UpdateWorkerMetrics(worker.Name, len(instances), healthyCount, worker.Queue.len(), healthyCount > 0)
 
 	// If we have at least one healthy instance, or if we had 0 instances to start with (caught above),
 	// we say the worker "group" is fine (the bad ones are being killed).
@@ -1136,47 +2603,35 @@ func (s *Supervisor) checkHTTPHealth(worker *Worker) bool {
 	return healthyCount > 0
 }
 
-// checkPHPHealth performs an active TCP probe to check if the PHP worker is reachable
+// checkPHPHealth performs an active connection probe to check if the PHP worker is reachable
 func (s *Supervisor) checkPHPHealth(worker *Worker) bool {
-	// For now, checks the first instance (PHP pool master)
-	// In the future we might want to check all instances if we have multiple PHP pools?
-	// But startPHPWorker creates one 'php-master' instance with the port.
-	if len(worker.Instances) == 0 {
-		return false
-	}
-
-	// Find the php-master instance or just use the first one
-	port := worker.Instances[0].Port
-	if port == 0 {
-		return false
-	}
-
-	workerMeta := s.getWorkerConfig(worker.Name)
-	if workerMeta == nil || workerMeta.Config.PHP == nil {
+	// startPHPWorker creates one pseudo-instance per php-fpm pool, the
+	// worker is healthy when every pool is reachable
+	worker.mu.RLock()
+	pools := worker.PHPPools
+	numInstances := len(worker.Instances)
+	worker.mu.RUnlock()
+	if numInstances == 0 || len(pools) == 0 {
 		return false
 	}
 
-	host := workerMeta.Config.PHP.Pool.ListenAddress
-	if host == "" {
-		host = "127.0.0.1"
-	}
-	addr := fmt.Sprintf("%s:%d", host, port)
-
+	// Dial the addresses the proxy uses, either TCP or a unix socket
 	start := time.Now()
-	conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+	isHealthy := true
+	for _, pool := range pools {
+		conn, err := net.DialTimeout(pool.Client.Transport(), pool.Client.Address(), 100*time.Millisecond)
+		if err != nil {
+			isHealthy = false
+			break
+		}
+		conn.Close()
+	}
 	duration := time.Since(start)
-	isHealthy := err == nil
 
 	// Record health check metrics
 	metrics := GetMetrics()
 	metrics.RecordHealthCheck(worker.Name, duration, isHealthy)
-	metrics.UpdateWorkerMetrics(worker.Name, len(worker.Instances), 1, 0, isHealthy)
+	metrics.UpdateWorkerMetrics(worker.Name, numInstances, 1, 0, isHealthy)
 
-	if !isHealthy {
-		// Only log verbose if we want to debug, otherwise it spams if down
-		// log.Printf("Health check failed for PHP worker %s (%s): %v", worker.Name, addr, err)
-		return false
-	}
-	conn.Close()
-	return true
+	return isHealthy
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultTestTimeout is the run time limit of the tests of a worker
+const defaultTestTimeout = 120 * time.Second
+
+// testOutputLines is the number of output lines kept of a failed run
+const testOutputLines = 200
+
+// testCommand returns the command that runs the tests of a worker, nil when
+// its tests do not run on change
+func (s *Supervisor) testCommand(workerMeta *WorkerConfigWithMeta) ([]string, error) {
+	cfg := workerMeta.Config
+	if !s.config.IsDevelopmentMode() || cfg.Test == nil || !cfg.Test.OnChange {
+		return nil, nil
+	}
+	if cfg.Test.Command != "" {
+		return []string{"sh", "-c", cfg.Test.Command}, nil
+	}
+	switch cfg.Type {
+	case "go":
+		return []string{"go", "test", "./..."}, nil
+	case "bun":
+		bunPath, err := findBunBinary()
+		if err != nil {
+			return nil, err
+		}
+		return []string{bunPath, "test"}, nil
+	}
+	return nil, fmt.Errorf("test.command is required for %s workers", cfg.Type)
+}
+
+// runTests runs the tests of a worker in the background after a rebuild in
+// dev mode, the output is logged as it comes. A run for an earlier change
+// that is still going is cancelled.
+func (s *Supervisor) runTests(w *Worker) {
+	workerMeta := s.getWorkerConfig(w.Name)
+	if workerMeta == nil {
+		return
+	}
+	args, err := s.testCommand(workerMeta)
+	if err != nil {
+		log.Printf("Tests of worker %s not run: %v", w.Name, err)
+		return
+	}
+	if args == nil {
+		return
+	}
+	timeout := defaultTestTimeout
+	if seconds := workerMeta.Config.Test.TimeoutSeconds; seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	run := w.startTestRun(cancel)
+	if s.proxy != nil {
+		s.proxy.BroadcastTestRun(w.Name, run)
+	}
+	log.Printf("Running tests of worker %s: %s", w.Name, strings.Join(args, " "))
+
+	go func() {
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Dir = s.workerDir(w.Name)
+		cmd.Env = os.Environ()
+		// Test binaries and shell commands are stopped with the runner
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+		output := &testOutput{prefix: fmt.Sprintf("[test %s] ", w.Name), logs: w.Logs}
+		cmd.Stdout = output
+		cmd.Stderr = output
+
+		err := cmd.Run()
+		output.flush()
+		if errors.Is(ctx.Err(), context.Canceled) {
+			// Replaced by the run for a newer change
+			return
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			output.add(fmt.Sprintf("tests timed out after %s", timeout))
+		}
+		finished, ok := w.finishTestRun(run, err == nil, strings.Join(output.lines, "\n"))
+		if !ok {
+			return
+		}
+		duration := finished.Finished.Sub(finished.Started).Round(100 * time.Millisecond)
+		if err == nil {
+			log.Printf("Tests passed for worker %s in %s", w.Name, duration)
+			s.events.Record(EventTestsPassed, w.Name, "", "in %s", duration)
+		} else {
+			log.Printf("Tests failed for worker %s in %s: %v", w.Name, duration, err)
+			s.events.Record(EventTestsFailed, w.Name, "", "in %s: %v", duration, err)
+		}
+		if s.proxy != nil {
+			s.proxy.BroadcastTestRun(w.Name, finished)
+		}
+	}()
+}
+
+// testOutput logs the lines of a test run with a prefix as they are
+// written, and keeps the last of them
+type testOutput struct {
+	prefix  string
+	logs    *logTail
+	partial []byte
+	lines   []string
+}
+
+// Write logs the complete lines, stdout and stderr are the same writer so
+// writes do not overlap
+func (o *testOutput) Write(p []byte) (int, error) {
+	data := append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		o.add(strings.TrimRight(string(data[:i]), "\r"))
+		data = data[i+1:]
+	}
+	o.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// flush logs a last line without a line ending
+func (o *testOutput) flush() {
+	if len(o.partial) > 0 {
+		o.add(string(o.partial))
+		o.partial = nil
+	}
+}
+
+// add logs a line and keeps it
+func (o *testOutput) add(line string) {
+	log.Print(o.prefix + line)
+	o.logs.AddLine(o.prefix + line)
+	if len(o.lines) == testOutputLines {
+		o.lines = o.lines[1:]
+	}
+	o.lines = append(o.lines, line)
+}
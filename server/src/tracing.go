@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/mevdschee/tqserver/pkg/tracing"
+)
+
+// newTracer creates the tracer of the proxy, it returns nil when tracing is
+// off, which the tracing package treats as a no-op tracer
+func newTracer(cfg *TracingConfig) *tracing.Tracer {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	opts := tracing.Options{
+		Endpoint:    cfg.Endpoint,
+		ServiceName: cfg.ServiceName,
+		SampleRatio: 1,
+		Headers:     cfg.Headers,
+	}
+	if opts.Endpoint == "" {
+		opts.Endpoint = "http://localhost:4318"
+	}
+	if cfg.SampleRatio != nil {
+		opts.SampleRatio = *cfg.SampleRatio
+	}
+	log.Printf("Tracing enabled, exporting to %s", opts.Endpoint)
+	return tracing.New(opts)
+}
+
+// startUpstreamSpan starts the span of a call to a worker instance and sets
+// the traceparent header that makes the worker's spans its children
+func (p *Proxy) startUpstreamSpan(r *http.Request, header http.Header, worker *Worker) *tracing.Span {
+	_, span := p.tracer.Start(r.Context(), "upstream "+worker.Name, tracing.KindClient)
+	if span == nil {
+		return nil
+	}
+	span.SetAttribute("tqserver.worker", worker.Name)
+	span.SetAttribute("tqserver.worker_type", worker.Type)
+	header.Set("traceparent", span.Traceparent())
+	return span
+}
+
+// endUpstreamSpan ends the span of a call to a worker with the response
+// status, or with an error when there was no response
+func endUpstreamSpan(span *tracing.Span, status int, err error) {
+	if err != nil {
+		span.SetError(err.Error())
+	} else {
+		span.SetAttribute("http.response.status_code", status)
+	}
+	span.End()
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// trafficHistory is the number of recent entries sent to new viewers
+const trafficHistory = 100
+
+// trafficClient is a viewer of the outbound traffic
+type trafficClient struct {
+	conn   net.Conn
+	worker string      // Only entries of this worker, "" for all
+	send   chan []byte // Frames to write, dropped when the viewer falls behind
+}
+
+// TrafficBroadcaster streams SOCKS5 connection log entries to WebSocket
+// viewers, for the live traffic page in dev mode
+type TrafficBroadcaster struct {
+	mu      sync.Mutex
+	clients map[*trafficClient]bool
+	recent  []*ConnectionLog
+}
+
+// NewTrafficBroadcaster creates a new traffic broadcaster
+func NewTrafficBroadcaster() *TrafficBroadcaster {
+	return &TrafficBroadcaster{
+		clients: make(map[*trafficClient]bool),
+	}
+}
+
+// Publish sends an entry to the viewers and keeps it for new ones
+func (tb *TrafficBroadcaster) Publish(entry *ConnectionLog) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	frame := makeTextFrame(data)
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if len(tb.recent) == trafficHistory {
+		tb.recent = tb.recent[1:]
+	}
+	tb.recent = append(tb.recent, entry)
+
+	for client := range tb.clients {
+		if client.worker != "" && client.worker != entry.WorkerName {
+			continue
+		}
+		select {
+		case client.send <- frame:
+		default:
+			// Never block the proxy on a slow viewer
+		}
+	}
+}
+
+// Recent returns the last entries, oldest first
+func (tb *TrafficBroadcaster) Recent() []*ConnectionLog {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return append([]*ConnectionLog(nil), tb.recent...)
+}
+
+// HandleWebSocket streams entries to a viewer, starting with the recent
+// ones. The "worker" query parameter selects a single worker.
+func (tb *TrafficBroadcaster) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	// Perform WebSocket handshake
+	if r.Header.Get("Upgrade") != "websocket" {
+		http.Error(w, "Not a websocket handshake", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Server doesn't support hijacking", http.StatusInternalServerError)
+		return
+	}
+
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("Hijack failed: %v", err)
+		return
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + computeAcceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"
+
+	if _, err := bufrw.WriteString(response); err != nil {
+		conn.Close()
+		return
+	}
+	if err := bufrw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	client := &trafficClient{
+		conn:   conn,
+		worker: r.URL.Query().Get("worker"),
+		send:   make(chan []byte, 256),
+	}
+
+	tb.mu.Lock()
+	for _, entry := range tb.recent {
+		if client.worker != "" && client.worker != entry.WorkerName {
+			continue
+		}
+		if data, err := json.Marshal(entry); err == nil {
+			select {
+			case client.send <- makeTextFrame(data):
+			default:
+			}
+		}
+	}
+	tb.clients[client] = true
+	tb.mu.Unlock()
+
+	done := make(chan struct{})
+	defer func() {
+		tb.mu.Lock()
+		delete(tb.clients, client)
+		tb.mu.Unlock()
+		close(done)
+		conn.Close()
+	}()
+
+	// Write frames until the viewer goes away
+	go func() {
+		for {
+			select {
+			case frame := <-client.send:
+				if _, err := conn.Write(frame); err != nil {
+					conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Read messages to detect disconnect and close frames
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if n > 0 && (buf[0]&0x0F) == 0x08 {
+			conn.Write([]byte{0x88, 0x00})
+			return
+		}
+	}
+}
+
+// HandlePage serves the live traffic page
+func (tb *TrafficBroadcaster) HandlePage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(trafficPage))
+}
+
+// trafficPage renders the entries of /ws/traffic as a network table
+const trafficPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>TQServer - Outbound Traffic</title>
+<style>
+body { font: 13px system-ui, sans-serif; margin: 0; }
+header { display: flex; gap: 8px; align-items: center; padding: 8px; background: #f3f3f3; border-bottom: 1px solid #ddd; }
+header h1 { font-size: 14px; margin: 0 8px 0 0; }
+#status { margin-left: auto; color: #888; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 3px 8px; border-bottom: 1px solid #eee; white-space: nowrap; }
+th { position: sticky; top: 0; background: #fafafa; font-weight: 600; }
+tr:hover { background: #f0f6ff; cursor: pointer; }
+tr.error td { color: #c00; }
+td.url { max-width: 40vw; overflow: hidden; text-overflow: ellipsis; }
+pre { margin: 0; padding: 8px 16px; background: #fbfbfb; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<header>
+<h1>Outbound traffic</h1>
+<input id="filter" placeholder="Filter (worker, host, path)">
+<button id="pause">Pause</button>
+<button id="clear">Clear</button>
+<span id="status">connecting...</span>
+</header>
+<table>
+<thead><tr><th>Time</th><th>Worker</th><th>Method</th><th>URL</th><th>Status</th><th>Sent</th><th>Received</th><th>Duration</th><th>Correlation ID</th></tr></thead>
+<tbody id="rows"></tbody>
+</table>
+<script>
+const rows = document.getElementById('rows');
+const filter = document.getElementById('filter');
+const status = document.getElementById('status');
+let paused = false;
+
+function text(value) {
+  return value === undefined || value === null ? '' : String(value);
+}
+
+function matches(tr) {
+  const q = filter.value.toLowerCase();
+  return !q || tr.dataset.search.includes(q);
+}
+
+function add(e) {
+  const tr = document.createElement('tr');
+  const port = e.dest_port === 443 || e.dest_port === 80 ? '' : ':' + e.dest_port;
+  const url = e.protocol + '://' + e.dest_host + port + text(e.path);
+  const cells = [
+    new Date(e.timestamp).toLocaleTimeString(), e.worker_name, e.method || 'CONNECT', url,
+    e.error ? 'error' : e.status_code, e.bytes_sent, e.bytes_recv, e.duration_ms + ' ms', e.correlation_id,
+  ];
+  for (const value of cells) {
+    const td = document.createElement('td');
+    td.textContent = text(value);
+    tr.appendChild(td);
+  }
+  tr.children[3].className = 'url';
+  tr.children[3].title = url;
+  if (e.error || e.status_code >= 400) tr.className = 'error';
+  tr.dataset.search = [e.worker_name, e.dest_host, e.path, e.correlation_id].map(text).join(' ').toLowerCase();
+  tr.hidden = !matches(tr);
+  tr.onclick = () => {
+    if (tr.nextSibling && tr.nextSibling.className === 'details') {
+      tr.nextSibling.remove();
+      return;
+    }
+    const details = document.createElement('tr');
+    details.className = 'details';
+    const td = document.createElement('td');
+    td.colSpan = cells.length;
+    const pre = document.createElement('pre');
+    pre.textContent = JSON.stringify(e, null, 2);
+    td.appendChild(pre);
+    details.appendChild(td);
+    tr.after(details);
+  };
+  rows.prepend(tr);
+  while (rows.children.length > 1000) rows.lastChild.remove();
+}
+
+function connect() {
+  const params = new URLSearchParams(location.search);
+  const query = params.get('worker') ? '?worker=' + encodeURIComponent(params.get('worker')) : '';
+  const ws = new WebSocket((location.protocol === 'https:' ? 'wss://' : 'ws://') + location.host + '/ws/traffic' + query);
+  ws.onopen = () => { status.textContent = 'live'; };
+  ws.onmessage = (msg) => { if (!paused) add(JSON.parse(msg.data)); };
+  ws.onclose = () => { status.textContent = 'disconnected, retrying...'; setTimeout(connect, 1000); };
+}
+
+filter.oninput = () => {
+  for (const tr of rows.children) {
+    if (tr.className !== 'details') tr.hidden = !matches(tr);
+  }
+};
+document.getElementById('pause').onclick = (ev) => {
+  paused = !paused;
+  ev.target.textContent = paused ? 'Resume' : 'Pause';
+};
+document.getElementById('clear').onclick = () => { rows.textContent = ''; };
+connect();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mevdschee/tqserver/pkg/cron"
+	"github.com/mevdschee/tqserver/pkg/logsink"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigProblem is an unknown or invalid setting in a config file
+type ConfigProblem struct {
+	File    string
+	Line    int // 0 when not known
+	Message string
+}
+
+// String formats the problem like a compiler error
+func (p ConfigProblem) String() string {
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+}
+
+var (
+	configLinePattern   = regexp.MustCompile(`(?:^|: )line (\d+): (.*)$`)
+	configReservedPaths = []string{"/admin", "/debug", "/ws/reload"}
+	secretFileName      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// errorProblem converts a load error, with its line when it has one
+func errorProblem(file string, err error) ConfigProblem {
+	var typeErr *yaml.TypeError
+	message := err.Error()
+	if errors.As(err, &typeErr) {
+		message = strings.Join(typeErr.Errors, "; ")
+	}
+	problem := ConfigProblem{File: file, Message: message}
+	if m := configLinePattern.FindStringSubmatch(message); m != nil {
+		problem.Line, _ = strconv.Atoi(m[1])
+		problem.Message = m[2]
+	}
+	return problem
+}
+
+// configFile looks up the lines of settings in a config file
+type configFile struct {
+	path string
+	root *yaml.Node // nil when the file could not be parsed
+}
+
+// newConfigFile parses a config file for its lines
+func newConfigFile(path string) *configFile {
+	f := &configFile{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return f
+	}
+	f.root, _ = parseConfigNode(path, data)
+	return f
+}
+
+// line returns the line of a dotted setting like "scaling.min_workers" or
+// "webhooks.0.url", or of its closest parent that is present
+func (f *configFile) line(key string) int {
+	node, line := f.root, 0
+	for _, part := range strings.Split(key, ".") {
+		if node == nil {
+			break
+		}
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == part {
+					line = node.Content[i].Line
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(part); err == nil && i >= 0 && i < len(node.Content) {
+				next = node.Content[i]
+				line = next.Line
+			}
+		}
+		node = next
+	}
+	return line
+}
+
+// configValidator collects the problems of a configuration
+type configValidator struct {
+	problems []ConfigProblem
+}
+
+// add records a problem with a setting, the message is prefixed with the key
+func (v *configValidator) add(file *configFile, key, format string, args ...interface{}) {
+	v.problems = append(v.problems, ConfigProblem{
+		File:    file.path,
+		Line:    file.line(key),
+		Message: key + ": " + fmt.Sprintf(format, args...),
+	})
+}
+
+// port checks that a port number is in range
+func (v *configValidator) port(file *configFile, key string, port int) {
+	if port < 1 || port > 65535 {
+		v.add(file, key, "%d is not a port number (1-65535)", port)
+	}
+}
+
+// nonNegative checks a count or duration
+func (v *configValidator) nonNegative(file *configFile, key string, value int) {
+	if value < 0 {
+		v.add(file, key, "%d must not be negative", value)
+	}
+}
+
+// oneOf checks a setting with a fixed set of values, empty is the default
+func (v *configValidator) oneOf(file *configFile, key, value string, allowed ...string) {
+	if value == "" {
+		return
+	}
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.add(file, key, "%q is not one of %s", value, strings.Join(allowed, ", "))
+}
+
+// urlPath checks a path served by the server, empty disables it
+func (v *configValidator) urlPath(file *configFile, key, path string) {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		v.add(file, key, "%q must start with /", path)
+	}
+}
+
+// ValidateConfig checks the values of the server and worker configs and how
+// they fit together, the problems are ordered by file and line
+func ValidateConfig(config *Config, configPath string, workerConfigs []*WorkerConfigWithMeta) []ConfigProblem {
+	v := &configValidator{}
+	f := newConfigFile(configPath)
+
+	v.port(f, "server.port", config.Server.Port)
+	v.nonNegative(f, "server.read_timeout_seconds", config.Server.ReadTimeoutSeconds)
+	v.nonNegative(f, "server.write_timeout_seconds", config.Server.WriteTimeoutSeconds)
+	v.nonNegative(f, "server.idle_timeout_seconds", config.Server.IdleTimeoutSeconds)
+	if config.Server.MaxBodySize < 0 {
+		v.add(f, "server.max_body_size", "%d must not be negative", config.Server.MaxBodySize)
+	}
+	if t := config.Server.TLS; t != nil {
+		if t.CertFile == "" {
+			v.add(f, "server.tls.cert_file", "is required")
+		}
+		if t.KeyFile == "" {
+			v.add(f, "server.tls.key_file", "is required")
+		}
+		if t.CertFile != "" && t.KeyFile != "" {
+			if _, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile); err != nil {
+				v.add(f, "server.tls.cert_file", "%v", err)
+			}
+		}
+		if t.ClientCA != "" {
+			if _, err := serverTLSConfig(t, ""); err != nil {
+				v.add(f, "server.tls.client_ca", "%v", err)
+			}
+			if config.Cluster.Enabled {
+				v.add(f, "server.tls.client_ca", "cannot be combined with cluster mode, peers forward without a client certificate")
+			}
+		} else if len(t.ClientHeaders) > 0 {
+			v.add(f, "server.tls.client_headers", "needs client_ca, there are no client certificates without it")
+		}
+		v.oneOf(f, "server.tls.client_auth", t.ClientAuth, "require", "optional")
+		for name, field := range t.ClientHeaders {
+			if _, ok := clientCertFields[field]; !ok {
+				v.add(f, "server.tls.client_headers."+name, "%q is not a certificate field, like subject.cn or san.email", field)
+			}
+		}
+	}
+	for i, entry := range config.Server.TrustedProxies {
+		if _, err := parseTrustedProxy(entry); err != nil {
+			v.add(f, fmt.Sprintf("server.trusted_proxies.%d", i), "%v", err)
+		}
+	}
+
+	start, end := config.Workers.PortRangeStart, config.Workers.PortRangeEnd
+	v.port(f, "workers.port_range_start", start)
+	v.port(f, "workers.port_range_end", end)
+	if start > end {
+		v.add(f, "workers.port_range_end", "%d is below port_range_start %d", end, start)
+	}
+	inWorkerRange := func(port int) bool { return port >= start && port <= end }
+	if inWorkerRange(config.Server.Port) {
+		v.add(f, "server.port", "%d is in the worker port range %d-%d", config.Server.Port, start, end)
+	}
+	v.nonNegative(f, "workers.startup_delay_ms", config.Workers.StartupDelayMs)
+	v.nonNegative(f, "workers.restart_delay_ms", config.Workers.RestartDelayMs)
+	v.nonNegative(f, "workers.shutdown_grace_period_ms", config.Workers.ShutdownGracePeriodMs)
+	v.nonNegative(f, "workers.health_check_wait_timeout_ms", config.Workers.HealthCheckWaitTimeoutMs)
+	v.nonNegative(f, "workers.health_check_timeout_ms", config.Workers.HealthCheckTimeoutMs)
+	v.nonNegative(f, "workers.rollback_window_seconds", config.Workers.RollbackWindowSeconds)
+	v.nonNegative(f, "workers.keep_binaries", config.Workers.KeepBinaries)
+	v.nonNegative(f, "workers.binary_max_age_hours", config.Workers.BinaryMaxAgeHours)
+	v.nonNegative(f, "file_watcher.debounce_ms", config.FileWatcher.DebounceMs)
+	if info, err := os.Stat(config.Workers.Directory); err != nil || !info.IsDir() {
+		v.add(f, "workers.directory", "%q is not a directory", config.Workers.Directory)
+	}
+	if config.Workers.VerifyKey != "" {
+		if _, err := readVerifyKey(config.Workers.VerifyKey); err != nil {
+			v.add(f, "workers.verify_key", "%v", err)
+		}
+	}
+
+	if config.Socks5.Enabled {
+		v.port(f, "socks5.port", config.Socks5.Port)
+		if config.Socks5.Port == config.Server.Port {
+			v.add(f, "socks5.port", "%d is also the server port", config.Socks5.Port)
+		} else if inWorkerRange(config.Socks5.Port) {
+			v.add(f, "socks5.port", "%d is in the worker port range %d-%d", config.Socks5.Port, start, end)
+		}
+		v.oneOf(f, "socks5.log_format", config.Socks5.LogFormat, "json", "text")
+		if e := config.Socks5.Enforce; e != nil && e.Enabled {
+			if runtime.GOOS != "linux" {
+				v.add(f, "socks5.enforce", "is only supported on Linux")
+			}
+			for i, port := range e.LocalPorts {
+				v.port(f, fmt.Sprintf("socks5.enforce.local_ports.%d", i), port)
+			}
+		}
+	}
+
+	if config.Metrics.Enabled {
+		v.urlPath(f, "metrics.path", config.Metrics.Path)
+	}
+	v.urlPath(f, "health.liveness_path", config.Health.LivenessPath)
+	v.urlPath(f, "health.readiness_path", config.Health.ReadinessPath)
+	v.oneOf(f, "health.startup_gate", config.Health.StartupGate, "bind", "unavailable")
+	v.nonNegative(f, "health.startup_timeout_seconds", config.Health.StartupTimeoutSeconds)
+	if config.Health.LivenessPath != "" && config.Health.LivenessPath == config.Health.ReadinessPath {
+		v.add(f, "health.readiness_path", "%q is also the liveness path", config.Health.ReadinessPath)
+	}
+
+	if config.Admin.Enabled {
+		if _, port, err := net.SplitHostPort(config.Admin.Listen); err != nil {
+			v.add(f, "admin.listen", "%q is not a host:port address", config.Admin.Listen)
+		} else if port == strconv.Itoa(config.Server.Port) {
+			v.add(f, "admin.listen", "%q uses the public port", config.Admin.Listen)
+		}
+	}
+	if d := config.Deploy; d.Enabled {
+		v.urlPath(f, "deploy.path", d.Path)
+		if d.Secret == "" {
+			v.add(f, "deploy.secret", "is required, the endpoint is public")
+		}
+		if d.Remote == "" || strings.HasPrefix(d.Remote, "-") {
+			v.add(f, "deploy.remote", "%q is not a git remote", d.Remote)
+		}
+		if d.Branch == "" || strings.HasPrefix(d.Branch, "-") {
+			v.add(f, "deploy.branch", "%q is not a branch", d.Branch)
+		}
+	}
+	if c := config.Cluster; c.Enabled {
+		if c.Secret == "" {
+			v.add(f, "cluster.secret", "is required, the state is served on the public port")
+		}
+		for i, peer := range c.Peers {
+			if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				v.add(f, fmt.Sprintf("cluster.peers.%d", i), "%q is not an http(s) URL", peer)
+			}
+		}
+		if c.IntervalMs <= 0 {
+			v.add(f, "cluster.interval_ms", "%d must be positive", c.IntervalMs)
+		}
+	}
+	if waf := config.WAF; waf != nil && waf.Enabled {
+		v.nonNegative(f, "waf.inspect_body_bytes", waf.InspectBodyBytes)
+		ruleNames := map[string]bool{badUserAgentRule: waf.KnownBadUserAgents}
+		for i, rule := range waf.Rules {
+			key := fmt.Sprintf("waf.rules.%d", i)
+			if rule.Name == "" {
+				v.add(f, key+".name", "is required")
+			} else if ruleNames[rule.Name] {
+				v.add(f, key+".name", "%q is used by another rule", rule.Name)
+			}
+			ruleNames[rule.Name] = true
+			if rule.MaxSize < 0 {
+				v.add(f, key+".max_size", "%d must not be negative", rule.MaxSize)
+			}
+			v.oneOf(f, key+".action", rule.Action, "block", "log")
+			if _, err := compileWAFRule(rule); err != nil {
+				v.add(f, key, "%v", err)
+			}
+		}
+	}
+	if rl := config.RateLimit; rl != nil && rl.Enabled {
+		tiers := make([]string, 0, len(rl.Tiers))
+		for name := range rl.Tiers {
+			tiers = append(tiers, name)
+		}
+		sort.Strings(tiers)
+		for _, name := range tiers {
+			tier := rl.Tiers[name]
+			key := "rate_limit.tiers." + name
+			if tier.RequestsPerSecond < 0 {
+				v.add(f, key+".requests_per_second", "%g must not be negative", tier.RequestsPerSecond)
+			}
+			v.nonNegative(f, key+".burst", tier.Burst)
+			if tier.DailyQuota < 0 {
+				v.add(f, key+".daily_quota", "%d must not be negative", tier.DailyQuota)
+			}
+		}
+		if _, ok := rl.Tiers[rl.Anonymous]; rl.Anonymous != "" && !ok {
+			v.add(f, "rate_limit.anonymous", "%q is not a tier", rl.Anonymous)
+		}
+		validateKeys := func(file *configFile, prefix string, keys []APIKey) {
+			for i, k := range keys {
+				key := fmt.Sprintf("%s.%d", prefix, i)
+				if _, err := k.hash(); err != nil {
+					v.add(file, key, "%v", err)
+				}
+				if k.Name == "" {
+					v.add(file, key+".name", "is required")
+				}
+				if _, ok := rl.Tiers[k.Tier]; !ok {
+					v.add(file, key+".tier", "%q is not a tier", k.Tier)
+				}
+			}
+		}
+		validateKeys(f, "rate_limit.keys", rl.Keys)
+		if rl.KeyFile != "" {
+			if keys, err := loadAPIKeyFile(rl.KeyFile); err != nil {
+				v.add(f, "rate_limit.key_file", "%v", err)
+			} else {
+				validateKeys(newConfigFile(rl.KeyFile), "keys", keys)
+			}
+		}
+	}
+	if c := config.CSRF; c != nil && c.Enabled {
+		if err := (&http.Cookie{Name: c.Cookie, Value: "x"}).Valid(); err != nil {
+			v.add(f, "csrf.cookie", "%q is not a valid cookie name", c.Cookie)
+		}
+		if strings.ContainsAny(c.Header, " :\r\n") {
+			v.add(f, "csrf.header", "%q is not a valid header name", c.Header)
+		}
+		for i, path := range c.ExemptPaths {
+			if path == "" {
+				v.add(f, fmt.Sprintf("csrf.exempt_paths.%d", i), "is empty")
+			}
+			v.urlPath(f, fmt.Sprintf("csrf.exempt_paths.%d", i), path)
+		}
+	}
+	if c := config.Static.FileCache; c != nil {
+		v.nonNegative(f, "static.file_cache.max_entries", c.MaxEntries)
+		v.nonNegative(f, "static.file_cache.max_open_files", c.MaxOpenFiles)
+	}
+	if c := config.Static.Assets; c != nil {
+		v.nonNegative(f, "static.assets.max_file_size", c.MaxFileSize)
+		v.nonNegative(f, "static.assets.max_total_size", c.MaxTotalSize)
+		v.nonNegative(f, "static.assets.max_age_seconds", c.MaxAgeSeconds)
+	}
+	if d := config.Dashboard; d != nil && d.Enabled && !config.IsDevelopmentMode() && (d.Username == "" || d.Password == "") {
+		v.add(f, "dashboard", "username and password are required in production mode")
+	}
+	if t := config.Tracing; t != nil && t.SampleRatio != nil && (*t.SampleRatio < 0 || *t.SampleRatio > 1) {
+		v.add(f, "tracing.sample_ratio", "%g is not between 0 and 1", *t.SampleRatio)
+	}
+
+	streams := map[string]*LogOutputConfig{
+		"logging.server": config.Logging.Server,
+		"logging.access": config.Logging.Access,
+		"logging.worker": config.Logging.Worker,
+		"logging.socks5": config.Logging.Socks5,
+	}
+	for key, stream := range streams {
+		if stream == nil {
+			continue
+		}
+		v.oneOf(f, key+".output", stream.Output, "file", "stdout", "stderr", "syslog", "journald", "off")
+		if _, err := logsink.ParseFacility(stream.Facility); err != nil {
+			v.add(f, key+".facility", "%q is not a syslog facility", stream.Facility)
+		}
+	}
+	v.oneOf(f, "logging.syslog.network", config.Logging.Syslog.Network, "unixgram", "unix", "udp", "tcp")
+
+	for i, hook := range config.Webhooks {
+		key := fmt.Sprintf("webhooks.%d", i)
+		if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add(f, key+".url", "%q is not an http(s) URL", hook.URL)
+		}
+		v.oneOf(f, key+".format", hook.Format, "json", "slack")
+		v.nonNegative(f, key+".timeout_seconds", hook.TimeoutSeconds)
+	}
+
+	for name := range config.Env {
+		if name == "" || strings.ContainsAny(name, "= \t") {
+			v.add(f, "env", "%q is not an environment variable name", name)
+		}
+	}
+
+	for name, secret := range config.Secrets {
+		if err := secret.check(); err != nil {
+			v.add(f, "secrets."+name, "%v", err)
+		}
+	}
+
+	// Workers, and the routes they claim
+	routes := map[string]string{}
+	names := map[string]bool{}
+	for _, wc := range workerConfigs {
+		wf := newConfigFile(wc.ConfigPath)
+		cfg := &wc.Config
+		names[wc.Name] = true
+
+		v.oneOf(wf, "type", cfg.Type, "go", "bun", "php", "container", "wasm", "remote")
+		v.oneOf(wf, "enabled", cfg.Enabled, "true", "false", "development")
+		if cfg.Recycle != "" {
+			if cfg.Type == "wasm" || cfg.Type == "remote" {
+				v.add(wf, "recycle", "%s workers have no instances to recycle", cfg.Type)
+			} else if _, err := cron.Parse(cfg.Recycle); err != nil {
+				v.add(wf, "recycle", "%v", err)
+			}
+		}
+		if c := cfg.Confine; c != nil && c.Enabled {
+			switch {
+			case cfg.Type != "" && cfg.Type != "go" && cfg.Type != "bun" && cfg.Type != "php":
+				v.add(wf, "confine", "only go, bun and php workers can be confined")
+			case runtime.GOOS != "linux":
+				v.add(wf, "confine", "is only supported on Linux")
+			}
+			for i, path := range c.ReadOnly {
+				if path == "" {
+					v.add(wf, fmt.Sprintf("confine.read_only.%d", i), "is empty")
+				}
+			}
+		}
+		if len(cfg.SecretFiles) > 0 && cfg.Type != "" && cfg.Type != "go" && cfg.Type != "bun" && cfg.Type != "container" {
+			v.add(wf, "secret_files", "only go, bun and container workers get secret files")
+		}
+		for name := range cfg.SecretFiles {
+			if !secretFileName.MatchString(name) {
+				v.add(wf, "secret_files."+name, "%q is not an environment variable name", name)
+			}
+		}
+		switch {
+		case cfg.Path == "":
+			v.add(wf, "path", "is required")
+		case !strings.HasPrefix(cfg.Path, "/"):
+			v.add(wf, "path", "%q must start with /", cfg.Path)
+		case cfg.IsEnabled(config.Mode):
+			route := strings.TrimSuffix(cfg.Path, "/")
+			if route == "" {
+				route = "/"
+			}
+			if other, ok := routes[route]; ok {
+				v.add(wf, "path", "%q is also the path of worker %q", cfg.Path, other)
+			}
+			routes[route] = wc.Name
+			for _, reserved := range append(configReservedPaths, config.Metrics.Path, config.Health.LivenessPath, config.Health.ReadinessPath) {
+				if reserved != "" && route == reserved {
+					v.add(wf, "path", "%q is served by the server itself", cfg.Path)
+				}
+			}
+		}
+
+		if s := cfg.Scaling; s != nil {
+			v.nonNegative(wf, "scaling.min_workers", s.MinWorkers)
+			v.nonNegative(wf, "scaling.max_workers", s.MaxWorkers)
+			if s.MaxWorkers > 0 && s.MinWorkers > s.MaxWorkers {
+				v.add(wf, "scaling.min_workers", "%d is above max_workers %d", s.MinWorkers, s.MaxWorkers)
+			}
+			v.nonNegative(wf, "scaling.queue_threshold", s.QueueThreshold)
+			v.nonNegative(wf, "scaling.scale_down_delay", s.ScaleDownDelay)
+		}
+		if q := cfg.Queue; q != nil {
+			v.nonNegative(wf, "queue.size", q.Size)
+			v.nonNegative(wf, "queue.max_wait_ms", q.MaxWaitMs)
+			v.nonNegative(wf, "queue.max_in_flight", q.MaxInFlight)
+			v.oneOf(wf, "queue.shed", q.Shed, queueShedReject, queueShedOldest)
+		}
+		if g := cfg.Go; g != nil {
+			v.nonNegative(wf, "go.go_max_procs", g.GOMAXPROCS)
+			v.nonNegative(wf, "go.read_timeout_seconds", g.ReadTimeoutSeconds)
+			v.nonNegative(wf, "go.write_timeout_seconds", g.WriteTimeoutSeconds)
+			v.nonNegative(wf, "go.idle_timeout_seconds", g.IdleTimeoutSeconds)
+			v.nonNegative(wf, "go.max_requests", g.MaxRequests)
+			if g.Debug != nil && g.Debug.Port != 0 {
+				v.port(wf, "go.debug.port", g.Debug.Port)
+			}
+		}
+		if php := cfg.PHP; php != nil {
+			validatePool := func(key string, pool PHPPoolConfig) {
+				v.oneOf(wf, key+".manager", pool.Manager, "static", "dynamic", "ondemand")
+				if pool.MaxWorkers > 0 && pool.MinWorkers > pool.MaxWorkers {
+					v.add(wf, key+".min_workers", "%d is above max_workers %d", pool.MinWorkers, pool.MaxWorkers)
+				}
+				if pool.MaxWorkers > 0 && pool.StartWorkers > pool.MaxWorkers {
+					v.add(wf, key+".start_workers", "%d is above max_workers %d", pool.StartWorkers, pool.MaxWorkers)
+				}
+			}
+			validatePool("php.pool", php.Pool)
+			for i, extra := range php.Pools {
+				key := fmt.Sprintf("php.pools.%d", i)
+				if extra.Name == "" {
+					v.add(wf, key+".name", "is required")
+				}
+				validatePool(key+".pool", extra.Pool)
+			}
+		}
+		if b := cfg.Bun; b != nil {
+			v.oneOf(wf, "bun.watch", b.Watch, "hot", "watch")
+			v.oneOf(wf, "bun.typecheck", b.Typecheck, "tsc", "build")
+		}
+		if c := cfg.Container; c != nil {
+			v.oneOf(wf, "container.runtime", c.Runtime, "docker", "podman")
+			if c.Image == "" && c.Build == "" {
+				v.add(wf, "container", "image or build is required")
+			}
+			if c.ContainerPort != 0 {
+				v.port(wf, "container.container_port", c.ContainerPort)
+			}
+		}
+		if r := cfg.Remote; r != nil {
+			if cfg.Type != "remote" {
+				v.add(wf, "remote", "is only used by remote workers")
+			}
+			for i, addr := range r.Instances {
+				if err := checkRemoteAddress(addr); err != nil {
+					v.add(wf, fmt.Sprintf("remote.instances.%d", i), "%v", err)
+				}
+			}
+			v.oneOf(wf, "remote.protocol", r.Protocol, "http", protocolSCGI, protocolUWSGI)
+		}
+		if t := cfg.Test; t != nil {
+			v.nonNegative(wf, "test.timeout_seconds", t.TimeoutSeconds)
+			if t.OnChange && t.Command == "" && cfg.Type != "go" && cfg.Type != "bun" {
+				v.add(wf, "test.command", "is required for %s workers", cfg.Type)
+			}
+		}
+		mockNames := make(map[string]bool)
+		for i, mock := range cfg.Mocks {
+			key := fmt.Sprintf("mocks.%d", i)
+			if mock.Name == "" {
+				v.add(wf, key+".name", "is required")
+			} else if mockNames[mock.Name] {
+				v.add(wf, key+".name", "%q is used by another mock", mock.Name)
+			}
+			mockNames[mock.Name] = true
+			if mock.Env == "" && mock.Host == "" {
+				v.add(wf, key, "env or host is required")
+			}
+			for j, route := range mock.Routes {
+				routeKey := fmt.Sprintf("%s.routes.%d", key, j)
+				if !strings.HasPrefix(route.Path, "/") {
+					v.add(wf, routeKey+".path", "%q must start with /", route.Path)
+				}
+				if route.Status != 0 && (route.Status < 100 || route.Status > 599) {
+					v.add(wf, routeKey+".status", "%d is not an HTTP status", route.Status)
+				}
+				if route.Body != "" && route.File != "" {
+					v.add(wf, routeKey+".file", "cannot be combined with body")
+				}
+				v.nonNegative(wf, routeKey+".latency_ms", route.LatencyMs)
+			}
+		}
+	}
+
+	for i, name := range config.Health.RequiredWorkers {
+		if !names[name] {
+			v.add(f, fmt.Sprintf("health.required_workers.%d", i), "%q is not a worker", name)
+		}
+	}
+	if waf := config.WAF; waf != nil && waf.Enabled {
+		for i, rule := range waf.Rules {
+			for j, name := range rule.Workers {
+				if !names[name] {
+					v.add(f, fmt.Sprintf("waf.rules.%d.workers.%d", i, j), "%q is not a worker", name)
+				}
+			}
+		}
+	}
+
+	if rl := config.RateLimit; rl != nil && rl.Enabled {
+		for i, name := range rl.Workers {
+			if !names[name] {
+				v.add(f, fmt.Sprintf("rate_limit.workers.%d", i), "%q is not a worker", name)
+			}
+		}
+	}
+
+	if c := config.CSRF; c != nil && c.Enabled {
+		for i, name := range c.Workers {
+			if !names[name] {
+				v.add(f, fmt.Sprintf("csrf.workers.%d", i), "%q is not a worker", name)
+			}
+		}
+	}
+
+	sortProblems(v.problems)
+	return v.problems
+}
+
+// sortProblems orders problems by file and line
+func sortProblems(problems []ConfigProblem) {
+	sort.SliceStable(problems, func(i, j int) bool {
+		a, b := problems[i], problems[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+}
+
+// runValidate implements "tqserver validate": it loads the server and worker
+// configs, prints every problem and exits with status 1 when there are any.
+// Paths are relative to the working directory, as when serving.
+func runValidate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := flags.String("config", "config/server.yaml", "Path to config file")
+	mode := flags.String("mode", "", "Server mode to validate for: dev or prod")
+	flags.Parse(args)
+
+	config, workerConfigs, problems, err := validateProject(findConfigFile(*configPath), *mode)
+	if err != nil {
+		fmt.Println(problems[0])
+		os.Exit(1)
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Printf("Configuration is valid (%d worker(s), %s mode)\n", len(workerConfigs), config.Mode)
+}
+
+// validateProject loads the server config and the config of every worker
+// in its workers directory and returns them with all problems found. When
+// the server config cannot be loaded the error is returned with its problem.
+func validateProject(configFile, mode string) (*Config, []*WorkerConfigWithMeta, []ConfigProblem, error) {
+	config, problems, err := loadConfigFile(configFile)
+	if err != nil {
+		return nil, nil, []ConfigProblem{errorProblem(configFile, err)}, err
+	}
+	if mode != "" {
+		config.Mode = mode
+	}
+
+	var workerConfigs []*WorkerConfigWithMeta
+	entries, err := os.ReadDir(config.Workers.Directory)
+	if err != nil {
+		problems = append(problems, ConfigProblem{File: configFile, Message: err.Error()})
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		path := findConfigFile(filepath.Join(config.Workers.Directory, entry.Name(), "config", "worker.yaml"))
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		workerConfig, unknown, err := loadWorkerConfigFile(path, config.SecretStore())
+		problems = append(problems, unknown...)
+		if err != nil {
+			problems = append(problems, errorProblem(path, err))
+			continue
+		}
+		workerConfigs = append(workerConfigs, &WorkerConfigWithMeta{Name: entry.Name(), ConfigPath: path, Config: *workerConfig})
+	}
+	problems = append(problems, ValidateConfig(config, configFile, workerConfigs)...)
+	sortProblems(problems)
+	return config, workerConfigs, problems, nil
+}
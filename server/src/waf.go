@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// defaultWAFInspectBody is the body prefix matched by body rules when
+// inspect_body_bytes is not set
+const defaultWAFInspectBody = 64 * 1024
+
+// badUserAgentRule is the name of the rule added by known_bad_user_agents
+const badUserAgentRule = "bad_user_agent"
+
+// badUserAgents matches the User-Agent of common vulnerability scanners
+const badUserAgents = `(?i)sqlmap|nikto|nmap|masscan|zgrab|acunetix|netsparker|wpscan|dirbuster|gobuster|nuclei|havij|w3af|fimap|jorgee|zmeu|morfeus`
+
+// wafEngine inspects requests before they reach a worker, the first
+// matching blocking rule rejects a request. A nil engine passes all.
+type wafEngine struct {
+	rules       []*wafRule
+	inspectBody int
+}
+
+// wafRule is a compiled WAF rule, it matches a request on all of its
+// conditions
+type wafRule struct {
+	name      string
+	block     bool
+	workers   []string
+	methods   []string
+	path      *regexp.Regexp
+	query     *regexp.Regexp
+	body      *regexp.Regexp
+	userAgent *regexp.Regexp
+	maxSize   int64
+}
+
+// newWAF compiles the rules of the WAF, nil when it is off. Invalid rules
+// are skipped, they are reported by ValidateConfig.
+func newWAF(cfg *WAFConfig) *wafEngine {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	e := &wafEngine{inspectBody: cfg.InspectBodyBytes}
+	if e.inspectBody <= 0 {
+		e.inspectBody = defaultWAFInspectBody
+	}
+	rules := cfg.Rules
+	if cfg.KnownBadUserAgents {
+		rules = append([]WAFRule{{Name: badUserAgentRule, UserAgent: badUserAgents}}, rules...)
+	}
+	for _, rule := range rules {
+		if rule.Action != "" && rule.Action != "block" && rule.Action != "log" {
+			continue
+		}
+		if compiled, err := compileWAFRule(rule); err == nil {
+			e.rules = append(e.rules, compiled)
+		}
+	}
+	return e
+}
+
+// compileWAFRule compiles the regular expressions of a rule
+func compileWAFRule(rule WAFRule) (*wafRule, error) {
+	compiled := &wafRule{
+		name:    rule.Name,
+		block:   rule.Action != "log",
+		workers: rule.Workers,
+		maxSize: rule.MaxSize,
+	}
+	for _, method := range rule.Methods {
+		compiled.methods = append(compiled.methods, strings.ToUpper(method))
+	}
+	for _, field := range []struct {
+		key, pattern string
+		re           **regexp.Regexp
+	}{
+		{"path", rule.Path, &compiled.path},
+		{"query", rule.Query, &compiled.query},
+		{"body", rule.Body, &compiled.body},
+		{"user_agent", rule.UserAgent, &compiled.userAgent},
+	} {
+		if field.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(field.pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", field.key, err)
+		}
+		*field.re = re
+	}
+	if compiled.methods == nil && compiled.path == nil && compiled.query == nil && compiled.body == nil && compiled.userAgent == nil && compiled.maxSize == 0 {
+		return nil, fmt.Errorf("has no condition, it would match every request")
+	}
+	return compiled, nil
+}
+
+// inspect matches a request of a worker against the rules in order. Matches
+// of log rules are logged and counted, the first matching block rule is
+// returned. The body is read up to inspect_body_bytes when a rule needs it,
+// the worker still gets all of it.
+func (e *wafEngine) inspect(r *http.Request, worker string) *wafRule {
+	if e == nil {
+		return nil
+	}
+	var (
+		query    []string
+		body     []byte
+		bodyRead bool
+		size     = r.ContentLength
+	)
+	readBody := func() {
+		if bodyRead || r.Body == nil || r.Body == http.NoBody {
+			bodyRead = true
+			return
+		}
+		bodyRead = true
+		prefix := peekBody(r, e.inspectBody+1)
+		if size < 0 {
+			// Without Content-Length, a longer body counts as one byte more
+			size = int64(len(prefix))
+		}
+		body = prefix[:min(len(prefix), e.inspectBody)]
+	}
+	form := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+
+	for _, rule := range e.rules {
+		if len(rule.workers) > 0 && !slices.Contains(rule.workers, worker) {
+			continue
+		}
+		if len(rule.methods) > 0 && !slices.Contains(rule.methods, r.Method) {
+			continue
+		}
+		if rule.path != nil && !rule.path.MatchString(r.URL.Path) {
+			continue
+		}
+		if rule.query != nil {
+			if query == nil {
+				query = []string{r.URL.RawQuery, wafUnescape(r.URL.RawQuery)}
+			}
+			if !rule.query.MatchString(query[0]) && !rule.query.MatchString(query[1]) {
+				continue
+			}
+		}
+		if rule.userAgent != nil && !rule.userAgent.MatchString(r.UserAgent()) {
+			continue
+		}
+		if rule.maxSize > 0 {
+			if size < 0 {
+				readBody()
+			}
+			if size <= rule.maxSize {
+				continue
+			}
+		}
+		if rule.body != nil {
+			readBody()
+			if !rule.body.Match(body) && (!form || !rule.body.MatchString(wafUnescape(string(body)))) {
+				continue
+			}
+		}
+
+		action := "log"
+		if rule.block {
+			action = "block"
+		}
+		GetMetrics().RecordWAFMatch(rule.name, action)
+		if rule.block {
+			log.Printf("WAF rule %s blocked %s %s from %s (worker %s)", rule.name, r.Method, r.URL.Path, clientIP(r), worker)
+			return rule
+		}
+		log.Printf("WAF rule %s matched %s %s from %s (worker %s)", rule.name, r.Method, r.URL.Path, clientIP(r), worker)
+	}
+	return nil
+}
+
+// wafUnescape decodes a query string or form body for matching, unlike
+// url.QueryUnescape it keeps an invalid escape as is and still decodes the
+// valid ones around it
+func wafUnescape(s string) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		case s[i] == '+':
+			b.WriteByte(' ')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// isHex reports whether c is a hexadecimal digit
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// unhex returns the value of a hexadecimal digit
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
+// peekBody reads up to n bytes of the body of a request, the body still
+// returns them after
+func peekBody(r *http.Request, n int) []byte {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	prefix, _ := io.ReadAll(io.LimitReader(r.Body, int64(n)))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), r.Body), r.Body}
+	return prefix
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWAFUnescape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"q=%3Cscript%3E", "q=<script>"},
+		{"q=%3Cscript%3E&x=%", "q=<script>&x=%"},
+		{"q=%3cscript%3e&x=%zz", "q=<script>&x=%zz"},
+		{"a+b=%2", "a b=%2"},
+		{"plain", "plain"},
+	}
+	for _, tt := range tests {
+		if got := wafUnescape(tt.in); got != tt.want {
+			t.Errorf("wafUnescape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestWAFInspectMalformedEscape(t *testing.T) {
+	waf := newWAF(&WAFConfig{Enabled: true, Rules: []WAFRule{
+		{Name: "xss_query", Query: "(?i)<script"},
+		{Name: "xss_body", Body: "(?i)<script"},
+	}})
+
+	tests := []struct {
+		name, target, contentType, body, want string
+	}{
+		{"query", "/?q=%3Cscript%3E", "", "", "xss_query"},
+		{"query with stray percent", "/?q=%3Cscript%3E&x=%", "", "", "xss_query"},
+		{"raw query", "/?q=<script>", "", "", "xss_query"},
+		{"form body", "/", "application/x-www-form-urlencoded", "q=%3Cscript%3E&x=%", "xss_body"},
+		{"encoded other body", "/", "application/json", `{"q":"%3Cscript%3E"}`, ""},
+		{"clean", "/?q=hello&x=%", "application/x-www-form-urlencoded", "q=hello", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", tt.target, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		got := ""
+		if rule := waf.inspect(r, "app"); rule != nil {
+			got = rule.name
+		}
+		if got != tt.want {
+			t.Errorf("%s: matched %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
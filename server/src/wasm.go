@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// WasmModule is a compiled WASI module that is instantiated once per request.
+// Requests are passed CGI-style (WAGI): metadata in environment variables,
+// the body on stdin, and a CGI response is read from stdout.
+type WasmModule struct {
+	name     string
+	path     string
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	timeout  time.Duration
+	env      map[string]string
+	mu       sync.RWMutex // Read locked by the requests, Close waits for them
+}
+
+// NewWasmModule compiles the WASI module at path
+func NewWasmModule(name, path string, memoryLimitMB int, timeout time.Duration, env map[string]string) (*WasmModule, error) {
+	wasmBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wasm module: %w", err)
+	}
+
+	ctx := context.Background()
+	runtimeConfig := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if memoryLimitMB > 0 {
+		// One wasm page is 64KiB
+		runtimeConfig = runtimeConfig.WithMemoryLimitPages(uint32(memoryLimitMB * 16))
+	}
+	runtime := wazero.NewRuntimeWithConfig(ctx, runtimeConfig)
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+	compiled, err := runtime.CompileModule(ctx, wasmBytes)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to compile wasm module: %w", err)
+	}
+
+	return &WasmModule{
+		name:     name,
+		path:     path,
+		runtime:  runtime,
+		compiled: compiled,
+		timeout:  timeout,
+		env:      env,
+	}, nil
+}
+
+// Close releases the compiled module and its runtime, once the requests
+// that use it finished
+func (m *WasmModule) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.runtime.Close(context.Background())
+}
+
+// ServeCGI runs the module for a single request and returns its stdout and
+// stderr. The caller holds the module, see acquireWasm.
+func (m *WasmModule) ServeCGI(ctx context.Context, params map[string]string, body io.Reader) ([]byte, []byte, error) {
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	config := wazero.NewModuleConfig().
+		WithName(""). // Anonymous so instances can run concurrently
+		WithArgs(m.name).
+		WithStdin(body).
+		WithStdout(&stdout).
+		WithStderr(&stderr).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithRandSource(rand.Reader)
+
+	for k, v := range m.env {
+		config = config.WithEnv(k, v)
+	}
+	for k, v := range params {
+		config = config.WithEnv(k, v)
+	}
+
+	mod, err := m.runtime.InstantiateModule(ctx, m.compiled, config)
+	if mod != nil {
+		mod.Close(ctx)
+	}
+	if err != nil {
+		// A WASI command exits through proc_exit, exit code 0 is a normal return
+		if exitErr, ok := err.(*sys.ExitError); !ok || exitErr.ExitCode() != 0 {
+			return stdout.Bytes(), stderr.Bytes(), err
+		}
+	}
+
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
+
+// wasmModulePath returns the compiled module location for a worker
+func wasmModulePath(workerRoot, workerName string, workerMeta *WorkerConfigWithMeta) string {
+	if workerMeta != nil && workerMeta.Config.Wasm != nil && workerMeta.Config.Wasm.Module != "" {
+		module := workerMeta.Config.Wasm.Module
+		if !filepath.IsAbs(module) {
+			module = filepath.Join(workerRoot, module)
+		}
+		return module
+	}
+	return filepath.Join(workerRoot, "bin", workerName+".wasm")
+}
+
+// buildWasmWorker compiles the worker sources to a WASI module. A configured
+// build command takes precedence, Go sources are built with TinyGo.
+func buildWasmWorker(workerName, workerRoot string, workerMeta *WorkerConfigWithMeta) error {
+	modulePath := wasmModulePath(workerRoot, workerName, workerMeta)
+
+	var cmd *exec.Cmd
+	if workerMeta != nil && workerMeta.Config.Wasm != nil && workerMeta.Config.Wasm.Build != "" {
+		cmd = exec.Command("sh", "-c", workerMeta.Config.Wasm.Build)
+	} else if hasGo, _ := hasGoSourceFiles(filepath.Join(workerRoot, "src")); hasGo {
+		tinygo, err := exec.LookPath("tinygo")
+		if err != nil {
+			return fmt.Errorf("tinygo not found in PATH; install tinygo or set wasm.build in worker config")
+		}
+		os.MkdirAll(filepath.Dir(modulePath), 0755)
+		cmd = exec.Command(tinygo, "build", "-o", modulePath, "-target=wasi", "./src")
+	} else {
+		// Prebuilt module, nothing to do
+		return nil
+	}
+
+	cmd.Dir = workerRoot
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("wasm build failed: %s", out)
+	}
+	return nil
+}
+
+// loadWasmModule (re)compiles the module of a wasm worker and swaps it in
+func (s *Supervisor) loadWasmModule(worker *Worker) error {
+	workerRoot := filepath.Join(s.projectRoot, s.config.Workers.Directory, worker.Name)
+	workerMeta := s.getWorkerConfig(worker.Name)
+
+	memoryLimitMB := 0
+	env := map[string]string{}
+	for k, v := range s.config.Env {
+		env[k] = v
+	}
+	if workerMeta != nil && workerMeta.Config.Wasm != nil {
+		memoryLimitMB = workerMeta.Config.Wasm.MemoryLimitMB
+		for k, v := range workerMeta.Config.Wasm.Env {
+			env[k] = v
+		}
+	}
+	env["WORKER_NAME"] = worker.Name
+	env["WORKER_PATH"] = worker.Path
+	env["WORKER_TYPE"] = worker.Type
+	env["WORKER_MODE"] = s.config.Mode
+
+	module, err := NewWasmModule(worker.Name, wasmModulePath(workerRoot, worker.Name, workerMeta), memoryLimitMB, s.config.GetWriteTimeout(), env)
+	if err != nil {
+		return err
+	}
+
+	worker.mu.Lock()
+	old := worker.Wasm
+	worker.Wasm = module
+	// Register pseudo-instance so the worker reports healthy
+	worker.Instances = []*WorkerInstance{{
+		ID:        "wasm-module",
+		Healthy:   true,
+		StartTime: time.Now(),
+	}}
+	worker.mu.Unlock()
+
+	// Closed after the requests that still use it
+	if old != nil {
+		go old.Close()
+	}
+
+	log.Printf("✅ WASM module loaded for %s from %s", worker.Path, module.path)
+	return nil
+}
+
+// acquireWasm returns the WASM module of a worker read locked, so a reload
+// closes it only after it is released, nil when none is loaded. The module
+// is locked before it can be swapped out.
+func acquireWasm(worker *Worker) *WasmModule {
+	worker.mu.RLock()
+	defer worker.mu.RUnlock()
+	module := worker.Wasm
+	if module != nil {
+		module.mu.RLock()
+	}
+	return module
+}
+
+// release ends the use of a module returned by acquireWasm
+func (m *WasmModule) release() {
+	m.mu.RUnlock()
+}
+
+// handleWasmRequest runs a request through the worker's WASM module
+func (p *Proxy) handleWasmRequest(w http.ResponseWriter, r *http.Request, worker *Worker) {
+	module := acquireWasm(worker)
+	if module == nil {
+		p.serveErrorPage(w, r, http.StatusServiceUnavailable, "Service Unavailable", "WASM module not loaded", map[string]interface{}{
+			"WorkerName": worker.Name,
+		})
+		return
+	}
+	defer module.release()
+
+	pathInfo := strings.TrimPrefix(r.URL.Path, worker.Path)
+	if pathInfo == "" {
+		pathInfo = "/"
+	}
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "TQServer",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       r.Host,
+		"SERVER_PORT":       fmt.Sprintf("%d", p.config.Server.Port),
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"SCRIPT_NAME":       worker.Path,
+		"PATH_INFO":         pathInfo,
+		"QUERY_STRING":      r.URL.RawQuery,
+		"REMOTE_ADDR":       clientIP(r),
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+		"CONTENT_LENGTH":    fmt.Sprintf("%d", max(r.ContentLength, 0)),
+	}
+	for key, values := range r.Header {
+		headerName := "HTTP_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		params[headerName] = strings.Join(values, ", ")
+	}
+
+	var body io.Reader = http.NoBody
+	if r.Body != nil {
+		body = r.Body
+	}
+
+	stdout, stderr, err := module.ServeCGI(r.Context(), params, body)
+	if len(stderr) > 0 {
+		log.Printf("[WASM stderr] %s", stderr)
+	}
+	if err != nil {
+		p.serveErrorPage(w, r, http.StatusBadGateway, "Bad Gateway", "WASM module failed", map[string]interface{}{
+			"Error":      err.Error(),
+			"WorkerName": worker.Name,
+		})
+		log.Printf("WASM module %s failed: %v", worker.Name, err)
+		return
+	}
+
+	if err := writeCGIResponse(w, stdout); err != nil {
+		p.serveErrorPage(w, r, http.StatusBadGateway, "Bad Gateway", "Invalid response from WASM module", map[string]interface{}{
+			"Error":      err.Error(),
+			"WorkerName": worker.Name,
+		})
+		log.Printf("WASM module %s sent an invalid response: %v", worker.Name, err)
+		return
+	}
+	worker.IncrementRequestCount()
+
+	log.Printf("%s %s -> WASM worker %s", r.Method, r.URL.Path, worker.Name)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// webhookAttempts is the number of tries for each delivery
+const webhookAttempts = 3
+
+// webhookEventTypes are the event types a webhook can select
+var webhookEventTypes = []string{
+	EventInstanceStarted, EventInstanceFailed, EventInstanceExited, EventInstanceUnhealthy,
+	EventScaleUp, EventScaleDown, EventBuildFailed, EventBuildSucceeded, EventTestsPassed, EventTestsFailed,
+	EventWorkerReloaded, EventWorkerRestarted, EventConfigReloaded, EventWorkerAdded, EventWorkerRemoved,
+	EventCrashLoop, EventHealthFlapping, EventWorkerRolledBack, EventDeployed, EventDeployFailed,
+	EventClusterNodeUp, EventClusterNodeDown, EventInstanceAdded, EventInstanceRemoved,
+}
+
+// webhookPayload is the JSON body of a webhook in the "json" format
+type webhookPayload struct {
+	Event
+	Host string `json:"host"`
+	Mode string `json:"mode"`
+}
+
+// webhook delivers the events of one endpoint in order, in the background
+type webhook struct {
+	config WebhookConfig
+	client *http.Client
+	queue  chan Event
+}
+
+// WebhookSender posts lifecycle events to the configured endpoints, so
+// alerts can be routed without scraping the logs
+type WebhookSender struct {
+	hooks  []*webhook
+	host   string
+	mode   string
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewWebhookSender validates the webhook configuration and starts the
+// delivery of each endpoint
+func NewWebhookSender(configs []WebhookConfig, mode string) (*WebhookSender, error) {
+	host, _ := os.Hostname()
+	s := &WebhookSender{host: host, mode: mode}
+	for i, cfg := range configs {
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("webhooks[%d]: url is required", i)
+		}
+		for _, eventType := range cfg.Events {
+			if !slices.Contains(webhookEventTypes, eventType) {
+				return nil, fmt.Errorf("webhooks[%d]: unknown event type %q", i, eventType)
+			}
+		}
+		if cfg.Format != "" && cfg.Format != "json" && cfg.Format != "slack" {
+			return nil, fmt.Errorf("webhooks[%d]: format must be \"json\" or \"slack\"", i)
+		}
+		timeout := 5 * time.Second
+		if cfg.TimeoutSeconds > 0 {
+			timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+		}
+		s.hooks = append(s.hooks, &webhook{
+			config: cfg,
+			client: &http.Client{Timeout: timeout},
+			queue:  make(chan Event, 100),
+		})
+	}
+	for _, hook := range s.hooks {
+		s.wg.Add(1)
+		go s.deliver(hook)
+	}
+	return s, nil
+}
+
+// Send queues an event for the endpoints that select it, without blocking
+func (s *WebhookSender) Send(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	for _, hook := range s.hooks {
+		if !hook.selects(event) {
+			continue
+		}
+		select {
+		case hook.queue <- event:
+		default:
+			log.Printf("Webhook %s is falling behind, dropped %s event", hook.config.URL, event.Type)
+		}
+	}
+}
+
+// Close delivers the queued events, giving up after a timeout
+func (s *WebhookSender) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for _, hook := range s.hooks {
+		close(hook.queue)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		log.Printf("Webhooks still delivering on shutdown, giving up")
+	}
+}
+
+// selects reports whether the endpoint wants an event
+func (h *webhook) selects(event Event) bool {
+	if len(h.config.Events) > 0 && !slices.Contains(h.config.Events, event.Type) {
+		return false
+	}
+	if len(h.config.Workers) > 0 && !slices.Contains(h.config.Workers, event.Worker) {
+		return false
+	}
+	return true
+}
+
+// deliver posts the events of an endpoint until its queue is closed
+func (s *WebhookSender) deliver(hook *webhook) {
+	defer s.wg.Done()
+	for event := range hook.queue {
+		body, err := s.body(hook, event)
+		if err != nil {
+			log.Printf("Webhook %s: %v", hook.config.URL, err)
+			continue
+		}
+		for attempt := 1; ; attempt++ {
+			err = hook.post(body)
+			if err == nil || attempt == webhookAttempts {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err != nil {
+			log.Printf("Webhook %s failed for %s event: %v", hook.config.URL, event.Type, err)
+		}
+	}
+}
+
+// body encodes an event in the format of the endpoint
+func (s *WebhookSender) body(hook *webhook, event Event) ([]byte, error) {
+	if hook.config.Format == "slack" {
+		text := fmt.Sprintf("[%s] %s", s.host, event.Type)
+		if event.Worker != "" {
+			text += " " + event.Worker
+		}
+		if event.Message != "" {
+			text += ": " + event.Message
+		}
+		return json.Marshal(map[string]string{"text": text})
+	}
+	return json.Marshal(webhookPayload{Event: event, Host: s.host, Mode: s.mode})
+}
+
+// post sends a body once, responses other than 2xx are failures
+func (h *webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "TQServer-Webhook")
+	for name, value := range h.config.Headers {
+		req.Header.Set(name, value)
+	}
+	if h.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.config.Secret))
+		mac.Write(body)
+		req.Header.Set("X-TQServer-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -83,13 +83,6 @@ app.get('/', (req, res) => {
         html = html.replace(/{{\s*URI\s*}}/g, req.url);
         html = html.replace(/{{\s*Time\s*}}/g, new Date().toLocaleString());
 
-        // Always inject dev reload script for now as requested by user context (dev environment)
-        if (process.env.WORKER_MODE === 'dev') {
-            html = html.replace(/{{\s*DevReload\s*}}/g, '<script src="/dev-reload.js"></script>');
-        } else {
-            html = html.replace(/{{\s*DevReload\s*}}/g, '');
-        }
-
         res.set('Content-Type', 'text/html');
         res.send(html);
     } catch (err) {
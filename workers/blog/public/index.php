@@ -173,9 +173,6 @@ http_response_code(200);
             Powered by <strong>TQServer</strong> - Webserver with PHP support via php-fpm
         </p>
     </div>
-    <?php if (getenv('WORKER_SERVER_MODE') === 'dev'): ?>
-        <script src="/dev-reload.js"></script>
-    <?php endif; ?>
 </body>
 
 </html>
\ No newline at end of file